@@ -61,6 +61,10 @@ type UserIDExistsResponse struct {
 	UserIDExists bool `json:"exists"`
 }
 
+// ErrProfileNotExists is returned by RetrieveUserProfile when neither the
+// local database nor any application service knows about the user.
+var ErrProfileNotExists = errors.New("no known profile for given user ID")
+
 // AppServiceQueryAPI is used to query user and room alias data from application
 // services
 type AppServiceQueryAPI interface {
@@ -109,12 +113,15 @@ func RetrieveUserProfile(
 
 	// If no user exists, return
 	if !userResp.UserIDExists {
-		return nil, errors.New("no known profile for given user ID")
+		return nil, ErrProfileNotExists
 	}
 
-	// Try to query the user from the local database again
+	// Try to query the user from the local database again, since the
+	// application service should have registered the user by now
 	profile, err = accountDB.GetProfileByLocalpart(ctx, localpart)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		return nil, ErrProfileNotExists
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -59,10 +59,10 @@ func NewInternalAPI(
 	// Wrap application services in a type that relates the application service and
 	// a sync.Cond object that can be used to notify workers when there are new
 	// events to be sent out.
-	workerStates := make([]types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
+	workerStates := make([]*types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
 	for i, appservice := range base.Cfg.Derived.ApplicationServices {
 		m := sync.Mutex{}
-		ws := types.ApplicationServiceWorkerState{
+		ws := &types.ApplicationServiceWorkerState{
 			AppService: appservice,
 			Cond:       sync.NewCond(&m),
 		}
@@ -97,6 +97,19 @@ func NewInternalAPI(
 		}
 	}
 
+	// Likewise, only consume EDUs if at least one AS wants ephemeral events.
+	for _, ws := range workerStates {
+		if ws.AppService.PushEphemeral {
+			eduConsumer := consumers.NewOutputEDUConsumer(
+				base.Cfg, consumer, appserviceDB, workerStates,
+			)
+			if err := eduConsumer.Start(); err != nil {
+				logrus.WithError(err).Panicf("failed to start appservice EDU server consumer")
+			}
+			break
+		}
+	}
+
 	// Create application service transaction workers
 	if err := workers.SetupTransactionWorkers(appserviceDB, workerStates); err != nil {
 		logrus.WithError(err).Panicf("failed to start app service transaction workers")
@@ -128,5 +141,11 @@ func generateAppServiceAccount(
 		DeviceID:          &as.SenderLocalpart,
 		DeviceDisplayName: &as.SenderLocalpart,
 	}, &devRes)
-	return err
+	if err != nil {
+		return err
+	}
+	if devRes.Err != nil {
+		return devRes.Err
+	}
+	return nil
 }
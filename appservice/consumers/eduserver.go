@@ -0,0 +1,212 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputEDUConsumer consumes typing notifications, receipts and presence
+// updates from the EDU server, and queues them to be sent to application
+// services that want ephemeral events, as described in MSC2409.
+type OutputEDUConsumer struct {
+	typingConsumer   *internal.ContinualConsumer
+	receiptConsumer  *internal.ContinualConsumer
+	presenceConsumer *internal.ContinualConsumer
+	typingCache      *cache.EDUCache
+	workerStates     []*types.ApplicationServiceWorkerState
+}
+
+// presenceContent is the content of an m.presence ephemeral event.
+type presenceContent struct {
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool    `json:"currently_active"`
+}
+
+// NewOutputEDUConsumer creates a new OutputEDUConsumer. Call Start() to begin
+// consuming from the EDU server.
+func NewOutputEDUConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	appserviceDB storage.Database,
+	workerStates []*types.ApplicationServiceWorkerState,
+) *OutputEDUConsumer {
+	s := &OutputEDUConsumer{
+		typingConsumer: &internal.ContinualConsumer{
+			ComponentName:  "appservice/eduserver/typing",
+			Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputTypingEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: appserviceDB,
+		},
+		receiptConsumer: &internal.ContinualConsumer{
+			ComponentName:  "appservice/eduserver/receipt",
+			Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputReceiptEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: appserviceDB,
+		},
+		presenceConsumer: &internal.ContinualConsumer{
+			ComponentName:  "appservice/eduserver/presence",
+			Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: appserviceDB,
+		},
+		typingCache:  cache.New(),
+		workerStates: workerStates,
+	}
+	s.typingConsumer.ProcessMessage = s.onTypingMessage
+	s.receiptConsumer.ProcessMessage = s.onReceiptMessage
+	s.presenceConsumer.ProcessMessage = s.onPresenceMessage
+
+	// Application services need to hear about users who stop typing because
+	// their typing notification timed out, as well as those who stop typing
+	// explicitly.
+	s.typingCache.SetTimeoutCallback(func(userID, roomID string, _ int64) {
+		s.queueTyping(userID, roomID)
+	})
+
+	return s
+}
+
+// Start consuming from the EDU server
+func (s *OutputEDUConsumer) Start() error {
+	if err := s.typingConsumer.Start(); err != nil {
+		return err
+	}
+	if err := s.receiptConsumer.Start(); err != nil {
+		return err
+	}
+	return s.presenceConsumer.Start()
+}
+
+func (s *OutputEDUConsumer) onTypingMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputTypingEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	if output.Event.Typing {
+		s.typingCache.AddTypingUser(output.Event.UserID, output.Event.RoomID, output.ExpireTime)
+	} else {
+		s.typingCache.RemoveUser(output.Event.UserID, output.Event.RoomID)
+	}
+	s.queueTyping(output.Event.UserID, output.Event.RoomID)
+	return nil
+}
+
+// queueTyping queues an m.typing event containing everyone who is currently
+// typing in the room, since that is what typing notifications contain.
+func (s *OutputEDUConsumer) queueTyping(userID, roomID string) {
+	userIDs := s.typingCache.GetTypingUsers(roomID)
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	content, err := json.Marshal(map[string][]string{"user_ids": userIDs})
+	if err != nil {
+		log.WithError(err).Errorf("failed to marshal typing content")
+		return
+	}
+	s.queueEphemeralEvent(userID, roomID, types.EphemeralEvent{
+		Type:    "m.typing",
+		RoomID:  roomID,
+		Content: content,
+	})
+}
+
+func (s *OutputEDUConsumer) onReceiptMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+	// Private read receipts are only for the user who sent them.
+	if output.Type == api.ReceiptTypeReadPrivate {
+		return nil
+	}
+
+	content, err := json.Marshal(map[string]api.ReceiptMRead{
+		output.EventID: {
+			User: map[string]api.ReceiptTS{
+				output.UserID: {TS: output.Timestamp},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	s.queueEphemeralEvent(output.UserID, output.RoomID, types.EphemeralEvent{
+		Type:    "m.receipt",
+		RoomID:  output.RoomID,
+		Content: content,
+	})
+	return nil
+}
+
+func (s *OutputEDUConsumer) onPresenceMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	presence := presenceContent{
+		Presence:        output.Presence,
+		StatusMsg:       output.StatusMsg,
+		CurrentlyActive: output.Presence == api.PresenceOnline,
+	}
+	if output.LastActiveTS > 0 {
+		presence.LastActiveAgo = time.Since(output.LastActiveTS.Time()).Milliseconds()
+	}
+	content, err := json.Marshal(presence)
+	if err != nil {
+		return err
+	}
+	s.queueEphemeralEvent(output.UserID, "", types.EphemeralEvent{
+		Type:    api.MPresence,
+		Sender:  output.UserID,
+		Content: content,
+	})
+	return nil
+}
+
+// queueEphemeralEvent queues an ephemeral event for every application service
+// that wants ephemeral events and has a namespace covering either the user or
+// the room that the event is about.
+func (s *OutputEDUConsumer) queueEphemeralEvent(userID, roomID string, ev types.EphemeralEvent) {
+	for _, ws := range s.workerStates {
+		if !ws.AppService.PushEphemeral || ws.AppService.URL == "" {
+			continue
+		}
+		if ws.AppService.IsInterestedInUserID(userID) ||
+			(roomID != "" && ws.AppService.IsInterestedInRoomID(roomID)) {
+			ws.QueueEphemeralEvent(ev)
+		}
+	}
+}
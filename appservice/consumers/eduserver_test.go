@@ -0,0 +1,144 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/appservice/workers"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+type ephemeralTransaction struct {
+	Events    []json.RawMessage      `json:"events"`
+	Ephemeral []types.EphemeralEvent `json:"de.sorunome.msc2409.ephemeral"`
+}
+
+func mustReceiptMessage(t *testing.T, userID, eventID string) *sarama.ConsumerMessage {
+	t.Helper()
+	value, err := json.Marshal(api.OutputReceiptEvent{
+		UserID:    userID,
+		RoomID:    "!room:localhost",
+		EventID:   eventID,
+		Type:      "m.read",
+		Timestamp: 1234,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal receipt: %s", err)
+	}
+	return &sarama.ConsumerMessage{Value: value}
+}
+
+func TestReceiptsSentToInterestedAppServices(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "appservice")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(tmpfile.Name()) // nolint: errcheck
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		t.Fatalf("failed to create appservice database: %s", err)
+	}
+
+	received := make(chan ephemeralTransaction, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var txn ephemeralTransaction
+		if decodeErr := json.NewDecoder(req.Body).Decode(&txn); decodeErr != nil {
+			t.Errorf("failed to decode transaction: %s", decodeErr)
+		}
+		_, _ = w.Write([]byte("{}"))
+		received <- txn
+	}))
+	defer srv.Close()
+
+	newWorkerState := func(id string, pushEphemeral bool) *types.ApplicationServiceWorkerState {
+		return &types.ApplicationServiceWorkerState{
+			AppService: config.ApplicationService{
+				ID:            id,
+				URL:           srv.URL,
+				PushEphemeral: pushEphemeral,
+				NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+					config.NamespaceUsers: {{
+						Exclusive:    true,
+						Regex:        "@" + id + "_.*:localhost",
+						RegexpObject: regexp.MustCompile("@" + id + "_.*:localhost"),
+					}},
+				},
+			},
+			Cond: sync.NewCond(&sync.Mutex{}),
+		}
+	}
+	irc := newWorkerState("irc", true)
+	// The slack appservice has its own users, but doesn't want ephemeral events
+	slack := newWorkerState("slack", false)
+	workerStates := []*types.ApplicationServiceWorkerState{irc, slack}
+	s := NewOutputEDUConsumer(&config.Dendrite{}, nil, db, workerStates)
+
+	for _, msg := range []*sarama.ConsumerMessage{
+		mustReceiptMessage(t, "@irc_alice:localhost", "$irc_event"),
+		mustReceiptMessage(t, "@bob:localhost", "$unrelated_event"),
+		mustReceiptMessage(t, "@slack_charlie:localhost", "$slack_event"),
+	} {
+		if err = s.onReceiptMessage(msg); err != nil {
+			t.Fatalf("failed to process receipt: %s", err)
+		}
+	}
+	if slack.HasEphemeralEvents() {
+		t.Fatalf("expected no ephemeral events to be queued for an appservice that didn't opt in")
+	}
+
+	if err = workers.SetupTransactionWorkers(db, workerStates); err != nil {
+		t.Fatalf("failed to set up transaction workers: %s", err)
+	}
+
+	var txn ephemeralTransaction
+	select {
+	case txn = <-received:
+	case <-time.After(time.Second * 10):
+		t.Fatalf("timed out waiting for transaction")
+	}
+	if len(txn.Events) != 0 {
+		t.Errorf("expected no room events in the transaction, got %d", len(txn.Events))
+	}
+	if len(txn.Ephemeral) != 1 {
+		t.Fatalf("expected one ephemeral event in the transaction, got %d", len(txn.Ephemeral))
+	}
+	ev := txn.Ephemeral[0]
+	if ev.Type != "m.receipt" || ev.RoomID != "!room:localhost" {
+		t.Errorf("got ephemeral event of type %q in room %q", ev.Type, ev.RoomID)
+	}
+	var content map[string]api.ReceiptMRead
+	if err = json.Unmarshal(ev.Content, &content); err != nil {
+		t.Fatalf("failed to unmarshal receipt content: %s", err)
+	}
+	if _, ok := content["$irc_event"].User["@irc_alice:localhost"]; !ok || len(content) != 1 {
+		t.Errorf("expected only the receipt from @irc_alice:localhost, got %s", string(ev.Content))
+	}
+}
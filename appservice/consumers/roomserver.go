@@ -35,7 +35,7 @@ type OutputRoomEventConsumer struct {
 	asDB               storage.Database
 	rsAPI              api.RoomserverInternalAPI
 	serverName         string
-	workerStates       []types.ApplicationServiceWorkerState
+	workerStates       []*types.ApplicationServiceWorkerState
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call
@@ -45,7 +45,7 @@ func NewOutputRoomEventConsumer(
 	kafkaConsumer sarama.Consumer,
 	appserviceDB storage.Database,
 	rsAPI api.RoomserverInternalAPI,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates []*types.ApplicationServiceWorkerState,
 ) *OutputRoomEventConsumer {
 	consumer := internal.ContinualConsumer{
 		ComponentName:  "appservice/roomserver",
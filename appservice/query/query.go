@@ -52,51 +52,18 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 		a.HTTPClient = makeHTTPClient()
 	}
 
-	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
-		if appservice.URL != "" && appservice.IsInterestedInRoomAlias(request.Alias) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + roomAliasExistsPath)
-			URL.Path += request.Alias
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
-			// Send a request to each application service. If one responds that it has
-			// created the room, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			req = req.WithContext(ctx)
-
-			resp, err := a.HTTPClient.Do(req)
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).WithError(err).Error("Unable to close application service response body")
-					}
-				}()
-			}
+	// Determine which application service should handle this request. If one
+	// responds that it has created the room, immediately return.
+	for _, appservice := range appservicesForNamespace(a.Cfg.Derived.ApplicationServices, config.NamespaceAliases, request.Alias) {
+		if appservice.URL != "" {
+			exists, err := a.queryAppService(ctx, appservice, roomAliasExistsPath, request.Alias)
 			if err != nil {
 				log.WithError(err).Errorf("Issue querying room alias on application service %s", appservice.ID)
 				return err
 			}
-			switch resp.StatusCode {
-			case http.StatusOK:
-				// OK received from appservice. Room exists
+			if exists {
 				response.AliasExists = true
 				return nil
-			case http.StatusNotFound:
-				// Room does not exist
-			default:
-				// Application service reported an error. Warn
-				log.WithFields(log.Fields{
-					"appservice_id": appservice.ID,
-					"status_code":   resp.StatusCode,
-				}).Warn("Application service responded with non-OK status code")
 			}
 		}
 	}
@@ -120,54 +87,93 @@ func (a *AppServiceQueryAPI) UserIDExists(
 		a.HTTPClient = makeHTTPClient()
 	}
 
-	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
-		if appservice.URL != "" && appservice.IsInterestedInUserID(request.UserID) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + userIDExistsPath)
-			URL.Path += request.UserID
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
-			// Send a request to each application service. If one responds that it has
-			// created the user, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			resp, err := a.HTTPClient.Do(req.WithContext(ctx))
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).Error("Unable to close application service response body")
-					}
-				}()
-			}
+	// Determine which application service should handle this request. If one
+	// responds that it has created the user, immediately return.
+	for _, appservice := range appservicesForNamespace(a.Cfg.Derived.ApplicationServices, config.NamespaceUsers, request.UserID) {
+		if appservice.URL != "" {
+			exists, err := a.queryAppService(ctx, appservice, userIDExistsPath, request.UserID)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"appservice_id": appservice.ID,
 				}).WithError(err).Error("issue querying user ID on application service")
 				return err
 			}
-			if resp.StatusCode == http.StatusOK {
-				// StatusOK received from appservice. User ID exists
+			if exists {
 				response.UserIDExists = true
 				return nil
 			}
+		}
+	}
+
+	response.UserIDExists = false
+	return nil
+}
 
-			// Log non OK
+// queryAppService asks an application service whether the given user ID or
+// room alias exists, by making a request to the application service at the
+// given path. The application service is expected to create the user or room
+// before responding with a 200 OK, and to respond with a 404 otherwise.
+// https://matrix.org/docs/spec/application_service/r0.1.2#querying
+func (a *AppServiceQueryAPI) queryAppService(
+	ctx context.Context, appservice config.ApplicationService, path, value string,
+) (exists bool, err error) {
+	URL, err := url.Parse(appservice.URL + path)
+	if err != nil {
+		return false, err
+	}
+	URL.Path += value
+	URL.RawQuery = url.Values{"access_token": []string{appservice.HSToken}}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, URL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := a.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
 			log.WithFields(log.Fields{
 				"appservice_id": appservice.ID,
 				"status_code":   resp.StatusCode,
-			}).Warn("application service responded with non-OK status code")
+			}).WithError(closeErr).Error("Unable to close application service response body")
 		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		// Application service reported an error. Warn
+		log.WithFields(log.Fields{
+			"appservice_id": appservice.ID,
+			"status_code":   resp.StatusCode,
+		}).Warn("Application service responded with non-OK status code")
+		return false, nil
 	}
+}
 
-	response.UserIDExists = false
-	return nil
+// appservicesForNamespace returns the application services that should be
+// asked about the given user ID or room alias. An application service with
+// an exclusive namespace covering the value owns it, so is the only one
+// returned. Otherwise every application service interested in it is.
+func appservicesForNamespace(
+	appservices []config.ApplicationService, kind, value string,
+) []config.ApplicationService {
+	var interested []config.ApplicationService
+	for _, appservice := range appservices {
+		matches, exclusive := appservice.MatchNamespace(kind, value)
+		if exclusive {
+			return []config.ApplicationService{appservice}
+		}
+		if matches {
+			interested = append(interested, appservice)
+		}
+	}
+	return interested
 }
 
 // makeHTTPClient creates an HTTP client with certain options that will be used for all query requests to application services
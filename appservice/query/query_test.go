@@ -0,0 +1,153 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+func testAppService(id, usersRegex string, exclusive bool) config.ApplicationService {
+	return config.ApplicationService{
+		ID: id,
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			config.NamespaceUsers: {{
+				Exclusive:    exclusive,
+				Regex:        usersRegex,
+				RegexpObject: regexp.MustCompile(usersRegex),
+			}},
+		},
+	}
+}
+
+func TestAppservicesForNamespace(t *testing.T) {
+	appservices := []config.ApplicationService{
+		testAppService("everyone", "@.*:localhost", false),
+		testAppService("irc", "@irc_.*:localhost", true),
+		testAppService("slack", "@slack_.*:localhost", false),
+	}
+	testCases := []struct {
+		userID string
+		want   []string
+	}{
+		// the irc appservice exclusively owns its users, so nobody else is asked
+		{"@irc_alice:localhost", []string{"irc"}},
+		{"@slack_alice:localhost", []string{"everyone", "slack"}},
+		{"@alice:localhost", []string{"everyone"}},
+		{"@alice:remote", nil},
+	}
+	for _, tc := range testCases {
+		got := appservicesForNamespace(appservices, config.NamespaceUsers, tc.userID)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %d application services, want %v", tc.userID, len(got), tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i].ID != tc.want[i] {
+				t.Errorf("%s: got application service %q, want %q", tc.userID, got[i].ID, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestQueryAppServiceCreatesEntities(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+
+	// The application service lazily creates users and rooms in its
+	// namespace when asked about them.
+	var queried []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queried = append(queried, req.URL.Path)
+		if req.URL.Query().Get("access_token") != "hs_token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/users/@irc_alice:localhost":
+			if _, createErr := accountDB.CreateAccount(req.Context(), "irc_alice", "", "irc", userapi.AccountTypeUser); createErr != nil {
+				t.Errorf("failed to create account: %s", createErr)
+			}
+		case "/rooms/#irc_room:localhost":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	appservice := testAppService("irc", "@irc_.*:localhost", true)
+	appservice.URL = srv.URL
+	appservice.HSToken = "hs_token"
+	appservice.NamespaceMap[config.NamespaceAliases] = []config.ApplicationServiceNamespace{{
+		Exclusive:    true,
+		Regex:        "#irc_.*:localhost",
+		RegexpObject: regexp.MustCompile("#irc_.*:localhost"),
+	}}
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{appservice}
+	queryAPI := &AppServiceQueryAPI{Cfg: cfg}
+
+	// A user in the namespace is created by the application service, so
+	// their profile can then be retrieved.
+	profile, err := api.RetrieveUserProfile(ctx, "@irc_alice:localhost", queryAPI, accountDB)
+	if err != nil {
+		t.Fatalf("failed to retrieve user profile: %s", err)
+	}
+	if profile.Localpart != "irc_alice" {
+		t.Errorf("got profile for %q, want irc_alice", profile.Localpart)
+	}
+
+	// A user the application service doesn't know about still doesn't exist.
+	if _, err = api.RetrieveUserProfile(ctx, "@irc_bob:localhost", queryAPI, accountDB); err != api.ErrProfileNotExists {
+		t.Errorf("got error %v, want %v", err, api.ErrProfileNotExists)
+	}
+
+	// Users outside the namespace never reach the application service.
+	var userRes api.UserIDExistsResponse
+	if err = queryAPI.UserIDExists(ctx, &api.UserIDExistsRequest{UserID: "@alice:localhost"}, &userRes); err != nil {
+		t.Fatalf("failed to query user ID: %s", err)
+	}
+	if userRes.UserIDExists {
+		t.Errorf("expected user outside of the namespace not to exist")
+	}
+
+	var aliasRes api.RoomAliasExistsResponse
+	if err = queryAPI.RoomAliasExists(ctx, &api.RoomAliasExistsRequest{Alias: "#irc_room:localhost"}, &aliasRes); err != nil {
+		t.Fatalf("failed to query room alias: %s", err)
+	}
+	if !aliasRes.AliasExists {
+		t.Errorf("expected room alias in the namespace to exist")
+	}
+
+	want := []string{"/users/@irc_alice:localhost", "/users/@irc_bob:localhost", "/rooms/#irc_room:localhost"}
+	if strings.Join(queried, ",") != strings.Join(want, ",") {
+		t.Errorf("application service got queries %v, want %v", queried, want)
+	}
+}
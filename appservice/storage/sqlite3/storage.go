@@ -42,7 +42,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*Database, error) {
 	if result.db, err = sqlutil.Open(dbProperties); err != nil {
 		return nil, err
 	}
-	result.writer = sqlutil.NewExclusiveWriter()
+	result.writer = sqlutil.ExclusiveWriterForDatabase(dbProperties)
 	if err = result.prepare(); err != nil {
 		return nil, err
 	}
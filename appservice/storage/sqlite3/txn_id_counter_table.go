@@ -31,15 +31,17 @@ CREATE TABLE IF NOT EXISTS appservice_counters (
 INSERT OR IGNORE INTO appservice_counters (name, last_id) VALUES('txn_id', 1);
 `
 
-const selectTxnIDSQL = `
-  SELECT last_id FROM appservice_counters WHERE name='txn_id';
-  UPDATE appservice_counters SET last_id=last_id+1 WHERE name='txn_id';
-`
+const selectTxnIDSQL = "" +
+	"SELECT last_id FROM appservice_counters WHERE name='txn_id'"
+
+const incrementTxnIDSQL = "" +
+	"UPDATE appservice_counters SET last_id=last_id+1 WHERE name='txn_id'"
 
 type txnStatements struct {
-	db              *sql.DB
-	writer          sqlutil.Writer
-	selectTxnIDStmt *sql.Stmt
+	db                 *sql.DB
+	writer             sqlutil.Writer
+	selectTxnIDStmt    *sql.Stmt
+	incrementTxnIDStmt *sql.Stmt
 }
 
 func (s *txnStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -53,6 +55,9 @@ func (s *txnStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
 	if s.selectTxnIDStmt, err = db.Prepare(selectTxnIDSQL); err != nil {
 		return
 	}
+	if s.incrementTxnIDStmt, err = db.Prepare(incrementTxnIDSQL); err != nil {
+		return
+	}
 
 	return
 }
@@ -62,8 +67,11 @@ func (s *txnStatements) selectTxnID(
 	ctx context.Context,
 ) (txnID int, err error) {
 	err = s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
-		err := s.selectTxnIDStmt.QueryRowContext(ctx).Scan(&txnID)
-		return err
+		if selectErr := sqlutil.TxStmt(txn, s.selectTxnIDStmt).QueryRowContext(ctx).Scan(&txnID); selectErr != nil {
+			return selectErr
+		}
+		_, updateErr := sqlutil.TxStmt(txn, s.incrementTxnIDStmt).ExecContext(ctx)
+		return updateErr
 	})
 	return
 }
@@ -13,6 +13,7 @@
 package types
 
 import (
+	"encoding/json"
 	"sync"
 
 	"github.com/matrix-org/dendrite/setup/config"
@@ -21,8 +22,21 @@ import (
 const (
 	// AppServiceDeviceID is the AS dummy device ID
 	AppServiceDeviceID = "AS_Device"
+	// MaxQueuedEphemeralEvents is the number of ephemeral events that will be
+	// queued for an application service before the oldest are dropped.
+	MaxQueuedEphemeralEvents = 1000
 )
 
+// EphemeralEvent is an EDU, such as a typing notification, receipt or
+// presence update, that is sent to application services which have opted in
+// to receiving them as described in MSC2409.
+type EphemeralEvent struct {
+	Type    string          `json:"type"`
+	RoomID  string          `json:"room_id,omitempty"`
+	Sender  string          `json:"sender,omitempty"`
+	Content json.RawMessage `json:"content"`
+}
+
 // ApplicationServiceWorkerState is a type that couples an application service,
 // a lockable condition as well as some other state variables, allowing the
 // roomserver to notify appservice workers when there are events ready to send
@@ -34,6 +48,9 @@ type ApplicationServiceWorkerState struct {
 	EventsReady bool
 	// Backoff exponent (2^x secs). Max 6, aka 64s.
 	Backoff int
+	// Ephemeral events ready to be sent. These aren't persisted, since they
+	// are of no use to the application service once they are stale.
+	EphemeralEvents []EphemeralEvent
 }
 
 // NotifyNewEvents wakes up all waiting goroutines, notifying that events remain
@@ -45,20 +62,46 @@ func (a *ApplicationServiceWorkerState) NotifyNewEvents() {
 	a.Cond.L.Unlock()
 }
 
-// FinishEventProcessing marks all events of this worker as being sent to the
-// application service.
-func (a *ApplicationServiceWorkerState) FinishEventProcessing() {
+// QueueEphemeralEvent adds an ephemeral event to the queue for this application
+// service worker and wakes it up.
+func (a *ApplicationServiceWorkerState) QueueEphemeralEvent(ev EphemeralEvent) {
 	a.Cond.L.Lock()
-	a.EventsReady = false
+	a.EphemeralEvents = append(a.EphemeralEvents, ev)
+	if over := len(a.EphemeralEvents) - MaxQueuedEphemeralEvents; over > 0 {
+		a.EphemeralEvents = a.EphemeralEvents[over:]
+	}
+	a.EventsReady = true
+	a.Cond.Broadcast()
 	a.Cond.L.Unlock()
 }
 
+// TakeEphemeralEvents removes all of the queued ephemeral events for this
+// application service worker and returns them.
+func (a *ApplicationServiceWorkerState) TakeEphemeralEvents() []EphemeralEvent {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	events := a.EphemeralEvents
+	a.EphemeralEvents = nil
+	return events
+}
+
+// HasEphemeralEvents returns true if there are ephemeral events queued for
+// this application service worker.
+func (a *ApplicationServiceWorkerState) HasEphemeralEvents() bool {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	return len(a.EphemeralEvents) > 0
+}
+
 // WaitForNewEvents causes the calling goroutine to wait on the worker state's
 // condition for a broadcast or similar wakeup, if there are no events ready.
+// The events are then considered to be taken by the caller, so any events
+// that arrive afterwards will wake the caller up again.
 func (a *ApplicationServiceWorkerState) WaitForNewEvents() {
 	a.Cond.L.Lock()
-	if !a.EventsReady {
+	for !a.EventsReady {
 		a.Cond.Wait()
 	}
+	a.EventsReady = false
 	a.Cond.L.Unlock()
 }
@@ -45,7 +45,7 @@ var (
 // handles exponentially backing off in case the AS isn't currently available.
 func SetupTransactionWorkers(
 	appserviceDB storage.Database,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates []*types.ApplicationServiceWorkerState,
 ) error {
 	// Create a worker that handles transmitting events to a single homeserver
 	for _, workerState := range workerStates {
@@ -59,7 +59,7 @@ func SetupTransactionWorkers(
 
 // worker is a goroutine that sends any queued events to the application service
 // it is given.
-func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
+func worker(db storage.Database, ws *types.ApplicationServiceWorkerState) {
 	log.WithFields(log.Fields{
 		"appservice": ws.AppService.ID,
 	}).Info("starting application service")
@@ -82,19 +82,46 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 		ws.NotifyNewEvents()
 	}
 
+	// Ephemeral events aren't persisted, so a transaction of them that failed
+	// to send is held on to here in order to retry it with the same ID
+	var ephemeral *ephemeralTransaction
+
 	// Loop forever and keep waiting for more events to send
 	for {
 		// Wait for more events if we've sent all the events in the database
 		ws.WaitForNewEvents()
 
-		// Batch events up into a transaction
-		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
-			}).WithError(err).Fatal("appservice worker unable to create transaction")
+		// Batch events up into a transaction, unless there is an ephemeral
+		// transaction that needs to be retried first
+		var transactionJSON []byte
+		var txnID, maxEventID int
+		var eventsRemaining bool
+		if ephemeral == nil {
+			transactionJSON, txnID, maxEventID, eventsRemaining, err = createTransaction(ctx, db, ws.AppService.ID)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"appservice": ws.AppService.ID,
+				}).WithError(err).Fatal("appservice worker unable to create transaction")
 
-			return
+				return
+			}
+		}
+		if transactionJSON == nil {
+			// There are no room events waiting, so send any ephemeral events
+			if ephemeral == nil {
+				ephemeral, err = createEphemeralTransaction(ctx, db, ws)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"appservice": ws.AppService.ID,
+					}).WithError(err).Fatal("appservice worker unable to create ephemeral transaction")
+
+					return
+				}
+			}
+			if ephemeral == nil {
+				continue
+			}
+			transactionJSON, txnID = ephemeral.transactionJSON, ephemeral.txnID
 		}
 
 		// Send the events off to the application service
@@ -104,18 +131,22 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
 			}).WithError(err).Error("unable to send event")
-			// Backoff
-			backoff(&ws, err)
+			// Backoff and then retry the same transaction, which will be
+			// picked up again with the same transaction ID
+			backoff(ws, err)
+			ws.NotifyNewEvents()
 			continue
 		}
 
 		// We sent successfully, hooray!
 		ws.Backoff = 0
 
-		// Transactions have a maximum event size, so there may still be some events
-		// left over to send. Keep sending until none are left
-		if !eventsRemaining {
-			ws.FinishEventProcessing()
+		if ephemeral != nil {
+			// Room events may have arrived while we were sending the ephemeral
+			// events, so check for them again
+			ephemeral = nil
+			ws.NotifyNewEvents()
+			continue
 		}
 
 		// Remove sent events from the DB
@@ -126,6 +157,13 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 			}).WithError(err).Fatal("unable to remove appservice events from the database")
 			return
 		}
+
+		// Transactions have a maximum event size, so there may still be some events
+		// left over to send. Keep sending until none are left, including any
+		// ephemeral events that were queued in the meantime
+		if eventsRemaining || ws.HasEphemeralEvents() {
+			ws.NotifyNewEvents()
+		}
 	}
 }
 
@@ -171,6 +209,11 @@ func createTransaction(
 		return
 	}
 
+	// There is nothing to send, so don't use up a transaction ID
+	if len(events) == 0 {
+		return
+	}
+
 	// Check if these events do not already have a transaction ID
 	if txnID == -1 {
 		// If not, grab next available ID from the DB
@@ -203,6 +246,54 @@ func createTransaction(
 	return
 }
 
+// transaction is an application service transaction, along with the
+// ephemeral events from MSC2409.
+type transaction struct {
+	gomatrixserverlib.ApplicationServiceTransaction
+	Ephemeral []types.EphemeralEvent `json:"de.sorunome.msc2409.ephemeral,omitempty"`
+}
+
+// ephemeralTransaction is a JSON-encoded transaction containing only
+// ephemeral events, along with its transaction ID.
+type ephemeralTransaction struct {
+	transactionJSON []byte
+	txnID           int
+}
+
+// createEphemeralTransaction takes all of the ephemeral events queued for an
+// application service and JSON-encodes them in a new transaction. Returns nil
+// if there are no ephemeral events to send.
+func createEphemeralTransaction(
+	ctx context.Context,
+	db storage.Database,
+	ws *types.ApplicationServiceWorkerState,
+) (*ephemeralTransaction, error) {
+	events := ws.TakeEphemeralEvents()
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	txnID, err := db.GetLatestTxnID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	transactionJSON, err := json.Marshal(transaction{
+		ApplicationServiceTransaction: gomatrixserverlib.ApplicationServiceTransaction{
+			Events: []gomatrixserverlib.ClientEvent{},
+		},
+		Ephemeral: events,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ephemeralTransaction{
+		transactionJSON: transactionJSON,
+		txnID:           txnID,
+	}, nil
+}
+
 // send sends events to an application service. Returns an error if an OK was not
 // received back from the application service or the request timed out.
 func send(
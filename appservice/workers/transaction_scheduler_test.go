@@ -0,0 +1,167 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type receivedTransaction struct {
+	txnID    string
+	eventIDs []string
+	status   int
+}
+
+func mustCreateEvent(t *testing.T, body string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	b := &gomatrixserverlib.EventBuilder{
+		RoomID:  "!room:localhost",
+		Sender:  "@irc_alice:localhost",
+		Type:    "m.room.message",
+		Content: []byte(fmt.Sprintf(`{"body":%q}`, body)),
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := b.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV4)
+}
+
+func TestTransactionDelivery(t *testing.T) {
+	ctx := context.Background()
+	tmpfile, err := ioutil.TempFile("", "appservice")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(tmpfile.Name()) // nolint: errcheck
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		t.Fatalf("failed to create appservice database: %s", err)
+	}
+
+	// The application service fails the first transaction it sees, so that
+	// the worker has to retry it.
+	var mu sync.Mutex
+	failed := false
+	received := make(chan receivedTransaction, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var txn gomatrixserverlib.ApplicationServiceTransaction
+		if decodeErr := json.NewDecoder(req.Body).Decode(&txn); decodeErr != nil {
+			t.Errorf("failed to decode transaction: %s", decodeErr)
+		}
+		rt := receivedTransaction{
+			txnID:  strings.TrimPrefix(req.URL.Path, "/transactions/"),
+			status: http.StatusOK,
+		}
+		for _, ev := range txn.Events {
+			rt.eventIDs = append(rt.eventIDs, ev.EventID)
+		}
+		mu.Lock()
+		if !failed {
+			failed = true
+			rt.status = http.StatusInternalServerError
+		}
+		mu.Unlock()
+		w.WriteHeader(rt.status)
+		_, _ = w.Write([]byte("{}"))
+		received <- rt
+	}))
+	defer srv.Close()
+
+	ws := &types.ApplicationServiceWorkerState{
+		AppService: config.ApplicationService{
+			ID:  "irc",
+			URL: srv.URL,
+		},
+		Cond: sync.NewCond(&sync.Mutex{}),
+	}
+	storeEvents := func(events ...*gomatrixserverlib.HeaderedEvent) (eventIDs []string) {
+		for _, ev := range events {
+			if err = db.StoreEvent(ctx, ws.AppService.ID, ev); err != nil {
+				t.Fatalf("failed to store event: %s", err)
+			}
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		ws.NotifyNewEvents()
+		return
+	}
+	expectTransaction := func(status int, eventIDs []string) string {
+		t.Helper()
+		select {
+		case rt := <-received:
+			if rt.status != status {
+				t.Fatalf("expected transaction to get status %d, got %d", status, rt.status)
+			}
+			if strings.Join(rt.eventIDs, ",") != strings.Join(eventIDs, ",") {
+				t.Fatalf("expected events %v in transaction, got %v", eventIDs, rt.eventIDs)
+			}
+			return rt.txnID
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timed out waiting for transaction")
+		}
+		return ""
+	}
+
+	first := storeEvents(mustCreateEvent(t, "one"), mustCreateEvent(t, "two"), mustCreateEvent(t, "three"))
+	if err = SetupTransactionWorkers(db, []*types.ApplicationServiceWorkerState{ws}); err != nil {
+		t.Fatalf("failed to set up transaction workers: %s", err)
+	}
+
+	failedTxnID := expectTransaction(http.StatusInternalServerError, first)
+	retriedTxnID := expectTransaction(http.StatusOK, first)
+	if failedTxnID != retriedTxnID {
+		t.Fatalf("expected retried transaction to reuse txn ID %s, got %s", failedTxnID, retriedTxnID)
+	}
+
+	second := storeEvents(mustCreateEvent(t, "four"), mustCreateEvent(t, "five"))
+	nextTxnID := expectTransaction(http.StatusOK, second)
+	if nextTxnID == retriedTxnID {
+		t.Fatalf("expected a new txn ID for new events, got %s again", nextTxnID)
+	}
+
+	// Wait for the worker to remove the sent events from the queue, so that
+	// it is idle before the database goes away.
+	for deadline := time.Now().Add(time.Second * 10); ; time.Sleep(time.Millisecond * 10) {
+		count, countErr := db.CountEventsWithAppServiceID(ctx, ws.AppService.ID)
+		if countErr != nil {
+			t.Fatalf("failed to count queued events: %s", countErr)
+		}
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected sent events to be removed from the queue, %d remain", count)
+		}
+	}
+}
@@ -47,7 +47,8 @@ type AccountDatabase interface {
 // VerifyUserFromRequest authenticates the HTTP request,
 // on success returns Device of the requester.
 // Finds local user or an application service user.
-// Note: For an AS user, AS dummy device is returned.
+// Note: For an AS user, AS dummy device is returned, unless the AS specified
+// one of the user's devices with the MSC3202 device_id query parameter.
 // On failure returns an JSON error response which can be sent to the client.
 func VerifyUserFromRequest(
 	req *http.Request, userAPI api.UserInternalAPI,
@@ -62,8 +63,9 @@ func VerifyUserFromRequest(
 	}
 	var res api.QueryAccessTokenResponse
 	err = userAPI.QueryAccessToken(req.Context(), &api.QueryAccessTokenRequest{
-		AccessToken:      token,
-		AppServiceUserID: req.URL.Query().Get("user_id"),
+		AccessToken:        token,
+		AppServiceUserID:   req.URL.Query().Get("user_id"),
+		AppServiceDeviceID: req.URL.Query().Get("org.matrix.msc3202.device_id"),
 	}, &res)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccessToken failed")
@@ -0,0 +1,126 @@
+package auth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/internal/caching"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type nopKeyAPI struct {
+	keyapi.KeyInternalAPI
+}
+
+func (k *nopKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+}
+
+// mustCreateCache returns an in-memory cache with the default sizes.
+func mustCreateCache(t *testing.T) *caching.Caches {
+	t.Helper()
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	return cache
+}
+
+func TestVerifyUserFromRequestAppServiceMasquerading(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	cfg := &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: "localhost",
+		},
+	}
+	appServices := []config.ApplicationService{{
+		ID:              "irc",
+		ASToken:         "as_token",
+		SenderLocalpart: "irc_bot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			config.NamespaceUsers: {{
+				Exclusive:    true,
+				Regex:        "@irc_.*:localhost",
+				RegexpObject: regexp.MustCompile("@irc_.*:localhost"),
+			}},
+		},
+	}}
+	userAPI := userapi.NewInternalAPI(accountDB, cfg, appServices, &nopKeyAPI{}, nil, mustCreateCache(t))
+
+	for _, localpart := range []string{"irc_alice", "bob"} {
+		if _, err = accountDB.CreateAccount(ctx, localpart, "", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+	}
+	deviceID := "ALICEDEVICE"
+	if err = userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   "irc_alice",
+		DeviceID:    &deviceID,
+		AccessToken: "alice_token",
+	}, &api.PerformDeviceCreationResponse{}); err != nil {
+		t.Fatalf("failed to create device: %s", err)
+	}
+
+	testCases := []struct {
+		name         string
+		query        string
+		wantCode     int
+		wantUserID   string
+		wantDeviceID string
+	}{
+		{"in namespace", "user_id=@irc_alice:localhost", http.StatusOK, "@irc_alice:localhost", types.AppServiceDeviceID},
+		{"localpart in namespace", "user_id=irc_alice", http.StatusOK, "@irc_alice:localhost", types.AppServiceDeviceID},
+		{"sender", "user_id=@irc_bot:localhost", http.StatusOK, "@irc_bot:localhost", types.AppServiceDeviceID},
+		{"with device", "user_id=@irc_alice:localhost&org.matrix.msc3202.device_id=ALICEDEVICE", http.StatusOK, "@irc_alice:localhost", deviceID},
+		{"unknown device", "user_id=@irc_alice:localhost&org.matrix.msc3202.device_id=NOTADEVICE", http.StatusForbidden, "", ""},
+		{"out of namespace", "user_id=@bob:localhost", http.StatusForbidden, "", ""},
+		{"remote user", "user_id=@irc_alice:remote", http.StatusForbidden, "", ""},
+		{"unregistered user", "user_id=@irc_charlie:localhost", http.StatusForbidden, "", ""},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/account/whoami?access_token=as_token&"+tc.query, nil)
+		device, errRes := auth.VerifyUserFromRequest(req, userAPI)
+		if errRes != nil {
+			if errRes.Code != tc.wantCode {
+				t.Errorf("%s: got HTTP %d, want %d", tc.name, errRes.Code, tc.wantCode)
+			}
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			t.Errorf("%s: got a device for %s, want HTTP %d", tc.name, device.UserID, tc.wantCode)
+			continue
+		}
+		if device.UserID != tc.wantUserID || device.ID != tc.wantDeviceID {
+			t.Errorf("%s: got device %s for %s, want device %s for %s", tc.name, device.ID, device.UserID, tc.wantDeviceID, tc.wantUserID)
+		}
+	}
+
+	// Users can't masquerade as other users, so the user_id is ignored.
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/account/whoami?access_token=alice_token&user_id=@bob:localhost", nil)
+	device, errRes := auth.VerifyUserFromRequest(req, userAPI)
+	if errRes != nil {
+		t.Fatalf("user token with user_id got HTTP %d", errRes.Code)
+	}
+	if device.UserID != "@irc_alice:localhost" {
+		t.Errorf("user token with user_id acted as %s", device.UserID)
+	}
+}
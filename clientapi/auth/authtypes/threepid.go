@@ -18,4 +18,6 @@ package authtypes
 type ThreePID struct {
 	Address string `json:"address"`
 	Medium  string `json:"medium"`
+	// The identity server that the 3PID is bound to, if any.
+	IDServer string `json:"-"`
 }
@@ -0,0 +1,72 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type LoginTokenRequest struct {
+	Login
+	Token string `json:"token"`
+}
+
+// LoginTypeToken implements https://matrix.org/docs/spec/client_server/r0.6.1#token-based
+type LoginTypeToken struct {
+	UserAPI api.UserInternalAPI
+}
+
+func (t *LoginTypeToken) Name() string {
+	return "m.login.token"
+}
+
+func (t *LoginTypeToken) Request() interface{} {
+	return &LoginTokenRequest{}
+}
+
+// Login exchanges the login token for the user it was issued to. Login tokens
+// can only be used once, so the token is no longer valid after this returns.
+func (t *LoginTypeToken) Login(ctx context.Context, req interface{}) (*Login, *util.JSONResponse) {
+	r := req.(*LoginTokenRequest)
+	if r.Token == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.BadJSON("'token' must be supplied."),
+		}
+	}
+	var res api.PerformLoginTokenConsumptionResponse
+	if err := t.UserAPI.PerformLoginTokenConsumption(ctx, &api.PerformLoginTokenConsumptionRequest{
+		Token: r.Token,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformLoginTokenConsumption failed")
+		jsonErr := jsonerror.InternalServerError()
+		return nil, &jsonErr
+	}
+	if res.UserID == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("invalid or expired login token"),
+		}
+	}
+	// The token identifies the user, so ignore any user supplied in the request.
+	r.Login.Identifier = LoginIdentifier{Type: "m.id.user", User: res.UserID}
+	r.Login.User = ""
+	return &r.Login, nil
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// fakeLoginTokenAPI hands out each of its tokens exactly once.
+type fakeLoginTokenAPI struct {
+	api.UserInternalAPI
+	tokens map[string]string // token -> user ID
+}
+
+func (a *fakeLoginTokenAPI) PerformLoginTokenConsumption(ctx context.Context, req *api.PerformLoginTokenConsumptionRequest, res *api.PerformLoginTokenConsumptionResponse) error {
+	res.UserID = a.tokens[req.Token]
+	delete(a.tokens, req.Token)
+	return nil
+}
+
+func TestLoginTypeToken(t *testing.T) {
+	tokenType := &LoginTypeToken{
+		UserAPI: &fakeLoginTokenAPI{tokens: map[string]string{
+			"valid": "@alice:example.com",
+		}},
+	}
+	login := func(body string) (*Login, int) {
+		r := tokenType.Request()
+		if err := json.Unmarshal([]byte(body), r); err != nil {
+			t.Fatalf("failed to unmarshal request: %s", err)
+		}
+		l, errRes := tokenType.Login(ctx, r)
+		if errRes != nil {
+			return nil, errRes.Code
+		}
+		return l, 200
+	}
+
+	// the token decides who logs in, not the user in the request
+	l, code := login(`{"type":"m.login.token","token":"valid","user":"@bob:example.com"}`)
+	if code != 200 {
+		t.Fatalf("login with a valid token returned HTTP %d", code)
+	}
+	if l.Username() != "@alice:example.com" {
+		t.Errorf("login with a valid token logged in as %q", l.Username())
+	}
+	// tokens are single-use
+	if _, code = login(`{"type":"m.login.token","token":"valid"}`); code != 403 {
+		t.Errorf("reusing a token returned HTTP %d, want 403", code)
+	}
+	if _, code = login(`{"type":"m.login.token","token":"unknown"}`); code != 403 {
+		t.Errorf("login with an unknown token returned HTTP %d, want 403", code)
+	}
+	if _, code = login(`{"type":"m.login.token"}`); code != 401 {
+		t.Errorf("login without a token returned HTTP %d, want 401", code)
+	}
+}
@@ -81,6 +81,18 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// InvalidParam is an error when a parameter in the request is invalid, e.g.
+// an uploaded key doesn't have the right format
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
+// InvalidSignature is an error when a signature in the request is missing or
+// doesn't verify
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -161,6 +173,22 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// WrongBackupVersionError is returned when the client uploads keys to a key
+// backup version which isn't the current one.
+type WrongBackupVersionError struct {
+	MatrixError
+	CurrentVersion string `json:"current_version"`
+}
+
+// WrongBackupVersion is an error which is returned when the client tries to
+// upload keys to an old key backup version.
+func WrongBackupVersion(currentVersion string) *WrongBackupVersionError {
+	return &WrongBackupVersionError{
+		MatrixError:    MatrixError{"M_WRONG_ROOM_KEYS_VERSION", "Wrong backup version."},
+		CurrentVersion: currentVersion,
+	}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
@@ -69,10 +69,19 @@ func GetAccountData(
 
 	return util.JSONResponse{
 		Code: http.StatusNotFound,
-		JSON: jsonerror.Forbidden("data not found"),
+		JSON: jsonerror.NotFound("data not found"),
 	}
 }
 
+// reservedAccountDataTypes are the types of the ephemeral events which sync
+// sends alongside account data. Storing account data with these types would
+// make it impossible for clients to tell the two apart.
+var reservedAccountDataTypes = map[string]bool{
+	"m.typing":   true,
+	"m.receipt":  true,
+	"m.presence": true,
+}
+
 // SaveAccountData implements PUT /user/{userId}/[rooms/{roomId}/]account_data/{type}
 func SaveAccountData(
 	req *http.Request, userAPI api.UserInternalAPI, device *api.Device,
@@ -100,6 +109,12 @@ func SaveAccountData(
 			JSON: jsonerror.Forbidden("Unable to set read marker"),
 		}
 	}
+	if reservedAccountDataTypes[dataType] {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("Cannot set %s through this API", dataType)),
+		}
+	}
 
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -139,8 +154,9 @@ func SaveAccountData(
 }
 
 type readMarkerJSON struct {
-	FullyRead string `json:"m.fully_read"`
-	Read      string `json:"m.read"`
+	FullyRead   string `json:"m.fully_read"`
+	Read        string `json:"m.read"`
+	ReadPrivate string `json:"m.read.private"`
 }
 
 type fullyReadEvent struct {
@@ -165,38 +181,41 @@ func SaveReadMarker(
 		return *resErr
 	}
 
-	if r.FullyRead == "" {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("Missing m.fully_read mandatory field"),
+	if r.FullyRead != "" {
+		data, err := json.Marshal(fullyReadEvent{EventID: r.FullyRead})
+		if err != nil {
+			return jsonerror.InternalServerError()
 		}
-	}
 
-	data, err := json.Marshal(fullyReadEvent{EventID: r.FullyRead})
-	if err != nil {
-		return jsonerror.InternalServerError()
-	}
-
-	dataReq := api.InputAccountDataRequest{
-		UserID:      device.UserID,
-		DataType:    "m.fully_read",
-		RoomID:      roomID,
-		AccountData: data,
-	}
-	dataRes := api.InputAccountDataResponse{}
-	if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
-		return util.ErrorResponse(err)
-	}
+		dataReq := api.InputAccountDataRequest{
+			UserID:      device.UserID,
+			DataType:    "m.fully_read",
+			RoomID:      roomID,
+			AccountData: data,
+		}
+		dataRes := api.InputAccountDataResponse{}
+		if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
+			return util.ErrorResponse(err)
+		}
 
-	if err := syncProducer.SendData(device.UserID, roomID, "m.fully_read"); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
-		return jsonerror.InternalServerError()
+		if err := syncProducer.SendData(device.UserID, roomID, "m.fully_read"); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+			return jsonerror.InternalServerError()
+		}
 	}
 
-	// Handle the read receipt that may be included in the read marker
-	if r.Read != "" {
-		return SetReceipt(req, eduAPI, device, roomID, "m.read", r.Read)
+	// Handle the read receipts that may be included in the read marker
+	for _, receipt := range []struct{ receiptType, eventID string }{
+		{"m.read", r.Read},
+		{"m.read.private", r.ReadPrivate},
+	} {
+		if receipt.eventID == "" {
+			continue
+		}
+		if res := SetReceipt(req, eduAPI, device, roomID, receipt.receiptType, receipt.eventID); res.Code != http.StatusOK {
+			return res
+		}
 	}
 
 	return util.JSONResponse{
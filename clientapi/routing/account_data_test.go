@@ -0,0 +1,176 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// recordingSyncProducer remembers the messages that are sent to it.
+type recordingSyncProducer struct {
+	sarama.SyncProducer
+	messages []*sarama.ProducerMessage
+}
+
+func (p *recordingSyncProducer) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	p.messages = append(p.messages, msg)
+	return 0, int64(len(p.messages)), nil
+}
+
+func TestAccountDataRoundTrip(t *testing.T) {
+	device := &api.Device{UserID: "@alice:localhost"}
+	userAPI := &fakeUserAPI{}
+	producer := &recordingSyncProducer{}
+	syncProducer := &producers.SyncAPIProducer{Topic: "account_data", Producer: producer}
+
+	for _, roomID := range []string{"", "!room:localhost"} {
+		req := httptest.NewRequest(http.MethodPut, "/account_data", strings.NewReader(`{"colour":"blue"}`))
+		res := SaveAccountData(req, userAPI, device, device.UserID, roomID, "com.example.colour", syncProducer)
+		if res.Code != http.StatusOK {
+			t.Fatalf("room %q: got HTTP %d saving account data: %+v", roomID, res.Code, res.JSON)
+		}
+
+		// The change is sent to the sync API.
+		msg := producer.messages[len(producer.messages)-1]
+		value, _ := msg.Value.Encode()
+		var output eventutil.AccountData
+		if err := json.Unmarshal(value, &output); err != nil {
+			t.Fatalf("room %q: failed to unmarshal output: %s", roomID, err)
+		}
+		if key, _ := msg.Key.Encode(); string(key) != device.UserID || output.RoomID != roomID || output.Type != "com.example.colour" {
+			t.Errorf("room %q: got output %+v for %s", roomID, output, string(key))
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/account_data", nil)
+		res = GetAccountData(req, userAPI, device, device.UserID, roomID, "com.example.colour")
+		if res.Code != http.StatusOK {
+			t.Fatalf("room %q: got HTTP %d getting account data: %+v", roomID, res.Code, res.JSON)
+		}
+		if got := string(res.JSON.(json.RawMessage)); got != `{"colour":"blue"}` {
+			t.Errorf("room %q: got account data %s", roomID, got)
+		}
+	}
+
+	// Data that was never saved in the room isn't found there, even though
+	// it exists globally.
+	req := httptest.NewRequest(http.MethodGet, "/account_data", nil)
+	if res := GetAccountData(req, userAPI, device, device.UserID, "!other:localhost", "com.example.colour"); res.Code != http.StatusNotFound {
+		t.Errorf("got HTTP %d for missing account data, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestAccountDataRejectsReservedTypes(t *testing.T) {
+	device := &api.Device{UserID: "@alice:localhost"}
+	producer := &recordingSyncProducer{}
+	syncProducer := &producers.SyncAPIProducer{Producer: producer}
+	for _, dataType := range []string{"m.fully_read", "m.typing", "m.receipt", "m.presence"} {
+		req := httptest.NewRequest(http.MethodPut, "/account_data", strings.NewReader(`{}`))
+		res := SaveAccountData(req, &fakeUserAPI{}, device, device.UserID, "!room:localhost", dataType, syncProducer)
+		if res.Code != http.StatusForbidden {
+			t.Errorf("%s: got HTTP %d, want %d", dataType, res.Code, http.StatusForbidden)
+		}
+	}
+	if len(producer.messages) > 0 {
+		t.Errorf("got %d messages sent to the sync API, want none", len(producer.messages))
+	}
+
+	// Users can only set their own account data.
+	req := httptest.NewRequest(http.MethodPut, "/account_data", strings.NewReader(`{}`))
+	if res := SaveAccountData(req, &fakeUserAPI{}, device, "@bob:localhost", "", "com.example.colour", syncProducer); res.Code != http.StatusForbidden {
+		t.Errorf("got HTTP %d setting another user's account data, want %d", res.Code, http.StatusForbidden)
+	}
+}
+
+// receiptEDUServerAPI remembers the receipts that are sent to it.
+type receiptEDUServerAPI struct {
+	eduserverAPI.EDUServerInputAPI
+	receipts []eduserverAPI.InputReceiptEvent
+}
+
+func (e *receiptEDUServerAPI) InputReceiptEvent(
+	ctx context.Context, req *eduserverAPI.InputReceiptEventRequest, res *eduserverAPI.InputReceiptEventResponse,
+) error {
+	e.receipts = append(e.receipts, req.InputReceiptEvent)
+	return nil
+}
+
+func TestSaveReadMarker(t *testing.T) {
+	device := &api.Device{UserID: "@alice:localhost"}
+	rsAPI := mustCreateRoom(t, `{}`)
+	userAPI := &fakeUserAPI{}
+	eduAPI := &receiptEDUServerAPI{}
+	producer := &recordingSyncProducer{}
+	syncProducer := &producers.SyncAPIProducer{Topic: "account_data", Producer: producer}
+
+	body := `{"m.fully_read":"$fullyread:localhost","m.read":"$read:localhost","m.read.private":"$private:localhost"}`
+	req := httptest.NewRequest(http.MethodPost, "/rooms/!room:localhost/read_markers", strings.NewReader(body))
+	if res := SaveReadMarker(req, userAPI, rsAPI, eduAPI, syncProducer, device, "!room:localhost"); res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d setting read markers: %+v", res.Code, res.JSON)
+	}
+
+	// The fully read marker is room account data, which is sent to the sync API.
+	if got := string(userAPI.roomAccountData[device.UserID]["!room:localhost"]["m.fully_read"]); got != `{"event_id":"$fullyread:localhost"}` {
+		t.Errorf("got m.fully_read account data %s", got)
+	}
+	if len(producer.messages) != 1 {
+		t.Fatalf("got %d messages sent to the sync API, want 1", len(producer.messages))
+	}
+	value, _ := producer.messages[0].Value.Encode()
+	var output eventutil.AccountData
+	if err := json.Unmarshal(value, &output); err != nil {
+		t.Fatalf("failed to unmarshal output: %s", err)
+	}
+	if output.RoomID != "!room:localhost" || output.Type != "m.fully_read" {
+		t.Errorf("got output %+v, want m.fully_read in the room", output)
+	}
+
+	// Both receipts are sent.
+	if len(eduAPI.receipts) != 2 {
+		t.Fatalf("got %d receipts, want 2", len(eduAPI.receipts))
+	}
+	for i, want := range []struct{ receiptType, eventID string }{
+		{"m.read", "$read:localhost"},
+		{"m.read.private", "$private:localhost"},
+	} {
+		got := eduAPI.receipts[i]
+		if got.Type != want.receiptType || got.EventID != want.eventID || got.UserID != device.UserID || got.RoomID != "!room:localhost" {
+			t.Errorf("got receipt %+v, want %s for %s", got, want.receiptType, want.eventID)
+		}
+	}
+
+	// The fully read marker is optional.
+	eduAPI.receipts = nil
+	req = httptest.NewRequest(http.MethodPost, "/rooms/!room:localhost/read_markers", strings.NewReader(`{"m.read":"$later:localhost"}`))
+	if res := SaveReadMarker(req, userAPI, rsAPI, eduAPI, syncProducer, device, "!room:localhost"); res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d setting only a read receipt: %+v", res.Code, res.JSON)
+	}
+	if len(eduAPI.receipts) != 1 || eduAPI.receipts[0].EventID != "$later:localhost" {
+		t.Errorf("got receipts %+v, want one for $later:localhost", eduAPI.receipts)
+	}
+	if len(producer.messages) != 1 {
+		t.Errorf("got %d messages sent to the sync API, want the fully read marker to be left alone", len(producer.messages))
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultDeadLettersLimit = 100
+	maxDeadLettersLimit     = 1000
+)
+
+type deadLettersResponse struct {
+	DeadLetters []types.DeadLetter `json:"dead_letters"`
+}
+
+// GetDeadLetters implements GET /_dendrite/admin/deadLetters, which lists the
+// events that the federation sender gave up trying to send to other servers,
+// most recent first.
+func GetDeadLetters(
+	req *http.Request, federationSender federationSenderAPI.FederationSenderInternalAPI,
+) util.JSONResponse {
+	limit := defaultDeadLettersLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxDeadLettersLimit {
+			limit = maxDeadLettersLimit
+		}
+	}
+	var res federationSenderAPI.QueryDeadLettersResponse
+	if err := federationSender.QueryDeadLetters(req.Context(), &federationSenderAPI.QueryDeadLettersRequest{
+		Limit: limit,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("federationSender.QueryDeadLetters failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.DeadLetters == nil {
+		res.DeadLetters = []types.DeadLetter{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deadLettersResponse{DeadLetters: res.DeadLetters},
+	}
+}
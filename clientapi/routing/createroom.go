@@ -28,6 +28,8 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -39,6 +41,7 @@ import (
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type createRoomRequest struct {
 	Invite          []string                      `json:"invite"`
+	Invite3PID      []invite3PID                  `json:"invite_3pid"`
 	Name            string                        `json:"name"`
 	Visibility      string                        `json:"visibility"`
 	Topic           string                        `json:"topic"`
@@ -48,6 +51,17 @@ type createRoomRequest struct {
 	RoomAliasName   string                        `json:"room_alias_name"`
 	GuestCanJoin    bool                          `json:"guest_can_join"`
 	RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+	IsDirect        bool                          `json:"is_direct"`
+	// PowerLevelContentOverride is merged into the default power levels.
+	PowerLevelContentOverride json.RawMessage `json:"power_level_content_override"`
+}
+
+// invite3PID is a third party identifier to invite to the room, as described
+// at https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-createroom
+type invite3PID struct {
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
 }
 
 const (
@@ -57,9 +71,14 @@ const (
 )
 
 const (
-	historyVisibilityShared = "shared"
+	guestAccessCanJoin   = "can_join"
+	guestAccessForbidden = "forbidden"
+)
+
+const (
+	historyVisibilityShared        = "shared"
+	historyVisibilityWorldReadable = "world_readable"
 	// TODO: These should be implemented once history visibility is implemented
-	// historyVisibilityWorldReadable = "world_readable"
 	// historyVisibilityInvited       = "invited"
 )
 
@@ -86,6 +105,14 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			}
 		}
 	}
+	for _, invite := range r.Invite3PID {
+		if invite.IDServer == "" || invite.Medium == "" || invite.Address == "" {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("invite_3pid entries must have an id_server, medium and address"),
+			}
+		}
+	}
 	switch r.Preset {
 	case presetPrivateChat, presetTrustedPrivateChat, presetPublicChat, "":
 	default:
@@ -95,6 +122,16 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 		}
 	}
 
+	if len(r.PowerLevelContentOverride) > 0 {
+		var override map[string]interface{}
+		if err := json.Unmarshal(r.PowerLevelContentOverride, &override); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("power_level_content_override must be a JSON object"),
+			}
+		}
+	}
+
 	// Validate creation_content fields defined in the spec by marshalling the
 	// creation_content map into bytes and then unmarshalling the bytes into
 	// eventutil.CreateContent.
@@ -137,12 +174,13 @@ func CreateRoom(
 	req *http.Request, device *api.Device,
 	cfg *config.ClientAPI,
 	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
-	asAPI appserviceAPI.AppServiceQueryAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI, userAPI api.UserInternalAPI,
+	syncProducer *producers.SyncAPIProducer,
 ) util.JSONResponse {
 	// TODO (#267): Check room ID doesn't clash with an existing one, and we
 	//              probably shouldn't be using pseudo-random strings, maybe GUIDs?
 	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
-	return createRoom(req, device, cfg, roomID, accountDB, rsAPI, asAPI)
+	return createRoom(req, device, cfg, roomID, accountDB, rsAPI, asAPI, userAPI, syncProducer)
 }
 
 // createRoom implements /createRoom
@@ -151,7 +189,8 @@ func createRoom(
 	req *http.Request, device *api.Device,
 	cfg *config.ClientAPI, roomID string,
 	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
-	asAPI appserviceAPI.AppServiceQueryAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI, userAPI api.UserInternalAPI,
+	syncProducer *producers.SyncAPIProducer,
 ) util.JSONResponse {
 	logger := util.GetLogger(req.Context())
 	userID := device.UserID
@@ -181,7 +220,7 @@ func createRoom(
 	}
 
 	r.CreationContent["creator"] = userID
-	roomVersion := roomserverVersion.DefaultRoomVersion()
+	var roomVersion gomatrixserverlib.RoomVersion
 	if r.RoomVersion != "" {
 		candidateVersion := gomatrixserverlib.RoomVersion(r.RoomVersion)
 		_, roomVersionError := roomserverVersion.SupportedRoomVersion(candidateVersion)
@@ -192,10 +231,19 @@ func createRoom(
 			}
 		}
 		roomVersion = candidateVersion
+	} else {
+		// Use the default room version that the roomserver is configured with.
+		versionRes := roomserverAPI.QueryRoomVersionCapabilitiesResponse{}
+		if err = rsAPI.QueryRoomVersionCapabilities(
+			req.Context(), &roomserverAPI.QueryRoomVersionCapabilitiesRequest{}, &versionRes,
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomVersionCapabilities failed")
+			return jsonerror.InternalServerError()
+		}
+		roomVersion = versionRes.DefaultRoomVersion
 	}
 	r.CreationContent["room_version"] = roomVersion
 
-	// TODO: visibility/presets/raw initial state
 	// TODO: Create room alias association
 	// Make sure this doesn't fall into an application service's namespace though!
 
@@ -236,71 +284,14 @@ func createRoom(
 		AvatarURL:   profile.AvatarURL,
 	}
 
-	var joinRules, historyVisibility string
-	switch r.Preset {
-	case presetPrivateChat:
-		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
-	case presetTrustedPrivateChat:
-		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
-		// TODO If trusted_private_chat, all invitees are given the same power level as the room creator.
-	case presetPublicChat:
-		joinRules = gomatrixserverlib.Public
-		historyVisibility = historyVisibilityShared
-	default:
-		// Default room rules, r.Preset was previously checked for valid values so
-		// only a request with no preset should end up here.
-		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
+	eventsToMake, err := r.stateEvents(userID, roomAlias, membershipContent, &cfg.DefaultPowerLevels)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("r.stateEvents failed")
+		return jsonerror.InternalServerError()
 	}
 
 	var builtEvents []*gomatrixserverlib.HeaderedEvent
 
-	// send events into the room in order of:
-	//  1- m.room.create
-	//  2- room creator join member
-	//  3- m.room.power_levels
-	//  4- m.room.join_rules
-	//  5- m.room.history_visibility
-	//  6- m.room.canonical_alias (opt)
-	//  7- m.room.guest_access (opt)
-	//  8- other initial state items
-	//  9- m.room.name (opt)
-	//  10- m.room.topic (opt)
-	//  11- invite events (opt) - with is_direct flag if applicable TODO
-	//  12- 3pid invite events (opt) TODO
-	//  13- m.room.aliases event for HS (if alias specified) TODO
-	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
-	// depending on if those events were in "initial_state" or not. This made it
-	// harder to reason about, hence sticking to a strict static ordering.
-	// TODO: Synapse has txn/token ID on each event. Do we need to do this here?
-	eventsToMake := []fledglingEvent{
-		{"m.room.create", "", r.CreationContent},
-		{"m.room.member", userID, membershipContent},
-		{"m.room.power_levels", "", eventutil.InitialPowerLevelsContent(userID)},
-		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: joinRules}},
-		{"m.room.history_visibility", "", eventutil.HistoryVisibilityContent{HistoryVisibility: historyVisibility}},
-	}
-	if roomAlias != "" {
-		// TODO: bit of a chicken and egg problem here as the alias doesn't exist and cannot until we have made the room.
-		// This means we might fail creating the alias but say the canonical alias is something that doesn't exist.
-		// m.room.aliases is handled when we call roomserver.SetRoomAlias
-		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.canonical_alias", "", eventutil.CanonicalAlias{Alias: roomAlias}})
-	}
-	if r.GuestCanJoin {
-		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.guest_access", "", eventutil.GuestAccessContent{GuestAccess: "can_join"}})
-	}
-	eventsToMake = append(eventsToMake, r.InitialState...)
-	if r.Name != "" {
-		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.name", "", eventutil.NameContent{Name: r.Name}})
-	}
-	if r.Topic != "" {
-		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.topic", "", eventutil.TopicContent{Topic: r.Topic}})
-	}
-	// TODO: invite events
-	// TODO: 3pid invite events
-
 	authEvents := gomatrixserverlib.NewAuthEvents(nil)
 	for i, e := range eventsToMake {
 		depth := i + 1 // depth starts at 1
@@ -352,6 +343,12 @@ func createRoom(
 			ev.Headered(roomVersion),
 			nil,
 		); err != nil {
+			if e, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden(e.Message),
+				}
+			}
 			util.GetLogger(req.Context()).WithError(err).Error("SendEventWithState failed")
 			return jsonerror.InternalServerError()
 		}
@@ -379,50 +376,45 @@ func createRoom(
 		}
 	}
 
-	// If this is a direct message then we should invite the participants.
-	if len(r.Invite) > 0 {
-		// Build some stripped state for the invite.
-		var globalStrippedState []gomatrixserverlib.InviteV2StrippedState
-		for _, event := range builtEvents {
-			switch event.Type() {
-			case gomatrixserverlib.MRoomName:
-				fallthrough
-			case gomatrixserverlib.MRoomCanonicalAlias:
-				fallthrough
-			case "m.room.encryption": // TODO: move this to gmsl
-				fallthrough
-			case gomatrixserverlib.MRoomMember:
-				fallthrough
-			case gomatrixserverlib.MRoomJoinRules:
-				ev := event.Event
-				globalStrippedState = append(
-					globalStrippedState,
-					gomatrixserverlib.NewInviteV2StrippedState(ev),
-				)
-			}
+	// Invite the third party identifiers. The identity server either knows
+	// the Matrix ID for the identifier, in which case we invite it like any
+	// other user, or it stores the invite and we send a third party invite
+	// event for it.
+	invitees := append([]string{}, r.Invite...)
+	for _, invite := range r.Invite3PID {
+		body := threepid.MembershipRequest{
+			IDServer: invite.IDServer,
+			Medium:   invite.Medium,
+			Address:  invite.Address,
+		}
+		inviteStored, errRes := checkAndProcessThreepid(req, device, &body, cfg, rsAPI, accountDB, roomID, evTime)
+		if errRes != nil {
+			return *errRes
+		}
+		if !inviteStored {
+			invitees = append(invitees, body.UserID)
 		}
+	}
 
+	// If this is a direct message then we should invite the participants.
+	if len(invitees) > 0 {
 		// Process the invites.
-		for _, invitee := range r.Invite {
+		for _, invitee := range invitees {
 			// Build the invite event.
 			inviteEvent, err := buildMembershipEvent(
 				req.Context(), invitee, "", accountDB, device, gomatrixserverlib.Invite,
-				roomID, true, cfg, evTime, rsAPI, asAPI,
+				roomID, r.IsDirect, cfg, evTime, rsAPI, asAPI,
 			)
 			if err != nil {
 				util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
 				continue
 			}
-			inviteStrippedState := append(
-				globalStrippedState,
-				gomatrixserverlib.NewInviteV2StrippedState(inviteEvent.Event),
-			)
 			// Send the invite event to the roomserver.
 			err = roomserverAPI.SendInvite(
 				req.Context(),
 				rsAPI,
 				inviteEvent.Headered(roomVersion),
-				inviteStrippedState,   // invite room state
+				nil,                   // ask the roomserver to draw up invite room state for us
 				cfg.Matrix.ServerName, // send as server
 				nil,                   // transaction ID
 			)
@@ -438,6 +430,16 @@ func createRoom(
 				}
 			}
 		}
+
+		// Remember the direct chat for the creator, so that their clients know
+		// who the room is with. The invitees' clients do the same for them when
+		// they see the is_direct flag on the invite. The room has been made by
+		// this point, so failing to do so isn't fatal.
+		if r.IsDirect {
+			if err = addDirectRoom(req.Context(), userAPI, syncProducer, userID, roomID, invitees); err != nil {
+				logger.WithError(err).Error("Failed to add direct room for the creator")
+			}
+		}
 	}
 
 	if r.Visibility == "public" {
@@ -464,6 +466,176 @@ func createRoom(
 	}
 }
 
+// stateEvents returns the state events which make up the new room, in the
+// order that they must be sent in:
+//
+//	1- m.room.create
+//	2- room creator join member
+//	3- m.room.power_levels
+//	4- m.room.join_rules
+//	5- m.room.history_visibility
+//	6- m.room.canonical_alias (opt)
+//	7- m.room.guest_access
+//	8- other initial state items
+//	9- m.room.name (opt)
+//	10- m.room.topic (opt)
+//
+// The invite events, with the is_direct flag if applicable, and the third
+// party invite events are sent after.
+// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
+// depending on if those events were in "initial_state" or not. This made it
+// harder to reason about, hence sticking to a strict static ordering. Instead
+// events in "initial_state" replace the ones that the preset would have set,
+// and are in turn replaced by the "name" and "topic" of the request.
+// TODO: Synapse has txn/token ID on each event. Do we need to do this here?
+func (r createRoomRequest) stateEvents(
+	userID, roomAlias string, membershipContent gomatrixserverlib.MemberContent,
+	defaultPowerLevels *config.DefaultPowerLevels,
+) ([]fledglingEvent, error) {
+	preset := r.Preset
+	if preset == "" {
+		// If there's no preset then it depends on the visibility of the room.
+		if r.Visibility == "public" {
+			preset = presetPublicChat
+		} else {
+			preset = presetPrivateChat
+		}
+	}
+
+	powerLevelContent := eventutil.InitialPowerLevelsContent(userID)
+	applyDefaultPowerLevels(&powerLevelContent, defaultPowerLevels)
+	joinRules, historyVisibility, guestAccess := gomatrixserverlib.Invite, historyVisibilityShared, guestAccessCanJoin
+	switch preset {
+	case presetTrustedPrivateChat:
+		// All invitees are given the same power level as the room creator.
+		for _, invitee := range r.Invite {
+			powerLevelContent.Users[invitee] = powerLevelContent.Users[userID]
+		}
+	case presetPublicChat:
+		joinRules = gomatrixserverlib.Public
+		guestAccess = guestAccessForbidden
+	}
+	if r.GuestCanJoin {
+		guestAccess = guestAccessCanJoin
+	}
+
+	// Work out which state the request sets explicitly, so that it isn't
+	// also set by the preset.
+	var initialState []fledglingEvent
+	var initialPowerLevels interface{}
+	overridden := map[gomatrixserverlib.StateKeyTuple]bool{}
+	for _, e := range r.InitialState {
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: e.Type, StateKey: e.StateKey}
+		switch {
+		case tuple.EventType == gomatrixserverlib.MRoomPowerLevels && tuple.StateKey == "":
+			// The power levels have to be sent before most other events, so
+			// they take the place of the default ones instead.
+			initialPowerLevels = e.Content
+			continue
+		case tuple.EventType == gomatrixserverlib.MRoomName && tuple.StateKey == "" && r.Name != "":
+			continue
+		case tuple.EventType == "m.room.topic" && tuple.StateKey == "" && r.Topic != "":
+			continue
+		}
+		overridden[tuple] = true
+		initialState = append(initialState, e)
+	}
+
+	powerLevels, err := mergePowerLevels(powerLevelContent, initialPowerLevels, r.PowerLevelContentOverride)
+	if err != nil {
+		return nil, err
+	}
+
+	eventsToMake := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, "", r.CreationContent},
+		{gomatrixserverlib.MRoomMember, userID, membershipContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", powerLevels},
+	}
+	for _, e := range []fledglingEvent{
+		{gomatrixserverlib.MRoomJoinRules, "", gomatrixserverlib.JoinRuleContent{JoinRule: joinRules}},
+		{gomatrixserverlib.MRoomHistoryVisibility, "", eventutil.HistoryVisibilityContent{HistoryVisibility: historyVisibility}},
+	} {
+		if !overridden[gomatrixserverlib.StateKeyTuple{EventType: e.Type, StateKey: e.StateKey}] {
+			eventsToMake = append(eventsToMake, e)
+		}
+	}
+	if roomAlias != "" {
+		// TODO: bit of a chicken and egg problem here as the alias doesn't exist and cannot until we have made the room.
+		// This means we might fail creating the alias but say the canonical alias is something that doesn't exist.
+		// m.room.aliases is handled when we call roomserver.SetRoomAlias
+		eventsToMake = append(eventsToMake, fledglingEvent{gomatrixserverlib.MRoomCanonicalAlias, "", eventutil.CanonicalAlias{Alias: roomAlias}})
+	}
+	if !overridden[gomatrixserverlib.StateKeyTuple{EventType: "m.room.guest_access", StateKey: ""}] {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.guest_access", "", eventutil.GuestAccessContent{GuestAccess: guestAccess}})
+	}
+	eventsToMake = append(eventsToMake, initialState...)
+	if r.Name != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{gomatrixserverlib.MRoomName, "", eventutil.NameContent{Name: r.Name}})
+	}
+	if r.Topic != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.topic", "", eventutil.TopicContent{Topic: r.Topic}})
+	}
+	return eventsToMake, nil
+}
+
+// applyDefaultPowerLevels replaces the built-in power levels with the ones
+// that are configured.
+func applyDefaultPowerLevels(content *gomatrixserverlib.PowerLevelContent, defaults *config.DefaultPowerLevels) {
+	for _, level := range []struct {
+		configured *int64
+		content    *int64
+	}{
+		{defaults.Ban, &content.Ban},
+		{defaults.Invite, &content.Invite},
+		{defaults.Kick, &content.Kick},
+		{defaults.Redact, &content.Redact},
+		{defaults.UsersDefault, &content.UsersDefault},
+		{defaults.EventsDefault, &content.EventsDefault},
+		{defaults.StateDefault, &content.StateDefault},
+	} {
+		if level.configured != nil {
+			*level.content = *level.configured
+		}
+	}
+	for evType, level := range defaults.Events {
+		content.Events[evType] = level
+	}
+	for key, level := range defaults.Notifications {
+		content.Notifications[key] = level
+	}
+}
+
+// mergePowerLevels returns the content of the initial power levels event of a
+// room. The initial power levels from the initial_state of the request, if
+// any, replace the default power levels, and then each key in the override
+// replaces the key of the same name.
+func mergePowerLevels(
+	defaults gomatrixserverlib.PowerLevelContent, initial interface{}, override json.RawMessage,
+) (map[string]interface{}, error) {
+	var base interface{} = defaults
+	if initial != nil {
+		base = initial
+	}
+	baseJSON, err := json.Marshal(base)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	var merged map[string]interface{}
+	if err = json.Unmarshal(baseJSON, &merged); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if len(override) > 0 {
+		var overrides map[string]interface{}
+		if err = json.Unmarshal(override, &overrides); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		for key, value := range overrides {
+			merged[key] = value
+		}
+	}
+	return merged, nil
+}
+
 // buildEvent fills out auth_events for the builder then builds the event
 func buildEvent(
 	builder *gomatrixserverlib.EventBuilder,
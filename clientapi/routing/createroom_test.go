@@ -0,0 +1,519 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/caching"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// fakeRoomserverAPI remembers the events that are sent to it, and answers
+// queries about the latest events and state from them.
+type fakeRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	events             []*gomatrixserverlib.HeaderedEvent
+	invites            []*gomatrixserverlib.HeaderedEvent
+	defaultRoomVersion gomatrixserverlib.RoomVersion
+	// spamChecker, if set, rejects new events like the roomserver does.
+	spamChecker spamcheck.Checker
+}
+
+func (r *fakeRoomserverAPI) QueryRoomVersionCapabilities(
+	ctx context.Context, req *roomserverAPI.QueryRoomVersionCapabilitiesRequest, res *roomserverAPI.QueryRoomVersionCapabilitiesResponse,
+) error {
+	res.DefaultRoomVersion = r.defaultRoomVersion
+	if res.DefaultRoomVersion == "" {
+		res.DefaultRoomVersion = gomatrixserverlib.RoomVersionV6
+	}
+	return nil
+}
+
+func (r *fakeRoomserverAPI) InputRoomEvents(
+	ctx context.Context, req *roomserverAPI.InputRoomEventsRequest, res *roomserverAPI.InputRoomEventsResponse,
+) {
+	for _, ire := range req.InputRoomEvents {
+		if ire.Kind == roomserverAPI.KindNew {
+			if r.spamChecker != nil {
+				if err := r.spamChecker.CheckEventAllowed(ctx, ire.Event); err != nil {
+					res.ErrMsg = err.Error()
+					res.NotAllowed = true
+					return
+				}
+			}
+			r.events = append(r.events, ire.Event)
+		}
+	}
+}
+
+func (r *fakeRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	latest := r.events[len(r.events)-1]
+	res.RoomExists = true
+	res.RoomVersion = latest.RoomVersion
+	res.LatestEvents = []gomatrixserverlib.EventReference{latest.EventReference()}
+	res.Depth = latest.Depth() + 1
+	for _, tuple := range req.StateToFetch {
+		if ev := r.state(tuple.EventType, tuple.StateKey); ev != nil {
+			res.StateEvents = append(res.StateEvents, ev)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRoomserverAPI) PerformInvite(
+	ctx context.Context, req *roomserverAPI.PerformInviteRequest, res *roomserverAPI.PerformInviteResponse,
+) error {
+	r.invites = append(r.invites, req.Event)
+	return nil
+}
+
+func (r *fakeRoomserverAPI) PerformPublish(
+	ctx context.Context, req *roomserverAPI.PerformPublishRequest, res *roomserverAPI.PerformPublishResponse,
+) {
+}
+
+// state returns the latest state event with the given type and state key.
+func (r *fakeRoomserverAPI) state(evType, stateKey string) *gomatrixserverlib.HeaderedEvent {
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].Type() == evType && r.events[i].StateKeyEquals(stateKey) {
+			return r.events[i]
+		}
+	}
+	return nil
+}
+
+// fakeUserAPI stores account data in memory.
+type fakeUserAPI struct {
+	api.UserInternalAPI
+	accountData     map[string]map[string]json.RawMessage            // user ID -> type -> data
+	roomAccountData map[string]map[string]map[string]json.RawMessage // user ID -> room ID -> type -> data
+}
+
+func (u *fakeUserAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
+	res.GlobalAccountData = map[string]json.RawMessage{}
+	res.RoomAccountData = map[string]map[string]json.RawMessage{}
+	if req.RoomID != "" {
+		if data, ok := u.roomAccountData[req.UserID][req.RoomID][req.DataType]; ok {
+			res.RoomAccountData[req.RoomID] = map[string]json.RawMessage{req.DataType: data}
+		}
+	} else if data, ok := u.accountData[req.UserID][req.DataType]; ok {
+		res.GlobalAccountData[req.DataType] = data
+	}
+	return nil
+}
+
+func (u *fakeUserAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
+	if req.RoomID != "" {
+		if u.roomAccountData == nil {
+			u.roomAccountData = map[string]map[string]map[string]json.RawMessage{}
+		}
+		if u.roomAccountData[req.UserID] == nil {
+			u.roomAccountData[req.UserID] = map[string]map[string]json.RawMessage{}
+		}
+		if u.roomAccountData[req.UserID][req.RoomID] == nil {
+			u.roomAccountData[req.UserID][req.RoomID] = map[string]json.RawMessage{}
+		}
+		u.roomAccountData[req.UserID][req.RoomID][req.DataType] = req.AccountData
+		return nil
+	}
+	if u.accountData == nil {
+		u.accountData = map[string]map[string]json.RawMessage{}
+	}
+	if u.accountData[req.UserID] == nil {
+		u.accountData[req.UserID] = map[string]json.RawMessage{}
+	}
+	u.accountData[req.UserID][req.DataType] = req.AccountData
+	return nil
+}
+
+// nopSyncProducer drops the messages that are sent to it.
+type nopSyncProducer struct {
+	sarama.SyncProducer
+}
+
+func (p *nopSyncProducer) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	return 0, 0, nil
+}
+
+func mustCreateRoom(t *testing.T, body string) *fakeRoomserverAPI {
+	t.Helper()
+	return mustCreateRoomWithUserAPI(t, body, &fakeUserAPI{})
+}
+
+// mustCreateAccountDB returns an in-memory account database with the local
+// users alice and dave.
+func mustCreateAccountDB(t *testing.T) accounts.Database {
+	t.Helper()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	for _, localpart := range []string{"alice", "dave"} {
+		if _, err = accountDB.CreateAccount(context.Background(), localpart, "", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+	}
+	return accountDB
+}
+
+// mustCreateCache returns an in-memory cache with the default sizes.
+func mustCreateCache(t *testing.T) *caching.Caches {
+	t.Helper()
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	return cache
+}
+
+func mustCreateRoomWithUserAPI(t *testing.T, body string, userAPI api.UserInternalAPI) *fakeRoomserverAPI {
+	t.Helper()
+	rsAPI := &fakeRoomserverAPI{}
+	mustCreateRoomWithAPIs(t, body, rsAPI, userAPI)
+	return rsAPI
+}
+
+func mustCreateRoomWithAPIs(t *testing.T, body string, rsAPI *fakeRoomserverAPI, userAPI api.UserInternalAPI) {
+	t.Helper()
+	res := createRoomWithConfig(t, body, testCreateRoomConfig(), rsAPI, userAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("createRoom returned HTTP %d: %+v", res.Code, res.JSON)
+	}
+}
+
+func testCreateRoomConfig() *config.ClientAPI {
+	return &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		},
+	}
+}
+
+func createRoomWithConfig(
+	t *testing.T, body string, cfg *config.ClientAPI, rsAPI *fakeRoomserverAPI, userAPI api.UserInternalAPI,
+) util.JSONResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/createRoom", strings.NewReader(body))
+	return createRoom(
+		req, &api.Device{UserID: "@alice:localhost"}, cfg, "!room:localhost", mustCreateAccountDB(t), rsAPI, nil,
+		userAPI, &producers.SyncAPIProducer{Producer: &nopSyncProducer{}},
+	)
+}
+
+// assertStateContent checks that the given field of the content of the room
+// state has the wanted value.
+func assertStateContent(t *testing.T, rsAPI *fakeRoomserverAPI, evType, field, want string) {
+	t.Helper()
+	ev := rsAPI.state(evType, "")
+	if ev == nil {
+		t.Fatalf("room has no %s event", evType)
+	}
+	if got := gjson.GetBytes(ev.Content(), field).String(); got != want {
+		t.Errorf("got %s %s %q, want %q", evType, field, got, want)
+	}
+}
+
+func TestCreateRoomPresets(t *testing.T) {
+	testCases := []struct {
+		preset      string
+		joinRule    string
+		guestAccess string
+		bobLevel    string
+	}{
+		{presetPrivateChat, gomatrixserverlib.Invite, guestAccessCanJoin, ""},
+		{presetTrustedPrivateChat, gomatrixserverlib.Invite, guestAccessCanJoin, "100"},
+		{presetPublicChat, gomatrixserverlib.Public, guestAccessForbidden, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.preset, func(t *testing.T) {
+			rsAPI := mustCreateRoom(t, `{"preset":"`+tc.preset+`","invite":["@bob:remote"]}`)
+			assertStateContent(t, rsAPI, gomatrixserverlib.MRoomJoinRules, "join_rule", tc.joinRule)
+			assertStateContent(t, rsAPI, gomatrixserverlib.MRoomHistoryVisibility, "history_visibility", historyVisibilityShared)
+			assertStateContent(t, rsAPI, "m.room.guest_access", "guest_access", tc.guestAccess)
+			assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, `users.@bob:remote`, tc.bobLevel)
+		})
+	}
+}
+
+func TestCreateRoomTrustedPrivateChatInvitees(t *testing.T) {
+	// Every invitee is given the same power level as the creator, and an
+	// override that doesn't touch the users keeps them there.
+	rsAPI := mustCreateRoom(t, `{
+		"preset": "trusted_private_chat",
+		"invite": ["@bob:remote", "@carol:elsewhere", "@dave:localhost"],
+		"power_level_content_override": {"state_default": 60}
+	}`)
+	for _, userID := range []string{"@alice:localhost", "@bob:remote", "@carol:elsewhere", "@dave:localhost"} {
+		assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, "users."+userID, "100")
+	}
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, "state_default", "60")
+	if got := len(rsAPI.invites); got != 3 {
+		t.Errorf("got %d invites, want 3", got)
+	}
+}
+
+func TestCreateRoomDefaultRoomVersion(t *testing.T) {
+	// Without a room version, the room gets the one the roomserver is
+	// configured with.
+	rsAPI := &fakeRoomserverAPI{defaultRoomVersion: gomatrixserverlib.RoomVersionV5}
+	mustCreateRoomWithAPIs(t, `{}`, rsAPI, &fakeUserAPI{})
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomCreate, "room_version", "5")
+	if got := rsAPI.events[0].RoomVersion; got != gomatrixserverlib.RoomVersionV5 {
+		t.Errorf("got room version %q, want %q", got, gomatrixserverlib.RoomVersionV5)
+	}
+
+	// The client can still ask for a different one.
+	rsAPI = &fakeRoomserverAPI{defaultRoomVersion: gomatrixserverlib.RoomVersionV5}
+	mustCreateRoomWithAPIs(t, `{"room_version":"4"}`, rsAPI, &fakeUserAPI{})
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomCreate, "room_version", "4")
+}
+
+func TestCreateRoomDefaultPresetFollowsVisibility(t *testing.T) {
+	rsAPI := mustCreateRoom(t, `{"visibility":"private"}`)
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomJoinRules, "join_rule", gomatrixserverlib.Invite)
+	rsAPI = mustCreateRoom(t, `{"visibility":"public"}`)
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomJoinRules, "join_rule", gomatrixserverlib.Public)
+}
+
+func TestCreateRoomInitialState(t *testing.T) {
+	rsAPI := mustCreateRoom(t, `{
+		"preset": "public_chat",
+		"name": "Explicit name",
+		"initial_state": [
+			{"type": "m.room.history_visibility", "content": {"history_visibility": "joined"}},
+			{"type": "m.room.name", "content": {"name": "Overridden name"}},
+			{"type": "m.room.topic", "content": {"topic": "First topic"}},
+			{"type": "m.room.topic", "content": {"topic": "Second topic"}},
+			{"type": "m.room.power_levels", "content": {"users": {"@alice:localhost": 100}, "state_default": 75}}
+		],
+		"power_level_content_override": {"events_default": 10, "state_default": 60}
+	}`)
+	// initial_state takes the place of the preset, but not of the name.
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomJoinRules, "join_rule", gomatrixserverlib.Public)
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomHistoryVisibility, "history_visibility", "joined")
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomName, "name", "Explicit name")
+	// initial_state events are sent in order, so the second topic wins.
+	assertStateContent(t, rsAPI, "m.room.topic", "topic", "Second topic")
+	// The override is merged into the power levels from initial_state.
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, "state_default", "60")
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, "events_default", "10")
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, `users.@alice:localhost`, "100")
+
+	// The preset's history visibility must not be sent as well.
+	for _, ev := range rsAPI.events {
+		if ev.Type() == gomatrixserverlib.MRoomHistoryVisibility && gjson.GetBytes(ev.Content(), "history_visibility").Str != "joined" {
+			t.Errorf("got unexpected history visibility event %s", string(ev.Content()))
+		}
+	}
+}
+
+func TestCreateRoomIsDirect(t *testing.T) {
+	for _, isDirect := range []bool{true, false} {
+		body := `{"invite":["@bob:remote"],"is_direct":false}`
+		if isDirect {
+			body = `{"invite":["@bob:remote"],"is_direct":true}`
+		}
+		rsAPI := mustCreateRoom(t, body)
+		if len(rsAPI.invites) != 1 {
+			t.Fatalf("got %d invites, want 1", len(rsAPI.invites))
+		}
+		if got := gjson.GetBytes(rsAPI.invites[0].Content(), "is_direct").Bool(); got != isDirect {
+			t.Errorf("got is_direct %v on the invite, want %v", got, isDirect)
+		}
+	}
+}
+
+func TestCreateRoomIsDirectUpdatesDirectAccountData(t *testing.T) {
+	userAPI := &fakeUserAPI{accountData: map[string]map[string]json.RawMessage{
+		"@alice:localhost": {"m.direct": json.RawMessage(`{"@carol:remote":["!other:localhost"]}`)},
+	}}
+	mustCreateRoomWithUserAPI(t, `{"invite":["@bob:remote","@dave:localhost"],"is_direct":true}`, userAPI)
+
+	testCases := []struct {
+		userID string
+		want   string
+	}{
+		// The creator's existing direct chats are kept.
+		{"@alice:localhost", `{"@bob:remote":["!room:localhost"],"@carol:remote":["!other:localhost"],"@dave:localhost":["!room:localhost"]}`},
+		// The invitees' clients update their own m.direct.
+		{"@dave:localhost", ``},
+		{"@bob:remote", ``},
+	}
+	for _, tc := range testCases {
+		if got := string(userAPI.accountData[tc.userID]["m.direct"]); got != tc.want {
+			t.Errorf("got m.direct %s for %s, want %s", got, tc.userID, tc.want)
+		}
+	}
+
+	// Rooms that aren't direct don't change m.direct.
+	userAPI = &fakeUserAPI{}
+	mustCreateRoomWithUserAPI(t, `{"invite":["@bob:remote"]}`, userAPI)
+	if data, ok := userAPI.accountData["@alice:localhost"]["m.direct"]; ok {
+		t.Errorf("got m.direct %s for a room that isn't direct", string(data))
+	}
+}
+
+func TestAddDirectRoomConcurrently(t *testing.T) {
+	userAPI := &fakeUserAPI{}
+	syncProducer := &producers.SyncAPIProducer{Producer: &nopSyncProducer{}}
+	var wg sync.WaitGroup
+	for _, roomID := range []string{"!a:localhost", "!b:localhost", "!c:localhost"} {
+		wg.Add(1)
+		go func(roomID string) {
+			defer wg.Done()
+			if err := addDirectRoom(context.Background(), userAPI, syncProducer, "@alice:localhost", roomID, []string{"@bob:remote"}); err != nil {
+				t.Errorf("addDirectRoom failed: %s", err)
+			}
+		}(roomID)
+	}
+	wg.Wait()
+
+	// None of the rooms are lost to a concurrent update.
+	direct := map[string][]string{}
+	if err := json.Unmarshal(userAPI.accountData["@alice:localhost"]["m.direct"], &direct); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if got := len(direct["@bob:remote"]); got != 3 {
+		t.Errorf("got %d direct rooms, want 3: %v", got, direct)
+	}
+}
+
+func TestCreateRoomInvite3PID(t *testing.T) {
+	// The identity server doesn't know a Matrix ID for the address, so it
+	// stores the invite instead.
+	idServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/_matrix/identity/api/v1/lookup":
+			_, _ = w.Write([]byte(`{}`))
+		case "/_matrix/identity/api/v1/store-invite":
+			if got := req.FormValue("address"); got != "bob@example.com" {
+				t.Errorf("got address %q stored on the identity server, want bob@example.com", got)
+			}
+			_, _ = w.Write([]byte(`{
+				"token": "sometoken",
+				"display_name": "b...@e...",
+				"public_key": "c29tZXB1YmxpY2tleQ",
+				"public_keys": [{"public_key": "c29tZXB1YmxpY2tleQ", "key_validity_url": "https://id.example.com/isvalid"}]
+			}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer idServer.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = idServer.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	idServerName := idServer.Listener.Addr().String()
+	body := fmt.Sprintf(`{"invite_3pid":[{"id_server":%q,"medium":"email","address":"bob@example.com"}]}`, idServerName)
+	cfg := testCreateRoomConfig()
+	cfg.Matrix.TrustedIDServers = []string{idServerName}
+	rsAPI := &fakeRoomserverAPI{}
+	if res := createRoomWithConfig(t, body, cfg, rsAPI, &fakeUserAPI{}); res.Code != http.StatusOK {
+		t.Fatalf("createRoom returned HTTP %d: %+v", res.Code, res.JSON)
+	}
+	ev := rsAPI.state("m.room.third_party_invite", "sometoken")
+	if ev == nil {
+		t.Fatalf("room has no m.room.third_party_invite event")
+	}
+	if ev.Sender() != "@alice:localhost" {
+		t.Errorf("got sender %s, want @alice:localhost", ev.Sender())
+	}
+	for field, want := range map[string]string{
+		"display_name":                   "b...@e...",
+		"key_validity_url":               "https://" + idServerName + "/_matrix/identity/api/v1/pubkey/isvalid",
+		"public_key":                     "c29tZXB1YmxpY2tleQ",
+		"public_keys.0.key_validity_url": "https://id.example.com/isvalid",
+	} {
+		if got := gjson.GetBytes(ev.Content(), field).String(); got != want {
+			t.Errorf("got m.room.third_party_invite %s %q, want %q", field, got, want)
+		}
+	}
+	if len(rsAPI.invites) != 0 {
+		t.Errorf("got %d invites, want none", len(rsAPI.invites))
+	}
+
+	// Identity servers must be trusted, and the identifiers must be complete.
+	for _, body := range []string{
+		`{"invite_3pid":[{"id_server":"untrusted.example.com","medium":"email","address":"bob@example.com"}]}`,
+		fmt.Sprintf(`{"invite_3pid":[{"id_server":%q,"medium":"email"}]}`, idServerName),
+	} {
+		if res := createRoomWithConfig(t, body, cfg, &fakeRoomserverAPI{}, &fakeUserAPI{}); res.Code != http.StatusBadRequest {
+			t.Errorf("%s: got HTTP %d, want %d", body, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCreateRoomDefaultPowerLevels(t *testing.T) {
+	invite, stateDefault := int64(50), int64(75)
+	cfg := testCreateRoomConfig()
+	cfg.DefaultPowerLevels = config.DefaultPowerLevels{
+		Invite:        &invite,
+		StateDefault:  &stateDefault,
+		Events:        map[string]int64{"m.room.encryption": 100},
+		Notifications: map[string]int64{"room": 20},
+	}
+	create := func(body string) *fakeRoomserverAPI {
+		t.Helper()
+		rsAPI := &fakeRoomserverAPI{}
+		if res := createRoomWithConfig(t, body, cfg, rsAPI, &fakeUserAPI{}); res.Code != http.StatusOK {
+			t.Fatalf("createRoom returned HTTP %d: %+v", res.Code, res.JSON)
+		}
+		return rsAPI
+	}
+
+	// The configured levels replace the built-in ones, which are otherwise kept.
+	rsAPI := create(`{}`)
+	for field, want := range map[string]string{
+		"invite":                       "50",
+		"state_default":                "75",
+		"ban":                          "50",
+		"events.m\\.room\\.encryption": "100",
+		"events.m\\.room\\.name":       "50",
+		"notifications.room":           "20",
+		"users.@alice:localhost":       "100",
+	} {
+		assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, field, want)
+	}
+
+	// The client's override is applied on top of the configured levels.
+	rsAPI = create(`{"power_level_content_override": {"invite": 0}}`)
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, "invite", "0")
+	assertStateContent(t, rsAPI, gomatrixserverlib.MRoomPowerLevels, "state_default", "75")
+}
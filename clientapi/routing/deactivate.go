@@ -1,22 +1,39 @@
 package routing
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
+type deactivateRequest struct {
+	// The identity server to unbind the 3PIDs of the user from. If it isn't
+	// given then each 3PID is unbound from the identity server that it was
+	// bound to.
+	IDServer string `json:"id_server"`
+}
+
+type deactivateResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // Deactivate handles POST requests to /account/deactivate
 func Deactivate(
 	req *http.Request,
 	userInteractiveAuth *auth.UserInteractive,
 	userAPI api.UserInternalAPI,
 	deviceAPI *api.Device,
+	accountDB accounts.Database,
+	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	ctx := req.Context()
 	defer req.Body.Close() // nolint:errcheck
@@ -39,6 +56,20 @@ func Deactivate(
 		return jsonerror.InternalServerError()
 	}
 
+	var body deactivateRequest
+	if err = json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	unbindResult, err := unbindThreePIDs(req, accountDB, cfg, login.User, localpart, body.IDServer)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unbindThreePIDs failed")
+		return jsonerror.InternalServerError()
+	}
+
 	var res api.PerformAccountDeactivationResponse
 	err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
 		Localpart: localpart,
@@ -50,6 +81,38 @@ func Deactivate(
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: deactivateResponse{
+			IDServerUnbindResult: unbindResult,
+		},
+	}
+}
+
+// unbindThreePIDs unbinds the 3PIDs of the user from the identity servers
+// that they are bound to, or from the given identity server instead. The
+// account is deactivated even if this fails, so the result is either
+// "success" or "no-support" if any of the 3PIDs couldn't be unbound.
+func unbindThreePIDs(
+	req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI,
+	userID, localpart, idServer string,
+) (string, error) {
+	threePIDs, err := accountDB.GetThreePIDsForLocalpart(req.Context(), localpart)
+	if err != nil {
+		return "", err
+	}
+	result := "success"
+	for _, threePID := range threePIDs {
+		server := idServer
+		if server == "" {
+			server = threePID.IDServer
+		}
+		if server == "" {
+			// The 3PID was never bound to an identity server.
+			continue
+		}
+		if err = threepid.UnbindAssociation(req.Context(), threePID, server, userID, cfg); err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("id_server", server).Warn("Failed to unbind 3PID from identity server")
+			result = "no-support"
+		}
 	}
+	return result, nil
 }
@@ -0,0 +1,123 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDeactivateUnbindsThreePIDs(t *testing.T) {
+	var mu sync.Mutex
+	var unbound []string
+	failUnbind := false
+	idServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_matrix/identity/api/v1/3pid/unbind" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !strings.HasPrefix(req.Header.Get("Authorization"), `X-Matrix origin="localhost",`) {
+			t.Errorf("got unsigned unbind request with Authorization %q", req.Header.Get("Authorization"))
+		}
+		var body struct {
+			MXID     string `json:"mxid"`
+			ThreePID struct {
+				Medium  string `json:"medium"`
+				Address string `json:"address"`
+			} `json:"threepid"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode unbind request: %s", err)
+		}
+		if body.MXID != "@alice:localhost" {
+			t.Errorf("got unbind request for %s, want @alice:localhost", body.MXID)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		unbound = append(unbound, body.ThreePID.Medium+":"+body.ThreePID.Address)
+		if failUnbind {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer idServer.Close()
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = idServer.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	idServerName := idServer.Listener.Addr().String()
+	cfg := testCreateRoomConfig()
+	cfg.Matrix.TrustedIDServers = []string{idServerName}
+	accountDB := mustCreateAccountDB(t)
+	for _, threePID := range []struct {
+		address, medium, idServer string
+	}{
+		{"alice@example.com", "email", idServerName},
+		{"+441234567890", "msisdn", idServerName},
+		// Never bound to an identity server.
+		{"alice@example.org", "email", ""},
+	} {
+		if err := accountDB.SaveThreePIDAssociation(context.Background(), threePID.address, "alice", threePID.medium, threePID.idServer); err != nil {
+			t.Fatalf("failed to save 3PID: %s", err)
+		}
+	}
+	unbind := func(idServer string) string {
+		t.Helper()
+		mu.Lock()
+		unbound = nil
+		mu.Unlock()
+		req := httptest.NewRequest(http.MethodPost, "/account/deactivate", nil)
+		result, err := unbindThreePIDs(req, accountDB, cfg, "@alice:localhost", "alice", idServer)
+		if err != nil {
+			t.Fatalf("unbindThreePIDs failed: %s", err)
+		}
+		return result
+	}
+	assertUnbound := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(unbound)
+		if strings.Join(unbound, ",") != strings.Join(want, ",") {
+			t.Errorf("got unbind requests for %v, want %v", unbound, want)
+		}
+	}
+
+	// Each bound 3PID is unbound from the identity server it was bound to.
+	if result := unbind(""); result != "success" {
+		t.Errorf("got id_server_unbind_result %q, want success", result)
+	}
+	assertUnbound("email:alice@example.com", "msisdn:+441234567890")
+
+	// If the client names an identity server then every 3PID is unbound from it.
+	if result := unbind(idServerName); result != "success" {
+		t.Errorf("got id_server_unbind_result %q, want success", result)
+	}
+	assertUnbound("email:alice@example.com", "email:alice@example.org", "msisdn:+441234567890")
+
+	// Failing to unbind doesn't stop the others from being unbound.
+	failUnbind = true
+	if result := unbind(""); result != "no-support" {
+		t.Errorf("got id_server_unbind_result %q, want no-support", result)
+	}
+	assertUnbound("email:alice@example.com", "msisdn:+441234567890")
+}
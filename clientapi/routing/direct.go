@@ -0,0 +1,94 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// directAccountDataType is the global account data which maps the users that
+// a user has direct chats with to the IDs of those rooms.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-direct
+const directAccountDataType = "m.direct"
+
+var directRoomMutexes sync.Map // userID -> mutex, so that concurrent updates don't drop rooms
+
+// addDirectRoom adds the room to the m.direct account data of the user, as a
+// direct chat with each of the other users, and tells the sync API about it.
+func addDirectRoom(
+	ctx context.Context, userAPI api.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+	userID, roomID string, otherUserIDs []string,
+) error {
+	mutex, _ := directRoomMutexes.LoadOrStore(userID, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	dataRes := api.QueryAccountDataResponse{}
+	if err := userAPI.QueryAccountData(ctx, &api.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: directAccountDataType,
+	}, &dataRes); err != nil {
+		return fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	direct := map[string][]string{}
+	if data, ok := dataRes.GlobalAccountData[directAccountDataType]; ok {
+		if err := json.Unmarshal(data, &direct); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+
+	changed := false
+	for _, otherUserID := range otherUserIDs {
+		if otherUserID == userID || containsString(direct[otherUserID], roomID) {
+			continue
+		}
+		direct[otherUserID] = append(direct[otherUserID], roomID)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	data, err := json.Marshal(direct)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err = userAPI.InputAccountData(ctx, &api.InputAccountDataRequest{
+		UserID:      userID,
+		DataType:    directAccountDataType,
+		AccountData: data,
+	}, &api.InputAccountDataResponse{}); err != nil {
+		return fmt.Errorf("userAPI.InputAccountData: %w", err)
+	}
+	if err = syncProducer.SendData(userID, "", directAccountDataType); err != nil {
+		return fmt.Errorf("syncProducer.SendData: %w", err)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -15,12 +15,15 @@
 package routing
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -141,8 +144,7 @@ func SetLocalAlias(
 
 	for _, appservice := range cfg.Derived.ApplicationServices {
 		// Don't prevent AS from creating aliases in its own namespace
-		// Note that Dendrite uses SenderLocalpart as UserID for AS users
-		if device.UserID != appservice.SenderLocalpart {
+		if device.UserID != userutil.MakeUserID(appservice.SenderLocalpart, cfg.Matrix.ServerName) {
 			if aliasNamespaces, ok := appservice.NamespaceMap["aliases"]; ok {
 				for _, namespace := range aliasNamespaces {
 					if namespace.Exclusive && namespace.RegexpObject.MatchString(alias) {
@@ -235,6 +237,63 @@ func RemoveLocalAlias(
 	}
 }
 
+type roomAliasesResponse struct {
+	Aliases []string `json:"aliases"`
+}
+
+// GetAliases implements GET /rooms/{roomID}/aliases. Anyone can list the local
+// aliases of a world-readable room, otherwise the user has to be joined to it.
+func GetAliases(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, device *userapi.Device,
+	roomID string,
+) util.JSONResponse {
+	tuple := gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomHistoryVisibility,
+		StateKey:  "",
+	}
+	var stateRes roomserverAPI.QueryCurrentStateResponse
+	err := rsAPI.QueryCurrentState(req.Context(), &roomserverAPI.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{tuple},
+	}, &stateRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("QueryCurrentState failed")
+		return jsonerror.InternalServerError()
+	}
+
+	visibility := historyVisibilityShared
+	if ev := stateRes.StateEvents[tuple]; ev != nil {
+		var content eventutil.HistoryVisibilityContent
+		if err = json.Unmarshal(ev.Content(), &content); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("json.Unmarshal for history visibility failed")
+			return jsonerror.InternalServerError()
+		}
+		visibility = content.HistoryVisibility
+	}
+	if visibility != historyVisibilityWorldReadable {
+		if resErr := checkMemberInRoom(req.Context(), rsAPI, device.UserID, roomID); resErr != nil {
+			return *resErr
+		}
+	}
+
+	var aliasesRes roomserverAPI.GetAliasesForRoomIDResponse
+	if err = rsAPI.GetAliasesForRoomID(req.Context(), &roomserverAPI.GetAliasesForRoomIDRequest{
+		RoomID: roomID,
+	}, &aliasesRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetAliasesForRoomID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := roomAliasesResponse{Aliases: aliasesRes.Aliases}
+	if res.Aliases == nil {
+		res.Aliases = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
 type roomVisibility struct {
 	Visibility string `json:"visibility"`
 }
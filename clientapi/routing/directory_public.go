@@ -116,9 +116,9 @@ func publicRooms(
 
 	response.TotalRoomCountEstimate = len(rooms)
 
-	rooms = filterRooms(rooms, request.Filter.SearchTerms)
+	rooms = roomserverAPI.FilterPublicRooms(rooms, request.Filter.SearchTerms)
 
-	chunk, prev, next := sliceInto(rooms, offset, limit)
+	chunk, prev, next := roomserverAPI.SlicePublicRooms(rooms, offset, limit)
 	if prev >= 0 {
 		response.PrevBatch = "T" + strconv.Itoa(prev)
 	}
@@ -131,25 +131,6 @@ func publicRooms(
 	return &response, err
 }
 
-func filterRooms(rooms []gomatrixserverlib.PublicRoom, searchTerm string) []gomatrixserverlib.PublicRoom {
-	if searchTerm == "" {
-		return rooms
-	}
-
-	normalizedTerm := strings.ToLower(searchTerm)
-
-	result := make([]gomatrixserverlib.PublicRoom, 0)
-	for _, room := range rooms {
-		if strings.Contains(strings.ToLower(room.Name), normalizedTerm) ||
-			strings.Contains(strings.ToLower(room.Topic), normalizedTerm) ||
-			strings.Contains(strings.ToLower(room.CanonicalAlias), normalizedTerm) {
-			result = append(result, room)
-		}
-	}
-
-	return result
-}
-
 // fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
 // on /publicRooms by parsing the incoming HTTP request
 // Filter is only filled for POST requests
@@ -182,6 +163,13 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		request.Server = httpReq.FormValue("server")
 	}
 
+	if request.Limit < 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("limit must not be negative"),
+		}
+	}
+
 	// strip the 'T' which is only required because when sytest does pagination tests it stops
 	// iterating when !prev_batch which then fails if prev_batch==0, so add arbitrary text to
 	// make it truthy not falsey.
@@ -189,40 +177,6 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 	return nil
 }
 
-// sliceInto returns a subslice of `slice` which honours the since/limit values given.
-//
-//    0  1  2  3  4  5  6   index
-//   [A, B, C, D, E, F, G]  slice
-//
-//   limit=3          => A,B,C (prev='', next='3')
-//   limit=3&since=3  => D,E,F (prev='0', next='6')
-//   limit=3&since=6  => G     (prev='3', next='')
-//
-//  A value of '-1' for prev/next indicates no position.
-func sliceInto(slice []gomatrixserverlib.PublicRoom, since int64, limit int16) (subset []gomatrixserverlib.PublicRoom, prev, next int) {
-	prev = -1
-	next = -1
-
-	if since > 0 {
-		prev = int(since) - int(limit)
-	}
-	nextIndex := int(since) + int(limit)
-	if len(slice) > nextIndex { // there are more rooms ahead of us
-		next = nextIndex
-	}
-
-	// apply sanity caps
-	if since < 0 {
-		since = 0
-	}
-	if nextIndex > len(slice) {
-		nextIndex = len(slice)
-	}
-
-	subset = slice[since:nextIndex]
-	return
-}
-
 func refreshPublicRoomCache(
 	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
 ) []gomatrixserverlib.PublicRoom {
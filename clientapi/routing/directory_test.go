@@ -0,0 +1,80 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// aliasesRoomserverAPI answers alias queries with a fixed set of aliases.
+type aliasesRoomserverAPI struct {
+	*fakeRoomserverAPI
+	aliases []string
+}
+
+func (r *aliasesRoomserverAPI) GetAliasesForRoomID(
+	ctx context.Context, req *roomserverAPI.GetAliasesForRoomIDRequest, res *roomserverAPI.GetAliasesForRoomIDResponse,
+) error {
+	res.Aliases = r.aliases
+	return nil
+}
+
+func TestGetAliases(t *testing.T) {
+	aliases := []string{"#first:localhost", "#second:localhost"}
+	testCases := []struct {
+		name     string
+		body     string
+		userID   string
+		wantCode int
+	}{
+		{"member of a shared room", `{"preset":"public_chat"}`, "@alice:localhost", http.StatusOK},
+		{"non-member of a shared room", `{"preset":"public_chat"}`, "@dave:localhost", http.StatusForbidden},
+		{"non-member of a world-readable room", `{
+			"preset": "public_chat",
+			"initial_state": [{"type": "m.room.history_visibility", "content": {"history_visibility": "world_readable"}}]
+		}`, "@dave:localhost", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		rsAPI := &aliasesRoomserverAPI{fakeRoomserverAPI: mustCreateRoom(t, tc.body), aliases: aliases}
+		req := httptest.NewRequest(http.MethodGet, "/rooms/!room:localhost/aliases", nil)
+		res := GetAliases(req, rsAPI, &api.Device{UserID: tc.userID}, "!room:localhost")
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal response: %s", tc.name, err)
+		}
+		var got roomAliasesResponse
+		if err = json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("%s: failed to unmarshal response: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(got.Aliases, aliases) {
+			t.Errorf("%s: got aliases %v, want %v", tc.name, got.Aliases, aliases)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// contentValidator checks that the content of an event is well formed.
+type contentValidator func(content gjson.Result) error
+
+// stateContentValidators are the validators for the content of state events
+// with well-known types. To validate another event type, add it here.
+var stateContentValidators = map[string]contentValidator{
+	"m.room.name":               requireString("name"),
+	"m.room.topic":              requireString("topic"),
+	"m.room.join_rules":         requireString("join_rule"),
+	"m.room.history_visibility": requireString("history_visibility"),
+	"m.room.guest_access":       requireString("guest_access"),
+	"m.room.avatar":             optionalString("url"),
+	"m.room.canonical_alias":    allOf(optionalString("alias"), optionalStringArray("alt_aliases")),
+}
+
+// validateStateContent returns an error if the content of a state event of
+// the given type is malformed. Event types without a validator are allowed.
+func validateStateContent(eventType string, content []byte) error {
+	validate, ok := stateContentValidators[eventType]
+	if !ok {
+		return nil
+	}
+	return validate(gjson.ParseBytes(content))
+}
+
+// requireString returns a validator which checks that the key is a string.
+func requireString(key string) contentValidator {
+	return func(content gjson.Result) error {
+		if value := content.Get(key); value.Type != gjson.String {
+			return fmt.Errorf("'%s' must be a string", key)
+		}
+		return nil
+	}
+}
+
+// optionalString returns a validator which checks that the key is a string,
+// if it is there.
+func optionalString(key string) contentValidator {
+	return func(content gjson.Result) error {
+		if value := content.Get(key); value.Exists() && value.Type != gjson.String {
+			return fmt.Errorf("'%s' must be a string", key)
+		}
+		return nil
+	}
+}
+
+// optionalStringArray returns a validator which checks that the key is an
+// array of strings, if it is there.
+func optionalStringArray(key string) contentValidator {
+	return func(content gjson.Result) error {
+		value := content.Get(key)
+		if !value.Exists() {
+			return nil
+		}
+		if !value.IsArray() {
+			return fmt.Errorf("'%s' must be an array of strings", key)
+		}
+		for _, item := range value.Array() {
+			if item.Type != gjson.String {
+				return fmt.Errorf("'%s' must be an array of strings", key)
+			}
+		}
+		return nil
+	}
+}
+
+// allOf returns a validator which checks all of the given validators.
+func allOf(validators ...contentValidator) contentValidator {
+	return func(content gjson.Result) error {
+		for _, validate := range validators {
+			if err := validate(content); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
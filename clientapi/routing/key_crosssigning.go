@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+type crossSigningRequest struct {
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+	UserSigningKey json.RawMessage `json:"user_signing_key,omitempty"`
+}
+
+// UploadCrossSigningDeviceKeys implements POST /keys/device_signing/upload
+func UploadCrossSigningDeviceKeys(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive,
+	keyAPI api.KeyInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	var r crossSigningRequest
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	// If the client has supplied auth then check it now. Otherwise we'll only
+	// demand it if the keyserver says it's needed to replace existing keys.
+	authenticated := false
+	if gjson.GetBytes(bodyBytes, "auth").Exists() {
+		if _, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device); errRes != nil {
+			return *errRes
+		}
+		authenticated = true
+	}
+
+	uploadReq := &api.PerformUploadDeviceSigningKeysRequest{
+		UserID:         device.UserID,
+		MasterKey:      r.MasterKey,
+		SelfSigningKey: r.SelfSigningKey,
+		UserSigningKey: r.UserSigningKey,
+		Authenticated:  authenticated,
+	}
+	uploadRes := &api.PerformUploadDeviceSigningKeysResponse{}
+	keyAPI.PerformUploadDeviceSigningKeys(ctx, uploadReq, uploadRes)
+
+	if err := uploadRes.Error; err != nil {
+		switch {
+		case err.IsMissingAuth:
+			// There is no auth in the request, so this starts a new session.
+			_, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+			return *errRes
+		case err.IsInvalidSignature:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidSignature(err.Error()),
+			}
+		case err.IsInvalidParam:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(err.Error()),
+			}
+		default:
+			util.GetLogger(ctx).WithError(err).Error("Failed to PerformUploadDeviceSigningKeys")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
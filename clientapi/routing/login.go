@@ -16,7 +16,10 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -44,13 +47,13 @@ type flow struct {
 	Type string `json:"type"`
 }
 
-func passwordLogin() flows {
-	f := flows{}
-	s := flow{
-		Type: "m.login.password",
+func loginFlows() flows {
+	return flows{
+		Flows: []flow{
+			{Type: "m.login.password"},
+			{Type: "m.login.token"},
+		},
 	}
-	f.Flows = append(f.Flows, s)
-	return f
 }
 
 // Login implements GET and POST /login
@@ -59,22 +62,50 @@ func Login(
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login other than password, depending on config options
+		// TODO: support other forms of login, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlows(),
 		}
 	} else if req.Method == http.MethodPost {
-		typePassword := auth.LoginTypePassword{
-			GetAccountByPassword: accountDB.GetAccountByPassword,
-			Config:               cfg,
-		}
-		r := typePassword.Request()
-		resErr := httputil.UnmarshalJSONRequest(req, r)
-		if resErr != nil {
+		var body json.RawMessage
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
 			return *resErr
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(body, &header); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+		var loginType auth.Type
+		switch header.Type {
+		case "m.login.token":
+			loginType = &auth.LoginTypeToken{
+				UserAPI: userAPI,
+			}
+		case "m.login.password", "":
+			loginType = &auth.LoginTypePassword{
+				GetAccountByPassword: accountDB.GetAccountByPassword,
+				Config:               cfg,
+			}
+		default:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("Unknown login type " + header.Type),
+			}
+		}
+		r := loginType.Request()
+		if err := json.Unmarshal(body, r); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+		login, authErr := loginType.Login(req.Context(), r)
 		if authErr != nil {
 			return *authErr
 		}
@@ -87,6 +118,63 @@ func Login(
 	}
 }
 
+type loginTokenResponse struct {
+	LoginToken  string `json:"login_token"`
+	ExpiresInMS int64  `json:"expires_in_ms"`
+}
+
+// GetLoginToken implements POST /login/get_token, which issues a single-use
+// token that can be exchanged for a new access token using m.login.token.
+// As the token can be used to log in as the user, they have to complete
+// user-interactive auth first.
+func GetLoginToken(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, userAPI userapi.UserInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// make sure that the access token being used matches the login creds used for user interactive auth, else
+	// 1 compromised access token could be used to log in as the user elsewhere.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot get a login token for another user"),
+		}
+	}
+
+	var res userapi.PerformLoginTokenCreationResponse
+	if err = userAPI.PerformLoginTokenCreation(ctx, &userapi.PerformLoginTokenCreationRequest{
+		UserID: device.UserID,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformLoginTokenCreation failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: loginTokenResponse{
+			LoginToken:  res.Token,
+			ExpiresInMS: res.ExpiresAtMS - time.Now().UnixNano()/int64(time.Millisecond),
+		},
+	}
+}
+
 func completeAuth(
 	ctx context.Context, serverName gomatrixserverlib.ServerName, userAPI userapi.UserInternalAPI, login *auth.Login,
 	ipAddr, userAgent string,
@@ -118,6 +206,12 @@ func completeAuth(
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 		}
 	}
+	if performRes.Err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(performRes.Err.Message),
+		}
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -0,0 +1,78 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestGetLoginTokenRequiresUserInteractiveAuth(t *testing.T) {
+	cfg := testCreateRoomConfig()
+	userAPI := userapi.NewInternalAPI(mustCreateAccountDB(t), &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: "localhost",
+		},
+		LoginTokenLifetimeMS: config.DefaultLoginTokenLifetimeMS,
+	}, nil, &nopKeyAPI{}, nil, mustCreateCache(t))
+	userInteractiveAuth := auth.NewUserInteractive(func(ctx context.Context, localpart, password string) (*api.Account, error) {
+		if password != localpart+"password" {
+			return nil, errors.New("wrong password")
+		}
+		return &api.Account{Localpart: localpart, ServerName: "localhost"}, nil
+	}, cfg)
+	device := &api.Device{UserID: "@alice:localhost", ID: "ALICE"}
+
+	getLoginToken := func(body string) (int, interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/login/get_token", strings.NewReader(body))
+		res := GetLoginToken(req, userInteractiveAuth, userAPI, device)
+		return res.Code, res.JSON
+	}
+
+	// Without an auth dict the client is told which flows it can use.
+	if code, _ := getLoginToken(`{}`); code != http.StatusUnauthorized {
+		t.Errorf("got HTTP %d without auth, want %d", code, http.StatusUnauthorized)
+	}
+	// The wrong password is rejected.
+	if code, _ := getLoginToken(`{"auth":{"type":"m.login.password","user":"alice","password":"wrong"}}`); code != http.StatusUnauthorized {
+		t.Errorf("got HTTP %d with the wrong password, want %d", code, http.StatusUnauthorized)
+	}
+	// Authenticating as somebody else doesn't get a token for this user.
+	if code, _ := getLoginToken(`{"auth":{"type":"m.login.password","user":"dave","password":"davepassword"}}`); code != http.StatusForbidden {
+		t.Errorf("got HTTP %d when authenticating as another user, want %d", code, http.StatusForbidden)
+	}
+	code, res := getLoginToken(`{"auth":{"type":"m.login.password","user":"alice","password":"alicepassword"}}`)
+	if code != http.StatusOK {
+		t.Fatalf("got HTTP %d with the right password, want %d: %+v", code, http.StatusOK, res)
+	}
+	if token := res.(loginTokenResponse); token.LoginToken == "" || token.ExpiresInMS <= 0 {
+		t.Errorf("got unexpected login token response %+v", token)
+	}
+}
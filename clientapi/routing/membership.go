@@ -47,6 +47,20 @@ func SendBan(
 	if reqErr != nil {
 		return *reqErr
 	}
+	if body.UserID == "" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("missing user_id"),
+		}
+	}
+
+	errRes := checkMemberInRoom(req.Context(), rsAPI, device.UserID, roomID)
+	if errRes != nil {
+		return *errRes
+	}
+
+	// The ban replaces any other membership the user has, so a banned user
+	// who was joined is removed from the room at the same time.
 	return sendMembership(req.Context(), accountDB, device, roomID, "ban", body.Reason, cfg, body.UserID, evTime, roomVer, rsAPI, asAPI)
 }
 
@@ -69,6 +83,11 @@ func sendMembership(ctx context.Context, accountDB accounts.Database, device *us
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound(err.Error()),
 		}
+	} else if e, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(e.Message),
+		}
 	} else if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("buildMembershipEvent failed")
 		return jsonerror.InternalServerError()
@@ -207,6 +226,11 @@ func SendInvite(
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound(err.Error()),
 		}
+	} else if e, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(e.Message),
+		}
 	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
 		return jsonerror.InternalServerError()
@@ -268,7 +292,23 @@ func buildMembershipEvent(
 		return nil, err
 	}
 
-	return eventutil.QueryAndBuildEvent(ctx, &builder, cfg.Matrix, evTime, rsAPI, nil)
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(ctx, &builder, cfg.Matrix, evTime, rsAPI, &queryRes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the power levels now so that we can tell the client why the
+	// membership change isn't allowed, rather than the roomserver rejecting it.
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = queryRes.StateEvents[i].Event
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(event.Event, &provider); err != nil {
+		return nil, err
+	}
+	return event, nil
 }
 
 // loadProfile lookups the profile of a given user from the database and returns
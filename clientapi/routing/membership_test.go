@@ -0,0 +1,160 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+type forgetRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	membership roomserverAPI.QueryMembershipForUserResponse
+	forgotten  []string // room IDs
+}
+
+func (r *forgetRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *roomserverAPI.QueryMembershipForUserRequest, res *roomserverAPI.QueryMembershipForUserResponse) error {
+	*res = r.membership
+	return nil
+}
+
+func (r *forgetRoomserverAPI) PerformForget(ctx context.Context, req *roomserverAPI.PerformForgetRequest, res *roomserverAPI.PerformForgetResponse) error {
+	r.forgotten = append(r.forgotten, req.RoomID)
+	return nil
+}
+
+func TestSendForget(t *testing.T) {
+	testCases := []struct {
+		name       string
+		membership roomserverAPI.QueryMembershipForUserResponse
+		wantCode   int
+	}{
+		{"left", roomserverAPI.QueryMembershipForUserResponse{HasBeenInRoom: true}, http.StatusOK},
+		{"still joined", roomserverAPI.QueryMembershipForUserResponse{HasBeenInRoom: true, IsInRoom: true}, http.StatusBadRequest},
+		{"never joined", roomserverAPI.QueryMembershipForUserResponse{}, http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		rsAPI := &forgetRoomserverAPI{membership: tc.membership}
+		req := httptest.NewRequest(http.MethodPost, "/rooms/!room:localhost/forget", nil)
+		res := SendForget(req, &api.Device{UserID: "@alice:localhost"}, "!room:localhost", rsAPI)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d", tc.name, res.Code, tc.wantCode)
+		}
+		if forgot := len(rsAPI.forgotten) > 0; forgot != (tc.wantCode == http.StatusOK) {
+			t.Errorf("%s: got forgotten rooms %v", tc.name, rsAPI.forgotten)
+		}
+	}
+}
+
+func (r *fakeRoomserverAPI) QueryCurrentState(
+	ctx context.Context, req *roomserverAPI.QueryCurrentStateRequest, res *roomserverAPI.QueryCurrentStateResponse,
+) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, tuple := range req.StateTuples {
+		if ev := r.state(tuple.EventType, tuple.StateKey); ev != nil {
+			res.StateEvents[tuple] = ev
+		}
+	}
+	return nil
+}
+
+func (r *fakeRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *roomserverAPI.QueryMembershipForUserRequest, res *roomserverAPI.QueryMembershipForUserResponse,
+) error {
+	if ev := r.state(gomatrixserverlib.MRoomMember, req.UserID); ev != nil {
+		res.HasBeenInRoom = true
+		res.Membership, _ = ev.Membership()
+		res.IsInRoom = res.Membership == gomatrixserverlib.Join
+	}
+	return nil
+}
+
+func TestKickBanUnban(t *testing.T) {
+	alice, dave, roomID := "@alice:localhost", "@dave:localhost", "!room:localhost"
+	rsAPI := mustCreateRoom(t, `{"preset":"public_chat"}`)
+	accountDB := mustCreateAccountDB(t)
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		},
+	}
+	aliceDevice, daveDevice := &api.Device{UserID: alice}, &api.Device{UserID: dave}
+	if res := sendMembership(
+		context.Background(), accountDB, daveDevice, roomID, gomatrixserverlib.Join, "", cfg, dave,
+		time.Now(), rsAPI.events[0].RoomVersion, rsAPI, nil,
+	); res.Code != http.StatusOK {
+		t.Fatalf("failed to join dave: HTTP %d: %+v", res.Code, res.JSON)
+	}
+
+	testCases := []struct {
+		name           string
+		device         *api.Device
+		endpoint       string
+		target         string
+		wantCode       int
+		wantMembership string // of the target afterwards
+	}{
+		{"dave can't kick alice", daveDevice, "kick", alice, http.StatusForbidden, gomatrixserverlib.Join},
+		{"dave can't ban alice", daveDevice, "ban", alice, http.StatusForbidden, gomatrixserverlib.Join},
+		{"alice bans dave", aliceDevice, "ban", dave, http.StatusOK, gomatrixserverlib.Ban},
+		{"alice can't kick a banned user", aliceDevice, "kick", dave, http.StatusForbidden, gomatrixserverlib.Ban},
+		{"alice unbans dave", aliceDevice, "unban", dave, http.StatusOK, gomatrixserverlib.Leave},
+	}
+	for _, tc := range testCases {
+		sent := len(rsAPI.events)
+		req := httptest.NewRequest(
+			http.MethodPost, "/rooms/"+roomID+"/"+tc.endpoint,
+			strings.NewReader(`{"user_id":"`+tc.target+`","reason":"`+tc.name+`"}`),
+		)
+		var res util.JSONResponse
+		switch tc.endpoint {
+		case "kick":
+			res = SendKick(req, accountDB, tc.device, roomID, cfg, rsAPI, nil)
+		case "ban":
+			res = SendBan(req, accountDB, tc.device, roomID, cfg, rsAPI, nil)
+		case "unban":
+			res = SendUnban(req, accountDB, tc.device, roomID, cfg, rsAPI, nil)
+		}
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+		}
+		if wantSent := tc.wantCode == http.StatusOK; (len(rsAPI.events) > sent) != wantSent {
+			t.Errorf("%s: got event sent %v, want %v", tc.name, len(rsAPI.events) > sent, wantSent)
+		}
+		member := rsAPI.state(gomatrixserverlib.MRoomMember, tc.target)
+		if membership, _ := member.Membership(); membership != tc.wantMembership {
+			t.Errorf("%s: got membership %q, want %q", tc.name, membership, tc.wantMembership)
+		}
+		if tc.wantCode == http.StatusOK {
+			if reason := gjson.GetBytes(member.Content(), "reason").Str; reason != tc.name {
+				t.Errorf("%s: got reason %q", tc.name, reason)
+			}
+		}
+	}
+}
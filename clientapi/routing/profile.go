@@ -334,7 +334,9 @@ func getProfile(
 	}
 
 	profile, err := appserviceAPI.RetrieveUserProfile(ctx, userID, asAPI, accountDB)
-	if err != nil {
+	if err == appserviceAPI.ErrProfileNotExists {
+		return nil, eventutil.ErrProfileNoExists
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -19,6 +19,7 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -34,6 +35,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -150,6 +152,8 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Registration token
+	Token string `json:"token"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -220,6 +224,26 @@ func validateUsername(username string) *util.JSONResponse {
 	return nil
 }
 
+// validateUsernameRules returns an error response if the username is one
+// that the server admin has reserved, or doesn't match the username regex.
+func validateUsernameRules(cfg *config.ClientAPI, username string) *util.JSONResponse {
+	for _, reserved := range cfg.ReservedUsernames {
+		if strings.EqualFold(username, reserved) {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidUsername("Username is reserved"),
+			}
+		}
+	}
+	if cfg.UsernameRegexp != nil && !cfg.UsernameRegexp.MatchString(username) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidUsername("Username isn't allowed on this server"),
+		}
+	}
+	return nil
+}
+
 // validateApplicationServiceUsername returns an error response if the username is invalid for an application service
 func validateApplicationServiceUsername(username string) *util.JSONResponse {
 	if len(username) > maxUsernameLength {
@@ -461,6 +485,7 @@ func Register(
 	userAPI userapi.UserInternalAPI,
 	accountDB accounts.Database,
 	cfg *config.ClientAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	var r registerRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -486,7 +511,8 @@ func Register(
 		}
 	}
 	// Auto generate a numeric username if r.Username is empty
-	if r.Username == "" {
+	chosenUsername := r.Username != ""
+	if !chosenUsername {
 		id, err := accountDB.GetNewNumericLocalpart(req.Context())
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetNewNumericLocalpart failed")
@@ -499,11 +525,22 @@ func Register(
 	// Squash username to all lowercase letters
 	r.Username = strings.ToLower(r.Username)
 
-	if resErr = validateUsername(r.Username); resErr != nil {
-		return *resErr
-	}
-	if resErr = validatePassword(r.Password); resErr != nil {
-		return *resErr
+	// Application services are checked against their namespaces instead, in
+	// validateApplicationService, and don't have passwords.
+	if !isApplicationServiceRegistration(req, r) {
+		if resErr = validateUsername(r.Username); resErr != nil {
+			return *resErr
+		}
+		// The server admin can still register reserved usernames with the
+		// shared secret.
+		if chosenUsername && r.Auth.Type != authtypes.LoginTypeSharedSecret {
+			if resErr = validateUsernameRules(cfg, r.Username); resErr != nil {
+				return *resErr
+			}
+		}
+		if resErr = validatePassword(r.Password); resErr != nil {
+			return *resErr
+		}
 	}
 
 	logger := util.GetLogger(req.Context())
@@ -513,7 +550,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, spamChecker)
 }
 
 func handleGuestRegistration(
@@ -559,6 +596,12 @@ func handleGuestRegistration(
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 		}
 	}
+	if devRes.Err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(devRes.Err.Message),
+		}
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
@@ -579,6 +622,7 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	// TODO: Shared secret registration (create new user scripts)
 	// TODO: Enable registration config flag
@@ -592,15 +636,17 @@ func handleRegistrationFlow(
 
 	// Appservices are special and are not affected by disabled
 	// registration or user exclusivity.
-	if r.Auth.Type == authtypes.LoginTypeApplicationService ||
-		(r.Auth.Type == "" && accessTokenErr == nil) {
+	if isApplicationServiceRegistration(req, r) {
 		return handleApplicationServiceRegistration(
-			accessToken, accessTokenErr, req, r, cfg, userAPI,
+			accessToken, accessTokenErr, req, r, cfg, userAPI, spamChecker,
 		)
 	}
 
 	if cfg.RegistrationDisabled && r.Auth.Type != authtypes.LoginTypeSharedSecret {
-		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration has been disabled"),
+		}
 	}
 
 	// Make sure normal user isn't registering under an exclusive application
@@ -626,6 +672,18 @@ func handleRegistrationFlow(
 		// Add Recaptcha to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
 
+	case authtypes.LoginTypeRegistrationToken:
+		// Check the given token against the ones in the config
+		if !isValidRegistrationToken(cfg, r.Auth.Token) {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("Invalid registration token"),
+			}
+		}
+
+		// Add RegistrationToken to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
 	case authtypes.LoginTypeSharedSecret:
 		// Check shared secret against config
 		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Auth.Mac)
@@ -660,7 +718,16 @@ func handleRegistrationFlow(
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
 	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+		req, r, sessionID, cfg, userAPI, spamChecker)
+}
+
+// isApplicationServiceRegistration returns true if the request is from an
+// application service registering one of its users, which is the case if it
+// says so or if it has an access token but no other auth.
+func isApplicationServiceRegistration(req *http.Request, r registerRequest) bool {
+	_, accessTokenErr := auth.ExtractAccessToken(req)
+	return r.Auth.Type == authtypes.LoginTypeApplicationService ||
+		(r.Auth.Type == "" && accessTokenErr == nil)
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -678,6 +745,7 @@ func handleApplicationServiceRegistration(
 	r registerRequest,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	// Check if we previously had issues extracting the access token from the
 	// request.
@@ -701,8 +769,8 @@ func handleApplicationServiceRegistration(
 	// Don't need to worry about appending to registration stages as
 	// application service registration is entirely separate.
 	return completeRegistration(
-		req.Context(), userAPI, r.Username, "", appserviceID, req.RemoteAddr, req.UserAgent(),
-		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		req.Context(), userAPI, spamChecker, r.Username, "", appserviceID, req.RemoteAddr, req.UserAgent(),
+		r.InhibitLogin, r.InitialDisplayName, r.DeviceID, userapi.AccountTypeUser,
 	)
 }
 
@@ -716,12 +784,13 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
 		return completeRegistration(
-			req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
-			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			req.Context(), userAPI, spamChecker, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
+			r.InhibitLogin, r.InitialDisplayName, r.DeviceID, userapi.AccountTypeUser,
 		)
 	}
 
@@ -739,6 +808,7 @@ func LegacyRegister(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
 	cfg *config.ClientAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	var r legacyRegisterRequest
 	resErr := parseAndValidateLegacyLogin(req, &r)
@@ -752,8 +822,13 @@ func LegacyRegister(
 		"auth.type": r.Type,
 	}).Info("Processing registration request")
 
-	if cfg.RegistrationDisabled && r.Type != authtypes.LoginTypeSharedSecret {
-		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
+	// The legacy API has no way of passing a registration token, so only
+	// shared secret registration works if a token is required.
+	if (cfg.RegistrationDisabled || cfg.RegistrationRequiresToken) && r.Type != authtypes.LoginTypeSharedSecret {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration has been disabled"),
+		}
 	}
 
 	switch r.Type {
@@ -772,10 +847,12 @@ func LegacyRegister(
 			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
 		}
 
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
+		return completeRegistration(req.Context(), userAPI, spamChecker, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil, userapi.AccountTypeUser)
 	case authtypes.LoginTypeDummy:
-		// there is nothing to do
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
+		if resErr = validateUsernameRules(cfg, r.Username); resErr != nil {
+			return *resErr
+		}
+		return completeRegistration(req.Context(), userAPI, spamChecker, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil, userapi.AccountTypeUser)
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
@@ -822,9 +899,11 @@ func parseAndValidateLegacyLogin(req *http.Request, r *legacyRegisterRequest) *u
 func completeRegistration(
 	ctx context.Context,
 	userAPI userapi.UserInternalAPI,
+	spamChecker spamcheck.Checker,
 	username, password, appserviceID, ipAddr, userAgent string,
 	inhibitLogin eventutil.WeakBoolean,
 	displayName, deviceID *string,
+	accountType userapi.AccountType,
 ) util.JSONResponse {
 	if username == "" {
 		return util.JSONResponse{
@@ -839,13 +918,21 @@ func completeRegistration(
 			JSON: jsonerror.BadJSON("missing password"),
 		}
 	}
+	if appserviceID == "" {
+		if err := spamChecker.CheckRegistrationAllowed(ctx, username, ipAddr, userAgent); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(err.Error()),
+			}
+		}
+	}
 
 	var accRes userapi.PerformAccountCreationResponse
 	err := userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
 		AppServiceID: appserviceID,
 		Localpart:    username,
 		Password:     password,
-		AccountType:  userapi.AccountTypeUser,
+		AccountType:  accountType,
 		OnConflict:   userapi.ConflictAbort,
 	}, &accRes)
 	if err != nil {
@@ -899,6 +986,12 @@ func completeRegistration(
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 		}
 	}
+	if devRes.Err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(devRes.Err.Message),
+		}
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -911,6 +1004,21 @@ func completeRegistration(
 	}
 }
 
+// isValidRegistrationToken checks if the token is one of the registration
+// tokens in the config.
+func isValidRegistrationToken(cfg *config.ClientAPI, token string) bool {
+	if token == "" {
+		return false
+	}
+	valid := false
+	for _, t := range cfg.RegistrationTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
 // Used for shared secret registration.
 // Checks if the username, password and isAdmin flag matches the given mac.
 func isValidMacLogin(
@@ -1024,6 +1132,9 @@ func RegisterAvailable(
 	if err := validateUsername(username); err != nil {
 		return *err
 	}
+	if err := validateUsernameRules(cfg, username); err != nil {
+		return *err
+	}
 
 	// Check if this username is reserved by an application service
 	userID := userutil.MakeUserID(username, cfg.Matrix.ServerName)
@@ -1038,10 +1149,8 @@ func RegisterAvailable(
 
 	availability, availabilityErr := accountDB.CheckAccountAvailability(req.Context(), username)
 	if availabilityErr != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: jsonerror.Unknown("failed to check availability: " + availabilityErr.Error()),
-		}
+		util.GetLogger(req.Context()).WithError(availabilityErr).Error("accountDB.CheckAccountAvailability failed")
+		return jsonerror.InternalServerError()
 	}
 	if !availability {
 		return util.JSONResponse{
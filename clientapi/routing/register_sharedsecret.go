@@ -0,0 +1,176 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+const (
+	sharedSecretNonceLength   = 32
+	sharedSecretNonceLifetime = time.Minute
+	// sharedSecretMaxNonces is the most nonces that can be outstanding at
+	// once, as anyone can ask for a nonce.
+	sharedSecretMaxNonces = 1000
+)
+
+// sharedSecretRegistration implements registration with the configured
+// registration_shared_secret, in the same way as Synapse's
+// /_synapse/admin/v1/register. The client fetches a nonce and then sends
+// the new user's details with an HMAC-SHA1, keyed by the shared secret,
+// over the nonce, username, password and admin flag. The nonce can only
+// be used once.
+type sharedSecretRegistration struct {
+	sync.Mutex
+	cfg         *config.ClientAPI
+	spamChecker spamcheck.Checker
+	nonces      map[string]time.Time // nonce -> expiry
+}
+
+type sharedSecretRegistrationRequest struct {
+	Nonce    string `json:"nonce"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+	MAC      string `json:"mac"`
+}
+
+func newSharedSecretRegistration(cfg *config.ClientAPI, spamChecker spamcheck.Checker) *sharedSecretRegistration {
+	return &sharedSecretRegistration{
+		cfg:         cfg,
+		spamChecker: spamChecker,
+		nonces:      make(map[string]time.Time),
+	}
+}
+
+// GenerateNonce implements GET /_dendrite/admin/register, returning a nonce
+// to use in a registration request.
+func (s *sharedSecretRegistration) GenerateNonce() util.JSONResponse {
+	if s.cfg.RegistrationSharedSecret == "" {
+		return util.MessageResponse(http.StatusBadRequest, "Shared secret registration is disabled")
+	}
+	nonce := util.RandomString(sharedSecretNonceLength)
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+	for n, expiry := range s.nonces {
+		if now.After(expiry) {
+			delete(s.nonces, n)
+		}
+	}
+	if len(s.nonces) >= sharedSecretMaxNonces {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many outstanding nonces", sharedSecretNonceLifetime.Milliseconds()),
+		}
+	}
+	s.nonces[nonce] = now.Add(sharedSecretNonceLifetime)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Nonce string `json:"nonce"`
+		}{nonce},
+	}
+}
+
+// Register implements POST /_dendrite/admin/register, creating the account
+// if the request has a valid nonce and HMAC. Admin requests create admin
+// accounts.
+func (s *sharedSecretRegistration) Register(req *http.Request, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	if s.cfg.RegistrationSharedSecret == "" {
+		return util.MessageResponse(http.StatusBadRequest, "Shared secret registration is disabled")
+	}
+	var r sharedSecretRegistrationRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if !s.consumeNonce(r.Nonce) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unrecognised nonce"),
+		}
+	}
+
+	// The MAC is over the username as the client sent it.
+	if !s.validMAC(r) {
+		return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
+	}
+	r.Username = strings.ToLower(r.Username)
+	if resErr := validateUsername(r.Username); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePassword(r.Password); resErr != nil {
+		return *resErr
+	}
+
+	accountType := userapi.AccountTypeUser
+	if r.Admin {
+		accountType = userapi.AccountTypeAdmin
+	}
+	return completeRegistration(
+		req.Context(), userAPI, s.spamChecker, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
+		false, nil, nil, accountType,
+	)
+}
+
+// consumeNonce returns true if the nonce was issued and hasn't expired, and
+// makes sure that it can't be used again.
+func (s *sharedSecretRegistration) consumeNonce(nonce string) bool {
+	s.Lock()
+	defer s.Unlock()
+	expiry, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return time.Now().Before(expiry)
+}
+
+// validMAC checks the hex-encoded HMAC in the request against the one we
+// expect for the nonce, username, password and admin flag.
+func (s *sharedSecretRegistration) validMAC(r sharedSecretRegistrationRequest) bool {
+	givenMAC, err := hex.DecodeString(r.MAC)
+	if err != nil {
+		return false
+	}
+	// The fields are separated by NUL bytes, so they can't contain any.
+	for _, field := range []string{r.Nonce, r.Username, r.Password} {
+		if strings.Contains(field, "\x00") {
+			return false
+		}
+	}
+	adminString := "notadmin"
+	if r.Admin {
+		adminString = "admin"
+	}
+	mac := hmac.New(sha1.New, []byte(s.cfg.RegistrationSharedSecret))
+	_, _ = mac.Write([]byte(strings.Join([]string{r.Nonce, r.Username, r.Password, adminString}, "\x00")))
+	return hmac.Equal(givenMAC, mac.Sum(nil))
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const testSharedSecret = "s3cr3t"
+
+func sharedSecretMAC(secret, nonce, username, password, admin string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	_, _ = mac.Write([]byte(strings.Join([]string{nonce, username, password, admin}, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSharedSecretRegistration(t *testing.T) {
+	accountDB := mustCreateAccountDB(t)
+	userAPI := userapi.NewInternalAPI(accountDB, &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: "localhost",
+		},
+	}, nil, &nopKeyAPI{}, nil, mustCreateCache(t))
+	s := newSharedSecretRegistration(&config.ClientAPI{
+		Matrix:                   &config.Global{ServerName: "localhost"},
+		RegistrationSharedSecret: testSharedSecret,
+	}, spamcheck.NopChecker{})
+
+	getNonce := func() string {
+		res := s.GenerateNonce()
+		if res.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d fetching a nonce", res.Code)
+		}
+		body, _ := json.Marshal(res.JSON)
+		var nonce struct {
+			Nonce string `json:"nonce"`
+		}
+		if err := json.Unmarshal(body, &nonce); err != nil || nonce.Nonce == "" {
+			t.Fatalf("got nonce response %s", body)
+		}
+		return nonce.Nonce
+	}
+	register := func(r sharedSecretRegistrationRequest) int {
+		body, _ := json.Marshal(r)
+		req := httptest.NewRequest(http.MethodPost, "/admin/register", strings.NewReader(string(body)))
+		return s.Register(req, userAPI).Code
+	}
+
+	// A MAC made with the wrong secret, or over different fields, is rejected.
+	nonce := getNonce()
+	if code := register(sharedSecretRegistrationRequest{
+		Nonce: nonce, Username: "bob", Password: "password1234",
+		MAC: sharedSecretMAC("wrong", nonce, "bob", "password1234", "notadmin"),
+	}); code != http.StatusForbidden {
+		t.Errorf("got HTTP %d for a MAC with the wrong secret, want %d", code, http.StatusForbidden)
+	}
+	nonce = getNonce()
+	if code := register(sharedSecretRegistrationRequest{
+		Nonce: nonce, Username: "bob", Password: "password1234", Admin: true,
+		MAC: sharedSecretMAC(testSharedSecret, nonce, "bob", "password1234", "notadmin"),
+	}); code != http.StatusForbidden {
+		t.Errorf("got HTTP %d for a MAC without the admin flag, want %d", code, http.StatusForbidden)
+	}
+	if code := register(sharedSecretRegistrationRequest{
+		Nonce: "unknown", Username: "bob", Password: "password1234",
+		MAC: sharedSecretMAC(testSharedSecret, "unknown", "bob", "password1234", "notadmin"),
+	}); code != http.StatusBadRequest {
+		t.Errorf("got HTTP %d for an unknown nonce, want %d", code, http.StatusBadRequest)
+	}
+
+	// A valid MAC creates the account, as an admin if asked for.
+	nonce = getNonce()
+	valid := sharedSecretRegistrationRequest{
+		Nonce: nonce, Username: "bob", Password: "password1234", Admin: true,
+		MAC: sharedSecretMAC(testSharedSecret, nonce, "bob", "password1234", "admin"),
+	}
+	if code := register(valid); code != http.StatusOK {
+		t.Fatalf("got HTTP %d for a valid MAC, want %d", code, http.StatusOK)
+	}
+	acc, err := accountDB.GetAccountByLocalpart(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("failed to get account: %s", err)
+	}
+	if acc.AccountType != api.AccountTypeAdmin {
+		t.Errorf("got account type %d, want admin", acc.AccountType)
+	}
+
+	// The nonce can't be used again.
+	valid.Username = "charlie"
+	valid.MAC = sharedSecretMAC(testSharedSecret, nonce, "charlie", "password1234", "admin")
+	if code := register(valid); code != http.StatusBadRequest {
+		t.Errorf("got HTTP %d reusing a nonce, want %d", code, http.StatusBadRequest)
+	}
+
+	// The MAC is checked against the username as it was sent, before it is
+	// lowercased.
+	nonce = getNonce()
+	if code := register(sharedSecretRegistrationRequest{
+		Nonce: nonce, Username: "Dave", Password: "password1234",
+		MAC: sharedSecretMAC(testSharedSecret, nonce, "Dave", "password1234", "notadmin"),
+	}); code != http.StatusOK {
+		t.Fatalf("got HTTP %d for a MAC over a mixed case username, want %d", code, http.StatusOK)
+	}
+	if _, err = accountDB.GetAccountByLocalpart(context.Background(), "dave"); err != nil {
+		t.Errorf("failed to get account: %s", err)
+	}
+
+	// Expired nonces are rejected.
+	nonce = getNonce()
+	s.nonces[nonce] = time.Now().Add(-time.Second)
+	if code := register(sharedSecretRegistrationRequest{
+		Nonce: nonce, Username: "eve", Password: "password1234",
+		MAC: sharedSecretMAC(testSharedSecret, nonce, "eve", "password1234", "notadmin"),
+	}); code != http.StatusBadRequest {
+		t.Errorf("got HTTP %d for an expired nonce, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestSharedSecretNonceLimit(t *testing.T) {
+	s := newSharedSecretRegistration(&config.ClientAPI{
+		Matrix:                   &config.Global{ServerName: "localhost"},
+		RegistrationSharedSecret: testSharedSecret,
+	}, spamcheck.NopChecker{})
+	for i := 0; i < sharedSecretMaxNonces; i++ {
+		if res := s.GenerateNonce(); res.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d fetching nonce %d", res.Code, i)
+		}
+	}
+	if res := s.GenerateNonce(); res.Code != http.StatusTooManyRequests {
+		t.Errorf("got HTTP %d with too many outstanding nonces, want %d", res.Code, http.StatusTooManyRequests)
+	}
+
+	// Expired nonces are evicted to make room for new ones.
+	for nonce := range s.nonces {
+		s.nonces[nonce] = time.Now().Add(-time.Second)
+	}
+	if res := s.GenerateNonce(); res.Code != http.StatusOK {
+		t.Errorf("got HTTP %d after the nonces expired, want %d", res.Code, http.StatusOK)
+	}
+	if len(s.nonces) != 1 {
+		t.Errorf("got %d outstanding nonces, want 1", len(s.nonces))
+	}
+}
@@ -15,11 +15,20 @@
 package routing
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 )
 
 var (
@@ -208,3 +217,214 @@ func TestValidationOfApplicationServices(t *testing.T) {
 		t.Errorf("user_id should not have been valid: @_something_else:localhost")
 	}
 }
+
+// registrationTester sends /register requests to a homeserver with the local
+// users alice and dave, and an application service which owns @_appservice_.*
+type registrationTester struct {
+	t         *testing.T
+	cfg       *config.Dendrite
+	accountDB accounts.Database
+}
+
+func newRegistrationTester(t *testing.T, configure func(c *config.ClientAPI)) *registrationTester {
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+	configure(&cfg.ClientAPI)
+	if err := cfg.Derive(); err != nil {
+		t.Fatalf("failed to derive config: %s", err)
+	}
+	regex := "@_appservice_.*"
+	cfg.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:              "FakeAS",
+		URL:             "null",
+		ASToken:         "1234",
+		HSToken:         "4321",
+		SenderLocalpart: "_appservice_bot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {{Exclusive: true, Regex: regex, RegexpObject: regexp.MustCompile(regex)}},
+		},
+	}}
+	return &registrationTester{t: t, cfg: cfg, accountDB: mustCreateAccountDB(t)}
+}
+
+// register sends the request body, with the access token if there is one,
+// and returns the response code and its errcode or flows.
+func (r *registrationTester) register(body, accessToken string) (code int, errcode string, flows []authtypes.Flow) {
+	r.t.Helper()
+	userAPI := userapi.NewInternalAPI(r.accountDB, &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: "localhost",
+		},
+	}, nil, &nopKeyAPI{}, nil, mustCreateCache(r.t))
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	res := Register(req, userAPI, r.accountDB, &r.cfg.ClientAPI, spamcheck.NopChecker{})
+	switch j := res.JSON.(type) {
+	case *jsonerror.MatrixError:
+		errcode = j.ErrCode
+	case userInteractiveResponse:
+		flows = j.Flows
+	default:
+		if res.Code != http.StatusOK {
+			b, _ := json.Marshal(res.JSON)
+			r.t.Fatalf("got unexpected HTTP %d response %s", res.Code, b)
+		}
+	}
+	return res.Code, errcode, flows
+}
+
+func TestRegistrationDisabled(t *testing.T) {
+	r := newRegistrationTester(t, func(c *config.ClientAPI) {
+		c.RegistrationDisabled = true
+	})
+
+	// A normal signup is forbidden.
+	code, errcode, _ := r.register(`{"username":"bob","password":"password1234","auth":{"type":"m.login.dummy"}}`, "")
+	if code != http.StatusForbidden || errcode != "M_FORBIDDEN" {
+		t.Errorf("got HTTP %d %s for a normal signup, want HTTP %d M_FORBIDDEN", code, errcode, http.StatusForbidden)
+	}
+
+	// The application service can still register its users.
+	code, errcode, _ = r.register(`{"type":"m.login.application_service","username":"_appservice_bob"}`, "1234")
+	if code != http.StatusOK {
+		t.Errorf("got HTTP %d %s for an application service signup, want HTTP %d", code, errcode, http.StatusOK)
+	}
+}
+
+func TestRegistrationRequiresToken(t *testing.T) {
+	r := newRegistrationTester(t, func(c *config.ClientAPI) {
+		c.RegistrationRequiresToken = true
+		c.RegistrationTokens = []string{"invite-me"}
+	})
+
+	// The only flow asks for a registration token.
+	code, _, flows := r.register(`{"username":"bob","password":"password1234","auth":{"session":"bobsession"}}`, "")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("got HTTP %d asking for the flows, want %d", code, http.StatusUnauthorized)
+	}
+	if len(flows) != 1 || len(flows[0].Stages) != 1 || flows[0].Stages[0] != authtypes.LoginTypeRegistrationToken {
+		t.Fatalf("got flows %+v, want a single registration token flow", flows)
+	}
+
+	// The dummy stage isn't enough, and neither is the wrong token.
+	code, _, _ = r.register(`{"username":"bob","password":"password1234","auth":{"session":"bobsession","type":"m.login.dummy"}}`, "")
+	if code != http.StatusUnauthorized {
+		t.Errorf("got HTTP %d for a dummy signup, want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = r.register(`{"username":"bob","password":"password1234","auth":{"session":"bobsession","type":"m.login.registration_token","token":"wrong"}}`, "")
+	if code != http.StatusUnauthorized {
+		t.Errorf("got HTTP %d for the wrong token, want %d", code, http.StatusUnauthorized)
+	}
+
+	// The right token completes the registration.
+	code, errcode, _ := r.register(`{"username":"bob","password":"password1234","auth":{"session":"bobsession","type":"m.login.registration_token","token":"invite-me"}}`, "")
+	if code != http.StatusOK {
+		t.Errorf("got HTTP %d %s for the right token, want %d", code, errcode, http.StatusOK)
+	}
+
+	// The application service doesn't need a token.
+	code, errcode, _ = r.register(`{"type":"m.login.application_service","username":"_appservice_bob"}`, "1234")
+	if code != http.StatusOK {
+		t.Errorf("got HTTP %d %s for an application service signup, want HTTP %d", code, errcode, http.StatusOK)
+	}
+}
+
+func TestRegisterAvailable(t *testing.T) {
+	r := newRegistrationTester(t, func(c *config.ClientAPI) {})
+	// An IRC bridge owns its users exclusively, but other bridges can share
+	// their namespace with real users.
+	for _, ns := range []struct {
+		regex     string
+		exclusive bool
+	}{
+		{"@irc_.*", true},
+		{"@bridge_.*", false},
+	} {
+		r.cfg.Derived.ApplicationServices = append(r.cfg.Derived.ApplicationServices, config.ApplicationService{
+			ID:      ns.regex,
+			ASToken: ns.regex,
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {{Exclusive: ns.exclusive, Regex: ns.regex, RegexpObject: regexp.MustCompile(ns.regex)}},
+			},
+		})
+	}
+
+	for _, tc := range []struct {
+		username    string
+		wantCode    int
+		wantErrCode string
+	}{
+		// Nobody has registered bob yet.
+		{"bob", http.StatusOK, ""},
+		// Alice already has an account, whatever the case.
+		{"alice", http.StatusBadRequest, "M_USER_IN_USE"},
+		{"Alice", http.StatusBadRequest, "M_USER_IN_USE"},
+		// The IRC bridge has reserved its users, but the other bridge hasn't.
+		{"irc_bob", http.StatusBadRequest, "M_USER_IN_USE"},
+		{"bridge_bob", http.StatusOK, ""},
+		// Usernames which couldn't be registered anyway.
+		{"", http.StatusBadRequest, "M_INVALID_USERNAME"},
+		{"bob:localhost", http.StatusBadRequest, "M_INVALID_USERNAME"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/register/available?username="+url.QueryEscape(tc.username), nil)
+		res := RegisterAvailable(req, &r.cfg.ClientAPI, r.accountDB)
+		if res.Code != tc.wantCode {
+			t.Errorf("%q: got HTTP %d %+v, want HTTP %d", tc.username, res.Code, res.JSON, tc.wantCode)
+			continue
+		}
+		switch j := res.JSON.(type) {
+		case *jsonerror.MatrixError:
+			if j.ErrCode != tc.wantErrCode {
+				t.Errorf("%q: got errcode %s, want %s", tc.username, j.ErrCode, tc.wantErrCode)
+			}
+		case availableResponse:
+			if !j.Available || tc.wantErrCode != "" {
+				t.Errorf("%q: got available=%v, want errcode %s", tc.username, j.Available, tc.wantErrCode)
+			}
+		default:
+			t.Errorf("%q: got unexpected response %+v", tc.username, res.JSON)
+		}
+	}
+}
+
+func TestRegistrationUsernameRules(t *testing.T) {
+	r := newRegistrationTester(t, func(c *config.ClientAPI) {
+		c.ReservedUsernames = []string{"admin", "system"}
+		c.UsernameRegex = "^[a-z0-9]+$"
+	})
+
+	for _, tc := range []struct {
+		username    string
+		wantCode    int
+		wantErrCode string
+	}{
+		// Reserved usernames are rejected, whatever the case.
+		{"admin", http.StatusBadRequest, "M_INVALID_USERNAME"},
+		{"System", http.StatusBadRequest, "M_INVALID_USERNAME"},
+		// The spec allows dots but the server doesn't.
+		{"bob.smith", http.StatusBadRequest, "M_INVALID_USERNAME"},
+		// Anything else is fine.
+		{"bob", http.StatusOK, ""},
+	} {
+		body := `{"username":"` + tc.username + `","password":"password1234","auth":{"type":"m.login.dummy"}}`
+		code, errcode, _ := r.register(body, "")
+		if code != tc.wantCode || errcode != tc.wantErrCode {
+			t.Errorf("%q: got HTTP %d %s, want HTTP %d %s", tc.username, code, errcode, tc.wantCode, tc.wantErrCode)
+		}
+	}
+
+	// The availability check follows the same rules.
+	req := httptest.NewRequest(http.MethodGet, "/register/available?username=admin", nil)
+	res := RegisterAvailable(req, &r.cfg.ClientAPI, r.accountDB)
+	if j, ok := res.JSON.(*jsonerror.MatrixError); res.Code != http.StatusBadRequest || !ok || j.ErrCode != "M_INVALID_USERNAME" {
+		t.Errorf("got HTTP %d %+v for a reserved username, want HTTP %d M_INVALID_USERNAME", res.Code, res.JSON, http.StatusBadRequest)
+	}
+}
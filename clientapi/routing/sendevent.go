@@ -15,12 +15,14 @@
 package routing
 
 import (
+	"context"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -30,6 +32,7 @@ import (
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-send-eventtype-txnid
@@ -71,6 +74,7 @@ func SendEvent(
 	roomID, eventType string, txnID, stateKey *string,
 	cfg *config.ClientAPI,
 	rsAPI api.RoomserverInternalAPI,
+	eduAPI eduserverAPI.EDUServerInputAPI,
 	txnCache *transactions.Cache,
 ) util.JSONResponse {
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
@@ -123,6 +127,12 @@ func SendEvent(
 		cfg.Matrix.ServerName,
 		txnAndSessionID,
 	); err != nil {
+		if e, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(e.Message),
+			}
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -133,6 +143,13 @@ func SendEvent(
 		"room_version": verRes.RoomVersion,
 	}).Info("Sent event to roomserver")
 
+	// Sending an event counts as being active for presence.
+	if err := eduserverAPI.SendPresenceActivity(
+		req.Context(), eduAPI, device.UserID, eduserverAPI.PresenceOnline, gomatrixserverlib.AsTimestamp(time.Now()),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Warn("eduserverAPI.SendPresenceActivity failed")
+	}
+
 	res := util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: sendEventResponse{e.EventID()},
@@ -186,6 +203,14 @@ func generateSendEvent(
 		resErr := jsonerror.InternalServerError()
 		return nil, &resErr
 	}
+	if stateKey != nil {
+		if err = validateStateContent(eventType, builder.Content); err != nil {
+			return nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(err.Error()),
+			}
+		}
+	}
 
 	var queryRes api.QueryLatestEventsAndStateResponse
 	e, err := eventutil.QueryAndBuildEvent(req.Context(), &builder, cfg.Matrix, evTime, rsAPI, &queryRes)
@@ -228,5 +253,69 @@ func generateSendEvent(
 			JSON: jsonerror.Forbidden(err.Error()), // TODO: Is this error string comprehensible to the client?
 		}
 	}
+	if resErr = validateEdit(req.Context(), e.Event, rsAPI); resErr != nil {
+		return nil, resErr
+	}
 	return e.Event, nil
 }
+
+// validateEdit returns an error response if the event is an edit, i.e. it
+// has an m.replace relation, that isn't allowed. Only the sender of an event
+// can edit it, and the event must exist in the same room. Edits can't be
+// edited themselves, as clients would show the edits of the original event
+// instead. In encrypted rooms m.new_content is inside the ciphertext, so it
+// is only checked for edits that aren't encrypted.
+// See: https://spec.matrix.org/v1.4/client-server-api/#event-replacements
+func validateEdit(ctx context.Context, event *gomatrixserverlib.Event, rsAPI api.RoomserverInternalAPI) *util.JSONResponse {
+	relation := gjson.GetBytes(event.Content(), "m\\.relates_to")
+	if relation.Get("rel_type").Str != "m.replace" {
+		return nil
+	}
+	if event.StateKey() != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("State events can't be edits"),
+		}
+	}
+	if event.Type() != "m.room.encrypted" && !gjson.GetBytes(event.Content(), "m\\.new_content").IsObject() {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Edits must have m.new_content"),
+		}
+	}
+
+	var res api.QueryEventsByIDResponse
+	if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{
+		EventIDs: []string{relation.Get("event_id").Str},
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if len(res.Events) == 0 || res.Events[0].RoomID() != event.RoomID() {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event being edited doesn't exist in this room"),
+		}
+	}
+	original := res.Events[0]
+	if original.Sender() != event.Sender() {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You can only edit your own events"),
+		}
+	}
+	if original.StateKey() != nil || original.Type() != event.Type() {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Edits must have the same type as the event being edited"),
+		}
+	}
+	if gjson.GetBytes(original.Content(), "m\\.relates_to.rel_type").Str == "m.replace" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Edits can't be edited, edit the original event instead"),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal/transactions"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+func (r *fakeRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *roomserverAPI.QueryRoomVersionForRoomRequest, res *roomserverAPI.QueryRoomVersionForRoomResponse,
+) error {
+	res.RoomVersion = r.events[0].RoomVersion
+	return nil
+}
+
+func (r *fakeRoomserverAPI) QueryEventsByID(
+	ctx context.Context, req *roomserverAPI.QueryEventsByIDRequest, res *roomserverAPI.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range req.EventIDs {
+		for _, ev := range r.events {
+			if ev.EventID() == eventID {
+				res.Events = append(res.Events, ev)
+			}
+		}
+	}
+	return nil
+}
+
+// presenceEDUServerAPI remembers the presence updates that are sent to it.
+type presenceEDUServerAPI struct {
+	eduserverAPI.EDUServerInputAPI
+	presence []eduserverAPI.InputPresenceEvent
+}
+
+func (e *presenceEDUServerAPI) InputPresenceEvent(
+	ctx context.Context, req *eduserverAPI.InputPresenceEventRequest, res *eduserverAPI.InputPresenceEventResponse,
+) error {
+	e.presence = append(e.presence, req.InputPresenceEvent)
+	return nil
+}
+
+// messageBlockingChecker refuses messages with a given body.
+type messageBlockingChecker struct {
+	spamcheck.NopChecker
+	body string
+}
+
+func (c *messageBlockingChecker) CheckEventAllowed(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error {
+	if gjson.GetBytes(event.Content(), "body").Str == c.body {
+		return fmt.Errorf("message from %s looks like spam", event.Sender())
+	}
+	return nil
+}
+
+func TestSpamCheckerBlocksMessage(t *testing.T) {
+	rsAPI := mustCreateRoom(t, `{}`)
+	eduAPI := &presenceEDUServerAPI{}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		},
+	}
+	device := &api.Device{UserID: "@alice:localhost", AccessToken: "token"}
+	rsAPI.spamChecker = &messageBlockingChecker{body: "spam"}
+
+	testCases := []struct {
+		body     string
+		wantCode int
+	}{
+		{"spam", http.StatusForbidden},
+		{"hello", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		sent := len(rsAPI.events)
+		req := httptest.NewRequest(http.MethodPut, "/send", strings.NewReader(`{"msgtype":"m.text","body":"`+tc.body+`"}`))
+		res := SendEvent(req, device, "!room:localhost", "m.room.message", nil, nil, cfg, rsAPI, eduAPI, transactions.New())
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.body, res.Code, tc.wantCode, res.JSON)
+		}
+		if wantSent := tc.wantCode == http.StatusOK; (len(rsAPI.events) > sent) != wantSent {
+			t.Errorf("%s: got event sent %v, want %v", tc.body, len(rsAPI.events) > sent, wantSent)
+		}
+	}
+}
+
+func TestSendEventValidatesEdits(t *testing.T) {
+	rsAPI := mustCreateRoom(t, `{"preset":"public_chat"}`)
+	eduAPI := &presenceEDUServerAPI{}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		},
+	}
+	alice := &api.Device{UserID: "@alice:localhost", AccessToken: "alicetoken"}
+	bob := &api.Device{UserID: "@bob:localhost", AccessToken: "bobtoken"}
+	send := func(device *api.Device, eventType string, stateKey *string, body string) util.JSONResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/send", strings.NewReader(body))
+		return SendEvent(req, device, "!room:localhost", eventType, nil, stateKey, cfg, rsAPI, eduAPI, transactions.New())
+	}
+	edit := func(eventID string) string {
+		return `{"msgtype":"m.text","body":"* edited","m.new_content":{"msgtype":"m.text","body":"edited"},` +
+			`"m.relates_to":{"rel_type":"m.replace","event_id":"` + eventID + `"}}`
+	}
+
+	if res := send(bob, "m.room.member", &bob.UserID, `{"membership":"join"}`); res.Code != http.StatusOK {
+		t.Fatalf("bob failed to join: HTTP %d %+v", res.Code, res.JSON)
+	}
+	res := send(alice, "m.room.message", nil, `{"msgtype":"m.text","body":"hello"}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("alice failed to send a message: HTTP %d %+v", res.Code, res.JSON)
+	}
+	message := res.JSON.(sendEventResponse).EventID
+
+	testCases := []struct {
+		name     string
+		device   *api.Device
+		body     string
+		wantCode int
+	}{
+		{"someone else's message", bob, edit(message), http.StatusForbidden},
+		{"a missing event", alice, edit("$missing:localhost"), http.StatusBadRequest},
+		{"no new content", alice, `{"msgtype":"m.text","body":"* edited","m.relates_to":{"rel_type":"m.replace","event_id":"` + message + `"}}`, http.StatusBadRequest},
+		{"own message", alice, edit(message), http.StatusOK},
+	}
+	for _, tc := range testCases {
+		sent := len(rsAPI.events)
+		res := send(tc.device, "m.room.message", nil, tc.body)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+		}
+		if wantSent := tc.wantCode == http.StatusOK; (len(rsAPI.events) > sent) != wantSent {
+			t.Errorf("%s: got event sent %v, want %v", tc.name, len(rsAPI.events) > sent, wantSent)
+		}
+	}
+
+	// Edits can't be edited.
+	if res = send(alice, "m.room.message", nil, edit(rsAPI.events[len(rsAPI.events)-1].EventID())); res.Code != http.StatusBadRequest {
+		t.Errorf("editing an edit: got HTTP %d, want %d: %+v", res.Code, http.StatusBadRequest, res.JSON)
+	}
+}
+
+func TestSendEventValidatesEncryptedEdits(t *testing.T) {
+	rsAPI := mustCreateRoom(t, `{}`)
+	eduAPI := &presenceEDUServerAPI{}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		},
+	}
+	device := &api.Device{UserID: "@alice:localhost", AccessToken: "token"}
+	send := func(eventType string, body string) util.JSONResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/send", strings.NewReader(body))
+		return SendEvent(req, device, "!room:localhost", eventType, nil, nil, cfg, rsAPI, eduAPI, transactions.New())
+	}
+	// Only m.relates_to is in the cleartext of an encrypted edit.
+	encryptedEdit := func(eventID string) string {
+		return `{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgAEnAC","device_id":"DEVICE","sender_key":"key","session_id":"session",` +
+			`"m.relates_to":{"rel_type":"m.replace","event_id":"` + eventID + `"}}`
+	}
+
+	res := send("m.room.encrypted", `{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgAEnAC","device_id":"DEVICE","sender_key":"key","session_id":"session"}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("failed to send an encrypted message: HTTP %d %+v", res.Code, res.JSON)
+	}
+	encrypted := res.JSON.(sendEventResponse).EventID
+	res = send("m.room.message", `{"msgtype":"m.text","body":"hello"}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("failed to send a message: HTTP %d %+v", res.Code, res.JSON)
+	}
+	message := res.JSON.(sendEventResponse).EventID
+
+	testCases := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"an encrypted message", encryptedEdit(encrypted), http.StatusOK},
+		{"a message which isn't encrypted", encryptedEdit(message), http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		sent := len(rsAPI.events)
+		res := send("m.room.encrypted", tc.body)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+		}
+		if wantSent := tc.wantCode == http.StatusOK; (len(rsAPI.events) > sent) != wantSent {
+			t.Errorf("%s: got event sent %v, want %v", tc.name, len(rsAPI.events) > sent, wantSent)
+		}
+	}
+}
+
+func TestSendEventValidatesStateContent(t *testing.T) {
+	rsAPI := mustCreateRoom(t, `{}`)
+	eduAPI := &presenceEDUServerAPI{}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		},
+	}
+	device := &api.Device{UserID: "@alice:localhost", AccessToken: "token"}
+	emptyStateKey := ""
+
+	testCases := []struct {
+		eventType string
+		body      string
+		wantCode  int
+	}{
+		{"m.room.name", `{"name":42}`, http.StatusBadRequest},
+		{"m.room.name", `{}`, http.StatusBadRequest},
+		{"m.room.name", `{"name":"Party room"}`, http.StatusOK},
+		{"m.room.topic", `{"topic":["not","a","string"]}`, http.StatusBadRequest},
+		{"m.room.canonical_alias", `{"alt_aliases":[1]}`, http.StatusBadRequest},
+		{"m.room.canonical_alias", `{"alias":"#party:localhost","alt_aliases":[]}`, http.StatusOK},
+		// Event types without a validator are allowed whatever their content.
+		{"org.example.custom", `{"name":42}`, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		sent := len(rsAPI.events)
+		req := httptest.NewRequest(http.MethodPut, "/state", strings.NewReader(tc.body))
+		res := SendEvent(req, device, "!room:localhost", tc.eventType, nil, &emptyStateKey, cfg, rsAPI, eduAPI, transactions.New())
+		if res.Code != tc.wantCode {
+			t.Errorf("%s %s: got HTTP %d, want %d: %+v", tc.eventType, tc.body, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if j, ok := res.JSON.(*jsonerror.MatrixError); tc.wantCode == http.StatusBadRequest && (!ok || j.ErrCode != "M_BAD_JSON") {
+			t.Errorf("%s %s: got %+v, want M_BAD_JSON", tc.eventType, tc.body, res.JSON)
+		}
+		if wantSent := tc.wantCode == http.StatusOK; (len(rsAPI.events) > sent) != wantSent {
+			t.Errorf("%s %s: got event sent %v, want %v", tc.eventType, tc.body, len(rsAPI.events) > sent, wantSent)
+		}
+	}
+}
+
+func TestSendEventMarksSenderActive(t *testing.T) {
+	rsAPI := mustCreateRoom(t, `{}`)
+	eduAPI := &presenceEDUServerAPI{}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		},
+	}
+	device := &api.Device{UserID: "@alice:localhost", AccessToken: "token"}
+	req := httptest.NewRequest(http.MethodPut, "/send", strings.NewReader(`{"msgtype":"m.text","body":"hello"}`))
+	if res := SendEvent(req, device, "!room:localhost", "m.room.message", nil, nil, cfg, rsAPI, eduAPI, transactions.New()); res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+	}
+	if len(eduAPI.presence) != 1 {
+		t.Fatalf("got %d presence updates, want 1", len(eduAPI.presence))
+	}
+	if got := eduAPI.presence[0]; got.UserID != device.UserID || got.Presence != eduserverAPI.PresenceOnline || !got.ActivityOnly {
+		t.Errorf("got presence update %+v, want alice to be active and online", got)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/eduserver/input"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/consumers"
+	syncstorage "github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/naffka"
+	naffkaStorage "github.com/matrix-org/naffka/storage"
+)
+
+// typingRoomserverAPI is a room containing alice and bob, as far as the
+// sync API's device list tracking is concerned.
+type typingRoomserverAPI struct {
+	*fakeRoomserverAPI
+}
+
+func (r *typingRoomserverAPI) QuerySharedUsers(
+	ctx context.Context, req *roomserverAPI.QuerySharedUsersRequest, res *roomserverAPI.QuerySharedUsersResponse,
+) error {
+	res.UserIDsToCount = map[string]int{"@alice:localhost": 1, "@bob:localhost": 1}
+	return nil
+}
+
+type typingKeyAPI struct {
+	keyapi.KeyInternalAPI
+}
+
+func (k *typingKeyAPI) QueryKeyChanges(ctx context.Context, req *keyapi.QueryKeyChangesRequest, res *keyapi.QueryKeyChangesResponse) {
+}
+
+func (k *typingKeyAPI) QueryOneTimeKeys(ctx context.Context, req *keyapi.QueryOneTimeKeysRequest, res *keyapi.QueryOneTimeKeysResponse) {
+}
+
+type typingUserAPI struct {
+	*fakeUserAPI
+}
+
+func (u *typingUserAPI) PerformLastSeenUpdate(ctx context.Context, req *api.PerformLastSeenUpdateRequest, res *api.PerformLastSeenUpdateResponse) error {
+	return nil
+}
+
+func TestSendTypingWakesSync(t *testing.T) {
+	rsAPI := &typingRoomserverAPI{mustCreateRoom(t, `{"preset":"public_chat"}`)}
+	bob := "@bob:localhost"
+	latest := rsAPI.events[len(rsAPI.events)-1]
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     bob,
+		RoomID:     latest.RoomID(),
+		Type:       gomatrixserverlib.MRoomMember,
+		StateKey:   &bob,
+		Depth:      latest.Depth() + 1,
+		PrevEvents: []gomatrixserverlib.EventReference{latest.EventReference()},
+	}
+	_ = builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Join})
+	join, err := builder.Build(time.Now(), "localhost", "ed25519:test", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), latest.RoomVersion)
+	if err != nil {
+		t.Fatalf("builder.Build failed: %s", err)
+	}
+	rsAPI.events = append(rsAPI.events, join.Headered(latest.RoomVersion))
+
+	// Set up the sync API with the room in it, listening for typing events
+	// from the EDU server.
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+	syncDB, err := syncstorage.NewSyncServerDatasource(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to create sync DB: %s", err)
+	}
+	for _, ev := range rsAPI.events {
+		var addState []*gomatrixserverlib.HeaderedEvent
+		var addStateIDs []string
+		if ev.StateKey() != nil {
+			addState = append(addState, ev)
+			addStateIDs = append(addStateIDs, ev.EventID())
+		}
+		if _, err = syncDB.WriteEvent(context.Background(), ev, addState, addStateIDs, nil, nil, false); err != nil {
+			t.Fatalf("failed to write event: %s", err)
+		}
+	}
+	pos, err := syncDB.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get sync position: %s", err)
+	}
+	notifier := sync.NewNotifier(pos)
+	if err = notifier.Load(context.Background(), syncDB); err != nil {
+		t.Fatalf("failed to load notifier: %s", err)
+	}
+	naffkaDB, err := naffkaStorage.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to create naffka DB: %s", err)
+	}
+	kafka, err := naffka.New(naffkaDB)
+	if err != nil {
+		t.Fatalf("failed to create naffka: %s", err)
+	}
+	if err = consumers.NewOutputTypingEventConsumer(&cfg.SyncAPI, kafka, notifier, syncDB).Start(); err != nil {
+		t.Fatalf("failed to start typing consumer: %s", err)
+	}
+	eduAPI := &input.EDUServerInputAPI{
+		Cache:                    cache.New(),
+		OutputTypingEventTopic:   string(cfg.Global.Kafka.TopicFor(config.TopicOutputTypingEvent)),
+		OutputPresenceEventTopic: string(cfg.Global.Kafka.TopicFor(config.TopicOutputPresenceEvent)),
+		PresenceCache:            cache.NewPresenceCache(),
+		Typing:                   cfg.EDUServer.Typing,
+		Producer:                 kafka,
+		ServerName:               "localhost",
+	}
+	requestPool := sync.NewRequestPool(syncDB, &cfg.SyncAPI, notifier, &typingUserAPI{&fakeUserAPI{}}, &typingKeyAPI{}, rsAPI, eduAPI)
+
+	// Bob starts a long-polling sync, and then alice starts typing.
+	syncRes := make(chan []byte, 1)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/sync?timeout=10000&since="+pos.String(), nil)
+		res := requestPool.OnIncomingSyncRequest(req, &api.Device{UserID: bob, ID: "BOBDEVICE"})
+		body, _ := json.Marshal(res.JSON)
+		syncRes <- body
+	}()
+	time.Sleep(100 * time.Millisecond) // give the sync a chance to start waiting
+	req := httptest.NewRequest(http.MethodPut, "/rooms/"+latest.RoomID()+"/typing/@alice:localhost", strings.NewReader(`{"typing":true,"timeout":30000}`))
+	res := SendTyping(req, &api.Device{UserID: "@alice:localhost"}, latest.RoomID(), "@alice:localhost", nil, eduAPI, rsAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d from /typing, want %d", res.Code, http.StatusOK)
+	}
+
+	// Bob's sync should return the typing notification straight away rather
+	// than waiting for the sync to time out.
+	var body []byte
+	select {
+	case body = <-syncRes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sync wasn't woken up by /typing")
+	}
+	var syncBody struct {
+		Rooms struct {
+			Join map[string]struct {
+				Ephemeral struct {
+					Events []gomatrixserverlib.ClientEvent `json:"events"`
+				} `json:"ephemeral"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	if err = json.Unmarshal(body, &syncBody); err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+	var typing struct {
+		UserIDs []string `json:"user_ids"`
+	}
+	for _, ev := range syncBody.Rooms.Join[latest.RoomID()].Ephemeral.Events {
+		if ev.Type == gomatrixserverlib.MTyping {
+			_ = json.Unmarshal(ev.Content, &typing)
+		}
+	}
+	if len(typing.UserIDs) != 1 || typing.UserIDs[0] != "@alice:localhost" {
+		t.Errorf("got typing users %v in sync response %s, want alice", typing.UserIDs, body)
+	}
+}
@@ -115,8 +115,12 @@ func CheckAndSave3PIDAssociation(
 		}
 	}
 
+	// Remember which identity server the association is published on, so
+	// that it can be removed from there again when the account is deactivated.
+	var idServer string
 	if body.Bind {
 		// Publish the association on the identity server if requested
+		idServer = body.Creds.IDServer
 		err = threepid.PublishAssociation(body.Creds, device.UserID, cfg)
 		if err == threepid.ErrNotTrusted {
 			return util.JSONResponse{
@@ -136,7 +140,7 @@ func CheckAndSave3PIDAssociation(
 		return jsonerror.InternalServerError()
 	}
 
-	if err = accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium); err != nil {
+	if err = accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium, idServer); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountsDB.SaveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
@@ -17,6 +17,7 @@ package routing
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -30,6 +31,19 @@ type UserDirectoryResponse struct {
 	Limited bool                              `json:"limited"`
 }
 
+// maxUserDirectorySearchLimit is the most results that a client can ask
+// for in a single user directory search.
+const maxUserDirectorySearchLimit = 50
+
+// SearchUserDirectory implements POST /user_directory/search. Local users
+// are matched from their profiles, and other users only if they share a
+// room with the searching user. Users are matched on a prefix of their
+// user ID or of any word in their display name.
+//
+// Remote users are matched on the display name from their latest join to
+// any room, rather than the display name that they have in each room, so a
+// user who uses different display names in different rooms can only be
+// found by the most recent one.
 func SearchUserDirectory(
 	ctx context.Context,
 	device *userapi.Device,
@@ -39,21 +53,37 @@ func SearchUserDirectory(
 	searchString string,
 	limit int,
 ) *util.JSONResponse {
-	if limit < 10 {
+	if limit <= 0 {
 		limit = 10
 	}
+	if limit > maxUserDirectorySearchLimit {
+		limit = maxUserDirectorySearchLimit
+	}
+	searchString = normaliseUserDirectorySearchTerm(searchString)
 
-	results := map[string]authtypes.FullyQualifiedProfile{}
+	seen := map[string]bool{}
 	response := &UserDirectoryResponse{
 		Results: []authtypes.FullyQualifiedProfile{},
 		Limited: false,
 	}
+	addResult := func(profile authtypes.FullyQualifiedProfile) {
+		if seen[profile.UserID] {
+			return
+		}
+		if len(response.Results) == limit {
+			response.Limited = true
+			return
+		}
+		seen[profile.UserID] = true
+		response.Results = append(response.Results, profile)
+	}
 
-	// First start searching local users.
+	// First start searching local users. We ask for one more than the limit
+	// so that we know whether the results are limited.
 
 	userReq := &userapi.QuerySearchProfilesRequest{
 		SearchString: searchString,
-		Limit:        limit,
+		Limit:        limit + 1,
 	}
 	userRes := &userapi.QuerySearchProfilesResponse{}
 	if err := userAPI.QuerySearchProfiles(ctx, userReq, userRes); err != nil {
@@ -62,29 +92,21 @@ func SearchUserDirectory(
 	}
 
 	for _, user := range userRes.Profiles {
-		if len(results) == limit {
-			response.Limited = true
-			break
-		}
-
-		userID := fmt.Sprintf("@%s:%s", user.Localpart, serverName)
-		if _, ok := results[userID]; !ok {
-			results[userID] = authtypes.FullyQualifiedProfile{
-				UserID:      userID,
-				DisplayName: user.DisplayName,
-				AvatarURL:   user.AvatarURL,
-			}
-		}
+		addResult(authtypes.FullyQualifiedProfile{
+			UserID:      fmt.Sprintf("@%s:%s", user.Localpart, serverName),
+			DisplayName: user.DisplayName,
+			AvatarURL:   user.AvatarURL,
+		})
 	}
 
 	// Then, if we have enough room left in the response,
 	// start searching for known users from joined rooms.
 
-	if len(results) <= limit {
+	if !response.Limited {
 		stateReq := &api.QueryKnownUsersRequest{
 			UserID:       device.UserID,
 			SearchString: searchString,
-			Limit:        limit - len(results),
+			Limit:        limit + 1,
 		}
 		stateRes := &api.QueryKnownUsersResponse{}
 		if err := rsAPI.QueryKnownUsers(ctx, stateReq, stateRes); err != nil {
@@ -93,23 +115,23 @@ func SearchUserDirectory(
 		}
 
 		for _, user := range stateRes.Users {
-			if len(results) == limit {
-				response.Limited = true
-				break
-			}
-
-			if _, ok := results[user.UserID]; !ok {
-				results[user.UserID] = user
-			}
+			addResult(user)
 		}
 	}
 
-	for _, result := range results {
-		response.Results = append(response.Results, result)
-	}
-
 	return &util.JSONResponse{
 		Code: 200,
 		JSON: response,
 	}
 }
+
+// normaliseUserDirectorySearchTerm turns a search for a user ID, such as
+// "@alice:example.com", into a search for its localpart, so that it matches
+// both the local profiles and the user IDs of known users.
+func normaliseUserDirectorySearchTerm(searchString string) string {
+	searchString = strings.TrimPrefix(strings.TrimSpace(searchString), "@")
+	if i := strings.IndexByte(searchString, ':'); i >= 0 {
+		searchString = searchString[:i]
+	}
+	return searchString
+}
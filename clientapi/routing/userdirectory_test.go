@@ -0,0 +1,78 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"testing"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// searchUserAPI remembers the last profile search that was made.
+type searchUserAPI struct {
+	api.UserInternalAPI
+	req *api.QuerySearchProfilesRequest
+}
+
+func (u *searchUserAPI) QuerySearchProfiles(ctx context.Context, req *api.QuerySearchProfilesRequest, res *api.QuerySearchProfilesResponse) error {
+	u.req = req
+	return nil
+}
+
+// searchRoomserverAPI remembers the last known users search that was made.
+type searchRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	req *roomserverAPI.QueryKnownUsersRequest
+}
+
+func (r *searchRoomserverAPI) QueryKnownUsers(ctx context.Context, req *roomserverAPI.QueryKnownUsersRequest, res *roomserverAPI.QueryKnownUsersResponse) error {
+	r.req = req
+	return nil
+}
+
+func TestSearchUserDirectory(t *testing.T) {
+	testCases := []struct {
+		searchString     string
+		limit            int
+		wantSearchString string
+		wantLimit        int
+	}{
+		{"alice", 0, "alice", 11},
+		{"alice", 5, "alice", 6},
+		{"alice", 1000, "alice", maxUserDirectorySearchLimit + 1},
+		{"@alice", 5, "alice", 6},
+		{" @alice:localhost ", 5, "alice", 6},
+		{"Alice Smith", 5, "Alice Smith", 6},
+	}
+	for _, tc := range testCases {
+		userAPI := &searchUserAPI{}
+		rsAPI := &searchRoomserverAPI{}
+		res := SearchUserDirectory(
+			context.Background(), &api.Device{UserID: "@bob:localhost"}, userAPI, rsAPI,
+			"localhost", tc.searchString, tc.limit,
+		)
+		if res.Code != 200 {
+			t.Fatalf("%q: got HTTP %d want 200", tc.searchString, res.Code)
+		}
+		if userAPI.req.SearchString != tc.wantSearchString || rsAPI.req.SearchString != tc.wantSearchString {
+			t.Errorf("%q: searched for %q and %q, want %q", tc.searchString, userAPI.req.SearchString, rsAPI.req.SearchString, tc.wantSearchString)
+		}
+		if userAPI.req.Limit != tc.wantLimit || rsAPI.req.Limit != tc.wantLimit {
+			t.Errorf("%q: searched with limit %d and %d, want %d", tc.searchString, userAPI.req.Limit, rsAPI.req.Limit, tc.wantLimit)
+		}
+	}
+}
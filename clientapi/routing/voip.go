@@ -29,13 +29,17 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// defaultTURNUserLifetime is how long TURN credentials last for if
+// turn_user_lifetime isn't set, which is the same as Synapse.
+const defaultTURNUserLifetime = time.Hour
+
 // RequestTurnServer implements:
 //     GET /voip/turnServer
 func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.ClientAPI) util.JSONResponse {
 	turnConfig := cfg.TURN
 
 	// TODO Guest Support
-	if len(turnConfig.URIs) == 0 || turnConfig.UserLifetime == "" {
+	if len(turnConfig.URIs) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: struct{}{},
@@ -43,7 +47,10 @@ func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Client
 	}
 
 	// Duration checked at startup, err not possible
-	duration, _ := time.ParseDuration(turnConfig.UserLifetime)
+	duration := defaultTURNUserLifetime
+	if turnConfig.UserLifetime != "" {
+		duration, _ = time.ParseDuration(turnConfig.UserLifetime)
+	}
 
 	resp := gomatrix.RespTurnServer{
 		URIs: turnConfig.URIs,
@@ -51,7 +58,12 @@ func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Client
 	}
 
 	if turnConfig.SharedSecret != "" {
+		// These are the time-limited credentials used by coturn's
+		// use-auth-secret option: the username is the expiry time and the
+		// user ID, and the password is the HMAC-SHA1 of the username keyed
+		// by the shared secret.
 		expiry := time.Now().Add(duration).Unix()
+		resp.Username = fmt.Sprintf("%d:%s", expiry, device.UserID)
 		mac := hmac.New(sha1.New, []byte(turnConfig.SharedSecret))
 		_, err := mac.Write([]byte(resp.Username))
 
@@ -60,7 +72,6 @@ func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Client
 			return jsonerror.InternalServerError()
 		}
 
-		resp.Username = fmt.Sprintf("%d:%s", expiry, device.UserID)
 		resp.Password = base64.StdEncoding.EncodeToString(mac.Sum(nil))
 	} else if turnConfig.Username != "" && turnConfig.Password != "" {
 		resp.Username = turnConfig.Username
@@ -0,0 +1,103 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrix"
+)
+
+func requestTurnServer(t *testing.T, turn config.TURN) (gomatrix.RespTurnServer, bool) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/voip/turnServer", nil)
+	res := RequestTurnServer(req, &api.Device{UserID: "@alice:localhost"}, &config.ClientAPI{TURN: turn})
+	if res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d, want %d", res.Code, http.StatusOK)
+	}
+	resp, ok := res.JSON.(gomatrix.RespTurnServer)
+	return resp, ok
+}
+
+func TestRequestTurnServerSharedSecret(t *testing.T) {
+	uris := []string{"turn:turn.localhost:3478?transport=udp"}
+	resp, ok := requestTurnServer(t, config.TURN{
+		UserLifetime: "5m",
+		URIs:         uris,
+		SharedSecret: "s3cr3t",
+	})
+	if !ok {
+		t.Fatalf("got no TURN server")
+	}
+	if len(resp.URIs) != 1 || resp.URIs[0] != uris[0] {
+		t.Errorf("got URIs %v, want %v", resp.URIs, uris)
+	}
+	if resp.TTL != 300 {
+		t.Errorf("got TTL %d, want 300", resp.TTL)
+	}
+
+	// The TURN server checks the password against the HMAC of the username
+	// with the shared secret.
+	mac := hmac.New(sha1.New, []byte("s3cr3t"))
+	_, _ = mac.Write([]byte(resp.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); resp.Password != want {
+		t.Errorf("got password %q, want %q", resp.Password, want)
+	}
+
+	// The username is the expiry time of the credentials and the user ID.
+	parts := strings.SplitN(resp.Username, ":", 2)
+	if len(parts) != 2 || parts[1] != "@alice:localhost" {
+		t.Fatalf("got username %q, want the expiry and user ID", resp.Username)
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		t.Fatalf("got username %q with an invalid expiry: %s", resp.Username, err)
+	}
+	if want := time.Now().Add(5 * time.Minute).Unix(); expiry < want-5 || expiry > want {
+		t.Errorf("got expiry %d, want about %d", expiry, want)
+	}
+}
+
+func TestRequestTurnServerStatic(t *testing.T) {
+	resp, ok := requestTurnServer(t, config.TURN{
+		URIs:     []string{"turn:turn.localhost:3478"},
+		Username: "turnuser",
+		Password: "turnpass",
+	})
+	if !ok {
+		t.Fatalf("got no TURN server")
+	}
+	if resp.Username != "turnuser" || resp.Password != "turnpass" {
+		t.Errorf("got credentials %q/%q, want the configured ones", resp.Username, resp.Password)
+	}
+	if resp.TTL != int(defaultTURNUserLifetime.Seconds()) {
+		t.Errorf("got TTL %d, want %d", resp.TTL, int(defaultTURNUserLifetime.Seconds()))
+	}
+
+	// Without any credentials, there isn't a TURN server to use.
+	if _, ok = requestTurnServer(t, config.TURN{URIs: []string{"turn:turn.localhost:3478"}}); ok {
+		t.Errorf("got a TURN server without any credentials")
+	}
+}
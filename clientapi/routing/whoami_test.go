@@ -0,0 +1,95 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type nopKeyAPI struct {
+	keyapi.KeyInternalAPI
+}
+
+func (k *nopKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+}
+
+func TestWhoami(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: "localhost",
+		},
+	}, nil, &nopKeyAPI{}, nil, mustCreateCache(t))
+
+	// whoami works on the device returned by the access token, so
+	// check that both the device and the account type survive that
+	whoami := func(accountType api.AccountType, localpart string) whoamiResponse {
+		var accRes api.PerformAccountCreationResponse
+		if err = userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			AccountType: accountType,
+			Localpart:   localpart,
+		}, &accRes); err != nil {
+			t.Fatalf("PerformAccountCreation failed: %s", err)
+		}
+		var devRes api.PerformDeviceCreationResponse
+		if err = userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   accRes.Account.Localpart,
+			AccessToken: "token_" + accRes.Account.Localpart,
+		}, &devRes); err != nil {
+			t.Fatalf("PerformDeviceCreation failed: %s", err)
+		}
+		var tokenRes api.QueryAccessTokenResponse
+		if err = userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{
+			AccessToken: devRes.Device.AccessToken,
+		}, &tokenRes); err != nil || tokenRes.Device == nil {
+			t.Fatalf("QueryAccessToken failed: %v", err)
+		}
+		res := Whoami(httptest.NewRequest("GET", "/account/whoami", nil), tokenRes.Device)
+		body, ok := res.JSON.(whoamiResponse)
+		if !ok {
+			t.Fatalf("Whoami returned unexpected response %+v", res.JSON)
+		}
+		if body.UserID != accRes.Account.UserID || body.DeviceID != devRes.Device.ID {
+			t.Errorf("Whoami returned %+v, want user %s device %s", body, accRes.Account.UserID, devRes.Device.ID)
+		}
+		return body
+	}
+
+	if user := whoami(api.AccountTypeUser, "alice"); user.IsGuest {
+		t.Errorf("Whoami reported a normal user as a guest")
+	}
+	if guest := whoami(api.AccountTypeGuest, ""); !guest.IsGuest {
+		t.Errorf("Whoami didn't report a guest as a guest")
+	}
+}
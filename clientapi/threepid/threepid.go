@@ -24,7 +24,9 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // EmailAssociationRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-register-email-requesttoken
@@ -174,6 +176,54 @@ func PublishAssociation(creds Credentials, userID string, cfg *config.ClientAPI)
 	return nil
 }
 
+// UnbindAssociation removes the association between a third-party identifier
+// and a Matrix ID from the given identity server. The request is signed with
+// the homeserver's key, as the identity server needs to know that it comes
+// from the homeserver of the user.
+// Returns an error if there was a problem sending the request, or if the
+// identity server responded with a non-OK status.
+func UnbindAssociation(
+	ctx context.Context, threePID authtypes.ThreePID, idServer, userID string, cfg *config.ClientAPI,
+) error {
+	if err := isTrusted(idServer, cfg); err != nil {
+		return err
+	}
+
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		http.MethodPost, gomatrixserverlib.ServerName(idServer), "/_matrix/identity/api/v1/3pid/unbind",
+	)
+	if err := fedReq.SetContent(map[string]interface{}{
+		"mxid":     userID,
+		"threepid": threePID,
+	}); err != nil {
+		return err
+	}
+	if err := fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	request, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	// Identity servers aren't reached through the federation API, so use HTTPS
+	// rather than matrix:// URLs.
+	request.URL.Scheme = "https"
+
+	client := http.Client{}
+	resp, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	// Error if the status isn't OK
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not remove the association from the server %s", idServer)
+	}
+
+	return nil
+}
+
 // isTrusted checks if a given identity server is part of the list of trusted
 // identity servers in the configuration file.
 // Returns an error if the server isn't trusted.
@@ -142,10 +142,6 @@ func main() {
 
 	accountDB := base.Base.CreateAccountsDB()
 	federation := createFederationClient(base)
-	keyAPI := keyserver.NewInternalAPI(&base.Base.Cfg.KeyServer, federation)
-	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, nil, keyAPI)
-	keyAPI.SetUserAPI(userAPI)
-
 	serverKeyAPI := signingkeyserver.NewInternalAPI(
 		&base.Base.Cfg.SigningKeyServer, federation, base.Base.Caches,
 	)
@@ -157,6 +153,10 @@ func main() {
 	rsAPI := roomserver.NewInternalAPI(
 		&base.Base, keyRing,
 	)
+	keyAPI := keyserver.NewInternalAPI(&base.Base.Cfg.KeyServer, federation)
+	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, nil, keyAPI, rsAPI, base.Base.Caches)
+	userapi.StartConsumers(accountDB, &cfg.UserAPI, rsAPI)
+	keyAPI.SetUserAPI(userAPI)
 	eduInputAPI := eduserver.NewInternalAPI(
 		&base.Base, cache.New(), userAPI,
 	)
@@ -187,12 +187,14 @@ func main() {
 		UserAPI:                userAPI,
 		KeyAPI:                 keyAPI,
 		ExtPublicRoomsProvider: provider,
+		SpamChecker:            base.Base.SpamChecker,
 	}
 	monolith.AddAllPublicRoutes(
 		base.Base.PublicClientAPIMux,
 		base.Base.PublicFederationAPIMux,
 		base.Base.PublicKeyAPIMux,
 		base.Base.PublicMediaAPIMux,
+		base.Base.DendriteAdminMux,
 	)
 	if err := mscs.Enable(&base.Base, &monolith); err != nil {
 		logrus.WithError(err).Fatalf("Failed to enable MSCs")
@@ -202,6 +204,7 @@ func main() {
 	httpRouter.PathPrefix(httputil.InternalPathPrefix).Handler(base.Base.InternalAPIMux)
 	httpRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(base.Base.PublicClientAPIMux)
 	httpRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(base.Base.PublicMediaAPIMux)
+	httpRouter.PathPrefix(httputil.PublicDendritePathPrefix).Handler(base.Base.DendriteAdminMux)
 	embed.Embed(httpRouter, *instancePort, "Yggdrasil Demo")
 
 	libp2pRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
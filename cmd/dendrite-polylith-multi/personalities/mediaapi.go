@@ -23,8 +23,13 @@ import (
 func MediaAPI(base *setup.BaseDendrite, cfg *config.Dendrite) {
 	userAPI := base.UserAPIClient()
 	client := base.CreateClient()
+	keyRing := base.SigningKeyServerHTTPClient().KeyRing()
 
-	mediaapi.AddPublicRoutes(base.PublicMediaAPIMux, &base.Cfg.MediaAPI, userAPI, client)
+	mediaapi.AddPublicRoutes(
+		base.PublicMediaAPIMux, base.PublicFederationAPIMux, base.DendriteAdminMux,
+		&base.Cfg.MediaAPI, &base.Cfg.FederationAPI, userAPI, client, keyRing,
+		base.SpamChecker,
+	)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.MediaAPI.InternalAPI.Listen,
@@ -25,11 +25,12 @@ func SyncAPI(base *setup.BaseDendrite, cfg *config.Dendrite) {
 	federation := base.CreateFederationClient()
 
 	rsAPI := base.RoomserverHTTPClient()
+	keyRing := base.SigningKeyServerHTTPClient().KeyRing()
 
 	syncapi.AddPublicRoutes(
-		base.PublicClientAPIMux, userAPI, rsAPI,
-		base.KeyServerHTTPClient(),
-		federation, &cfg.SyncAPI,
+		base.PublicClientAPIMux, base.DendriteAdminMux, userAPI, rsAPI,
+		base.KeyServerHTTPClient(), base.EDUServerClient(),
+		federation, base.FederationSenderHTTPClient(), keyRing, &cfg.SyncAPI,
 	)
 
 	base.SetupAndServeHTTP(
@@ -23,7 +23,8 @@ import (
 func UserAPI(base *setup.BaseDendrite, cfg *config.Dendrite) {
 	accountDB := base.CreateAccountsDB()
 
-	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, cfg.Derived.ApplicationServices, base.KeyServerHTTPClient())
+	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, cfg.Derived.ApplicationServices, base.KeyServerHTTPClient(), base.RoomserverHTTPClient(), base.Caches)
+	userapi.StartConsumers(accountDB, &cfg.UserAPI, base.RoomserverHTTPClient())
 
 	userapi.AddInternalRoutes(base.InternalAPIMux, userAPI)
 
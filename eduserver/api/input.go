@@ -75,6 +75,32 @@ type InputReceiptEventRequest struct {
 // InputReceiptEventResponse is a response to InputReceiptEventRequest
 type InputReceiptEventResponse struct{}
 
+// InputPresenceEvent is an event for notifying the EDU server about a
+// change in a user's presence.
+type InputPresenceEvent struct {
+	// UserID of the user whose presence has changed.
+	UserID string `json:"user_id"`
+	// Presence is one of "online", "unavailable" or "offline".
+	Presence string `json:"presence"`
+	// StatusMsg is the optional status message of the user.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// LastActiveTS is when the user was last active.
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+	// ActivityOnly is set when the user was only seen to be active, e.g.
+	// by syncing or sending an event, rather than setting their presence.
+	// Their status message is kept, and nothing is sent to other users
+	// unless their presence changed or they haven't been seen for a while.
+	ActivityOnly bool `json:"activity_only,omitempty"`
+}
+
+// InputPresenceEventRequest is a request to EDUServerInputAPI
+type InputPresenceEventRequest struct {
+	InputPresenceEvent InputPresenceEvent `json:"input_presence_event"`
+}
+
+// InputPresenceEventResponse is a response to InputPresenceEventRequest
+type InputPresenceEventResponse struct{}
+
 // EDUServerInputAPI is used to write events to the typing server.
 type EDUServerInputAPI interface {
 	InputTypingEvent(
@@ -94,4 +120,10 @@ type EDUServerInputAPI interface {
 		request *InputReceiptEventRequest,
 		response *InputReceiptEventResponse,
 	) error
+
+	InputPresenceEvent(
+		ctx context.Context,
+		request *InputPresenceEventRequest,
+		response *InputPresenceEventResponse,
+	) error
 }
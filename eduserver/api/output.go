@@ -67,6 +67,27 @@ type OutputReceiptEvent struct {
 	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
 }
 
+// The presence states from
+// https://matrix.org/docs/spec/client_server/r0.6.1#id73
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// OutputPresenceEvent is an entry in the presence output kafka log
+type OutputPresenceEvent struct {
+	UserID       string                      `json:"user_id"`
+	Presence     string                      `json:"presence"`
+	StatusMsg    *string                     `json:"status_msg,omitempty"`
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+}
+
+// ReceiptTypeReadPrivate is the type of private read receipts, which only
+// the user who sent them gets to see. They aren't sent to other users,
+// application services or other servers.
+const ReceiptTypeReadPrivate = "m.read.private"
+
 // Helper structs for receipts json creation
 type ReceiptMRead struct {
 	User map[string]ReceiptTS `json:"m.read"`
@@ -85,3 +106,19 @@ type FederationReceiptData struct {
 	Data     ReceiptTS `json:"data"`
 	EventIDs []string  `json:"event_ids"`
 }
+
+// MPresence is the type of presence EDUs sent over federation
+const MPresence = "m.presence"
+
+// FederationPresence is the content of an m.presence EDU
+type FederationPresence struct {
+	Push []FederationPresenceUpdate `json:"push"`
+}
+
+type FederationPresenceUpdate struct {
+	UserID          string  `json:"user_id"`
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago"`
+	CurrentlyActive bool    `json:"currently_active,omitempty"`
+}
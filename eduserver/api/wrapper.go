@@ -86,3 +86,40 @@ func SendReceipt(
 	response := InputReceiptEventResponse{}
 	return eduAPI.InputReceiptEvent(ctx, &request, &response)
 }
+
+// SendPresence sends a presence event to EDU Server
+func SendPresence(
+	ctx context.Context,
+	eduAPI EDUServerInputAPI, userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) error {
+	request := InputPresenceEventRequest{
+		InputPresenceEvent: InputPresenceEvent{
+			UserID:       userID,
+			Presence:     presence,
+			StatusMsg:    statusMsg,
+			LastActiveTS: lastActiveTS,
+		},
+	}
+	response := InputPresenceEventResponse{}
+	return eduAPI.InputPresenceEvent(ctx, &request, &response)
+}
+
+// SendPresenceActivity tells the EDU Server that a local user was active,
+// with the given presence
+func SendPresenceActivity(
+	ctx context.Context,
+	eduAPI EDUServerInputAPI, userID, presence string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) error {
+	request := InputPresenceEventRequest{
+		InputPresenceEvent: InputPresenceEvent{
+			UserID:       userID,
+			Presence:     presence,
+			LastActiveTS: lastActiveTS,
+			ActivityOnly: true,
+		},
+	}
+	response := InputPresenceEventResponse{}
+	return eduAPI.InputPresenceEvent(ctx, &request, &response)
+}
@@ -96,6 +96,7 @@ func (t *EDUCache) GetTypingUsersIfUpdatedAfter(
 // AddTypingUser sets an user as typing in a room.
 // expire is the time when the user typing should time out.
 // if expire is nil, defaultTypingTimeout is assumed.
+// If expire has already passed then the user is no longer typing.
 // Returns the latest sync position for typing after update.
 func (t *EDUCache) AddTypingUser(
 	userID, roomID string, expire *time.Time,
@@ -110,7 +111,8 @@ func (t *EDUCache) AddTypingUser(
 		})
 		return t.addUser(userID, roomID, timer)
 	}
-	return t.GetLatestSyncPosition()
+	// Don't leave the user typing until an earlier, longer timeout fires.
+	return t.RemoveUser(userID, roomID)
 }
 
 // AddSendToDeviceMessage increases the sync position for
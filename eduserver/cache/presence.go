@@ -0,0 +1,124 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// UserPresence is the presence state of a single user.
+type UserPresence struct {
+	UserID       string
+	Presence     string
+	StatusMsg    *string
+	LastActiveTS gomatrixserverlib.Timestamp
+}
+
+// PresenceCache maintains the presence of local users so that they can be
+// automatically transitioned to unavailable and then offline when they stop
+// being active.
+type PresenceCache struct {
+	sync.Mutex
+	users map[string]*UserPresence
+}
+
+// NewPresenceCache returns a new PresenceCache initialised for use.
+func NewPresenceCache() *PresenceCache {
+	return &PresenceCache{users: make(map[string]*UserPresence)}
+}
+
+// SetPresence updates the presence of a user. Users who go offline are no
+// longer tracked, since there is nothing further to transition them to.
+func (c *PresenceCache) SetPresence(presence UserPresence) {
+	c.Lock()
+	defer c.Unlock()
+
+	if presence.Presence == api.PresenceOffline {
+		delete(c.users, presence.UserID)
+		return
+	}
+	c.users[presence.UserID] = &presence
+}
+
+// MarkActive records that a user was active at the given time with the given
+// presence, keeping their status message. Returns the user's presence, and
+// whether to tell anyone about it: if the presence didn't change and the user
+// was last active within the granularity then it isn't worth sending.
+func (c *PresenceCache) MarkActive(
+	userID, presence string, lastActiveTS gomatrixserverlib.Timestamp, granularity time.Duration,
+) (UserPresence, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	existing, ok := c.users[userID]
+	if ok && existing.Presence == presence && lastActiveTS.Time().Sub(existing.LastActiveTS.Time()) < granularity {
+		if lastActiveTS > existing.LastActiveTS {
+			existing.LastActiveTS = lastActiveTS
+		}
+		return *existing, false
+	}
+	updated := &UserPresence{
+		UserID:       userID,
+		Presence:     presence,
+		LastActiveTS: lastActiveTS,
+	}
+	if ok {
+		updated.StatusMsg = existing.StatusMsg
+	}
+	c.users[userID] = updated
+	return *updated, true
+}
+
+// GetPresence returns the presence of a user, or nil if the user isn't
+// being tracked.
+func (c *PresenceCache) GetPresence(userID string) *UserPresence {
+	c.Lock()
+	defer c.Unlock()
+
+	if presence, ok := c.users[userID]; ok {
+		p := *presence
+		return &p
+	}
+	return nil
+}
+
+// Sweep transitions online users who have not been active since idleTimeout
+// before now to unavailable, and users who have not been active since
+// offlineTimeout before now to offline. Returns the presence of every user who
+// was transitioned.
+func (c *PresenceCache) Sweep(now time.Time, idleTimeout, offlineTimeout time.Duration) []UserPresence {
+	c.Lock()
+	defer c.Unlock()
+
+	var changed []UserPresence
+	for userID, presence := range c.users {
+		inactive := now.Sub(presence.LastActiveTS.Time())
+		switch {
+		case inactive >= offlineTimeout:
+			presence.Presence = api.PresenceOffline
+			delete(c.users, userID)
+		case inactive >= idleTimeout && presence.Presence == api.PresenceOnline:
+			presence.Presence = api.PresenceUnavailable
+		default:
+			continue
+		}
+		changed = append(changed, *presence)
+	}
+	return changed
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPresenceSweep(t *testing.T) {
+	now := time.Now()
+	idleTimeout := 5 * time.Minute
+	offlineTimeout := 30 * time.Minute
+
+	pCache := NewPresenceCache()
+	tests := []struct {
+		userID       string
+		presence     string
+		lastActive   time.Duration
+		wantPresence string
+	}{
+		{"@active:localhost", api.PresenceOnline, time.Minute, api.PresenceOnline},
+		{"@idle:localhost", api.PresenceOnline, 10 * time.Minute, api.PresenceUnavailable},
+		{"@away:localhost", api.PresenceUnavailable, 10 * time.Minute, api.PresenceUnavailable},
+		{"@gone:localhost", api.PresenceOnline, time.Hour, api.PresenceOffline},
+		{"@goneaway:localhost", api.PresenceUnavailable, time.Hour, api.PresenceOffline},
+	}
+	for _, tt := range tests {
+		pCache.SetPresence(UserPresence{
+			UserID:       tt.userID,
+			Presence:     tt.presence,
+			LastActiveTS: gomatrixserverlib.AsTimestamp(now.Add(-tt.lastActive)),
+		})
+	}
+
+	changed := map[string]string{}
+	for _, presence := range pCache.Sweep(now, idleTimeout, offlineTimeout) {
+		changed[presence.UserID] = presence.Presence
+	}
+	for _, tt := range tests {
+		got, ok := changed[tt.userID]
+		if wantChange := tt.presence != tt.wantPresence; ok != wantChange {
+			t.Errorf("user %s: expected change %v, got %v", tt.userID, wantChange, ok)
+			continue
+		}
+		if ok && got != tt.wantPresence {
+			t.Errorf("user %s: expected presence %s, got %s", tt.userID, tt.wantPresence, got)
+		}
+		if tt.wantPresence == api.PresenceOffline {
+			if p := pCache.GetPresence(tt.userID); p != nil {
+				t.Errorf("user %s: expected offline user to no longer be tracked", tt.userID)
+			}
+		} else if p := pCache.GetPresence(tt.userID); p == nil || p.Presence != tt.wantPresence {
+			t.Errorf("user %s: expected cached presence %s, got %v", tt.userID, tt.wantPresence, p)
+		}
+	}
+
+	// Sweeping again at the same time shouldn't transition anyone else.
+	if again := pCache.Sweep(now, idleTimeout, offlineTimeout); len(again) != 0 {
+		t.Errorf("expected no further transitions, got %v", again)
+	}
+}
+
+func TestPresenceSetOffline(t *testing.T) {
+	pCache := NewPresenceCache()
+	pCache.SetPresence(UserPresence{UserID: "@alice:localhost", Presence: api.PresenceOnline})
+	pCache.SetPresence(UserPresence{UserID: "@alice:localhost", Presence: api.PresenceOffline})
+	if p := pCache.GetPresence("@alice:localhost"); p != nil {
+		t.Fatalf("expected user who went offline to no longer be tracked, got %v", p)
+	}
+}
+
+func TestPresenceMarkActive(t *testing.T) {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	statusMsg := "busy"
+	pCache := NewPresenceCache()
+	pCache.SetPresence(UserPresence{UserID: "@alice:localhost", Presence: api.PresenceUnavailable, StatusMsg: &statusMsg})
+
+	if p, changed := pCache.MarkActive("@alice:localhost", api.PresenceOnline, now, time.Minute); !changed || p.Presence != api.PresenceOnline || p.StatusMsg != &statusMsg {
+		t.Fatalf("expected idle user to come back online keeping their status, got %v (changed %v)", p, changed)
+	}
+	later := now + gomatrixserverlib.Timestamp(time.Second/time.Millisecond)
+	if p, changed := pCache.MarkActive("@alice:localhost", api.PresenceOnline, later, time.Minute); changed || p.LastActiveTS != later {
+		t.Fatalf("expected activity within the granularity to only bump the timestamp, got %v (changed %v)", p, changed)
+	}
+	muchLater := now + gomatrixserverlib.Timestamp(2*time.Minute/time.Millisecond)
+	if _, changed := pCache.MarkActive("@alice:localhost", api.PresenceOnline, muchLater, time.Minute); !changed {
+		t.Fatalf("expected activity after the granularity to be reported")
+	}
+}
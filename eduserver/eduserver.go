@@ -17,6 +17,8 @@
 package eduserver
 
 import (
+	"time"
+
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
@@ -28,6 +30,9 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
+// How often to check for local users who should be marked as unavailable or offline.
+const presenceSweepInterval = time.Minute
+
 // AddInternalRoutes registers HTTP handlers for the internal API. Invokes functions
 // on the given input API.
 func AddInternalRoutes(internalMux *mux.Router, inputAPI api.EDUServerInputAPI) {
@@ -45,13 +50,21 @@ func NewInternalAPI(
 
 	_, producer := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
 
-	return &input.EDUServerInputAPI{
+	inputAPI := &input.EDUServerInputAPI{
 		Cache:                        eduCache,
 		UserAPI:                      userAPI,
 		Producer:                     producer,
 		OutputTypingEventTopic:       cfg.Matrix.Kafka.TopicFor(config.TopicOutputTypingEvent),
 		OutputSendToDeviceEventTopic: cfg.Matrix.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent),
 		OutputReceiptEventTopic:      cfg.Matrix.Kafka.TopicFor(config.TopicOutputReceiptEvent),
+		OutputPresenceEventTopic:     cfg.Matrix.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+		PresenceCache:                cache.NewPresenceCache(),
+		PresenceIdleTimeout:          cfg.Matrix.Presence.IdleTimeout,
+		PresenceOfflineTimeout:       cfg.Matrix.Presence.OfflineTimeout,
+		Typing:                       cfg.Typing,
 		ServerName:                   cfg.Matrix.ServerName,
 	}
+	inputAPI.StartPresenceSweeper(presenceSweepInterval)
+
+	return inputAPI
 }
@@ -24,11 +24,16 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 )
 
+// presenceActivityGranularity is how often a user who keeps being active
+// has their last active time sent to other users.
+const presenceActivityGranularity = time.Minute
+
 // EDUServerInputAPI implements api.EDUServerInputAPI
 type EDUServerInputAPI struct {
 	// Cache to store the current typing members in each room.
@@ -39,6 +44,17 @@ type EDUServerInputAPI struct {
 	OutputSendToDeviceEventTopic string
 	// The kafka topic to output new receipt events to
 	OutputReceiptEventTopic string
+	// The kafka topic to output new presence events to
+	OutputPresenceEventTopic string
+	// Cache to store the presence of local users, so that they can be marked
+	// as unavailable or offline when they stop being active.
+	PresenceCache *cache.PresenceCache
+	// How long local users can be inactive before being marked as unavailable.
+	PresenceIdleTimeout time.Duration
+	// How long local users can be inactive before being marked as offline.
+	PresenceOfflineTimeout time.Duration
+	// The default and maximum typing timeouts.
+	Typing config.TypingOptions
 	// kafka producer
 	Producer sarama.SyncProducer
 	// Internal user query API
@@ -54,17 +70,19 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	response *api.InputTypingEventResponse,
 ) error {
 	ite := &request.InputTypingEvent
+	// Clamp the timeout that was asked for, so that users can't be shown as
+	// typing indefinitely.
+	expireTime := ite.OriginServerTS.Time().Add(
+		t.Typing.Timeout(time.Duration(ite.TimeoutMS) * time.Millisecond),
+	)
 	if ite.Typing {
 		// user is typing, update our current state of users typing.
-		expireTime := ite.OriginServerTS.Time().Add(
-			time.Duration(ite.TimeoutMS) * time.Millisecond,
-		)
 		t.Cache.AddTypingUser(ite.UserID, ite.RoomID, &expireTime)
 	} else {
 		t.Cache.RemoveUser(ite.UserID, ite.RoomID)
 	}
 
-	return t.sendTypingEvent(ite)
+	return t.sendTypingEvent(ite, expireTime)
 }
 
 // InputTypingEvent implements api.EDUServerInputAPI
@@ -77,7 +95,7 @@ func (t *EDUServerInputAPI) InputSendToDeviceEvent(
 	return t.sendToDeviceEvent(ise)
 }
 
-func (t *EDUServerInputAPI) sendTypingEvent(ite *api.InputTypingEvent) error {
+func (t *EDUServerInputAPI) sendTypingEvent(ite *api.InputTypingEvent, expireTime time.Time) error {
 	ev := &api.TypingEvent{
 		Type:   gomatrixserverlib.MTyping,
 		RoomID: ite.RoomID,
@@ -89,9 +107,6 @@ func (t *EDUServerInputAPI) sendTypingEvent(ite *api.InputTypingEvent) error {
 	}
 
 	if ev.Typing {
-		expireTime := ite.OriginServerTS.Time().Add(
-			time.Duration(ite.TimeoutMS) * time.Millisecond,
-		)
 		ote.ExpireTime = &expireTime
 	}
 
@@ -203,3 +218,93 @@ func (t *EDUServerInputAPI) InputReceiptEvent(
 	_, _, err = t.Producer.SendMessage(m)
 	return err
 }
+
+// InputPresenceEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *api.InputPresenceEventRequest,
+	response *api.InputPresenceEventResponse,
+) error {
+	ipe := &request.InputPresenceEvent
+	_, domain, err := gomatrixserverlib.SplitID('@', ipe.UserID)
+	isLocal := err == nil && domain == t.ServerName
+	if ipe.ActivityOnly {
+		if !isLocal {
+			return nil
+		}
+		presence, changed := t.PresenceCache.MarkActive(ipe.UserID, ipe.Presence, ipe.LastActiveTS, presenceActivityGranularity)
+		if !changed {
+			return nil
+		}
+		return t.sendPresenceEvent(&api.OutputPresenceEvent{
+			UserID:       presence.UserID,
+			Presence:     presence.Presence,
+			StatusMsg:    presence.StatusMsg,
+			LastActiveTS: presence.LastActiveTS,
+		})
+	}
+	if isLocal {
+		// Only local users are swept, remote servers are responsible for
+		// telling us when their own users go idle or offline.
+		t.PresenceCache.SetPresence(cache.UserPresence{
+			UserID:       ipe.UserID,
+			Presence:     ipe.Presence,
+			StatusMsg:    ipe.StatusMsg,
+			LastActiveTS: ipe.LastActiveTS,
+		})
+	}
+	return t.sendPresenceEvent(&api.OutputPresenceEvent{
+		UserID:       ipe.UserID,
+		Presence:     ipe.Presence,
+		StatusMsg:    ipe.StatusMsg,
+		LastActiveTS: ipe.LastActiveTS,
+	})
+}
+
+// SweepPresence marks any local users who have stopped being active as
+// unavailable or offline, and emits their new presence.
+func (t *EDUServerInputAPI) SweepPresence(now time.Time) error {
+	for _, presence := range t.PresenceCache.Sweep(now, t.PresenceIdleTimeout, t.PresenceOfflineTimeout) {
+		if err := t.sendPresenceEvent(&api.OutputPresenceEvent{
+			UserID:       presence.UserID,
+			Presence:     presence.Presence,
+			StatusMsg:    presence.StatusMsg,
+			LastActiveTS: presence.LastActiveTS,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartPresenceSweeper calls SweepPresence at the given interval in a new goroutine.
+func (t *EDUServerInputAPI) StartPresenceSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if err := t.SweepPresence(now); err != nil {
+				logrus.WithError(err).Error("Failed to sweep presence")
+			}
+		}
+	}()
+}
+
+func (t *EDUServerInputAPI) sendPresenceEvent(output *api.OutputPresenceEvent) error {
+	js, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"user_id":  output.UserID,
+		"presence": output.Presence,
+	}).Infof("Producing to topic '%s'", t.OutputPresenceEventTopic)
+
+	m := &sarama.ProducerMessage{
+		Topic: t.OutputPresenceEventTopic,
+		Key:   sarama.StringEncoder(output.UserID),
+		Value: sarama.ByteEncoder(js),
+	}
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type dummyProducer struct {
+	sarama.SyncProducer
+	typingEvents []api.OutputTypingEvent
+}
+
+func (p *dummyProducer) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	var ote api.OutputTypingEvent
+	if err = json.Unmarshal(msg.Value.(sarama.ByteEncoder), &ote); err != nil {
+		return 0, 0, err
+	}
+	p.typingEvents = append(p.typingEvents, ote)
+	return 0, 0, nil
+}
+
+func TestTypingTimeoutClamped(t *testing.T) {
+	producer := &dummyProducer{}
+	inputAPI := &EDUServerInputAPI{
+		Cache:    cache.New(),
+		Producer: producer,
+		Typing: config.TypingOptions{
+			DefaultTimeout: 50 * time.Millisecond,
+			MaxTimeout:     100 * time.Millisecond,
+		},
+	}
+	roomID, userID := "!room:localhost", "@alice:localhost"
+	removed := make(chan struct{}, 1)
+	inputAPI.Cache.SetTimeoutCallback(func(u, r string, _ int64) {
+		if u == userID && r == roomID {
+			removed <- struct{}{}
+		}
+	})
+
+	now := time.Now()
+	if err := inputAPI.InputTypingEvent(context.Background(), &api.InputTypingEventRequest{
+		InputTypingEvent: api.InputTypingEvent{
+			UserID:         userID,
+			RoomID:         roomID,
+			Typing:         true,
+			TimeoutMS:      time.Hour.Milliseconds(),
+			OriginServerTS: gomatrixserverlib.AsTimestamp(now),
+		},
+	}, &api.InputTypingEventResponse{}); err != nil {
+		t.Fatalf("InputTypingEvent failed: %s", err)
+	}
+
+	if len(producer.typingEvents) != 1 {
+		t.Fatalf("got %d typing events, want 1", len(producer.typingEvents))
+	}
+	expireTime := producer.typingEvents[0].ExpireTime
+	if expireTime == nil || expireTime.After(now.Add(100*time.Millisecond)) {
+		t.Errorf("got expiry time %v, want no later than %v", expireTime, now.Add(100*time.Millisecond))
+	}
+	if users := inputAPI.Cache.GetTypingUsers(roomID); len(users) != 1 || users[0] != userID {
+		t.Fatalf("got typing users %v, want [%s]", users, userID)
+	}
+
+	// The user should stop typing once the clamped timeout passes, rather
+	// than after the hour that they asked for.
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the typing notification to expire")
+	}
+	if users := inputAPI.Cache.GetTypingUsers(roomID); len(users) != 0 {
+		t.Errorf("got typing users %v after expiry, want none", users)
+	}
+}
@@ -15,6 +15,7 @@ const (
 	EDUServerInputTypingEventPath       = "/eduserver/input"
 	EDUServerInputSendToDeviceEventPath = "/eduserver/sendToDevice"
 	EDUServerInputReceiptEventPath      = "/eduserver/receipt"
+	EDUServerInputPresenceEventPath     = "/eduserver/presence"
 )
 
 // NewEDUServerClient creates a EDUServerInputAPI implemented by talking to a HTTP POST API.
@@ -68,3 +69,16 @@ func (h *httpEDUServerInputAPI) InputReceiptEvent(
 	apiURL := h.eduServerURL + EDUServerInputReceiptEventPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// InputPresenceEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *api.InputPresenceEventRequest,
+	response *api.InputPresenceEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputPresenceEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputPresenceEventPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
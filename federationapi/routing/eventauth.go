@@ -14,9 +14,13 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -41,3 +45,43 @@ func GetEventAuth(
 		JSON: gomatrixserverlib.RespEventAuth{AuthEvents: state.AuthEvents},
 	}
 }
+
+// eventAuthClient adds auth chain lookups to a federation client. The events in
+// an /event_auth response can only be decoded once we know the room version,
+// which gomatrixserverlib's GetEventAuth doesn't take, so we make the request
+// ourselves.
+type eventAuthClient struct {
+	*gomatrixserverlib.FederationClient
+	cfg *config.FederationAPI
+}
+
+// LookupEventAuth fetches the auth chain for an event from a remote server.
+// See https://matrix.org/docs/spec/server_server/latest#get-matrix-federation-v1-event-auth-roomid-eventid
+func (c *eventAuthClient) LookupEventAuth(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) ([]*gomatrixserverlib.Event, error) {
+	path := "/_matrix/federation/v1/event_auth/" + url.PathEscape(roomID) + "/" + url.PathEscape(eventID)
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path)
+	if err := fedReq.Sign(c.cfg.Matrix.ServerName, c.cfg.Matrix.KeyID, c.cfg.Matrix.PrivateKey); err != nil {
+		return nil, fmt.Errorf("fedReq.Sign: %w", err)
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return nil, fmt.Errorf("fedReq.HTTPRequest: %w", err)
+	}
+	var res struct {
+		AuthChain []json.RawMessage `json:"auth_chain"`
+	}
+	if err = c.DoRequestAndParseResponse(ctx, req, &res); err != nil {
+		return nil, err
+	}
+	authChain := make([]*gomatrixserverlib.Event, 0, len(res.AuthChain))
+	for _, raw := range res.AuthChain {
+		ev, err := gomatrixserverlib.NewEventFromUntrustedJSON(raw, roomVersion)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.NewEventFromUntrustedJSON: %w", err)
+		}
+		authChain = append(authChain, ev)
+	}
+	return authChain, nil
+}
@@ -187,6 +187,12 @@ func SendJoin(
 			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON: " + err.Error()),
 		}
 	}
+	if err = verifyCanonicalJSON(httpReq.Context(), request.Content(), verRes.RoomVersion, cfg.CanonicalJSONWarnOnly); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The join event is not canonical JSON: " + err.Error()),
+		}
+	}
 
 	// Check that a state key is provided.
 	if event.StateKey() == nil || event.StateKeyEquals("") {
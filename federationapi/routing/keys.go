@@ -196,7 +196,7 @@ func NotaryKeys(
 			} else {
 				return util.ErrorResponse(err)
 			}
-		} else {
+		} else if !cfg.DisableKeyNotary {
 			if k, err := fsAPI.GetServerKeys(httpReq.Context(), serverName); err == nil {
 				keys = &k
 			} else {
@@ -0,0 +1,106 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// notaryFederationSenderAPI returns empty keys for any server, remembering
+// which servers were asked for.
+type notaryFederationSenderAPI struct {
+	federationSenderAPI.FederationSenderInternalAPI
+	requested []gomatrixserverlib.ServerName
+}
+
+func (f *notaryFederationSenderAPI) GetServerKeys(
+	ctx context.Context, s gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerKeys, error) {
+	f.requested = append(f.requested, s)
+	var keys gomatrixserverlib.ServerKeys
+	keys.ServerName = s
+	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))
+	return keys, nil
+}
+
+func TestNotaryKeysCanBeDisabled(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName:        testDestination,
+			KeyID:             "ed25519:auto",
+			PrivateKey:        key,
+			KeyValidityPeriod: time.Hour,
+		},
+	}
+	notaryKeys := func() (got, requested []gomatrixserverlib.ServerName) {
+		t.Helper()
+		req := &gomatrixserverlib.PublicKeyNotaryLookupRequest{
+			ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.PublicKeyNotaryQueryCriteria{
+				testDestination: {},
+				testOrigin:      {},
+			},
+		}
+		fsAPI := &notaryFederationSenderAPI{}
+		httpReq := httptest.NewRequest(http.MethodPost, "/_matrix/key/v2/query", nil)
+		res := NotaryKeys(httpReq, cfg, fsAPI, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var response struct {
+			ServerKeys []gomatrixserverlib.ServerKeys `json:"server_keys"`
+		}
+		if err = json.Unmarshal(body, &response); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		for _, keys := range response.ServerKeys {
+			got = append(got, keys.ServerName)
+		}
+		return got, fsAPI.requested
+	}
+
+	// As a notary we return the keys of other servers as well as our own.
+	got, requested := notaryKeys()
+	if len(got) != 2 {
+		t.Errorf("got keys for %v, want %s and %s", got, testDestination, testOrigin)
+	}
+	if len(requested) != 1 || requested[0] != testOrigin {
+		t.Errorf("fetched keys for %v, want only %s", requested, testOrigin)
+	}
+
+	// Without the notary we only return our own keys.
+	cfg.DisableKeyNotary = true
+	got, requested = notaryKeys()
+	if len(got) != 1 || got[0] != testDestination {
+		t.Errorf("got keys for %v with the notary disabled, want only %s", got, testDestination)
+	}
+	if len(requested) != 0 {
+		t.Errorf("fetched keys for %v with the notary disabled, want none", requested)
+	}
+}
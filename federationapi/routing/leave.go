@@ -151,6 +151,12 @@ func SendLeave(
 			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 		}
 	}
+	if err = verifyCanonicalJSON(httpReq.Context(), request.Content(), verRes.RoomVersion, cfg.CanonicalJSONWarnOnly); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The leave event is not canonical JSON: " + err.Error()),
+		}
+	}
 
 	// Check that the room ID is correct.
 	if event.RoomID() != roomID {
@@ -176,6 +182,33 @@ func SendLeave(
 		}
 	}
 
+	// Check that this is a membership event for the sender.
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event JSON must be an m.room.member event with a state key"),
+		}
+	}
+	if *event.StateKey() != event.Sender() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The state key of the leave event must match the sender"),
+		}
+	}
+	_, senderDomain, err := gomatrixserverlib.SplitID('@', event.Sender())
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The sender of the leave event is not a valid user ID"),
+		}
+	}
+	if senderDomain != request.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The leave must be sent by the server of the user"),
+		}
+	}
+
 	// Check if the user has already left. If so, no-op!
 	queryReq := &api.QueryLatestEventsAndStateRequest{
 		RoomID: roomID,
@@ -263,6 +296,12 @@ func SendLeave(
 		cfg.Matrix.ServerName,
 		nil,
 	); err != nil {
+		if _, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(err.Error()),
+			}
+		}
 		util.GetLogger(httpReq.Context()).WithError(err).Error("producer.SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -2,10 +2,12 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
-	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -23,9 +25,11 @@ type filter struct {
 }
 
 // GetPostPublicRooms implements GET and POST /publicRooms
-func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI) util.JSONResponse {
+func GetPostPublicRooms(
+	req *http.Request, fedReq *gomatrixserverlib.FederationRequest, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
 	var request PublicRoomReq
-	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
+	if fillErr := fillPublicRoomsReq(req, fedReq, &request); fillErr != nil {
 		return *fillErr
 	}
 	if request.Limit == 0 {
@@ -44,11 +48,9 @@ func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.RoomserverInterna
 func publicRooms(
 	ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI.RoomserverInternalAPI,
 ) (*gomatrixserverlib.RespPublicRooms, error) {
-
-	var response gomatrixserverlib.RespPublicRooms
-	var limit int16
-	var offset int64
-	limit = request.Limit
+	response := gomatrixserverlib.RespPublicRooms{
+		Chunk: []gomatrixserverlib.PublicRoom{},
+	}
 	offset, err := strconv.ParseInt(request.Since, 10, 64)
 	// ParseInt returns 0 and an error when trying to parse an empty string
 	// In that case, we want to assign 0 so we ignore the error
@@ -63,116 +65,78 @@ func publicRooms(
 		util.GetLogger(ctx).WithError(err).Error("QueryPublishedRooms failed")
 		return nil, err
 	}
-	response.TotalRoomCountEstimate = len(queryRes.RoomIDs)
-
-	if offset > 0 {
-		response.PrevBatch = strconv.Itoa(int(offset) - 1)
-	}
-	nextIndex := int(offset) + int(limit)
-	if response.TotalRoomCountEstimate > nextIndex {
-		response.NextBatch = strconv.Itoa(nextIndex)
+	rooms, err := roomserverAPI.PopulatePublicRooms(ctx, queryRes.RoomIDs, rsAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("PopulatePublicRooms failed")
+		return nil, err
 	}
+	// Sort by the number of joined members (big to small), then by room ID so
+	// that the order is stable between pages.
+	sort.SliceStable(rooms, func(i, j int) bool {
+		if rooms[i].JoinedMembersCount != rooms[j].JoinedMembersCount {
+			return rooms[i].JoinedMembersCount > rooms[j].JoinedMembersCount
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	response.TotalRoomCountEstimate = len(rooms)
 
-	if offset < 0 {
-		offset = 0
+	rooms = roomserverAPI.FilterPublicRooms(rooms, request.Filter.SearchTerms)
+
+	chunk, prev, next := roomserverAPI.SlicePublicRooms(rooms, offset, request.Limit)
+	if prev >= 0 {
+		response.PrevBatch = "T" + strconv.Itoa(prev)
+	}
+	if next >= 0 {
+		response.NextBatch = "T" + strconv.Itoa(next)
 	}
-	if nextIndex > len(queryRes.RoomIDs) {
-		nextIndex = len(queryRes.RoomIDs)
+	if chunk != nil {
+		response.Chunk = chunk
 	}
-	roomIDs := queryRes.RoomIDs[offset:nextIndex]
-	response.Chunk, err = fillInRooms(ctx, roomIDs, rsAPI)
-	return &response, err
+	return &response, nil
 }
 
 // fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
 // on /publicRooms by parsing the incoming HTTP request
 // Filter is only filled for POST requests
-func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSONResponse {
-	if httpReq.Method == http.MethodGet {
+func fillPublicRoomsReq(
+	httpReq *http.Request, fedReq *gomatrixserverlib.FederationRequest, request *PublicRoomReq,
+) *util.JSONResponse {
+	switch httpReq.Method {
+	case http.MethodGet:
 		limit, err := strconv.Atoi(httpReq.FormValue("limit"))
 		// Atoi returns 0 and an error when trying to parse an empty string
 		// In that case, we want to assign 0 so we ignore the error
 		if err != nil && len(httpReq.FormValue("limit")) > 0 {
-			util.GetLogger(httpReq.Context()).WithError(err).Error("strconv.Atoi failed")
-			reqErr := jsonerror.InternalServerError()
-			return &reqErr
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("limit param is not a number"),
+			}
 		}
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
-		return nil
-	} else if httpReq.Method == http.MethodPost {
-		return httputil.UnmarshalJSONRequest(httpReq, request)
-	}
-
-	return &util.JSONResponse{
-		Code: http.StatusMethodNotAllowed,
-		JSON: jsonerror.NotFound("Bad method"),
-	}
-}
-
-// due to lots of switches
-// nolint:gocyclo
-func fillInRooms(ctx context.Context, roomIDs []string, rsAPI roomserverAPI.RoomserverInternalAPI) ([]gomatrixserverlib.PublicRoom, error) {
-	avatarTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.avatar", StateKey: ""}
-	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.name", StateKey: ""}
-	canonicalTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
-	topicTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.topic", StateKey: ""}
-	guestTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.guest_access", StateKey: ""}
-	visibilityTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""}
-	joinRuleTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}
-
-	var stateRes roomserverAPI.QueryBulkStateContentResponse
-	err := rsAPI.QueryBulkStateContent(ctx, &roomserverAPI.QueryBulkStateContentRequest{
-		RoomIDs:        roomIDs,
-		AllowWildcards: true,
-		StateTuples: []gomatrixserverlib.StateKeyTuple{
-			nameTuple, canonicalTuple, topicTuple, guestTuple, visibilityTuple, joinRuleTuple, avatarTuple,
-			{EventType: gomatrixserverlib.MRoomMember, StateKey: "*"},
-		},
-	}, &stateRes)
-	if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("QueryBulkStateContent failed")
-		return nil, err
-	}
-	util.GetLogger(ctx).Infof("room IDs: %+v", roomIDs)
-	util.GetLogger(ctx).Infof("State res: %+v", stateRes.Rooms)
-	chunk := make([]gomatrixserverlib.PublicRoom, len(roomIDs))
-	i := 0
-	for roomID, data := range stateRes.Rooms {
-		pub := gomatrixserverlib.PublicRoom{
-			RoomID: roomID,
-		}
-		joinCount := 0
-		var joinRule, guestAccess string
-		for tuple, contentVal := range data {
-			if tuple.EventType == gomatrixserverlib.MRoomMember && contentVal == "join" {
-				joinCount++
-				continue
-			}
-			switch tuple {
-			case avatarTuple:
-				pub.AvatarURL = contentVal
-			case nameTuple:
-				pub.Name = contentVal
-			case topicTuple:
-				pub.Topic = contentVal
-			case canonicalTuple:
-				pub.CanonicalAlias = contentVal
-			case visibilityTuple:
-				pub.WorldReadable = contentVal == "world_readable"
-			// need both of these to determine whether guests can join
-			case joinRuleTuple:
-				joinRule = contentVal
-			case guestTuple:
-				guestAccess = contentVal
+	case http.MethodPost:
+		if err := json.Unmarshal(fedReq.Content(), request); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 			}
 		}
-		if joinRule == gomatrixserverlib.Public && guestAccess == "can_join" {
-			pub.GuestCanJoin = true
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
+		}
+	}
+
+	if request.Limit < 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("limit must not be negative"),
 		}
-		pub.JoinedMembersCount = joinCount
-		chunk[i] = pub
-		i++
 	}
-	return chunk, nil
+
+	// The 'T' is only there so that a since token of 0 isn't falsey, see
+	// the client API's /publicRooms.
+	request.Since = strings.TrimPrefix(request.Since, "T")
+	return nil
 }
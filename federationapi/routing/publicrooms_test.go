@@ -0,0 +1,107 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// publicRoomsRoomserverAPI publishes rooms with the given names, where each
+// room has one more joined member than the one before it.
+type publicRoomsRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	names []string
+}
+
+func (r *publicRoomsRoomserverAPI) roomID(i int) string {
+	return "!" + r.names[i] + ":" + string(testDestination)
+}
+
+func (r *publicRoomsRoomserverAPI) QueryPublishedRooms(
+	ctx context.Context, req *api.QueryPublishedRoomsRequest, res *api.QueryPublishedRoomsResponse,
+) error {
+	for i := range r.names {
+		res.RoomIDs = append(res.RoomIDs, r.roomID(i))
+	}
+	return nil
+}
+
+func (r *publicRoomsRoomserverAPI) QueryBulkStateContent(
+	ctx context.Context, req *api.QueryBulkStateContentRequest, res *api.QueryBulkStateContentResponse,
+) error {
+	res.Rooms = map[string]map[gomatrixserverlib.StateKeyTuple]string{}
+	for i, name := range r.names {
+		state := map[gomatrixserverlib.StateKeyTuple]string{
+			{EventType: "m.room.name", StateKey: ""}: name,
+		}
+		for j := 0; j <= i; j++ {
+			userID := "@user" + string(rune('a'+j)) + ":" + string(testDestination)
+			state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}] = gomatrixserverlib.Join
+		}
+		res.Rooms[r.roomID(i)] = state
+	}
+	return nil
+}
+
+func TestGetPostPublicRooms(t *testing.T) {
+	rsAPI := &publicRoomsRoomserverAPI{
+		names: []string{"apples", "bananas", "cherries"},
+	}
+	getPublicRooms := func(method, uri string, content interface{}) gomatrixserverlib.RespPublicRooms {
+		t.Helper()
+		fedReq := gomatrixserverlib.NewFederationRequest(method, testDestination, uri)
+		if content != nil {
+			if err := fedReq.SetContent(content); err != nil {
+				t.Fatalf("failed to set content: %s", err)
+			}
+		}
+		res := GetPostPublicRooms(httptest.NewRequest(method, uri, nil), &fedReq, rsAPI)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s %s returned HTTP %d", method, uri, res.Code)
+		}
+		return *res.JSON.(*gomatrixserverlib.RespPublicRooms)
+	}
+	assertRooms := func(res gomatrixserverlib.RespPublicRooms, want ...string) {
+		t.Helper()
+		if len(res.Chunk) != len(want) {
+			t.Fatalf("got %d rooms, want %d", len(res.Chunk), len(want))
+		}
+		for i := range want {
+			if res.Chunk[i].Name != want[i] {
+				t.Errorf("room %d: got %q, want %q", i, res.Chunk[i].Name, want[i])
+			}
+		}
+	}
+
+	// Rooms with the most members come first, and can be paginated through.
+	res := getPublicRooms(http.MethodGet, "/_matrix/federation/v1/publicRooms?limit=2", nil)
+	assertRooms(res, "cherries", "bananas")
+	if res.TotalRoomCountEstimate != 3 || res.PrevBatch != "" || res.NextBatch == "" {
+		t.Fatalf("got total %d, prev %q, next %q", res.TotalRoomCountEstimate, res.PrevBatch, res.NextBatch)
+	}
+	res = getPublicRooms(http.MethodGet, "/_matrix/federation/v1/publicRooms?limit=2&since="+res.NextBatch, nil)
+	assertRooms(res, "apples")
+	if res.PrevBatch == "" || res.NextBatch != "" {
+		t.Errorf("got prev %q, next %q on the last page", res.PrevBatch, res.NextBatch)
+	}
+
+	// POST requests can search the directory.
+	res = getPublicRooms(http.MethodPost, "/_matrix/federation/v1/publicRooms", PublicRoomReq{
+		Filter: filter{SearchTerms: "AN"},
+	})
+	assertRooms(res, "bananas")
+
+	// A since token past the end of the directory gives an empty page, and
+	// negative limits are rejected.
+	res = getPublicRooms(http.MethodGet, "/_matrix/federation/v1/publicRooms?limit=2&since=T10", nil)
+	assertRooms(res)
+	uri := "/_matrix/federation/v1/publicRooms?limit=-1"
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, testDestination, uri)
+	if res := GetPostPublicRooms(httptest.NewRequest(http.MethodGet, uri, nil), &fedReq, rsAPI); res.Code != http.StatusBadRequest {
+		t.Errorf("got HTTP %d for a negative limit, want %d", res.Code, http.StatusBadRequest)
+	}
+}
@@ -15,11 +15,14 @@
 package routing
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
+	"strconv"
 	"sync"
 	"time"
 
@@ -49,10 +52,13 @@ func Send(
 		rsAPI:      rsAPI,
 		eduAPI:     eduAPI,
 		keys:       keys,
-		federation: federation,
+		federation: &eventAuthClient{federation, cfg},
 		haveEvents: make(map[string]*gomatrixserverlib.HeaderedEvent),
 		newEvents:  make(map[string]bool),
 		keyAPI:     keyAPI,
+
+		inboundPresence:       cfg.Matrix.Presence.EnableInbound,
+		canonicalJSONWarnOnly: cfg.CanonicalJSONWarnOnly,
 	}
 
 	var txnEvents struct {
@@ -100,6 +106,71 @@ func Send(
 	}
 }
 
+// verifyCanonicalJSON returns an error if the PDU is in a room version which
+// enforces canonical JSON but it has values that canonical JSON can't hold,
+// e.g. numbers which aren't integers in range, unless warnOnly is set. Only
+// the values are compared with the canonical form, not the bytes, because
+// encoders are free to escape characters such as < and > in transit.
+func verifyCanonicalJSON(ctx context.Context, pdu []byte, roomVersion gomatrixserverlib.RoomVersion, warnOnly bool) error {
+	enforce, err := roomVersion.EnforceCanonicalJSON()
+	if err != nil || !enforce {
+		return err
+	}
+	canonical, err := gomatrixserverlib.CanonicalJSON(pdu)
+	if err != nil {
+		return err
+	}
+	var value, canonicalValue interface{}
+	if err = decodeJSONValue(pdu, &value); err != nil {
+		return err
+	}
+	if err = decodeJSONValue(canonical, &canonicalValue); err != nil {
+		return err
+	}
+	err = checkCanonicalJSONValue(value)
+	if err == nil && !reflect.DeepEqual(value, canonicalValue) {
+		err = fmt.Errorf("values change when converted to canonical form")
+	}
+	if err == nil || !warnOnly {
+		return err
+	}
+	util.GetLogger(ctx).WithError(err).Warn("Accepting PDU which is not in canonical form")
+	return nil
+}
+
+// decodeJSONValue decodes the JSON keeping numbers exactly as they were sent.
+func decodeJSONValue(data []byte, value *interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// checkCanonicalJSONValue returns an error if the decoded value contains a
+// number which isn't an integer in the range that canonical JSON allows.
+// See: https://matrix.org/docs/spec/rooms/v6#canonical-json
+func checkCanonicalJSONValue(value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, elem := range v {
+			if err := checkCanonicalJSONValue(elem); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if err := checkCanonicalJSONValue(elem); err != nil {
+				return err
+			}
+		}
+	case json.Number:
+		i, err := strconv.ParseInt(v.String(), 10, 64)
+		if err != nil || i < -(1<<53)+1 || i > (1<<53)-1 {
+			return fmt.Errorf("number %s isn't an integer in the allowed range", v)
+		}
+	}
+	return nil
+}
+
 type txnReq struct {
 	gomatrixserverlib.Transaction
 	rsAPI      api.RoomserverInternalAPI
@@ -107,6 +178,10 @@ type txnReq struct {
 	keyAPI     keyapi.KeyInternalAPI
 	keys       gomatrixserverlib.JSONVerifier
 	federation txnFederationClient
+	// whether to process presence EDUs from the origin server
+	inboundPresence bool
+	// whether to accept PDUs which aren't in canonical form, with a warning
+	canonicalJSONWarnOnly bool
 	// local cache of events for auth checks, etc - this may include events
 	// which the roomserver is unaware of.
 	haveEvents map[string]*gomatrixserverlib.HeaderedEvent
@@ -122,6 +197,9 @@ type txnFederationClient interface {
 	)
 	LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error)
 	GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error)
+	LookupEventAuth(ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+		res []*gomatrixserverlib.Event, err error,
+	)
 	LookupMissingEvents(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents,
 		roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespMissingEvents, err error)
 }
@@ -166,6 +244,13 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %s", string(pdu))
 			continue
 		}
+		if err = verifyCanonicalJSON(ctx, pdu, verRes.RoomVersion, t.canonicalJSONWarnOnly); err != nil {
+			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Event %q is not canonical JSON", event.EventID())
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: "PDU is not canonical JSON: " + err.Error(),
+			}
+			continue
+		}
 		if api.IsServerBannedFromRoom(ctx, t.rsAPI, event.RoomID(), t.Origin) {
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
 				Error: "Forbidden by server ACLs",
@@ -325,6 +410,11 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 			}
 		case gomatrixserverlib.MDeviceListUpdate:
 			t.processDeviceListUpdate(ctx, e)
+		case eduserverAPI.MPresence:
+			if !t.inboundPresence {
+				continue // presence from other servers is disabled
+			}
+			t.processPresence(ctx, e)
 		case gomatrixserverlib.MReceipt:
 			// https://matrix.org/docs/spec/server_server/r0.1.4#receipts
 			payload := map[string]eduserverAPI.FederationReceiptMRead{}
@@ -388,6 +478,38 @@ func (t *txnReq) processReceiptEvent(ctx context.Context,
 	return nil
 }
 
+// processPresence sends presence updates to the edu server
+func (t *txnReq) processPresence(ctx context.Context, e gomatrixserverlib.EDU) {
+	// https://matrix.org/docs/spec/server_server/r0.1.4#presence
+	var payload eduserverAPI.FederationPresence
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal presence event")
+		return
+	}
+	now := time.Now()
+	for _, update := range payload.Push {
+		_, domain, err := gomatrixserverlib.SplitID('@', update.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to split domain from presence event sender")
+			continue
+		}
+		if domain != t.Origin {
+			util.GetLogger(ctx).Warnf("Dropping presence event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
+			continue
+		}
+		switch update.Presence {
+		case eduserverAPI.PresenceOnline, eduserverAPI.PresenceUnavailable, eduserverAPI.PresenceOffline:
+		default:
+			util.GetLogger(ctx).Warnf("Dropping presence event with unknown presence %q", update.Presence)
+			continue
+		}
+		lastActiveTS := gomatrixserverlib.AsTimestamp(now.Add(-time.Duration(update.LastActiveAgo) * time.Millisecond))
+		if err := eduserverAPI.SendPresence(ctx, t.eduAPI, update.UserID, update.Presence, update.StatusMsg, lastActiveTS); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", update.UserID).Error("Failed to send presence event to edu server")
+		}
+	}
+}
+
 func (t *txnReq) processDeviceListUpdate(ctx context.Context, e gomatrixserverlib.EDU) {
 	var payload gomatrixserverlib.DeviceListUpdateEvent
 	if err := json.Unmarshal(e.Content, &payload); err != nil {
@@ -482,6 +604,15 @@ func (t *txnReq) retrieveMissingAuthEvents(
 		missingAuthEvents[missingAuthEventID] = struct{}{}
 	}
 
+	// Ask the origin for the whole auth chain first, as that will usually
+	// give us all of the missing auth events in one request.
+	if err := t.retrieveAuthChain(ctx, e, stateResp.RoomVersion, missingAuthEvents); err != nil {
+		logger.WithError(err).Warnf("Failed to retrieve auth chain from %q", t.Origin)
+	}
+	if len(missingAuthEvents) == 0 {
+		return nil
+	}
+
 	servers := t.getServers(ctx, e.RoomID())
 	if len(servers) > 5 {
 		servers = servers[:5]
@@ -501,6 +632,10 @@ withNextEvent:
 				logger.WithError(err).Warnf("Failed to unmarshal auth event %q", missingAuthEventID)
 				continue withNextServer
 			}
+			if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, []*gomatrixserverlib.Event{ev}, t.keys); err != nil {
+				logger.WithError(err).Warnf("Auth event %q has invalid signatures", missingAuthEventID)
+				continue withNextServer
+			}
 			if err = api.SendInputRoomEvents(
 				context.Background(),
 				t.rsAPI,
@@ -526,6 +661,55 @@ withNextEvent:
 	return nil
 }
 
+// retrieveAuthChain fetches the auth chain of the event from the origin and
+// sends the events in it with valid signatures to the roomserver as outliers.
+// The events that were sent are removed from missingAuthEvents.
+func (t *txnReq) retrieveAuthChain(
+	ctx context.Context, e *gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion,
+	missingAuthEvents map[string]struct{},
+) error {
+	authChain, err := t.federation.LookupEventAuth(ctx, t.Origin, e.RoomID(), e.EventID(), roomVersion)
+	if err != nil {
+		return fmt.Errorf("t.federation.LookupEventAuth: %w", err)
+	}
+	verifyErrs, err := gomatrixserverlib.VerifyEventSignatures(ctx, authChain, t.keys)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.VerifyEventSignatures: %w", err)
+	}
+	verified := make([]*gomatrixserverlib.Event, 0, len(authChain))
+	for i, ev := range authChain {
+		if ev.RoomID() != e.RoomID() {
+			continue
+		}
+		if verifyErrs[i] != nil {
+			util.GetLogger(ctx).WithError(verifyErrs[i]).Warnf("Auth event %q has invalid signatures", ev.EventID())
+			continue
+		}
+		verified = append(verified, ev)
+	}
+
+	// Send the auth events so that each one comes after its own auth events.
+	inputEvents := make([]api.InputRoomEvent, 0, len(verified))
+	for _, ev := range gomatrixserverlib.ReverseTopologicalOrdering(verified, gomatrixserverlib.TopologicalOrderByAuthEvents) {
+		inputEvents = append(inputEvents, api.InputRoomEvent{
+			Kind:         api.KindOutlier,
+			Event:        ev.Headered(roomVersion),
+			AuthEventIDs: ev.AuthEventIDs(),
+			SendAsServer: api.DoNotSendToOtherServers,
+		})
+	}
+	if len(inputEvents) == 0 {
+		return nil
+	}
+	if err = api.SendInputRoomEvents(context.Background(), t.rsAPI, inputEvents); err != nil {
+		return fmt.Errorf("api.SendInputRoomEvents: %w", err)
+	}
+	for _, ev := range verified {
+		delete(missingAuthEvents, ev.EventID())
+	}
+	return nil
+}
+
 func checkAllowedByState(e *gomatrixserverlib.Event, stateEvents []*gomatrixserverlib.Event) error {
 	authUsingState := gomatrixserverlib.NewAuthEvents(nil)
 	for i := range stateEvents {
@@ -1,13 +1,17 @@
 package routing
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/internal/test"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -56,6 +60,8 @@ func init() {
 type testEDUProducer struct {
 	// this producer keeps track of calls to InputTypingEvent
 	invocations []eduAPI.InputTypingEventRequest
+	// and calls to InputPresenceEvent
+	presenceInvocations []eduAPI.InputPresenceEventRequest
 }
 
 func (p *testEDUProducer) InputTypingEvent(
@@ -83,6 +89,15 @@ func (o *testEDUProducer) InputReceiptEvent(
 	return nil
 }
 
+func (o *testEDUProducer) InputPresenceEvent(
+	ctx context.Context,
+	request *eduAPI.InputPresenceEventRequest,
+	response *eduAPI.InputPresenceEventResponse,
+) error {
+	o.presenceInvocations = append(o.presenceInvocations, *request)
+	return nil
+}
+
 type testRoomserverAPI struct {
 	api.RoomserverInternalAPITrace
 	inputRoomEvents            []api.InputRoomEvent
@@ -90,6 +105,8 @@ type testRoomserverAPI struct {
 	queryStateAfterEvents      func(*api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse
 	queryEventsByID            func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse
 	queryLatestEventsAndState  func(*api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse
+	// the room version to report, or testRoomVersion if empty
+	roomVersion gomatrixserverlib.RoomVersion
 }
 
 func (t *testRoomserverAPI) InputRoomEvents(
@@ -246,6 +263,9 @@ func (t *testRoomserverAPI) QueryRoomVersionForRoom(
 	response *api.QueryRoomVersionForRoomResponse,
 ) error {
 	response.RoomVersion = testRoomVersion
+	if t.roomVersion != "" {
+		response.RoomVersion = t.roomVersion
+	}
 	return nil
 }
 
@@ -322,6 +342,7 @@ type txnFedClient struct {
 	state            map[string]gomatrixserverlib.RespState    // event_id to response
 	stateIDs         map[string]gomatrixserverlib.RespStateIDs // event_id to response
 	getEvent         map[string]gomatrixserverlib.Transaction  // event_id to response
+	eventAuth        map[string][]*gomatrixserverlib.Event     // event_id to auth chain
 	getMissingEvents func(gomatrixserverlib.MissingEvents) (res gomatrixserverlib.RespMissingEvents, err error)
 }
 
@@ -357,6 +378,18 @@ func (c *txnFedClient) GetEvent(ctx context.Context, s gomatrixserverlib.ServerN
 	res = r
 	return
 }
+func (c *txnFedClient) LookupEventAuth(ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+	res []*gomatrixserverlib.Event, err error,
+) {
+	fmt.Println("testFederationClient.LookupEventAuth", eventID)
+	r, ok := c.eventAuth[eventID]
+	if !ok {
+		err = fmt.Errorf("txnFedClient: no /event_auth for event ID %s", eventID)
+		return
+	}
+	res = r
+	return
+}
 func (c *txnFedClient) LookupMissingEvents(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents,
 	roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespMissingEvents, err error) {
 	return c.getMissingEvents(missing)
@@ -370,6 +403,8 @@ func mustCreateTransaction(rsAPI api.RoomserverInternalAPI, fedClient txnFederat
 		federation: fedClient,
 		haveEvents: make(map[string]*gomatrixserverlib.HeaderedEvent),
 		newEvents:  make(map[string]bool),
+
+		inboundPresence: true,
 	}
 	t.PDUs = pdus
 	t.Origin = testOrigin
@@ -453,6 +488,191 @@ func TestBasicTransaction(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// The purpose of this test is to check that presence EDUs are passed to the EDU
+// server, but only for users who belong to the origin server.
+func TestTransactionPresenceEDU(t *testing.T) {
+	statusMsg := "slaying monsters"
+	content, err := json.Marshal(eduAPI.FederationPresence{
+		Push: []eduAPI.FederationPresenceUpdate{
+			{
+				UserID:          "@geralt:" + string(testOrigin),
+				Presence:        eduAPI.PresenceOnline,
+				StatusMsg:       &statusMsg,
+				LastActiveAgo:   60 * 1000,
+				CurrentlyActive: true,
+			},
+			{
+				UserID:   "@ciri:elsewhere",
+				Presence: eduAPI.PresenceOnline,
+			},
+			{
+				UserID:   "@yennefer:" + string(testOrigin),
+				Presence: "teleporting",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal presence EDU: %s", err)
+	}
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduAPI = eduProducer
+	txn.EDUs = []gomatrixserverlib.EDU{
+		{Type: eduAPI.MPresence, Origin: string(testOrigin), Content: content},
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	if len(eduProducer.presenceInvocations) != 1 {
+		t.Fatalf("expected 1 presence update, got %d", len(eduProducer.presenceInvocations))
+	}
+	got := eduProducer.presenceInvocations[0].InputPresenceEvent
+	if got.UserID != "@geralt:"+string(testOrigin) || got.Presence != eduAPI.PresenceOnline {
+		t.Errorf("unexpected presence update: %+v", got)
+	}
+	if got.StatusMsg == nil || *got.StatusMsg != statusMsg {
+		t.Errorf("expected status message %q, got %v", statusMsg, got.StatusMsg)
+	}
+	lastActiveAgo := time.Since(got.LastActiveTS.Time())
+	if lastActiveAgo < time.Minute || lastActiveAgo > 2*time.Minute {
+		t.Errorf("expected last active to be about a minute ago, got %s", lastActiveAgo)
+	}
+}
+
+// The purpose of this test is to check that presence EDUs are ignored when
+// inbound presence is disabled.
+func TestTransactionPresenceEDUInboundDisabled(t *testing.T) {
+	content, err := json.Marshal(eduAPI.FederationPresence{
+		Push: []eduAPI.FederationPresenceUpdate{
+			{UserID: "@geralt:" + string(testOrigin), Presence: eduAPI.PresenceOnline},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal presence EDU: %s", err)
+	}
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduAPI = eduProducer
+	txn.inboundPresence = false
+	txn.EDUs = []gomatrixserverlib.EDU{
+		{Type: eduAPI.MPresence, Origin: string(testOrigin), Content: content},
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	if len(eduProducer.presenceInvocations) != 0 {
+		t.Errorf("expected presence to be ignored, got %d presence updates", len(eduProducer.presenceInvocations))
+	}
+}
+
+// The purpose of this test is to check that PDUs in room versions which enforce
+// canonical JSON are rejected unless they were sent in canonical form, or we
+// have been told to only warn about that, and that PDUs containing floats are
+// always rejected.
+func TestTransactionRejectsNonCanonicalJSON(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	b := gomatrixserverlib.EventBuilder{
+		Sender: "@userid:kaer.morhen", RoomID: "!roomid:kaer.morhen", Type: "m.room.message",
+		Depth: 10, PrevEvents: []string{testEvents[len(testEvents)-1].EventID()},
+	}
+	if err := b.SetContent(map[string]interface{}{"amount": 100, "body": "Test Message"}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := b.Build(time.Now(), testOrigin, "ed25519:auto", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	canonical := ev.JSON()
+	unsorted := append([]byte(`{"type":"m.room.message",`), bytes.Replace(canonical[1:], []byte(`,"type":"m.room.message"`), nil, 1)...)
+	exponent := bytes.Replace(canonical, []byte(`"amount":100`), []byte(`"amount":1e2`), 1)
+	float := bytes.Replace(canonical, []byte(`"amount":100`), []byte(`"amount":1.5`), 1)
+
+	for _, tc := range []struct {
+		name         string
+		pdu          json.RawMessage
+		warnOnly     bool
+		wantPDUError bool
+		wantBadJSON  bool
+	}{
+		{"canonical", canonical, false, false, false},
+		// Only the values have to be canonical, not the encoding.
+		{"unsorted keys", unsorted, false, false, false},
+		{"exponent", exponent, false, true, false},
+		{"exponent when only warning", exponent, true, false, false},
+		{"float when only warning", float, true, false, true},
+	} {
+		rsAPI := &testRoomserverAPI{
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+				return api.QueryMissingAuthPrevEventsResponse{RoomExists: true}
+			},
+		}
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{tc.pdu})
+		txn.canonicalJSONWarnOnly = tc.warnOnly
+		res, jsonErr := txn.processTransaction(context.Background())
+		if tc.wantBadJSON {
+			if jsonErr == nil {
+				t.Errorf("%s: txn.processTransaction accepted the transaction, want M_BAD_JSON", tc.name)
+			} else if merr, ok := jsonErr.JSON.(*jsonerror.MatrixError); !ok || merr.ErrCode != "M_BAD_JSON" || jsonErr.Code != 400 {
+				t.Errorf("%s: got HTTP %d %+v, want 400 M_BAD_JSON", tc.name, jsonErr.Code, jsonErr.JSON)
+			}
+			continue
+		}
+		if jsonErr != nil {
+			t.Errorf("%s: txn.processTransaction returned an error: %+v", tc.name, jsonErr.JSON)
+			continue
+		}
+		if gotPDUError := res.PDUs[ev.EventID()].Error != ""; gotPDUError != tc.wantPDUError {
+			t.Errorf("%s: got PDU result %+v, want error %v", tc.name, res.PDUs[ev.EventID()], tc.wantPDUError)
+		}
+		if gotSent := len(rsAPI.inputRoomEvents) != 0; gotSent == tc.wantPDUError {
+			t.Errorf("%s: got event sent to the roomserver %v, want %v", tc.name, gotSent, !tc.wantPDUError)
+		}
+	}
+}
+
+// The purpose of this test is to check that events containing characters
+// which encoding/json escapes, such as HTML, are still accepted as canonical
+// JSON after going through the encoding that federation requests use.
+func TestTransactionAcceptsEscapedHTML(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	b := gomatrixserverlib.EventBuilder{
+		Sender: "@userid:kaer.morhen", RoomID: "!roomid:kaer.morhen", Type: "m.room.message",
+		Depth: 10, PrevEvents: []string{testEvents[len(testEvents)-1].EventID()},
+	}
+	if err := b.SetContent(map[string]interface{}{
+		"msgtype": "m.text", "body": "hi & bye", "format": "org.matrix.custom.html", "formatted_body": "<b>hi</b> &amp; bye",
+	}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := b.Build(time.Now(), testOrigin, "ed25519:auto", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+
+	request := gomatrixserverlib.NewFederationRequest(http.MethodPut, testDestination, "/_matrix/federation/v1/send/1")
+	if err = request.SetContent(gomatrixserverlib.Transaction{PDUs: []json.RawMessage{ev.JSON()}}); err != nil {
+		t.Fatalf("failed to set request content: %s", err)
+	}
+	var received gomatrixserverlib.Transaction
+	if err = json.Unmarshal(request.Content(), &received); err != nil {
+		t.Fatalf("failed to unmarshal transaction: %s", err)
+	}
+	if bytes.Equal(received.PDUs[0], ev.JSON()) {
+		t.Fatalf("expected the encoding to escape the HTML in the PDU")
+	}
+
+	rsAPI := &testRoomserverAPI{
+		roomVersion: gomatrixserverlib.RoomVersionV6,
+		queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			return api.QueryMissingAuthPrevEventsResponse{RoomExists: true}
+		},
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, received.PDUs)
+	mustProcessTransaction(t, txn, []string{})
+	if len(rsAPI.inputRoomEvents) != 1 {
+		t.Errorf("got %d events sent to the roomserver, want 1", len(rsAPI.inputRoomEvents))
+	}
+}
+
 // The purpose of this test is to check that if the event received fails auth checks the event is still sent to the roomserver
 // as it does the auth check.
 func TestTransactionFailAuthChecks(t *testing.T) {
@@ -474,6 +694,40 @@ func TestTransactionFailAuthChecks(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// The purpose of this test is to make sure that when an event is received for which we do not know the auth_events,
+// we fetch its auth chain from the origin with /event_auth. The auth events should be sent to the roomserver as
+// outliers in auth order, followed by the event itself.
+func TestTransactionFetchMissingAuthChain(t *testing.T) {
+	createEvent := testEvents[0]
+	memberEvent := testEvents[1]
+	inputEvent := testEvents[len(testEvents)-1]
+	rsAPI := &testRoomserverAPI{
+		queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			return api.QueryMissingAuthPrevEventsResponse{
+				RoomExists:          true,
+				MissingAuthEventIDs: []string{createEvent.EventID(), memberEvent.EventID()},
+				MissingPrevEventIDs: []string{},
+			}
+		},
+	}
+	cli := &txnFedClient{
+		eventAuth: map[string][]*gomatrixserverlib.Event{
+			inputEvent.EventID(): {memberEvent.Unwrap(), createEvent.Unwrap()},
+		},
+	}
+	pdus := []json.RawMessage{
+		inputEvent.JSON(),
+	}
+	txn := mustCreateTransaction(rsAPI, cli, pdus)
+	mustProcessTransaction(t, txn, nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{createEvent, memberEvent, inputEvent})
+	for i, kind := range []api.Kind{api.KindOutlier, api.KindOutlier, api.KindNew} {
+		if i < len(rsAPI.inputRoomEvents) && rsAPI.inputRoomEvents[i].Kind != kind {
+			t.Errorf("InputRoomEvents[%d] got kind %d want %d", i, rsAPI.inputRoomEvents[i].Kind, kind)
+		}
+	}
+}
+
 // The purpose of this test is to make sure that when an event is received for which we do not know the prev_events,
 // we request them from /get_missing_events. It works by setting PrevEventsExist=false in the roomserver query response,
 // resulting in a call to /get_missing_events which returns the missing prev event. Both events should be processed in
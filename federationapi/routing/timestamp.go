@@ -0,0 +1,85 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// TimestampToEvent implements the federation version of the
+// timestamp_to_event endpoint from MSC3030, which returns the event
+// closest to the given timestamp in the given direction.
+// See: https://github.com/matrix-org/matrix-doc/pull/3030
+func TimestampToEvent(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	rsAPI api.RoomserverInternalAPI,
+	roomID string,
+) util.JSONResponse {
+	ctx := httpReq.Context()
+	query := httpReq.URL.Query()
+	ts, err := strconv.ParseUint(query.Get("ts"), 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("ts must be a timestamp in milliseconds"),
+		}
+	}
+	var backwards bool
+	switch query.Get("dir") {
+	case "b":
+		backwards = true
+	case "f":
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("dir must be either 'f' or 'b'"),
+		}
+	}
+
+	var res api.QueryEventNearestTimestampResponse
+	if err = rsAPI.QueryEventNearestTimestamp(ctx, &api.QueryEventNearestTimestampRequest{
+		RoomID:    roomID,
+		Timestamp: gomatrixserverlib.Timestamp(ts),
+		Backwards: backwards,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryEventNearestTimestamp failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.EventID == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unable to find an event in that direction"),
+		}
+	}
+	if resErr := allowedToSeeEvent(ctx, request.Origin(), rsAPI, res.EventID); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationSenderAPI.MSC3030TimestampToEventResponse{
+			EventID:        res.EventID,
+			OriginServerTS: res.OriginServerTS,
+		},
+	}
+}
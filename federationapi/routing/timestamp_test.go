@@ -0,0 +1,75 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// timestampRoomserverAPI has an event every second, the second of which
+// the requesting server isn't allowed to see.
+type timestampRoomserverAPI struct {
+	api.RoomserverInternalAPI
+}
+
+var timestampEventIDs = []string{"$first", "$hidden", "$third"}
+
+func (r *timestampRoomserverAPI) QueryEventNearestTimestamp(
+	ctx context.Context, req *api.QueryEventNearestTimestampRequest, res *api.QueryEventNearestTimestampResponse,
+) error {
+	for i := range timestampEventIDs {
+		if req.Backwards {
+			i = len(timestampEventIDs) - 1 - i
+		}
+		ts := gomatrixserverlib.Timestamp((i + 1) * 1000)
+		if (req.Backwards && ts <= req.Timestamp) || (!req.Backwards && ts >= req.Timestamp) {
+			res.EventID, res.OriginServerTS = timestampEventIDs[i], ts
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *timestampRoomserverAPI) QueryServerAllowedToSeeEvent(
+	ctx context.Context, req *api.QueryServerAllowedToSeeEventRequest, res *api.QueryServerAllowedToSeeEventResponse,
+) error {
+	res.AllowedToSeeEvent = req.EventID != "$hidden"
+	return nil
+}
+
+func TestTimestampToEvent(t *testing.T) {
+	rsAPI := &timestampRoomserverAPI{}
+	for _, tc := range []struct {
+		query     string
+		wantCode  int
+		wantEvent string
+	}{
+		{"ts=500&dir=f", http.StatusOK, "$first"},
+		{"ts=3500&dir=b", http.StatusOK, "$third"},
+		{"ts=2500&dir=f", http.StatusOK, "$third"},
+		{"ts=2500&dir=b", http.StatusForbidden, ""},
+		{"ts=500&dir=b", http.StatusNotFound, ""},
+		{"ts=3500&dir=f", http.StatusNotFound, ""},
+		{"ts=500", http.StatusBadRequest, ""},
+		{"ts=soon&dir=f", http.StatusBadRequest, ""},
+	} {
+		uri := "/_matrix/federation/unstable/org.matrix.msc3030/timestamp_to_event/!room:localhost?" + tc.query
+		fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, testDestination, uri)
+		res := TimestampToEvent(httptest.NewRequest(http.MethodGet, uri, nil), &fedReq, rsAPI, "!room:localhost")
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.query, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		if got := res.JSON.(federationSenderAPI.MSC3030TimestampToEventResponse); got.EventID != tc.wantEvent {
+			t.Errorf("%s: got event %s, want %s", tc.query, got.EventID, tc.wantEvent)
+		}
+	}
+}
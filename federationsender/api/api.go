@@ -25,6 +25,13 @@ type FederationClient interface {
 	LookupServerKeys(ctx context.Context, s gomatrixserverlib.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) ([]gomatrixserverlib.ServerKeys, error)
 }
 
+// MSC3030TimestampToEventResponse is the response to a timestamp_to_event
+// request to a remote server, as described in MSC3030.
+type MSC3030TimestampToEventResponse struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
 // FederationClientError is returned from FederationClient methods in the event of a problem.
 type FederationClientError struct {
 	Err         string
@@ -40,6 +47,10 @@ func (e *FederationClientError) Error() string {
 type FederationSenderInternalAPI interface {
 	FederationClient
 
+	// MSC3030TimestampToEvent asks a remote server for the event in a room
+	// which was sent closest to a time, as described in MSC3030.
+	MSC3030TimestampToEvent(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, backwards bool) (res MSC3030TimestampToEventResponse, err error)
+
 	// PerformDirectoryLookup looks up a remote room ID from a room alias.
 	PerformDirectoryLookup(
 		ctx context.Context,
@@ -55,6 +66,12 @@ type FederationSenderInternalAPI interface {
 		request *QueryJoinedHostServerNamesInRoomRequest,
 		response *QueryJoinedHostServerNamesInRoomResponse,
 	) error
+	// Query the events that we gave up trying to send to other servers.
+	QueryDeadLetters(
+		ctx context.Context,
+		request *QueryDeadLettersRequest,
+		response *QueryDeadLettersResponse,
+	) error
 	// Handle an instruction to make_join & send_join with a remote server.
 	PerformJoin(
 		ctx context.Context,
@@ -146,6 +163,18 @@ type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
 }
 
+// QueryDeadLettersRequest is a request to QueryDeadLetters
+type QueryDeadLettersRequest struct {
+	// The maximum number of dead letters to return.
+	Limit int `json:"limit"`
+}
+
+// QueryDeadLettersResponse is a response to QueryDeadLetters
+type QueryDeadLettersResponse struct {
+	// The dead letters, most recent first.
+	DeadLetters []types.DeadLetter `json:"dead_letters"`
+}
+
 type PerformBroadcastEDURequest struct {
 }
 
@@ -200,6 +200,11 @@ func (t *OutputEDUConsumer) onReceiptEvent(msg *sarama.ConsumerMessage) error {
 		return nil
 	}
 
+	// private read receipts are only for the user who sent them
+	if receipt.Type == api.ReceiptTypeReadPrivate {
+		return nil
+	}
+
 	// only send receipt events which originated from us
 	_, receiptServerName, err := gomatrixserverlib.SplitID('@', receipt.UserID)
 	if err != nil {
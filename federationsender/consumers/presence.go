@@ -0,0 +1,199 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/internal"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// presenceBatchInterval is how often batched up presence updates are sent
+// to remote servers.
+const presenceBatchInterval = time.Second * 2
+
+// PresenceConsumer consumes presence updates that originate in the EDU server
+// and sends them in batches to the servers that share a room with the user.
+type PresenceConsumer struct {
+	consumer   *internal.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	serverName gomatrixserverlib.ServerName
+	rsAPI      roomserverAPI.RoomserverInternalAPI
+
+	pendingMutex sync.Mutex
+	// destination -> user ID -> latest presence update for that user
+	pending map[gomatrixserverlib.ServerName]map[string]api.OutputPresenceEvent
+}
+
+// NewPresenceConsumer creates a new PresenceConsumer. Call Start() to begin consuming from EDU servers.
+func NewPresenceConsumer(
+	cfg *config.FederationSender,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) *PresenceConsumer {
+	c := &PresenceConsumer{
+		consumer: &internal.ContinualConsumer{
+			ComponentName:  "eduserver/presence",
+			Topic:          cfg.Matrix.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: store,
+		},
+		queues:     queues,
+		db:         store,
+		serverName: cfg.Matrix.ServerName,
+		rsAPI:      rsAPI,
+		pending:    make(map[gomatrixserverlib.ServerName]map[string]api.OutputPresenceEvent),
+	}
+	c.consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers and sending batches of presence updates
+func (t *PresenceConsumer) Start() error {
+	if err := t.consumer.Start(); err != nil {
+		return fmt.Errorf("t.consumer.Start: %w", err)
+	}
+	go func() {
+		ticker := time.NewTicker(presenceBatchInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			t.sendPending()
+		}
+	}()
+	return nil
+}
+
+// onMessage is called in response to a message received on the
+// presence events topic from the EDU server.
+func (t *PresenceConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed (expected presence)")
+		return nil
+	}
+	logger := log.WithField("user_id", output.UserID)
+
+	// only send presence updates which originated from us
+	_, originServerName, err := gomatrixserverlib.SplitID('@', output.UserID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to extract domain from presence sender")
+		return nil
+	}
+	if originServerName != t.serverName {
+		return nil
+	}
+
+	var queryRes roomserverAPI.QueryRoomsForUserResponse
+	err = t.rsAPI.QueryRoomsForUser(context.Background(), &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         output.UserID,
+		WantMembership: "join",
+	}, &queryRes)
+	if err != nil {
+		logger.WithError(err).Error("failed to calculate joined rooms for user")
+		return nil
+	}
+	// send this presence update to all servers who share rooms with this user.
+	destinations, err := t.db.GetJoinedHostsForRooms(context.Background(), queryRes.RoomIDs)
+	if err != nil {
+		logger.WithError(err).Error("failed to calculate joined hosts for rooms user is in")
+		return nil
+	}
+
+	t.queuePresence(output, destinations)
+	return nil
+}
+
+// queuePresence adds a presence update to the next batch for each of the
+// destinations, replacing any earlier update for the same user.
+func (t *PresenceConsumer) queuePresence(
+	presence api.OutputPresenceEvent, destinations []gomatrixserverlib.ServerName,
+) {
+	t.pendingMutex.Lock()
+	defer t.pendingMutex.Unlock()
+
+	for _, destination := range destinations {
+		if destination == t.serverName {
+			continue
+		}
+		if _, ok := t.pending[destination]; !ok {
+			t.pending[destination] = make(map[string]api.OutputPresenceEvent)
+		}
+		t.pending[destination][presence.UserID] = presence
+	}
+}
+
+// takePending returns the batched up presence updates, leaving nothing
+// pending.
+func (t *PresenceConsumer) takePending() map[gomatrixserverlib.ServerName]map[string]api.OutputPresenceEvent {
+	t.pendingMutex.Lock()
+	defer t.pendingMutex.Unlock()
+
+	pending := t.pending
+	t.pending = make(map[gomatrixserverlib.ServerName]map[string]api.OutputPresenceEvent)
+	return pending
+}
+
+// sendPending sends an m.presence EDU to each destination containing all of
+// the presence updates that have been batched up for it.
+func (t *PresenceConsumer) sendPending() {
+	now := time.Now()
+	for destination, presences := range t.takePending() {
+		content := api.FederationPresence{
+			Push: make([]api.FederationPresenceUpdate, 0, len(presences)),
+		}
+		for _, presence := range presences {
+			update := api.FederationPresenceUpdate{
+				UserID:          presence.UserID,
+				Presence:        presence.Presence,
+				StatusMsg:       presence.StatusMsg,
+				CurrentlyActive: presence.Presence == api.PresenceOnline,
+			}
+			if presence.LastActiveTS > 0 {
+				update.LastActiveAgo = now.Sub(presence.LastActiveTS.Time()).Milliseconds()
+			}
+			content.Push = append(content.Push, update)
+		}
+
+		edu := &gomatrixserverlib.EDU{
+			Type:   api.MPresence,
+			Origin: string(t.serverName),
+		}
+		var err error
+		if edu.Content, err = json.Marshal(content); err != nil {
+			log.WithError(err).Error("failed to marshal presence EDU")
+			continue
+		}
+		if err = t.queues.SendEDU(edu, t.serverName, []gomatrixserverlib.ServerName{destination}); err != nil {
+			log.WithError(err).WithField("destination", destination).Error("failed to send presence EDU")
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type presenceTestRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	roomsForUser map[string][]string
+}
+
+func (r *presenceTestRoomserverAPI) QueryRoomsForUser(
+	ctx context.Context, req *roomserverAPI.QueryRoomsForUserRequest, res *roomserverAPI.QueryRoomsForUserResponse,
+) error {
+	res.RoomIDs = r.roomsForUser[req.UserID]
+	return nil
+}
+
+type presenceTestDatabase struct {
+	storage.Database
+	hostsForRoom map[string][]gomatrixserverlib.ServerName
+}
+
+func (d *presenceTestDatabase) GetJoinedHostsForRooms(
+	ctx context.Context, roomIDs []string,
+) ([]gomatrixserverlib.ServerName, error) {
+	var hosts []gomatrixserverlib.ServerName
+	for _, roomID := range roomIDs {
+		hosts = append(hosts, d.hostsForRoom[roomID]...)
+	}
+	return hosts, nil
+}
+
+func presenceMessage(t *testing.T, userID, presence string) *sarama.ConsumerMessage {
+	value, err := json.Marshal(api.OutputPresenceEvent{UserID: userID, Presence: presence})
+	if err != nil {
+		t.Fatalf("failed to marshal presence: %s", err)
+	}
+	return &sarama.ConsumerMessage{Value: value}
+}
+
+func TestPresenceBatchedToSharedRoomServers(t *testing.T) {
+	c := &PresenceConsumer{
+		serverName: "localhost",
+		rsAPI: &presenceTestRoomserverAPI{
+			roomsForUser: map[string][]string{
+				"@alice:localhost": {"!room1:localhost", "!room2:localhost"},
+				"@bob:localhost":   {"!room2:localhost"},
+				"@carol:localhost": {"!room3:localhost"},
+			},
+		},
+		db: &presenceTestDatabase{
+			hostsForRoom: map[string][]gomatrixserverlib.ServerName{
+				"!room1:localhost": {"localhost", "a.server"},
+				"!room2:localhost": {"localhost", "b.server"},
+			},
+		},
+		pending: make(map[gomatrixserverlib.ServerName]map[string]api.OutputPresenceEvent),
+	}
+
+	messages := []*sarama.ConsumerMessage{
+		presenceMessage(t, "@alice:localhost", api.PresenceOnline),
+		presenceMessage(t, "@bob:localhost", api.PresenceOnline),
+		// a later update for the same user should replace the earlier one
+		presenceMessage(t, "@alice:localhost", api.PresenceUnavailable),
+		// carol doesn't share any rooms with remote servers
+		presenceMessage(t, "@carol:localhost", api.PresenceOnline),
+		// presence of remote users shouldn't be sent back out over federation
+		presenceMessage(t, "@dave:a.server", api.PresenceOnline),
+	}
+	for _, msg := range messages {
+		if err := c.onMessage(msg); err != nil {
+			t.Fatalf("onMessage failed: %s", err)
+		}
+	}
+
+	want := map[gomatrixserverlib.ServerName]map[string]string{
+		"a.server": {"@alice:localhost": api.PresenceUnavailable},
+		"b.server": {"@alice:localhost": api.PresenceUnavailable, "@bob:localhost": api.PresenceOnline},
+	}
+	pending := c.takePending()
+	if len(pending) != len(want) {
+		t.Fatalf("expected presence for %d destinations, got %d: %v", len(want), len(pending), pending)
+	}
+	for destination, wantUsers := range want {
+		gotUsers := pending[destination]
+		if len(gotUsers) != len(wantUsers) {
+			t.Errorf("destination %s: expected %d presence updates, got %d: %v", destination, len(wantUsers), len(gotUsers), gotUsers)
+			continue
+		}
+		for userID, wantPresence := range wantUsers {
+			if got := gotUsers[userID].Presence; got != wantPresence {
+				t.Errorf("destination %s: expected %s to be %s, got %q", destination, userID, wantPresence, got)
+			}
+		}
+	}
+
+	if pending = c.takePending(); len(pending) != 0 {
+		t.Errorf("expected nothing to be pending after taking the batch, got %v", pending)
+	}
+}
@@ -66,6 +66,8 @@ func NewInternalAPI(
 			PrivateKey: cfg.Matrix.PrivateKey,
 			ServerName: cfg.Matrix.ServerName,
 		},
+		&base.Cfg.FederationAPI, cfg.Timeouts.Send, cfg.SendBatchWindow,
+		cfg.MaxDeadLetters,
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -89,5 +91,14 @@ func NewInternalAPI(
 		logrus.WithError(err).Panic("failed to start key server consumer")
 	}
 
-	return internal.NewFederationSenderInternalAPI(federationSenderDB, cfg, rsAPI, federation, keyRing, stats, queues)
+	if cfg.Matrix.Presence.EnableOutbound {
+		presenceConsumer := consumers.NewPresenceConsumer(
+			cfg, consumer, queues, federationSenderDB, rsAPI,
+		)
+		if err := presenceConsumer.Start(); err != nil {
+			logrus.WithError(err).Panic("failed to start presence consumer")
+		}
+	}
+
+	return internal.NewFederationSenderInternalAPI(federationSenderDB, cfg, rsAPI, federation, keyRing, stats, queues, base.Caches)
 }
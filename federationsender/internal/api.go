@@ -2,6 +2,10 @@ package internal
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -9,6 +13,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/statistics"
 	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/internal/caching"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrix"
@@ -25,6 +30,7 @@ type FederationSenderInternalAPI struct {
 	keyRing    *gomatrixserverlib.KeyRing
 	queues     *queue.OutgoingQueues
 	joins      sync.Map // joins currently in progress
+	serverKeys caching.FederationServerKeysCache
 }
 
 func NewFederationSenderInternalAPI(
@@ -34,6 +40,7 @@ func NewFederationSenderInternalAPI(
 	keyRing *gomatrixserverlib.KeyRing,
 	statistics *statistics.Statistics,
 	queues *queue.OutgoingQueues,
+	serverKeys caching.FederationServerKeysCache,
 ) *FederationSenderInternalAPI {
 	return &FederationSenderInternalAPI{
 		db:         db,
@@ -43,6 +50,7 @@ func NewFederationSenderInternalAPI(
 		keyRing:    keyRing,
 		statistics: statistics,
 		queues:     queues,
+		serverKeys: serverKeys,
 	}
 }
 
@@ -109,7 +117,7 @@ func (a *FederationSenderInternalAPI) doRequest(
 func (a *FederationSenderInternalAPI) GetUserDevices(
 	ctx context.Context, s gomatrixserverlib.ServerName, userID string,
 ) (gomatrixserverlib.RespUserDevices, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.Default)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.GetUserDevices(ctx, s, userID)
@@ -123,7 +131,7 @@ func (a *FederationSenderInternalAPI) GetUserDevices(
 func (a *FederationSenderInternalAPI) ClaimKeys(
 	ctx context.Context, s gomatrixserverlib.ServerName, oneTimeKeys map[string]map[string]string,
 ) (gomatrixserverlib.RespClaimKeys, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.Default)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.ClaimKeys(ctx, s, oneTimeKeys)
@@ -137,6 +145,8 @@ func (a *FederationSenderInternalAPI) ClaimKeys(
 func (a *FederationSenderInternalAPI) QueryKeys(
 	ctx context.Context, s gomatrixserverlib.ServerName, keys map[string][]string,
 ) (gomatrixserverlib.RespQueryKeys, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.Default)
+	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.QueryKeys(ctx, s, keys)
 	})
@@ -149,7 +159,7 @@ func (a *FederationSenderInternalAPI) QueryKeys(
 func (a *FederationSenderInternalAPI) Backfill(
 	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, limit int, eventIDs []string,
 ) (res gomatrixserverlib.Transaction, err error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.Backfill)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.Backfill(ctx, s, roomID, limit, eventIDs)
@@ -163,7 +173,7 @@ func (a *FederationSenderInternalAPI) Backfill(
 func (a *FederationSenderInternalAPI) LookupState(
 	ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
 ) (res gomatrixserverlib.RespState, err error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.State)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.LookupState(ctx, s, roomID, eventID, roomVersion)
@@ -177,7 +187,7 @@ func (a *FederationSenderInternalAPI) LookupState(
 func (a *FederationSenderInternalAPI) LookupStateIDs(
 	ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string,
 ) (res gomatrixserverlib.RespStateIDs, err error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.State)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.LookupStateIDs(ctx, s, roomID, eventID)
@@ -191,7 +201,7 @@ func (a *FederationSenderInternalAPI) LookupStateIDs(
 func (a *FederationSenderInternalAPI) GetEvent(
 	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
 ) (res gomatrixserverlib.Transaction, err error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.Default)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.GetEvent(ctx, s, eventID)
@@ -205,7 +215,13 @@ func (a *FederationSenderInternalAPI) GetEvent(
 func (a *FederationSenderInternalAPI) GetServerKeys(
 	ctx context.Context, s gomatrixserverlib.ServerName,
 ) (gomatrixserverlib.ServerKeys, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	// If we've already got a copy of the server keys that is still within
+	// its validity period then there's no need to go to the remote server
+	// again. This is mostly to stop notary requests from hammering them.
+	if keys, ok := a.serverKeys.GetFederationServerKeys(s); ok {
+		return keys, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.ServerKeys)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.GetServerKeys(ctx, s)
@@ -213,13 +229,15 @@ func (a *FederationSenderInternalAPI) GetServerKeys(
 	if err != nil {
 		return gomatrixserverlib.ServerKeys{}, err
 	}
-	return ires.(gomatrixserverlib.ServerKeys), nil
+	keys := ires.(gomatrixserverlib.ServerKeys)
+	a.serverKeys.StoreFederationServerKeys(s, keys)
+	return keys, nil
 }
 
 func (a *FederationSenderInternalAPI) LookupServerKeys(
 	ctx context.Context, s gomatrixserverlib.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
 ) ([]gomatrixserverlib.ServerKeys, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.ServerKeys)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.LookupServerKeys(ctx, s, keyRequests)
@@ -234,7 +252,7 @@ func (a *FederationSenderInternalAPI) MSC2836EventRelationships(
 	ctx context.Context, s gomatrixserverlib.ServerName, r gomatrixserverlib.MSC2836EventRelationshipsRequest,
 	roomVersion gomatrixserverlib.RoomVersion,
 ) (res gomatrixserverlib.MSC2836EventRelationshipsResponse, err error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.Default)
 	defer cancel()
 	ires, err := a.doRequest(s, func() (interface{}, error) {
 		return a.federation.MSC2836EventRelationships(ctx, s, r, roomVersion)
@@ -244,3 +262,47 @@ func (a *FederationSenderInternalAPI) MSC2836EventRelationships(
 	}
 	return ires.(gomatrixserverlib.MSC2836EventRelationshipsResponse), nil
 }
+
+func (a *FederationSenderInternalAPI) MSC3030TimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, backwards bool,
+) (res api.MSC3030TimestampToEventResponse, err error) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeouts.Default)
+	defer cancel()
+	ires, err := a.doRequest(s, func() (interface{}, error) {
+		return a.msc3030TimestampToEvent(ctx, s, roomID, ts, backwards)
+	})
+	if err != nil {
+		return res, err
+	}
+	return ires.(api.MSC3030TimestampToEventResponse), nil
+}
+
+// msc3030TimestampToEvent asks a remote server for the event in the room
+// which is closest to the timestamp. gomatrixserverlib doesn't know about
+// this endpoint yet, so we make the request ourselves.
+func (a *FederationSenderInternalAPI) msc3030TimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, backwards bool,
+) (res api.MSC3030TimestampToEventResponse, err error) {
+	query := url.Values{}
+	query.Set("ts", strconv.FormatUint(uint64(ts), 10))
+	query.Set("dir", "f")
+	if backwards {
+		query.Set("dir", "b")
+	}
+	path := "/_matrix/federation/unstable/org.matrix.msc3030/timestamp_to_event/" + url.PathEscape(roomID) + "?" + query.Encode()
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path)
+	if err = fedReq.Sign(a.cfg.Matrix.ServerName, a.cfg.Matrix.KeyID, a.cfg.Matrix.PrivateKey); err != nil {
+		return res, fmt.Errorf("fedReq.Sign: %w", err)
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return res, fmt.Errorf("fedReq.HTTPRequest: %w", err)
+	}
+	if err = a.federation.DoRequestAndParseResponse(ctx, req, &res); err != nil {
+		return res, err
+	}
+	if res.EventID == "" {
+		return res, fmt.Errorf("server returned no event ID")
+	}
+	return res, nil
+}
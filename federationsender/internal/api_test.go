@@ -0,0 +1,179 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/statistics"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// deadlineTransport records how long each request had left before its
+// deadline, by destination, and responds with an empty JSON object.
+type deadlineTransport struct {
+	sync.Mutex
+	remaining map[string]time.Duration
+}
+
+func (d *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d.Lock()
+	defer d.Unlock()
+	if deadline, ok := req.Context().Deadline(); ok {
+		d.remaining[req.URL.Host] = time.Until(deadline)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func mustCreateCache(t *testing.T) *caching.Caches {
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	return cache
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+	cfg.FederationSender.Timeouts = config.FederationTimeouts{
+		Default:    time.Second * 11,
+		Send:       time.Second * 22,
+		State:      time.Second * 33,
+		Backfill:   time.Second * 44,
+		ServerKeys: time.Second * 55,
+	}
+	transport := &deadlineTransport{remaining: map[string]time.Duration{}}
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, transport)
+	fsAPI := NewFederationSenderInternalAPI(
+		nil, &cfg.FederationSender, nil, federation, nil,
+		&statistics.Statistics{DB: &leaveTestDatabase{}, FailuresUntilBlacklist: 16}, nil, mustCreateCache(t),
+	)
+
+	// Each request goes to a different server, so that we can tell them apart.
+	ctx := context.Background()
+	for _, tc := range []struct {
+		server  gomatrixserverlib.ServerName
+		request func(s gomatrixserverlib.ServerName)
+		want    time.Duration
+	}{
+		{"devices", func(s gomatrixserverlib.ServerName) { _, _ = fsAPI.GetUserDevices(ctx, s, "@bob:devices") }, time.Second * 11},
+		{"claim", func(s gomatrixserverlib.ServerName) { _, _ = fsAPI.ClaimKeys(ctx, s, nil) }, time.Second * 11},
+		{"query", func(s gomatrixserverlib.ServerName) { _, _ = fsAPI.QueryKeys(ctx, s, nil) }, time.Second * 11},
+		{"event", func(s gomatrixserverlib.ServerName) { _, _ = fsAPI.GetEvent(ctx, s, "$event:event") }, time.Second * 11},
+		{"state", func(s gomatrixserverlib.ServerName) {
+			_, _ = fsAPI.LookupState(ctx, s, "!room:state", "$event:state", gomatrixserverlib.RoomVersionV6)
+		}, time.Second * 33},
+		{"stateids", func(s gomatrixserverlib.ServerName) {
+			_, _ = fsAPI.LookupStateIDs(ctx, s, "!room:stateids", "$event:stateids")
+		}, time.Second * 33},
+		{"backfill", func(s gomatrixserverlib.ServerName) {
+			_, _ = fsAPI.Backfill(ctx, s, "!room:backfill", 10, []string{"$event:backfill"})
+		}, time.Second * 44},
+		{"serverkeys", func(s gomatrixserverlib.ServerName) { _, _ = fsAPI.GetServerKeys(ctx, s) }, time.Second * 55},
+		{"notary", func(s gomatrixserverlib.ServerName) { _, _ = fsAPI.LookupServerKeys(ctx, s, nil) }, time.Second * 55},
+	} {
+		tc.request(tc.server)
+		transport.Lock()
+		remaining, ok := transport.remaining[string(tc.server)]
+		transport.Unlock()
+		if !ok {
+			t.Errorf("request to %q had no deadline", tc.server)
+			continue
+		}
+		if remaining > tc.want || remaining < tc.want-time.Second*5 {
+			t.Errorf("request to %q had %s before its deadline, want %s", tc.server, remaining, tc.want)
+		}
+	}
+}
+
+// serverKeysTransport responds to /key/v2/server requests with keys that are
+// valid until the given time, counting the requests.
+type serverKeysTransport struct {
+	sync.Mutex
+	requests   int
+	validUntil time.Time
+}
+
+func (s *serverKeysTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	body := fmt.Sprintf(
+		`{"server_name":%q,"valid_until_ts":%d,"verify_keys":{},"old_verify_keys":{}}`,
+		req.URL.Host, gomatrixserverlib.AsTimestamp(s.validUntil),
+	)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestGetServerKeysUsesCache(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+	transport := &serverKeysTransport{validUntil: time.Now().Add(time.Hour)}
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, transport)
+	fsAPI := NewFederationSenderInternalAPI(
+		nil, &cfg.FederationSender, nil, federation, nil,
+		&statistics.Statistics{DB: &leaveTestDatabase{}, FailuresUntilBlacklist: 16}, nil, mustCreateCache(t),
+	)
+	ctx := context.Background()
+
+	// Keys that are still valid are only fetched once.
+	for i := 0; i < 3; i++ {
+		if _, err := fsAPI.GetServerKeys(ctx, "valid"); err != nil {
+			t.Fatalf("GetServerKeys failed: %s", err)
+		}
+	}
+	if transport.requests != 1 {
+		t.Errorf("got %d requests for valid keys, want 1", transport.requests)
+	}
+
+	// Keys that have expired are fetched again every time.
+	transport.requests = 0
+	transport.validUntil = time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, err := fsAPI.GetServerKeys(ctx, "expired"); err != nil {
+			t.Fatalf("GetServerKeys failed: %s", err)
+		}
+	}
+	if transport.requests != 3 {
+		t.Errorf("got %d requests for expired keys, want 3", transport.requests)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/federationapi"
+	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/statistics"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/test"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testRoomID     = "!room:remote"
+	testRemoteUser = "@bob:remote"
+	testLocalUser  = "@alice:localhost"
+)
+
+// leaveTestRoomserver is the roomserver of the remote server which hosts the
+// room, holding just enough of the room for it to handle make_leave and
+// send_leave.
+type leaveTestRoomserver struct {
+	roomserverAPI.RoomserverInternalAPI
+	sync.Mutex
+	state  map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent
+	latest *gomatrixserverlib.HeaderedEvent
+	input  []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *leaveTestRoomserver) QueryServerBannedFromRoom(
+	ctx context.Context, req *roomserverAPI.QueryServerBannedFromRoomRequest, res *roomserverAPI.QueryServerBannedFromRoomResponse,
+) error {
+	return nil
+}
+
+func (r *leaveTestRoomserver) QueryRoomVersionForRoom(
+	ctx context.Context, req *roomserverAPI.QueryRoomVersionForRoomRequest, res *roomserverAPI.QueryRoomVersionForRoomResponse,
+) error {
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	return nil
+}
+
+func (r *leaveTestRoomserver) QueryLatestEventsAndState(
+	ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	r.Lock()
+	defer r.Unlock()
+	if req.RoomID != testRoomID {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	res.Depth = r.latest.Depth() + 1
+	res.LatestEvents = []gomatrixserverlib.EventReference{r.latest.EventReference()}
+	for _, tuple := range req.StateToFetch {
+		if ev, ok := r.state[tuple]; ok {
+			res.StateEvents = append(res.StateEvents, ev)
+		}
+	}
+	return nil
+}
+
+func (r *leaveTestRoomserver) InputRoomEvents(
+	ctx context.Context, req *roomserverAPI.InputRoomEventsRequest, res *roomserverAPI.InputRoomEventsResponse,
+) {
+	r.Lock()
+	defer r.Unlock()
+	for _, ire := range req.InputRoomEvents {
+		r.input = append(r.input, ire.Event)
+	}
+}
+
+func (r *leaveTestRoomserver) addEvent(t *testing.T, key ed25519.PrivateKey, origin gomatrixserverlib.ServerName, eventType, sender string, stateKey *string, content interface{}) {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   testRoomID,
+		Type:     eventType,
+		StateKey: stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		t.Fatalf("builder.SetContent failed: %s", err)
+	}
+	if r.latest != nil {
+		builder.Depth = r.latest.Depth() + 1
+		builder.PrevEvents = []gomatrixserverlib.EventReference{r.latest.EventReference()}
+	}
+	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+	if err != nil {
+		t.Fatalf("gomatrixserverlib.StateNeededForEventBuilder failed: %s", err)
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for _, ev := range r.state {
+		_ = authEvents.AddEvent(ev.Event)
+	}
+	if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(&authEvents); err != nil {
+		t.Fatalf("eventsNeeded.AuthEventReferences failed: %s", err)
+	}
+	ev, err := builder.Build(time.Now(), origin, "ed25519:auto", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("builder.Build failed: %s", err)
+	}
+	r.latest = ev.Headered(gomatrixserverlib.RoomVersionV6)
+	r.state[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: *stateKey}] = r.latest
+}
+
+type leaveTestFederationSender struct {
+	api.FederationSenderInternalAPI
+}
+
+func (f *leaveTestFederationSender) PerformServersAlive(
+	ctx context.Context, req *api.PerformServersAliveRequest, res *api.PerformServersAliveResponse,
+) error {
+	return nil
+}
+
+type leaveTestDatabase struct {
+	storage.Database
+}
+
+func (d *leaveTestDatabase) IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error) {
+	return false, nil
+}
+
+func (d *leaveTestDatabase) AddServerToBlacklist(serverName gomatrixserverlib.ServerName) error {
+	return nil
+}
+
+func (d *leaveTestDatabase) RemoveServerFromBlacklist(serverName gomatrixserverlib.ServerName) error {
+	return nil
+}
+
+func TestPerformLeave(t *testing.T) {
+	_, remoteKey, _ := ed25519.GenerateKey(nil)
+	_, localKey, _ := ed25519.GenerateKey(nil)
+
+	// Set up the remote server which hosts a room that our user is joined to.
+	rsAPI := &leaveTestRoomserver{
+		state: map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{},
+	}
+	remoteUser, localUser := testRemoteUser, testLocalUser
+	empty := ""
+	rsAPI.addEvent(t, remoteKey, "remote", gomatrixserverlib.MRoomCreate, remoteUser, &empty, map[string]interface{}{
+		"creator": remoteUser,
+	})
+	rsAPI.addEvent(t, remoteKey, "remote", gomatrixserverlib.MRoomMember, remoteUser, &remoteUser, map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	})
+	rsAPI.addEvent(t, remoteKey, "remote", gomatrixserverlib.MRoomJoinRules, remoteUser, &empty, map[string]interface{}{
+		"join_rule": gomatrixserverlib.Public,
+	})
+	rsAPI.addEvent(t, localKey, "localhost", gomatrixserverlib.MRoomMember, localUser, &localUser, map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	})
+
+	remoteCfg := &config.Dendrite{}
+	remoteCfg.Defaults()
+	remoteCfg.Global.ServerName = "remote"
+	remoteCfg.Global.KeyID = "ed25519:auto"
+	remoteCfg.Global.PrivateKey = remoteKey
+	fedMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath()
+	keyMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicKeyPathPrefix).Subrouter().UseEncodedPath()
+	federationapi.AddPublicRoutes(
+		fedMux, keyMux, &remoteCfg.FederationAPI, nil, nil, &test.NopJSONVerifier{},
+		rsAPI, &leaveTestFederationSender{}, nil, nil,
+	)
+	baseURL, cancel := test.ListenAndServe(t, fedMux, true)
+	defer cancel()
+	remoteAddr := gomatrixserverlib.ServerName(strings.TrimPrefix(baseURL, "https://"))
+
+	// Leave the room from our server, which should make_leave and then
+	// send_leave to the remote server.
+	localCfg := &config.Dendrite{}
+	localCfg.Defaults()
+	localCfg.Global.ServerName = "localhost"
+	localCfg.Global.KeyID = "ed25519:auto"
+	localCfg.Global.PrivateKey = localKey
+	fsAPI := NewFederationSenderInternalAPI(
+		nil, &localCfg.FederationSender, nil,
+		gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", localKey, true),
+		nil, &statistics.Statistics{DB: &leaveTestDatabase{}, FailuresUntilBlacklist: 16}, nil, mustCreateCache(t),
+	)
+	if err := fsAPI.PerformLeave(context.Background(), &api.PerformLeaveRequest{
+		RoomID:      testRoomID,
+		UserID:      testLocalUser,
+		ServerNames: []gomatrixserverlib.ServerName{remoteAddr},
+	}, &api.PerformLeaveResponse{}); err != nil {
+		t.Fatalf("PerformLeave failed: %s", err)
+	}
+
+	// The remote server should have been sent a leave event for our user,
+	// signed by our server and pointing at the latest event in the room.
+	rsAPI.Lock()
+	defer rsAPI.Unlock()
+	if len(rsAPI.input) != 1 {
+		t.Fatalf("remote roomserver got %d events, want 1", len(rsAPI.input))
+	}
+	leave := rsAPI.input[0]
+	if leave.Type() != gomatrixserverlib.MRoomMember || leave.Sender() != testLocalUser || !leave.StateKeyEquals(testLocalUser) {
+		t.Errorf("got event of type %q from %q, want a membership event for %q", leave.Type(), leave.Sender(), testLocalUser)
+	}
+	if mem, err := leave.Membership(); err != nil || mem != gomatrixserverlib.Leave {
+		t.Errorf("got membership %q, want %q", mem, gomatrixserverlib.Leave)
+	}
+	if leave.Origin() != "localhost" {
+		t.Errorf("got origin %q, want localhost", leave.Origin())
+	}
+	if err := gomatrixserverlib.VerifyJSON("localhost", "ed25519:auto", localKey.Public().(ed25519.PublicKey), leave.Redact().JSON()); err != nil {
+		t.Errorf("leave event is not signed by our server: %s", err)
+	}
+	prevEvents := leave.PrevEventIDs()
+	if len(prevEvents) != 1 || prevEvents[0] != rsAPI.state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: testLocalUser}].EventID() {
+		t.Errorf("got prev events %v, want our join event", prevEvents)
+	}
+
+	// The remote server shouldn't accept a leave that we send on behalf of
+	// a user on someone else's server.
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     testRemoteUser,
+		RoomID:     testRoomID,
+		Type:       gomatrixserverlib.MRoomMember,
+		StateKey:   &remoteUser,
+		Depth:      rsAPI.latest.Depth() + 1,
+		PrevEvents: []gomatrixserverlib.EventReference{rsAPI.latest.EventReference()},
+	}
+	_ = builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Leave})
+	forged, err := builder.Build(time.Now(), "localhost", "ed25519:auto", localKey, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("builder.Build failed: %s", err)
+	}
+	rsAPI.input = nil
+	rsAPI.Unlock()
+	err = fsAPI.federation.SendLeave(context.Background(), remoteAddr, forged)
+	rsAPI.Lock()
+	if gerr, ok := err.(gomatrix.HTTPError); !ok || gerr.Code != http.StatusForbidden {
+		t.Errorf("got error %v sending a leave for another server's user, want HTTP 403", err)
+	}
+	if len(rsAPI.input) != 0 {
+		t.Errorf("remote roomserver got %d events, want none", len(rsAPI.input))
+	}
+}
@@ -20,3 +20,13 @@ func (f *FederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 
 	return
 }
+
+// QueryDeadLetters implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryDeadLetters(
+	ctx context.Context,
+	request *api.QueryDeadLettersRequest,
+	response *api.QueryDeadLettersResponse,
+) (err error) {
+	response.DeadLetters, err = f.db.GetDeadLetters(ctx, request.Limit)
+	return
+}
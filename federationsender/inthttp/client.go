@@ -15,6 +15,7 @@ import (
 // HTTP paths for the internal HTTP API
 const (
 	FederationSenderQueryJoinedHostServerNamesInRoomPath = "/federationsender/queryJoinedHostServerNamesInRoom"
+	FederationSenderQueryDeadLettersPath                 = "/federationsender/queryDeadLetters"
 
 	FederationSenderPerformDirectoryLookupRequestPath = "/federationsender/performDirectoryLookup"
 	FederationSenderPerformJoinRequestPath            = "/federationsender/performJoinRequest"
@@ -33,6 +34,7 @@ const (
 	FederationSenderGetServerKeysPath      = "/federationsender/client/getServerKeys"
 	FederationSenderLookupServerKeysPath   = "/federationsender/client/lookupServerKeys"
 	FederationSenderEventRelationshipsPath = "/federationsender/client/msc2836eventRelationships"
+	FederationSenderTimestampToEventPath   = "/federationsender/client/msc3030timestampToEvent"
 )
 
 // NewFederationSenderClient creates a FederationSenderInternalAPI implemented by talking to a HTTP POST API.
@@ -100,6 +102,19 @@ func (h *httpFederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryDeadLetters implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryDeadLetters(
+	ctx context.Context,
+	request *api.QueryDeadLettersRequest,
+	response *api.QueryDeadLettersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDeadLetters")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryDeadLettersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // Handle an instruction to make_join & send_join with a remote server.
 func (h *httpFederationSenderInternalAPI) PerformJoin(
 	ctx context.Context,
@@ -449,3 +464,36 @@ func (h *httpFederationSenderInternalAPI) MSC2836EventRelationships(
 	}
 	return response.Res, nil
 }
+
+type timestampToEvent struct {
+	S         gomatrixserverlib.ServerName
+	RoomID    string
+	Timestamp gomatrixserverlib.Timestamp
+	Backwards bool
+	Res       api.MSC3030TimestampToEventResponse
+	Err       *api.FederationClientError
+}
+
+func (h *httpFederationSenderInternalAPI) MSC3030TimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, backwards bool,
+) (res api.MSC3030TimestampToEventResponse, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MSC3030TimestampToEvent")
+	defer span.Finish()
+
+	request := timestampToEvent{
+		S:         s,
+		RoomID:    roomID,
+		Timestamp: ts,
+		Backwards: backwards,
+	}
+	var response timestampToEvent
+	apiURL := h.federationSenderURL + FederationSenderTimestampToEventPath
+	err = httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+	if err != nil {
+		return res, err
+	}
+	if response.Err != nil {
+		return res, response.Err
+	}
+	return response.Res, nil
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -62,6 +63,9 @@ type destinationQueue struct {
 	pendingEDUs        []*queuedEDU                        // EDUs waiting to be sent
 	pendingMutex       sync.RWMutex                        // protects pendingPDUs and pendingEDUs
 	interruptBackoff   chan bool                           // interrupts backoff
+	sendTimeout        time.Duration                       // how long to wait for a transaction to be sent
+	batchWindow        time.Duration                       // how long to wait for more events before sending a transaction
+	maxDeadLetters     int                                 // how many dead letters to keep, or 0 for all of them
 }
 
 // Send event adds the event to the pending queue for the destination.
@@ -220,6 +224,17 @@ func (oq *destinationQueue) getPendingFromDatabase() {
 			logrus.WithError(err).Errorf("Failed to get pending EDUs for %q", oq.destination)
 		}
 	}
+	// The database doesn't return the events in any particular order, and
+	// there may be newer events in memory already, so put them back into the
+	// order that they were queued in before sending them.
+	if retrieved {
+		sort.SliceStable(oq.pendingPDUs, func(i, j int) bool {
+			return oq.pendingPDUs[i].receipt.Before(oq.pendingPDUs[j].receipt)
+		})
+		sort.SliceStable(oq.pendingEDUs, func(i, j int) bool {
+			return oq.pendingEDUs[i].receipt.Before(oq.pendingEDUs[j].receipt)
+		})
+	}
 	// If we've retrieved all of the events from the database with room to spare
 	// in memory then we'll no longer consider this queue to be overflowed.
 	if len(oq.pendingPDUs) < maxPDUsInMemory && len(oq.pendingEDUs) < maxEDUsInMemory {
@@ -234,6 +249,23 @@ func (oq *destinationQueue) getPendingFromDatabase() {
 	}
 }
 
+// deadLetterQueuedPDUs records the PDUs queued for this destination as dead
+// letters, so that server admins can find out which events we gave up trying
+// to send. This includes the PDUs which overflowed to the database and were
+// never loaded into memory.
+func (oq *destinationQueue) deadLetterQueuedPDUs() {
+	count, err := oq.db.DeadLetterQueuedPDUs(context.Background(), oq.destination, oq.maxDeadLetters)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to record dead-lettered events for %q", oq.destination)
+		return
+	}
+	if count == 0 {
+		return
+	}
+	deadLetteredPDUs.Add(float64(count))
+	log.Warnf("Gave up sending %d events to %q", count, oq.destination)
+}
+
 // backgroundSend is the worker goroutine for sending events.
 // nolint:gocyclo
 func (oq *destinationQueue) backgroundSend() {
@@ -250,6 +282,11 @@ func (oq *destinationQueue) backgroundSend() {
 	// to see if there's anything new to send.
 	oq.overflowed.Store(true)
 
+	// The queue is idle when everything was sent by the last transaction, so
+	// that the next event to arrive is the first of a new batch. Otherwise
+	// we're retrying or working through a backlog, so we carry on straight
+	// away.
+	idle := true
 	for {
 		// If we are overflowing memory and have sent things out to the
 		// database then we can look up what those things are.
@@ -257,18 +294,27 @@ func (oq *destinationQueue) backgroundSend() {
 			oq.getPendingFromDatabase()
 		}
 
-		// If we have nothing to do then wait either for incoming events, or
-		// until we hit an idle timeout.
-		select {
-		case <-oq.notify:
-			// There's work to do, either because getPendingFromDatabase
-			// told us there is, or because a new event has come in via
-			// sendEvent/sendEDU.
-		case <-time.After(queueIdleTimeout):
-			// The worker is idle so stop the goroutine. It'll get
-			// restarted automatically the next time we have an event to
-			// send.
-			return
+		if idle {
+			// If we have nothing to do then wait either for incoming events, or
+			// until we hit an idle timeout.
+			select {
+			case <-oq.notify:
+				// There's work to do, either because getPendingFromDatabase
+				// told us there is, or because a new event has come in via
+				// sendEvent/sendEDU.
+			case <-time.After(queueIdleTimeout):
+				// The worker is idle so stop the goroutine. It'll get
+				// restarted automatically the next time we have an event to
+				// send.
+				return
+			}
+
+			// Wait a moment for any more events that are on their way to
+			// this destination, so that they are sent in the same transaction
+			// rather than one transaction each.
+			if oq.batchWindow > 0 {
+				oq.waitForBatch()
+			}
 		}
 
 		// If we are backing off this server then wait for the
@@ -281,6 +327,7 @@ func (oq *destinationQueue) backgroundSend() {
 			// buffers at this point. The PDU clean-up is already on a defer.
 			log.Warnf("Blacklisting %q due to exceeding backoff threshold", oq.destination)
 			oq.pendingMutex.Lock()
+			oq.deadLetterQueuedPDUs()
 			for i := range oq.pendingPDUs {
 				oq.pendingPDUs[i] = nil
 			}
@@ -325,8 +372,16 @@ func (oq *destinationQueue) backgroundSend() {
 		// Try sending the next transaction and see what happens.
 		transaction, pc, ec, terr := oq.nextTransaction(toSendPDUs, toSendEDUs)
 		if terr != nil {
-			// We failed to send the transaction. Mark it as a failure.
-			oq.statistics.Failure()
+			// We failed to send the transaction. Mark it as a failure. If
+			// that was the last straw then wake up straight away, so that
+			// the pending events are dead-lettered rather than waiting for
+			// something else to wake the queue.
+			if _, blacklisted := oq.statistics.Failure(); blacklisted {
+				select {
+				case oq.notify <- struct{}{}:
+				default:
+				}
+			}
 
 		} else if transaction {
 			// If we successfully sent the transaction then clear out
@@ -343,6 +398,31 @@ func (oq *destinationQueue) backgroundSend() {
 			oq.pendingEDUs = oq.pendingEDUs[ec:]
 			oq.pendingMutex.Unlock()
 		}
+
+		oq.pendingMutex.RLock()
+		idle = len(oq.pendingPDUs) == 0 && len(oq.pendingEDUs) == 0 && !oq.overflowed.Load()
+		oq.pendingMutex.RUnlock()
+	}
+}
+
+// waitForBatch waits until the batch window has passed, so that events which
+// are queued for this destination in the meantime are sent in the same
+// transaction, or until there are enough events to fill a transaction.
+func (oq *destinationQueue) waitForBatch() {
+	timer := time.NewTimer(oq.batchWindow)
+	defer timer.Stop()
+	for {
+		oq.pendingMutex.RLock()
+		full := len(oq.pendingPDUs) >= maxPDUsPerTransaction || len(oq.pendingEDUs) >= maxEDUsPerTransaction
+		oq.pendingMutex.RUnlock()
+		if full {
+			return
+		}
+		select {
+		case <-timer.C:
+			return
+		case <-oq.notify:
+		}
 	}
 }
 
@@ -411,7 +491,7 @@ func (oq *destinationQueue) nextTransaction(
 	// TODO: we should check for 500-ish fails vs 400-ish here,
 	// since we shouldn't queue things indefinitely in response
 	// to a 400-ish error
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	ctx, cancel := context.WithTimeout(context.Background(), oq.sendTimeout)
 	defer cancel()
 	_, err := oq.client.SendTransaction(ctx, t)
 	switch err.(type) {
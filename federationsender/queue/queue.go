@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -35,21 +36,25 @@ import (
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
-	db          storage.Database
-	disabled    bool
-	rsAPI       api.RoomserverInternalAPI
-	origin      gomatrixserverlib.ServerName
-	client      *gomatrixserverlib.FederationClient
-	statistics  *statistics.Statistics
-	signing     *SigningInfo
-	queuesMutex sync.Mutex // protects the below
-	queues      map[gomatrixserverlib.ServerName]*destinationQueue
+	db             storage.Database
+	disabled       bool
+	rsAPI          api.RoomserverInternalAPI
+	origin         gomatrixserverlib.ServerName
+	client         *gomatrixserverlib.FederationClient
+	statistics     *statistics.Statistics
+	signing        *SigningInfo
+	fedCfg         *config.FederationAPI
+	sendTimeout    time.Duration
+	batchWindow    time.Duration
+	maxDeadLetters int
+	queuesMutex    sync.Mutex // protects the below
+	queues         map[gomatrixserverlib.ServerName]*destinationQueue
 }
 
 func init() {
 	prometheus.MustRegister(
 		destinationQueueTotal, destinationQueueRunning,
-		destinationQueueBackingOff,
+		destinationQueueBackingOff, deadLetteredPDUs,
 	)
 }
 
@@ -77,6 +82,14 @@ var destinationQueueBackingOff = prometheus.NewGauge(
 	},
 )
 
+var deadLetteredPDUs = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "dead_lettered_pdus_total",
+	},
+)
+
 // NewOutgoingQueues makes a new OutgoingQueues
 func NewOutgoingQueues(
 	db storage.Database,
@@ -86,45 +99,63 @@ func NewOutgoingQueues(
 	rsAPI api.RoomserverInternalAPI,
 	statistics *statistics.Statistics,
 	signing *SigningInfo,
+	fedCfg *config.FederationAPI,
+	sendTimeout time.Duration,
+	batchWindow time.Duration,
+	maxDeadLetters int,
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
-		disabled:   disabled,
-		db:         db,
-		rsAPI:      rsAPI,
-		origin:     origin,
-		client:     client,
-		statistics: statistics,
-		signing:    signing,
-		queues:     map[gomatrixserverlib.ServerName]*destinationQueue{},
+		disabled:       disabled,
+		db:             db,
+		rsAPI:          rsAPI,
+		origin:         origin,
+		client:         client,
+		statistics:     statistics,
+		signing:        signing,
+		fedCfg:         fedCfg,
+		sendTimeout:    sendTimeout,
+		batchWindow:    batchWindow,
+		maxDeadLetters: maxDeadLetters,
+		queues:         map[gomatrixserverlib.ServerName]*destinationQueue{},
 	}
 	// Look up which servers we have pending items for and then rehydrate those queues.
 	if !disabled {
-		time.AfterFunc(time.Second*5, func() {
-			serverNames := map[gomatrixserverlib.ServerName]struct{}{}
-			if names, err := db.GetPendingPDUServerNames(context.Background()); err == nil {
-				for _, serverName := range names {
-					serverNames[serverName] = struct{}{}
-				}
-			} else {
-				log.WithError(err).Error("Failed to get PDU server names for destination queue hydration")
-			}
-			if names, err := db.GetPendingEDUServerNames(context.Background()); err == nil {
-				for _, serverName := range names {
-					serverNames[serverName] = struct{}{}
-				}
-			} else {
-				log.WithError(err).Error("Failed to get EDU server names for destination queue hydration")
-			}
-			for serverName := range serverNames {
-				if queue := queues.getQueue(serverName); !queue.statistics.Blacklisted() {
-					queue.wakeQueueIfNeeded()
-				}
-			}
-		})
+		time.AfterFunc(time.Second*5, queues.catchUp)
 	}
 	return queues
 }
 
+// catchUp wakes up the queues for every destination that still has events
+// waiting to be sent in the database, e.g. because they were queued before
+// the server was last shut down. Each queue then resumes sending from its
+// oldest pending event.
+func (oqs *OutgoingQueues) catchUp() {
+	ctx := context.Background()
+	serverNames := map[gomatrixserverlib.ServerName]struct{}{}
+	if names, err := oqs.db.GetPendingPDUServerNames(ctx); err == nil {
+		for _, serverName := range names {
+			serverNames[serverName] = struct{}{}
+		}
+	} else {
+		log.WithError(err).Error("Failed to get PDU server names for destination queue hydration")
+	}
+	if names, err := oqs.db.GetPendingEDUServerNames(ctx); err == nil {
+		for _, serverName := range names {
+			serverNames[serverName] = struct{}{}
+		}
+	} else {
+		log.WithError(err).Error("Failed to get EDU server names for destination queue hydration")
+	}
+	for serverName := range serverNames {
+		if !oqs.fedCfg.IsServerAllowed(serverName) {
+			continue
+		}
+		if queue := oqs.getQueue(serverName); !queue.statistics.Blacklisted() {
+			queue.wakeQueueIfNeeded()
+		}
+	}
+}
+
 // TODO: Move this somewhere useful for other components as we often need to ferry these 3 variables
 // around together
 type SigningInfo struct {
@@ -159,6 +190,9 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 			notify:           make(chan struct{}, 1),
 			interruptBackoff: make(chan bool),
 			signing:          oqs.signing,
+			sendTimeout:      oqs.sendTimeout,
+			batchWindow:      oqs.batchWindow,
+			maxDeadLetters:   oqs.maxDeadLetters,
 		}
 		oqs.queues[destination] = oq
 	}
@@ -198,6 +232,7 @@ func (oqs *OutgoingQueues) SendEvent(
 		destmap[d] = struct{}{}
 	}
 	delete(destmap, oqs.origin)
+	oqs.removeDisallowedServers(destmap)
 
 	// Check if any of the destinations are prohibited by server ACLs.
 	for destination := range destmap {
@@ -262,6 +297,7 @@ func (oqs *OutgoingQueues) SendEDU(
 		destmap[d] = struct{}{}
 	}
 	delete(destmap, oqs.origin)
+	oqs.removeDisallowedServers(destmap)
 
 	// There is absolutely no guarantee that the EDU will have a room_id
 	// field, as it is not required by the spec. However, if it *does*
@@ -307,6 +343,16 @@ func (oqs *OutgoingQueues) SendEDU(
 	return nil
 }
 
+// removeDisallowedServers removes the servers that we are not allowed to
+// federate with from the set of destinations.
+func (oqs *OutgoingQueues) removeDisallowedServers(destmap map[gomatrixserverlib.ServerName]struct{}) {
+	for destination := range destmap {
+		if !oqs.fedCfg.IsServerAllowed(destination) {
+			delete(destmap, destination)
+		}
+	}
+}
+
 // RetryServer attempts to resend events to the given server if we had given up.
 func (oqs *OutgoingQueues) RetryServer(srv gomatrixserverlib.ServerName) {
 	if oqs.disabled {
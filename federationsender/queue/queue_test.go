@@ -0,0 +1,666 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/federationapi"
+	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/statistics"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+func TestSendSuppressedForDisallowedServers(t *testing.T) {
+	fedCfg := &config.FederationAPI{
+		AllowedServers: []gomatrixserverlib.ServerName{"allowed", "blocked"},
+		BlockedServers: []gomatrixserverlib.ServerName{"blocked"},
+	}
+	// Nothing should reach the database or the roomserver, so they are nil.
+	oqs := NewOutgoingQueues(nil, true, "localhost", nil, nil, nil, nil, fedCfg, time.Minute, 0, 0)
+	oqs.disabled = false
+
+	destinations := []gomatrixserverlib.ServerName{"blocked", "other"}
+	if err := oqs.SendEDU(&gomatrixserverlib.EDU{Type: "m.typing"}, "localhost", destinations); err != nil {
+		t.Fatalf("SendEDU failed: %s", err)
+	}
+	if err := oqs.SendEvent(&gomatrixserverlib.HeaderedEvent{}, "localhost", destinations); err != nil {
+		t.Fatalf("SendEvent failed: %s", err)
+	}
+	if len(oqs.queues) != 0 {
+		t.Errorf("got %d destination queues, want none", len(oqs.queues))
+	}
+}
+
+// callTestRoomserver is used by both servers in TestCallEventsReachRemoteServer.
+// It knows about the room and remembers the events that are sent to it.
+type callTestRoomserver struct {
+	api.RoomserverInternalAPI
+	sync.Mutex
+	input []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *callTestRoomserver) QueryServerBannedFromRoom(
+	ctx context.Context, req *api.QueryServerBannedFromRoomRequest, res *api.QueryServerBannedFromRoomResponse,
+) error {
+	return nil
+}
+
+func (r *callTestRoomserver) QueryRoomVersionForRoom(
+	ctx context.Context, req *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse,
+) error {
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	return nil
+}
+
+func (r *callTestRoomserver) QueryMissingAuthPrevEvents(
+	ctx context.Context, req *api.QueryMissingAuthPrevEventsRequest, res *api.QueryMissingAuthPrevEventsResponse,
+) error {
+	res.RoomExists = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	return nil
+}
+
+func (r *callTestRoomserver) InputRoomEvents(
+	ctx context.Context, req *api.InputRoomEventsRequest, res *api.InputRoomEventsResponse,
+) {
+	r.Lock()
+	defer r.Unlock()
+	for _, ire := range req.InputRoomEvents {
+		r.input = append(r.input, ire.Event)
+	}
+}
+
+func (r *callTestRoomserver) received() []*gomatrixserverlib.HeaderedEvent {
+	r.Lock()
+	defer r.Unlock()
+	return append([]*gomatrixserverlib.HeaderedEvent{}, r.input...)
+}
+
+type callTestFederationSender struct {
+	fsAPI.FederationSenderInternalAPI
+}
+
+func (f *callTestFederationSender) PerformServersAlive(
+	ctx context.Context, req *fsAPI.PerformServersAliveRequest, res *fsAPI.PerformServersAliveResponse,
+) error {
+	return nil
+}
+
+// Call events are normal room events, so they should be sent to the other
+// servers in the room without being filtered out, in the order that they
+// were sent.
+func TestCallEventsReachRemoteServer(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	rsAPI := &callTestRoomserver{}
+
+	// Set up the remote server with a participant in the call.
+	remoteCfg := &config.Dendrite{}
+	remoteCfg.Defaults()
+	remoteCfg.Global.ServerName = "remote"
+	remoteCfg.Global.KeyID = "ed25519:auto"
+	remoteCfg.Global.PrivateKey = key
+	fedMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath()
+	keyMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicKeyPathPrefix).Subrouter().UseEncodedPath()
+	federationapi.AddPublicRoutes(
+		fedMux, keyMux, &remoteCfg.FederationAPI, nil, nil, &test.NopJSONVerifier{},
+		rsAPI, &callTestFederationSender{}, nil, nil,
+	)
+	baseURL, cancel := test.ListenAndServe(t, fedMux, true)
+	defer cancel()
+	remoteAddr := gomatrixserverlib.ServerName(strings.TrimPrefix(baseURL, "https://"))
+
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	oqs := NewOutgoingQueues(
+		db, false, "localhost",
+		gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true),
+		rsAPI, &statistics.Statistics{DB: db, FailuresUntilBlacklist: 16},
+		&SigningInfo{ServerName: "localhost", KeyID: "ed25519:auto", PrivateKey: key},
+		&config.FederationAPI{}, time.Minute, 0, 0,
+	)
+
+	// Alice calls and then sends her ICE candidates.
+	var prev *gomatrixserverlib.HeaderedEvent
+	var sent []*gomatrixserverlib.HeaderedEvent
+	for _, call := range []struct {
+		eventType string
+		content   map[string]interface{}
+	}{
+		{"m.call.invite", map[string]interface{}{
+			"call_id": "c1", "version": 0, "lifetime": 60000,
+			"offer": map[string]interface{}{"type": "offer", "sdp": "v=0"},
+		}},
+		{"m.call.candidates", map[string]interface{}{
+			"call_id": "c1", "version": 0,
+			"candidates": []map[string]interface{}{{"candidate": "candidate:1", "sdpMid": "0", "sdpMLineIndex": 0}},
+		}},
+		{"m.call.hangup", map[string]interface{}{
+			"call_id": "c1", "version": 0,
+		}},
+	} {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender: "@alice:localhost",
+			RoomID: "!call:localhost",
+			Type:   call.eventType,
+			Depth:  int64(len(sent) + 1),
+		}
+		if prev != nil {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{prev.EventReference()}
+		}
+		_ = builder.SetContent(call.content)
+		ev, err := builder.Build(time.Now(), "localhost", "ed25519:auto", key, gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("builder.Build failed: %s", err)
+		}
+		prev = ev.Headered(gomatrixserverlib.RoomVersionV6)
+		sent = append(sent, prev)
+		if err = oqs.SendEvent(prev, "localhost", []gomatrixserverlib.ServerName{remoteAddr}); err != nil {
+			t.Fatalf("SendEvent failed: %s", err)
+		}
+	}
+
+	// The remote server should get all of the call events, in order.
+	deadline := time.Now().Add(10 * time.Second)
+	for len(rsAPI.received()) < len(sent) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	received := rsAPI.received()
+	if len(received) != len(sent) {
+		t.Fatalf("remote server got %d events, want %d", len(received), len(sent))
+	}
+	for i := range sent {
+		if received[i].EventID() != sent[i].EventID() {
+			t.Errorf("remote server got event %d of type %q, want %q", i, received[i].Type(), sent[i].Type())
+		}
+	}
+	if lifetime := gjson.GetBytes(received[0].Content(), "lifetime").Int(); lifetime != 60000 {
+		t.Errorf("got m.call.invite lifetime %d, want 60000", lifetime)
+	}
+}
+
+// sendDeadlineTransport records how long each /send request had left before
+// its deadline.
+type sendDeadlineTransport struct {
+	remaining chan time.Duration
+}
+
+func (d *sendDeadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if deadline, ok := req.Context().Deadline(); ok && strings.Contains(req.URL.Path, "/send/") {
+		select {
+		case d.remaining <- time.Until(deadline):
+		default:
+		}
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func TestSendTransactionTimeout(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	transport := &sendDeadlineTransport{remaining: make(chan time.Duration, 1)}
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, transport)
+	oqs := NewOutgoingQueues(
+		db, false, "localhost", federation, nil,
+		&statistics.Statistics{DB: db, FailuresUntilBlacklist: 16},
+		&SigningInfo{ServerName: "localhost", KeyID: "ed25519:auto", PrivateKey: key},
+		&config.FederationAPI{}, time.Second*42, 0, 0,
+	)
+	if err = oqs.SendEDU(&gomatrixserverlib.EDU{Type: "m.typing"}, "localhost", []gomatrixserverlib.ServerName{"remote"}); err != nil {
+		t.Fatalf("SendEDU failed: %s", err)
+	}
+	select {
+	case remaining := <-transport.remaining:
+		if remaining > time.Second*42 || remaining < time.Second*37 {
+			t.Errorf("transaction had %s before its deadline, want 42s", remaining)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("transaction wasn't sent")
+	}
+}
+
+// failingTransport fails every transaction with a server error.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"errcode":"M_UNKNOWN"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestExhaustedEventsAreDeadLettered(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, failingTransport{})
+	// The server is blacklisted after the first failure, so there are no
+	// retries to wait for.
+	oqs := NewOutgoingQueues(
+		db, false, "localhost", federation, &callTestRoomserver{},
+		&statistics.Statistics{DB: db, FailuresUntilBlacklist: 1},
+		&SigningInfo{ServerName: "localhost", KeyID: "ed25519:auto", PrivateKey: key},
+		&config.FederationAPI{}, time.Minute, 0, 0,
+	)
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: "@alice:localhost",
+		RoomID: "!room:localhost",
+		Type:   "m.room.message",
+		Depth:  1,
+	}
+	_ = builder.SetContent(map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:auto", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("builder.Build failed: %s", err)
+	}
+	if err = oqs.SendEvent(ev.Headered(gomatrixserverlib.RoomVersionV6), "localhost", []gomatrixserverlib.ServerName{"remote"}); err != nil {
+		t.Fatalf("SendEvent failed: %s", err)
+	}
+
+	var deadLetters []types.DeadLetter
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deadLetters) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if deadLetters, err = db.GetDeadLetters(context.Background(), 10); err != nil {
+			t.Fatalf("GetDeadLetters failed: %s", err)
+		}
+	}
+	if len(deadLetters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(deadLetters))
+	}
+	got := deadLetters[0]
+	if got.ServerName != "remote" || got.EventID != ev.EventID() || got.RoomID != "!room:localhost" {
+		t.Errorf("got dead letter %+v, want event %q to %q", got, ev.EventID(), "remote")
+	}
+	if got.FailedTS == 0 {
+		t.Errorf("dead letter has no failure time")
+	}
+}
+
+// catchUpTransport records the PDU bodies and EDU types of each transaction
+// sent to it, in the order that they were sent.
+type catchUpTransport struct {
+	sync.Mutex
+	pdus         []string
+	edus         []string
+	transactions int
+}
+
+func (c *catchUpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.Path, "/send/") {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.Lock()
+		c.transactions++
+		for _, pdu := range gjson.GetBytes(body, "pdus.#.content.body").Array() {
+			c.pdus = append(c.pdus, pdu.Str)
+		}
+		for _, edu := range gjson.GetBytes(body, "edus.#.edu_type").Array() {
+			c.edus = append(c.edus, edu.Str)
+		}
+		c.Unlock()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func (c *catchUpTransport) sent() (pdus, edus []string) {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string{}, c.pdus...), append([]string{}, c.edus...)
+}
+
+func TestOverflowedEventsAreDeadLetteredUpToLimit(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	// We look at the dead letters while the queue is writing them, which
+	// can need a second connection, so the database can't be in memory.
+	tmpfile, err := ioutil.TempFile("", "federationsender")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(tmpfile.Name()) // nolint:errcheck
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+
+	// Queue up more events than fit in memory, so that some of them are
+	// only ever in the database.
+	ctx := context.Background()
+	queued := maxPDUsInMemory + 10
+	for i := 0; i < queued; i++ {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender: "@alice:localhost",
+			RoomID: "!room:localhost",
+			Type:   "m.room.message",
+			Depth:  int64(i + 1),
+		}
+		_ = builder.SetContent(map[string]interface{}{"body": fmt.Sprintf("message %d", i), "msgtype": "m.text"})
+		ev, err := builder.Build(time.Now(), "localhost", "ed25519:auto", key, gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("builder.Build failed: %s", err)
+		}
+		headeredJSON, err := json.Marshal(ev.Headered(gomatrixserverlib.RoomVersionV6))
+		if err != nil {
+			t.Fatalf("json.Marshal failed: %s", err)
+		}
+		receipt, err := db.StoreJSON(ctx, string(headeredJSON))
+		if err != nil {
+			t.Fatalf("StoreJSON failed: %s", err)
+		}
+		if err = db.AssociatePDUWithDestination(ctx, "", "remote", receipt); err != nil {
+			t.Fatalf("AssociatePDUWithDestination failed: %s", err)
+		}
+	}
+
+	// The server is blacklisted after the first failure, and we only keep
+	// some of the dead letters.
+	maxDeadLetters := maxPDUsInMemory + 5
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, failingTransport{})
+	oqs := NewOutgoingQueues(
+		db, false, "localhost", federation, nil,
+		&statistics.Statistics{DB: db, FailuresUntilBlacklist: 1},
+		&SigningInfo{ServerName: "localhost", KeyID: "ed25519:auto", PrivateKey: key},
+		&config.FederationAPI{}, time.Minute, 0, maxDeadLetters,
+	)
+	oqs.catchUp()
+
+	var deadLetters []types.DeadLetter
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deadLetters) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if deadLetters, err = db.GetDeadLetters(ctx, queued); err != nil {
+			t.Fatalf("GetDeadLetters failed: %s", err)
+		}
+	}
+	if len(deadLetters) != maxDeadLetters {
+		t.Fatalf("got %d dead letters, want %d", len(deadLetters), maxDeadLetters)
+	}
+}
+
+func TestCatchUpSendsQueuedEventsAfterRestart(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	tmpfile, err := ioutil.TempFile("", "federationsender")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(tmpfile.Name()) // nolint:errcheck
+	mustOpenDatabase := func() storage.Database {
+		t.Helper()
+		cache, err := caching.NewInMemoryLRUCache(nil, false)
+		if err != nil {
+			t.Fatalf("failed to make caches: %s", err)
+		}
+		db, err := storage.NewDatabase(&config.DatabaseOptions{
+			ConnectionString:   config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		}, cache)
+		if err != nil {
+			t.Fatalf("failed to create database: %s", err)
+		}
+		return db
+	}
+
+	// Queue up some events for the remote server, in the same way that
+	// SendEvent and SendEDU do, without ever sending them.
+	ctx := context.Background()
+	db := mustOpenDatabase()
+	var want []string
+	for i := 0; i < 5; i++ {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender: "@alice:localhost",
+			RoomID: "!room:localhost",
+			Type:   "m.room.message",
+			Depth:  int64(i + 1),
+		}
+		body := fmt.Sprintf("message %d", i)
+		_ = builder.SetContent(map[string]interface{}{"body": body, "msgtype": "m.text"})
+		ev, err := builder.Build(time.Now(), "localhost", "ed25519:auto", key, gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("builder.Build failed: %s", err)
+		}
+		headeredJSON, err := json.Marshal(ev.Headered(gomatrixserverlib.RoomVersionV6))
+		if err != nil {
+			t.Fatalf("json.Marshal failed: %s", err)
+		}
+		receipt, err := db.StoreJSON(ctx, string(headeredJSON))
+		if err != nil {
+			t.Fatalf("StoreJSON failed: %s", err)
+		}
+		if err = db.AssociatePDUWithDestination(ctx, "", "remote", receipt); err != nil {
+			t.Fatalf("AssociatePDUWithDestination failed: %s", err)
+		}
+		want = append(want, body)
+	}
+	eduJSON, err := json.Marshal(&gomatrixserverlib.EDU{Type: "m.typing"})
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	receipt, err := db.StoreJSON(ctx, string(eduJSON))
+	if err != nil {
+		t.Fatalf("StoreJSON failed: %s", err)
+	}
+	if err = db.AssociateEDUWithDestination(ctx, "remote", receipt); err != nil {
+		t.Fatalf("AssociateEDUWithDestination failed: %s", err)
+	}
+
+	// "Restart" with a fresh database connection and queues, which know
+	// nothing about the events other than what is in the database.
+	db = mustOpenDatabase()
+	transport := &catchUpTransport{}
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, transport)
+	oqs := NewOutgoingQueues(
+		db, false, "localhost", federation, nil,
+		&statistics.Statistics{DB: db, FailuresUntilBlacklist: 16},
+		&SigningInfo{ServerName: "localhost", KeyID: "ed25519:auto", PrivateKey: key},
+		&config.FederationAPI{}, time.Minute, 0, 0,
+	)
+	oqs.catchUp()
+
+	deadline := time.Now().Add(5 * time.Second)
+	pdus, edus := transport.sent()
+	for (len(pdus) < len(want) || len(edus) < 1) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		pdus, edus = transport.sent()
+	}
+	if len(pdus) != len(want) {
+		t.Fatalf("remote server got PDUs %v, want %v", pdus, want)
+	}
+	for i := range want {
+		if pdus[i] != want[i] {
+			t.Errorf("remote server got PDUs %v, want %v", pdus, want)
+			break
+		}
+	}
+	if len(edus) != 1 || edus[0] != "m.typing" {
+		t.Errorf("remote server got EDUs %v, want [m.typing]", edus)
+	}
+}
+
+func TestEventsWithinBatchWindowShareTransaction(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	transport := &catchUpTransport{}
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, transport)
+	oqs := NewOutgoingQueues(
+		db, false, "localhost", federation, nil,
+		&statistics.Statistics{DB: db, FailuresUntilBlacklist: 16},
+		&SigningInfo{ServerName: "localhost", KeyID: "ed25519:auto", PrivateKey: key},
+		&config.FederationAPI{}, time.Minute, time.Second, 0,
+	)
+
+	// The EDUs are queued a little while apart, but all within the batch
+	// window of the first one.
+	want := []string{"m.typing", "m.receipt", "m.device_list_update"}
+	for _, eduType := range want {
+		if err = oqs.SendEDU(&gomatrixserverlib.EDU{Type: eduType}, "localhost", []gomatrixserverlib.ServerName{"remote"}); err != nil {
+			t.Fatalf("SendEDU failed: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	_, edus := transport.sent()
+	for len(edus) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		_, edus = transport.sent()
+	}
+	if len(edus) != len(want) {
+		t.Fatalf("remote server got EDUs %v, want %v", edus, want)
+	}
+	transport.Lock()
+	transactions := transport.transactions
+	transport.Unlock()
+	if transactions != 1 {
+		t.Errorf("remote server got %d transactions, want 1", transactions)
+	}
+}
+
+func TestFullBatchIsSentWithoutWaitingForBatchWindow(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	transport := &catchUpTransport{}
+	federation := gomatrixserverlib.NewFederationClient("localhost", "ed25519:auto", key, true)
+	federation.Client = *gomatrixserverlib.NewClientWithTransportTimeout(time.Minute, transport)
+	oqs := NewOutgoingQueues(
+		db, false, "localhost", federation, nil,
+		&statistics.Statistics{DB: db, FailuresUntilBlacklist: 16},
+		&SigningInfo{ServerName: "localhost", KeyID: "ed25519:auto", PrivateKey: key},
+		&config.FederationAPI{}, time.Minute, time.Minute, 0,
+	)
+
+	// There are enough EDUs to fill a transaction, so there's no point in
+	// waiting for the rest of the batch window.
+	for i := 0; i < maxEDUsPerTransaction; i++ {
+		if err = oqs.SendEDU(&gomatrixserverlib.EDU{Type: "m.typing"}, "localhost", []gomatrixserverlib.ServerName{"remote"}); err != nil {
+			t.Fatalf("SendEDU failed: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	_, edus := transport.sent()
+	for len(edus) < maxEDUsPerTransaction && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		_, edus = transport.sent()
+	}
+	if len(edus) != maxEDUsPerTransaction {
+		t.Fatalf("remote server got %d EDUs, want %d", len(edus), maxEDUsPerTransaction)
+	}
+	transport.Lock()
+	transactions := transport.transactions
+	transport.Unlock()
+	if transactions != 1 {
+		t.Errorf("remote server got %d transactions, want 1", transactions)
+	}
+}
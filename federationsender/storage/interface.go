@@ -54,4 +54,10 @@ type Database interface {
 	AddServerToBlacklist(serverName gomatrixserverlib.ServerName) error
 	RemoveServerFromBlacklist(serverName gomatrixserverlib.ServerName) error
 	IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error)
+
+	// DeadLetterQueuedPDUs records that we gave up trying to send the PDUs queued for the server,
+	// keeping no more than maxDeadLetters dead letters in total.
+	DeadLetterQueuedPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, maxDeadLetters int) (int, error)
+	// GetDeadLetters returns up to limit of the events that we gave up trying to send, most recent first.
+	GetDeadLetters(ctx context.Context, limit int) ([]types.DeadLetter, error)
 }
@@ -48,6 +48,7 @@ const deleteQueuePDUSQL = "" +
 const selectQueuePDUsSQL = "" +
 	"SELECT json_nid FROM federationsender_queue_pdus" +
 	" WHERE server_name = $1" +
+	" ORDER BY json_nid ASC" +
 	" LIMIT $2"
 
 const selectQueuePDUReferenceJSONCountSQL = "" +
@@ -64,6 +64,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions, cache caching.FederationS
 	if err != nil {
 		return nil, err
 	}
+	deadLetters, err := NewPostgresDeadLettersTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                          d.db,
 		Cache:                       cache,
@@ -74,6 +78,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, cache caching.FederationS
 		FederationSenderQueueJSON:   queueJSON,
 		FederationSenderRooms:       rooms,
 		FederationSenderBlacklist:   blacklist,
+		FederationSenderDeadLetters: deadLetters,
 	}
 	if err = d.PartitionOffsetStatements.Prepare(d.db, d.writer, "federationsender"); err != nil {
 		return nil, err
@@ -17,7 +17,9 @@ package shared
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/storage/tables"
 	"github.com/matrix-org/dendrite/federationsender/types"
@@ -26,6 +28,10 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// deadLetterBatchSize is how many queued PDUs are looked up at a time
+// when dead-lettering them.
+const deadLetterBatchSize = 100
+
 type Database struct {
 	DB                          *sql.DB
 	Cache                       caching.FederationSenderCache
@@ -36,6 +42,7 @@ type Database struct {
 	FederationSenderJoinedHosts tables.FederationSenderJoinedHosts
 	FederationSenderRooms       tables.FederationSenderRooms
 	FederationSenderBlacklist   tables.FederationSenderBlacklist
+	FederationSenderDeadLetters tables.FederationSenderDeadLetters
 }
 
 // An Receipt contains the NIDs of a call to GetNextTransactionPDUs/EDUs.
@@ -50,6 +57,12 @@ func (r *Receipt) String() string {
 	return fmt.Sprintf("%d", r.nid)
 }
 
+// Before returns true if the entry for this receipt was queued before the
+// entry for the other one.
+func (r *Receipt) Before(other *Receipt) bool {
+	return r.nid < other.nid
+}
+
 // UpdateRoom updates the joined hosts for a room and returns what the joined
 // hosts were before the update, or nil if this was a duplicate message.
 // This is called when we receive a message from kafka, so we pass in
@@ -173,3 +186,77 @@ func (d *Database) RemoveServerFromBlacklist(serverName gomatrixserverlib.Server
 func (d *Database) IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error) {
 	return d.FederationSenderBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
+
+// DeadLetterQueuedPDUs records every PDU that is still queued for the server
+// as a dead letter, because we gave up trying to send them, and then deletes
+// the oldest dead letters so that no more than maxDeadLetters are kept. If
+// maxDeadLetters is 0 then they are all kept. Returns how many PDUs were
+// dead-lettered.
+func (d *Database) DeadLetterQueuedPDUs(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, maxDeadLetters int,
+) (count int, err error) {
+	failedTS := gomatrixserverlib.AsTimestamp(time.Now())
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		queued, err := d.FederationSenderQueuePDUs.SelectQueuePDUCount(ctx, txn, serverName)
+		if err != nil {
+			return fmt.Errorf("d.FederationSenderQueuePDUs.SelectQueuePDUCount: %w", err)
+		}
+		if queued == 0 {
+			return nil
+		}
+		nids, err := d.FederationSenderQueuePDUs.SelectQueuePDUs(ctx, txn, serverName, int(queued))
+		if err != nil {
+			return fmt.Errorf("d.FederationSenderQueuePDUs.SelectQueuePDUs: %w", err)
+		}
+		// Look the events up in batches, so that a long queue doesn't
+		// have to be in memory all at once.
+		for len(nids) > 0 {
+			batch := nids
+			if len(batch) > deadLetterBatchSize {
+				batch = batch[:deadLetterBatchSize]
+			}
+			nids = nids[len(batch):]
+			events := make([]*gomatrixserverlib.HeaderedEvent, 0, len(batch))
+			retrieve := make([]int64, 0, len(batch))
+			for _, nid := range batch {
+				if event, ok := d.Cache.GetFederationSenderQueuedPDU(nid); ok {
+					events = append(events, event)
+				} else {
+					retrieve = append(retrieve, nid)
+				}
+			}
+			blobs, err := d.FederationSenderQueueJSON.SelectQueueJSON(ctx, txn, retrieve)
+			if err != nil {
+				return fmt.Errorf("d.FederationSenderQueueJSON.SelectQueueJSON: %w", err)
+			}
+			for _, blob := range blobs {
+				var event gomatrixserverlib.HeaderedEvent
+				if err := json.Unmarshal(blob, &event); err != nil {
+					return fmt.Errorf("json.Unmarshal: %w", err)
+				}
+				events = append(events, &event)
+			}
+			for _, event := range events {
+				if err := d.FederationSenderDeadLetters.InsertDeadLetter(
+					ctx, txn, serverName, event.RoomID(), event.EventID(), failedTS,
+				); err != nil {
+					return fmt.Errorf("d.FederationSenderDeadLetters.InsertDeadLetter: %w", err)
+				}
+			}
+			count += len(events)
+		}
+		if maxDeadLetters > 0 {
+			if err := d.FederationSenderDeadLetters.DeleteOldestDeadLetters(ctx, txn, maxDeadLetters); err != nil {
+				return fmt.Errorf("d.FederationSenderDeadLetters.DeleteOldestDeadLetters: %w", err)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// GetDeadLetters returns up to limit of the events that we gave up trying to
+// send, most recent first.
+func (d *Database) GetDeadLetters(ctx context.Context, limit int) ([]types.DeadLetter, error) {
+	return d.FederationSenderDeadLetters.SelectDeadLetters(ctx, nil, limit)
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const deadLettersSchema = `
+-- Stores the events that we gave up trying to send to a server, so that
+-- server admins can find out what didn't get delivered.
+CREATE TABLE IF NOT EXISTS federationsender_dead_letters (
+	-- The server that we failed to send the event to
+	server_name TEXT NOT NULL,
+	-- The room that the event is in
+	room_id TEXT NOT NULL,
+	-- The event that we failed to send
+	event_id TEXT NOT NULL,
+	-- When we gave up trying to send the event
+	failed_ts BIGINT NOT NULL,
+	UNIQUE (server_name, event_id)
+);
+CREATE INDEX IF NOT EXISTS federationsender_dead_letters_failed_ts_idx
+	ON federationsender_dead_letters (failed_ts);
+`
+
+const insertDeadLetterSQL = "" +
+	"INSERT INTO federationsender_dead_letters (server_name, room_id, event_id, failed_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (server_name, event_id) DO UPDATE SET failed_ts = $4"
+
+const selectDeadLettersSQL = "" +
+	"SELECT server_name, room_id, event_id, failed_ts FROM federationsender_dead_letters" +
+	" ORDER BY failed_ts DESC, server_name ASC, event_id ASC LIMIT $1"
+
+const deleteOldestDeadLettersSQL = "" +
+	"DELETE FROM federationsender_dead_letters WHERE rowid NOT IN (" +
+	"  SELECT rowid FROM federationsender_dead_letters" +
+	"  ORDER BY failed_ts DESC, server_name ASC, event_id ASC LIMIT $1" +
+	")"
+
+type deadLettersStatements struct {
+	db                          *sql.DB
+	insertDeadLetterStmt        *sql.Stmt
+	selectDeadLettersStmt       *sql.Stmt
+	deleteOldestDeadLettersStmt *sql.Stmt
+}
+
+func NewSQLiteDeadLettersTable(db *sql.DB) (s *deadLettersStatements, err error) {
+	s = &deadLettersStatements{
+		db: db,
+	}
+	_, err = db.Exec(deadLettersSchema)
+	if err != nil {
+		return
+	}
+
+	if s.insertDeadLetterStmt, err = db.Prepare(insertDeadLetterSQL); err != nil {
+		return
+	}
+	if s.selectDeadLettersStmt, err = db.Prepare(selectDeadLettersSQL); err != nil {
+		return
+	}
+	if s.deleteOldestDeadLettersStmt, err = db.Prepare(deleteOldestDeadLettersSQL); err != nil {
+		return
+	}
+	return
+}
+
+// InsertDeadLetter records that we gave up trying to send the event to the
+// server. If we had already given up on it before then the time is updated.
+func (s *deadLettersStatements) InsertDeadLetter(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+	roomID, eventID string, failedTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertDeadLetterStmt)
+	_, err := stmt.ExecContext(ctx, serverName, roomID, eventID, failedTS)
+	return err
+}
+
+// SelectDeadLetters returns up to limit of the events that we gave up on,
+// most recent first.
+func (s *deadLettersStatements) SelectDeadLetters(
+	ctx context.Context, txn *sql.Tx, limit int,
+) ([]types.DeadLetter, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectDeadLettersStmt)
+	rows, err := stmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectDeadLetters: rows.close() failed")
+	var deadLetters []types.DeadLetter
+	for rows.Next() {
+		var deadLetter types.DeadLetter
+		if err = rows.Scan(
+			&deadLetter.ServerName, &deadLetter.RoomID, &deadLetter.EventID, &deadLetter.FailedTS,
+		); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
+
+// DeleteOldestDeadLetters deletes the oldest dead letters so that no more
+// than keep of them are left.
+func (s *deadLettersStatements) DeleteOldestDeadLetters(
+	ctx context.Context, txn *sql.Tx, keep int,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteOldestDeadLettersStmt)
+	_, err := stmt.ExecContext(ctx, keep)
+	return err
+}
@@ -56,6 +56,7 @@ const selectQueueNextTransactionIDSQL = "" +
 const selectQueuePDUsSQL = "" +
 	"SELECT json_nid FROM federationsender_queue_pdus" +
 	" WHERE server_name = $1" +
+	" ORDER BY json_nid ASC" +
 	" LIMIT $2"
 
 const selectQueuePDUsReferenceJSONCountSQL = "" +
@@ -67,3 +67,9 @@ type FederationSenderBlacklist interface {
 	SelectBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (bool, error)
 	DeleteBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
 }
+
+type FederationSenderDeadLetters interface {
+	InsertDeadLetter(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, roomID, eventID string, failedTS gomatrixserverlib.Timestamp) error
+	SelectDeadLetters(ctx context.Context, txn *sql.Tx, limit int) ([]types.DeadLetter, error)
+	DeleteOldestDeadLetters(ctx context.Context, txn *sql.Tx, keep int) error
+}
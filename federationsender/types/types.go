@@ -28,6 +28,15 @@ type JoinedHost struct {
 	ServerName gomatrixserverlib.ServerName
 }
 
+// A DeadLetter is an event that we gave up trying to send to a server,
+// because the server was blacklisted after too many failed attempts.
+type DeadLetter struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	RoomID     string                       `json:"room_id"`
+	EventID    string                       `json:"event_id"`
+	FailedTS   gomatrixserverlib.Timestamp  `json:"failed_ts"`
+}
+
 type ServerNames []gomatrixserverlib.ServerName
 
 func (s ServerNames) Len() int           { return len(s) }
@@ -0,0 +1,33 @@
+package caching
+
+import (
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const (
+	AccountTypeCacheName       = "account_types"
+	AccountTypeCacheMaxEntries = 1024
+	AccountTypeCacheMutable    = false
+)
+
+// AccountTypeCache contains the subset of functions needed for
+// an account type cache. The type of an account never changes
+// once the account has been created, so the cache is immutable.
+type AccountTypeCache interface {
+	GetAccountType(localpart string) (accountType api.AccountType, ok bool)
+	StoreAccountType(localpart string, accountType api.AccountType)
+}
+
+func (c Caches) GetAccountType(localpart string) (api.AccountType, bool) {
+	val, found := c.AccountTypes.Get(localpart)
+	if found && val != nil {
+		if accountType, ok := val.(api.AccountType); ok {
+			return accountType, true
+		}
+	}
+	return 0, false
+}
+
+func (c Caches) StoreAccountType(localpart string, accountType api.AccountType) {
+	c.AccountTypes.Set(localpart, accountType)
+}
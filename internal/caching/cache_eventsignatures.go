@@ -0,0 +1,31 @@
+package caching
+
+// Events are immutable, so once the signatures on an event have been
+// verified there is no need to ever verify them again.
+
+const (
+	EventSignaturesCacheName       = "event_signatures"
+	EventSignaturesCacheMaxEntries = 8192
+	EventSignaturesCacheMutable    = false
+)
+
+// EventSignaturesCache contains the subset of functions needed for
+// an event signature verification cache.
+type EventSignaturesCache interface {
+	IsEventSignatureVerified(key string) bool
+	StoreEventSignatureVerified(key string)
+}
+
+func (c Caches) IsEventSignatureVerified(key string) bool {
+	val, found := c.EventSignatures.Get(key)
+	if found && val != nil {
+		if verified, ok := val.(bool); ok {
+			return verified
+		}
+	}
+	return false
+}
+
+func (c Caches) StoreEventSignatureVerified(key string) {
+	c.EventSignatures.Set(key, true)
+}
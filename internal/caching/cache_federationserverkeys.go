@@ -0,0 +1,41 @@
+package caching
+
+import (
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	FederationServerKeysCacheName       = "federation_server_keys"
+	FederationServerKeysCacheMaxEntries = 1024
+	FederationServerKeysCacheMutable    = true
+)
+
+// FederationServerKeysCache contains the subset of functions needed for
+// a cache of the keys that remote servers return from /key/v2/server.
+type FederationServerKeysCache interface {
+	GetFederationServerKeys(serverName gomatrixserverlib.ServerName) (keys gomatrixserverlib.ServerKeys, ok bool)
+	StoreFederationServerKeys(serverName gomatrixserverlib.ServerName, keys gomatrixserverlib.ServerKeys)
+}
+
+func (c Caches) GetFederationServerKeys(serverName gomatrixserverlib.ServerName) (gomatrixserverlib.ServerKeys, bool) {
+	key := string(serverName)
+	val, found := c.FederationServerKeys.Get(key)
+	if found && val != nil {
+		if keys, ok := val.(gomatrixserverlib.ServerKeys); ok {
+			if keys.ValidUntilTS <= gomatrixserverlib.AsTimestamp(time.Now()) {
+				// The keys have expired so don't return them. The caller
+				// will have to fetch them again.
+				c.FederationServerKeys.Unset(key)
+				return gomatrixserverlib.ServerKeys{}, false
+			}
+			return keys, true
+		}
+	}
+	return gomatrixserverlib.ServerKeys{}, false
+}
+
+func (c Caches) StoreFederationServerKeys(serverName gomatrixserverlib.ServerName, keys gomatrixserverlib.ServerKeys) {
+	c.FederationServerKeys.Set(string(serverName), keys)
+}
@@ -0,0 +1,73 @@
+package caching
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// WARNING: This cache is mutable because redacting an event changes it.
+// The roomserver invalidates an event when it is redacted, which is only
+// safe because the RoomServerEventsCache is used ONLY within the roomserver.
+// It MUST NOT be used from other components as we currently have no way to
+// invalidate the cache in downstream components.
+//
+// The size of the cache is set by global.cache.event_cache_max_entries.
+
+const (
+	RoomServerEventsCacheName    = "roomserver_events"
+	RoomServerEventsCacheMutable = true
+)
+
+// RoomServerEventsCache contains the subset of functions needed for
+// a roomserver event cache. It must only be used from the roomserver.
+// Events are copied into and out of the cache, so changing an event
+// doesn't change the cached copy.
+type RoomServerEventsCache interface {
+	GetRoomServerEvent(eventID string) (*gomatrixserverlib.HeaderedEvent, bool)
+	StoreRoomServerEvent(event *gomatrixserverlib.HeaderedEvent)
+	InvalidateRoomServerEvent(eventID string)
+}
+
+// invalidatedRoomServerEvent replaces an event in the cache when it is
+// invalidated, so that a copy of the event which was loaded before it
+// was redacted can't be stored again afterwards.
+type invalidatedRoomServerEvent struct{}
+
+// roomServerEventsMutex makes checking for an invalidated event and
+// storing the event atomic.
+var roomServerEventsMutex sync.Mutex
+
+func (c Caches) GetRoomServerEvent(eventID string) (*gomatrixserverlib.HeaderedEvent, bool) {
+	val, found := c.RoomServerEvents.Get(eventID)
+	if found && val != nil {
+		if event, ok := val.(*gomatrixserverlib.HeaderedEvent); ok {
+			return copyHeaderedEvent(event), true
+		}
+	}
+	return nil, false
+}
+
+func (c Caches) StoreRoomServerEvent(event *gomatrixserverlib.HeaderedEvent) {
+	roomServerEventsMutex.Lock()
+	defer roomServerEventsMutex.Unlock()
+	if _, found := c.RoomServerEvents.Get(event.EventID()); found {
+		// either the event is cached already or it has been invalidated
+		return
+	}
+	c.RoomServerEvents.Set(event.EventID(), copyHeaderedEvent(event))
+}
+
+func (c Caches) InvalidateRoomServerEvent(eventID string) {
+	roomServerEventsMutex.Lock()
+	defer roomServerEventsMutex.Unlock()
+	c.RoomServerEvents.Set(eventID, invalidatedRoomServerEvent{})
+}
+
+func copyHeaderedEvent(event *gomatrixserverlib.HeaderedEvent) *gomatrixserverlib.HeaderedEvent {
+	unwrapped := *event.Unwrap()
+	return &gomatrixserverlib.HeaderedEvent{
+		EventHeader: event.EventHeader,
+		Event:       &unwrapped,
+	}
+}
@@ -0,0 +1,37 @@
+package caching
+
+import (
+	"strconv"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// Auth chains never change once an event has been stored, as the auth events
+// of an event are part of the event itself, so this cache is immutable.
+
+const (
+	RoomServerAuthChainsCacheName       = "roomserver_auth_chains"
+	RoomServerAuthChainsCacheMaxEntries = 1024
+	RoomServerAuthChainsCacheMutable    = false
+)
+
+// RoomServerAuthChainsCache contains the subset of functions needed for
+// a roomserver auth chain cache.
+type RoomServerAuthChainsCache interface {
+	GetRoomServerAuthChain(eventNID types.EventNID) ([]types.EventNID, bool)
+	StoreRoomServerAuthChain(eventNID types.EventNID, authChain []types.EventNID)
+}
+
+func (c Caches) GetRoomServerAuthChain(eventNID types.EventNID) ([]types.EventNID, bool) {
+	val, found := c.RoomServerAuthChains.Get(strconv.Itoa(int(eventNID)))
+	if found && val != nil {
+		if authChain, ok := val.([]types.EventNID); ok {
+			return authChain, true
+		}
+	}
+	return nil, false
+}
+
+func (c Caches) StoreRoomServerAuthChain(eventNID types.EventNID, authChain []types.EventNID) {
+	c.RoomServerAuthChains.Set(strconv.Itoa(int(eventNID)), authChain)
+}
@@ -24,6 +24,8 @@ type RoomServerCaches interface {
 	RoomServerNIDsCache
 	RoomVersionCache
 	RoomInfoCache
+	RoomServerEventsCache
+	RoomServerAuthChainsCache
 }
 
 // RoomServerNIDsCache contains the subset of functions needed for
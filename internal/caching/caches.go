@@ -11,7 +11,12 @@ type Caches struct {
 	RoomServerRoomNIDs      Cache // RoomServerNIDsCache
 	RoomServerRoomIDs       Cache // RoomServerNIDsCache
 	RoomInfos               Cache // RoomInfoCache
+	RoomServerEvents        Cache // RoomServerEventsCache
+	RoomServerAuthChains    Cache // RoomServerAuthChainsCache
 	FederationEvents        Cache // FederationEventsCache
+	EventSignatures         Cache // EventSignaturesCache
+	FederationServerKeys    Cache // FederationServerKeysCache
+	AccountTypes            Cache // AccountTypeCache
 }
 
 // Cache is the interface that an implementation must satisfy.
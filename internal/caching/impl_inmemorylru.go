@@ -4,11 +4,18 @@ import (
 	"fmt"
 
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
+// NewInMemoryLRUCache creates the caches. A nil config uses the default
+// cache sizes.
+func NewInMemoryLRUCache(cfg *config.Cache, enablePrometheus bool) (*Caches, error) {
+	if cfg == nil {
+		cfg = &config.Cache{}
+		cfg.Defaults()
+	}
 	roomVersions, err := NewInMemoryLRUCachePartition(
 		RoomVersionCacheName,
 		RoomVersionCacheMutable,
@@ -63,6 +70,24 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 	if err != nil {
 		return nil, err
 	}
+	roomServerEvents, err := NewInMemoryLRUCachePartition(
+		RoomServerEventsCacheName,
+		RoomServerEventsCacheMutable,
+		cfg.EventCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	roomServerAuthChains, err := NewInMemoryLRUCachePartition(
+		RoomServerAuthChainsCacheName,
+		RoomServerAuthChainsCacheMutable,
+		RoomServerAuthChainsCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
 	federationEvents, err := NewInMemoryLRUCachePartition(
 		FederationEventCacheName,
 		FederationEventCacheMutable,
@@ -72,6 +97,33 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 	if err != nil {
 		return nil, err
 	}
+	eventSignatures, err := NewInMemoryLRUCachePartition(
+		EventSignaturesCacheName,
+		EventSignaturesCacheMutable,
+		EventSignaturesCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	federationServerKeys, err := NewInMemoryLRUCachePartition(
+		FederationServerKeysCacheName,
+		FederationServerKeysCacheMutable,
+		FederationServerKeysCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	accountTypes, err := NewInMemoryLRUCachePartition(
+		AccountTypeCacheName,
+		AccountTypeCacheMutable,
+		AccountTypeCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
 	return &Caches{
 		RoomVersions:            roomVersions,
 		ServerKeys:              serverKeys,
@@ -79,7 +131,12 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		RoomServerEventTypeNIDs: roomServerEventTypeNIDs,
 		RoomServerRoomIDs:       roomServerRoomIDs,
 		RoomInfos:               roomInfos,
+		RoomServerEvents:        roomServerEvents,
+		RoomServerAuthChains:    roomServerAuthChains,
 		FederationEvents:        federationEvents,
+		EventSignatures:         eventSignatures,
+		FederationServerKeys:    federationServerKeys,
+		AccountTypes:            accountTypes,
 	}, nil
 }
 
@@ -88,6 +145,8 @@ type InMemoryLRUCachePartition struct {
 	mutable    bool
 	maxEntries int
 	lru        *lru.Cache
+	hits       prometheus.Counter // nil if Prometheus is disabled
+	misses     prometheus.Counter // nil if Prometheus is disabled
 }
 
 func NewInMemoryLRUCachePartition(name string, mutable bool, maxEntries int, enablePrometheus bool) (*InMemoryLRUCachePartition, error) {
@@ -109,6 +168,16 @@ func NewInMemoryLRUCachePartition(name string, mutable bool, maxEntries int, ena
 		}, func() float64 {
 			return float64(cache.lru.Len())
 		})
+		cache.hits = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching_in_memory_lru",
+			Name:      name + "_hits_total",
+		})
+		cache.misses = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching_in_memory_lru",
+			Name:      name + "_misses_total",
+		})
 	}
 	return &cache, nil
 }
@@ -130,5 +199,11 @@ func (c *InMemoryLRUCachePartition) Unset(key string) {
 }
 
 func (c *InMemoryLRUCachePartition) Get(key string) (value interface{}, ok bool) {
-	return c.lru.Get(key)
+	value, ok = c.lru.Get(key)
+	if ok && c.hits != nil {
+		c.hits.Inc()
+	} else if !ok && c.misses != nil {
+		c.misses.Inc()
+	}
+	return
 }
@@ -0,0 +1,57 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MRoomRetention is the type of the state event which holds a room's
+// message retention policy (MSC1763).
+const MRoomRetention = "m.room.retention"
+
+// RetentionMaxLifetime returns how long events in a room should be kept
+// for, given the room's m.room.retention event (which may be nil) and the
+// server's retention configuration. The room's max_lifetime is clamped to
+// the bounds in the configuration, and rooms without one use the default.
+// Returns 0 if events should be kept forever.
+func RetentionMaxLifetime(cfg *config.RetentionOptions, retention *gomatrixserverlib.HeaderedEvent) time.Duration {
+	if !cfg.Enabled {
+		return 0
+	}
+	maxLifetime := cfg.DefaultMaxLifetime
+	if retention != nil {
+		var content struct {
+			MaxLifetime *int64 `json:"max_lifetime"`
+		}
+		if err := json.Unmarshal(retention.Content(), &content); err == nil && content.MaxLifetime != nil && *content.MaxLifetime > 0 {
+			maxLifetime = time.Duration(*content.MaxLifetime) * time.Millisecond
+		}
+	}
+	if maxLifetime <= 0 {
+		return 0
+	}
+	if cfg.AllowedLifetimeMin > 0 && maxLifetime < cfg.AllowedLifetimeMin {
+		maxLifetime = cfg.AllowedLifetimeMin
+	}
+	if cfg.AllowedLifetimeMax > 0 && maxLifetime > cfg.AllowedLifetimeMax {
+		maxLifetime = cfg.AllowedLifetimeMax
+	}
+	return maxLifetime
+}
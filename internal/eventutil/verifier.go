@@ -0,0 +1,97 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// CachingJSONVerifier is a gomatrixserverlib.JSONVerifier which remembers
+// the signatures that it has successfully verified, so that verifying the
+// same event again, e.g. when it turns up repeatedly during backfill, doesn't
+// have to check the signatures again.
+//
+// gomatrixserverlib verifies the redacted JSON of an event, which identifies
+// the event by its contents just like the event ID does in newer room
+// versions, so the entries are keyed on a hash of that rather than on the
+// event ID. This means that an event with a forged event ID in room versions
+// 1 and 2 never matches the entry of the real event. Failures aren't cached,
+// since they may be down to not being able to fetch the keys at the time.
+type CachingJSONVerifier struct {
+	inner gomatrixserverlib.JSONVerifier
+	cache caching.EventSignaturesCache
+}
+
+// NewCachingJSONVerifier wraps the verifier with the cache. If the cache is
+// nil then the verifier is returned as-is.
+func NewCachingJSONVerifier(inner gomatrixserverlib.JSONVerifier, cache caching.EventSignaturesCache) gomatrixserverlib.JSONVerifier {
+	if cache == nil {
+		return inner
+	}
+	return &CachingJSONVerifier{
+		inner: inner,
+		cache: cache,
+	}
+}
+
+// VerifyJSONs implements gomatrixserverlib.JSONVerifier
+func (v *CachingJSONVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	keys := make([]string, len(requests))
+	var uncached []gomatrixserverlib.VerifyJSONRequest
+	var uncachedIdxs []int
+	for i, req := range requests {
+		keys[i] = verifiedJSONCacheKey(req)
+		if v.cache.IsEventSignatureVerified(keys[i]) {
+			continue
+		}
+		uncached = append(uncached, req)
+		uncachedIdxs = append(uncachedIdxs, i)
+	}
+	if len(uncached) == 0 {
+		return results, nil
+	}
+	uncachedResults, err := v.inner.VerifyJSONs(ctx, uncached)
+	if err != nil {
+		return nil, err
+	}
+	for j, res := range uncachedResults {
+		i := uncachedIdxs[j]
+		results[i] = res
+		if res.Error == nil {
+			v.cache.StoreEventSignatureVerified(keys[i])
+		}
+	}
+	return results, nil
+}
+
+// verifiedJSONCacheKey includes everything that affects the result of the
+// verification, since the same JSON may be checked against the keys of
+// different servers.
+func verifiedJSONCacheKey(req gomatrixserverlib.VerifyJSONRequest) string {
+	hash := sha256.Sum256(req.Message)
+	return fmt.Sprintf(
+		"%s/%d/%t/%s", req.ServerName, req.AtTS, req.StrictValidityChecking,
+		base64.RawStdEncoding.EncodeToString(hash[:]),
+	)
+}
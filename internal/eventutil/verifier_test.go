@@ -0,0 +1,108 @@
+package eventutil
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// countingVerifier checks signatures against a single known key, counting
+// how many signatures it has been asked to check.
+type countingVerifier struct {
+	key   ed25519.PublicKey
+	count int
+	fail  bool
+}
+
+func (v *countingVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		v.count++
+		if v.fail {
+			results[i].Error = errors.New("couldn't fetch keys")
+			continue
+		}
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(req.ServerName), "ed25519:test", v.key, req.Message)
+	}
+	return results, nil
+}
+
+func TestCachingJSONVerifier(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	inner := &countingVerifier{key: pub}
+	verifier := NewCachingJSONVerifier(inner, cache)
+	mustBuild := func(body string) *gomatrixserverlib.Event {
+		t.Helper()
+		b := gomatrixserverlib.EventBuilder{
+			Sender:  "@alice:localhost",
+			RoomID:  "!room:localhost",
+			Type:    "m.room.message",
+			Content: []byte(`{"body":"` + body + `"}`),
+		}
+		ev, err := b.Build(time.Now(), "localhost", "ed25519:test", priv, gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		return ev
+	}
+	mustVerify := func(ev *gomatrixserverlib.Event, wantCount int) {
+		t.Helper()
+		if err := gomatrixserverlib.VerifyAllEventSignatures(context.Background(), []*gomatrixserverlib.Event{ev}, verifier); err != nil {
+			t.Fatalf("VerifyAllEventSignatures failed: %s", err)
+		}
+		if inner.count != wantCount {
+			t.Fatalf("inner verifier checked %d signatures, want %d", inner.count, wantCount)
+		}
+	}
+
+	// The second verification of the same event should hit the cache.
+	first := mustBuild("first")
+	mustVerify(first, 1)
+	mustVerify(first, 1)
+
+	// A different event isn't in the cache yet.
+	second := mustBuild("second")
+	mustVerify(second, 2)
+	mustVerify(first, 2)
+
+	// Failures aren't cached, so the event is checked again next time.
+	inner.fail = true
+	third := mustBuild("third")
+	if err = gomatrixserverlib.VerifyAllEventSignatures(context.Background(), []*gomatrixserverlib.Event{third}, verifier); err == nil {
+		t.Fatalf("VerifyAllEventSignatures succeeded, want an error")
+	}
+	inner.fail = false
+	mustVerify(third, 4)
+	mustVerify(third, 4)
+
+	// An event with a bad signature is never treated as verified.
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	forged, err := (&gomatrixserverlib.EventBuilder{
+		Sender:  "@alice:localhost",
+		RoomID:  "!room:localhost",
+		Type:    "m.room.message",
+		Content: []byte(`{"body":"forged"}`),
+	}).Build(time.Now(), "localhost", "ed25519:test", otherKey, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = gomatrixserverlib.VerifyAllEventSignatures(context.Background(), []*gomatrixserverlib.Event{forged}, verifier); err == nil {
+			t.Fatalf("VerifyAllEventSignatures succeeded for a forged event, want an error")
+		}
+	}
+	if inner.count != 6 {
+		t.Errorf("inner verifier checked %d signatures, want 6", inner.count)
+	}
+}
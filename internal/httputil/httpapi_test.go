@@ -15,9 +15,17 @@
 package httputil
 
 import (
+	"context"
+	"crypto/ed25519"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	federationsenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +115,96 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+// acceptingVerifier accepts all signatures.
+type acceptingVerifier struct{}
+
+func (v acceptingVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	return make([]gomatrixserverlib.VerifyJSONResult, len(requests)), nil
+}
+
+type nopFederationSenderAPI struct {
+	federationsenderAPI.FederationSenderInternalAPI
+}
+
+func (a *nopFederationSenderAPI) PerformServersAlive(
+	ctx context.Context, req *federationsenderAPI.PerformServersAliveRequest, res *federationsenderAPI.PerformServersAliveResponse,
+) error {
+	return nil
+}
+
+func TestMakeFedAPIAllowedServers(t *testing.T) {
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+		},
+		AllowedServers: []gomatrixserverlib.ServerName{"allowed", "blocked"},
+		BlockedServers: []gomatrixserverlib.ServerName{"blocked"},
+	}
+	h := MakeFedAPI("test", cfg, acceptingVerifier{}, &FederationWakeups{FsAPI: &nopFederationSenderAPI{}},
+		func(req *http.Request, fedReq *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+		},
+	)
+
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	for origin, want := range map[gomatrixserverlib.ServerName]int{
+		"allowed": http.StatusOK,
+		"blocked": http.StatusForbidden,
+		"other":   http.StatusForbidden,
+	} {
+		fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, "localhost", "/_matrix/federation/v1/version")
+		if err := fedReq.Sign(origin, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		signed, err := fedReq.HTTPRequest()
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		// Make it look like an incoming request rather than an outgoing one.
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/version", nil)
+		req.Header = signed.Header
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("request from %s: got HTTP %d, want %d", origin, rec.Code, want)
+		}
+	}
+}
+
+type accessTokenUserAPI struct {
+	userapi.UserInternalAPI
+	devices map[string]*userapi.Device // access token -> device
+}
+
+func (u *accessTokenUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
+	res.Device = u.devices[req.AccessToken]
+	return nil
+}
+
+func TestMakeAdminAPI(t *testing.T) {
+	userAPI := &accessTokenUserAPI{devices: map[string]*userapi.Device{
+		"admin": {UserID: "@admin:localhost", AccountType: userapi.AccountTypeAdmin},
+		"user":  {UserID: "@user:localhost", AccountType: userapi.AccountTypeUser},
+		"guest": {UserID: "@guest:localhost", AccountType: userapi.AccountTypeGuest},
+	}}
+	h := MakeAdminAPI("test", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+	for token, want := range map[string]int{
+		"admin":   http.StatusOK,
+		"user":    http.StatusForbidden,
+		"guest":   http.StatusForbidden,
+		"unknown": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: got HTTP %d, want %d", token, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DestinationLimiter is an http.RoundTripper that allows no more than a fixed
+// number of requests to be in flight to each destination at once. Requests
+// over the limit wait until an earlier request to the same destination has
+// finished, or until their context is done.
+type DestinationLimiter struct {
+	client     *gomatrixserverlib.Client
+	limit      int
+	slotsMutex sync.Mutex // protects slots
+	slots      map[string]chan struct{}
+}
+
+// NewDestinationLimiter returns a DestinationLimiter which sends requests
+// using the given client.
+func NewDestinationLimiter(client *gomatrixserverlib.Client, limit int) *DestinationLimiter {
+	return &DestinationLimiter{
+		client: client,
+		limit:  limit,
+		slots:  make(map[string]chan struct{}),
+	}
+}
+
+func (l *DestinationLimiter) slotsFor(destination string) chan struct{} {
+	l.slotsMutex.Lock()
+	defer l.slotsMutex.Unlock()
+	slots, ok := l.slots[destination]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[destination] = slots
+	}
+	return slots
+}
+
+// RoundTrip implements http.RoundTripper. The request counts against the limit
+// until the response body is closed.
+func (l *DestinationLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	slots := l.slotsFor(req.URL.Host)
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	res, err := l.client.DoHTTPRequest(req.Context(), req)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	res.Body = &releasingBody{
+		ReadCloser: res.Body,
+		release:    func() { <-slots },
+	}
+	return res, nil
+}
+
+// releasingBody frees a slot in the limiter the first time it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
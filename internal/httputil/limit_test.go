@@ -0,0 +1,97 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// concurrencyRecorder is a transport that records the highest number of
+// requests that were in flight to each destination at once.
+type concurrencyRecorder struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+	highest  map[string]int
+}
+
+func (r *concurrencyRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.inFlight[req.URL.Host]++
+	if r.inFlight[req.URL.Host] > r.highest[req.URL.Host] {
+		r.highest[req.URL.Host] = r.inFlight[req.URL.Host]
+	}
+	r.mu.Unlock()
+
+	time.Sleep(time.Millisecond * 20)
+
+	r.mu.Lock()
+	r.inFlight[req.URL.Host]--
+	r.mu.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+	}, nil
+}
+
+func TestDestinationLimiter(t *testing.T) {
+	const limit = 3
+	recorder := &concurrencyRecorder{
+		inFlight: map[string]int{},
+		highest:  map[string]int{},
+	}
+	client := gomatrixserverlib.NewClientWithTransport(
+		NewDestinationLimiter(gomatrixserverlib.NewClientWithTransport(recorder), limit),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for _, destination := range []string{"busy", "quiet"} {
+			if destination == "quiet" && i > 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(destination string) {
+				defer wg.Done()
+				req, err := http.NewRequest(http.MethodGet, "matrix://"+destination+"/_matrix/federation/v1/version", nil)
+				if err != nil {
+					t.Errorf("failed to make request: %s", err)
+					return
+				}
+				res, err := client.DoHTTPRequest(context.Background(), req)
+				if err != nil {
+					t.Errorf("request failed: %s", err)
+					return
+				}
+				_ = res.Body.Close()
+			}(destination)
+		}
+	}
+	wg.Wait()
+
+	if got := recorder.highest["busy"]; got != limit {
+		t.Errorf("got %d concurrent requests to the busy destination, want %d", got, limit)
+	}
+	if got := recorder.highest["quiet"]; got != 1 {
+		t.Errorf("got %d concurrent requests to the quiet destination, want 1", got)
+	}
+}
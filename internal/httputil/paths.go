@@ -19,5 +19,6 @@ const (
 	PublicFederationPathPrefix = "/_matrix/federation/"
 	PublicKeyPathPrefix        = "/_matrix/key/"
 	PublicMediaPathPrefix      = "/_matrix/media/"
+	PublicDendritePathPrefix   = "/_dendrite/"
 	InternalPathPrefix         = "/api/"
 )
@@ -0,0 +1,253 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules evaluates push rules against events.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#push-rules
+package pushrules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// ConditionKind is the kind of a push rule condition.
+type ConditionKind string
+
+const (
+	// EventMatchCondition matches a glob pattern against a field of the event.
+	EventMatchCondition ConditionKind = "event_match"
+	// SenderNotificationPermissionCondition matches if the sender of the
+	// event has the power level required for the notification key, as set
+	// in the "notifications" of the room's power levels.
+	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+)
+
+// RoomNotificationKey is the notifications power level key for @room.
+const RoomNotificationKey = "room"
+
+// Condition is a condition of a push rule.
+type Condition struct {
+	Kind    ConditionKind `json:"kind"`
+	Key     string        `json:"key,omitempty"`
+	Pattern string        `json:"pattern,omitempty"`
+}
+
+// Action is an action of a push rule. The spec allows actions to be objects
+// such as {"set_tweak": "highlight"}, which are represented by their tweak.
+type Action string
+
+const (
+	NotifyAction     Action = "notify"
+	DontNotifyAction Action = "dont_notify"
+	HighlightAction  Action = "highlight"
+)
+
+// Rule is a push rule.
+type Rule struct {
+	RuleID     string      `json:"rule_id"`
+	Default    bool        `json:"default"`
+	Enabled    bool        `json:"enabled"`
+	Conditions []Condition `json:"conditions"`
+	Actions    []Action    `json:"actions"`
+}
+
+// RoomNotificationRule returns the default .m.rule.roomnotif rule, which
+// highlights messages mentioning @room from senders who are allowed to
+// notify the whole room.
+func RoomNotificationRule() Rule {
+	return Rule{
+		RuleID:  ".m.rule.roomnotif",
+		Default: true,
+		Enabled: true,
+		Conditions: []Condition{
+			{Kind: EventMatchCondition, Key: "content.body", Pattern: "@room"},
+			{Kind: SenderNotificationPermissionCondition, Key: RoomNotificationKey},
+		},
+		Actions: []Action{NotifyAction, HighlightAction},
+	}
+}
+
+// ContainsUserNameRule returns the default .m.rule.contains_user_name rule,
+// which highlights messages mentioning the localpart of the user.
+func ContainsUserNameRule(localpart string) Rule {
+	return Rule{
+		RuleID:  ".m.rule.contains_user_name",
+		Default: true,
+		Enabled: true,
+		Conditions: []Condition{
+			{Kind: EventMatchCondition, Key: "content.body", Pattern: localpart},
+		},
+		Actions: []Action{NotifyAction, HighlightAction},
+	}
+}
+
+// EventTypeRule returns a default rule which notifies for all events of the
+// given type, such as .m.rule.message for m.room.message.
+func EventTypeRule(ruleID, eventType string) Rule {
+	return Rule{
+		RuleID:  ruleID,
+		Default: true,
+		Enabled: true,
+		Conditions: []Condition{
+			{Kind: EventMatchCondition, Key: "type", Pattern: eventType},
+		},
+		Actions: []Action{NotifyAction},
+	}
+}
+
+// DefaultRules returns the default push rules of the user with the given
+// localpart, in the order that they are evaluated. This is a subset of the
+// rules in the spec, as users can't set their own rules yet.
+func DefaultRules(localpart string) []Rule {
+	return []Rule{
+		RoomNotificationRule(),
+		ContainsUserNameRule(localpart),
+		EventTypeRule(".m.rule.encrypted", "m.room.encrypted"),
+		EventTypeRule(".m.rule.message", "m.room.message"),
+	}
+}
+
+// Evaluate returns the first of the rules which matches the event, or nil
+// if none of them do.
+func Evaluate(rules []Rule, event *gomatrixserverlib.Event, powerLevels *gomatrixserverlib.PowerLevelContent) (*Rule, error) {
+	for i := range rules {
+		ok, err := rules[i].Matches(event, powerLevels)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Notifies returns true if the rule's actions notify the user of the event.
+func (r *Rule) Notifies() bool {
+	for _, action := range r.Actions {
+		if action == NotifyAction {
+			return true
+		}
+	}
+	return false
+}
+
+// Highlights returns true if the rule's actions highlight the event.
+func (r *Rule) Highlights() bool {
+	for _, action := range r.Actions {
+		if action == HighlightAction {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the rule is enabled and all of its conditions match
+// the event, given the power levels of the room.
+func (r *Rule) Matches(event *gomatrixserverlib.Event, powerLevels *gomatrixserverlib.PowerLevelContent) (bool, error) {
+	if !r.Enabled {
+		return false, nil
+	}
+	for i := range r.Conditions {
+		ok, err := conditionMatches(&r.Conditions[i], event, powerLevels)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func conditionMatches(
+	cond *Condition, event *gomatrixserverlib.Event, powerLevels *gomatrixserverlib.PowerLevelContent,
+) (bool, error) {
+	switch cond.Kind {
+	case EventMatchCondition:
+		return eventMatches(cond.Key, cond.Pattern, event)
+	case SenderNotificationPermissionCondition:
+		return powerLevels.UserLevel(event.Sender()) >= powerLevels.NotificationLevel(cond.Key), nil
+	default:
+		// Conditions we don't understand never match, as the spec requires.
+		return false, nil
+	}
+}
+
+// eventMatches matches the glob pattern against the field of the event with
+// the given dot-separated key. Patterns on content.body match whole words,
+// all others must match the entire value.
+func eventMatches(key, pattern string, event *gomatrixserverlib.Event) (bool, error) {
+	var value gjson.Result
+	if strings.HasPrefix(key, "content.") {
+		value = gjson.GetBytes(event.Content(), strings.TrimPrefix(key, "content."))
+	} else {
+		value = gjson.GetBytes(event.JSON(), key)
+	}
+	if value.Type != gjson.String {
+		return false, nil
+	}
+	re, err := compileGlob(pattern, key == "content.body")
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value.Str), nil
+}
+
+// globCache holds the compiled regexps of the glob patterns which have been
+// matched before, keyed by globKey.
+var globCache sync.Map
+
+type globKey struct {
+	pattern   string
+	wordMatch bool
+}
+
+// compileGlob returns a case-insensitive regexp for the glob pattern, which
+// matches whole words if wordMatch is set and the entire value otherwise.
+func compileGlob(pattern string, wordMatch bool) (*regexp.Regexp, error) {
+	key := globKey{pattern, wordMatch}
+	if re, ok := globCache.Load(key); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	expr := globToRegexp(pattern)
+	if wordMatch {
+		expr = `(^|\W)` + expr + `(\W|$)`
+	} else {
+		expr = "^" + expr + "$"
+	}
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("regexp.Compile: %w", err)
+	}
+	globCache.Store(key, re)
+	return re, nil
+}
+
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
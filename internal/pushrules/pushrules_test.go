@@ -0,0 +1,120 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateMessage(t *testing.T, sender, body string) *gomatrixserverlib.Event {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender: sender,
+		RoomID: "!room:localhost",
+		Type:   "m.room.message",
+		Depth:  1,
+	}
+	if err := eb.SetContent(map[string]interface{}{"msgtype": "m.text", "body": body}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev
+}
+
+func TestRoomNotificationRequiresNotificationsLevel(t *testing.T) {
+	alice, bob := "@alice:localhost", "@bob:localhost"
+	var powerLevels gomatrixserverlib.PowerLevelContent
+	powerLevels.Defaults()
+	powerLevels.Users = map[string]int64{alice: 100, bob: 10}
+
+	tests := []struct {
+		name      string
+		sender    string
+		body      string
+		roomLevel *int64
+		want      bool
+	}{
+		{name: "admin mentioning @room", sender: alice, body: "@room: meeting now", want: true},
+		{name: "user below the default level", sender: bob, body: "hey @room", want: false},
+		{name: "user meeting a lowered level", sender: bob, body: "hey @room", roomLevel: new(int64), want: true},
+		{name: "no @room mention", sender: alice, body: "hello everyone", want: false},
+		{name: "@room inside a word", sender: alice, body: "email me@roomservice", want: false},
+	}
+	rule := RoomNotificationRule()
+	for _, tt := range tests {
+		levels := powerLevels
+		levels.Notifications = map[string]int64{}
+		if tt.roomLevel != nil {
+			levels.Notifications[RoomNotificationKey] = *tt.roomLevel
+		}
+		got, err := rule.Matches(mustCreateMessage(t, tt.sender, tt.body), &levels)
+		if err != nil {
+			t.Fatalf("%s: Matches failed: %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got match %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !rule.Highlights() {
+		t.Errorf("%s doesn't highlight", rule.RuleID)
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	alice, bob := "@alice:localhost", "@bob:localhost"
+	var powerLevels gomatrixserverlib.PowerLevelContent
+	powerLevels.Defaults()
+	powerLevels.Users = map[string]int64{alice: 100}
+
+	tests := []struct {
+		name          string
+		sender        string
+		body          string
+		wantRule      string
+		wantHighlight bool
+	}{
+		{name: "admin mentioning @room", sender: alice, body: "@room: meeting now", wantRule: ".m.rule.roomnotif", wantHighlight: true},
+		{name: "user mentioning @room", sender: bob, body: "hey @room", wantRule: ".m.rule.message"},
+		{name: "user mentioning dave", sender: bob, body: "hey Dave!", wantRule: ".m.rule.contains_user_name", wantHighlight: true},
+		{name: "plain message", sender: bob, body: "hello", wantRule: ".m.rule.message"},
+	}
+	rules := DefaultRules("dave")
+	for _, tt := range tests {
+		rule, err := Evaluate(rules, mustCreateMessage(t, tt.sender, tt.body), &powerLevels)
+		if err != nil {
+			t.Fatalf("%s: Evaluate failed: %s", tt.name, err)
+		}
+		if rule == nil {
+			t.Fatalf("%s: got no rule, want %s", tt.name, tt.wantRule)
+		}
+		if rule.RuleID != tt.wantRule {
+			t.Errorf("%s: got rule %s, want %s", tt.name, rule.RuleID, tt.wantRule)
+		}
+		if !rule.Notifies() {
+			t.Errorf("%s: rule %s doesn't notify", tt.name, rule.RuleID)
+		}
+		if rule.Highlights() != tt.wantHighlight {
+			t.Errorf("%s: got highlight %v, want %v", tt.name, rule.Highlights(), tt.wantHighlight)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// connector opens connections to a fixed data source name with the given
+// driver, so that a wrapped driver can be used without registering it, and
+// runs the given PRAGMA statements on each new connection.
+type connector struct {
+	driver  driver.Driver
+	dsn     string
+	pragmas []string
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range c.pragmas {
+		if err = execConn(ctx, conn, pragma); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close() // nolint:errcheck
+	execer, ok := stmt.(driver.StmtExecContext)
+	if !ok {
+		return fmt.Errorf("driver doesn't support ExecContext")
+	}
+	_, err = execer.ExecContext(ctx, nil)
+	return err
+}
+
+// sqlitePragmas returns the PRAGMA statements needed to apply the options to
+// a SQLite connection.
+func sqlitePragmas(opts *config.SQLiteOptions) ([]string, error) {
+	var pragmas []string
+	if opts.BusyTimeoutMilliseconds > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", opts.BusyTimeoutMilliseconds))
+	}
+	if opts.WAL {
+		pragmas = append(pragmas, "PRAGMA journal_mode = WAL")
+	}
+	if opts.Synchronous != "" {
+		switch level := strings.ToUpper(opts.Synchronous); level {
+		case "OFF", "NORMAL", "FULL", "EXTRA":
+			pragmas = append(pragmas, "PRAGMA synchronous = "+level)
+		default:
+			return nil, fmt.Errorf("invalid SQLite synchronous level %q", opts.Synchronous)
+		}
+	}
+	return pragmas, nil
+}
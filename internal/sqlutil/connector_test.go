@@ -0,0 +1,59 @@
+package sqlutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestSQLitePragmas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlutil")
+	assertNoError(t, err, "Failed to make temp dir")
+	defer os.RemoveAll(dir) // nolint:errcheck
+	db, err := Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "test.db")),
+		SQLite: config.SQLiteOptions{
+			WAL:                     true,
+			BusyTimeoutMilliseconds: 1234,
+			Synchronous:             "normal",
+		},
+	})
+	assertNoError(t, err, "Failed to open DB")
+	defer db.Close() // nolint:errcheck
+
+	// Hold one connection open so that the second one is definitely new,
+	// and check both of them.
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(ctx)
+		assertNoError(t, err, "Failed to get connection")
+		defer conn.Close() // nolint:errcheck
+		var journalMode string
+		var busyTimeout, synchronous int
+		assertNoError(t, conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode), "Failed to get journal_mode")
+		assertNoError(t, conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busyTimeout), "Failed to get busy_timeout")
+		assertNoError(t, conn.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&synchronous), "Failed to get synchronous")
+		if journalMode != "wal" {
+			t.Errorf("connection %d: got journal_mode %q, want wal", i, journalMode)
+		}
+		if busyTimeout != 1234 {
+			t.Errorf("connection %d: got busy_timeout %d, want 1234", i, busyTimeout)
+		}
+		if synchronous != 1 { // NORMAL
+			t.Errorf("connection %d: got synchronous %d, want 1", i, synchronous)
+		}
+	}
+
+	// An unknown synchronous level is rejected rather than being put into
+	// the PRAGMA.
+	if _, err = Open(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+		SQLite:           config.SQLiteOptions{Synchronous: "1; DROP TABLE foo"},
+	}); err == nil {
+		t.Errorf("expected an error for an invalid synchronous level")
+	}
+}
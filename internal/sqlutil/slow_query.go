@@ -0,0 +1,101 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/ngrok/sqlmw"
+	"github.com/sirupsen/logrus"
+)
+
+// slowQueryInterceptor logs a warning for any statement that takes longer
+// than the threshold to run. The query arguments are never logged, since
+// they may contain things like password hashes or access tokens.
+type slowQueryInterceptor struct {
+	sqlmw.NullInterceptor
+	threshold time.Duration
+}
+
+func (in *slowQueryInterceptor) StmtQueryContext(ctx context.Context, stmt driver.StmtQueryContext, query string, args []driver.NamedValue) (driver.Rows, error) {
+	startedAt := time.Now()
+	rows, err := stmt.QueryContext(ctx, args)
+	if err != nil {
+		in.check(query, len(args), time.Since(startedAt))
+		return nil, err
+	}
+	return &slowQueryRows{Rows: rows, in: in, query: query, args: len(args), duration: time.Since(startedAt)}, nil
+}
+
+func (in *slowQueryInterceptor) StmtExecContext(ctx context.Context, stmt driver.StmtExecContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	startedAt := time.Now()
+	result, err := stmt.ExecContext(ctx, args)
+	in.check(query, len(args), time.Since(startedAt))
+	return result, err
+}
+
+func (in *slowQueryInterceptor) ConnQueryContext(ctx context.Context, conn driver.QueryerContext, query string, args []driver.NamedValue) (driver.Rows, error) {
+	startedAt := time.Now()
+	rows, err := conn.QueryContext(ctx, query, args)
+	if err != nil {
+		in.check(query, len(args), time.Since(startedAt))
+		return nil, err
+	}
+	return &slowQueryRows{Rows: rows, in: in, query: query, args: len(args), duration: time.Since(startedAt)}, nil
+}
+
+func (in *slowQueryInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	startedAt := time.Now()
+	result, err := conn.ExecContext(ctx, query, args)
+	in.check(query, len(args), time.Since(startedAt))
+	return result, err
+}
+
+func (in *slowQueryInterceptor) check(query string, args int, duration time.Duration) {
+	if duration <= in.threshold {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"duration": duration,
+		"args":     args,
+	}).Warn("Slow SQL query: ", strings.Join(strings.Fields(query), " "))
+}
+
+// slowQueryRows adds up the time spent fetching rows, since some drivers
+// (like SQLite) don't do any of the work until the first call to Next, and
+// checks the total when the rows are closed. Time that the caller spends
+// between calls to Next isn't counted.
+type slowQueryRows struct {
+	driver.Rows
+	in       *slowQueryInterceptor
+	query    string
+	args     int
+	duration time.Duration
+}
+
+func (r *slowQueryRows) Next(dest []driver.Value) error {
+	startedAt := time.Now()
+	err := r.Rows.Next(dest)
+	r.duration += time.Since(startedAt)
+	return err
+}
+
+func (r *slowQueryRows) Close() error {
+	r.in.check(r.query, r.args, r.duration)
+	return r.Rows.Close()
+}
@@ -0,0 +1,62 @@
+package sqlutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSlowQueryLogging(t *testing.T) {
+	db, err := Open(&config.DatabaseOptions{
+		ConnectionString:               "file::memory:",
+		SlowQueryThresholdMilliseconds: 20,
+	})
+	assertNoError(t, err, "Failed to open DB")
+	defer db.Close() // nolint:errcheck
+	hook := logrustest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	// The query counts up to the given number, so with a large enough number
+	// it is slow, and with a small one it is fast.
+	stmt, err := db.Prepare(
+		"WITH RECURSIVE counter(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM counter WHERE x < $1)" +
+			" SELECT COUNT(*) FROM counter",
+	)
+	assertNoError(t, err, "Failed to prepare statement")
+	count := func(n int) {
+		var got int
+		err = stmt.QueryRowContext(context.Background(), n).Scan(&got)
+		assertNoError(t, err, "Failed to run query")
+		if got != n {
+			t.Fatalf("got count %d, want %d", got, n)
+		}
+	}
+
+	count(10)
+	if entries := hook.AllEntries(); len(entries) != 0 {
+		t.Fatalf("got %d log entries for a fast query, want none", len(entries))
+	}
+
+	count(1000000)
+	entries := hook.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("got %d log entries for a slow query, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != logrus.WarnLevel {
+		t.Errorf("got log level %s, want %s", entry.Level, logrus.WarnLevel)
+	}
+	if !strings.Contains(entry.Message, "WITH RECURSIVE counter(x)") {
+		t.Errorf("log message %q doesn't contain the query", entry.Message)
+	}
+	if strings.Contains(entry.Message, "1000000") {
+		t.Errorf("log message %q contains the query args", entry.Message)
+	}
+	if entry.Data["args"] != 1 {
+		t.Errorf("got args %v, want 1", entry.Data["args"])
+	}
+}
@@ -98,7 +98,8 @@ func trackGoID(query string) {
 
 // Open opens a database specified by its database driver name and a driver-specific data source name,
 // usually consisting of at least a database name and connection information. Includes tracing driver
-// if DENDRITE_TRACE_SQL=1
+// if DENDRITE_TRACE_SQL=1, logs slow queries if a slow query threshold is configured and applies
+// any SQLite options to each new connection.
 func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	var err error
 	var driverName, dsn string
@@ -123,6 +124,24 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	var pragmas []string
+	if dbProperties.ConnectionString.IsSQLite() {
+		if pragmas, err = sqlitePragmas(&dbProperties.SQLite); err != nil {
+			return nil, err
+		}
+	}
+	if threshold := dbProperties.SlowQueryThreshold(); threshold > 0 || len(pragmas) > 0 {
+		// reopen the database with a connector, so that we can wrap the
+		// driver and set up each new connection
+		drv := db.Driver()
+		if threshold > 0 {
+			drv = sqlmw.Driver(drv, &slowQueryInterceptor{threshold: threshold})
+		}
+		if err = db.Close(); err != nil {
+			return nil, err
+		}
+		db = sql.OpenDB(&connector{driver: drv, dsn: dsn, pragmas: pragmas})
+	}
 	if driverName != SQLiteDriverName() {
 		logrus.WithFields(logrus.Fields{
 			"MaxOpenConns":    dbProperties.MaxOpenConns,
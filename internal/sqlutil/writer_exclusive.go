@@ -3,7 +3,11 @@ package sqlutil
 import (
 	"database/sql"
 	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/matrix-org/dendrite/setup/config"
 	"go.uber.org/atomic"
 )
 
@@ -11,6 +15,15 @@ import (
 // ExclusiveWriter allows queuing database writes so that you don't
 // contend on database locks in, e.g. SQLite. Only one task will run
 // at a time on a given ExclusiveWriter.
+//
+// SQLite only allows one writer at a time on a database file, so every
+// write to a SQLite database, whether it's an INSERT, UPDATE or DELETE on
+// its own or a transaction, MUST go through the same ExclusiveWriter.
+// Writes that bypass it or use a different writer for the same file will
+// contend for the lock and can fail with "database is locked". Use
+// ExclusiveWriterForDatabase to get the writer for a database, so that
+// components which are configured to share a database file also share a
+// writer. Reads don't need to use the writer.
 type ExclusiveWriter struct {
 	running atomic.Bool
 	todo    chan transactionWriterTask
@@ -22,6 +35,24 @@ func NewExclusiveWriter() Writer {
 	}
 }
 
+var exclusiveWriters sync.Map // SQLite file path -> *ExclusiveWriter
+
+// ExclusiveWriterForDatabase returns the ExclusiveWriter for the given
+// SQLite database, creating it if this is the first time that the file
+// has been opened. In-memory databases aren't shared between connections
+// so always get a new writer.
+func ExclusiveWriterForDatabase(dbProperties *config.DatabaseOptions) Writer {
+	path, err := ParseFileURI(dbProperties.ConnectionString)
+	if err != nil || path == "" || strings.Contains(path, ":memory:") || strings.Contains(path, "mode=memory") {
+		return NewExclusiveWriter()
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	writer, _ := exclusiveWriters.LoadOrStore(path, NewExclusiveWriter())
+	return writer.(Writer)
+}
+
 // transactionWriterTask represents a specific task.
 type transactionWriterTask struct {
 	db   *sql.DB
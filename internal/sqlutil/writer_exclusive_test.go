@@ -0,0 +1,81 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestExclusiveWriterConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlutil")
+	assertNoError(t, err, "Failed to make temp dir")
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	// Open the same database twice, as two components configured with the
+	// same database file would, and give up on locks straight away so that
+	// any contention shows up as an error.
+	opts := &config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "test.db")),
+		SQLite:           config.SQLiteOptions{BusyTimeoutMilliseconds: 1},
+	}
+	var dbs []*sql.DB
+	var writers []Writer
+	for i := 0; i < 2; i++ {
+		db, err := Open(opts)
+		assertNoError(t, err, "Failed to open DB")
+		defer db.Close() // nolint:errcheck
+		dbs = append(dbs, db)
+		writers = append(writers, ExclusiveWriterForDatabase(opts))
+	}
+	if writers[0] != writers[1] {
+		t.Fatalf("got different writers for the same database")
+	}
+	_, err = dbs[0].Exec("CREATE TABLE counter (n INTEGER NOT NULL)")
+	assertNoError(t, err, "Failed to create table")
+	_, err = dbs[0].Exec("INSERT INTO counter (n) VALUES (0)")
+	assertNoError(t, err, "Failed to insert row")
+
+	// Each write reads the counter and then increments it in a transaction,
+	// which SQLite can't do concurrently.
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(db *sql.DB, writer Writer) {
+			defer wg.Done()
+			errs <- writer.Do(db, nil, func(txn *sql.Tx) error {
+				var n int
+				if err := txn.QueryRowContext(ctx, "SELECT n FROM counter").Scan(&n); err != nil {
+					return err
+				}
+				_, err := txn.ExecContext(ctx, "UPDATE counter SET n = $1", n+1)
+				return err
+			})
+		}(dbs[i%2], writers[i%2])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent write failed: %s", err)
+		}
+	}
+	var n int
+	assertNoError(t, dbs[1].QueryRow("SELECT n FROM counter").Scan(&n), "Failed to select counter")
+	if n != 100 {
+		t.Errorf("got counter %d, want 100", n)
+	}
+
+	// In-memory databases aren't shared, so they don't share a writer either.
+	memory := &config.DatabaseOptions{ConnectionString: "file::memory:"}
+	if ExclusiveWriterForDatabase(memory) == ExclusiveWriterForDatabase(memory) {
+		t.Errorf("got the same writer for two in-memory databases")
+	}
+}
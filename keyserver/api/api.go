@@ -36,11 +36,20 @@ type KeyInternalAPI interface {
 	QueryKeyChanges(ctx context.Context, req *QueryKeyChangesRequest, res *QueryKeyChangesResponse)
 	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse)
 	QueryDeviceMessages(ctx context.Context, req *QueryDeviceMessagesRequest, res *QueryDeviceMessagesResponse)
+	// PerformUploadDeviceSigningKeys stores the cross-signing keys of a local user
+	PerformUploadDeviceSigningKeys(ctx context.Context, req *PerformUploadDeviceSigningKeysRequest, res *PerformUploadDeviceSigningKeysResponse)
 }
 
 // KeyError is returned if there was a problem performing/querying the server
 type KeyError struct {
 	Err string
+	// IsInvalidParam is set if the request contained invalid keys
+	IsInvalidParam bool
+	// IsInvalidSignature is set if a key wasn't signed correctly
+	IsInvalidSignature bool
+	// IsMissingAuth is set if the request needs to be authenticated with
+	// user-interactive auth before it can be performed
+	IsMissingAuth bool
 }
 
 func (k *KeyError) Error() string {
@@ -75,6 +84,28 @@ func (k *DeviceKeys) WithStreamID(streamID int) DeviceMessage {
 	}
 }
 
+// CrossSigningKeyPurpose is the usage of a cross-signing key
+type CrossSigningKeyPurpose string
+
+// The cross-signing key purposes from
+// https://github.com/matrix-org/matrix-doc/blob/master/proposals/1756-cross-signing.md
+const (
+	CrossSigningKeyPurposeMaster      CrossSigningKeyPurpose = "master"
+	CrossSigningKeyPurposeSelfSigning CrossSigningKeyPurpose = "self_signing"
+	CrossSigningKeyPurposeUserSigning CrossSigningKeyPurpose = "user_signing"
+)
+
+// CrossSigningKeyMap maps a key purpose to the raw key JSON
+type CrossSigningKeyMap map[CrossSigningKeyPurpose]json.RawMessage
+
+// CrossSigningKey is a cross-signing key as uploaded by the client
+type CrossSigningKey struct {
+	UserID     string                                                               `json:"user_id"`
+	Usage      []CrossSigningKeyPurpose                                             `json:"usage"`
+	Keys       map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes            `json:"keys"`
+	Signatures map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"signatures,omitempty"`
+}
+
 // OneTimeKeys represents a set of one-time keys for a single device
 // https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-upload
 type OneTimeKeys struct {
@@ -134,6 +165,25 @@ func (r *PerformUploadKeysResponse) KeyError(userID, deviceID string, err *KeyEr
 	r.KeyErrors[userID][deviceID] = err
 }
 
+// PerformUploadDeviceSigningKeysRequest is the request to PerformUploadDeviceSigningKeys.
+// Any of the keys may be omitted, in which case the existing key is kept.
+type PerformUploadDeviceSigningKeysRequest struct {
+	// The local user whose keys are being uploaded
+	UserID         string
+	MasterKey      json.RawMessage
+	SelfSigningKey json.RawMessage
+	UserSigningKey json.RawMessage
+	// Authenticated should be true if the user has completed user-interactive
+	// auth. Without it, existing keys can only be replaced by keys which are
+	// signed by the existing master key.
+	Authenticated bool
+}
+
+// PerformUploadDeviceSigningKeysResponse is the response to PerformUploadDeviceSigningKeys
+type PerformUploadDeviceSigningKeysResponse struct {
+	Error *KeyError
+}
+
 type PerformClaimKeysRequest struct {
 	// Map of user_id to device_id to algorithm name
 	OneTimeKeys map[string]map[string]string
@@ -150,6 +200,9 @@ type PerformClaimKeysResponse struct {
 }
 
 type QueryKeysRequest struct {
+	// The user ID asking for the keys, e.g. for determining whether to
+	// include user-signing keys, which are only visible to their owner
+	UserID string
 	// Maps user IDs to a list of devices
 	UserToDevices map[string][]string
 	Timeout       time.Duration
@@ -160,6 +213,10 @@ type QueryKeysResponse struct {
 	Failures map[string]interface{}
 	// Map of user_id to device_id to device_key
 	DeviceKeys map[string]map[string]json.RawMessage
+	// Maps of user_id to cross-signing key
+	MasterKeys      map[string]json.RawMessage
+	SelfSigningKeys map[string]json.RawMessage
+	UserSigningKeys map[string]json.RawMessage
 	// Set if there was a fatal error processing this query
 	Error *KeyError
 }
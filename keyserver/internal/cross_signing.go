@@ -0,0 +1,214 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// crossSigningKey is a parsed and sanity-checked cross-signing key
+type crossSigningKey struct {
+	api.CrossSigningKey
+	raw       json.RawMessage
+	keyID     gomatrixserverlib.KeyID
+	publicKey ed25519.PublicKey
+}
+
+// parseCrossSigningKey parses a cross-signing key and checks that it belongs
+// to the given user, has the right purpose and contains exactly one ed25519
+// public key.
+func parseCrossSigningKey(userID string, purpose api.CrossSigningKeyPurpose, raw json.RawMessage) (*crossSigningKey, error) {
+	key := &crossSigningKey{raw: raw}
+	if err := json.Unmarshal(raw, &key.CrossSigningKey); err != nil {
+		return nil, fmt.Errorf("%s key is invalid: %w", purpose, err)
+	}
+	if key.UserID != userID {
+		return nil, fmt.Errorf("%s key belongs to %q, not %q", purpose, key.UserID, userID)
+	}
+	hasPurpose := false
+	for _, usage := range key.Usage {
+		hasPurpose = hasPurpose || usage == purpose
+	}
+	if !hasPurpose {
+		return nil, fmt.Errorf("%s key is missing the %q usage", purpose, purpose)
+	}
+	if len(key.Keys) != 1 {
+		return nil, fmt.Errorf("%s key must contain exactly one public key", purpose)
+	}
+	for keyID, publicKey := range key.Keys {
+		if !strings.HasPrefix(string(keyID), "ed25519:") || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s key must be an ed25519 key", purpose)
+		}
+		key.keyID, key.publicKey = keyID, ed25519.PublicKey(publicKey)
+	}
+	return key, nil
+}
+
+// isSignedBy returns true if the key has a valid signature from the signer.
+func (k *crossSigningKey) isSignedBy(signer *crossSigningKey) bool {
+	if signer == nil {
+		return false
+	}
+	if _, ok := k.Signatures[signer.UserID][signer.keyID]; !ok {
+		return false
+	}
+	return gomatrixserverlib.VerifyJSON(signer.UserID, signer.keyID, signer.publicKey, k.raw) == nil
+}
+
+// isSameKey returns true if the other key has the same ID and public key. The
+// key ID is chosen by the client, so it isn't enough to compare that alone.
+func (k *crossSigningKey) isSameKey(other *crossSigningKey) bool {
+	return k.keyID == other.keyID && bytes.Equal(k.publicKey, other.publicKey)
+}
+
+func (a *KeyInternalAPI) PerformUploadDeviceSigningKeys(ctx context.Context, req *api.PerformUploadDeviceSigningKeysRequest, res *api.PerformUploadDeviceSigningKeysResponse) {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil || domain != a.ThisServer {
+		res.Error = &api.KeyError{
+			Err:            fmt.Sprintf("cannot upload cross-signing keys for %q", req.UserID),
+			IsInvalidParam: true,
+		}
+		return
+	}
+
+	// Parse and sanity-check the keys that were uploaded.
+	uploaded := map[api.CrossSigningKeyPurpose]*crossSigningKey{}
+	for purpose, raw := range map[api.CrossSigningKeyPurpose]json.RawMessage{
+		api.CrossSigningKeyPurposeMaster:      req.MasterKey,
+		api.CrossSigningKeyPurposeSelfSigning: req.SelfSigningKey,
+		api.CrossSigningKeyPurposeUserSigning: req.UserSigningKey,
+	} {
+		if len(raw) == 0 {
+			continue
+		}
+		key, perr := parseCrossSigningKey(req.UserID, purpose, raw)
+		if perr != nil {
+			res.Error = &api.KeyError{
+				Err:            perr.Error(),
+				IsInvalidParam: true,
+			}
+			return
+		}
+		uploaded[purpose] = key
+	}
+	if len(uploaded) == 0 {
+		res.Error = &api.KeyError{
+			Err:            "no cross-signing keys were uploaded",
+			IsInvalidParam: true,
+		}
+		return
+	}
+
+	// Work out what the existing keys are, if any.
+	existingKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query existing cross-signing keys: %s", err),
+		}
+		return
+	}
+	existing := map[api.CrossSigningKeyPurpose]*crossSigningKey{}
+	for purpose, raw := range existingKeys {
+		if key, perr := parseCrossSigningKey(req.UserID, purpose, raw); perr == nil {
+			existing[purpose] = key
+		}
+	}
+
+	// The self-signing and user-signing keys must be signed by the master key,
+	// which is either the one being uploaded or the one we already have.
+	masterKey := uploaded[api.CrossSigningKeyPurposeMaster]
+	if masterKey == nil {
+		masterKey = existing[api.CrossSigningKeyPurposeMaster]
+	}
+	if masterKey == nil {
+		res.Error = &api.KeyError{
+			Err:            "a master key must be uploaded first",
+			IsInvalidParam: true,
+		}
+		return
+	}
+	for _, purpose := range []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeSelfSigning, api.CrossSigningKeyPurposeUserSigning} {
+		if key, ok := uploaded[purpose]; ok && !key.isSignedBy(masterKey) {
+			res.Error = &api.KeyError{
+				Err:                fmt.Sprintf("%s key is not signed by the master key", purpose),
+				IsInvalidSignature: true,
+			}
+			return
+		}
+	}
+
+	// Without user-interactive auth, someone who has only got hold of an access
+	// token could replace the keys with their own. The only changes we'll accept
+	// in that case are those vouched for by the existing master key.
+	if !req.Authenticated {
+		existingMasterKey := existing[api.CrossSigningKeyPurposeMaster]
+		for purpose, key := range uploaded {
+			if current, ok := existing[purpose]; ok && current.isSameKey(key) {
+				continue // the key isn't changing
+			}
+			if key.isSignedBy(existingMasterKey) {
+				continue
+			}
+			res.Error = &api.KeyError{
+				Err:           "user-interactive auth is required to replace cross-signing keys",
+				IsMissingAuth: true,
+			}
+			return
+		}
+	}
+
+	keyMap := api.CrossSigningKeyMap{}
+	for purpose, key := range uploaded {
+		keyMap[purpose] = key.raw
+	}
+	if err = a.DB.StoreCrossSigningKeysForUser(ctx, req.UserID, keyMap); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to store cross-signing keys: %s", err),
+		}
+		return
+	}
+}
+
+// crossSigningKeysFromDatabase adds the cross-signing keys of a local user
+// to the response. User-signing keys are only visible to their owner.
+func (a *KeyInternalAPI) crossSigningKeysFromDatabase(
+	ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse, userID string,
+) error {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for purpose, key := range keys {
+		switch purpose {
+		case api.CrossSigningKeyPurposeMaster:
+			res.MasterKeys[userID] = key
+		case api.CrossSigningKeyPurposeSelfSigning:
+			res.SelfSigningKeys[userID] = key
+		case api.CrossSigningKeyPurposeUserSigning:
+			if userID == req.UserID {
+				res.UserSigningKeys[userID] = key
+			}
+		}
+	}
+	return nil
+}
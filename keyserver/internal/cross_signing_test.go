@@ -0,0 +1,215 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const crossSigningUserID = "@alice:localhost"
+
+type crossSigningUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *crossSigningUserAPI) QueryDeviceInfos(ctx context.Context, req *userapi.QueryDeviceInfosRequest, res *userapi.QueryDeviceInfosResponse) error {
+	return nil
+}
+
+type testCrossSigningKey struct {
+	t          *testing.T
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func newTestCrossSigningKey(t *testing.T) *testCrossSigningKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	return &testCrossSigningKey{t, publicKey, privateKey}
+}
+
+func (k *testCrossSigningKey) keyID() gomatrixserverlib.KeyID {
+	return gomatrixserverlib.KeyID("ed25519:" + gomatrixserverlib.Base64Bytes(k.publicKey).Encode())
+}
+
+// json returns the key JSON for the given purpose, signed by each of the signers.
+func (k *testCrossSigningKey) json(purpose api.CrossSigningKeyPurpose, signers ...*testCrossSigningKey) json.RawMessage {
+	raw, err := json.Marshal(api.CrossSigningKey{
+		UserID: crossSigningUserID,
+		Usage:  []api.CrossSigningKeyPurpose{purpose},
+		Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+			k.keyID(): gomatrixserverlib.Base64Bytes(k.publicKey),
+		},
+	})
+	if err != nil {
+		k.t.Fatalf("failed to marshal key: %s", err)
+	}
+	for _, signer := range signers {
+		if raw, err = gomatrixserverlib.SignJSON(crossSigningUserID, signer.keyID(), signer.privateKey, raw); err != nil {
+			k.t.Fatalf("failed to sign key: %s", err)
+		}
+	}
+	return raw
+}
+
+func mustCreateCrossSigningAPI(t *testing.T) *KeyInternalAPI {
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	})
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	return &KeyInternalAPI{
+		DB:         db,
+		ThisServer: "localhost",
+		UserAPI:    &crossSigningUserAPI{},
+	}
+}
+
+func mustQueryCrossSigningKeys(t *testing.T, a *KeyInternalAPI, requestingUserID string) *api.QueryKeysResponse {
+	res := &api.QueryKeysResponse{}
+	a.QueryKeys(ctx, &api.QueryKeysRequest{
+		UserID:        requestingUserID,
+		UserToDevices: map[string][]string{crossSigningUserID: {}},
+	}, res)
+	if res.Error != nil {
+		t.Fatalf("QueryKeys failed: %s", res.Error)
+	}
+	return res
+}
+
+func TestUploadCrossSigningKeys(t *testing.T) {
+	a := mustCreateCrossSigningAPI(t)
+	master := newTestCrossSigningKey(t)
+	selfSigning := newTestCrossSigningKey(t)
+	userSigning := newTestCrossSigningKey(t)
+	initialUpload := &api.PerformUploadDeviceSigningKeysRequest{
+		UserID:         crossSigningUserID,
+		MasterKey:      master.json(api.CrossSigningKeyPurposeMaster),
+		SelfSigningKey: selfSigning.json(api.CrossSigningKeyPurposeSelfSigning, master),
+		UserSigningKey: userSigning.json(api.CrossSigningKeyPurposeUserSigning, master),
+	}
+
+	// the initial upload needs user-interactive auth
+	res := &api.PerformUploadDeviceSigningKeysResponse{}
+	a.PerformUploadDeviceSigningKeys(ctx, initialUpload, res)
+	if res.Error == nil || !res.Error.IsMissingAuth {
+		t.Fatalf("expected initial upload without auth to need auth, got %+v", res.Error)
+	}
+
+	initialUpload.Authenticated = true
+	res = &api.PerformUploadDeviceSigningKeysResponse{}
+	a.PerformUploadDeviceSigningKeys(ctx, initialUpload, res)
+	if res.Error != nil {
+		t.Fatalf("expected initial upload with auth to succeed, got %s", res.Error)
+	}
+
+	// the keys should now be visible in /keys/query, but the user-signing key
+	// is only visible to its owner
+	queryRes := mustQueryCrossSigningKeys(t, a, crossSigningUserID)
+	if !bytes.Equal(queryRes.MasterKeys[crossSigningUserID], initialUpload.MasterKey) {
+		t.Errorf("expected master key %s, got %s", initialUpload.MasterKey, queryRes.MasterKeys[crossSigningUserID])
+	}
+	if !bytes.Equal(queryRes.SelfSigningKeys[crossSigningUserID], initialUpload.SelfSigningKey) {
+		t.Errorf("expected self-signing key %s, got %s", initialUpload.SelfSigningKey, queryRes.SelfSigningKeys[crossSigningUserID])
+	}
+	if !bytes.Equal(queryRes.UserSigningKeys[crossSigningUserID], initialUpload.UserSigningKey) {
+		t.Errorf("expected user-signing key %s, got %s", initialUpload.UserSigningKey, queryRes.UserSigningKeys[crossSigningUserID])
+	}
+	queryRes = mustQueryCrossSigningKeys(t, a, "@bob:localhost")
+	if _, ok := queryRes.MasterKeys[crossSigningUserID]; !ok {
+		t.Errorf("expected master key to be visible to other users")
+	}
+	if _, ok := queryRes.UserSigningKeys[crossSigningUserID]; ok {
+		t.Errorf("expected user-signing key to be hidden from other users")
+	}
+
+	// replacing the master key without auth must be rejected, otherwise anyone
+	// with an access token could hijack the user's identity
+	hijacker := newTestCrossSigningKey(t)
+	res = &api.PerformUploadDeviceSigningKeysResponse{}
+	a.PerformUploadDeviceSigningKeys(ctx, &api.PerformUploadDeviceSigningKeysRequest{
+		UserID:         crossSigningUserID,
+		MasterKey:      hijacker.json(api.CrossSigningKeyPurposeMaster),
+		SelfSigningKey: hijacker.json(api.CrossSigningKeyPurposeSelfSigning, hijacker),
+	}, res)
+	if res.Error == nil || !res.Error.IsMissingAuth {
+		t.Fatalf("expected replacement without auth to need auth, got %+v", res.Error)
+	}
+	queryRes = mustQueryCrossSigningKeys(t, a, crossSigningUserID)
+	if !bytes.Equal(queryRes.MasterKeys[crossSigningUserID], initialUpload.MasterKey) {
+		t.Errorf("expected master key to be unchanged after rejected replacement")
+	}
+
+	// nor can it be replaced by reusing the key ID of the existing master key
+	sameKeyID, err := json.Marshal(api.CrossSigningKey{
+		UserID: crossSigningUserID,
+		Usage:  []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeMaster},
+		Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+			master.keyID(): gomatrixserverlib.Base64Bytes(hijacker.publicKey),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	res = &api.PerformUploadDeviceSigningKeysResponse{}
+	a.PerformUploadDeviceSigningKeys(ctx, &api.PerformUploadDeviceSigningKeysRequest{
+		UserID:    crossSigningUserID,
+		MasterKey: sameKeyID,
+	}, res)
+	if res.Error == nil || !res.Error.IsMissingAuth {
+		t.Fatalf("expected replacement with the same key ID without auth to need auth, got %+v", res.Error)
+	}
+	queryRes = mustQueryCrossSigningKeys(t, a, crossSigningUserID)
+	if !bytes.Equal(queryRes.MasterKeys[crossSigningUserID], initialUpload.MasterKey) {
+		t.Errorf("expected master key to be unchanged after rejected replacement with the same key ID")
+	}
+
+	// keys which aren't signed by the master key are never accepted
+	res = &api.PerformUploadDeviceSigningKeysResponse{}
+	a.PerformUploadDeviceSigningKeys(ctx, &api.PerformUploadDeviceSigningKeysRequest{
+		UserID:         crossSigningUserID,
+		SelfSigningKey: hijacker.json(api.CrossSigningKeyPurposeSelfSigning, hijacker),
+		Authenticated:  true,
+	}, res)
+	if res.Error == nil || !res.Error.IsInvalidSignature {
+		t.Fatalf("expected self-signing key not signed by the master key to be rejected, got %+v", res.Error)
+	}
+
+	// but a new self-signing key vouched for by the existing master key
+	// doesn't need auth
+	newSelfSigning := newTestCrossSigningKey(t)
+	res = &api.PerformUploadDeviceSigningKeysResponse{}
+	a.PerformUploadDeviceSigningKeys(ctx, &api.PerformUploadDeviceSigningKeysRequest{
+		UserID:         crossSigningUserID,
+		SelfSigningKey: newSelfSigning.json(api.CrossSigningKeyPurposeSelfSigning, master),
+	}, res)
+	if res.Error != nil {
+		t.Fatalf("expected self-signing key signed by the existing master key to be accepted, got %s", res.Error)
+	}
+}
@@ -17,8 +17,11 @@ package internal
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,6 +37,11 @@ import (
 	"github.com/tidwall/sjson"
 )
 
+const (
+	oneTimeKeyAlgorithmCurve25519       = "curve25519"
+	oneTimeKeyAlgorithmSignedCurve25519 = "signed_curve25519"
+)
+
 type KeyInternalAPI struct {
 	DB         storage.Database
 	ThisServer gomatrixserverlib.ServerName
@@ -41,6 +49,9 @@ type KeyInternalAPI struct {
 	UserAPI    userapi.UserInternalAPI
 	Producer   *producers.KeyChange
 	Updater    *DeviceListUpdater
+	// The maximum number of one-time keys that a device can have stored at
+	// once, or zero for no limit.
+	MaxOneTimeKeysPerDevice int
 }
 
 func (a *KeyInternalAPI) SetUserAPI(i userapi.UserInternalAPI) {
@@ -221,6 +232,9 @@ func (a *KeyInternalAPI) QueryDeviceMessages(ctx context.Context, req *api.Query
 
 func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse) {
 	res.DeviceKeys = make(map[string]map[string]json.RawMessage)
+	res.MasterKeys = make(map[string]json.RawMessage)
+	res.SelfSigningKeys = make(map[string]json.RawMessage)
+	res.UserSigningKeys = make(map[string]json.RawMessage)
 	res.Failures = make(map[string]interface{})
 	// make a map from domain to device keys
 	domainToDeviceKeys := make(map[string]map[string][]string)
@@ -260,18 +274,28 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 				if len(dk.KeyJSON) == 0 {
 					continue // don't include blank keys
 				}
-				// inject display name if known (either locally or remotely)
+				// inject display name if known (either locally or remotely). Device IDs
+				// aren't unique across users, so ignore devices belonging to someone else.
 				displayName := dk.DisplayName
-				if queryRes.DeviceInfo[dk.DeviceID].DisplayName != "" {
-					displayName = queryRes.DeviceInfo[dk.DeviceID].DisplayName
+				if info, ok := queryRes.DeviceInfo[dk.DeviceID]; ok && info.UserID == userID && info.DisplayName != "" {
+					displayName = info.DisplayName
 				}
 				dk.KeyJSON, _ = sjson.SetBytes(dk.KeyJSON, "unsigned", struct {
 					DisplayName string `json:"device_display_name,omitempty"`
 				}{displayName})
 				res.DeviceKeys[userID][dk.DeviceID] = dk.KeyJSON
 			}
+
+			if err = a.crossSigningKeysFromDatabase(ctx, req, res, userID); err != nil {
+				res.Error = &api.KeyError{
+					Err: fmt.Sprintf("failed to query local cross-signing keys: %s", err),
+				}
+				return
+			}
 		} else {
-			domainToDeviceKeys[domain] = make(map[string][]string)
+			if _, ok := domainToDeviceKeys[domain]; !ok {
+				domainToDeviceKeys[domain] = make(map[string][]string)
+			}
 			domainToDeviceKeys[domain][userID] = append(domainToDeviceKeys[domain][userID], deviceIDs...)
 		}
 	}
@@ -335,7 +359,9 @@ func (a *KeyInternalAPI) queryRemoteKeys(
 
 	for result := range resultCh {
 		for userID, nest := range result.DeviceKeys {
-			res.DeviceKeys[userID] = make(map[string]json.RawMessage)
+			if res.DeviceKeys[userID] == nil {
+				res.DeviceKeys[userID] = make(map[string]json.RawMessage)
+			}
 			for deviceID, deviceKey := range nest {
 				keyJSON, err := json.Marshal(deviceKey)
 				if err != nil {
@@ -398,6 +424,7 @@ func (a *KeyInternalAPI) queryRemoteKeysOnServer(
 	}
 	queryKeysResp, err := a.FedClient.QueryKeys(fedCtx, gomatrixserverlib.ServerName(serverName), devKeys)
 	if err == nil {
+		filterRemoteDeviceKeys(&queryKeysResp, devKeys)
 		resultCh <- &queryKeysResp
 		return
 	}
@@ -417,6 +444,31 @@ func (a *KeyInternalAPI) queryRemoteKeysOnServer(
 
 }
 
+// filterRemoteDeviceKeys removes any users and devices from the response that
+// weren't asked for, so that a remote server can't add keys for devices that
+// weren't requested. An empty device list means that all devices were requested.
+func filterRemoteDeviceKeys(resp *gomatrixserverlib.RespQueryKeys, devKeys map[string][]string) {
+	for userID, devices := range resp.DeviceKeys {
+		deviceIDs, ok := devKeys[userID]
+		if !ok {
+			delete(resp.DeviceKeys, userID)
+			continue
+		}
+		if len(deviceIDs) == 0 {
+			continue
+		}
+		wanted := make(map[string]bool, len(deviceIDs))
+		for _, deviceID := range deviceIDs {
+			wanted[deviceID] = true
+		}
+		for deviceID := range devices {
+			if !wanted[deviceID] {
+				delete(devices, deviceID)
+			}
+		}
+	}
+}
+
 func (a *KeyInternalAPI) populateResponseWithDeviceKeysFromDatabase(
 	ctx context.Context, res *api.QueryKeysResponse, userID string, deviceIDs []string,
 ) error {
@@ -425,7 +477,7 @@ func (a *KeyInternalAPI) populateResponseWithDeviceKeysFromDatabase(
 	if err != nil {
 		return fmt.Errorf("DeviceKeysForUser %s %v failed: %w", userID, deviceIDs, err)
 	}
-	if len(keys) < len(deviceIDs) {
+	if len(keys) < countUnique(deviceIDs) {
 		return fmt.Errorf("DeviceKeysForUser %s returned fewer devices than requested, falling back to remote", userID)
 	}
 	if len(deviceIDs) == 0 && len(keys) == 0 {
@@ -448,6 +500,16 @@ func (a *KeyInternalAPI) populateResponseWithDeviceKeysFromDatabase(
 	return nil
 }
 
+// countUnique returns the number of distinct strings in the slice, since the
+// database only returns each device once however many times it was requested.
+func countUnique(strs []string) int {
+	seen := make(map[string]bool, len(strs))
+	for _, s := range strs {
+		seen[s] = true
+	}
+	return len(seen)
+}
+
 func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
 	var keysToStore []api.DeviceMessage
 	// assert that the user ID / device ID are not lying for each key
@@ -465,17 +527,22 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 		}
 		gotUserID := gjson.GetBytes(key.KeyJSON, "user_id").Str
 		gotDeviceID := gjson.GetBytes(key.KeyJSON, "device_id").Str
-		if gotUserID == key.UserID && gotDeviceID == key.DeviceID {
-			keysToStore = append(keysToStore, key.WithStreamID(0))
+		if gotUserID != key.UserID || gotDeviceID != key.DeviceID {
+			res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+				Err: fmt.Sprintf(
+					"user_id or device_id mismatch: users: %s - %s, devices: %s - %s",
+					gotUserID, key.UserID, gotDeviceID, key.DeviceID,
+				),
+			})
 			continue
 		}
-
-		res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
-			Err: fmt.Sprintf(
-				"user_id or device_id mismatch: users: %s - %s, devices: %s - %s",
-				gotUserID, key.UserID, gotDeviceID, key.DeviceID,
-			),
-		})
+		if err = verifyDeviceKeySelfSignature(key); err != nil {
+			res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+				Err: err.Error(),
+			})
+			continue
+		}
+		keysToStore = append(keysToStore, key.WithStreamID(0))
 	}
 
 	// get existing device keys so we can check for changes
@@ -512,8 +579,49 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 	}
 }
 
+// verifyDeviceKeySelfSignature checks that the device keys are signed by the
+// device's own ed25519 key, so that nobody can upload keys for a device which
+// they don't hold the private key of.
+func verifyDeviceKeySelfSignature(key api.DeviceKeys) error {
+	keyID, publicKey, err := deviceSigningKey(key)
+	if err != nil {
+		return err
+	}
+	if err = gomatrixserverlib.VerifyJSON(key.UserID, keyID, publicKey, key.KeyJSON); err != nil {
+		return fmt.Errorf("device keys have an invalid signature: %w", err)
+	}
+	return nil
+}
+
+// deviceSigningKey returns the ed25519 key of the device from its device keys.
+func deviceSigningKey(key api.DeviceKeys) (gomatrixserverlib.KeyID, ed25519.PublicKey, error) {
+	var deviceKeys struct {
+		Keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"keys"`
+	}
+	if err := json.Unmarshal(key.KeyJSON, &deviceKeys); err != nil {
+		return "", nil, fmt.Errorf("device keys are invalid: %w", err)
+	}
+	keyID := gomatrixserverlib.KeyID("ed25519:" + key.DeviceID)
+	publicKey, ok := deviceKeys.Keys[keyID]
+	if !ok {
+		return "", nil, fmt.Errorf("device keys are missing the %s key", keyID)
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return "", nil, fmt.Errorf("device key %s is not a valid ed25519 key", keyID)
+	}
+	return keyID, ed25519.PublicKey(publicKey), nil
+}
+
 func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
 	for _, key := range req.OneTimeKeys {
+		// drop any keys which are malformed or badly signed, storing the rest
+		validKeys, err := a.validOneTimeKeys(ctx, key)
+		if err != nil {
+			res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+				Err: err.Error(),
+			})
+		}
+		key.KeyJSON = validKeys
 		// grab existing keys based on (user/device/algorithm/key ID)
 		keyIDsWithAlgorithms := make([]string, len(key.KeyJSON))
 		i := 0
@@ -534,6 +642,15 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 				res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
 					Err: fmt.Sprintf("%s device %s: algorithm / key ID %s one-time key already exists", key.UserID, key.DeviceID, keyIDWithAlgo),
 				})
+				delete(key.KeyJSON, keyIDWithAlgo)
+			}
+		}
+		// reject the whole upload if the new keys would take the device over the limit
+		if a.MaxOneTimeKeysPerDevice > 0 {
+			if err = a.checkOneTimeKeysLimit(ctx, key, existingKeys); err != nil {
+				res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+					Err: err.Error(),
+				})
 				continue
 			}
 		}
@@ -551,6 +668,102 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 
 }
 
+// checkOneTimeKeysLimit returns an error if storing the one-time keys would
+// leave the device with more than the maximum number of one-time keys. Keys
+// which are already stored don't count towards the limit again.
+func (a *KeyInternalAPI) checkOneTimeKeysLimit(ctx context.Context, key api.OneTimeKeys, existingKeys map[string]json.RawMessage) error {
+	counts, err := a.DB.OneTimeKeysCount(ctx, key.UserID, key.DeviceID)
+	if err != nil {
+		return fmt.Errorf("%s device %s: failed to count one-time keys: %w", key.UserID, key.DeviceID, err)
+	}
+	total := 0
+	for _, count := range counts.KeyCount {
+		total += count
+	}
+	for keyIDWithAlgo := range key.KeyJSON {
+		if _, ok := existingKeys[keyIDWithAlgo]; !ok {
+			total++
+		}
+	}
+	if total > a.MaxOneTimeKeysPerDevice {
+		return fmt.Errorf(
+			"%s device %s: uploading these one-time keys would exceed the limit of %d one-time keys per device",
+			key.UserID, key.DeviceID, a.MaxOneTimeKeysPerDevice,
+		)
+	}
+	return nil
+}
+
+// validOneTimeKeys returns the one-time keys which are well-formed. Unsigned
+// curve25519 keys must be a base64 string and signed_curve25519 keys must be
+// signed by the device's ed25519 key. Keys of other algorithms are kept as
+// they are. If any keys were dropped then an error describing them is also
+// returned.
+func (a *KeyInternalAPI) validOneTimeKeys(ctx context.Context, key api.OneTimeKeys) (map[string]json.RawMessage, error) {
+	valid := make(map[string]json.RawMessage, len(key.KeyJSON))
+	var problems []string
+	var signingKeyID gomatrixserverlib.KeyID
+	var signingKey ed25519.PublicKey
+	var signingKeyErr error
+	loadedSigningKey := false
+	for keyIDWithAlgo, keyJSON := range key.KeyJSON {
+		segments := strings.SplitN(keyIDWithAlgo, ":", 2)
+		if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+			problems = append(problems, fmt.Sprintf("%s: key ID must be of the form algorithm:key_id", keyIDWithAlgo))
+			continue
+		}
+		switch segments[0] {
+		case oneTimeKeyAlgorithmCurve25519:
+			var encoded gomatrixserverlib.Base64Bytes
+			if err := json.Unmarshal(keyJSON, &encoded); err != nil || len(encoded) == 0 {
+				problems = append(problems, fmt.Sprintf("%s: key must be a base64 string", keyIDWithAlgo))
+				continue
+			}
+		case oneTimeKeyAlgorithmSignedCurve25519:
+			var signed struct {
+				Key gomatrixserverlib.Base64Bytes `json:"key"`
+			}
+			if err := json.Unmarshal(keyJSON, &signed); err != nil || len(signed.Key) == 0 {
+				problems = append(problems, fmt.Sprintf("%s: signed key must contain a base64 key", keyIDWithAlgo))
+				continue
+			}
+			if !loadedSigningKey {
+				signingKeyID, signingKey, signingKeyErr = a.storedDeviceSigningKey(ctx, key.UserID, key.DeviceID)
+				loadedSigningKey = true
+			}
+			if signingKeyErr != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", keyIDWithAlgo, signingKeyErr))
+				continue
+			}
+			if err := gomatrixserverlib.VerifyJSON(key.UserID, signingKeyID, signingKey, keyJSON); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid signature: %s", keyIDWithAlgo, err))
+				continue
+			}
+		}
+		valid[keyIDWithAlgo] = keyJSON
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return valid, fmt.Errorf("%s device %s: rejected one-time keys: %s", key.UserID, key.DeviceID, strings.Join(problems, "; "))
+	}
+	return valid, nil
+}
+
+// storedDeviceSigningKey returns the ed25519 key of the device from the
+// device keys we have stored for it.
+func (a *KeyInternalAPI) storedDeviceSigningKey(ctx context.Context, userID, deviceID string) (gomatrixserverlib.KeyID, ed25519.PublicKey, error) {
+	deviceKeys := []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{UserID: userID, DeviceID: deviceID}},
+	}
+	if err := a.DB.DeviceKeysJSON(ctx, deviceKeys); err != nil {
+		return "", nil, fmt.Errorf("failed to query device keys: %w", err)
+	}
+	if len(deviceKeys[0].KeyJSON) == 0 {
+		return "", nil, fmt.Errorf("no device keys have been uploaded to sign with")
+	}
+	return deviceSigningKey(deviceKeys[0].DeviceKeys)
+}
+
 func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.DeviceMessage) error {
 	// find keys in new that are not in existing
 	var keysAdded []api.DeviceMessage
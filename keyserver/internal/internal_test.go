@@ -0,0 +1,323 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	fedsenderapi "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// nopSyncProducer drops the messages that are sent to it.
+type nopSyncProducer struct {
+	sarama.SyncProducer
+}
+
+func (p *nopSyncProducer) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	return 0, 0, nil
+}
+
+// mustSignDeviceKeys returns the device keys JSON for the device's public key,
+// signed with the given private key.
+func mustSignDeviceKeys(t *testing.T, deviceID string, publicKey ed25519.PublicKey, signingKey ed25519.PrivateKey) json.RawMessage {
+	t.Helper()
+	keyID := gomatrixserverlib.KeyID("ed25519:" + deviceID)
+	raw, err := json.Marshal(map[string]interface{}{
+		"user_id":    crossSigningUserID,
+		"device_id":  deviceID,
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
+		"keys": map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+			keyID: gomatrixserverlib.Base64Bytes(publicKey),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal device keys: %s", err)
+	}
+	if raw, err = gomatrixserverlib.SignJSON(crossSigningUserID, keyID, signingKey, raw); err != nil {
+		t.Fatalf("failed to sign device keys: %s", err)
+	}
+	return raw
+}
+
+func TestUploadDeviceKeysChecksSelfSignature(t *testing.T) {
+	a := mustCreateCrossSigningAPI(t)
+	a.Producer = &producers.KeyChange{Producer: &nopSyncProducer{}, DB: a.DB}
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	_, otherPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	res := &api.PerformUploadKeysResponse{}
+	a.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{
+		DeviceKeys: []api.DeviceKeys{
+			{UserID: crossSigningUserID, DeviceID: "GOOD", KeyJSON: mustSignDeviceKeys(t, "GOOD", publicKey, privateKey)},
+			{UserID: crossSigningUserID, DeviceID: "FORGED", KeyJSON: mustSignDeviceKeys(t, "FORGED", publicKey, otherPrivateKey)},
+		},
+	}, res)
+	if res.Error != nil {
+		t.Fatalf("PerformUploadKeys failed: %s", res.Error)
+	}
+	if res.KeyErrors[crossSigningUserID]["GOOD"] != nil {
+		t.Errorf("validly signed keys were rejected: %s", res.KeyErrors[crossSigningUserID]["GOOD"])
+	}
+	if res.KeyErrors[crossSigningUserID]["FORGED"] == nil {
+		t.Errorf("forged keys were accepted")
+	}
+
+	stored := []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{UserID: crossSigningUserID, DeviceID: "GOOD"}},
+		{DeviceKeys: api.DeviceKeys{UserID: crossSigningUserID, DeviceID: "FORGED"}},
+	}
+	if err = a.DB.DeviceKeysJSON(ctx, stored); err != nil {
+		t.Fatalf("DeviceKeysJSON failed: %s", err)
+	}
+	if len(stored[0].KeyJSON) == 0 {
+		t.Errorf("validly signed keys weren't stored")
+	}
+	if len(stored[1].KeyJSON) != 0 {
+		t.Errorf("forged keys were stored: %s", stored[1].KeyJSON)
+	}
+}
+
+func TestUploadOneTimeKeysChecksSignatures(t *testing.T) {
+	a := mustCreateCrossSigningAPI(t)
+	a.Producer = &producers.KeyChange{Producer: &nopSyncProducer{}, DB: a.DB}
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	_, otherPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	signedKey := func(signingKey ed25519.PrivateKey) json.RawMessage {
+		raw, err := gomatrixserverlib.SignJSON(
+			crossSigningUserID, "ed25519:DEVICE", signingKey, []byte(`{"key":"zKbLg+NrIjpnagy+pIY6uPL4ZwEG2v+8F9lmgsnlZzs"}`),
+		)
+		if err != nil {
+			t.Fatalf("failed to sign one-time key: %s", err)
+		}
+		return raw
+	}
+
+	res := &api.PerformUploadKeysResponse{}
+	a.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{
+		DeviceKeys: []api.DeviceKeys{
+			{UserID: crossSigningUserID, DeviceID: "DEVICE", KeyJSON: mustSignDeviceKeys(t, "DEVICE", publicKey, privateKey)},
+		},
+		OneTimeKeys: []api.OneTimeKeys{
+			{
+				UserID:   crossSigningUserID,
+				DeviceID: "DEVICE",
+				KeyJSON: map[string]json.RawMessage{
+					"signed_curve25519:AAAAAQ": signedKey(privateKey),
+					"signed_curve25519:AAAAAg": signedKey(otherPrivateKey),
+					"curve25519:AAAAAw":        json.RawMessage(`"zKbLg+NrIjpnagy+pIY6uPL4ZwEG2v+8F9lmgsnlZzs"`),
+					"curve25519:AAAABA":        json.RawMessage(`{"key":"not a string"}`),
+					"no_key_id":                json.RawMessage(`"zKbLg+NrIjpnagy+pIY6uPL4ZwEG2v+8F9lmgsnlZzs"`),
+				},
+			},
+		},
+	}, res)
+	if res.Error != nil {
+		t.Fatalf("PerformUploadKeys failed: %s", res.Error)
+	}
+	if res.KeyErrors[crossSigningUserID]["DEVICE"] == nil {
+		t.Errorf("malformed and badly signed one-time keys were accepted")
+	}
+	if len(res.OneTimeKeyCounts) != 1 {
+		t.Fatalf("got %d one-time key counts, want 1", len(res.OneTimeKeyCounts))
+	}
+	counts := res.OneTimeKeyCounts[0].KeyCount
+	if len(counts) != 2 || counts["signed_curve25519"] != 1 || counts["curve25519"] != 1 {
+		t.Errorf("got one-time key counts %v, want one of each algorithm", counts)
+	}
+}
+
+func TestUploadOneTimeKeysLimit(t *testing.T) {
+	a := mustCreateCrossSigningAPI(t)
+	a.Producer = &producers.KeyChange{Producer: &nopSyncProducer{}, DB: a.DB}
+	a.MaxOneTimeKeysPerDevice = 3
+	curveKey := json.RawMessage(`"zKbLg+NrIjpnagy+pIY6uPL4ZwEG2v+8F9lmgsnlZzs"`)
+	upload := func(keyIDs ...string) *api.PerformUploadKeysResponse {
+		t.Helper()
+		keyJSON := make(map[string]json.RawMessage, len(keyIDs))
+		for _, keyID := range keyIDs {
+			keyJSON["curve25519:"+keyID] = curveKey
+		}
+		res := &api.PerformUploadKeysResponse{}
+		a.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{
+			OneTimeKeys: []api.OneTimeKeys{
+				{UserID: crossSigningUserID, DeviceID: "DEVICE", KeyJSON: keyJSON},
+			},
+		}, res)
+		if res.Error != nil {
+			t.Fatalf("PerformUploadKeys failed: %s", res.Error)
+		}
+		return res
+	}
+	assertCount := func(want int) {
+		t.Helper()
+		counts, err := a.DB.OneTimeKeysCount(ctx, crossSigningUserID, "DEVICE")
+		if err != nil {
+			t.Fatalf("OneTimeKeysCount failed: %s", err)
+		}
+		if got := counts.KeyCount["curve25519"]; got != want {
+			t.Errorf("got %d one-time keys stored, want %d", got, want)
+		}
+	}
+
+	if res := upload("AAAAAQ", "AAAAAg"); res.KeyErrors[crossSigningUserID]["DEVICE"] != nil {
+		t.Fatalf("upload under the limit was rejected: %s", res.KeyErrors[crossSigningUserID]["DEVICE"])
+	}
+	assertCount(2)
+
+	// Going over the limit rejects the whole upload, leaving the existing
+	// keys as they were.
+	if res := upload("AAAAAw", "AAAABA"); res.KeyErrors[crossSigningUserID]["DEVICE"] == nil {
+		t.Errorf("upload over the limit was accepted")
+	}
+	assertCount(2)
+	existing, err := a.DB.ExistingOneTimeKeys(ctx, crossSigningUserID, "DEVICE", []string{"curve25519:AAAAAQ", "curve25519:AAAAAg"})
+	if err != nil {
+		t.Fatalf("ExistingOneTimeKeys failed: %s", err)
+	}
+	if len(existing) != 2 {
+		t.Errorf("got %d of the existing one-time keys, want 2", len(existing))
+	}
+
+	// Uploading keys which are already stored again doesn't count against
+	// the limit, so this fills it up exactly.
+	if res := upload("AAAAAQ", "AAAAAg", "AAAAAw"); res.KeyErrors[crossSigningUserID]["DEVICE"] != nil {
+		t.Fatalf("upload up to the limit was rejected: %s", res.KeyErrors[crossSigningUserID]["DEVICE"])
+	}
+	assertCount(3)
+}
+
+// queryKeysFederationClient answers /keys/query from a fixed set of devices,
+// returning every device it knows about for each requested user regardless of
+// which devices were asked for.
+type queryKeysFederationClient struct {
+	fedsenderapi.FederationClient
+	devices   map[string][]string
+	requested map[string][]string
+}
+
+func (f *queryKeysFederationClient) QueryKeys(ctx context.Context, s gomatrixserverlib.ServerName, keys map[string][]string) (res gomatrixserverlib.RespQueryKeys, err error) {
+	f.requested = keys
+	res.DeviceKeys = make(map[string]map[string]gomatrixserverlib.DeviceKeys)
+	for userID := range keys {
+		res.DeviceKeys[userID] = make(map[string]gomatrixserverlib.DeviceKeys)
+		for _, deviceID := range f.devices[userID] {
+			res.DeviceKeys[userID][deviceID] = gomatrixserverlib.DeviceKeys{
+				RespUserDeviceKeys: gomatrixserverlib.RespUserDeviceKeys{UserID: userID, DeviceID: deviceID},
+			}
+		}
+	}
+	return res, nil
+}
+
+func assertQueriedDevices(t *testing.T, res *api.QueryKeysResponse, userID string, want ...string) {
+	t.Helper()
+	if res.Error != nil {
+		t.Fatalf("QueryKeys failed: %s", res.Error)
+	}
+	got := res.DeviceKeys[userID]
+	if len(got) != len(want) {
+		t.Errorf("got %d devices for %s, want %v", len(got), userID, want)
+	}
+	for _, deviceID := range want {
+		if _, ok := got[deviceID]; !ok {
+			t.Errorf("device %s for %s is missing from the response", deviceID, userID)
+		}
+	}
+}
+
+func TestQueryKeysDeviceFiltering(t *testing.T) {
+	a := mustCreateCrossSigningAPI(t)
+	a.Producer = &producers.KeyChange{Producer: &nopSyncProducer{}, DB: a.DB}
+	var deviceKeys []api.DeviceKeys
+	for _, deviceID := range []string{"ALPHA", "BRAVO", "CHARLIE"} {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key: %s", err)
+		}
+		deviceKeys = append(deviceKeys, api.DeviceKeys{
+			UserID: crossSigningUserID, DeviceID: deviceID, KeyJSON: mustSignDeviceKeys(t, deviceID, publicKey, privateKey),
+		})
+	}
+	uploadRes := &api.PerformUploadKeysResponse{}
+	a.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{DeviceKeys: deviceKeys}, uploadRes)
+	if uploadRes.Error != nil {
+		t.Fatalf("PerformUploadKeys failed: %s", uploadRes.Error)
+	}
+
+	query := func(deviceIDs ...string) *api.QueryKeysResponse {
+		res := &api.QueryKeysResponse{}
+		a.QueryKeys(ctx, &api.QueryKeysRequest{
+			UserID:        crossSigningUserID,
+			UserToDevices: map[string][]string{crossSigningUserID: deviceIDs},
+		}, res)
+		return res
+	}
+	assertQueriedDevices(t, query(), crossSigningUserID, "ALPHA", "BRAVO", "CHARLIE")
+	assertQueriedDevices(t, query("BRAVO"), crossSigningUserID, "BRAVO")
+	assertQueriedDevices(t, query("ALPHA", "CHARLIE"), crossSigningUserID, "ALPHA", "CHARLIE")
+	// Unknown devices are left out of the response rather than failing it.
+	assertQueriedDevices(t, query("ALPHA", "UNKNOWN"), crossSigningUserID, "ALPHA")
+	assertQueriedDevices(t, query("UNKNOWN"), crossSigningUserID)
+}
+
+func TestQueryKeysRemoteDeviceFiltering(t *testing.T) {
+	a := mustCreateCrossSigningAPI(t)
+	fedClient := &queryKeysFederationClient{
+		devices: map[string][]string{
+			"@bob:remote":   {"BOB1", "BOB2"},
+			"@carol:remote": {"CAROL1", "CAROL2"},
+		},
+	}
+	a.FedClient = fedClient
+
+	res := &api.QueryKeysResponse{}
+	a.QueryKeys(ctx, &api.QueryKeysRequest{
+		UserID: crossSigningUserID,
+		UserToDevices: map[string][]string{
+			"@bob:remote":   {"BOB1"},
+			"@carol:remote": {"CAROL2", "UNKNOWN"},
+		},
+		Timeout: time.Second * 10,
+	}, res)
+
+	// Both users are on the same server, so should be asked for in the same
+	// request, and only the devices that were asked for should be returned.
+	if len(fedClient.requested) != 2 {
+		t.Errorf("remote server was asked about %v, want both users", fedClient.requested)
+	}
+	assertQueriedDevices(t, res, "@bob:remote", "BOB1")
+	assertQueriedDevices(t, res, "@carol:remote", "CAROL2")
+}
@@ -27,13 +27,14 @@ import (
 
 // HTTP paths for the internal HTTP APIs
 const (
-	InputDeviceListUpdatePath = "/keyserver/inputDeviceListUpdate"
-	PerformUploadKeysPath     = "/keyserver/performUploadKeys"
-	PerformClaimKeysPath      = "/keyserver/performClaimKeys"
-	QueryKeysPath             = "/keyserver/queryKeys"
-	QueryKeyChangesPath       = "/keyserver/queryKeyChanges"
-	QueryOneTimeKeysPath      = "/keyserver/queryOneTimeKeys"
-	QueryDeviceMessagesPath   = "/keyserver/queryDeviceMessages"
+	InputDeviceListUpdatePath          = "/keyserver/inputDeviceListUpdate"
+	PerformUploadKeysPath              = "/keyserver/performUploadKeys"
+	PerformClaimKeysPath               = "/keyserver/performClaimKeys"
+	PerformUploadDeviceSigningKeysPath = "/keyserver/performUploadDeviceSigningKeys"
+	QueryKeysPath                      = "/keyserver/queryKeys"
+	QueryKeyChangesPath                = "/keyserver/queryKeyChanges"
+	QueryOneTimeKeysPath               = "/keyserver/queryOneTimeKeys"
+	QueryDeviceMessagesPath            = "/keyserver/queryDeviceMessages"
 )
 
 // NewKeyServerClient creates a KeyInternalAPI implemented by talking to a HTTP POST API.
@@ -175,3 +176,20 @@ func (h *httpKeyInternalAPI) QueryKeyChanges(
 		}
 	}
 }
+
+func (h *httpKeyInternalAPI) PerformUploadDeviceSigningKeys(
+	ctx context.Context,
+	request *api.PerformUploadDeviceSigningKeysRequest,
+	response *api.PerformUploadDeviceSigningKeysResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUploadDeviceSigningKeys")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformUploadDeviceSigningKeysPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
@@ -102,4 +102,15 @@ func AddRoutes(internalAPIMux *mux.Router, s api.KeyInternalAPI) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(PerformUploadDeviceSigningKeysPath,
+		httputil.MakeInternalAPI("performUploadDeviceSigningKeys", func(req *http.Request) util.JSONResponse {
+			request := api.PerformUploadDeviceSigningKeysRequest{}
+			response := api.PerformUploadDeviceSigningKeysResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			s.PerformUploadDeviceSigningKeys(req.Context(), &request, &response)
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
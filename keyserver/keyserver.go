@@ -61,5 +61,7 @@ func NewInternalAPI(
 		FedClient:  fedClient,
 		Producer:   keyChangeProducer,
 		Updater:    updater,
+
+		MaxOneTimeKeysPerDevice: cfg.MaxOneTimeKeysPerDevice,
 	}
 }
@@ -73,4 +73,12 @@ type Database interface {
 
 	// MarkDeviceListStale sets the stale bit for this user to isStale.
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
+
+	// CrossSigningKeysForUser returns the cross-signing keys of a local user, keyed by purpose.
+	// Purposes with no key are omitted from the map.
+	CrossSigningKeysForUser(ctx context.Context, userID string) (api.CrossSigningKeyMap, error)
+
+	// StoreCrossSigningKeysForUser persists the given cross-signing keys, replacing any existing
+	// keys with the same purpose.
+	StoreCrossSigningKeysForUser(ctx context.Context, userID string, keyMap api.CrossSigningKeyMap) error
 }
@@ -0,0 +1,85 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package identicon generates simple avatars for users who haven't set one.
+package identicon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// gridSize is the number of cells along each side of an identicon.
+const gridSize = 5
+
+// MinSize and MaxSize are the bounds on the width and height of an identicon
+// in pixels.
+const (
+	MinSize = 16
+	MaxSize = 512
+)
+
+// background is the colour of the cells which aren't filled in.
+var background = color.NRGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+// Generate returns a PNG identicon of the given size for the input. The
+// image depends only on the input and the size, so the same input always
+// produces exactly the same bytes. The identicon is a grid of cells which is
+// symmetrical from left to right, where the cells that are filled in and
+// their colour are taken from the SHA-256 hash of the input.
+func Generate(input string, size int) ([]byte, error) {
+	if size < MinSize || size > MaxSize {
+		return nil, fmt.Errorf("size must be between %d and %d", MinSize, MaxSize)
+	}
+	sum := sha256.Sum256([]byte(input))
+
+	// Keep the colour reasonably dark so that it stands out from the
+	// background.
+	foreground := color.NRGBA{R: sum[0] / 2, G: sum[1] / 2, B: sum[2] / 2, A: 0xff}
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{background, foreground})
+
+	// Leave a margin around the grid of half a cell on each side.
+	cell := size / (gridSize + 1)
+	margin := (size - cell*gridSize) / 2
+	fill := func(x, y int) {
+		for py := margin + y*cell; py < margin+(y+1)*cell; py++ {
+			for px := margin + x*cell; px < margin+(x+1)*cell; px++ {
+				img.SetColorIndex(px, py, 1)
+			}
+		}
+	}
+
+	// Each cell in the left half of the grid and the middle column is filled
+	// in if its bit of the hash is set, and then mirrored onto the right.
+	columns := (gridSize + 1) / 2
+	for y := 0; y < gridSize; y++ {
+		for x := 0; x < columns; x++ {
+			if sum[3+y*columns+x]&1 == 0 {
+				continue
+			}
+			fill(x, y)
+			fill(gridSize-1-x, y)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("png.Encode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identicon
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func mustGenerate(t *testing.T, input string, size int) []byte {
+	t.Helper()
+	img, err := Generate(input, size)
+	if err != nil {
+		t.Fatalf("Generate(%q, %d) failed: %s", input, size, err)
+	}
+	return img
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	alice := mustGenerate(t, "@alice:localhost", 64)
+	if again := mustGenerate(t, "@alice:localhost", 64); !bytes.Equal(alice, again) {
+		t.Errorf("got different images for the same input")
+	}
+	if bob := mustGenerate(t, "@bob:localhost", 64); bytes.Equal(alice, bob) {
+		t.Errorf("got the same image for different inputs")
+	}
+	if bigger := mustGenerate(t, "@alice:localhost", 128); bytes.Equal(alice, bigger) {
+		t.Errorf("got the same image for different sizes")
+	}
+}
+
+func TestGenerateSize(t *testing.T) {
+	cfg, err := png.DecodeConfig(bytes.NewReader(mustGenerate(t, "@alice:localhost", 100)))
+	if err != nil {
+		t.Fatalf("failed to decode identicon: %s", err)
+	}
+	if cfg.Width != 100 || cfg.Height != 100 {
+		t.Errorf("got %dx%d identicon, want 100x100", cfg.Width, cfg.Height)
+	}
+	for _, size := range []int{0, MinSize - 1, MaxSize + 1} {
+		if _, err = Generate("@alice:localhost", size); err == nil {
+			t.Errorf("Generate with size %d succeeded, want an error", size)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
@@ -26,9 +27,13 @@ import (
 
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
-	router *mux.Router, cfg *config.MediaAPI,
+	router, fedRouter, dendriteRouter *mux.Router,
+	cfg *config.MediaAPI,
+	fedCfg *config.FederationAPI,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
+	keyRing gomatrixserverlib.JSONVerifier,
+	spamChecker spamcheck.Checker,
 ) {
 	mediaDB, err := storage.Open(&cfg.Database)
 	if err != nil {
@@ -36,6 +41,6 @@ func AddPublicRoutes(
 	}
 
 	routing.Setup(
-		router, cfg, mediaDB, userAPI, client,
+		router, fedRouter, dendriteRouter, cfg, fedCfg, mediaDB, userAPI, client, keyRing, spamChecker,
 	)
 }
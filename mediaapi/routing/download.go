@@ -20,7 +20,9 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -60,6 +62,7 @@ type downloadRequest struct {
 	ThumbnailSize      types.ThumbnailSize
 	Logger             *log.Entry
 	DownloadFilename   string
+	MultipartResponse  bool
 }
 
 // Download implements GET /download and GET /thumbnail
@@ -68,6 +71,8 @@ type downloadRequest struct {
 // If they are present in the cache, they are served directly.
 // If they are not present in the cache, they are obtained from the remote server and
 // simultaneously served back to the client and written into the cache.
+// Federation requests get a multipart/mixed response, as required by
+// https://spec.matrix.org/v1.11/server-server-api/#content-repository
 func Download(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -79,6 +84,7 @@ func Download(
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	isThumbnailRequest bool,
+	isFederationRequest bool,
 	customFilename string,
 ) {
 	dReq := &downloadRequest{
@@ -91,7 +97,8 @@ func Download(
 			"Origin":  origin,
 			"MediaID": mediaID,
 		}),
-		DownloadFilename: customFilename,
+		DownloadFilename:  customFilename,
+		MultipartResponse: isFederationRequest,
 	}
 
 	if dReq.IsThumbnailRequest {
@@ -314,6 +321,13 @@ func (r *downloadRequest) respondFromLocalFile(
 		}
 	}
 
+	if r.MultipartResponse {
+		if err := writeMultipartResponse(w, responseFile, responseMetadata); err != nil {
+			return nil, err
+		}
+		return responseMetadata, nil
+	}
+
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
@@ -329,6 +343,29 @@ func (r *downloadRequest) respondFromLocalFile(
 	return responseMetadata, nil
 }
 
+// writeMultipartResponse writes the file as a multipart/mixed response. The
+// first part holds the metadata of the media, which is always empty for now,
+// and the second part holds the file itself.
+func writeMultipartResponse(w http.ResponseWriter, file io.Reader, metadata *types.MediaMetadata) error {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return errors.Wrap(err, "failed to create metadata part")
+	}
+	if _, err = part.Write([]byte("{}")); err != nil {
+		return errors.Wrap(err, "failed to write metadata part")
+	}
+	part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {string(metadata.ContentType)}})
+	if err != nil {
+		return errors.Wrap(err, "failed to create file part")
+	}
+	if _, err = io.Copy(part, file); err != nil {
+		return errors.Wrap(err, "failed to copy from cache")
+	}
+	return mw.Close()
+}
+
 func (r *downloadRequest) addDownloadFilenameToHeaders(
 	w http.ResponseWriter,
 	responseMetadata *types.MediaMetadata,
@@ -0,0 +1,183 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// remoteKeyVerifier only accepts JSON signed by the remote server's key.
+type remoteKeyVerifier struct {
+	serverName gomatrixserverlib.ServerName
+	keyID      gomatrixserverlib.KeyID
+	key        ed25519.PublicKey
+}
+
+func (v *remoteKeyVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		if req.ServerName != v.serverName {
+			results[i].Error = fmt.Errorf("unknown server %q", req.ServerName)
+			continue
+		}
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(v.serverName), v.keyID, v.key, req.Message)
+	}
+	return results, nil
+}
+
+// mustCreateMediaStore makes a config with a temporary media store and an
+// in-memory database. The returned function removes the media store.
+func mustCreateMediaStore(t *testing.T) (*config.Dendrite, storage.Database, func()) {
+	t.Helper()
+	basePath, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatalf("failed to create media store: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+	cfg.MediaAPI.AbsBasePath = config.Path(basePath)
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to create media DB: %s", err)
+	}
+	return cfg, db, func() {
+		os.RemoveAll(basePath) // nolint: errcheck
+	}
+}
+
+func TestFederationThumbnail(t *testing.T) {
+	cfg, db, cleanup := mustCreateMediaStore(t)
+	defer cleanup()
+	cfg.MediaAPI.DynamicThumbnails = true
+
+	// Store one of our own images, as if it had been uploaded.
+	image96, err := os.Open("../bimg-96x96-crop.jpg")
+	if err != nil {
+		t.Fatalf("failed to open test image: %s", err)
+	}
+	defer image96.Close() // nolint: errcheck
+	ctx := context.Background()
+	hash, size, tmpDir, err := fileutils.WriteTempFile(ctx, image96, 0, cfg.MediaAPI.AbsBasePath)
+	if err != nil {
+		t.Fatalf("failed to write test image: %s", err)
+	}
+	metadata := &types.MediaMetadata{
+		MediaID:       "testmedia",
+		Origin:        cfg.Global.ServerName,
+		ContentType:   "image/jpeg",
+		FileSizeBytes: size,
+		UploadName:    "test.jpg",
+		Base64Hash:    hash,
+	}
+	if _, _, err = fileutils.MoveFileWithHashCheck(tmpDir, metadata, cfg.MediaAPI.AbsBasePath, util.GetLogger(ctx)); err != nil {
+		t.Fatalf("failed to move test image: %s", err)
+	}
+	if err = db.StoreMediaMetadata(ctx, metadata); err != nil {
+		t.Fatalf("failed to store media metadata: %s", err)
+	}
+
+	_, remoteKey, _ := ed25519.GenerateKey(nil)
+	keyRing := &remoteKeyVerifier{
+		serverName: "remote",
+		keyID:      "ed25519:auto",
+		key:        remoteKey.Public().(ed25519.PublicKey),
+	}
+	mediaMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicMediaPathPrefix).Subrouter().UseEncodedPath()
+	fedMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath()
+	dendriteMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicDendritePathPrefix).Subrouter().UseEncodedPath()
+	Setup(mediaMux, fedMux, dendriteMux, &cfg.MediaAPI, &cfg.FederationAPI, db, nil, nil, keyRing, spamcheck.NopChecker{})
+
+	path := "/_matrix/federation/v1/media/thumbnail/testmedia?width=32&height=32&method=scale"
+
+	// Requests which aren't signed by the remote server are rejected.
+	rec := httptest.NewRecorder()
+	fedMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got HTTP %d for an unsigned request, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, cfg.Global.ServerName, path)
+	if err = fedReq.Sign("remote", "ed25519:auto", remoteKey); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+	signedReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header = signedReq.Header
+	rec = httptest.NewRecorder()
+	fedMux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d for a signed request, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	// The response holds the metadata and then the thumbnail.
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("got Content-Type %q, want multipart/mixed", rec.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("failed to read metadata part: %s", err)
+	}
+	if ct := part.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got metadata Content-Type %q, want application/json", ct)
+	}
+	if body, _ := ioutil.ReadAll(part); string(body) != "{}" {
+		t.Errorf("got metadata %q, want {}", body)
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatalf("failed to read thumbnail part: %s", err)
+	}
+	if ct := part.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("got thumbnail Content-Type %q, want image/jpeg", ct)
+	}
+	thumbnail, format, err := image.DecodeConfig(part)
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %s", err)
+	}
+	if format != "jpeg" || thumbnail.Width != 32 || thumbnail.Height != 32 {
+		t.Errorf("got %dx%d %s thumbnail, want 32x32 jpeg", thumbnail.Width, thumbnail.Height, format)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/identicon"
+	"github.com/matrix-org/util"
+)
+
+// defaultIdenticonSize is the size of an identicon in pixels if the request
+// doesn't give one.
+const defaultIdenticonSize = 64
+
+// Identicon implements GET /_dendrite/media/identicon/{hash}, which returns a
+// generated avatar for the given string, e.g. the user ID of a user who has
+// no avatar. The same string always gives the same image, so it can be cached
+// for as long as the client likes.
+func Identicon(w http.ResponseWriter, req *http.Request, hash string) {
+	r := &downloadRequest{Logger: util.GetLogger(req.Context())}
+	size := defaultIdenticonSize
+	if s := req.URL.Query().Get("size"); s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil {
+			r.jsonErrorResponse(w, util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("size must be an integer"),
+			})
+			return
+		}
+	}
+	if size < identicon.MinSize || size > identicon.MaxSize {
+		r.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(fmt.Sprintf("size must be between %d and %d", identicon.MinSize, identicon.MaxSize)),
+		})
+		return
+	}
+
+	img, err := identicon.Generate(hash, size)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to generate identicon")
+		r.jsonErrorResponse(w, jsonerror.InternalServerError())
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.WriteHeader(http.StatusOK)
+	w.Write(img) // nolint: errcheck
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+// uploadRateLimits limits how quickly each user can upload files. Each user
+// has a bucket of threshold slots, one of which is used by each upload, and
+// which refills at a rate of one slot per cooloff.
+type uploadRateLimits struct {
+	sync.Mutex
+	enabled bool
+	cooloff time.Duration
+	window  time.Duration // how long it takes for an empty bucket to refill
+	// For each user, the time at which their bucket will be full again.
+	full map[string]time.Time
+	now  func() time.Time
+}
+
+func newUploadRateLimits(cfg *config.RateLimiting) *uploadRateLimits {
+	cooloff := time.Duration(cfg.CooloffMS) * time.Millisecond
+	l := &uploadRateLimits{
+		enabled: cfg.Enabled,
+		cooloff: cooloff,
+		window:  time.Duration(cfg.Threshold) * cooloff,
+		full:    make(map[string]time.Time),
+		now:     time.Now,
+	}
+	if l.enabled {
+		go l.clean()
+	}
+	return l
+}
+
+func (l *uploadRateLimits) clean() {
+	for {
+		// On a 30 second interval, forget about any users whose buckets
+		// have refilled, since they make no difference anymore.
+		time.Sleep(time.Second * 30)
+		l.Lock()
+		now := l.now()
+		for userID, full := range l.full {
+			if !full.After(now) {
+				delete(l.full, userID)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+// rateLimit takes a slot from the user's bucket, or returns an error telling
+// them how long to wait if the bucket is empty.
+func (l *uploadRateLimits) rateLimit(userID string) *util.JSONResponse {
+	// If rate limiting is disabled then do nothing.
+	if !l.enabled {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+
+	// Taking a slot pushes back the time at which the bucket is full by one
+	// cooloff. If that would be further away than it takes to refill the
+	// whole bucket then the bucket is empty.
+	full := l.full[userID]
+	if full.Before(now) {
+		full = now
+	}
+	full = full.Add(l.cooloff)
+	if wait := full.Sub(now) - l.window; wait > 0 {
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded(
+				"You are uploading files too quickly!",
+				int64((wait+time.Millisecond-1)/time.Millisecond),
+			),
+		}
+	}
+	l.full[userID] = full
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestUploadRateLimits(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	l := newUploadRateLimits(&config.RateLimiting{
+		Enabled:   true,
+		Threshold: 3,
+		CooloffMS: 1000,
+	})
+	l.now = func() time.Time { return now }
+	alice, bob := "@alice:localhost", "@bob:localhost"
+
+	allowed := func(userID string) {
+		t.Helper()
+		if res := l.rateLimit(userID); res != nil {
+			t.Fatalf("upload by %s was rate limited: %+v", userID, res.JSON)
+		}
+	}
+	limited := func(userID string, wantRetryAfterMS int64) {
+		t.Helper()
+		res := l.rateLimit(userID)
+		if res == nil {
+			t.Fatalf("upload by %s wasn't rate limited", userID)
+		}
+		if res.Code != http.StatusTooManyRequests {
+			t.Errorf("got HTTP %d, want %d", res.Code, http.StatusTooManyRequests)
+		}
+		lerr, ok := res.JSON.(*jsonerror.LimitExceededError)
+		if !ok || lerr.ErrCode != "M_LIMIT_EXCEEDED" {
+			t.Fatalf("got error %+v, want M_LIMIT_EXCEEDED", res.JSON)
+		}
+		if lerr.RetryAfterMS != wantRetryAfterMS {
+			t.Errorf("got retry_after_ms %d, want %d", lerr.RetryAfterMS, wantRetryAfterMS)
+		}
+	}
+
+	// A user can use up their whole bucket at once, and then has to wait
+	// for it to refill.
+	allowed(alice)
+	allowed(alice)
+	allowed(alice)
+	limited(alice, 1000)
+
+	// Other users have buckets of their own.
+	allowed(bob)
+
+	// Being rate limited doesn't use up a slot, so after a cooloff there is
+	// a slot for exactly one more upload.
+	now = now.Add(250 * time.Millisecond)
+	limited(alice, 750)
+	now = now.Add(750 * time.Millisecond)
+	allowed(alice)
+	limited(alice, 1000)
+
+	// After long enough, the whole bucket refills, but no further.
+	now = now.Add(time.Hour)
+	allowed(alice)
+	allowed(alice)
+	allowed(alice)
+	limited(alice, 1000)
+}
+
+func TestUploadRateLimitsDisabled(t *testing.T) {
+	l := newUploadRateLimits(&config.RateLimiting{
+		Enabled:   false,
+		Threshold: 1,
+		CooloffMS: 1000,
+	})
+	for i := 0; i < 10; i++ {
+		if res := l.rateLimit("@alice:localhost"); res != nil {
+			t.Fatalf("upload was rate limited with rate limiting disabled: %+v", res.JSON)
+		}
+	}
+}
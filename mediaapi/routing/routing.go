@@ -17,14 +17,17 @@ package routing
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -38,23 +41,31 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux *mux.Router,
+	publicAPIMux, fedMux, dendriteMux *mux.Router,
 	cfg *config.MediaAPI,
+	fedCfg *config.FederationAPI,
 	db storage.Database,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
+	keyRing gomatrixserverlib.JSONVerifier,
+	spamChecker spamcheck.Checker,
 ) {
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
+	v1fedmux := fedMux.PathPrefix("/v1").Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
 	}
 
+	uploadRateLimits := newUploadRateLimits(&cfg.UploadRateLimiting)
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			if r := uploadRateLimits.rateLimit(dev.UserID); r != nil {
+				return *r
+			}
+			return Upload(req, cfg, dev, db, activeThumbnailGeneration, spamChecker)
 		},
 	)
 
@@ -74,6 +85,14 @@ func Setup(
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
 		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteMux.Handle("/media/identicon/{hash}",
+		makeIdenticonAPI("identicon"),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1fedmux.Handle("/media/thumbnail/{mediaId}",
+		makeFederationThumbnailAPI("federation_thumbnail", cfg, fedCfg, db, keyRing, activeThumbnailGeneration),
+	).Methods(http.MethodGet)
 }
 
 func makeDownloadAPI(
@@ -123,8 +142,91 @@ func makeDownloadAPI(
 			activeRemoteRequests,
 			activeThumbnailGeneration,
 			name == "thumbnail",
+			false,
 			vars["downloadName"],
 		)
 	}
 	return promhttp.InstrumentHandlerCounter(counterVec, http.HandlerFunc(httpHandler))
 }
+
+func makeIdenticonAPI(name string) http.HandlerFunc {
+	counterVec := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: "Total number of media_api requests for identicons",
+		},
+		[]string{"code"},
+	)
+	httpHandler := func(w http.ResponseWriter, req *http.Request) {
+		req = util.RequestWithLogging(req)
+
+		// Set internal headers returned regardless of the outcome of the request
+		util.SetCORSHeaders(w)
+		// Content-Type will be overridden in case of returning the image, else we respond with JSON-formatted errors
+		w.Header().Set("Content-Type", "application/json")
+
+		vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
+		Identicon(w, req, vars["hash"])
+	}
+	return promhttp.InstrumentHandlerCounter(counterVec, http.HandlerFunc(httpHandler))
+}
+
+// makeFederationThumbnailAPI makes an http.Handler for thumbnails of our own
+// media which have been requested by another server. The request must be
+// signed by a server that we are allowed to federate with.
+func makeFederationThumbnailAPI(
+	name string,
+	cfg *config.MediaAPI,
+	fedCfg *config.FederationAPI,
+	db storage.Database,
+	keyRing gomatrixserverlib.JSONVerifier,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) http.HandlerFunc {
+	counterVec := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: "Total number of media_api requests for thumbnails from other servers",
+		},
+		[]string{"code"},
+	)
+	httpHandler := func(w http.ResponseWriter, req *http.Request) {
+		req = util.RequestWithLogging(req)
+
+		// Content-Type will be overridden in case of returning file data, else we respond with JSON-formatted errors
+		w.Header().Set("Content-Type", "application/json")
+
+		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+			req, time.Now(), cfg.Matrix.ServerName, keyRing,
+		)
+		if fedReq == nil {
+			(&downloadRequest{Logger: util.GetLogger(req.Context())}).jsonErrorResponse(w, errResp)
+			return
+		}
+		if !fedCfg.IsServerAllowed(fedReq.Origin()) {
+			(&downloadRequest{Logger: util.GetLogger(req.Context())}).jsonErrorResponse(w, util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Federation with this server is not allowed"),
+			})
+			return
+		}
+
+		// Only our own media can be requested over federation, so there is
+		// never any need to fetch the file from a remote server.
+		vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
+		Download(
+			w,
+			req,
+			cfg.Matrix.ServerName,
+			types.MediaID(vars["mediaId"]),
+			cfg,
+			db,
+			nil,
+			nil,
+			activeThumbnailGeneration,
+			true,
+			true,
+			"",
+		)
+	}
+	return promhttp.InstrumentHandlerCounter(counterVec, http.HandlerFunc(httpHandler))
+}
@@ -15,11 +15,13 @@
 package routing
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"path"
@@ -31,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -56,13 +59,28 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration, spamChecker spamcheck.Checker) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if err := spamChecker.CheckMediaAllowed(
+		req.Context(), dev.UserID, string(r.MediaMetadata.ContentType),
+		req.FormValue("filename"), int64(r.MediaMetadata.FileSizeBytes),
+	); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	body := bufio.NewReaderSize(req.Body, sniffLen)
+	if resErr = r.checkContentType(body, cfg); resErr != nil {
+		return *resErr
+	}
+
+	if resErr = r.doUpload(req.Context(), body, cfg, db, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
 
@@ -96,6 +114,58 @@ func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *usera
 	return r, nil
 }
 
+// sniffLen is the number of bytes that http.DetectContentType looks at.
+const sniffLen = 512
+
+// checkContentType checks that both the Content-Type given in the request
+// and the type that the file content looks like are allowed to be uploaded,
+// so that a blocked type can't be uploaded by claiming that it is something
+// else. Content which can't be identified as anything more specific than
+// text, XML or binary data is only checked by the given type, since JSON or
+// SVG files for example look like plain text or XML. Nothing is checked when
+// neither an allow list nor a block list is configured.
+func (r *uploadRequest) checkContentType(body *bufio.Reader, cfg *config.MediaAPI) *util.JSONResponse {
+	if len(cfg.AllowedContentTypes) == 0 && len(cfg.BlockedContentTypes) == 0 {
+		return nil
+	}
+	start, err := body.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		r.Logger.WithError(err).Warn("Error while reading file")
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Failed to upload"),
+		}
+	}
+	sniffed := http.DetectContentType(start)
+	if !cfg.IsContentTypeAllowed(string(r.MediaMetadata.ContentType)) ||
+		(!isGenericContentType(sniffed) && !cfg.IsContentTypeAllowed(sniffed)) {
+		r.Logger.WithFields(log.Fields{
+			"ContentType":        r.MediaMetadata.ContentType,
+			"SniffedContentType": sniffed,
+		}).Info("Rejecting upload of disallowed content type")
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Uploads of this type of file are not allowed"),
+		}
+	}
+	return nil
+}
+
+// isGenericContentType returns true if the type returned by
+// http.DetectContentType is one of the types it falls back to when it can't
+// identify the content more precisely.
+func isGenericContentType(sniffed string) bool {
+	mediaType, _, err := mime.ParseMediaType(sniffed)
+	if err != nil {
+		return true
+	}
+	switch mediaType {
+	case "application/octet-stream", "text/plain", "text/xml":
+		return true
+	}
+	return false
+}
+
 func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database) (types.MediaID, error) {
 	for {
 		// First try generating a meda ID. We'll do this by
@@ -0,0 +1,114 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestUploadContentTypes(t *testing.T) {
+	cfg, db, cleanup := mustCreateMediaStore(t)
+	defer cleanup()
+	cfg.MediaAPI.AllowedContentTypes = []string{"image/*", "text/plain", "application/json"}
+	cfg.MediaAPI.BlockedContentTypes = []string{"image/gif"}
+
+	jpeg, err := ioutil.ReadFile("../bimg-96x96-crop.jpg")
+	if err != nil {
+		t.Fatalf("failed to read test image: %s", err)
+	}
+	html := []byte("<!DOCTYPE html><html><script>alert(1)</script></html>")
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	svg := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`)
+
+	testCases := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantCode    int
+	}{
+		{"allowed type", "image/jpeg", jpeg, http.StatusOK},
+		{"allowed type with parameters", "text/plain; charset=utf-8", []byte("hello"), http.StatusOK},
+		{"JSON which looks like plain text", "application/json", []byte(`{"hello":"world"}`), http.StatusOK},
+		{"SVG which looks like XML", "image/svg+xml", svg, http.StatusOK},
+		{"type not in the allow list", "application/pdf", []byte("%PDF-1.4"), http.StatusForbidden},
+		{"blocked type", "image/gif", gif, http.StatusForbidden},
+		{"blocked content claiming to be allowed", "image/png", gif, http.StatusForbidden},
+		{"unlisted content claiming to be allowed", "image/jpeg", html, http.StatusForbidden},
+		{"malformed type", "not a type", []byte("hello"), http.StatusForbidden},
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/_matrix/media/r0/upload?filename=test", bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			res := Upload(req, &cfg.MediaAPI, dev, db, activeThumbnailGeneration, spamcheck.NopChecker{})
+			if res.Code != tc.wantCode {
+				t.Fatalf("got HTTP %d, want %d: %+v", res.Code, tc.wantCode, res.JSON)
+			}
+			if res.Code != http.StatusOK {
+				if merr, ok := res.JSON.(*jsonerror.MatrixError); !ok || merr.ErrCode != "M_FORBIDDEN" {
+					t.Errorf("got error %+v, want M_FORBIDDEN", res.JSON)
+				}
+				return
+			}
+
+			// The upload should have been stored with the type that was given.
+			uri := res.JSON.(uploadResponse).ContentURI
+			mediaID := types.MediaID(uri[strings.LastIndex(uri, "/")+1:])
+			metadata, err := db.GetMediaMetadata(context.Background(), mediaID, cfg.Global.ServerName)
+			if err != nil {
+				t.Fatalf("GetMediaMetadata failed: %s", err)
+			}
+			if metadata == nil {
+				t.Fatalf("upload wasn't stored")
+			}
+			if string(metadata.ContentType) != tc.contentType {
+				t.Errorf("got stored content type %q, want %q", metadata.ContentType, tc.contentType)
+			}
+		})
+	}
+}
+
+func TestUploadContentTypesWithoutLists(t *testing.T) {
+	cfg, db, cleanup := mustCreateMediaStore(t)
+	defer cleanup()
+
+	// Nothing is checked when there are no allow or block lists, even if the
+	// Content-Type can't be parsed.
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/media/r0/upload?filename=test", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "not a type")
+	res := Upload(req, &cfg.MediaAPI, dev, db, activeThumbnailGeneration, spamcheck.NopChecker{})
+	if res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+}
@@ -37,7 +37,7 @@ type Database struct {
 // Open opens a postgres database.
 func Open(dbProperties *config.DatabaseOptions) (*Database, error) {
 	d := Database{
-		writer: sqlutil.NewExclusiveWriter(),
+		writer: sqlutil.ExclusiveWriterForDatabase(dbProperties),
 	}
 	var err error
 	if d.db, err = sqlutil.Open(dbProperties); err != nil {
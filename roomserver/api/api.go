@@ -118,6 +118,13 @@ type RoomserverInternalAPI interface {
 		response *QueryServerAllowedToSeeEventResponse,
 	) error
 
+	// Query the non-state event in a room which was sent closest to a time
+	QueryEventNearestTimestamp(
+		ctx context.Context,
+		request *QueryEventNearestTimestampRequest,
+		response *QueryEventNearestTimestampResponse,
+	) error
+
 	// Query missing events for a room from roomserver
 	QueryMissingEvents(
 		ctx context.Context,
@@ -178,6 +178,16 @@ func (t *RoomserverInternalAPITrace) QueryServerAllowedToSeeEvent(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryEventNearestTimestamp(
+	ctx context.Context,
+	req *QueryEventNearestTimestampRequest,
+	res *QueryEventNearestTimestampResponse,
+) error {
+	err := t.Impl.QueryEventNearestTimestamp(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventNearestTimestamp req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryMissingEvents(
 	ctx context.Context,
 	req *QueryMissingEventsRequest,
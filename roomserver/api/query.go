@@ -198,6 +198,26 @@ type QueryServerAllowedToSeeEventResponse struct {
 	AllowedToSeeEvent bool `json:"can_see_event"`
 }
 
+// QueryEventNearestTimestampRequest is a request to QueryEventNearestTimestamp
+type QueryEventNearestTimestampRequest struct {
+	// The room to look for an event in.
+	RoomID string `json:"room_id"`
+	// The time to look for the closest event to.
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+	// Look for an event at or before the time if true, or at or after it
+	// otherwise.
+	Backwards bool `json:"backwards"`
+}
+
+// QueryEventNearestTimestampResponse is a response to QueryEventNearestTimestamp
+type QueryEventNearestTimestampResponse struct {
+	// The ID of the closest event, or empty if there are no events in that
+	// direction.
+	EventID string `json:"event_id"`
+	// When the closest event was sent.
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
 // QueryMissingEventsRequest is a request to QueryMissingEvents
 type QueryMissingEventsRequest struct {
 	// Events which are known previous to the gap in the timeline.
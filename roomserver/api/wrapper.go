@@ -17,6 +17,7 @@ package api
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -235,3 +236,69 @@ func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI Roomserver
 	}
 	return chunk, nil
 }
+
+// FilterPublicRooms returns the rooms whose name, topic or canonical alias
+// contains the search term, ignoring case.
+func FilterPublicRooms(rooms []gomatrixserverlib.PublicRoom, searchTerm string) []gomatrixserverlib.PublicRoom {
+	if searchTerm == "" {
+		return rooms
+	}
+
+	normalizedTerm := strings.ToLower(searchTerm)
+
+	result := make([]gomatrixserverlib.PublicRoom, 0)
+	for _, room := range rooms {
+		if strings.Contains(strings.ToLower(room.Name), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.Topic), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.CanonicalAlias), normalizedTerm) {
+			result = append(result, room)
+		}
+	}
+
+	return result
+}
+
+// SlicePublicRooms returns a subslice of `slice` which honours the since/limit values given.
+//
+//	  0  1  2  3  4  5  6   index
+//	 [A, B, C, D, E, F, G]  slice
+//
+//	 limit=3          => A,B,C (prev='', next='3')
+//	 limit=3&since=3  => D,E,F (prev='0', next='6')
+//	 limit=3&since=6  => G     (prev='3', next='')
+//
+//	A value of '-1' for prev/next indicates no position. The since value
+//	is clamped to the bounds of the slice and a negative limit is treated
+//	as 0, so callers should reject negative limits before getting here.
+func SlicePublicRooms(slice []gomatrixserverlib.PublicRoom, since int64, limit int16) (subset []gomatrixserverlib.PublicRoom, prev, next int) {
+	prev = -1
+	next = -1
+
+	// apply sanity caps
+	if limit < 0 {
+		limit = 0
+	}
+	if since < 0 {
+		since = 0
+	}
+	if since > int64(len(slice)) {
+		since = int64(len(slice))
+	}
+
+	if since > 0 {
+		prev = int(since) - int(limit)
+		if prev < 0 {
+			prev = 0
+		}
+	}
+	nextIndex := int(since) + int(limit)
+	if len(slice) > nextIndex { // there are more rooms ahead of us
+		next = nextIndex
+	}
+	if nextIndex > len(slice) {
+		nextIndex = len(slice)
+	}
+
+	subset = slice[since:nextIndex]
+	return
+}
@@ -1,4 +1,4 @@
-package routing
+package api
 
 import (
 	"reflect"
@@ -20,6 +20,7 @@ func TestSliceInto(t *testing.T) {
 	limit := int16(3)
 	testCases := []struct {
 		since      int64
+		limit      int16
 		wantPrev   int
 		wantNext   int
 		wantSubset []gomatrixserverlib.PublicRoom
@@ -42,9 +43,40 @@ func TestSliceInto(t *testing.T) {
 			wantNext:   -1,
 			wantSubset: slice[6:7],
 		},
+		{
+			since:      2,
+			wantPrev:   0,
+			wantNext:   5,
+			wantSubset: slice[2:5],
+		},
+		{
+			// since is clamped to the start of the slice
+			since:      -5,
+			wantPrev:   -1,
+			wantNext:   3,
+			wantSubset: slice[0:3],
+		},
+		{
+			// since is clamped to the end of the slice
+			since:      10,
+			wantPrev:   4,
+			wantNext:   -1,
+			wantSubset: slice[7:7],
+		},
+		{
+			// a negative limit is treated as 0
+			since:      3,
+			limit:      -3,
+			wantPrev:   3,
+			wantNext:   3,
+			wantSubset: slice[3:3],
+		},
 	}
 	for _, tc := range testCases {
-		subset, prev, next := sliceInto(slice, tc.since, limit)
+		if tc.limit == 0 {
+			tc.limit = limit
+		}
+		subset, prev, next := SlicePublicRooms(slice, tc.since, tc.limit)
 		if !reflect.DeepEqual(subset, tc.wantSubset) {
 			t.Errorf("returned subset is wrong, got %v want %v", subset, tc.wantSubset)
 		}
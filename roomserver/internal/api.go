@@ -14,6 +14,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -45,6 +46,7 @@ func NewRoomserverAPI(
 	cfg *config.RoomServer, roomserverDB storage.Database, producer sarama.SyncProducer,
 	outputRoomEventTopic string, caches caching.RoomServerCaches,
 	keyRing gomatrixserverlib.JSONVerifier, perspectiveServerNames []gomatrixserverlib.ServerName,
+	spamChecker spamcheck.Checker,
 ) *RoomserverInternalAPI {
 	serverACLs := acls.NewServerACLs(roomserverDB)
 	a := &RoomserverInternalAPI{
@@ -58,16 +60,22 @@ func NewRoomserverAPI(
 			DB:         roomserverDB,
 			Cache:      caches,
 			ServerACLs: serverACLs,
+			Cfg:        cfg,
 		},
 		Inputer: &input.Inputer{
 			DB:                   roomserverDB,
 			OutputRoomEventTopic: outputRoomEventTopic,
 			Producer:             producer,
 			ServerName:           cfg.Matrix.ServerName,
+			Cfg:                  cfg,
 			ACLs:                 serverACLs,
+			SpamChecker:          spamChecker,
 		},
 		// perform-er structs get initialised when we have a federation sender to use
 	}
+	if cfg.Matrix.Retention.Enabled {
+		go a.purgeExpiredEventsPeriodically()
+	}
 	return a
 }
 
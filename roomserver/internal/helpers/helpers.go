@@ -293,6 +293,13 @@ func ScanEventTree(
 
 	resultNIDs = make([]types.EventNID, 0, limit)
 
+	// The events at the front of the tree weren't reached by walking
+	// prev_events, so they haven't had their visibility checked yet.
+	unchecked := make(map[string]bool, len(front))
+	for _, id := range front {
+		unchecked[id] = true
+	}
+
 	var checkedServerInRoom bool
 	var isServerInRoom bool
 
@@ -328,6 +335,20 @@ BFSLoop:
 				break BFSLoop
 			}
 
+			if unchecked[ev.EventID()] {
+				allowed, err = CheckServerAllowedToSeeEvent(ctx, db, info, ev.EventID(), serverName, isServerInRoom)
+				if err != nil {
+					util.GetLogger(ctx).WithField("server", serverName).WithField("event_id", ev.EventID()).WithError(err).Error(
+						"Error checking if allowed to see event",
+					)
+					return resultNIDs, nil
+				}
+				if !allowed {
+					util.GetLogger(ctx).WithField("server", serverName).WithField("event_id", ev.EventID()).Info("Not allowed to see event")
+					continue
+				}
+			}
+
 			if !initialIgnoreList[ev.EventID()] {
 				// Update the list of events to retrieve.
 				resultNIDs = append(resultNIDs, ev.EventNID)
@@ -0,0 +1,74 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helpers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// CheckRoomsPerUserLimit returns a PerformError if the user is already
+// joined to the maximum number of rooms allowed by the config.
+func CheckRoomsPerUserLimit(
+	ctx context.Context, db storage.Database, cfg *config.RoomServer, userID string,
+) error {
+	if cfg.MaxRoomsPerUser == 0 {
+		return nil
+	}
+	roomIDs, err := db.GetRoomsByMembership(ctx, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return fmt.Errorf("db.GetRoomsByMembership: %w", err)
+	}
+	if len(roomIDs) >= cfg.MaxRoomsPerUser {
+		return &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("User %q is already in the maximum of %d rooms", userID, cfg.MaxRoomsPerUser),
+		}
+	}
+	return nil
+}
+
+// CheckMembersPerRoomLimit returns a PerformError if the room already has
+// the maximum number of joined members allowed by the config.
+func CheckMembersPerRoomLimit(
+	ctx context.Context, db storage.Database, cfg *config.RoomServer, roomID string,
+) error {
+	if cfg.MaxMembersPerRoom == 0 {
+		return nil
+	}
+	info, err := db.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("db.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	eventNIDs, err := db.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, true, false)
+	if err != nil {
+		return fmt.Errorf("db.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	if len(eventNIDs) >= cfg.MaxMembersPerRoom {
+		return &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("Room %q already has the maximum of %d members", roomID, cfg.MaxMembersPerRoom),
+		}
+	}
+	return nil
+}
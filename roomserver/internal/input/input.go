@@ -26,6 +26,8 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 	"go.uber.org/atomic"
@@ -35,10 +37,14 @@ type Inputer struct {
 	DB                   storage.Database
 	Producer             sarama.SyncProducer
 	ServerName           gomatrixserverlib.ServerName
+	Cfg                  *config.RoomServer
 	ACLs                 *acls.ServerACLs
 	OutputRoomEventTopic string
+	SpamChecker          spamcheck.Checker
 
-	workers sync.Map // room ID -> *inputWorker
+	workers     sync.Map // room ID -> *inputWorker
+	slotsOnce   sync.Once
+	workerSlots chan struct{} // limits how many rooms are processed at once, nil if unlimited
 }
 
 type inputTask struct {
@@ -60,11 +66,20 @@ func (w *inputWorker) start() {
 	for {
 		select {
 		case task := <-w.input:
+			// Each room only has one worker, so events in the same room are
+			// processed in order, but we also have to wait for a free slot
+			// in the pool before processing events in any room.
+			if w.r.workerSlots != nil {
+				w.r.workerSlots <- struct{}{}
+			}
 			hooks.Run(hooks.KindNewEventReceived, task.event.Event)
 			_, task.err = w.r.processRoomEvent(task.ctx, task.event)
 			if task.err == nil {
 				hooks.Run(hooks.KindNewEventPersisted, task.event.Event)
 			}
+			if w.r.workerSlots != nil {
+				<-w.r.workerSlots
+			}
 			task.wg.Done()
 		case <-time.After(time.Second * 5):
 			return
@@ -123,6 +138,11 @@ func (r *Inputer) InputRoomEvents(
 	// Create a wait group. Each task that we dispatch will call Done on
 	// this wait group so that we know when all of our events have been
 	// processed.
+	r.slotsOnce.Do(func() {
+		if r.Cfg.InputWorkers > 0 {
+			r.workerSlots = make(chan struct{}, r.Cfg.InputWorkers)
+		}
+	})
 	wg := &sync.WaitGroup{}
 	wg.Add(len(request.InputRoomEvents))
 	tasks := make([]*inputTask, len(request.InputRoomEvents))
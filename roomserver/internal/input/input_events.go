@@ -68,6 +68,27 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
+	// Local users can't create rooms if they are already in as many rooms
+	// as they are allowed to be.
+	if input.Kind == api.KindNew && event.Type() == gomatrixserverlib.MRoomCreate {
+		if _, domain, serr := gomatrixserverlib.SplitID('@', event.Sender()); serr == nil && domain == r.ServerName {
+			if err = helpers.CheckRoomsPerUserLimit(ctx, r.DB, r.Cfg, event.Sender()); err != nil {
+				if perr, ok := err.(*api.PerformError); ok {
+					return "", &gomatrixserverlib.NotAllowed{Message: perr.Msg}
+				}
+				return "", err
+			}
+		}
+	}
+
+	// Give the spam checker a chance to reject new events before we do
+	// anything else with them.
+	if input.Kind == api.KindNew {
+		if err = r.SpamChecker.CheckEventAllowed(ctx, headered); err != nil {
+			return "", &gomatrixserverlib.NotAllowed{Message: err.Error()}
+		}
+	}
+
 	// Check that the event passes authentication checks and work out
 	// the numeric IDs for the auth events.
 	isRejected := false
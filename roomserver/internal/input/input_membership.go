@@ -145,11 +145,20 @@ func (r *Inputer) isLocalTarget(event *gomatrixserverlib.Event) bool {
 func updateToJoinMembership(
 	mu *shared.MembershipUpdater, add *gomatrixserverlib.Event, updates []api.OutputEvent,
 ) ([]api.OutputEvent, error) {
+	// Every join event, including those which only change the profile, updates
+	// the profile in the user directory.
+	content, err := gomatrixserverlib.NewMemberContentFromEvent(add)
+	if err != nil {
+		return nil, err
+	}
+	if err = mu.SetProfile(content.DisplayName, content.AvatarURL); err != nil {
+		return nil, err
+	}
 	// If the user is already marked as being joined, we call SetToJoin to update
 	// the event ID then we can return immediately. Retired is ignored as there
 	// is no invite event to retire.
 	if mu.IsJoin() {
-		_, err := mu.SetToJoin(add.Sender(), add.EventID(), true)
+		_, err = mu.SetToJoin(add.Sender(), add.EventID(), true)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,204 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/hooks"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// inputTestDB already knows about every event, so that outliers are accepted
+// without needing the rest of the database.
+type inputTestDB struct {
+	storage.Database
+	events map[string]*gomatrixserverlib.Event
+}
+
+func (db *inputTestDB) SupportsConcurrentRoomInputs() bool {
+	return true
+}
+
+func (db *inputTestDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventID := range eventIDs {
+		if ev, ok := db.events[eventID]; ok {
+			result = append(result, types.Event{Event: ev})
+		}
+	}
+	return result, nil
+}
+
+var (
+	onReceivedMu sync.Mutex
+	onReceived   func(ev *gomatrixserverlib.HeaderedEvent)
+)
+
+func init() {
+	hooks.Enable()
+	hooks.Attach(hooks.KindNewEventReceived, func(data interface{}) {
+		onReceivedMu.Lock()
+		cb := onReceived
+		onReceivedMu.Unlock()
+		if cb != nil {
+			cb(data.(*gomatrixserverlib.HeaderedEvent))
+		}
+	})
+}
+
+// mustInputRoomEvents sends a few outliers in each of the rooms in a single
+// request, with the given number of input workers, calling received as each
+// event is processed.
+func mustInputRoomEvents(
+	t *testing.T, workers int, roomIDs []string, received func(ev *gomatrixserverlib.HeaderedEvent),
+) (sent map[string][]string) {
+	t.Helper()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	db := &inputTestDB{events: map[string]*gomatrixserverlib.Event{}}
+	sent = map[string][]string{}
+	request := &api.InputRoomEventsRequest{}
+	for i := 0; i < 3; i++ {
+		for _, roomID := range roomIDs {
+			eb := gomatrixserverlib.EventBuilder{
+				Sender: "@alice:localhost",
+				RoomID: roomID,
+				Type:   "m.room.message",
+				Depth:  int64(i + 1),
+			}
+			if err := eb.SetContent(map[string]interface{}{"body": fmt.Sprintf("message %d", i)}); err != nil {
+				t.Fatalf("failed to set content: %s", err)
+			}
+			ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+			if err != nil {
+				t.Fatalf("failed to build event: %s", err)
+			}
+			db.events[ev.EventID()] = ev
+			sent[roomID] = append(sent[roomID], ev.EventID())
+			request.InputRoomEvents = append(request.InputRoomEvents, api.InputRoomEvent{
+				Kind:  api.KindOutlier,
+				Event: ev.Headered(gomatrixserverlib.RoomVersionV4),
+			})
+		}
+	}
+
+	onReceivedMu.Lock()
+	onReceived = received
+	onReceivedMu.Unlock()
+	defer func() {
+		onReceivedMu.Lock()
+		onReceived = nil
+		onReceivedMu.Unlock()
+	}()
+
+	r := &Inputer{
+		DB:          db,
+		Cfg:         &config.RoomServer{InputWorkers: workers},
+		SpamChecker: spamcheck.NopChecker{},
+	}
+	response := &api.InputRoomEventsResponse{}
+	r.InputRoomEvents(context.Background(), request, response)
+	if response.ErrMsg != "" {
+		t.Fatalf("InputRoomEvents failed: %s", response.ErrMsg)
+	}
+	return sent
+}
+
+func TestInputWorkersSerializeRooms(t *testing.T) {
+	roomIDs := []string{"!a:localhost", "!b:localhost"}
+	var mu sync.Mutex
+	active := map[string]int{}
+	processed := map[string][]string{}
+	bothStarted := make(chan struct{})
+	var errs []string
+
+	sent := mustInputRoomEvents(t, 2, roomIDs, func(ev *gomatrixserverlib.HeaderedEvent) {
+		roomID := ev.RoomID()
+		mu.Lock()
+		active[roomID]++
+		if active[roomID] > 1 {
+			errs = append(errs, "events in room "+roomID+" were processed at the same time")
+		}
+		first := len(processed[roomID]) == 0
+		processed[roomID] = append(processed[roomID], ev.EventID())
+		if first && len(processed) == len(roomIDs) {
+			close(bothStarted)
+		}
+		mu.Unlock()
+
+		// The first event in each room waits for the other room to start, which
+		// only happens if the rooms are processed in parallel.
+		if first {
+			select {
+			case <-bothStarted:
+			case <-time.After(5 * time.Second):
+				mu.Lock()
+				errs = append(errs, "room "+roomID+" wasn't processed at the same time as the other room")
+				mu.Unlock()
+			}
+		}
+
+		mu.Lock()
+		active[roomID]--
+		mu.Unlock()
+	})
+
+	for _, err := range errs {
+		t.Error(err)
+	}
+	for _, roomID := range roomIDs {
+		if fmt.Sprint(processed[roomID]) != fmt.Sprint(sent[roomID]) {
+			t.Errorf("room %s: got events processed in order %v, want %v", roomID, processed[roomID], sent[roomID])
+		}
+	}
+}
+
+func TestInputWorkersLimitRooms(t *testing.T) {
+	roomIDs := []string{"!a:localhost", "!b:localhost", "!c:localhost"}
+	var mu sync.Mutex
+	active, maxActive, count := 0, 0, 0
+
+	mustInputRoomEvents(t, 1, roomIDs, func(ev *gomatrixserverlib.HeaderedEvent) {
+		mu.Lock()
+		active++
+		count++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		// Give the other rooms a chance to start, if they are allowed to.
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+
+	if count != 3*len(roomIDs) {
+		t.Errorf("got %d events processed, want %d", count, 3*len(roomIDs))
+	}
+	if maxActive != 1 {
+		t.Errorf("got %d rooms processed at the same time, want 1", maxActive)
+	}
+}
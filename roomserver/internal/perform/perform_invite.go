@@ -126,6 +126,14 @@ func (r *Inviter) PerformInvite(
 		return nil, nil
 	}
 
+	if err = r.Inputer.SpamChecker.CheckInviteAllowed(ctx, event.Sender(), targetUserID, roomID); err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  err.Error(),
+		}
+		return nil, nil
+	}
+
 	if isOriginLocal {
 		// The invite originated locally. Therefore we have a responsibility to
 		// try and see if the user is allowed to make this invite. We can't do
@@ -219,7 +227,11 @@ func buildInviteStrippedState(
 	info *types.RoomInfo,
 	input *api.PerformInviteRequest,
 ) ([]gomatrixserverlib.InviteV2StrippedState, error) {
-	stateWanted := []gomatrixserverlib.StateKeyTuple{}
+	// The membership of the inviter tells the invitee who invited them, even
+	// if they have a display name or avatar in the room.
+	stateWanted := []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: input.Event.Sender()},
+	}
 	// "If they are set on the room, at least the state for m.room.avatar, m.room.canonical_alias, m.room.join_rules, and m.room.name SHOULD be included."
 	// https://matrix.org/docs/spec/client_server/r0.6.0#m-room-member
 	for _, t := range []string{
@@ -247,10 +259,9 @@ func buildInviteStrippedState(
 	if err != nil {
 		return nil, err
 	}
-	inviteState := []gomatrixserverlib.InviteV2StrippedState{
-		gomatrixserverlib.NewInviteV2StrippedState(input.Event.Event),
-	}
-	stateEvents = append(stateEvents, types.Event{Event: input.Event.Unwrap()})
+	// The invite itself isn't included, as the sync API adds it to the
+	// invite state of the room anyway.
+	inviteState := []gomatrixserverlib.InviteV2StrippedState{}
 	for _, event := range stateEvents {
 		inviteState = append(inviteState, gomatrixserverlib.NewInviteV2StrippedState(event.Event))
 	}
@@ -237,8 +237,15 @@ func (r *Joiner) performJoinRoomByID(
 		}
 
 		// If we haven't already joined the room then send an event
-		// into the room changing our membership status.
+		// into the room changing our membership status, as long as
+		// that doesn't take the user or the room over their limits.
 		if !alreadyJoined {
+			if err = helpers.CheckRoomsPerUserLimit(ctx, r.DB, r.Cfg, userID); err != nil {
+				return "", "", err
+			}
+			if err = helpers.CheckMembersPerRoomLimit(ctx, r.DB, r.Cfg, req.RoomIDOrAlias); err != nil {
+				return "", "", err
+			}
 			inputReq := api.InputRoomEventsRequest{
 				InputRoomEvents: []api.InputRoomEvent{
 					{
@@ -295,6 +302,12 @@ func (r *Joiner) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
 ) (gomatrixserverlib.ServerName, error) {
+	// We can't know how many members a remote room has until we've joined,
+	// but we can stop the user from joining too many rooms.
+	if err := helpers.CheckRoomsPerUserLimit(ctx, r.DB, r.Cfg, req.UserID); err != nil {
+		return "", err
+	}
+
 	// Try joining by all of the supplied server names.
 	fedReq := fsAPI.PerformJoinRequest{
 		RoomID:      req.RoomIDOrAlias, // the room ID to try and join
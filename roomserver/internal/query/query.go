@@ -19,7 +19,6 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -28,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
@@ -37,6 +37,7 @@ type Queryer struct {
 	DB         storage.Database
 	Cache      caching.RoomServerCaches
 	ServerACLs *acls.ServerACLs
+	Cfg        *config.RoomServer
 }
 
 // QueryLatestEventsAndState implements api.RoomserverInternalAPI
@@ -163,7 +164,20 @@ func (r *Queryer) QueryEventsByID(
 	request *api.QueryEventsByIDRequest,
 	response *api.QueryEventsByIDResponse,
 ) error {
-	eventNIDMap, err := r.DB.EventNIDs(ctx, request.EventIDs)
+	// Serve what we can from the cache and only go to the database for the rest.
+	var uncachedEventIDs []string
+	for _, eventID := range request.EventIDs {
+		if event, ok := r.Cache.GetRoomServerEvent(eventID); ok {
+			response.Events = append(response.Events, event)
+		} else {
+			uncachedEventIDs = append(uncachedEventIDs, eventID)
+		}
+	}
+	if len(uncachedEventIDs) == 0 {
+		return nil
+	}
+
+	eventNIDMap, err := r.DB.EventNIDs(ctx, uncachedEventIDs)
 	if err != nil {
 		return err
 	}
@@ -184,7 +198,9 @@ func (r *Queryer) QueryEventsByID(
 			return verr
 		}
 
-		response.Events = append(response.Events, event.Headered(roomVersion))
+		headered := event.Headered(roomVersion)
+		r.Cache.StoreRoomServerEvent(headered)
+		response.Events = append(response.Events, headered)
 	}
 
 	return nil
@@ -371,6 +387,18 @@ func (r *Queryer) QueryServerAllowedToSeeEvent(
 	return
 }
 
+// QueryEventNearestTimestamp implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventNearestTimestamp(
+	ctx context.Context,
+	request *api.QueryEventNearestTimestampRequest,
+	response *api.QueryEventNearestTimestampResponse,
+) (err error) {
+	response.EventID, response.OriginServerTS, err = r.DB.EventNearestTimestamp(
+		ctx, request.RoomID, request.Timestamp, request.Backwards,
+	)
+	return
+}
+
 // QueryMissingEvents implements api.RoomserverInternalAPI
 // nolint:gocyclo
 func (r *Queryer) QueryMissingEvents(
@@ -567,7 +595,7 @@ func (r *Queryer) QueryRoomVersionCapabilities(
 	request *api.QueryRoomVersionCapabilitiesRequest,
 	response *api.QueryRoomVersionCapabilitiesResponse,
 ) error {
-	response.DefaultRoomVersion = version.DefaultRoomVersion()
+	response.DefaultRoomVersion = r.Cfg.DefaultRoomVersion
 	response.AvailableRoomVersions = make(map[gomatrixserverlib.RoomVersion]string)
 	for v, desc := range version.SupportedRoomVersions() {
 		if desc.Stable {
@@ -651,11 +679,7 @@ func (r *Queryer) QueryKnownUsers(ctx context.Context, req *api.QueryKnownUsersR
 	if err != nil {
 		return err
 	}
-	for _, user := range users {
-		res.Users = append(res.Users, authtypes.FullyQualifiedProfile{
-			UserID: user,
-		})
-	}
+	res.Users = users
 	return nil
 }
 
@@ -0,0 +1,78 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// PurgeExpiredEvents deletes the events in each room which are older than
+// the room's retention policy allows, as bounded by the server's retention
+// configuration.
+func (r *RoomserverInternalAPI) PurgeExpiredEvents(ctx context.Context) error {
+	roomIDs, err := r.DB.GetKnownRooms(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetKnownRooms: %w", err)
+	}
+	now := time.Now()
+	for _, roomID := range roomIDs {
+		logger := logrus.WithField("room_id", roomID)
+		purged, err := r.purgeExpiredEventsInRoom(ctx, roomID, now)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to purge expired events")
+			continue
+		}
+		if purged > 0 {
+			logger.Infof("Purged %d expired events", purged)
+		}
+	}
+	return nil
+}
+
+func (r *RoomserverInternalAPI) purgeExpiredEventsInRoom(ctx context.Context, roomID string, now time.Time) (int, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return 0, nil
+	}
+	retention, err := r.DB.GetStateEvent(ctx, roomID, eventutil.MRoomRetention, "")
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	maxLifetime := eventutil.RetentionMaxLifetime(&r.Cfg.Matrix.Retention, retention)
+	if maxLifetime == 0 {
+		return 0, nil
+	}
+	return r.DB.PurgeEventsBefore(ctx, roomID, gomatrixserverlib.AsTimestamp(now.Add(-maxLifetime)))
+}
+
+// purgeExpiredEventsPeriodically runs PurgeExpiredEvents every purge interval.
+func (r *RoomserverInternalAPI) purgeExpiredEventsPeriodically() {
+	ticker := time.NewTicker(r.Cfg.Matrix.Retention.PurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.PurgeExpiredEvents(context.Background()); err != nil {
+			logrus.WithError(err).Error("Failed to purge expired events")
+		}
+	}
+}
@@ -44,6 +44,7 @@ const (
 	RoomserverQueryMembershipsForRoomPath      = "/roomserver/queryMembershipsForRoom"
 	RoomserverQueryServerJoinedToRoomPath      = "/roomserver/queryServerJoinedToRoomPath"
 	RoomserverQueryServerAllowedToSeeEventPath = "/roomserver/queryServerAllowedToSeeEvent"
+	RoomserverQueryEventNearestTimestampPath   = "/roomserver/queryEventNearestTimestamp"
 	RoomserverQueryMissingEventsPath           = "/roomserver/queryMissingEvents"
 	RoomserverQueryStateAndAuthChainPath       = "/roomserver/queryStateAndAuthChain"
 	RoomserverQueryRoomVersionCapabilitiesPath = "/roomserver/queryRoomVersionCapabilities"
@@ -378,6 +379,19 @@ func (h *httpRoomserverInternalAPI) QueryServerAllowedToSeeEvent(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryEventNearestTimestamp implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryEventNearestTimestamp(
+	ctx context.Context,
+	request *api.QueryEventNearestTimestampRequest,
+	response *api.QueryEventNearestTimestampResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventNearestTimestamp")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventNearestTimestampPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMissingEvents implements RoomServerQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -220,6 +220,20 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(
+		RoomserverQueryEventNearestTimestampPath,
+		httputil.MakeInternalAPI("queryEventNearestTimestamp", func(req *http.Request) util.JSONResponse {
+			var request api.QueryEventNearestTimestampRequest
+			var response api.QueryEventNearestTimestampResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryEventNearestTimestamp(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverQueryMissingEventsPath,
 		httputil.MakeInternalAPI("queryMissingEvents", func(req *http.Request) util.JSONResponse {
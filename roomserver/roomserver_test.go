@@ -17,10 +17,13 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 const (
@@ -92,6 +95,7 @@ type fledglingEvent struct {
 	Content  interface{}
 	Sender   string
 	RoomID   string
+	Time     time.Time // defaults to now
 }
 
 func mustCreateEvents(t *testing.T, roomVer gomatrixserverlib.RoomVersion, events []fledglingEvent) (result []*gomatrixserverlib.HeaderedEvent) {
@@ -126,7 +130,11 @@ func mustCreateEvents(t *testing.T, roomVer gomatrixserverlib.RoomVersion, event
 			}
 		}
 		eb.AuthEvents = authEvents
-		signedEvent, err := eb.Build(time.Now(), testOrigin, "ed25519:test", key, roomVer)
+		ts := ev.Time
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		signedEvent, err := eb.Build(ts, testOrigin, "ed25519:test", key, roomVer)
 		if err != nil {
 			t.Fatalf("mustCreateEvent: failed to sign event: %s", err)
 		}
@@ -157,6 +165,10 @@ func mustLoadRawEvents(t *testing.T, ver gomatrixserverlib.RoomVersion, events [
 }
 
 func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyProducer) {
+	return mustCreateRoomserverAPIWithSpamChecker(t, spamcheck.NopChecker{})
+}
+
+func mustCreateRoomserverAPIWithSpamChecker(t *testing.T, spamChecker spamcheck.Checker) (api.RoomserverInternalAPI, *dummyProducer) {
 	t.Helper()
 	cfg := &config.Dendrite{}
 	cfg.Defaults()
@@ -168,7 +180,7 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 	dp := &dummyProducer{
 		topic: cfg.Global.Kafka.TopicFor(config.TopicOutputRoomEvent),
 	}
-	cache, err := caching.NewInMemoryLRUCache(false)
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
 	if err != nil {
 		t.Fatalf("failed to make caches: %s", err)
 	}
@@ -182,7 +194,7 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 	}
 	return internal.NewRoomserverAPI(
 		&cfg.RoomServer, roomserverDB, dp, string(cfg.Global.Kafka.TopicFor(config.TopicOutputRoomEvent)),
-		base.Caches, &test.NopJSONVerifier{}, nil,
+		base.Caches, &test.NopJSONVerifier{}, nil, spamChecker,
 	), dp
 }
 
@@ -406,3 +418,656 @@ func TestOutputRewritesState(t *testing.T) {
 		t.Errorf("Output event did not overwrite room state")
 	}
 }
+
+// inviteBlockingChecker refuses invites for one user.
+type inviteBlockingChecker struct {
+	spamcheck.NopChecker
+	blocked string
+}
+
+func (c *inviteBlockingChecker) CheckInviteAllowed(ctx context.Context, inviterUserID, inviteeUserID, roomID string) error {
+	if inviteeUserID == c.blocked {
+		return fmt.Errorf("invites for %s are blocked", inviteeUserID)
+	}
+	return nil
+}
+
+func TestSpamCheckerBlocksInvite(t *testing.T) {
+	alice, bob, emptyStateKey := "@alice:kaer.morhen", "@bob:kaer.morhen", ""
+	roomID := "!spam:kaer.morhen"
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "join"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "invite"}},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPIWithSpamChecker(t, &inviteBlockingChecker{blocked: bob})
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:2], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	res := &api.PerformInviteResponse{}
+	if err := rsAPI.PerformInvite(ctx, &api.PerformInviteRequest{
+		RoomVersion: gomatrixserverlib.RoomVersionV4,
+		Event:       events[2],
+	}, res); err != nil {
+		t.Fatalf("PerformInvite failed: %s", err)
+	}
+	if res.Error == nil || res.Error.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("got error %+v, want the invite to be refused", res.Error)
+	}
+	if res.Error.Msg != "invites for @bob:kaer.morhen are blocked" {
+		t.Errorf("got error message %q, want the checker's reason", res.Error.Msg)
+	}
+}
+
+// messageBlockingChecker refuses messages with a given body.
+type messageBlockingChecker struct {
+	spamcheck.NopChecker
+	body string
+}
+
+func (c *messageBlockingChecker) CheckEventAllowed(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error {
+	if gjson.GetBytes(event.Content(), "body").Str == c.body {
+		return fmt.Errorf("message from %s looks like spam", event.Sender())
+	}
+	return nil
+}
+
+func TestSpamCheckerBlocksEvent(t *testing.T) {
+	alice, emptyStateKey := "@alice:kaer.morhen", ""
+	roomID := "!spamevent:kaer.morhen"
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "join"}},
+		{Type: "m.room.message", Sender: alice, RoomID: roomID, Content: map[string]interface{}{"msgtype": "m.text", "body": "spam"}},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPIWithSpamChecker(t, &messageBlockingChecker{body: "spam"})
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:2], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	err := api.SendEvents(ctx, rsAPI, api.KindNew, events[2:], testOrigin, nil)
+	if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok {
+		t.Fatalf("got error %v, want the message to be refused", err)
+	}
+	// Outliers have already been accepted elsewhere, so aren't checked.
+	if err = api.SendEvents(ctx, rsAPI, api.KindOutlier, events[2:], testOrigin, nil); err != nil {
+		t.Errorf("got error %v, want the outlier to be stored", err)
+	}
+}
+
+func TestInviteRoomState(t *testing.T) {
+	alice, bob, emptyStateKey := "@alice:kaer.morhen", "@bob:kaer.morhen", ""
+	roomID := "!invite:kaer.morhen"
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "join", "displayname": "Alice"}},
+		{Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"join_rule": "invite"}},
+		{Type: gomatrixserverlib.MRoomName, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"name": "Kaer Morhen"}},
+		{Type: "m.room.avatar", StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"url": "mxc://kaer.morhen/avatar"}},
+		{Type: gomatrixserverlib.MRoomCanonicalAlias, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"alias": "#keep:kaer.morhen"}},
+		{Type: "m.room.topic", StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"topic": "not stripped"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "invite"}},
+	})
+	deleteDatabase()
+	rsAPI, producer := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:7], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	producer.producedMessages = nil
+
+	res := &api.PerformInviteResponse{}
+	if err := rsAPI.PerformInvite(ctx, &api.PerformInviteRequest{
+		RoomVersion:  gomatrixserverlib.RoomVersionV4,
+		Event:        events[7],
+		SendAsServer: string(testOrigin),
+	}, res); err != nil {
+		t.Fatalf("PerformInvite failed: %s", err)
+	}
+	if res.Error != nil {
+		t.Fatalf("PerformInvite returned error: %+v", res.Error)
+	}
+
+	var invite *gomatrixserverlib.HeaderedEvent
+	for _, msg := range producer.producedMessages {
+		if msg.Type == api.OutputTypeNewInviteEvent {
+			invite = msg.NewInviteEvent.Event
+		}
+	}
+	if invite == nil {
+		t.Fatalf("no invite event was output")
+	}
+	var unsigned struct {
+		InviteRoomState []gomatrixserverlib.InviteV2StrippedState `json:"invite_room_state"`
+	}
+	if err := json.Unmarshal(invite.Unsigned(), &unsigned); err != nil {
+		t.Fatalf("failed to unmarshal invite_room_state: %s", err)
+	}
+	strippedState := unsigned.InviteRoomState
+	want := map[gomatrixserverlib.StateKeyTuple]string{
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: alice}:      `{"displayname":"Alice","membership":"join"}`,
+		{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}:      `{"join_rule":"invite"}`,
+		{EventType: gomatrixserverlib.MRoomName, StateKey: ""}:           `{"name":"Kaer Morhen"}`,
+		{EventType: "m.room.avatar", StateKey: ""}:                       `{"url":"mxc://kaer.morhen/avatar"}`,
+		{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}: `{"alias":"#keep:kaer.morhen"}`,
+	}
+	if len(strippedState) != len(want) {
+		t.Errorf("got %d stripped state events, want %d", len(strippedState), len(want))
+	}
+	for _, ev := range strippedState {
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}
+		if content, ok := want[tuple]; !ok {
+			t.Errorf("got unexpected stripped state event %+v", tuple)
+		} else if string(ev.Content()) != content {
+			t.Errorf("got content %s for %+v, want %s", string(ev.Content()), tuple, content)
+		}
+	}
+}
+
+// mustCreateRedaction builds a redaction of the target event which follows on
+// from the previous event, authed by the given events.
+func mustCreateRedaction(
+	t *testing.T, sender string, target, prev *gomatrixserverlib.HeaderedEvent, authEvents ...*gomatrixserverlib.HeaderedEvent,
+) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		Depth:      prev.Depth() + 1,
+		Type:       gomatrixserverlib.MRoomRedaction,
+		RoomID:     target.RoomID(),
+		Redacts:    target.EventID(),
+		PrevEvents: []string{prev.EventID()},
+	}
+	if err := eb.SetContent(map[string]interface{}{}); err != nil {
+		t.Fatalf("mustCreateRedaction: failed to set content: %s", err)
+	}
+	authEventIDs := make([]string, 0, len(authEvents))
+	for _, ev := range authEvents {
+		authEventIDs = append(authEventIDs, ev.EventID())
+	}
+	eb.AuthEvents = authEventIDs
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := eb.Build(time.Now(), testOrigin, "ed25519:test", key, target.RoomVersion)
+	if err != nil {
+		t.Fatalf("mustCreateRedaction: failed to sign event: %s", err)
+	}
+	return ev.Headered(target.RoomVersion)
+}
+
+func TestRedactionRequiresPowerOrAuthorship(t *testing.T) {
+	alice, bob, emptyStateKey := "@alice:kaer.morhen", "@bob:kaer.morhen", ""
+	roomID := "!redact:kaer.morhen"
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "join"}},
+		{Type: gomatrixserverlib.MRoomPowerLevels, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"users": map[string]int{alice: 100}, "redact": 50}},
+		{Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"join_rule": "public"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Sender: bob, RoomID: roomID, Content: map[string]interface{}{"membership": "join"}},
+		{Type: "m.room.message", Sender: alice, RoomID: roomID, Content: map[string]interface{}{"body": "from alice"}},
+		{Type: "m.room.message", Sender: bob, RoomID: roomID, Content: map[string]interface{}{"body": "from bob"}},
+	})
+	create, powerLevels, bobJoin := events[0], events[2], events[4]
+	aliceMessage, bobMessage := events[5], events[6]
+	// bob, who has the default power level of 0, tries to redact alice's
+	// message and then redacts his own.
+	bobRedactsAlice := mustCreateRedaction(t, bob, aliceMessage, bobMessage, create, powerLevels, bobJoin)
+	bobRedactsBob := mustCreateRedaction(t, bob, bobMessage, bobRedactsAlice, create, powerLevels, bobJoin)
+	events = append(events, bobRedactsAlice, bobRedactsBob)
+
+	deleteDatabase()
+	rsAPI, producer := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	var redactedEventIDs []string
+	for _, msg := range producer.producedMessages {
+		if msg.Type == api.OutputTypeRedactedEvent {
+			redactedEventIDs = append(redactedEventIDs, msg.RedactedEvent.RedactedEventID)
+		}
+	}
+	if len(redactedEventIDs) != 1 || redactedEventIDs[0] != bobMessage.EventID() {
+		t.Fatalf("got redacted events %v, want only bob's message %s", redactedEventIDs, bobMessage.EventID())
+	}
+}
+
+func TestQueryEventsByIDUsesEventCache(t *testing.T) {
+	alice, emptyStateKey := "@alice:kaer.morhen", ""
+	roomID := "!cache:kaer.morhen"
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "join"}},
+		{Type: "m.room.message", Sender: alice, RoomID: roomID, Content: map[string]interface{}{"body": "hello"}},
+		{Type: "m.room.message", Sender: alice, RoomID: roomID, Content: map[string]interface{}{"body": "never sent"}},
+	})
+	message, unsent := events[2], events[3]
+	redaction := mustCreateRedaction(t, alice, message, message, events[0], events[1])
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	cache := rsAPI.(*internal.RoomserverInternalAPI).Cache
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:3], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	queryBody := func(eventID string) (string, bool) {
+		t.Helper()
+		res := &api.QueryEventsByIDResponse{}
+		if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: []string{eventID}}, res); err != nil {
+			t.Fatalf("QueryEventsByID failed: %s", err)
+		}
+		if len(res.Events) != 1 {
+			return "", false
+		}
+		var content struct {
+			Body string `json:"body"`
+		}
+		_ = json.Unmarshal(res.Events[0].Content(), &content)
+		return content.Body, true
+	}
+
+	// Loading an event from the database caches it.
+	if body, _ := queryBody(message.EventID()); body != "hello" {
+		t.Fatalf("got body %q, want the message", body)
+	}
+	if _, ok := cache.GetRoomServerEvent(message.EventID()); !ok {
+		t.Fatalf("event wasn't cached")
+	}
+
+	// Cached events are served without going to the database.
+	if _, found := queryBody(unsent.EventID()); found {
+		t.Fatalf("found an event which was never sent")
+	}
+	cache.StoreRoomServerEvent(unsent)
+	if body, _ := queryBody(unsent.EventID()); body != "never sent" {
+		t.Errorf("got body %q, want the cached event", body)
+	}
+
+	// Changing an event from the cache doesn't change the cached copy.
+	cached, _ := cache.GetRoomServerEvent(unsent.EventID())
+	if err := cached.SetUnsignedField("changed", true); err != nil {
+		t.Fatalf("SetUnsignedField failed: %s", err)
+	}
+	if cached, _ = cache.GetRoomServerEvent(unsent.EventID()); len(cached.Unsigned()) != 0 {
+		t.Errorf("got unsigned %s on the cached event, want it unchanged", string(cached.Unsigned()))
+	}
+
+	// Redacting the event invalidates the cache.
+	stale, _ := cache.GetRoomServerEvent(message.EventID())
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{redaction}, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	if _, ok := cache.GetRoomServerEvent(message.EventID()); ok {
+		t.Errorf("redacted event is still cached")
+	}
+
+	// A copy loaded before the redaction can't be cached again.
+	cache.StoreRoomServerEvent(stale)
+	if _, ok := cache.GetRoomServerEvent(message.EventID()); ok {
+		t.Errorf("stale copy of the redacted event was cached")
+	}
+	if body, found := queryBody(message.EventID()); !found || body != "" {
+		t.Errorf("got body %q after redaction, want it redacted", body)
+	}
+}
+
+func TestEventAuthChainUsesCache(t *testing.T) {
+	alice, emptyStateKey := "@alice:kaer.morhen", ""
+	roomID := "!authchain:kaer.morhen"
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "join"}},
+		{Type: gomatrixserverlib.MRoomPowerLevels, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"users": map[string]interface{}{alice: 100}}},
+		{Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"join_rule": "public"}},
+		{Type: "m.room.message", Sender: alice, RoomID: roomID, Content: map[string]interface{}{"body": "hello"}},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	eventNIDs, err := internalAPI.DB.EventNIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatalf("EventNIDs failed: %s", err)
+	}
+
+	// Work out the auth chains by following the auth events.
+	byID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(events))
+	for _, ev := range events {
+		byID[ev.EventID()] = ev
+	}
+	var walk func(eventID string, chain map[types.EventNID]bool)
+	walk = func(eventID string, chain map[types.EventNID]bool) {
+		for _, authEventID := range byID[eventID].AuthEventIDs() {
+			chain[eventNIDs[authEventID]] = true
+			walk(authEventID, chain)
+		}
+	}
+
+	// The auth chains from the database match, and are cached.
+	for _, ev := range events {
+		want := map[types.EventNID]bool{}
+		walk(ev.EventID(), want)
+		eventNID := eventNIDs[ev.EventID()]
+		got, err := internalAPI.DB.EventAuthChain(ctx, eventNID)
+		if err != nil {
+			t.Fatalf("EventAuthChain failed: %s", err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("event %s of type %s: got auth chain %v, want %v", ev.EventID(), ev.Type(), got, want)
+		}
+		for _, nid := range got {
+			if !want[nid] {
+				t.Errorf("event %s of type %s: got auth chain %v, want %v", ev.EventID(), ev.Type(), got, want)
+			}
+		}
+		if cached, ok := internalAPI.Cache.GetRoomServerAuthChain(eventNID); !ok || !reflect.DeepEqual(cached, got) {
+			t.Errorf("event %s of type %s: got cached auth chain %v, want %v", ev.EventID(), ev.Type(), cached, got)
+		}
+	}
+
+	// Cached auth chains are served without going to the database, which
+	// doesn't know about this event at all.
+	unknown := types.EventNID(1000)
+	fake := []types.EventNID{eventNIDs[events[0].EventID()]}
+	internalAPI.Cache.StoreRoomServerAuthChain(unknown, fake)
+	got, err := internalAPI.DB.EventAuthChain(ctx, unknown)
+	if err != nil {
+		t.Fatalf("EventAuthChain failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, fake) {
+		t.Errorf("got auth chain %v, want the cached auth chain %v", got, fake)
+	}
+}
+
+func TestStateResolutionPicksEventFromAuthChainDifference(t *testing.T) {
+	alice, bob, emptyStateKey := "@alice:kaer.morhen", "@bob:kaer.morhen", ""
+	roomID := "!authdifference:kaer.morhen"
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	start := time.Now()
+	var events []*gomatrixserverlib.HeaderedEvent
+	build := func(eventType, sender string, content map[string]interface{}, prev *gomatrixserverlib.HeaderedEvent, authEvents ...*gomatrixserverlib.HeaderedEvent) *gomatrixserverlib.HeaderedEvent {
+		t.Helper()
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:   sender,
+			Depth:    int64(len(events) + 1),
+			Type:     eventType,
+			StateKey: &emptyStateKey,
+			RoomID:   roomID,
+		}
+		if eventType == gomatrixserverlib.MRoomMember {
+			eb.StateKey = &sender
+		}
+		if prev != nil {
+			eb.PrevEvents = []string{prev.EventID()}
+		}
+		authEventIDs := make([]string, 0, len(authEvents))
+		for _, authEvent := range authEvents {
+			authEventIDs = append(authEventIDs, authEvent.EventID())
+		}
+		eb.AuthEvents = authEventIDs
+		if err := eb.SetContent(content); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		ev, err := eb.Build(start.Add(time.Duration(len(events))*time.Second), testOrigin, "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		events = append(events, ev.Headered(gomatrixserverlib.RoomVersionV4))
+		return events[len(events)-1]
+	}
+
+	create := build(gomatrixserverlib.MRoomCreate, alice, map[string]interface{}{"creator": alice, "room_version": "4"}, nil)
+	aliceJoin := build(gomatrixserverlib.MRoomMember, alice, map[string]interface{}{"membership": "join"}, create, create)
+	powerLevels := build(gomatrixserverlib.MRoomPowerLevels, alice, map[string]interface{}{"users": map[string]interface{}{alice: 100, bob: 50}}, aliceJoin, create, aliceJoin)
+	inviteOnly := build(gomatrixserverlib.MRoomJoinRules, alice, map[string]interface{}{"join_rule": "invite"}, powerLevels, create, powerLevels, aliceJoin)
+	// On one side, alice makes the room public, which lets bob join and then
+	// change the join rules back.
+	public := build(gomatrixserverlib.MRoomJoinRules, alice, map[string]interface{}{"join_rule": "public"}, inviteOnly, create, powerLevels, aliceJoin)
+	bobJoin := build(gomatrixserverlib.MRoomMember, bob, map[string]interface{}{"membership": "join"}, public, create, powerLevels, public)
+	// On the other side, alice takes bob's power away.
+	demoteBob := build(gomatrixserverlib.MRoomPowerLevels, alice, map[string]interface{}{"users": map[string]interface{}{alice: 100, bob: 0}}, inviteOnly, create, powerLevels, aliceJoin)
+	bobInviteOnly := build(gomatrixserverlib.MRoomJoinRules, bob, map[string]interface{}{"join_rule": "invite"}, bobJoin, create, powerLevels, bobJoin)
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	// Neither of the conflicted join rules pass auth once bob is demoted, so
+	// the join rules resolve to the public ones, which are only in the auth
+	// chain difference.
+	var res api.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{bobInviteOnly.EventID(), demoteBob.EventID()},
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+		},
+	}, &res); err != nil {
+		t.Fatalf("QueryStateAfterEvents failed: %s", err)
+	}
+	got := map[string]string{}
+	for _, ev := range res.StateEvents {
+		got[ev.Type()] = ev.EventID()
+	}
+	want := map[string]string{
+		gomatrixserverlib.MRoomJoinRules:   public.EventID(),
+		gomatrixserverlib.MRoomPowerLevels: demoteBob.EventID(),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got resolved state %v, want %v", got, want)
+	}
+}
+
+func TestPurgeExpiredEvents(t *testing.T) {
+	alice, emptyStateKey := "@alice:kaer.morhen", ""
+	roomID := "!retention:kaer.morhen"
+	old := time.Now().Add(-48 * time.Hour)
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Time: old, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Time: old, Content: map[string]interface{}{"membership": "join"}},
+		{Type: "m.room.retention", StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Time: old, Content: map[string]interface{}{"max_lifetime": 86400000}},
+		{Type: "m.room.message", Sender: alice, RoomID: roomID, Time: old, Content: map[string]interface{}{"body": "old message"}},
+		{Type: "m.room.message", Sender: alice, RoomID: roomID, Content: map[string]interface{}{"body": "new message"}},
+	})
+	expired := events[3]
+	// In a room where nothing has happened for a while, the latest event is
+	// kept even though it has expired.
+	quietRoomID := "!quiet:kaer.morhen"
+	quiet := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: quietRoomID, Time: old, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: quietRoomID, Time: old, Content: map[string]interface{}{"membership": "join"}},
+		{Type: "m.room.retention", StateKey: &emptyStateKey, Sender: alice, RoomID: quietRoomID, Time: old, Content: map[string]interface{}{"max_lifetime": 86400000}},
+		{Type: "m.room.message", Sender: alice, RoomID: quietRoomID, Time: old, Content: map[string]interface{}{"body": "old message"}},
+		{Type: "m.room.message", Sender: alice, RoomID: quietRoomID, Time: old, Content: map[string]interface{}{"body": "last message"}},
+	})
+	quietExpired := quiet[3]
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	for _, evs := range [][]*gomatrixserverlib.HeaderedEvent{events, quiet} {
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, evs, testOrigin, nil); err != nil {
+			t.Fatalf("failed to SendEvents: %s", err)
+		}
+	}
+	events = append(events, quiet...)
+	// Load all of the events into the cache, so that we know that purging
+	// the events removes them from there too.
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	res := &api.QueryEventsByIDResponse{}
+	if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: eventIDs}, res); err != nil {
+		t.Fatalf("QueryEventsByID failed: %s", err)
+	}
+	if len(res.Events) != len(events) {
+		t.Fatalf("got %d events before purging, want %d", len(res.Events), len(events))
+	}
+
+	internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+	internalAPI.Cfg.Matrix.Retention.Enabled = true
+	if err := internalAPI.PurgeExpiredEvents(ctx); err != nil {
+		t.Fatalf("PurgeExpiredEvents failed: %s", err)
+	}
+
+	// Only the old messages should have been purged. State events are kept
+	// however old they are.
+	res = &api.QueryEventsByIDResponse{}
+	if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: eventIDs}, res); err != nil {
+		t.Fatalf("QueryEventsByID failed: %s", err)
+	}
+	got := map[string]bool{}
+	for _, ev := range res.Events {
+		got[ev.EventID()] = true
+	}
+	for _, ev := range events {
+		if want := ev != expired && ev != quietExpired; got[ev.EventID()] != want {
+			t.Errorf("event %s of type %s: got present=%v, want %v", ev.EventID(), ev.Type(), got[ev.EventID()], want)
+		}
+	}
+}
+
+func TestQueryKnownUsers(t *testing.T) {
+	alice, bob, charlie, emptyStateKey := "@alice:kaer.morhen", "@bob:kaer.morhen", "@charlie:kaer.morhen", ""
+	sharedRoomID, otherRoomID := "!shared:kaer.morhen", "!other:kaer.morhen"
+	shared := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: sharedRoomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: sharedRoomID, Content: map[string]interface{}{"membership": "join"}},
+		{Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyStateKey, Sender: alice, RoomID: sharedRoomID, Content: map[string]interface{}{"join_rule": "public"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Sender: bob, RoomID: sharedRoomID, Content: map[string]interface{}{"membership": "join", "displayname": "Bobby Tables"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Sender: bob, RoomID: sharedRoomID, Content: map[string]interface{}{"membership": "join", "displayname": "Robert Tables"}},
+	})
+	// charlie is in a room that alice isn't in, so alice can't find him.
+	other := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: charlie, RoomID: otherRoomID, Content: map[string]interface{}{"creator": charlie, "room_version": "4"}},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &charlie, Sender: charlie, RoomID: otherRoomID, Content: map[string]interface{}{"membership": "join", "displayname": "Roberta"}},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, shared[:4], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, other, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	search := func(searchString string) []string {
+		t.Helper()
+		res := &api.QueryKnownUsersResponse{}
+		if err := rsAPI.QueryKnownUsers(ctx, &api.QueryKnownUsersRequest{
+			UserID: alice, SearchString: searchString, Limit: 10,
+		}, res); err != nil {
+			t.Fatalf("QueryKnownUsers failed: %s", err)
+		}
+		var found []string
+		for _, user := range res.Users {
+			found = append(found, user.UserID+" "+user.DisplayName)
+		}
+		return found
+	}
+
+	for searchString, want := range map[string]string{
+		"bo":     "[@bob:kaer.morhen Bobby Tables]", // user ID prefix
+		"@bo":    "[@bob:kaer.morhen Bobby Tables]", // user ID prefix with sigil
+		"BOBBY":  "[@bob:kaer.morhen Bobby Tables]", // display name, case insensitive
+		"tab":    "[@bob:kaer.morhen Bobby Tables]", // later word of the display name
+		"obby":   "[]",                              // not a prefix
+		"ob%":    "[]",                              // wildcards are literal
+		"char":   "[]",                              // doesn't share a room
+		"robert": "[]",                              // doesn't share a room
+	} {
+		if got := fmt.Sprint(search(searchString)); got != want {
+			t.Errorf("searching for %q: got %s, want %s", searchString, got, want)
+		}
+	}
+
+	// Changing the display name updates the directory.
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, shared[4:], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	if got := fmt.Sprint(search("rob")); got != "[@bob:kaer.morhen Robert Tables]" {
+		t.Errorf("got %s after changing display name", got)
+	}
+}
+
+func TestJoinAndCreateLimits(t *testing.T) {
+	alice, bob, charlie, emptyStateKey := "@alice:kaer.morhen", "@bob:kaer.morhen", "@charlie:kaer.morhen", ""
+	publicRoom := func(roomID string) []fledglingEvent {
+		return []fledglingEvent{
+			{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"creator": alice, "room_version": "4"}},
+			{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"membership": "join"}},
+			{Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyStateKey, Sender: alice, RoomID: roomID, Content: map[string]interface{}{"join_rule": "public"}},
+		}
+	}
+	firstRoomID, secondRoomID := "!first:kaer.morhen", "!second:kaer.morhen"
+	events := append(
+		mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, publicRoom(firstRoomID)),
+		mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, publicRoom(secondRoomID))...,
+	)
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+	internalAPI.SetFederationSenderAPI(nil)
+	internalAPI.Cfg.Matrix.KeyID = "ed25519:test"
+	internalAPI.Cfg.Matrix.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	internalAPI.Cfg.MaxRoomsPerUser = 1
+	internalAPI.Cfg.MaxMembersPerRoom = 2
+
+	join := func(userID, roomID string) *api.PerformError {
+		t.Helper()
+		res := &api.PerformJoinResponse{}
+		rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{RoomIDOrAlias: roomID, UserID: userID}, res)
+		return res.Error
+	}
+
+	// bob can join the first room, but that takes it to the member limit
+	// and him to the room limit.
+	if err := join(bob, firstRoomID); err != nil {
+		t.Fatalf("bob failed to join: %s", err)
+	}
+	if err := join(charlie, firstRoomID); err == nil || err.Code != api.PerformErrorNotAllowed {
+		t.Errorf("got error %v for joining a full room, want not allowed", err)
+	}
+	if err := join(bob, secondRoomID); err == nil || err.Code != api.PerformErrorNotAllowed {
+		t.Errorf("got error %v for joining too many rooms, want not allowed", err)
+	}
+	if err := join(charlie, secondRoomID); err != nil {
+		t.Errorf("charlie failed to join: %s", err)
+	}
+
+	// bob can't create a room either.
+	create := mustCreateEvents(t, gomatrixserverlib.RoomVersionV4, []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Sender: bob, RoomID: "!third:kaer.morhen", Content: map[string]interface{}{"creator": bob, "room_version": "4"}},
+	})
+	err := api.SendEvents(ctx, rsAPI, api.KindNew, create, testOrigin, nil)
+	if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok {
+		t.Errorf("got error %v for creating too many rooms, want not allowed", err)
+	}
+}
@@ -870,7 +870,6 @@ func (v StateResolution) resolveConflictsV2(
 	// events may be duplicated across these sets but that's OK.
 	authSets := make(map[string][]*gomatrixserverlib.Event)
 	var authEvents []*gomatrixserverlib.Event
-	var authDifference []*gomatrixserverlib.Event
 
 	// For each conflicted event, let's try and get the needed auth events.
 	for _, conflictedEvent := range conflictedEvents {
@@ -907,34 +906,17 @@ func (v StateResolution) resolveConflictsV2(
 		authEvents = append(authEvents, authSets[key]...)
 	}
 
-	// This function helps us to work out whether an event exists in one of the
-	// auth sets.
-	isInAuthList := func(k string, event *gomatrixserverlib.Event) bool {
-		for _, e := range authSets[k] {
-			if e.EventID() == event.EventID() {
-				return true
-			}
-		}
-		return false
-	}
-
-	// This function works out if an event exists in all of the auth sets.
-	isInAllAuthLists := func(event *gomatrixserverlib.Event) bool {
-		found := true
-		for k := range authSets {
-			found = found && isInAuthList(k, event)
-		}
-		return found
+	// Work out which events are in the auth chains of some, but not all, of
+	// the conflicted events. State resolution can pick one of these events
+	// for a state key, so we need to be able to map them back to state entries.
+	authDifference, authDifferenceMap, err := v.calculateAuthChainDifference(ctx, conflicted)
+	if err != nil {
+		return nil, err
 	}
-
-	// Look through all of the auth events that we've been given and work out if
-	// there are any events which don't appear in all of the auth sets. If they
-	// don't then we add them to the auth difference.
-	for _, event := range authEvents {
-		if !isInAllAuthLists(event) {
-			authDifference = append(authDifference, event)
-		}
+	for k, v := range authDifferenceMap {
+		eventIDMap[k] = v
 	}
+	authEvents = append(authEvents, authDifference...)
 
 	// Resolve the conflicts.
 	resolvedEvents := gomatrixserverlib.ResolveStateConflictsV2(
@@ -958,6 +940,71 @@ func (v StateResolution) resolveConflictsV2(
 	return notConflicted, nil
 }
 
+// calculateAuthChainDifference works out the auth chain difference of the
+// conflicted state entries, which is the set of events that are in the auth
+// chain of at least one of the entries but not in the auth chains of all of
+// them. The auth chains come from the database, which caches them, so that
+// they aren't walked again every time the same events are in conflict, and
+// only the events in the difference are loaded. Returns the events in the
+// difference and a map from their event IDs to their state entries.
+func (v StateResolution) calculateAuthChainDifference(
+	ctx context.Context, conflicted []types.StateEntry,
+) ([]*gomatrixserverlib.Event, map[string]types.StateEntry, error) {
+	// Count how many of the auth chains each event appears in.
+	counts := make(map[types.EventNID]int)
+	authChainNIDs := make(map[types.EventNID]struct{}, len(conflicted))
+	for _, entry := range conflicted {
+		if _, ok := authChainNIDs[entry.EventNID]; ok {
+			continue
+		}
+		authChainNIDs[entry.EventNID] = struct{}{}
+		authChain, err := v.db.EventAuthChain(ctx, entry.EventNID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("v.db.EventAuthChain: %w", err)
+		}
+		for _, nid := range authChain {
+			counts[nid]++
+		}
+	}
+	var eventNIDs []types.EventNID
+	for nid, count := range counts {
+		if count < len(authChainNIDs) {
+			eventNIDs = append(eventNIDs, nid)
+		}
+	}
+	if len(eventNIDs) == 0 {
+		return nil, nil, nil
+	}
+
+	events, err := v.db.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("v.db.Events: %w", err)
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	entries, err := v.db.StateEntriesForEventIDs(ctx, eventIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("v.db.StateEntriesForEventIDs: %w", err)
+	}
+	entryMap := make(map[types.EventNID]types.StateEntry, len(entries))
+	for _, entry := range entries {
+		entryMap[entry.EventNID] = entry
+	}
+	authDifference := make([]*gomatrixserverlib.Event, 0, len(events))
+	eventIDMap := make(map[string]types.StateEntry, len(events))
+	for _, event := range events {
+		entry, ok := entryMap[event.EventNID]
+		if !ok {
+			return nil, nil, fmt.Errorf("missing state entry for auth event %q", event.EventID())
+		}
+		authDifference = append(authDifference, event.Event)
+		eventIDMap[event.EventID()] = entry
+	}
+	return authDifference, eventIDMap, nil
+}
+
 // stateKeyTuplesNeeded works out which numeric state key tuples we need to authenticate some events.
 func (v StateResolution) stateKeyTuplesNeeded(stateKeyNIDMap map[string]types.EventStateKeyNID, stateNeeded gomatrixserverlib.StateNeeded) []types.StateKeyTuple {
 	var keyTuples []types.StateKeyTuple
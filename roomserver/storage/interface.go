@@ -17,6 +17,7 @@ package storage
 import (
 	"context"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -65,6 +66,10 @@ type Database interface {
 	// Look up the Events for a list of numeric event IDs.
 	// Returns a sorted list of events.
 	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Look up the numeric IDs of the full auth chain of an event, which is every auth event of the
+	// event and all of their auth events, recursively. The event itself is not included.
+	// Returns a sorted list of numeric event IDs.
+	EventAuthChain(ctx context.Context, eventNID types.EventNID) ([]types.EventNID, error)
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot and the redacted event ID if any, or an error.
@@ -155,9 +160,16 @@ type Database interface {
 	// JoinedUsersSetInRooms returns all joined users in the rooms given, along with the count of how many times they appear.
 	JoinedUsersSetInRooms(ctx context.Context, roomIDs []string) (map[string]int, error)
 	// GetKnownUsers searches all users that userID knows about.
-	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error)
+	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]authtypes.FullyQualifiedProfile, error)
 	// GetKnownRooms returns a list of all rooms we know about.
 	GetKnownRooms(ctx context.Context) ([]string, error)
 	// ForgetRoom sets a flag in the membership table, that the user wishes to forget a specific room
 	ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error
+	// PurgeEventsBefore deletes the non-state events in a room that were sent before the given time, other
+	// than the latest events in the room. Returns the number of events that were deleted.
+	PurgeEventsBefore(ctx context.Context, roomID string, before gomatrixserverlib.Timestamp) (int, error)
+	// EventNearestTimestamp returns the ID and timestamp of the non-state event in the room closest to the given
+	// timestamp, at or before it if backwards is true and at or after it otherwise. Returns an empty event ID if
+	// there is no such event.
+	EventNearestTimestamp(ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, backwards bool) (string, gomatrixserverlib.Timestamp, error)
 }
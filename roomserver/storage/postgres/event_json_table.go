@@ -20,6 +20,7 @@ import (
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -54,9 +55,13 @@ const bulkSelectEventJSONSQL = "" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+const deleteEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY($1)"
+
 type eventJSONStatements struct {
 	insertEventJSONStmt     *sql.Stmt
 	bulkSelectEventJSONStmt *sql.Stmt
+	deleteEventJSONStmt     *sql.Stmt
 }
 
 func NewPostgresEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
@@ -68,6 +73,7 @@ func NewPostgresEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.deleteEventJSONStmt, deleteEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -103,3 +109,10 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], rows.Err()
 }
+
+func (s *eventJSONStatements) DeleteEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEventJSONStmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
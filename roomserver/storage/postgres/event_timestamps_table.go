@@ -0,0 +1,134 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const eventTimestampsSchema = `
+-- Stores the origin_server_ts of each non-state event, so that expired
+-- events can be found without reading the JSON of every event in the room.
+CREATE TABLE IF NOT EXISTS roomserver_event_timestamps (
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    room_nid BIGINT NOT NULL,
+    origin_server_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS roomserver_event_timestamps_room_ts_idx ON roomserver_event_timestamps(room_nid, origin_server_ts, event_nid);
+`
+
+const insertEventTimestampSQL = "" +
+	"INSERT INTO roomserver_event_timestamps (event_nid, room_nid, origin_server_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+// Events are returned in the order that they were sent, starting after the
+// given timestamp and event NID, so that events which aren't deleted can be
+// paginated past.
+const selectEventsBeforeTimestampSQL = "" +
+	"SELECT event_nid, origin_server_ts FROM roomserver_event_timestamps" +
+	" WHERE room_nid = $1 AND origin_server_ts < $2" +
+	" AND (origin_server_ts > $3 OR (origin_server_ts = $3 AND event_nid > $4))" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT $5"
+
+const selectEventBeforeTimestampSQL = "" +
+	"SELECT event_nid, origin_server_ts FROM roomserver_event_timestamps" +
+	" WHERE room_nid = $1 AND origin_server_ts <= $2" +
+	" ORDER BY origin_server_ts DESC, event_nid DESC LIMIT 1"
+
+const selectEventAfterTimestampSQL = "" +
+	"SELECT event_nid, origin_server_ts FROM roomserver_event_timestamps" +
+	" WHERE room_nid = $1 AND origin_server_ts >= $2" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT 1"
+
+const deleteEventTimestampsSQL = "" +
+	"DELETE FROM roomserver_event_timestamps WHERE event_nid = ANY($1)"
+
+type eventTimestampsStatements struct {
+	insertEventTimestampStmt        *sql.Stmt
+	selectEventsBeforeTimestampStmt *sql.Stmt
+	selectEventBeforeTimestampStmt  *sql.Stmt
+	selectEventAfterTimestampStmt   *sql.Stmt
+	deleteEventTimestampsStmt       *sql.Stmt
+}
+
+func NewPostgresEventTimestampsTable(db *sql.DB) (tables.EventTimestamps, error) {
+	s := &eventTimestampsStatements{}
+	_, err := db.Exec(eventTimestampsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertEventTimestampStmt, insertEventTimestampSQL},
+		{&s.selectEventsBeforeTimestampStmt, selectEventsBeforeTimestampSQL},
+		{&s.selectEventBeforeTimestampStmt, selectEventBeforeTimestampSQL},
+		{&s.selectEventAfterTimestampStmt, selectEventAfterTimestampSQL},
+		{&s.deleteEventTimestampsStmt, deleteEventTimestampsSQL},
+	}.Prepare(db)
+}
+
+func (s *eventTimestampsStatements) InsertEventTimestamp(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, roomNID types.RoomNID, originServerTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertEventTimestampStmt).ExecContext(ctx, int64(eventNID), int64(roomNID), int64(originServerTS))
+	return err
+}
+
+func (s *eventTimestampsStatements) SelectEventsBeforeTimestamp(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, before gomatrixserverlib.Timestamp, after tables.EventTimestamp, limit int,
+) ([]tables.EventTimestamp, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventsBeforeTimestampStmt).QueryContext(
+		ctx, int64(roomNID), int64(before), int64(after.OriginServerTS), int64(after.EventNID), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsBeforeTimestampStmt: rows.close() failed")
+	var results []tables.EventTimestamp
+	for rows.Next() {
+		var result tables.EventTimestamp
+		if err = rows.Scan(&result.EventNID, &result.OriginServerTS); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventTimestampsStatements) SelectEventNearestTimestamp(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, backwards bool,
+) (types.EventNID, gomatrixserverlib.Timestamp, error) {
+	stmt := s.selectEventAfterTimestampStmt
+	if backwards {
+		stmt = s.selectEventBeforeTimestampStmt
+	}
+	var eventNID, originServerTS int64
+	err := sqlutil.TxStmt(txn, stmt).QueryRowContext(ctx, int64(roomNID), int64(ts)).Scan(&eventNID, &originServerTS)
+	return types.EventNID(eventNID), gomatrixserverlib.Timestamp(originServerTS), err
+}
+
+func (s *eventTimestampsStatements) DeleteEventTimestamps(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEventTimestampsStmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
@@ -123,6 +123,12 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid = ANY($1)"
 
+const bulkSelectAuthEventNIDsSQL = "" +
+	"SELECT event_nid, auth_event_nids FROM roomserver_events WHERE event_nid = ANY($1)"
+
+const deleteEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid = ANY($1)"
+
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
 	selectEventStmt                        *sql.Stmt
@@ -138,6 +144,8 @@ type eventStatements struct {
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
 	selectRoomNIDsForEventNIDsStmt         *sql.Stmt
+	bulkSelectAuthEventNIDsStmt            *sql.Stmt
+	deleteEventsStmt                       *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -162,6 +170,8 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
+		{&s.bulkSelectAuthEventNIDsStmt, bulkSelectAuthEventNIDsSQL},
+		{&s.deleteEventsStmt, deleteEventsSQL},
 	}.Prepare(db)
 }
 
@@ -452,6 +462,37 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) BulkSelectAuthEventNIDs(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID][]types.EventNID, error) {
+	rows, err := s.bulkSelectAuthEventNIDsStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectAuthEventNIDsStmt: rows.close() failed")
+	result := make(map[types.EventNID][]types.EventNID, len(eventNIDs))
+	for rows.Next() {
+		var eventNID types.EventNID
+		var authEventNIDs pq.Int64Array
+		if err = rows.Scan(&eventNID, &authEventNIDs); err != nil {
+			return nil, err
+		}
+		nids := make([]types.EventNID, len(authEventNIDs))
+		for i := range authEventNIDs {
+			nids[i] = types.EventNID(authEventNIDs[i])
+		}
+		result[eventNID] = nids
+	}
+	return result, rows.Err()
+}
+
+func (s *eventStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEventsStmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
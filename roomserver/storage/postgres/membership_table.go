@@ -19,8 +19,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
@@ -116,13 +118,17 @@ const selectRoomsWithMembershipSQL = "" +
 
 // selectKnownUsersSQL uses a sub-select statement here to find rooms that the user is
 // joined to. Since this information is used to populate the user directory, we will
-// only return users that the user would ordinarily be able to see anyway.
+// only return users that the user would ordinarily be able to see anyway. Users are
+// matched on a prefix of their user ID, or of any word in their display name.
 var selectKnownUsersSQL = "" +
-	"SELECT DISTINCT event_state_key FROM roomserver_membership INNER JOIN roomserver_event_state_keys ON " +
-	"roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
+	"SELECT DISTINCT event_state_key, COALESCE(display_name, ''), COALESCE(avatar_url, '') FROM roomserver_membership" +
+	" INNER JOIN roomserver_event_state_keys ON roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
+	" LEFT JOIN roomserver_user_directory ON roomserver_membership.target_nid = roomserver_user_directory.user_nid" +
 	" WHERE room_nid = ANY(" +
 	"  SELECT DISTINCT room_nid FROM roomserver_membership WHERE target_nid=$1 AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) +
-	") AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) + " AND event_state_key LIKE $2 LIMIT $3"
+	") AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) +
+	" AND (LOWER(event_state_key) LIKE $2 ESCAPE '\\' OR LOWER(display_name) LIKE $3 ESCAPE '\\' OR LOWER(display_name) LIKE $4 ESCAPE '\\')" +
+	" ORDER BY event_state_key LIMIT $5"
 
 type membershipStatements struct {
 	insertMembershipStmt                            *sql.Stmt
@@ -301,19 +307,20 @@ func (s *membershipStatements) SelectJoinedUsersSetForRooms(ctx context.Context,
 	return result, rows.Err()
 }
 
-func (s *membershipStatements) SelectKnownUsers(ctx context.Context, userID types.EventStateKeyNID, searchString string, limit int) ([]string, error) {
-	rows, err := s.selectKnownUsersStmt.QueryContext(ctx, userID, fmt.Sprintf("%%%s%%", searchString), limit)
+func (s *membershipStatements) SelectKnownUsers(ctx context.Context, userID types.EventStateKeyNID, searchString string, limit int) ([]authtypes.FullyQualifiedProfile, error) {
+	search := sqlutil.EscapeLike(strings.ToLower(strings.TrimPrefix(searchString, "@")))
+	rows, err := s.selectKnownUsersStmt.QueryContext(ctx, userID, "@"+search+"%", search+"%", "% "+search+"%", limit)
 	if err != nil {
 		return nil, err
 	}
-	result := []string{}
+	result := []authtypes.FullyQualifiedProfile{}
 	defer internal.CloseAndLogIfError(ctx, rows, "SelectKnownUsers: rows.close() failed")
 	for rows.Next() {
-		var userID string
-		if err := rows.Scan(&userID); err != nil {
+		var profile authtypes.FullyQualifiedProfile
+		if err := rows.Scan(&profile.UserID, &profile.DisplayName, &profile.AvatarURL); err != nil {
 			return nil, err
 		}
-		result = append(result, userID)
+		result = append(result, profile)
 	}
 	return result, rows.Err()
 }
@@ -60,9 +60,21 @@ const selectPreviousEventExistsSQL = "" +
 	"SELECT 1 FROM roomserver_previous_events" +
 	" WHERE previous_event_id = $1 AND previous_reference_sha256 = $2"
 
+// Remove the event NID from the events that reference the previous event,
+// and forget about the previous event if nothing references it any more.
+const removePreviousEventNIDSQL = "" +
+	"UPDATE roomserver_previous_events SET event_nids = array_remove(event_nids, $3)" +
+	" WHERE previous_event_id = $1 AND previous_reference_sha256 = $2"
+
+const deleteUnreferencedPreviousEventSQL = "" +
+	"DELETE FROM roomserver_previous_events" +
+	" WHERE previous_event_id = $1 AND previous_reference_sha256 = $2 AND event_nids = '{}'"
+
 type previousEventStatements struct {
-	insertPreviousEventStmt       *sql.Stmt
-	selectPreviousEventExistsStmt *sql.Stmt
+	insertPreviousEventStmt             *sql.Stmt
+	selectPreviousEventExistsStmt       *sql.Stmt
+	removePreviousEventNIDStmt          *sql.Stmt
+	deleteUnreferencedPreviousEventStmt *sql.Stmt
 }
 
 func NewPostgresPreviousEventsTable(db *sql.DB) (tables.PreviousEvents, error) {
@@ -75,6 +87,8 @@ func NewPostgresPreviousEventsTable(db *sql.DB) (tables.PreviousEvents, error) {
 	return s, shared.StatementList{
 		{&s.insertPreviousEventStmt, insertPreviousEventSQL},
 		{&s.selectPreviousEventExistsStmt, selectPreviousEventExistsSQL},
+		{&s.removePreviousEventNIDStmt, removePreviousEventNIDSQL},
+		{&s.deleteUnreferencedPreviousEventStmt, deleteUnreferencedPreviousEventSQL},
 	}.Prepare(db)
 }
 
@@ -101,3 +115,22 @@ func (s *previousEventStatements) SelectPreviousEventExists(
 	stmt := sqlutil.TxStmt(txn, s.selectPreviousEventExistsStmt)
 	return stmt.QueryRowContext(ctx, eventID, eventReferenceSHA256).Scan(&ok)
 }
+
+func (s *previousEventStatements) DeletePreviousEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	previousEventID string,
+	previousEventReferenceSHA256 []byte,
+	eventNID types.EventNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.removePreviousEventNIDStmt).ExecContext(
+		ctx, previousEventID, previousEventReferenceSHA256, int64(eventNID),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.deleteUnreferencedPreviousEventStmt).ExecContext(
+		ctx, previousEventID, previousEventReferenceSHA256,
+	)
+	return err
+}
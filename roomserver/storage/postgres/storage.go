@@ -48,8 +48,14 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	if err := ms.execSchema(db); err != nil {
 		return nil, err
 	}
+	for _, schema := range []string{eventsSchema, eventJSONSchema, eventTimestampsSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return nil, err
+		}
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadAddForgottenColumn(m)
+	deltas.LoadAddEventTimestamps(m)
 	if err := m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -106,6 +112,10 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) (err erro
 	if err != nil {
 		return err
 	}
+	userDirectory, err := NewPostgresUserDirectoryTable(db)
+	if err != nil {
+		return err
+	}
 	membership, err := NewPostgresMembershipTable(db)
 	if err != nil {
 		return err
@@ -118,24 +128,30 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) (err erro
 	if err != nil {
 		return err
 	}
+	eventTimestamps, err := NewPostgresEventTimestampsTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
-		DB:                  db,
-		Cache:               cache,
-		Writer:              sqlutil.NewDummyWriter(),
-		EventTypesTable:     eventTypes,
-		EventStateKeysTable: eventStateKeys,
-		EventJSONTable:      eventJSON,
-		EventsTable:         events,
-		RoomsTable:          rooms,
-		TransactionsTable:   transactions,
-		StateBlockTable:     stateBlock,
-		StateSnapshotTable:  stateSnapshot,
-		PrevEventsTable:     prevEvents,
-		RoomAliasesTable:    roomAliases,
-		InvitesTable:        invites,
-		MembershipTable:     membership,
-		PublishedTable:      published,
-		RedactionsTable:     redactions,
+		DB:                   db,
+		Cache:                cache,
+		Writer:               sqlutil.NewDummyWriter(),
+		EventTypesTable:      eventTypes,
+		EventStateKeysTable:  eventStateKeys,
+		EventJSONTable:       eventJSON,
+		EventsTable:          events,
+		RoomsTable:           rooms,
+		TransactionsTable:    transactions,
+		StateBlockTable:      stateBlock,
+		StateSnapshotTable:   stateSnapshot,
+		PrevEventsTable:      prevEvents,
+		RoomAliasesTable:     roomAliases,
+		InvitesTable:         invites,
+		MembershipTable:      membership,
+		UserDirectoryTable:   userDirectory,
+		PublishedTable:       published,
+		RedactionsTable:      redactions,
+		EventTimestampsTable: eventTimestamps,
 	}
 	return nil
 }
@@ -0,0 +1,66 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const userDirectorySchema = `
+-- Stores the profile from the latest join event of each user, so that the
+-- user directory can be searched by display name. There is only one profile
+-- per user, so a display name that the user has set in one room replaces the
+-- one from any other room.
+CREATE TABLE IF NOT EXISTS roomserver_user_directory (
+    -- The state key NID of the user
+    user_nid BIGINT NOT NULL PRIMARY KEY,
+    -- The display name and avatar URL from the join event
+    display_name TEXT NOT NULL DEFAULT '',
+    avatar_url TEXT NOT NULL DEFAULT ''
+);
+`
+
+const upsertUserProfileSQL = "" +
+	"INSERT INTO roomserver_user_directory (user_nid, display_name, avatar_url) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_nid) DO UPDATE SET display_name = $2, avatar_url = $3"
+
+type userDirectoryStatements struct {
+	upsertUserProfileStmt *sql.Stmt
+}
+
+func NewPostgresUserDirectoryTable(db *sql.DB) (tables.UserDirectory, error) {
+	s := &userDirectoryStatements{}
+	_, err := db.Exec(userDirectorySchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.upsertUserProfileStmt, upsertUserProfileSQL},
+	}.Prepare(db)
+}
+
+func (s *userDirectoryStatements) UpsertUserProfile(
+	ctx context.Context, txn *sql.Tx, userNID types.EventStateKeyNID, displayName, avatarURL string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertUserProfileStmt)
+	_, err := stmt.ExecContext(ctx, userNID, displayName, avatarURL)
+	return err
+}
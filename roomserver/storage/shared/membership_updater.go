@@ -148,6 +148,17 @@ func (u *MembershipUpdater) SetToJoin(senderUserID string, eventID string, isUpd
 	return inviteEventIDs, err
 }
 
+// SetProfile records the display name and avatar URL from the user's latest
+// join event, for searching the user directory.
+func (u *MembershipUpdater) SetProfile(displayName, avatarURL string) error {
+	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		if err := u.d.UserDirectoryTable.UpsertUserProfile(u.ctx, txn, u.targetUserNID, displayName, avatarURL); err != nil {
+			return fmt.Errorf("u.d.UserDirectoryTable.UpsertUserProfile: %w", err)
+		}
+		return nil
+	})
+}
+
 // SetToLeave implements types.MembershipUpdater
 func (u *MembershipUpdater) SetToLeave(senderUserID string, eventID string) ([]string, error) {
 	var inviteEventIDs []string
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"sort"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -42,8 +43,10 @@ type Database struct {
 	PrevEventsTable            tables.PreviousEvents
 	InvitesTable               tables.Invites
 	MembershipTable            tables.Membership
+	UserDirectoryTable         tables.UserDirectory
 	PublishedTable             tables.Published
 	RedactionsTable            tables.Redactions
+	EventTimestampsTable       tables.EventTimestamps
 	GetLatestEventsForUpdateFn func(ctx context.Context, roomInfo types.RoomInfo) (*LatestEventsUpdater, error)
 }
 
@@ -310,6 +313,50 @@ func (d *Database) GetInvitesForUser(
 	return d.InvitesTable.SelectInviteActiveForUserInRoom(ctx, targetUserNID, roomNID)
 }
 
+// EventAuthChain implements storage.Database. Auth chains are cached, as the
+// auth events of an event never change, and any auth events whose auth chains
+// are already cached don't need to be walked again.
+func (d *Database) EventAuthChain(
+	ctx context.Context, eventNID types.EventNID,
+) ([]types.EventNID, error) {
+	if authChain, ok := d.Cache.GetRoomServerAuthChain(eventNID); ok {
+		return authChain, nil
+	}
+	seen := make(map[types.EventNID]struct{})
+	eventsToFetch := []types.EventNID{eventNID}
+	for len(eventsToFetch) > 0 {
+		authEventNIDs, err := d.EventsTable.BulkSelectAuthEventNIDs(ctx, eventsToFetch)
+		if err != nil {
+			return nil, fmt.Errorf("d.EventsTable.BulkSelectAuthEventNIDs: %w", err)
+		}
+		eventsToFetch = eventsToFetch[:0]
+		for _, nids := range authEventNIDs {
+			for _, nid := range nids {
+				if _, ok := seen[nid]; ok {
+					continue
+				}
+				seen[nid] = struct{}{}
+				if authChain, ok := d.Cache.GetRoomServerAuthChain(nid); ok {
+					for _, authNID := range authChain {
+						seen[authNID] = struct{}{}
+					}
+					continue
+				}
+				eventsToFetch = append(eventsToFetch, nid)
+			}
+		}
+	}
+	authChain := make([]types.EventNID, 0, len(seen))
+	for nid := range seen {
+		authChain = append(authChain, nid)
+	}
+	sort.Slice(authChain, func(i, j int) bool {
+		return authChain[i] < authChain[j]
+	})
+	d.Cache.StoreRoomServerAuthChain(eventNID, authChain)
+	return authChain, nil
+}
+
 func (d *Database) Events(
 	ctx context.Context, eventNIDs []types.EventNID,
 ) ([]types.Event, error) {
@@ -493,6 +540,11 @@ func (d *Database) StoreEvent(
 		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
 			return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
 		}
+		if eventStateKey == nil {
+			if err = d.EventTimestampsTable.InsertEventTimestamp(ctx, txn, eventNID, roomNID, event.OriginServerTS()); err != nil {
+				return fmt.Errorf("d.EventTimestampsTable.InsertEventTimestamp: %w", err)
+			}
+		}
 		if !isRejected { // ignore rejected redaction events
 			redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
 			if err != nil {
@@ -504,6 +556,10 @@ func (d *Database) StoreEvent(
 	if err != nil {
 		return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.Writer.Do: %w", err)
 	}
+	if redactedEventID != "" {
+		// the redacted event has changed, so don't serve it from the cache
+		d.Cache.InvalidateRoomServerEvent(redactedEventID)
+	}
 
 	// We should attempt to update the previous events table with any
 	// references that this new event makes. We do this using a latest
@@ -706,6 +762,15 @@ func (d *Database) handleRedactions(
 		// redactions across rooms aren't allowed
 		return nil, "", nil
 	}
+	allowed, err := d.redactionAllowed(ctx, redactionEvent, redactedEvent)
+	if err != nil {
+		return nil, "", fmt.Errorf("d.redactionAllowed: %w", err)
+	}
+	if !allowed {
+		// the redacter neither sent the event nor has the power to redact it,
+		// so leave the redaction unvalidated
+		return nil, "", nil
+	}
 
 	// mark the event as redacted
 	err = redactedEvent.SetUnsignedField("redacted_because", redactionEvent)
@@ -771,6 +836,39 @@ func (d *Database) loadRedactionPair(
 	return redactionEvent, redactedEvent, info.Validated, nil
 }
 
+// redactionAllowed returns true if the sender of the redaction is allowed to
+// redact the event: either they sent it, or their power level at the point
+// of the redaction is at least the "redact" level.
+// https://matrix.org/docs/spec/client_server/r0.6.1#put-matrix-client-r0-rooms-roomid-redact-eventid-txnid
+func (d *Database) redactionAllowed(
+	ctx context.Context, redactionEvent, redactedEvent *types.Event,
+) (bool, error) {
+	if redactionEvent.Sender() == redactedEvent.Sender() {
+		return true, nil
+	}
+	authEvents, err := d.EventsFromIDs(ctx, redactionEvent.AuthEventIDs())
+	if err != nil {
+		return false, fmt.Errorf("d.EventsFromIDs: %w", err)
+	}
+	events := make([]*gomatrixserverlib.Event, 0, len(authEvents))
+	for _, ev := range authEvents {
+		events = append(events, ev.Event)
+	}
+	provider := gomatrixserverlib.NewAuthEvents(events)
+	var creator string
+	if createEvent, _ := provider.Create(); createEvent != nil {
+		var content gomatrixserverlib.CreateContent
+		if err = json.Unmarshal(createEvent.Content(), &content); err == nil {
+			creator = content.Creator
+		}
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&provider, creator)
+	if err != nil {
+		return false, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromAuthEvents: %w", err)
+	}
+	return powerLevels.UserLevel(redactionEvent.Sender()) >= powerLevels.Redact, nil
+}
+
 // applyRedactions will redact events that have an `unsigned.redacted_because` field.
 func (d *Database) applyRedactions(events []types.Event) {
 	for i := range events {
@@ -1012,7 +1110,7 @@ func (d *Database) JoinedUsersSetInRooms(ctx context.Context, roomIDs []string)
 }
 
 // GetKnownUsers searches all users that userID knows about.
-func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error) {
+func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]authtypes.FullyQualifiedProfile, error) {
 	stateKeyNID, err := d.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, userID)
 	if err != nil {
 		return nil, err
@@ -1105,3 +1203,122 @@ func (s stateEntryByStateKeySorter) Less(i, j int) bool {
 	return s[i].StateKeyTuple.LessThan(s[j].StateKeyTuple)
 }
 func (s stateEntryByStateKeySorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// EventNearestTimestamp implements Database
+func (d *Database) EventNearestTimestamp(
+	ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, backwards bool,
+) (string, gomatrixserverlib.Timestamp, error) {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return "", 0, fmt.Errorf("d.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return "", 0, nil
+	}
+	eventNID, originServerTS, err := d.EventTimestampsTable.SelectEventNearestTimestamp(ctx, nil, roomInfo.RoomNID, ts, backwards)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("d.EventTimestampsTable.SelectEventNearestTimestamp: %w", err)
+	}
+	eventIDs, err := d.EventsTable.BulkSelectEventID(ctx, []types.EventNID{eventNID})
+	if err != nil {
+		return "", 0, fmt.Errorf("d.EventsTable.BulkSelectEventID: %w", err)
+	}
+	return eventIDs[eventNID], originServerTS, nil
+}
+
+// purgeBatchSize is how many events PurgeEventsBefore looks at, and deletes, at once.
+const purgeBatchSize = 500
+
+// PurgeEventsBefore implements Database
+func (d *Database) PurgeEventsBefore(ctx context.Context, roomID string, before gomatrixserverlib.Timestamp) (int, error) {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("d.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return 0, nil
+	}
+	// Work through the expired events from the oldest, stopping once we get
+	// to the first event which hasn't expired. The events that we keep are
+	// skipped over on the next batch.
+	purged := 0
+	var after tables.EventTimestamp
+	for {
+		expired, err := d.EventTimestampsTable.SelectEventsBeforeTimestamp(ctx, nil, roomInfo.RoomNID, before, after, purgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("d.EventTimestampsTable.SelectEventsBeforeTimestamp: %w", err)
+		}
+		if len(expired) == 0 {
+			return purged, nil
+		}
+		after = expired[len(expired)-1]
+		eventNIDs := make([]types.EventNID, len(expired))
+		for i := range expired {
+			eventNIDs[i] = expired[i].EventNID
+		}
+		n, err := d.purgeEvents(ctx, roomInfo.RoomNID, eventNIDs)
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+}
+
+// purgeEvents deletes the given events, other than the latest events in the
+// room, along with the references that they make to their previous events.
+func (d *Database) purgeEvents(ctx context.Context, roomNID types.RoomNID, eventNIDs []types.EventNID) (int, error) {
+	events, err := d.Events(ctx, eventNIDs)
+	if err != nil {
+		return 0, fmt.Errorf("d.Events: %w", err)
+	}
+	var purged []types.Event
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		// Keep the latest events in the room, since we need them to send
+		// new events and they are the starting point for backfilling.
+		latestNIDs, lastEventSentNID, _, err := d.RoomsTable.SelectLatestEventsNIDsForUpdate(ctx, txn, roomNID)
+		if err != nil {
+			return fmt.Errorf("d.RoomsTable.SelectLatestEventsNIDsForUpdate: %w", err)
+		}
+		keep := map[types.EventNID]bool{lastEventSentNID: true}
+		for _, eventNID := range latestNIDs {
+			keep[eventNID] = true
+		}
+		var purgedNIDs []types.EventNID
+		for _, event := range events {
+			if !keep[event.EventNID] {
+				purged = append(purged, event)
+				purgedNIDs = append(purgedNIDs, event.EventNID)
+			}
+		}
+		if len(purged) == 0 {
+			return nil
+		}
+		for _, event := range purged {
+			for _, ref := range event.PrevEvents() {
+				if err = d.PrevEventsTable.DeletePreviousEvent(ctx, txn, ref.EventID, ref.EventSHA256, event.EventNID); err != nil {
+					return fmt.Errorf("d.PrevEventsTable.DeletePreviousEvent: %w", err)
+				}
+			}
+		}
+		if err = d.EventJSONTable.DeleteEventJSON(ctx, txn, purgedNIDs); err != nil {
+			return fmt.Errorf("d.EventJSONTable.DeleteEventJSON: %w", err)
+		}
+		if err = d.EventTimestampsTable.DeleteEventTimestamps(ctx, txn, purgedNIDs); err != nil {
+			return fmt.Errorf("d.EventTimestampsTable.DeleteEventTimestamps: %w", err)
+		}
+		if err = d.EventsTable.DeleteEvents(ctx, txn, purgedNIDs); err != nil {
+			return fmt.Errorf("d.EventsTable.DeleteEvents: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, event := range purged {
+		d.Cache.InvalidateRoomServerEvent(event.EventID())
+	}
+	return len(purged), nil
+}
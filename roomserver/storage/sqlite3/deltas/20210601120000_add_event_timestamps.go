@@ -0,0 +1,75 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+func LoadAddEventTimestamps(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddEventTimestamps, DownAddEventTimestamps)
+}
+
+// UpAddEventTimestamps fills in roomserver_event_timestamps for the non-state
+// events which were stored before the table existed.
+func UpAddEventTimestamps(tx *sql.Tx) error {
+	rows, err := tx.Query("" +
+		"SELECT e.event_nid, e.room_nid, j.event_json" +
+		" FROM roomserver_events e INNER JOIN roomserver_event_json j ON e.event_nid = j.event_nid" +
+		" WHERE e.event_state_key_nid = 0",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query events: %w", err)
+	}
+	type eventTimestamp struct {
+		eventNID, roomNID, ts int64
+	}
+	var timestamps []eventTimestamp
+	for rows.Next() {
+		var ev eventTimestamp
+		var eventJSON []byte
+		if err = rows.Scan(&ev.eventNID, &ev.roomNID, &eventJSON); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan event: %w", err)
+		}
+		ev.ts = gjson.GetBytes(eventJSON, "origin_server_ts").Int()
+		timestamps = append(timestamps, ev)
+	}
+	if err = rows.Close(); err != nil {
+		return fmt.Errorf("failed to close rows: %w", err)
+	}
+	for _, ev := range timestamps {
+		_, err = tx.Exec(
+			"INSERT INTO roomserver_event_timestamps (event_nid, room_nid, origin_server_ts) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			ev.eventNID, ev.roomNID, ev.ts,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	return nil
+}
+
+func DownAddEventTimestamps(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM roomserver_event_timestamps")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -47,10 +47,15 @@ const bulkSelectEventJSONSQL = `
 	  ORDER BY event_nid ASC
 `
 
+const deleteEventJSONSQL = `
+	DELETE FROM roomserver_event_json WHERE event_nid = $1
+`
+
 type eventJSONStatements struct {
 	db                      *sql.DB
 	insertEventJSONStmt     *sql.Stmt
 	bulkSelectEventJSONStmt *sql.Stmt
+	deleteEventJSONStmt     *sql.Stmt
 }
 
 func NewSqliteEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
@@ -64,6 +69,7 @@ func NewSqliteEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.deleteEventJSONStmt, deleteEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -105,3 +111,15 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], nil
 }
+
+func (s *eventJSONStatements) DeleteEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteEventJSONStmt)
+	for _, eventNID := range eventNIDs {
+		if _, err := stmt.ExecContext(ctx, int64(eventNID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSelectEventNearestTimestamp(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	timestamps, err := NewSqliteEventTimestampsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	// Events 1 and 2 were sent at the same time, and event 3 in another room.
+	for _, ev := range []struct {
+		eventNID types.EventNID
+		roomNID  types.RoomNID
+		ts       gomatrixserverlib.Timestamp
+	}{
+		{1, 1, 1000}, {2, 1, 1000}, {3, 2, 2000}, {4, 1, 3000},
+	} {
+		if err = timestamps.InsertEventTimestamp(ctx, nil, ev.eventNID, ev.roomNID, ev.ts); err != nil {
+			t.Fatalf("InsertEventTimestamp failed: %s", err)
+		}
+	}
+	for _, tc := range []struct {
+		ts        gomatrixserverlib.Timestamp
+		backwards bool
+		wantNID   types.EventNID
+		wantErr   error
+	}{
+		{2000, true, 2, nil},
+		{2000, false, 4, nil},
+		{1000, false, 1, nil},
+		{3000, true, 4, nil},
+		{500, true, 0, sql.ErrNoRows},
+		{3500, false, 0, sql.ErrNoRows},
+	} {
+		eventNID, _, err := timestamps.SelectEventNearestTimestamp(ctx, nil, 1, tc.ts, tc.backwards)
+		if err != tc.wantErr {
+			t.Errorf("ts %d backwards %v: got error %v, want %v", tc.ts, tc.backwards, err, tc.wantErr)
+			continue
+		}
+		if eventNID != tc.wantNID {
+			t.Errorf("ts %d backwards %v: got event %d, want %d", tc.ts, tc.backwards, eventNID, tc.wantNID)
+		}
+	}
+}
@@ -98,6 +98,12 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid IN ($1)"
 
+const bulkSelectAuthEventNIDsSQL = "" +
+	"SELECT event_nid, auth_event_nids FROM roomserver_events WHERE event_nid IN ($1)"
+
+const deleteEventSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid = $1"
+
 type eventStatements struct {
 	db                                     *sql.DB
 	insertEventStmt                        *sql.Stmt
@@ -112,6 +118,7 @@ type eventStatements struct {
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
+	deleteEventStmt                        *sql.Stmt
 	//selectRoomNIDsForEventNIDsStmt           *sql.Stmt
 }
 
@@ -137,6 +144,7 @@ func NewSqliteEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
+		{&s.deleteEventStmt, deleteEventSQL},
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 	}.Prepare(db)
 }
@@ -509,6 +517,52 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) BulkSelectAuthEventNIDs(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID][]types.EventNID, error) {
+	sqlStr := strings.Replace(bulkSelectAuthEventNIDsSQL, "($1)", sqlutil.QueryVariadic(len(eventNIDs)), 1)
+	sqlPrep, err := s.db.Prepare(sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, sqlPrep, "bulkSelectAuthEventNIDs: stmt.close() failed")
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for i, v := range eventNIDs {
+		iEventNIDs[i] = v
+	}
+	rows, err := sqlPrep.QueryContext(ctx, iEventNIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectAuthEventNIDs: rows.close() failed")
+	result := make(map[types.EventNID][]types.EventNID, len(eventNIDs))
+	for rows.Next() {
+		var eventNID types.EventNID
+		var authEventNIDsJSON string
+		if err = rows.Scan(&eventNID, &authEventNIDsJSON); err != nil {
+			return nil, err
+		}
+		var authEventNIDs []types.EventNID
+		if err = json.Unmarshal([]byte(authEventNIDsJSON), &authEventNIDs); err != nil {
+			return nil, err
+		}
+		result[eventNID] = authEventNIDs
+	}
+	return result, rows.Err()
+}
+
+func (s *eventStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteEventStmt)
+	for _, eventNID := range eventNIDs {
+		if _, err := stmt.ExecContext(ctx, int64(eventNID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
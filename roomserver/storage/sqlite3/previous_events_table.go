@@ -64,11 +64,17 @@ const selectPreviousEventExistsSQL = `
 	  WHERE previous_event_id = $1 AND previous_reference_sha256 = $2
 `
 
+const deletePreviousEventSQL = `
+	DELETE FROM roomserver_previous_events
+	  WHERE previous_event_id = $1 AND previous_reference_sha256 = $2
+`
+
 type previousEventStatements struct {
 	db                            *sql.DB
 	insertPreviousEventStmt       *sql.Stmt
 	selectPreviousEventNIDsStmt   *sql.Stmt
 	selectPreviousEventExistsStmt *sql.Stmt
+	deletePreviousEventStmt       *sql.Stmt
 }
 
 func NewSqlitePrevEventsTable(db *sql.DB) (tables.PreviousEvents, error) {
@@ -84,6 +90,7 @@ func NewSqlitePrevEventsTable(db *sql.DB) (tables.PreviousEvents, error) {
 		{&s.insertPreviousEventStmt, insertPreviousEventSQL},
 		{&s.selectPreviousEventNIDsStmt, selectPreviousEventNIDsSQL},
 		{&s.selectPreviousEventExistsStmt, selectPreviousEventExistsSQL},
+		{&s.deletePreviousEventStmt, deletePreviousEventSQL},
 	}.Prepare(db)
 }
 
@@ -96,7 +103,7 @@ func (s *previousEventStatements) InsertPreviousEvent(
 ) error {
 	var eventNIDs string
 	eventNIDAsString := fmt.Sprintf("%d", eventNID)
-	selectStmt := sqlutil.TxStmt(txn, s.selectPreviousEventExistsStmt)
+	selectStmt := sqlutil.TxStmt(txn, s.selectPreviousEventNIDsStmt)
 	err := selectStmt.QueryRowContext(ctx, previousEventID, previousEventReferenceSHA256).Scan(&eventNIDs)
 	if err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("selectStmt.QueryRowContext.Scan: %w", err)
@@ -129,3 +136,41 @@ func (s *previousEventStatements) SelectPreviousEventExists(
 	stmt := sqlutil.TxStmt(txn, s.selectPreviousEventExistsStmt)
 	return stmt.QueryRowContext(ctx, eventID, eventReferenceSHA256).Scan(&ok)
 }
+
+// DeletePreviousEvent removes the event NID from the events that reference the
+// previous event, and forgets about the previous event if nothing references it
+// any more.
+func (s *previousEventStatements) DeletePreviousEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	previousEventID string,
+	previousEventReferenceSHA256 []byte,
+	eventNID types.EventNID,
+) error {
+	var eventNIDs string
+	selectStmt := sqlutil.TxStmt(txn, s.selectPreviousEventNIDsStmt)
+	err := selectStmt.QueryRowContext(ctx, previousEventID, previousEventReferenceSHA256).Scan(&eventNIDs)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("selectStmt.QueryRowContext.Scan: %w", err)
+	}
+	eventNIDAsString := fmt.Sprintf("%d", eventNID)
+	var nids []string
+	for _, nid := range strings.Split(eventNIDs, ",") {
+		if nid != eventNIDAsString && nid != "" {
+			nids = append(nids, nid)
+		}
+	}
+	if len(nids) > 0 {
+		insertStmt := sqlutil.TxStmt(txn, s.insertPreviousEventStmt)
+		_, err = insertStmt.ExecContext(
+			ctx, previousEventID, previousEventReferenceSHA256, strings.Join(nids, ","),
+		)
+		return err
+	}
+	deleteStmt := sqlutil.TxStmt(txn, s.deletePreviousEventStmt)
+	_, err = deleteStmt.ExecContext(ctx, previousEventID, previousEventReferenceSHA256)
+	return err
+}
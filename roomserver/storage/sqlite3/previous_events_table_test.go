@@ -0,0 +1,59 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestDeletePreviousEvent(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	prevEvents, err := NewSqlitePrevEventsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	sha := []byte("sha")
+
+	// Two events reference the previous event, so it is still referenced
+	// once one of them has gone, but not once both have.
+	for _, eventNID := range []types.EventNID{1, 2} {
+		if err = prevEvents.InsertPreviousEvent(ctx, nil, "$prev", sha, eventNID); err != nil {
+			t.Fatalf("InsertPreviousEvent failed: %s", err)
+		}
+	}
+	if err = prevEvents.DeletePreviousEvent(ctx, nil, "$prev", sha, types.EventNID(1)); err != nil {
+		t.Fatalf("DeletePreviousEvent failed: %s", err)
+	}
+	if err = prevEvents.SelectPreviousEventExists(ctx, nil, "$prev", sha); err != nil {
+		t.Fatalf("got %v for a previous event which is still referenced, want it to exist", err)
+	}
+	if err = prevEvents.DeletePreviousEvent(ctx, nil, "$prev", sha, types.EventNID(2)); err != nil {
+		t.Fatalf("DeletePreviousEvent failed: %s", err)
+	}
+	if err = prevEvents.SelectPreviousEventExists(ctx, nil, "$prev", sha); err != sql.ErrNoRows {
+		t.Fatalf("got %v for a previous event which isn't referenced any more, want sql.ErrNoRows", err)
+	}
+}
@@ -59,12 +59,18 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	if err := ms.execSchema(db); err != nil {
 		return nil, err
 	}
+	for _, schema := range []string{eventsSchema, eventJSONSchema, eventTimestampsSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return nil, err
+		}
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadAddForgottenColumn(m)
+	deltas.LoadAddEventTimestamps(m)
 	if err := m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
-	if err := d.prepare(db, cache); err != nil {
+	if err := d.prepare(db, sqlutil.ExclusiveWriterForDatabase(dbProperties), cache); err != nil {
 		return nil, err
 	}
 
@@ -72,7 +78,7 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 }
 
 // nolint: gocyclo
-func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
+func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.RoomServerCaches) error {
 	var err error
 	eventStateKeys, err := NewSqliteEventStateKeysTable(db)
 	if err != nil {
@@ -118,6 +124,10 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	userDirectory, err := NewSqliteUserDirectoryTable(db)
+	if err != nil {
+		return err
+	}
 	membership, err := NewSqliteMembershipTable(db)
 	if err != nil {
 		return err
@@ -130,10 +140,14 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	eventTimestamps, err := NewSqliteEventTimestampsTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                         db,
 		Cache:                      cache,
-		Writer:                     sqlutil.NewExclusiveWriter(),
+		Writer:                     writer,
 		EventsTable:                events,
 		EventTypesTable:            eventTypes,
 		EventStateKeysTable:        eventStateKeys,
@@ -146,8 +160,10 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		RoomAliasesTable:           roomAliases,
 		InvitesTable:               invites,
 		MembershipTable:            membership,
+		UserDirectoryTable:         userDirectory,
 		PublishedTable:             published,
 		RedactionsTable:            redactions,
+		EventTimestampsTable:       eventTimestamps,
 		GetLatestEventsForUpdateFn: d.GetLatestEventsForUpdate,
 	}
 	return nil
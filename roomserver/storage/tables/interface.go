@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
@@ -19,6 +20,8 @@ type EventJSON interface {
 	// Insert the event JSON. On conflict, replace the event JSON with the new value (for redactions).
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
 	BulkSelectEventJSON(ctx context.Context, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	// DeleteEventJSON deletes the JSON for the given events, e.g. when they have expired.
+	DeleteEventJSON(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
 }
 
 type EventTypes interface {
@@ -60,6 +63,11 @@ type Events interface {
 	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
+	// BulkSelectAuthEventNIDs returns a map from numeric event ID to the numeric IDs of the auth events of the event.
+	// If an event is not in the database then it is omitted from the map.
+	BulkSelectAuthEventNIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID][]types.EventNID, error)
+	// DeleteEvents deletes the given events, e.g. when they have expired.
+	DeleteEvents(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
 }
 
 type Rooms interface {
@@ -104,6 +112,28 @@ type PreviousEvents interface {
 	// Check if the event reference exists
 	// Returns sql.ErrNoRows if the event reference doesn't exist.
 	SelectPreviousEventExists(ctx context.Context, txn *sql.Tx, eventID string, eventReferenceSHA256 []byte) error
+	// DeletePreviousEvent removes the event from the events that reference the previous event, e.g. when the
+	// event has expired. The previous event is no longer referenced at all once there are no events left.
+	DeletePreviousEvent(ctx context.Context, txn *sql.Tx, previousEventID string, previousEventReferenceSHA256 []byte, eventNID types.EventNID) error
+}
+
+// EventTimestamp is the origin_server_ts of an event.
+type EventTimestamp struct {
+	EventNID       types.EventNID
+	OriginServerTS gomatrixserverlib.Timestamp
+}
+
+// EventTimestamps stores when each non-state event was sent, so that expired events can be purged and
+// events can be looked up by when they were sent.
+type EventTimestamps interface {
+	InsertEventTimestamp(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, roomNID types.RoomNID, originServerTS gomatrixserverlib.Timestamp) error
+	// SelectEventsBeforeTimestamp returns up to limit events in the room which were sent before the given time, oldest
+	// first, starting after the given event.
+	SelectEventsBeforeTimestamp(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, before gomatrixserverlib.Timestamp, after EventTimestamp, limit int) ([]EventTimestamp, error)
+	// SelectEventNearestTimestamp returns the event in the room which is closest to the given timestamp, at or
+	// before it if backwards is true and at or after it otherwise. Returns sql.ErrNoRows if there is no such event.
+	SelectEventNearestTimestamp(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, backwards bool) (types.EventNID, gomatrixserverlib.Timestamp, error)
+	DeleteEventTimestamps(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
 }
 
 type Invites interface {
@@ -132,10 +162,19 @@ type Membership interface {
 	// SelectJoinedUsersSetForRooms returns the set of all users in the rooms who are joined to any of these rooms, along with the
 	// counts of how many rooms they are joined.
 	SelectJoinedUsersSetForRooms(ctx context.Context, roomNIDs []types.RoomNID) (map[types.EventStateKeyNID]int, error)
-	SelectKnownUsers(ctx context.Context, userID types.EventStateKeyNID, searchString string, limit int) ([]string, error)
+	// SelectKnownUsers returns the profiles of users who are joined to a room that the user is joined to, and whose
+	// user ID or display name starts with the search string.
+	SelectKnownUsers(ctx context.Context, userID types.EventStateKeyNID, searchString string, limit int) ([]authtypes.FullyQualifiedProfile, error)
 	UpdateForgetMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, forget bool) error
 }
 
+// UserDirectory stores the latest profile of each user from their join events, so
+// that the user directory can search by display name. Profiles are global rather
+// than per-room, so the latest join to any room replaces the profile.
+type UserDirectory interface {
+	UpsertUserProfile(ctx context.Context, txn *sql.Tx, userNID types.EventStateKeyNID, displayName, avatarURL string) error
+}
+
 type Published interface {
 	UpsertRoomPublished(ctx context.Context, txn *sql.Tx, roomID string, published bool) (err error)
 	SelectPublishedFromRoomID(ctx context.Context, roomID string) (published bool, err error)
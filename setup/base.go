@@ -46,6 +46,7 @@ import (
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	rsinthttp "github.com/matrix-org/dendrite/roomserver/inthttp"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	skapi "github.com/matrix-org/dendrite/signingkeyserver/api"
 	skinthttp "github.com/matrix-org/dendrite/signingkeyserver/inthttp"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -67,12 +68,17 @@ type BaseDendrite struct {
 	PublicFederationAPIMux *mux.Router
 	PublicKeyAPIMux        *mux.Router
 	PublicMediaAPIMux      *mux.Router
+	DendriteAdminMux       *mux.Router
 	InternalAPIMux         *mux.Router
 	UseHTTPAPIs            bool
 	apiHttpClient          *http.Client
 	httpClient             *http.Client
 	Cfg                    *config.Dendrite
 	Caches                 *caching.Caches
+	// SpamChecker is given to each component that checks for spam. It
+	// allows everything unless a custom build replaces it before setting
+	// up the components.
+	SpamChecker spamcheck.Checker
 	//	KafkaConsumer          sarama.Consumer
 	//	KafkaProducer          sarama.SyncProducer
 }
@@ -106,7 +112,7 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 		logrus.WithError(err).Panicf("failed to start opentracing")
 	}
 
-	cache, err := caching.NewInMemoryLRUCache(true)
+	cache, err := caching.NewInMemoryLRUCache(&cfg.Global.Cache, true)
 	if err != nil {
 		logrus.WithError(err).Warnf("Failed to create cache")
 	}
@@ -152,10 +158,12 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 		tracerCloser:           closer,
 		Cfg:                    cfg,
 		Caches:                 cache,
+		SpamChecker:            spamcheck.NopChecker{},
 		PublicClientAPIMux:     mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicClientPathPrefix).Subrouter().UseEncodedPath(),
 		PublicFederationAPIMux: mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath(),
 		PublicKeyAPIMux:        mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicKeyPathPrefix).Subrouter().UseEncodedPath(),
 		PublicMediaAPIMux:      mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicMediaPathPrefix).Subrouter().UseEncodedPath(),
+		DendriteAdminMux:       mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicDendritePathPrefix).Subrouter().UseEncodedPath(),
 		InternalAPIMux:         mux.NewRouter().SkipClean(true).PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
 		apiHttpClient:          &apiClient,
 		httpClient:             &client,
@@ -238,7 +246,7 @@ func (b *BaseDendrite) KeyServerHTTPClient() keyserverAPI.KeyInternalAPI {
 // CreateAccountsDB creates a new instance of the accounts database. Should only
 // be called once per component.
 func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
-	db, err := accounts.NewDatabase(&b.Cfg.UserAPI.AccountDatabase, b.Cfg.Global.ServerName)
+	db, err := accounts.NewDatabase(&b.Cfg.UserAPI.AccountDatabase, b.Cfg.Global.ServerName, &b.Cfg.UserAPI.PasswordHashing)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to accounts db")
 	}
@@ -268,10 +276,23 @@ func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationCli
 			b.Cfg.FederationSender.DisableTLSValidation, noOpHTTPTransport,
 		)
 	}
+	// Each request has its own timeout depending on the type of request, so
+	// the client itself only needs to stop requests that outlive all of them.
+	timeout := b.Cfg.FederationSender.Timeouts.Longest()
 	client := gomatrixserverlib.NewFederationClientWithTimeout(
 		b.Cfg.Global.ServerName, b.Cfg.Global.KeyID, b.Cfg.Global.PrivateKey,
-		b.Cfg.FederationSender.DisableTLSValidation, time.Minute*5,
+		b.Cfg.FederationSender.DisableTLSValidation, timeout,
 	)
+	if limit := b.Cfg.FederationSender.MaxConcurrentRequests; limit > 0 {
+		// Send requests through a client that resolves server names as usual,
+		// but via a transport that limits the requests to each destination.
+		resolving := gomatrixserverlib.NewClientWithTimeout(
+			timeout, b.Cfg.FederationSender.DisableTLSValidation,
+		)
+		client.Client = *gomatrixserverlib.NewClientWithTransportTimeout(
+			timeout, httputil.NewDestinationLimiter(resolving, limit),
+		)
+	}
 	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
 	return client
 }
@@ -322,6 +343,7 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		externalRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(b.PublicFederationAPIMux)
 	}
 	externalRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(b.PublicMediaAPIMux)
+	externalRouter.PathPrefix(httputil.PublicDendritePathPrefix).Handler(b.DendriteAdminMux)
 
 	if internalAddr != NoListener && internalAddr != externalAddr {
 		go func() {
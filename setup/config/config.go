@@ -250,6 +250,24 @@ func loadConfig(
 			return nil, perr
 		}
 
+		// A superseded key must not share a key ID with the current key or any
+		// other superseded key, otherwise remote servers won't be able to tell
+		// them apart when verifying signatures.
+		if keyID == c.Global.KeyID {
+			return nil, fmt.Errorf("old private key %q has the same key ID %q as the current private key", oldPrivateKeyPath, keyID)
+		}
+		for _, otherKey := range c.Global.OldVerifyKeys[:i] {
+			if keyID == otherKey.KeyID {
+				return nil, fmt.Errorf("old private key %q has the same key ID %q as another old private key", oldPrivateKeyPath, keyID)
+			}
+		}
+
+		// Remote servers use expired_ts to decide which events the old key is
+		// still allowed to verify, so it must be set.
+		if oldPrivateKey.ExpiredAt == 0 {
+			return nil, fmt.Errorf("old private key %q must specify expired_at", oldPrivateKeyPath)
+		}
+
 		c.Global.OldVerifyKeys[i].KeyID, c.Global.OldVerifyKeys[i].PrivateKey = keyID, privateKey
 	}
 
@@ -275,13 +293,27 @@ func (config *Dendrite) Derive() error {
 	// TODO: Add email auth type
 	// TODO: Add MSISDN auth type
 
+	var stages []authtypes.LoginType
 	if config.ClientAPI.RecaptchaEnabled {
 		config.Derived.Registration.Params[authtypes.LoginTypeRecaptcha] = map[string]string{"public_key": config.ClientAPI.RecaptchaPublicKey}
-		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
-			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}})
-	} else {
-		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
-			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
+		stages = append(stages, authtypes.LoginTypeRecaptcha)
+	}
+	if config.ClientAPI.RegistrationRequiresToken {
+		stages = append(stages, authtypes.LoginTypeRegistrationToken)
+	}
+	if len(stages) == 0 {
+		stages = append(stages, authtypes.LoginTypeDummy)
+	}
+	config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
+		authtypes.Flow{Stages: stages})
+
+	// Compile the username regex once, rather than for every registration
+	if config.ClientAPI.UsernameRegex != "" {
+		re, err := regexp.Compile(config.ClientAPI.UsernameRegex)
+		if err != nil {
+			return fmt.Errorf("invalid regex for config key %q: %w", "client_api.username_regex", err)
+		}
+		config.ClientAPI.UsernameRegexp = re
 	}
 
 	// Load application service configuration files
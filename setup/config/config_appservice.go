@@ -88,6 +88,31 @@ type ApplicationService struct {
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// Whether the application service wants to receive ephemeral events, such
+	// as typing notifications, receipts and presence, as described in MSC2409
+	PushEphemeral bool `yaml:"de.sorunome.msc2409.push_ephemeral"`
+}
+
+// The namespace kinds that an application service can register interest in.
+const (
+	NamespaceUsers   = "users"
+	NamespaceAliases = "aliases"
+	NamespaceRooms   = "rooms"
+)
+
+// MatchNamespace returns whether any of the application service's namespaces
+// of the given kind match the value, and whether any of those matching
+// namespaces are exclusive.
+func (a *ApplicationService) MatchNamespace(kind, value string) (matches, exclusive bool) {
+	for _, namespace := range a.NamespaceMap[kind] {
+		if namespace.RegexpObject != nil && namespace.RegexpObject.MatchString(value) {
+			matches = true
+			if namespace.Exclusive {
+				exclusive = true
+			}
+		}
+	}
+	return
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
@@ -180,6 +205,15 @@ func loadAppServices(config *AppServiceAPI, derived *Derived) error {
 			return err
 		}
 
+		// Compile the namespace regexes so that they can be matched against
+		// later on. Invalid regexes are reported by checkErrors below.
+		for key, namespaceSlice := range appservice.NamespaceMap {
+			for i := range namespaceSlice {
+				namespaceSlice[i].RegexpObject, _ = regexp.Compile(namespaceSlice[i].Regex)
+			}
+			appservice.NamespaceMap[key] = namespaceSlice
+		}
+
 		// Append the parsed application service to the global config
 		derived.ApplicationServices = append(
 			derived.ApplicationServices, appservice,
@@ -203,9 +237,9 @@ func setupRegexps(_ *AppServiceAPI, derived *Derived) (err error) {
 	for _, appservice := range derived.ApplicationServices {
 		for key, namespaceSlice := range appservice.NamespaceMap {
 			switch key {
-			case "users":
+			case NamespaceUsers:
 				appendExclusiveNamespaceRegexs(&exclusiveUsernameStrings, namespaceSlice)
-			case "aliases":
+			case NamespaceAliases:
 				appendExclusiveNamespaceRegexs(&exclusiveAliasStrings, namespaceSlice)
 			}
 		}
@@ -244,15 +278,12 @@ func setupRegexps(_ *AppServiceAPI, derived *Derived) (err error) {
 func appendExclusiveNamespaceRegexs(
 	exclusiveStrings *[]string, namespaces []ApplicationServiceNamespace,
 ) {
-	for index, namespace := range namespaces {
+	for _, namespace := range namespaces {
 		if namespace.Exclusive {
 			// We append parenthesis to later separate each regex when we compile
 			// i.e. "app1.*", "app2.*" -> "(app1.*)|(app2.*)"
 			*exclusiveStrings = append(*exclusiveStrings, "("+namespace.Regex+")")
 		}
-
-		// Compile this regex into a Regexp object for later use
-		namespaces[index].RegexpObject, _ = regexp.Compile(namespace.Regex)
 	}
 }
 
@@ -266,11 +297,13 @@ func checkErrors(config *AppServiceAPI, derived *Derived) (err error) {
 	groupIDRegexp := regexp.MustCompile(`\+.*:.*`)
 
 	// Check each application service for any config errors
-	for _, appservice := range derived.ApplicationServices {
+	for i := range derived.ApplicationServices {
+		appservice := &derived.ApplicationServices[i]
+
 		// Namespace-related checks
 		for key, namespaceSlice := range appservice.NamespaceMap {
 			for _, namespace := range namespaceSlice {
-				if err := validateNamespace(&appservice, key, &namespace, groupIDRegexp); err != nil {
+				if err := validateNamespace(appservice, key, &namespace, groupIDRegexp); err != nil {
 					return err
 				}
 			}
@@ -308,9 +341,57 @@ func checkErrors(config *AppServiceAPI, derived *Derived) (err error) {
 		}
 	}
 
+	if err := checkNamespaceConflicts(config, derived); err != nil {
+		return err
+	}
+
 	return setupRegexps(config, derived)
 }
 
+// checkNamespaceConflicts makes sure that no application service claims a
+// namespace that is exclusively reserved by another application service,
+// either by registering the same exclusive regex or by exclusively claiming
+// the user ID that another application service sends as.
+func checkNamespaceConflicts(config *AppServiceAPI, derived *Derived) error {
+	// exclusive namespace kind + regex -> ID of the application service reserving it
+	reserved := make(map[string]string)
+	for _, appservice := range derived.ApplicationServices {
+		for key, namespaceSlice := range appservice.NamespaceMap {
+			for _, namespace := range namespaceSlice {
+				if !namespace.Exclusive {
+					continue
+				}
+				if owner, ok := reserved[key+" "+namespace.Regex]; ok && owner != appservice.ID {
+					return ConfigErrors([]string{fmt.Sprintf(
+						"Application service %s claims exclusive %s namespace %q which is already reserved by application service %s",
+						appservice.ID, key, namespace.Regex, owner,
+					)})
+				}
+				reserved[key+" "+namespace.Regex] = appservice.ID
+			}
+		}
+	}
+
+	if config.Matrix == nil {
+		return nil
+	}
+	for _, appservice := range derived.ApplicationServices {
+		senderUserID := fmt.Sprintf("@%s:%s", appservice.SenderLocalpart, config.Matrix.ServerName)
+		for _, other := range derived.ApplicationServices {
+			if other.ID == appservice.ID {
+				continue
+			}
+			if _, exclusive := other.MatchNamespace(NamespaceUsers, senderUserID); exclusive {
+				return ConfigErrors([]string{fmt.Sprintf(
+					"Application service %s exclusively claims the sender %s of application service %s",
+					other.ID, senderUserID, appservice.ID,
+				)})
+			}
+		}
+	}
+	return nil
+}
+
 // validateNamespace returns nil or an error based on whether a given
 // application service namespace is valid. A namespace is valid if it has the
 // required fields, and its regex is correct.
@@ -320,15 +401,23 @@ func validateNamespace(
 	namespace *ApplicationServiceNamespace,
 	groupIDRegexp *regexp.Regexp,
 ) error {
+	switch key {
+	case NamespaceUsers, NamespaceAliases, NamespaceRooms:
+	default:
+		return ConfigErrors([]string{fmt.Sprintf(
+			"Unknown namespace %q for Application Service %s", key, appservice.ID,
+		)})
+	}
+
 	// Check that namespace(s) are valid regex
-	if !IsValidRegex(namespace.Regex) {
+	if _, err := regexp.Compile(namespace.Regex); err != nil {
 		return ConfigErrors([]string{fmt.Sprintf(
-			"Invalid regex string for Application Service %s", appservice.ID,
+			"Invalid regex string %q for Application Service %s: %s", namespace.Regex, appservice.ID, err,
 		)})
 	}
 
 	// Check if GroupID for the users namespace is in the correct format
-	if key == "users" && namespace.GroupID != "" {
+	if key == NamespaceUsers && namespace.GroupID != "" {
 		// TODO: Remove once group_id is implemented
 		log.Warn("WARNING: Application service option group_id is currently unimplemented")
 
@@ -0,0 +1,123 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testAppService(id, senderLocalpart, usersRegex string, exclusive bool) string {
+	return fmt.Sprintf(`
+id: %s
+url: http://localhost:9999
+as_token: %s_as_token
+hs_token: %s_hs_token
+sender_localpart: %s
+rate_limited: false
+namespaces:
+  users:
+  - exclusive: %v
+    regex: %q
+  rooms:
+  - exclusive: false
+    regex: "!%s.*:localhost"
+`, id, id, id, senderLocalpart, exclusive, usersRegex, id)
+}
+
+func loadTestAppServices(t *testing.T, registrations ...string) (*Derived, error) {
+	dir, err := ioutil.TempDir("", "appservices")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) }) // nolint: errcheck
+	cfg := &AppServiceAPI{
+		Matrix: &Global{ServerName: "localhost"},
+	}
+	for i, registration := range registrations {
+		path := filepath.Join(dir, fmt.Sprintf("appservice%d.yaml", i))
+		if err = ioutil.WriteFile(path, []byte(registration), 0600); err != nil {
+			t.Fatalf("failed to write registration: %s", err)
+		}
+		cfg.ConfigFiles = append(cfg.ConfigFiles, path)
+	}
+	derived := &Derived{}
+	return derived, loadAppServices(cfg, derived)
+}
+
+func TestLoadAppServices(t *testing.T) {
+	derived, err := loadTestAppServices(t,
+		testAppService("irc", "irc_bot", "@irc_.*:localhost", true),
+		testAppService("slack", "slack_bot", "@slack_.*:localhost", false),
+	)
+	if err != nil {
+		t.Fatalf("failed to load application services: %s", err)
+	}
+	if len(derived.ApplicationServices) != 2 {
+		t.Fatalf("got %d application services, want 2", len(derived.ApplicationServices))
+	}
+	irc := derived.ApplicationServices[0]
+	if matches, exclusive := irc.MatchNamespace(NamespaceUsers, "@irc_alice:localhost"); !matches || !exclusive {
+		t.Errorf("irc namespace matches %v exclusive %v, want both", matches, exclusive)
+	}
+	// room namespaces need to be compiled too, not just users and aliases
+	if !irc.IsInterestedInRoomID("!irc1234:localhost") {
+		t.Errorf("irc application service isn't interested in its own room")
+	}
+	if !derived.ExclusiveApplicationServicesUsernameRegexp.MatchString("@irc_alice:localhost") {
+		t.Errorf("exclusive username regexp doesn't cover the irc namespace")
+	}
+	if derived.ExclusiveApplicationServicesUsernameRegexp.MatchString("@slack_alice:localhost") {
+		t.Errorf("exclusive username regexp covers the non-exclusive slack namespace")
+	}
+}
+
+func TestLoadAppServicesRejectsBadRegistrations(t *testing.T) {
+	testCases := []struct {
+		name          string
+		registrations []string
+	}{
+		{"malformed regex", []string{
+			testAppService("irc", "irc_bot", "@irc_[:localhost", true),
+		}},
+		{"unknown namespace", []string{`
+id: irc
+url: http://localhost:9999
+as_token: as_token
+hs_token: hs_token
+sender_localpart: irc_bot
+namespaces:
+  things:
+  - exclusive: true
+    regex: ".*"
+`}},
+		{"same exclusive namespace", []string{
+			testAppService("irc", "irc_bot", "@irc_.*:localhost", true),
+			testAppService("irc2", "irc2_bot", "@irc_.*:localhost", true),
+		}},
+		{"exclusively claims another sender", []string{
+			testAppService("irc", "irc_bot", "@.*_bot:localhost", true),
+			testAppService("slack", "slack_bot", "@slack_.*:localhost", false),
+		}},
+	}
+	for _, tc := range testCases {
+		if _, err := loadTestAppServices(t, tc.registrations...); err == nil {
+			t.Errorf("%s: expected loading application services to fail", tc.name)
+		}
+	}
+}
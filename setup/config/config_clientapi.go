@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"regexp"
 	"time"
 )
 
@@ -18,6 +19,22 @@ type ClientAPI struct {
 	// If set, allows registration by anyone who also has the shared
 	// secret, even if registration is otherwise disabled.
 	RegistrationSharedSecret string `yaml:"registration_shared_secret"`
+	// If set, new users can only register with one of the registration
+	// tokens, e.g. to make registration invite-only.
+	RegistrationRequiresToken bool `yaml:"registration_requires_token"`
+	// The tokens that can be used to register when registration requires
+	// a token. Each token can be used any number of times.
+	RegistrationTokens []string `yaml:"registration_tokens"`
+	// Usernames that nobody can register, e.g. to stop users from pretending
+	// to be the server admins. Registration with the shared secret and by
+	// application services isn't affected.
+	ReservedUsernames []string `yaml:"reserved_usernames"`
+	// If set, new usernames must also match this regular expression, e.g. to
+	// allow fewer characters than the spec does. Registration with the shared
+	// secret and by application services isn't affected.
+	UsernameRegex string `yaml:"username_regex"`
+	// The compiled UsernameRegex, or nil if it isn't set.
+	UsernameRegexp *regexp.Regexp `yaml:"-"`
 
 	// Boolean stating whether catpcha registration is enabled
 	// and required
@@ -37,6 +54,10 @@ type ClientAPI struct {
 
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
+
+	// The power levels that new rooms are created with, unless the client
+	// sets them when creating the room.
+	DefaultPowerLevels DefaultPowerLevels `yaml:"default_power_levels"`
 }
 
 func (c *ClientAPI) Defaults() {
@@ -50,6 +71,8 @@ func (c *ClientAPI) Defaults() {
 	c.RecaptchaBypassSecret = ""
 	c.RecaptchaSiteVerifyAPI = ""
 	c.RegistrationDisabled = false
+	c.RegistrationRequiresToken = false
+	c.RegistrationTokens = nil
 	c.RateLimiting.Defaults()
 }
 
@@ -64,15 +87,39 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", string(c.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "client_api.recaptcha_siteverify_api", string(c.RecaptchaSiteVerifyAPI))
 	}
+	if c.RegistrationRequiresToken {
+		if len(c.RegistrationTokens) == 0 {
+			configErrs.Add(fmt.Sprintf("missing config key %q", "client_api.registration_tokens"))
+		}
+		for i, token := range c.RegistrationTokens {
+			checkNotEmpty(configErrs, fmt.Sprintf("client_api.registration_tokens[%d]", i), token)
+		}
+	}
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
 }
 
+// DefaultPowerLevels replaces the built-in power levels of new rooms. Unset
+// levels keep their built-in values, and the events and notifications levels
+// are merged into the built-in ones.
+type DefaultPowerLevels struct {
+	Ban           *int64           `yaml:"ban"`
+	Invite        *int64           `yaml:"invite"`
+	Kick          *int64           `yaml:"kick"`
+	Redact        *int64           `yaml:"redact"`
+	UsersDefault  *int64           `yaml:"users_default"`
+	EventsDefault *int64           `yaml:"events_default"`
+	StateDefault  *int64           `yaml:"state_default"`
+	Events        map[string]int64 `yaml:"events"`
+	Notifications map[string]int64 `yaml:"notifications"`
+}
+
 type TURN struct {
 	// TODO Guest Support
 	// Whether or not guests can request TURN credentials
 	// AllowGuests bool `yaml:"turn_allow_guests"`
-	// How long the authorization should last
+	// How long the authorization should last, as a duration like "1h".
+	// Defaults to an hour.
 	UserLifetime string `yaml:"turn_user_lifetime"`
 	// The list of TURN URIs to pass to clients
 	URIs []string `yaml:"turn_uris"`
@@ -110,9 +157,13 @@ type RateLimiting struct {
 }
 
 func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
+	r.verify(configErrs, "client_api.rate_limiting")
+}
+
+func (r *RateLimiting) verify(configErrs *ConfigErrors, key string) {
 	if r.Enabled {
-		checkPositive(configErrs, "client_api.rate_limiting.threshold", r.Threshold)
-		checkPositive(configErrs, "client_api.rate_limiting.cooloff_ms", r.CooloffMS)
+		checkPositive(configErrs, key+".threshold", r.Threshold)
+		checkPositive(configErrs, key+".cooloff_ms", r.CooloffMS)
 	}
 }
 
@@ -1,17 +1,61 @@
 package config
 
+import "time"
+
 type EDUServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
+
+	// Typing notification configuration
+	Typing TypingOptions `yaml:"typing"`
 }
 
 func (c *EDUServer) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7778"
 	c.InternalAPI.Connect = "http://localhost:7778"
+	c.Typing.Defaults()
 }
 
 func (c *EDUServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "edu_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "edu_server.internal_api.connect", string(c.InternalAPI.Connect))
+	c.Typing.Verify(configErrs, isMonolith)
+}
+
+// The configuration to use for typing notifications
+type TypingOptions struct {
+	// How long a user is shown as typing for if they don't say how long they
+	// will be typing for. Defaults to 30 seconds.
+	DefaultTimeout time.Duration `yaml:"default_timeout"`
+
+	// The longest that a user can be shown as typing for. Longer timeouts
+	// requested by clients are reduced to this. Defaults to 2 minutes.
+	MaxTimeout time.Duration `yaml:"max_timeout"`
+}
+
+func (c *TypingOptions) Defaults() {
+	c.DefaultTimeout = time.Second * 30
+	c.MaxTimeout = time.Minute * 2
+}
+
+func (c *TypingOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkPositive(configErrs, "edu_server.typing.default_timeout", int64(c.DefaultTimeout))
+	checkPositive(configErrs, "edu_server.typing.max_timeout", int64(c.MaxTimeout))
+	if c.DefaultTimeout > c.MaxTimeout {
+		configErrs.Add("edu_server.typing.default_timeout must not be longer than edu_server.typing.max_timeout")
+	}
+}
+
+// Timeout returns how long a user should be shown as typing for when they
+// asked for the given timeout, which is zero if they didn't ask for one.
+func (c *TypingOptions) Timeout(requested time.Duration) time.Duration {
+	switch {
+	case requested <= 0:
+		return c.DefaultTimeout
+	case requested > c.MaxTimeout:
+		return c.MaxTimeout
+	default:
+		return requested
+	}
 }
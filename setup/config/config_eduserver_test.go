@@ -0,0 +1,36 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingTimeout(t *testing.T) {
+	opts := TypingOptions{
+		DefaultTimeout: 30 * time.Second,
+		MaxTimeout:     2 * time.Minute,
+	}
+	for requested, want := range map[time.Duration]time.Duration{
+		0:                opts.DefaultTimeout,
+		10 * time.Second: 10 * time.Second,
+		time.Hour:        opts.MaxTimeout,
+	} {
+		if got := opts.Timeout(requested); got != want {
+			t.Errorf("requested timeout %s: got %s, want %s", requested, got, want)
+		}
+	}
+}
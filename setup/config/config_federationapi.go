@@ -1,5 +1,7 @@
 package config
 
+import "github.com/matrix-org/gomatrixserverlib"
+
 type FederationAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -12,6 +14,25 @@ type FederationAPI struct {
 	// to match one of these certificates.
 	// The certificates should be in PEM format.
 	FederationCertificatePaths []Path `yaml:"federation_certificates"`
+
+	// Disables acting as a key notary. If set, /key/v2/query will only return
+	// our own keys and will not fetch the keys of other servers on their behalf.
+	DisableKeyNotary bool `yaml:"disable_key_notary"`
+
+	// If not empty, only these servers are allowed to federate with us. Requests
+	// from other servers are rejected and nothing is sent to them.
+	AllowedServers []gomatrixserverlib.ServerName `yaml:"allowed_servers"`
+
+	// Servers that are not allowed to federate with us, even if they are listed
+	// in AllowedServers.
+	BlockedServers []gomatrixserverlib.ServerName `yaml:"blocked_servers"`
+
+	// Only log a warning, rather than rejecting the request, when a PDU in a
+	// room version which requires canonical JSON has values which change when
+	// converted to canonical form, e.g. numbers written with exponents. This is
+	// intended to be used while migrating. PDUs containing floats are always
+	// rejected.
+	CanonicalJSONWarnOnly bool `yaml:"canonical_json_warn_only"`
 }
 
 func (c *FederationAPI) Defaults() {
@@ -29,3 +50,22 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	// TODO: not applicable always, e.g. in demos
 	//checkNotZero(configErrs, "federation_api.federation_certificates", int64(len(c.FederationCertificatePaths)))
 }
+
+// IsServerAllowed returns true if we are allowed to federate with the given
+// server according to the allow and block lists.
+func (c *FederationAPI) IsServerAllowed(serverName gomatrixserverlib.ServerName) bool {
+	for _, blocked := range c.BlockedServers {
+		if serverName == blocked {
+			return false
+		}
+	}
+	if len(c.AllowedServers) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedServers {
+		if serverName == allowed {
+			return true
+		}
+	}
+	return false
+}
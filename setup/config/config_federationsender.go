@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type FederationSender struct {
 	Matrix *Global `yaml:"-"`
 
@@ -19,6 +24,24 @@ type FederationSender struct {
 	// on remote federation endpoints. This is not recommended in production!
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
 
+	// The maximum number of federation requests that can be in flight to a
+	// single server at once. Further requests wait for an earlier one to finish.
+	// The default value is 8 if not specified. 0 disables the limit.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests_per_destination"`
+
+	// How long to wait for more events to the same server before sending a
+	// transaction, so that events sent close together share a transaction.
+	// The default value is 0 if not specified, which sends events straight away.
+	SendBatchWindow time.Duration `yaml:"send_batch_window"`
+
+	// The maximum number of events that we gave up trying to send to keep a
+	// record of. The oldest records are deleted first. The default value is
+	// 10000 if not specified. 0 keeps every record.
+	MaxDeadLetters int `yaml:"max_dead_letters"`
+
+	// How long to wait for each type of federation request to complete.
+	Timeouts FederationTimeouts `yaml:"timeouts"`
+
 	Proxy Proxy `yaml:"proxy_outbound"`
 }
 
@@ -30,7 +53,10 @@ func (c *FederationSender) Defaults() {
 
 	c.FederationMaxRetries = 16
 	c.DisableTLSValidation = false
+	c.MaxConcurrentRequests = 8
+	c.MaxDeadLetters = 10000
 
+	c.Timeouts.Defaults()
 	c.Proxy.Defaults()
 }
 
@@ -38,6 +64,66 @@ func (c *FederationSender) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "federation_sender.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "federation_sender.internal_api.connect", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "federation_sender.database.connection_string", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "federation_sender.max_concurrent_requests_per_destination", int64(c.MaxConcurrentRequests))
+	checkPositive(configErrs, "federation_sender.send_batch_window", int64(c.SendBatchWindow))
+	checkPositive(configErrs, "federation_sender.max_dead_letters", int64(c.MaxDeadLetters))
+	c.Timeouts.Verify(configErrs)
+}
+
+// The timeouts for federation requests, by the type of request. Requests
+// which don't have a type of their own use the default.
+type FederationTimeouts struct {
+	// The timeout for requests which don't have their own timeout below.
+	// Defaults to 30 seconds.
+	Default time.Duration `yaml:"default"`
+	// The timeout for sending a transaction with /send. Defaults to 5 minutes.
+	Send time.Duration `yaml:"send"`
+	// The timeout for fetching the state of a room with /state and /state_ids,
+	// which can be very slow for large rooms. Defaults to 2 minutes.
+	State time.Duration `yaml:"state"`
+	// The timeout for fetching history with /backfill. Defaults to 1 minute.
+	Backfill time.Duration `yaml:"backfill"`
+	// The timeout for fetching the signing keys of a server, either directly
+	// or from a notary server. Defaults to 1 minute.
+	ServerKeys time.Duration `yaml:"server_keys"`
+}
+
+func (c *FederationTimeouts) Defaults() {
+	c.Default = time.Second * 30
+	c.Send = time.Minute * 5
+	c.State = time.Minute * 2
+	c.Backfill = time.Minute
+	c.ServerKeys = time.Minute
+}
+
+func (c *FederationTimeouts) Verify(configErrs *ConfigErrors) {
+	// A timeout of zero would make every request fail straight away.
+	for _, t := range []struct {
+		key     string
+		timeout time.Duration
+	}{
+		{"federation_sender.timeouts.default", c.Default},
+		{"federation_sender.timeouts.send", c.Send},
+		{"federation_sender.timeouts.state", c.State},
+		{"federation_sender.timeouts.backfill", c.Backfill},
+		{"federation_sender.timeouts.server_keys", c.ServerKeys},
+	} {
+		if t.timeout <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", t.key, t.timeout))
+		}
+	}
+}
+
+// Longest returns the longest of the timeouts, which the HTTP client that
+// makes the requests must allow for.
+func (c *FederationTimeouts) Longest() time.Duration {
+	longest := c.Default
+	for _, timeout := range []time.Duration{c.Send, c.State, c.Backfill, c.ServerKeys} {
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
 }
 
 // The config for setting a proxy to use for server->server requests
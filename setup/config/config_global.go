@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"math/rand"
 	"time"
 
@@ -48,6 +49,15 @@ type Global struct {
 
 	// Metrics configuration
 	Metrics Metrics `yaml:"metrics"`
+
+	// Presence configuration
+	Presence PresenceOptions `yaml:"presence"`
+
+	// Message retention configuration
+	Retention RetentionOptions `yaml:"retention"`
+
+	// In-memory cache configuration
+	Cache Cache `yaml:"cache"`
 }
 
 func (c *Global) Defaults() {
@@ -59,6 +69,9 @@ func (c *Global) Defaults() {
 
 	c.Kafka.Defaults()
 	c.Metrics.Defaults()
+	c.Presence.Defaults()
+	c.Retention.Defaults()
+	c.Cache.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -67,6 +80,104 @@ func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 
 	c.Kafka.Verify(configErrs, isMonolith)
 	c.Metrics.Verify(configErrs, isMonolith)
+	c.Presence.Verify(configErrs, isMonolith)
+	c.Retention.Verify(configErrs, isMonolith)
+	c.Cache.Verify(configErrs, isMonolith)
+}
+
+// The configuration to use for presence
+type PresenceOptions struct {
+	// How long a local user can go without being active before they are
+	// automatically marked as unavailable. Defaults to 5 minutes.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// How long a local user can go without being active before they are
+	// automatically marked as offline. This must be longer than the idle
+	// timeout. Defaults to 30 minutes.
+	OfflineTimeout time.Duration `yaml:"offline_timeout"`
+
+	// Whether to process presence updates received from other servers over
+	// federation. Defaults to true.
+	EnableInbound bool `yaml:"enable_inbound"`
+
+	// Whether to send presence updates for local users to other servers over
+	// federation. Defaults to true.
+	EnableOutbound bool `yaml:"enable_outbound"`
+}
+
+func (c *PresenceOptions) Defaults() {
+	c.IdleTimeout = time.Minute * 5
+	c.OfflineTimeout = time.Minute * 30
+	c.EnableInbound = true
+	c.EnableOutbound = true
+}
+
+// Enabled returns true if presence is enabled in either direction. If it
+// isn't then presence is turned off entirely, including in /sync.
+func (c *PresenceOptions) Enabled() bool {
+	return c.EnableInbound || c.EnableOutbound
+}
+
+func (c *PresenceOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkPositive(configErrs, "global.presence.idle_timeout", int64(c.IdleTimeout))
+	checkPositive(configErrs, "global.presence.offline_timeout", int64(c.OfflineTimeout))
+	if c.OfflineTimeout <= c.IdleTimeout {
+		configErrs.Add("global.presence.offline_timeout must be longer than global.presence.idle_timeout")
+	}
+}
+
+// The configuration to use for message retention (MSC1763)
+type RetentionOptions struct {
+	// Whether or not to purge events according to rooms' m.room.retention
+	// policies. Defaults to false.
+	Enabled bool `yaml:"enabled"`
+
+	// How long to keep events for in rooms which don't have a retention
+	// policy. Defaults to 0, which keeps them forever.
+	DefaultMaxLifetime time.Duration `yaml:"default_max_lifetime"`
+
+	// The shortest and longest max_lifetime that we will honour in a room's
+	// retention policy. Policies outside of these bounds are clamped to them.
+	// Defaults to 0, which means no bound.
+	AllowedLifetimeMin time.Duration `yaml:"allowed_lifetime_min"`
+	AllowedLifetimeMax time.Duration `yaml:"allowed_lifetime_max"`
+
+	// How often to look for and purge expired events. Defaults to 1 hour.
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+func (c *RetentionOptions) Defaults() {
+	c.PurgeInterval = time.Hour
+}
+
+func (c *RetentionOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkPositive(configErrs, "global.retention.default_max_lifetime", int64(c.DefaultMaxLifetime))
+	checkPositive(configErrs, "global.retention.allowed_lifetime_min", int64(c.AllowedLifetimeMin))
+	checkPositive(configErrs, "global.retention.allowed_lifetime_max", int64(c.AllowedLifetimeMax))
+	if c.AllowedLifetimeMax > 0 && c.AllowedLifetimeMax < c.AllowedLifetimeMin {
+		configErrs.Add("global.retention.allowed_lifetime_max must not be shorter than global.retention.allowed_lifetime_min")
+	}
+	checkPositive(configErrs, "global.retention.purge_interval", int64(c.PurgeInterval))
+	if c.Enabled {
+		checkNotZero(configErrs, "global.retention.purge_interval", int64(c.PurgeInterval))
+	}
+}
+
+// The configuration to use for the in-memory caches
+type Cache struct {
+	// The maximum number of events the roomserver keeps in memory to avoid
+	// loading them from the database again. Defaults to 1024.
+	EventCacheMaxEntries int `yaml:"event_cache_max_entries"`
+}
+
+func (c *Cache) Defaults() {
+	c.EventCacheMaxEntries = 1024
+}
+
+func (c *Cache) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.EventCacheMaxEntries <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "global.cache.event_cache_max_entries", c.EventCacheMaxEntries))
+	}
 }
 
 type OldVerifyKeys struct {
@@ -115,6 +226,22 @@ type DatabaseOptions struct {
 	MaxIdleConnections int `yaml:"max_idle_conns"`
 	// maximum amount of time (in seconds) a connection may be reused (<= 0 means unlimited)
 	ConnMaxLifetimeSeconds int `yaml:"conn_max_lifetime"`
+	// log a warning for queries that take longer than this (in milliseconds, <= 0 means disabled)
+	SlowQueryThresholdMilliseconds int `yaml:"slow_query_threshold"`
+	// SQLite connection options, ignored for PostgreSQL
+	SQLite SQLiteOptions `yaml:"sqlite"`
+}
+
+// SQLiteOptions are applied to each new SQLite connection.
+type SQLiteOptions struct {
+	// Use write-ahead logging rather than a rollback journal, so that readers
+	// don't block the writer
+	WAL bool `yaml:"wal"`
+	// How long to wait for a lock before failing with "database is locked",
+	// in milliseconds (0 = use the driver default)
+	BusyTimeoutMilliseconds int `yaml:"busy_timeout"`
+	// The synchronous level, one of OFF, NORMAL, FULL or EXTRA (empty = use the SQLite default)
+	Synchronous string `yaml:"synchronous"`
 }
 
 func (c *DatabaseOptions) Defaults() {
@@ -140,3 +267,8 @@ func (c DatabaseOptions) MaxOpenConns() int {
 func (c DatabaseOptions) ConnMaxLifetime() time.Duration {
 	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
 }
+
+// SlowQueryThreshold returns how long a query may take before it is logged as slow
+func (c DatabaseOptions) SlowQueryThreshold() time.Duration {
+	return time.Duration(c.SlowQueryThresholdMilliseconds) * time.Millisecond
+}
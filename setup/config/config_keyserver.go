@@ -6,6 +6,11 @@ type KeyServer struct {
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// The maximum number of one-time keys that a device can have stored at
+	// once. Uploads that would go over the limit are rejected. Zero means
+	// that there is no limit.
+	MaxOneTimeKeysPerDevice int `yaml:"max_one_time_keys_per_device"`
 }
 
 func (c *KeyServer) Defaults() {
@@ -13,10 +18,12 @@ func (c *KeyServer) Defaults() {
 	c.InternalAPI.Connect = "http://localhost:7779"
 	c.Database.Defaults()
 	c.Database.ConnectionString = "file:keyserver.db"
+	c.MaxOneTimeKeysPerDevice = 1000
 }
 
 func (c *KeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "key_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "key_server.internal_api.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "key_server.database.connection_string", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "key_server.max_one_time_keys_per_device", int64(c.MaxOneTimeKeysPerDevice))
 }
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"mime"
+	"strings"
 )
 
 type MediaAPI struct {
@@ -33,6 +35,18 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// The MIME types which may be uploaded, e.g. "image/png" or "image/*". If
+	// empty then all types are allowed, except for those which are blocked.
+	AllowedContentTypes []string `yaml:"allowed_content_types"`
+
+	// The MIME types which may not be uploaded. These take precedence over
+	// the allowed types.
+	BlockedContentTypes []string `yaml:"blocked_content_types"`
+
+	// Rate limiting of uploads for each user, separately from the rate
+	// limiting of the client API.
+	UploadRateLimiting RateLimiting `yaml:"upload_rate_limiting"`
 }
 
 func (c *MediaAPI) Defaults() {
@@ -46,6 +60,9 @@ func (c *MediaAPI) Defaults() {
 	c.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
 	c.BasePath = "./media_store"
+	c.UploadRateLimiting.Enabled = true
+	c.UploadRateLimiting.Threshold = 10
+	c.UploadRateLimiting.CooloffMS = 2000
 }
 
 func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -64,4 +81,53 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+	c.UploadRateLimiting.verify(configErrs, "media_api.upload_rate_limiting")
+	for i, contentType := range c.AllowedContentTypes {
+		checkContentType(configErrs, fmt.Sprintf("media_api.allowed_content_types[%d]", i), contentType)
+	}
+	for i, contentType := range c.BlockedContentTypes {
+		checkContentType(configErrs, fmt.Sprintf("media_api.blocked_content_types[%d]", i), contentType)
+	}
+}
+
+// IsContentTypeAllowed returns true if media of the given MIME type may be
+// uploaded according to the allow and block lists.
+func (c *MediaAPI) IsContentTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, blocked := range c.BlockedContentTypes {
+		if contentTypeMatches(blocked, mediaType) {
+			return false
+		}
+	}
+	if len(c.AllowedContentTypes) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedContentTypes {
+		if contentTypeMatches(allowed, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeMatches returns true if the media type matches the pattern,
+// which is either a full media type or a top-level type like "image/*".
+func contentTypeMatches(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == mediaType
+}
+
+// checkContentType verifies that the value is a MIME type without any
+// parameters, with "*" allowed in place of the subtype.
+func checkContentType(configErrs *ConfigErrors, key, value string) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" || strings.ContainsAny(value, "; ") {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key, value))
+	}
 }
@@ -1,11 +1,34 @@
 package config
 
+import (
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// The room version of new rooms when the client doesn't ask for one.
+	DefaultRoomVersion gomatrixserverlib.RoomVersion `yaml:"default_room_version"`
+
+	// The maximum number of rooms that a local user can create or be joined
+	// to at once. Zero means that there is no limit.
+	MaxRoomsPerUser int `yaml:"max_rooms_per_user"`
+
+	// The maximum number of joined members in a room. Only joins made through
+	// this server are checked. Zero means that there is no limit.
+	MaxMembersPerRoom int `yaml:"max_members_per_room"`
+
+	// The maximum number of rooms whose input events are processed at the
+	// same time. Events in the same room are always processed one at a time.
+	// Zero means that there is no limit.
+	InputWorkers int `yaml:"input_workers"`
 }
 
 func (c *RoomServer) Defaults() {
@@ -13,10 +36,18 @@ func (c *RoomServer) Defaults() {
 	c.InternalAPI.Connect = "http://localhost:7770"
 	c.Database.Defaults()
 	c.Database.ConnectionString = "file:roomserver.db"
+	c.DefaultRoomVersion = version.DefaultRoomVersion()
+	c.InputWorkers = 16
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "room_server.max_rooms_per_user", int64(c.MaxRoomsPerUser))
+	checkPositive(configErrs, "room_server.max_members_per_room", int64(c.MaxMembersPerRoom))
+	checkPositive(configErrs, "room_server.input_workers", int64(c.InputWorkers))
+	if _, err := version.SupportedRoomVersion(c.DefaultRoomVersion); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.default_room_version", err))
+	}
 }
@@ -0,0 +1,39 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestRoomServerDefaultRoomVersion(t *testing.T) {
+	for version, valid := range map[string]bool{
+		"5":   true,
+		"6":   true,
+		"":    false,
+		"999": false,
+	} {
+		var c RoomServer
+		c.Defaults()
+		c.DefaultRoomVersion = gomatrixserverlib.RoomVersion(version)
+		var errs ConfigErrors
+		c.Verify(&errs, true)
+		if got := len(errs) == 0; got != valid {
+			t.Errorf("default room version %q: got valid %v, want %v: %v", version, got, valid, errs)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -9,6 +11,23 @@ type SyncAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	RealIPHeader string `yaml:"real_ip_header"`
+
+	// The maximum number of events that a client can ask for in a single
+	// /messages request, and in the timeline of each room in a /sync. Larger
+	// limits are reduced to these. 0 disables the maximum.
+	MaxMessagesLimit int `yaml:"max_messages_limit"`
+	MaxTimelineLimit int `yaml:"max_timeline_limit"`
+
+	// The maximum number of state or timeline events that are fetched from
+	// the database by a single query when building a sync response. Larger
+	// rooms are fetched in several chunks to bound memory use. 0 disables
+	// chunking.
+	QueryChunkSize int `yaml:"query_chunk_size"`
+
+	// How long to remember which users share a room with each user, which
+	// is needed to work out device list changes. The cache is invalidated
+	// whenever a room membership changes. 0 disables the cache.
+	SharedUsersCacheLifetime time.Duration `yaml:"shared_users_cache_lifetime"`
 }
 
 func (c *SyncAPI) Defaults() {
@@ -17,6 +36,10 @@ func (c *SyncAPI) Defaults() {
 	c.ExternalAPI.Listen = "http://localhost:8073"
 	c.Database.Defaults()
 	c.Database.ConnectionString = "file:syncapi.db"
+	c.MaxMessagesLimit = 1000
+	c.MaxTimelineLimit = 100
+	c.QueryChunkSize = 500
+	c.SharedUsersCacheLifetime = time.Minute * 5
 }
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -26,4 +49,8 @@ func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkURL(configErrs, "sync_api.external_api.listen", string(c.ExternalAPI.Listen))
 	}
 	checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "sync_api.max_messages_limit", int64(c.MaxMessagesLimit))
+	checkPositive(configErrs, "sync_api.max_timeline_limit", int64(c.MaxTimelineLimit))
+	checkPositive(configErrs, "sync_api.query_chunk_size", int64(c.QueryChunkSize))
+	checkPositive(configErrs, "sync_api.shared_users_cache_lifetime", int64(c.SharedUsersCacheLifetime))
 }
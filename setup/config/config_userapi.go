@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -11,8 +16,98 @@ type UserAPI struct {
 	// The Device database stores session information for the devices of logged
 	// in local users. It is accessed by the UserAPI.
 	DeviceDatabase DatabaseOptions `yaml:"device_database"`
+
+	// The lifetime of OpenID tokens issued by /openid/request_token, which
+	// remote services can exchange for the user ID using /openid/userinfo.
+	OpenIDTokenLifetimeMS int64 `yaml:"openid_token_lifetime_ms"`
+	// The lifetime of single-use login tokens issued by /login/get_token,
+	// which can be exchanged for an access token using m.login.token.
+	LoginTokenLifetimeMS int64 `yaml:"login_token_lifetime_ms"`
+	// Rooms that newly registered users are automatically joined to, given
+	// as either room IDs or room aliases.
+	AutoJoinRooms []string `yaml:"auto_join_rooms"`
+	// How the passwords of local users are hashed when accounts are created
+	// or passwords are changed.
+	PasswordHashing PasswordHashing `yaml:"password_hashing"`
+	// The maximum number of devices that each user may have. 0 means that
+	// there is no limit.
+	MaxDevicesPerUser int `yaml:"max_devices_per_user"`
+	// What to do when a user with the maximum number of devices logs in
+	// again, either "reject" or "prune_oldest".
+	DeviceLimitStrategy string `yaml:"device_limit_strategy"`
+}
+
+const (
+	// DeviceLimitReject refuses to create new devices for users who have the
+	// maximum number of devices.
+	DeviceLimitReject = "reject"
+	// DeviceLimitPruneOldest removes the least recently used devices of users
+	// who have the maximum number of devices to make room for new ones.
+	DeviceLimitPruneOldest = "prune_oldest"
+)
+
+// PasswordHashing configures the scheme used for new password hashes.
+// Existing hashes are always verified using the scheme that made them, so
+// this can be changed without locking anyone out.
+type PasswordHashing struct {
+	// The algorithm to hash new passwords with, either "bcrypt" or "argon2id".
+	Algorithm string `yaml:"algorithm"`
+	// The bcrypt cost, between 4 and 31. Each step doubles the work needed.
+	BcryptCost int `yaml:"bcrypt_cost"`
+	// The parameters for argon2id.
+	Argon2id Argon2idOptions `yaml:"argon2id"`
+}
+
+// Argon2idOptions are the parameters for hashing passwords with argon2id.
+type Argon2idOptions struct {
+	// The amount of memory to use, in KiB.
+	MemoryKiB int `yaml:"memory_kib"`
+	// The number of passes over the memory.
+	Iterations int `yaml:"iterations"`
+	// The number of threads to use.
+	Parallelism int `yaml:"parallelism"`
 }
 
+const (
+	PasswordHashingBcrypt   = "bcrypt"
+	PasswordHashingArgon2id = "argon2id"
+)
+
+func (c *PasswordHashing) Defaults() {
+	c.Algorithm = PasswordHashingBcrypt
+	c.BcryptCost = 10
+	c.Argon2id.MemoryKiB = 64 * 1024
+	c.Argon2id.Iterations = 3
+	c.Argon2id.Parallelism = 2
+}
+
+func (c *PasswordHashing) Verify(configErrs *ConfigErrors) {
+	switch c.Algorithm {
+	case PasswordHashingBcrypt:
+		if c.BcryptCost < 4 || c.BcryptCost > 31 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.password_hashing.bcrypt_cost", c.BcryptCost))
+		}
+	case PasswordHashingArgon2id:
+		if c.Argon2id.MemoryKiB < 1 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.password_hashing.argon2id.memory_kib", c.Argon2id.MemoryKiB))
+		}
+		if c.Argon2id.Iterations < 1 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.password_hashing.argon2id.iterations", c.Argon2id.Iterations))
+		}
+		if c.Argon2id.Parallelism < 1 || c.Argon2id.Parallelism > 255 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.password_hashing.argon2id.parallelism", c.Argon2id.Parallelism))
+		}
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.password_hashing.algorithm", c.Algorithm))
+	}
+}
+
+// DefaultOpenIDTokenLifetimeMS is the default lifetime of an OpenID token.
+const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
+
+// DefaultLoginTokenLifetimeMS is the default lifetime of a login token.
+const DefaultLoginTokenLifetimeMS = 120000 // 2 minutes
+
 func (c *UserAPI) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7781"
 	c.InternalAPI.Connect = "http://localhost:7781"
@@ -20,6 +115,10 @@ func (c *UserAPI) Defaults() {
 	c.DeviceDatabase.Defaults()
 	c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
 	c.DeviceDatabase.ConnectionString = "file:userapi_devices.db"
+	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.LoginTokenLifetimeMS = DefaultLoginTokenLifetimeMS
+	c.PasswordHashing.Defaults()
+	c.DeviceLimitStrategy = DeviceLimitReject
 }
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -27,4 +126,20 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "user_api.internal_api.connect", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	checkNotEmpty(configErrs, "user_api.device_database.connection_string", string(c.DeviceDatabase.ConnectionString))
+	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.login_token_lifetime_ms", c.LoginTokenLifetimeMS)
+	c.PasswordHashing.Verify(configErrs)
+	if c.MaxDevicesPerUser < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.max_devices_per_user", c.MaxDevicesPerUser))
+	}
+	switch c.DeviceLimitStrategy {
+	case DeviceLimitReject, DeviceLimitPruneOldest:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.device_limit_strategy", c.DeviceLimitStrategy))
+	}
+	for _, room := range c.AutoJoinRooms {
+		if !strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#") {
+			configErrs.Add(fmt.Sprintf("invalid room ID or alias for config key %q: %s", "user_api.auto_join_rooms", room))
+		}
+	}
 }
@@ -27,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/mediaapi"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/spamcheck"
 	serverKeyAPI "github.com/matrix-org/dendrite/signingkeyserver/api"
 	"github.com/matrix-org/dendrite/syncapi"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -53,24 +54,33 @@ type Monolith struct {
 
 	// Optional
 	ExtPublicRoomsProvider api.ExtraPublicRoomsProvider
+	SpamChecker            spamcheck.Checker
 }
 
 // AddAllPublicRoutes attaches all public paths to the given router
-func (m *Monolith) AddAllPublicRoutes(csMux, ssMux, keyMux, mediaMux *mux.Router) {
+func (m *Monolith) AddAllPublicRoutes(csMux, ssMux, keyMux, mediaMux, dendriteMux *mux.Router) {
+	spamChecker := m.SpamChecker
+	if spamChecker == nil {
+		spamChecker = spamcheck.NopChecker{}
+	}
 	clientapi.AddPublicRoutes(
-		csMux, &m.Config.ClientAPI, m.AccountDB,
+		csMux, dendriteMux, &m.Config.ClientAPI, m.AccountDB,
 		m.FedClient, m.RoomserverAPI,
 		m.EDUInternalAPI, m.AppserviceAPI, transactions.New(),
 		m.FederationSenderAPI, m.UserAPI, m.KeyAPI, m.ExtPublicRoomsProvider,
+		spamChecker,
 	)
 	federationapi.AddPublicRoutes(
 		ssMux, keyMux, &m.Config.FederationAPI, m.UserAPI, m.FedClient,
 		m.KeyRing, m.RoomserverAPI, m.FederationSenderAPI,
 		m.EDUInternalAPI, m.KeyAPI,
 	)
-	mediaapi.AddPublicRoutes(mediaMux, &m.Config.MediaAPI, m.UserAPI, m.Client)
+	mediaapi.AddPublicRoutes(
+		mediaMux, ssMux, dendriteMux, &m.Config.MediaAPI, &m.Config.FederationAPI,
+		m.UserAPI, m.Client, m.KeyRing, spamChecker,
+	)
 	syncapi.AddPublicRoutes(
-		csMux, m.UserAPI, m.RoomserverAPI,
-		m.KeyAPI, m.FedClient, &m.Config.SyncAPI,
+		csMux, dendriteMux, m.UserAPI, m.RoomserverAPI,
+		m.KeyAPI, m.EDUInternalAPI, m.FedClient, m.FederationSenderAPI, m.KeyRing, &m.Config.SyncAPI,
 	)
 }
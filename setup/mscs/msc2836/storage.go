@@ -147,7 +147,7 @@ func newPostgresDatabase(dbOpts *config.DatabaseOptions) (Database, error) {
 
 func newSQLiteDatabase(dbOpts *config.DatabaseOptions) (Database, error) {
 	d := DB{
-		writer: sqlutil.NewExclusiveWriter(),
+		writer: sqlutil.ExclusiveWriterForDatabase(dbOpts),
 	}
 	var err error
 	if d.db, err = sqlutil.Open(dbOpts); err != nil {
@@ -0,0 +1,66 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spamcheck exposes places in Dendrite where operators can reject
+// spam with their own code. A custom build of Dendrite sets its Checker on
+// the base before setting up any components:
+//   base.SpamChecker = &myChecker{}
+// Each component uses the checker of the base that it was set up with, so
+// in polylith mode it must be set in every component binary.
+package spamcheck
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Checker decides whether things that users do are allowed. Each method
+// returns nil to allow the action, or an error to reject it, in which case
+// the error message is returned to the client.
+type Checker interface {
+	// CheckEventAllowed is called when the roomserver processes each new
+	// event, whether the sender is local or remote.
+	CheckEventAllowed(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
+	// CheckRegistrationAllowed is called before an account is created for
+	// a user registering themselves. Registrations by application services
+	// are not checked.
+	CheckRegistrationAllowed(ctx context.Context, localpart, ipAddr, userAgent string) error
+	// CheckInviteAllowed is called when the roomserver processes an invite,
+	// whether the inviter is local or remote.
+	CheckInviteAllowed(ctx context.Context, inviterUserID, inviteeUserID, roomID string) error
+	// CheckMediaAllowed is called before the media that a local user uploads
+	// is stored. The size is as reported by the client.
+	CheckMediaAllowed(ctx context.Context, userID, contentType, fileName string, size int64) error
+}
+
+// NopChecker allows everything. It is used when no other checker has been
+// set.
+type NopChecker struct{}
+
+func (NopChecker) CheckEventAllowed(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error {
+	return nil
+}
+
+func (NopChecker) CheckRegistrationAllowed(ctx context.Context, localpart, ipAddr, userAgent string) error {
+	return nil
+}
+
+func (NopChecker) CheckInviteAllowed(ctx context.Context, inviterUserID, inviteeUserID, roomID string) error {
+	return nil
+}
+
+func (NopChecker) CheckMediaAllowed(ctx context.Context, userID, contentType, fileName string, size int64) error {
+	return nil
+}
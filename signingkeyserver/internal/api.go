@@ -23,6 +23,8 @@ type ServerKeyAPI struct {
 
 	OurKeyRing gomatrixserverlib.KeyRing
 	FedClient  gomatrixserverlib.KeyClient
+
+	fetchBackoff keyFetchBackoff // keys we recently failed to fetch from their servers
 }
 
 func (s *ServerKeyAPI) KeyRing() *gomatrixserverlib.KeyRing {
@@ -81,8 +83,16 @@ func (s *ServerKeyAPI) FetchKeys(
 			break
 		}
 
-		// Ask the fetcher to look up our keys.
-		if err := s.handleFetcherKeys(ctx, now, fetcher, requests, results); err != nil {
+		// Ask the fetcher to look up our keys. Notaries are always asked,
+		// but we back off from asking servers directly for keys that they
+		// failed to give us recently.
+		var err error
+		if _, ok := fetcher.(*gomatrixserverlib.PerspectiveKeyFetcher); ok {
+			err = s.handleFetcherKeys(ctx, now, fetcher, requests, results)
+		} else {
+			err = s.handleDirectFetcherKeys(ctx, now, fetcher, requests, results)
+		}
+		if err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"fetcher_name": fetcher.FetcherName(),
 			}).Errorf("Failed to retrieve %d key(s)", len(requests))
@@ -194,6 +204,46 @@ func (s *ServerKeyAPI) handleDatabaseKeys(
 	return nil
 }
 
+// handleDirectFetcherKeys handles cases where a fetcher that asks the
+// servers themselves can satisfy the remaining requests. Keys that we
+// failed to fetch recently aren't asked for again until the backoff has
+// passed. Any keys that aren't fetched are left in the requests so that
+// the remaining fetchers can still be asked for them.
+func (s *ServerKeyAPI) handleDirectFetcherKeys(
+	ctx context.Context,
+	now gomatrixserverlib.Timestamp,
+	fetcher gomatrixserverlib.KeyFetcher,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	fetching := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, ts := range requests {
+		if !s.fetchBackoff.backingOff(req, time.Now()) {
+			fetching[req] = ts
+		}
+	}
+	if len(fetching) == 0 {
+		return nil
+	}
+	asked := make([]gomatrixserverlib.PublicKeyLookupRequest, 0, len(fetching))
+	for req := range fetching {
+		asked = append(asked, req)
+	}
+
+	// The fetcher removes the requests that it satisfies, so anything
+	// left over afterwards wasn't fetched.
+	err := s.handleFetcherKeys(ctx, now, fetcher, fetching, results)
+	for _, req := range asked {
+		if _, ok := fetching[req]; ok {
+			s.fetchBackoff.failure(req, time.Now())
+		} else {
+			s.fetchBackoff.success(req)
+			delete(requests, req)
+		}
+	}
+	return err
+}
+
 // handleFetcherKeys handles cases where a fetcher can satisfy
 // the remaining requests.
 func (s *ServerKeyAPI) handleFetcherKeys(
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type emptyKeyDatabase struct {
+	gomatrixserverlib.KeyDatabase
+}
+
+func (d *emptyKeyDatabase) FetcherName() string {
+	return "emptyKeyDatabase"
+}
+
+func (d *emptyKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return nil, nil
+}
+
+func (d *emptyKeyDatabase) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+// countingKeyFetcher counts the requests for each server and fails to fetch
+// keys for any server that is offline.
+type countingKeyFetcher struct {
+	offline  map[gomatrixserverlib.ServerName]bool
+	requests map[gomatrixserverlib.ServerName]int
+}
+
+func (f *countingKeyFetcher) FetcherName() string {
+	return "countingKeyFetcher"
+}
+
+func (f *countingKeyFetcher) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		f.requests[req.ServerName]++
+		if f.offline[req.ServerName] {
+			continue
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no keys available")
+	}
+	return results, nil
+}
+
+// notaryKeyClient counts the requests made to a notary, which never has
+// any keys.
+type notaryKeyClient struct {
+	gomatrixserverlib.KeyClient
+	requests map[gomatrixserverlib.ServerName]int
+}
+
+func (c *notaryKeyClient) LookupServerKeys(
+	ctx context.Context, matrixServer gomatrixserverlib.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	for req := range keyRequests {
+		c.requests[req.ServerName]++
+	}
+	return nil, fmt.Errorf("no keys available")
+}
+
+func TestFailedKeyFetchesBackOff(t *testing.T) {
+	fetcher := &countingKeyFetcher{
+		offline:  map[gomatrixserverlib.ServerName]bool{"dead.com": true},
+		requests: map[gomatrixserverlib.ServerName]int{},
+	}
+	notary := &notaryKeyClient{
+		requests: map[gomatrixserverlib.ServerName]int{},
+	}
+	s := &ServerKeyAPI{
+		ServerName: "localhost",
+		OurKeyRing: gomatrixserverlib.KeyRing{
+			KeyDatabase: &emptyKeyDatabase{},
+			KeyFetchers: []gomatrixserverlib.KeyFetcher{
+				fetcher,
+				&gomatrixserverlib.PerspectiveKeyFetcher{
+					PerspectiveServerName: "notary.com",
+					Client:                notary,
+				},
+			},
+		},
+	}
+	deadKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "dead.com", KeyID: "ed25519:auto"}
+	fetch := func(reqs ...gomatrixserverlib.PublicKeyLookupRequest) {
+		requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+		for _, req := range reqs {
+			requests[req] = gomatrixserverlib.AsTimestamp(time.Now())
+		}
+		if _, err := s.FetchKeys(context.Background(), requests); err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+	}
+
+	// A failed fetch is not retried within the backoff window, but the
+	// notary is still asked each time.
+	fetch(deadKey)
+	fetch(deadKey)
+	if got := fetcher.requests["dead.com"]; got != 1 {
+		t.Errorf("got %d fetches from the dead server, want 1", got)
+	}
+	if got := notary.requests["dead.com"]; got != 2 {
+		t.Errorf("got %d notary requests for the dead server, want 2", got)
+	}
+
+	// The backoff is for the key that we failed to fetch, so other keys
+	// from the same server are still asked for.
+	fetch(gomatrixserverlib.PublicKeyLookupRequest{ServerName: "dead.com", KeyID: "ed25519:other"})
+	if got := fetcher.requests["dead.com"]; got != 2 {
+		t.Errorf("got %d fetches from the dead server for another key, want 2", got)
+	}
+
+	// Servers that give us their keys aren't backed off from. The keys aren't
+	// stored anywhere so we ask for them again, and the notary isn't needed.
+	aliveKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "alive.com", KeyID: "ed25519:auto"}
+	fetch(aliveKey)
+	fetch(aliveKey)
+	if got := fetcher.requests["alive.com"]; got != 2 {
+		t.Errorf("got %d fetches from the live server, want 2", got)
+	}
+	if got := notary.requests["alive.com"]; got != 0 {
+		t.Errorf("got %d notary requests for the live server, want 0", got)
+	}
+
+	// Once the backoff has passed, we try again, and then wait for longer.
+	if !s.fetchBackoff.backingOff(deadKey, time.Now().Add(minKeyFetchBackoff-time.Second)) {
+		t.Errorf("expected to be backing off from the dead server")
+	}
+	s.fetchBackoff.keys[deadKey].until = time.Now()
+	fetch(deadKey)
+	if got := fetcher.requests["dead.com"]; got != 3 {
+		t.Errorf("got %d fetches from the dead server after the backoff, want 3", got)
+	}
+	if !s.fetchBackoff.backingOff(deadKey, time.Now().Add(minKeyFetchBackoff+time.Second)) {
+		t.Errorf("expected the backoff to grow after another failure")
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// minKeyFetchBackoff is how long we wait before trying to fetch keys
+	// from a server again after the first failure.
+	minKeyFetchBackoff = time.Second * 30
+	// maxKeyFetchBackoff is the longest that we will wait before trying
+	// to fetch keys from a server again.
+	maxKeyFetchBackoff = time.Hour
+)
+
+// keyFetchBackoff remembers the keys that we recently failed to fetch
+// from their servers, so that we don't keep asking servers that are
+// unreachable or that don't have the key. The wait doubles with each
+// consecutive failure.
+type keyFetchBackoff struct {
+	mutex sync.Mutex // protects keys
+	keys  map[gomatrixserverlib.PublicKeyLookupRequest]*serverKeyFetchBackoff
+}
+
+type serverKeyFetchBackoff struct {
+	failures uint32
+	until    time.Time
+}
+
+// backingOff returns true if we shouldn't try to fetch the given key from
+// its server yet.
+func (b *keyFetchBackoff) backingOff(req gomatrixserverlib.PublicKeyLookupRequest, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	backoff, ok := b.keys[req]
+	return ok && now.Before(backoff.until)
+}
+
+// failure records that we failed to fetch the given key from its server.
+func (b *keyFetchBackoff) failure(req gomatrixserverlib.PublicKeyLookupRequest, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.keys == nil {
+		b.keys = map[gomatrixserverlib.PublicKeyLookupRequest]*serverKeyFetchBackoff{}
+	}
+	backoff, ok := b.keys[req]
+	if !ok {
+		backoff = &serverKeyFetchBackoff{}
+		b.keys[req] = backoff
+	}
+	duration := minKeyFetchBackoff << backoff.failures
+	if duration > maxKeyFetchBackoff || duration <= 0 {
+		duration = maxKeyFetchBackoff
+	} else {
+		backoff.failures++
+	}
+	backoff.until = now.Add(duration)
+}
+
+// success records that we fetched the given key from its server, so that
+// future failures start from the shortest backoff again.
+func (b *keyFetchBackoff) success(req gomatrixserverlib.PublicKeyLookupRequest) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.keys, req)
+}
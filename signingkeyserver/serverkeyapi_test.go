@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -23,6 +24,9 @@ import (
 type server struct {
 	name      gomatrixserverlib.ServerName        // server name
 	validity  time.Duration                       // key validity duration from now
+	rotated   bool                                // has an old, superseded key
+	offline   bool                                // refuses direct key requests
+	oldKey    ed25519.PrivateKey                  // the superseded key, if rotated
 	config    *config.SigningKeyServer            // skeleton config, from TestMain
 	fedconfig *config.FederationAPI               //
 	fedclient *gomatrixserverlib.FederationClient // uses MockRoundTripper
@@ -44,12 +48,21 @@ var (
 	serverA     = &server{name: "a.com", validity: time.Duration(0)} // expires now
 	serverB     = &server{name: "b.com", validity: time.Hour}        // expires in an hour
 	serverC     = &server{name: "c.com", validity: -time.Hour}       // expired an hour ago
+	serverD     = &server{name: "d.com", validity: time.Hour, rotated: true}
+	serverE     = &server{name: "e.com", validity: time.Hour, offline: true}
+)
+
+var (
+	oldServerKeyID     = gomatrixserverlib.KeyID("ed25519:old")
+	oldServerKeyExpiry = gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
 )
 
 var servers = map[string]*server{
 	"a.com": serverA,
 	"b.com": serverB,
 	"c.com": serverC,
+	"d.com": serverD,
+	"e.com": serverE,
 }
 
 func TestMain(m *testing.M) {
@@ -63,7 +76,7 @@ func TestMain(m *testing.M) {
 		}
 
 		// Create a new cache but don't enable prometheus!
-		s.cache, err = caching.NewInMemoryLRUCache(false)
+		s.cache, err = caching.NewInMemoryLRUCache(nil, false)
 		if err != nil {
 			panic("can't create cache: " + err.Error())
 		}
@@ -77,6 +90,21 @@ func TestMain(m *testing.M) {
 		cfg.Global.KeyID = serverKeyID
 		cfg.Global.KeyValidityPeriod = s.validity
 		cfg.SigningKeyServer.Database.ConnectionString = config.DataSource("file::memory:")
+		if s.rotated {
+			// Server D has rotated its key, so the previous one is
+			// advertised as an old verify key.
+			_, s.oldKey, err = ed25519.GenerateKey(nil)
+			if err != nil {
+				panic("can't generate old identity key: " + err.Error())
+			}
+			cfg.Global.OldVerifyKeys = []config.OldVerifyKeys{
+				{
+					PrivateKey: s.oldKey,
+					KeyID:      oldServerKeyID,
+					ExpiredAt:  oldServerKeyExpiry,
+				},
+			}
+		}
 		s.config = &cfg.SigningKeyServer
 		s.fedconfig = &cfg.FederationAPI
 
@@ -111,17 +139,32 @@ func (m *MockRoundTripper) RoundTrip(req *http.Request) (res *http.Response, err
 		return nil, fmt.Errorf("server not known: %s", req.Host)
 	}
 
-	// We're intercepting /matrix/key/v2/server requests here, so check
-	// that the URL supplied in the request is for that.
-	if req.URL.Path != "/_matrix/key/v2/server" {
-		return nil, fmt.Errorf("unexpected request path: %s", req.URL.Path)
+	// Servers that are offline can't answer any requests, as if they
+	// were unreachable.
+	if s.offline {
+		return nil, fmt.Errorf("server offline: %s", req.Host)
 	}
 
-	// Get the keys and JSON-ify them.
-	keys := routing.LocalKeys(s.fedconfig)
-	body, err := json.MarshalIndent(keys.JSON, "", "  ")
-	if err != nil {
-		return nil, err
+	var body []byte
+	switch req.URL.Path {
+	case "/_matrix/key/v2/server":
+		// Get the keys and JSON-ify them.
+		keys := routing.LocalKeys(s.fedconfig)
+		body, err = json.MarshalIndent(keys.JSON, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+	case "/_matrix/key/v2/query":
+		// The server is being asked to act as a notary, so sign the keys
+		// of each of the requested servers and return them.
+		body, err = notaryResponse(s, req)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unexpected request path: %s", req.URL.Path)
 	}
 
 	// And respond.
@@ -132,6 +175,34 @@ func (m *MockRoundTripper) RoundTrip(req *http.Request) (res *http.Response, err
 	return
 }
 
+func notaryResponse(s *server, req *http.Request) ([]byte, error) {
+	var notaryReq gomatrixserverlib.PublicKeyNotaryLookupRequest
+	if err := json.NewDecoder(req.Body).Decode(&notaryReq); err != nil {
+		return nil, err
+	}
+	var response struct {
+		ServerKeys []json.RawMessage `json:"server_keys"`
+	}
+	for serverName := range notaryReq.ServerKeys {
+		target, ok := servers[string(serverName)]
+		if !ok {
+			continue
+		}
+		keys, err := json.Marshal(routing.LocalKeys(target.fedconfig).JSON)
+		if err != nil {
+			return nil, err
+		}
+		signed, err := gomatrixserverlib.SignJSON(
+			string(s.name), serverKeyID, s.config.Matrix.PrivateKey, keys,
+		)
+		if err != nil {
+			return nil, err
+		}
+		response.ServerKeys = append(response.ServerKeys, signed)
+	}
+	return json.Marshal(response)
+}
+
 func TestServersRequestOwnKeys(t *testing.T) {
 	// Each server will request its own keys. There's no reason
 	// for this to fail as each server should know its own keys.
@@ -316,3 +387,133 @@ func TestRenewalBehaviour(t *testing.T) {
 	}
 	t.Log(res)
 }
+
+func TestRotatedKeyStillVerifies(t *testing.T) {
+	// Server D has rotated its signing key. Server A should still be
+	// able to verify things that server D signed with its old key
+	// before the key expired, but not afterwards.
+
+	message := []byte(`{"content":"rotated"}`)
+	oldSigned, err := gomatrixserverlib.SignJSON(
+		string(serverD.name), oldServerKeyID, serverD.oldKey, message,
+	)
+	if err != nil {
+		t.Fatalf("failed to sign message with old key: %s", err)
+	}
+	newSigned, err := gomatrixserverlib.SignJSON(
+		string(serverD.name), serverKeyID, serverD.config.Matrix.PrivateKey, message,
+	)
+	if err != nil {
+		t.Fatalf("failed to sign message with current key: %s", err)
+	}
+
+	beforeExpiry := gomatrixserverlib.AsTimestamp(oldServerKeyExpiry.Time().Add(-time.Hour))
+	results, err := serverA.api.KeyRing().VerifyJSONs(
+		context.Background(),
+		[]gomatrixserverlib.VerifyJSONRequest{
+			{ServerName: serverD.name, AtTS: beforeExpiry, Message: oldSigned},
+			{ServerName: serverD.name, AtTS: gomatrixserverlib.AsTimestamp(time.Now()), Message: oldSigned},
+			{ServerName: serverD.name, AtTS: gomatrixserverlib.AsTimestamp(time.Now()), Message: newSigned},
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed to verify JSON: %s", err)
+	}
+	if results[0].Error != nil {
+		t.Fatalf("message signed with old key before expiry should verify: %s", results[0].Error)
+	}
+	if results[1].Error == nil {
+		t.Fatalf("message signed with old key after expiry shouldn't verify")
+	}
+	if results[2].Error != nil {
+		t.Fatalf("message signed with current key should verify: %s", results[2].Error)
+	}
+}
+
+func TestServerRequestsOwnOldKey(t *testing.T) {
+	// Server D should be able to answer requests for its own old key
+	// without going to the network, and should mark it as expired.
+
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: serverD.name,
+		KeyID:      oldServerKeyID,
+	}
+	res, err := serverD.api.FetchKeys(
+		context.Background(),
+		map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: gomatrixserverlib.AsTimestamp(time.Now()),
+		},
+	)
+	if err != nil {
+		t.Fatalf("server could not fetch own old key: %s", err)
+	}
+	key, ok := res[req]
+	if !ok {
+		t.Fatalf("server didn't return its own old key in the results")
+	}
+	if key.ExpiredTS != oldServerKeyExpiry {
+		t.Fatalf("expected old key to have expired_ts %d, got %d", oldServerKeyExpiry, key.ExpiredTS)
+	}
+	if !bytes.Equal(key.Key, serverD.oldKey.Public().(ed25519.PublicKey)) {
+		t.Fatalf("server returned the wrong public key for its old key")
+	}
+}
+
+func TestNotaryFallback(t *testing.T) {
+	// Server E is offline, so a direct key fetch for its keys will fail.
+	// We'll configure a key API that trusts server B as a notary, which
+	// should be used as a fallback to retrieve server E's keys.
+
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("can't create cache: %s", err)
+	}
+	cfg := *serverA.config
+	cfg.PreferDirectFetch = true
+	cfg.KeyPerspectives = config.KeyPerspectives{
+		{
+			ServerName: serverB.name,
+			Keys: []config.KeyPerspectiveTrustKey{
+				{
+					KeyID: serverKeyID,
+					PublicKey: base64.RawStdEncoding.EncodeToString(
+						serverB.config.Matrix.PrivateKey.Public().(ed25519.PublicKey),
+					),
+				},
+			},
+		},
+	}
+	keyAPI := NewInternalAPI(&cfg, serverA.fedclient, cache)
+
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: serverE.name,
+		KeyID:      serverKeyID,
+	}
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := keyAPI.FetchKeys(
+		context.Background(),
+		map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: ts,
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed to retrieve server E key: %s", err)
+	}
+	key, ok := res[req]
+	if !ok {
+		t.Fatalf("server E key wasn't retrieved from the notary")
+	}
+	if !bytes.Equal(key.Key, serverE.config.Matrix.PrivateKey.Public().(ed25519.PublicKey)) {
+		t.Fatalf("the notary returned the wrong key for server E")
+	}
+
+	// The key should have been cached respecting the validity period
+	// that server E gave it, so we shouldn't need to go to the notary
+	// again for an event within that period.
+	if _, ok = cache.GetServerKey(req, ts); !ok {
+		t.Fatalf("server E key should be in cache but isn't")
+	}
+	if _, ok = cache.GetServerKey(req, gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute*90))); ok {
+		t.Fatalf("server E key is in cache when it shouldn't be (+90 minutes)")
+	}
+}
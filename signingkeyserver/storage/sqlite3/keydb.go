@@ -49,7 +49,7 @@ func NewDatabase(
 		return nil, err
 	}
 	d := &Database{
-		writer: sqlutil.NewExclusiveWriter(),
+		writer: sqlutil.ExclusiveWriterForDatabase(dbProperties),
 	}
 	err = d.statements.prepare(db, d.writer)
 	if err != nil {
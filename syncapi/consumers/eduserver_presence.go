@@ -0,0 +1,91 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputPresenceEventConsumer consumes events that originated in the EDU server.
+type OutputPresenceEventConsumer struct {
+	presenceConsumer *internal.ContinualConsumer
+	db               storage.Database
+	notifier         *sync.Notifier
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputPresenceEventConsumer(
+	cfg *config.SyncAPI,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputPresenceEventConsumer {
+
+	consumer := internal.ContinualConsumer{
+		ComponentName:  "syncapi/eduserver/presence",
+		Topic:          cfg.Matrix.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputPresenceEventConsumer{
+		presenceConsumer: &consumer,
+		db:               store,
+		notifier:         n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputPresenceEventConsumer) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+func (s *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	streamPos, err := s.db.StorePresence(
+		context.TODO(),
+		output.UserID,
+		output.Presence,
+		output.StatusMsg,
+		output.LastActiveTS,
+	)
+	if err != nil {
+		return err
+	}
+	s.notifier.OnNewPresence(types.StreamingToken{PresencePosition: streamPos}, output.UserID)
+
+	return nil
+}
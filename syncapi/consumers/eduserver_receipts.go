@@ -88,7 +88,11 @@ func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) erro
 		return err
 	}
 	// update stream position
-	s.notifier.OnNewReceipt(output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
+	if output.Type == api.ReceiptTypeReadPrivate {
+		s.notifier.OnNewPrivateReceipt(output.UserID, types.StreamingToken{ReceiptPosition: streamPos})
+	} else {
+		s.notifier.OnNewReceipt(output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
+	}
 
 	return nil
 }
@@ -21,23 +21,27 @@ import (
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	syncinternal "github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // OutputRoomEventConsumer consumes events that originated in the room server.
 type OutputRoomEventConsumer struct {
-	cfg        *config.SyncAPI
-	rsAPI      api.RoomserverInternalAPI
-	rsConsumer *internal.ContinualConsumer
-	db         storage.Database
-	notifier   *sync.Notifier
+	cfg         *config.SyncAPI
+	rsAPI       api.RoomserverInternalAPI
+	rsConsumer  *internal.ContinualConsumer
+	db          storage.Database
+	notifier    *sync.Notifier
+	sharedUsers *syncinternal.SharedUsersCache
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -47,6 +51,7 @@ func NewOutputRoomEventConsumer(
 	n *sync.Notifier,
 	store storage.Database,
 	rsAPI api.RoomserverInternalAPI,
+	sharedUsers *syncinternal.SharedUsersCache,
 ) *OutputRoomEventConsumer {
 
 	consumer := internal.ContinualConsumer{
@@ -56,11 +61,12 @@ func NewOutputRoomEventConsumer(
 		PartitionStore: store,
 	}
 	s := &OutputRoomEventConsumer{
-		cfg:        cfg,
-		rsConsumer: &consumer,
-		db:         store,
-		notifier:   n,
-		rsAPI:      rsAPI,
+		cfg:         cfg,
+		rsConsumer:  &consumer,
+		db:          store,
+		notifier:    n,
+		rsAPI:       rsAPI,
+		sharedUsers: sharedUsers,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -181,11 +187,95 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		return err
 	}
 
+	if pduPos, err = s.retirePeeksIfNotWorldReadable(ctx, ev, pduPos); err != nil {
+		logrus.WithError(err).Errorf("Failed to retirePeeksIfNotWorldReadable for PDU pos %d", pduPos)
+		return err
+	}
+
+	// The users who share rooms with each other, and therefore whose device
+	// lists they track, change whenever a room membership does.
+	if msg.RewritesState || membershipChanged(ev) {
+		s.sharedUsers.Invalidate()
+	} else {
+		for _, stateEvent := range addsStateEvents {
+			if membershipChanged(stateEvent) {
+				s.sharedUsers.Invalidate()
+				break
+			}
+		}
+	}
+
+	if err = s.addNotifications(ctx, ev); err != nil {
+		// the event has been stored, so carry on without counting it
+		log.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to count notifications")
+	}
+
 	s.notifier.OnNewEvent(ev, "", nil, types.StreamingToken{PDUPosition: pduPos})
 
 	return nil
 }
 
+// addNotifications evaluates the push rules of each local user in the room,
+// other than the sender, against the event and counts a notification for
+// the users whose rules notify them about it.
+func (s *OutputRoomEventConsumer) addNotifications(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) error {
+	if ev.StateKey() != nil {
+		return nil
+	}
+	userIDs, err := s.db.JoinedUsersInRoom(ctx, ev.RoomID())
+	if err != nil {
+		return fmt.Errorf("s.db.JoinedUsersInRoom: %w", err)
+	}
+	var powerLevels gomatrixserverlib.PowerLevelContent
+	plEvent, err := s.db.GetStateEvent(ctx, ev.RoomID(), gomatrixserverlib.MRoomPowerLevels, "")
+	if err != nil {
+		return fmt.Errorf("s.db.GetStateEvent: %w", err)
+	}
+	if plEvent != nil {
+		if powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(plEvent.Event); err != nil {
+			return fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+		}
+	} else {
+		powerLevels.Defaults()
+	}
+
+	highlights := map[string]bool{}
+	for _, userID := range userIDs {
+		if userID == ev.Sender() {
+			continue
+		}
+		localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != s.cfg.Matrix.ServerName {
+			continue
+		}
+		rule, err := pushrules.Evaluate(pushrules.DefaultRules(localpart), ev.Event, &powerLevels)
+		if err != nil {
+			return fmt.Errorf("pushrules.Evaluate: %w", err)
+		}
+		if rule != nil && rule.Notifies() {
+			highlights[userID] = rule.Highlights()
+		}
+	}
+	if len(highlights) == 0 {
+		return nil
+	}
+	return s.db.AddNotifications(ctx, ev.RoomID(), highlights)
+}
+
+// membershipChanged returns true if the event is a membership event which
+// changes the membership, rather than only the profile, of the user. This
+// relies on updateStateEvent having set the previous content.
+func membershipChanged(ev *gomatrixserverlib.HeaderedEvent) bool {
+	if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+		return false
+	}
+	membership, err := ev.Membership()
+	if err != nil {
+		return false
+	}
+	return gjson.GetBytes(ev.Unsigned(), "prev_content.membership").Str != membership
+}
+
 func (s *OutputRoomEventConsumer) onOldRoomEvent(
 	ctx context.Context, msg api.OutputOldRoomEvent,
 ) error {
@@ -256,6 +346,33 @@ func (s *OutputRoomEventConsumer) notifyJoinedPeeks(ctx context.Context, ev *gom
 	return sp, nil
 }
 
+// retirePeeksIfNotWorldReadable ends all peeks into a room when its history
+// visibility changes to something other than world_readable, since peeking is
+// only allowed into world_readable rooms.
+func (s *OutputRoomEventConsumer) retirePeeksIfNotWorldReadable(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, sp types.StreamPosition) (types.StreamPosition, error) {
+	if ev.Type() != gomatrixserverlib.MRoomHistoryVisibility || !ev.StateKeyEquals("") {
+		return sp, nil
+	}
+	if visibility, err := ev.HistoryVisibility(); err == nil && visibility == "world_readable" {
+		return sp, nil
+	}
+	peekingDevices, err := s.db.AllPeekingDevicesInRooms(ctx)
+	if err != nil {
+		return sp, fmt.Errorf("s.db.AllPeekingDevicesInRooms: %w", err)
+	}
+	for _, peekingDevice := range peekingDevices[ev.RoomID()] {
+		peekSP, peekErr := s.db.DeletePeek(ctx, ev.RoomID(), peekingDevice.UserID, peekingDevice.DeviceID)
+		if peekErr != nil {
+			return sp, fmt.Errorf("s.db.DeletePeek: %w", peekErr)
+		}
+		s.notifier.OnRetirePeek(ev.RoomID(), peekingDevice.UserID, peekingDevice.DeviceID)
+		if peekSP > sp {
+			sp = peekSP
+		}
+	}
+	return sp, nil
+}
+
 func (s *OutputRoomEventConsumer) onNewInviteEvent(
 	ctx context.Context, msg api.OutputNewInviteEvent,
 ) error {
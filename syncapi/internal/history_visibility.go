@@ -0,0 +1,203 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The history visibility values from
+// https://matrix.org/docs/spec/client_server/r0.6.1#room-history-visibility
+const (
+	HistoryVisibilityWorldReadable = "world_readable"
+	HistoryVisibilityShared        = "shared"
+	HistoryVisibilityInvited       = "invited"
+	HistoryVisibilityJoined        = "joined"
+)
+
+// ApplyHistoryVisibilityFilter removes any events from the list that the
+// given user isn't allowed to see according to the history visibility of
+// the room. The events must all belong to the same room and must be sorted
+// in topological order, oldest first.
+func ApplyHistoryVisibilityFilter(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, userID string,
+	events []*gomatrixserverlib.HeaderedEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	roomID := events[0].RoomID()
+
+	// Find out what the history visibility and the user's membership
+	// were just before the earliest event. We'll then walk forward through
+	// the events, updating these as we go.
+	state, err := visibilityStateBefore(ctx, rsAPI, userID, events[0])
+	if err != nil {
+		return nil, err
+	}
+	currentlyJoined, err := isCurrentlyJoined(ctx, rsAPI, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return FilterVisibleEvents(userID, currentlyJoined, state, events), nil
+}
+
+// ApplyHistoryVisibilityFilterSeparately removes any events from the list
+// that the given user isn't allowed to see, like ApplyHistoryVisibilityFilter,
+// but works out whether each event is visible from the room state just before
+// it. This is for events which aren't next to each other in the timeline, such
+// as the relations of an event, since walking forward through them would miss
+// any changes to the state in between. The events must all belong to the same
+// room, and are returned in the same order.
+func ApplyHistoryVisibilityFilterSeparately(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, userID string,
+	events []*gomatrixserverlib.HeaderedEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	currentlyJoined, err := isCurrentlyJoined(ctx, rsAPI, events[0].RoomID(), userID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		state, err := visibilityStateBefore(ctx, rsAPI, userID, ev)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, FilterVisibleEvents(userID, currentlyJoined, state, []*gomatrixserverlib.HeaderedEvent{ev})...)
+	}
+	return result, nil
+}
+
+// visibilityStateBefore returns the history visibility and the user's
+// membership just before the event.
+func visibilityStateBefore(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, userID string,
+	ev *gomatrixserverlib.HeaderedEvent,
+) (VisibilityState, error) {
+	state := NewVisibilityState()
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       ev.RoomID(),
+		PrevEventIDs: ev.PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+			{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		},
+	}, &stateRes); err != nil {
+		return state, fmt.Errorf("rsAPI.QueryStateAfterEvents: %w", err)
+	}
+	for _, stateEvent := range stateRes.StateEvents {
+		state.Update(userID, stateEvent)
+	}
+	return state, nil
+}
+
+// isCurrentlyJoined returns true if the user is in the room right now, which
+// decides whether "shared" history is visible to them.
+func isCurrentlyJoined(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID, userID string,
+) (bool, error) {
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: userID,
+	}, &membershipRes); err != nil {
+		return false, fmt.Errorf("rsAPI.QueryMembershipForUser: %w", err)
+	}
+	return membershipRes.IsInRoom, nil
+}
+
+// VisibilityState is the subset of the room state that is needed to work
+// out whether a user can see an event.
+type VisibilityState struct {
+	HistoryVisibility string
+	Membership        string
+}
+
+// NewVisibilityState returns the visibility state of a room with no
+// history visibility set and in which the user has no membership.
+func NewVisibilityState() VisibilityState {
+	return VisibilityState{
+		HistoryVisibility: HistoryVisibilityShared,
+		Membership:        gomatrixserverlib.Leave,
+	}
+}
+
+// Update applies a state event to the visibility state, if it is relevant.
+func (s *VisibilityState) Update(userID string, ev *gomatrixserverlib.HeaderedEvent) {
+	switch {
+	case ev.Type() == gomatrixserverlib.MRoomHistoryVisibility && ev.StateKeyEquals(""):
+		s.HistoryVisibility = HistoryVisibilityShared
+		if visibility, err := ev.HistoryVisibility(); err == nil {
+			switch visibility {
+			case HistoryVisibilityWorldReadable, HistoryVisibilityShared, HistoryVisibilityInvited, HistoryVisibilityJoined:
+				s.HistoryVisibility = visibility
+			}
+		}
+	case ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(userID):
+		if membership, err := ev.Membership(); err == nil {
+			s.Membership = membership
+		}
+	}
+}
+
+// Allows returns true if a user can see an event sent with this
+// visibility state. This implements the rules from
+// https://matrix.org/docs/spec/client_server/r0.6.1#id87
+func (s *VisibilityState) Allows(currentlyJoined bool) bool {
+	switch {
+	case s.HistoryVisibility == HistoryVisibilityWorldReadable:
+		return true
+	case s.Membership == gomatrixserverlib.Join:
+		return true
+	case s.HistoryVisibility == HistoryVisibilityShared && currentlyJoined:
+		return true
+	case s.HistoryVisibility == HistoryVisibilityInvited && s.Membership == gomatrixserverlib.Invite:
+		return true
+	default:
+		return false
+	}
+}
+
+// FilterVisibleEvents walks through the events, which must be sorted in
+// topological order, oldest first, and returns only those that the user can
+// see, given the visibility state just before the first event.
+func FilterVisibleEvents(
+	userID string, currentlyJoined bool, state VisibilityState,
+	events []*gomatrixserverlib.HeaderedEvent,
+) []*gomatrixserverlib.HeaderedEvent {
+	result := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		allowed := state.Allows(currentlyJoined)
+		state.Update(userID, ev)
+		// The user's own membership events are visible if the user could
+		// see either side of them, so that they can always see themselves
+		// joining or leaving the room.
+		if !allowed && ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(userID) {
+			allowed = state.Allows(currentlyJoined)
+		}
+		if allowed {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
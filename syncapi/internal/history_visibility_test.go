@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	visibilityRoomID  = "!visibility:localhost"
+	visibilityCreator = "@alice:localhost"
+	visibilityJoiner  = "@bob:localhost"
+	visibilityKey     = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+)
+
+type visibilityRoom struct {
+	t      *testing.T
+	events []*gomatrixserverlib.HeaderedEvent
+	names  map[string]string // event ID -> name
+}
+
+func (r *visibilityRoom) add(name, sender, evType string, stateKey *string, content string) {
+	b := &gomatrixserverlib.EventBuilder{
+		RoomID:   visibilityRoomID,
+		Sender:   sender,
+		Type:     evType,
+		StateKey: stateKey,
+		Content:  []byte(content),
+		Depth:    int64(len(r.events) + 1),
+	}
+	if len(r.events) > 0 {
+		b.PrevEvents = []string{r.events[len(r.events)-1].EventID()}
+	}
+	ev, err := b.Build(time.Now(), "localhost", "ed25519:test", visibilityKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		r.t.Fatalf("failed to build event: %s", err)
+	}
+	r.events = append(r.events, ev.Headered(gomatrixserverlib.RoomVersionV4))
+	r.names[ev.EventID()] = name
+}
+
+func (r *visibilityRoom) member(name, sender, target, membership string) {
+	r.add(name, sender, gomatrixserverlib.MRoomMember, &target, fmt.Sprintf(`{"membership":%q}`, membership))
+}
+
+func (r *visibilityRoom) message(name string) {
+	r.add(name, visibilityCreator, "m.room.message", nil, fmt.Sprintf(`{"body":%q}`, name))
+}
+
+func (r *visibilityRoom) visible(userID string, currentlyJoined bool) []string {
+	var names []string
+	for _, ev := range FilterVisibleEvents(userID, currentlyJoined, NewVisibilityState(), r.events) {
+		names = append(names, r.names[ev.EventID()])
+	}
+	return names
+}
+
+// newVisibilityRoom creates a room with the given history visibility in
+// which bob is invited and then joins midway through the history.
+func newVisibilityRoom(t *testing.T, visibility string) *visibilityRoom {
+	emptyStateKey := ""
+	r := &visibilityRoom{t: t, names: map[string]string{}}
+	r.add("create", visibilityCreator, gomatrixserverlib.MRoomCreate, &emptyStateKey, fmt.Sprintf(`{"creator":%q}`, visibilityCreator))
+	r.member("alice_join", visibilityCreator, visibilityCreator, gomatrixserverlib.Join)
+	r.add("visibility", visibilityCreator, gomatrixserverlib.MRoomHistoryVisibility, &emptyStateKey, fmt.Sprintf(`{"history_visibility":%q}`, visibility))
+	r.message("before_invite")
+	r.member("bob_invite", visibilityCreator, visibilityJoiner, gomatrixserverlib.Invite)
+	r.message("while_invited")
+	r.member("bob_join", visibilityJoiner, visibilityJoiner, gomatrixserverlib.Join)
+	r.message("while_joined")
+	return r
+}
+
+func assertVisible(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected visible events %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected visible events %v, got %v", want, got)
+		}
+	}
+}
+
+func TestHistoryVisibilityWorldReadable(t *testing.T) {
+	r := newVisibilityRoom(t, HistoryVisibilityWorldReadable)
+	// The create and alice's join happen before the history visibility is
+	// set, so they default to shared and need the user to be in the room.
+	assertVisible(t, r.visible("@nobody:localhost", false),
+		"before_invite", "bob_invite", "while_invited", "bob_join", "while_joined",
+	)
+}
+
+func TestHistoryVisibilityShared(t *testing.T) {
+	r := newVisibilityRoom(t, HistoryVisibilityShared)
+	assertVisible(t, r.visible(visibilityJoiner, true),
+		"create", "alice_join", "visibility", "before_invite", "bob_invite", "while_invited", "bob_join", "while_joined",
+	)
+	// If bob isn't in the room any more then only the events that
+	// happened while bob was joined are visible.
+	assertVisible(t, r.visible(visibilityJoiner, false),
+		"bob_join", "while_joined",
+	)
+}
+
+func TestHistoryVisibilityInvited(t *testing.T) {
+	r := newVisibilityRoom(t, HistoryVisibilityInvited)
+	// Everything up to and including the history visibility event is
+	// shared, since there was no history visibility before it.
+	assertVisible(t, r.visible(visibilityJoiner, true),
+		"create", "alice_join", "visibility", "bob_invite", "while_invited", "bob_join", "while_joined",
+	)
+}
+
+func TestHistoryVisibilityJoined(t *testing.T) {
+	r := newVisibilityRoom(t, HistoryVisibilityJoined)
+	assertVisible(t, r.visible(visibilityJoiner, true),
+		"create", "alice_join", "visibility", "bob_join", "while_joined",
+	)
+}
+
+func TestHistoryVisibilityAfterLeave(t *testing.T) {
+	r := newVisibilityRoom(t, HistoryVisibilityJoined)
+	r.member("bob_leave", visibilityJoiner, visibilityJoiner, gomatrixserverlib.Leave)
+	r.message("after_leave")
+	// Bob should see the leave event but nothing that happened afterwards.
+	assertVisible(t, r.visible(visibilityJoiner, false),
+		"bob_join", "while_joined", "bob_leave",
+	)
+}
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
@@ -25,7 +26,9 @@ var (
 	}
 )
 
-type mockKeyAPI struct{}
+type mockKeyAPI struct {
+	changedUserIDs []string
+}
 
 func (k *mockKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
 }
@@ -35,9 +38,12 @@ func (k *mockKeyAPI) SetUserAPI(i userapi.UserInternalAPI) {}
 // PerformClaimKeys claims one-time keys for use in pre-key messages
 func (k *mockKeyAPI) PerformClaimKeys(ctx context.Context, req *keyapi.PerformClaimKeysRequest, res *keyapi.PerformClaimKeysResponse) {
 }
+func (k *mockKeyAPI) PerformUploadDeviceSigningKeys(ctx context.Context, req *keyapi.PerformUploadDeviceSigningKeysRequest, res *keyapi.PerformUploadDeviceSigningKeysResponse) {
+}
 func (k *mockKeyAPI) QueryKeys(ctx context.Context, req *keyapi.QueryKeysRequest, res *keyapi.QueryKeysResponse) {
 }
 func (k *mockKeyAPI) QueryKeyChanges(ctx context.Context, req *keyapi.QueryKeyChangesRequest, res *keyapi.QueryKeyChangesResponse) {
+	res.UserIDs = k.changedUserIDs
 }
 func (k *mockKeyAPI) QueryOneTimeKeys(ctx context.Context, req *keyapi.QueryOneTimeKeysRequest, res *keyapi.QueryOneTimeKeysResponse) {
 
@@ -190,6 +196,53 @@ func TestKeyChangeCatchupOnJoinShareNewUser(t *testing.T) {
 	})
 }
 
+// tests that joining a room invalidates the shared users cache, so that the members of the new room are
+// included in `changed` and their key changes are no longer filtered out
+func TestKeyChangeCatchupOnJoinInvalidatesSharedUsers(t *testing.T) {
+	newShareUser := "@bill:localhost"
+	newlyJoinedRoom := "!TestKeyChangeCatchupOnJoinInvalidatesSharedUsers:bar"
+	rsAPI := &mockRoomserverAPI{
+		roomIDToJoinedMembers: map[string][]string{
+			"!another:room": {syncingUser},
+			newlyJoinedRoom: {newShareUser},
+		},
+	}
+	keyAPI := &mockKeyAPI{changedUserIDs: []string{newShareUser}}
+	sharedUsers := NewSharedUsersCache(rsAPI, time.Minute)
+
+	// We don't share a room with the user yet, so their key changes are filtered out.
+	hasNew, err := DeviceListCatchup(context.Background(), keyAPI, sharedUsers, syncingUser, types.NewResponse(), emptyToken, newestToken)
+	if err != nil {
+		t.Fatalf("DeviceListCatchup returned an error: %s", err)
+	}
+	assertCatchup(t, hasNew, types.NewResponse(), wantCatchup{})
+
+	// The syncing user joins the room, which invalidates the cache.
+	rsAPI.roomIDToJoinedMembers[newlyJoinedRoom] = []string{syncingUser, newShareUser}
+	sharedUsers.Invalidate()
+
+	syncResponse := joinResponseWithRooms(types.NewResponse(), syncingUser, []string{newlyJoinedRoom})
+	hasNew, err = DeviceListCatchup(context.Background(), keyAPI, sharedUsers, syncingUser, syncResponse, emptyToken, newestToken)
+	if err != nil {
+		t.Fatalf("DeviceListCatchup returned an error: %s", err)
+	}
+	assertCatchup(t, hasNew, syncResponse, wantCatchup{
+		hasNew:  true,
+		changed: []string{newShareUser},
+	})
+
+	// Later key changes for the user are no longer filtered out either.
+	syncResponse = types.NewResponse()
+	hasNew, err = DeviceListCatchup(context.Background(), keyAPI, sharedUsers, syncingUser, syncResponse, emptyToken, newestToken)
+	if err != nil {
+		t.Fatalf("DeviceListCatchup returned an error: %s", err)
+	}
+	assertCatchup(t, hasNew, syncResponse, wantCatchup{
+		hasNew:  true,
+		changed: []string{newShareUser},
+	})
+}
+
 // tests that leaving a room which results in sharing no rooms with a user includes that user in `left`
 func TestKeyChangeCatchupOnLeaveShareLeftUser(t *testing.T) {
 	removeUser := "@bill:localhost"
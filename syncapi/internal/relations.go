@@ -0,0 +1,104 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// RelTypeReplace is the relation type of an edit, as described in MSC2676.
+const RelTypeReplace = "m.replace"
+
+// RelTypeReference is the relation type of a reference, as described in MSC3267.
+const RelTypeReference = "m.reference"
+
+// BundleAggregations bundles the latest edit of each event into its
+// unsigned.m.relations.m.replace. Only edits by the sender of the original
+// event with the same event type count. If applyEdits is true then the content
+// of each edited event is also replaced with the m.new_content of its latest
+// edit, i.e. the client gets the replaced view of the event. The IDs of any
+// events which reference an event are bundled into its
+// unsigned.m.relations.m.reference.
+func BundleAggregations(
+	ctx context.Context, db storage.Database, events []gomatrixserverlib.ClientEvent, applyEdits bool,
+) error {
+	for i := range events {
+		ev := &events[i]
+		if err := bundleReferences(ctx, db, ev); err != nil {
+			return err
+		}
+		// State events can't be edited.
+		if ev.StateKey != nil {
+			continue
+		}
+		edit, err := db.LatestRelation(ctx, ev.RoomID, ev.EventID, RelTypeReplace, ev.Sender)
+		if err != nil {
+			return fmt.Errorf("db.LatestRelation: %w", err)
+		}
+		if edit == nil || edit.Type() != ev.Type {
+			continue
+		}
+		unsigned := []byte(ev.Unsigned)
+		if len(unsigned) == 0 {
+			unsigned = []byte("{}")
+		}
+		unsigned, err = sjson.SetBytes(
+			unsigned, `m\.relations.m\.replace`,
+			gomatrixserverlib.HeaderedToClientEvent(edit, gomatrixserverlib.FormatAll),
+		)
+		if err != nil {
+			return fmt.Errorf("sjson.SetBytes: %w", err)
+		}
+		ev.Unsigned = unsigned
+		if applyEdits {
+			if newContent := gjson.GetBytes(edit.Content(), `m\.new_content`); newContent.IsObject() {
+				ev.Content = gomatrixserverlib.RawJSON(newContent.Raw)
+			}
+		}
+	}
+	return nil
+}
+
+// bundleReferences bundles the IDs of the events which reference the event
+// into its unsigned.m.relations.m.reference, oldest first.
+func bundleReferences(ctx context.Context, db storage.Database, ev *gomatrixserverlib.ClientEvent) error {
+	childEventIDs, err := db.RelationChildren(ctx, ev.RoomID, ev.EventID, RelTypeReference)
+	if err != nil {
+		return fmt.Errorf("db.RelationChildren: %w", err)
+	}
+	if len(childEventIDs) == 0 {
+		return nil
+	}
+	chunk := make([]map[string]string, 0, len(childEventIDs))
+	for _, childEventID := range childEventIDs {
+		chunk = append(chunk, map[string]string{"event_id": childEventID})
+	}
+	unsigned := []byte(ev.Unsigned)
+	if len(unsigned) == 0 {
+		unsigned = []byte("{}")
+	}
+	unsigned, err = sjson.SetBytes(unsigned, `m\.relations.m\.reference`, map[string]interface{}{"chunk": chunk})
+	if err != nil {
+		return fmt.Errorf("sjson.SetBytes: %w", err)
+	}
+	ev.Unsigned = unsigned
+	return nil
+}
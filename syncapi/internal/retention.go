@@ -0,0 +1,71 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// PurgeExpiredEvents deletes the events in each room which are older than
+// the room's retention policy allows, as bounded by the server's retention
+// configuration. Only rooms which still have joined members are purged,
+// since we stop receiving state for rooms that everyone has left.
+func PurgeExpiredEvents(ctx context.Context, cfg *config.RetentionOptions, db storage.Database) error {
+	rooms, err := db.AllJoinedUsersInRooms(ctx)
+	if err != nil {
+		return fmt.Errorf("db.AllJoinedUsersInRooms: %w", err)
+	}
+	now := time.Now()
+	for roomID := range rooms {
+		logger := logrus.WithField("room_id", roomID)
+		retention, err := db.GetStateEvent(ctx, roomID, eventutil.MRoomRetention, "")
+		if err != nil {
+			logger.WithError(err).Warn("Failed to get retention policy")
+			continue
+		}
+		maxLifetime := eventutil.RetentionMaxLifetime(cfg, retention)
+		if maxLifetime == 0 {
+			continue
+		}
+		purged, err := db.PurgeEventsBefore(ctx, roomID, gomatrixserverlib.AsTimestamp(now.Add(-maxLifetime)))
+		if err != nil {
+			logger.WithError(err).Warn("Failed to purge expired events")
+			continue
+		}
+		if purged > 0 {
+			logger.Infof("Purged %d expired events", purged)
+		}
+	}
+	return nil
+}
+
+// PurgeExpiredEventsPeriodically runs PurgeExpiredEvents every purge interval.
+func PurgeExpiredEventsPeriodically(cfg *config.RetentionOptions, db storage.Database) {
+	ticker := time.NewTicker(cfg.PurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := PurgeExpiredEvents(context.Background(), cfg, db); err != nil {
+			logrus.WithError(err).Error("Failed to purge expired events")
+		}
+	}
+}
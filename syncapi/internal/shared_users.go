@@ -0,0 +1,105 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// SharedUsersCache wraps the roomserver API to remember which users share a
+// room with each user, so that we don't have to ask the roomserver for every
+// key change and every sync. Only queries which don't include or exclude any
+// rooms are cached. Invalidate must be called whenever a room membership
+// changes, otherwise device_lists.changed and left would be worked out from
+// out-of-date room memberships.
+type SharedUsersCache struct {
+	roomserverAPI.RoomserverInternalAPI
+	lifetime   time.Duration
+	mu         sync.Mutex
+	generation uint64
+	entries    map[string]sharedUsersEntry
+}
+
+type sharedUsersEntry struct {
+	userIDsToCount map[string]int
+	expires        time.Time
+}
+
+// NewSharedUsersCache returns a cache which remembers shared users for the
+// given lifetime. A lifetime of 0 disables the cache.
+func NewSharedUsersCache(rsAPI roomserverAPI.RoomserverInternalAPI, lifetime time.Duration) *SharedUsersCache {
+	return &SharedUsersCache{
+		RoomserverInternalAPI: rsAPI,
+		lifetime:              lifetime,
+		entries:               make(map[string]sharedUsersEntry),
+	}
+}
+
+// QuerySharedUsers returns the users who share at least one room with the
+// given user, from the cache if possible.
+func (c *SharedUsersCache) QuerySharedUsers(
+	ctx context.Context, req *roomserverAPI.QuerySharedUsersRequest, res *roomserverAPI.QuerySharedUsersResponse,
+) error {
+	if c.lifetime == 0 || len(req.IncludeRoomIDs) > 0 || len(req.ExcludeRoomIDs) > 0 {
+		return c.RoomserverInternalAPI.QuerySharedUsers(ctx, req, res)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[req.UserID]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		res.UserIDsToCount = copyUserIDsToCount(entry.userIDsToCount)
+		return nil
+	}
+
+	if err := c.RoomserverInternalAPI.QuerySharedUsers(ctx, req, res); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// If the memberships changed while we were asking the roomserver then
+	// the answer might already be out of date, so don't remember it.
+	if c.generation == generation {
+		c.entries[req.UserID] = sharedUsersEntry{
+			userIDsToCount: copyUserIDsToCount(res.UserIDsToCount),
+			expires:        time.Now().Add(c.lifetime),
+		}
+	}
+	return nil
+}
+
+// Invalidate forgets all of the cached shared users. A membership change in
+// one room changes the shared users of everyone in that room, so it is
+// simplest to start again.
+func (c *SharedUsersCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]sharedUsersEntry)
+}
+
+func copyUserIDsToCount(userIDsToCount map[string]int) map[string]int {
+	result := make(map[string]int, len(userIDsToCount))
+	for userID, count := range userIDsToCount {
+		result[userID] = count
+	}
+	return result
+}
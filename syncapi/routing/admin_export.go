@@ -0,0 +1,122 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type exportUserResponse struct {
+	UserID      string                          `json:"user_id"`
+	Profile     exportProfile                   `json:"profile"`
+	AccountData exportAccountData               `json:"account_data"`
+	Devices     []exportDevice                  `json:"devices"`
+	Events      []gomatrixserverlib.ClientEvent `json:"events"`
+}
+
+type exportProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type exportAccountData struct {
+	Global map[string]json.RawMessage            `json:"global"`
+	Rooms  map[string]map[string]json.RawMessage `json:"rooms"`
+}
+
+// exportDevice is the metadata of a device, leaving out its access token.
+type exportDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	LastSeenIP  string `json:"last_seen_ip,omitempty"`
+	LastSeenTS  int64  `json:"last_seen_ts,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+// ExportUser implements GET /_dendrite/admin/exportUser/{userId}, which
+// returns everything we hold about a local user as a JSON file: their
+// profile, account data, devices and the events they have sent.
+func ExportUser(
+	req *http.Request, db storage.Database, userAPI userapi.UserInternalAPI, userID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	var profileRes userapi.QueryProfileResponse
+	if err := userAPI.QueryProfile(ctx, &userapi.QueryProfileRequest{UserID: userID}, &profileRes); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	if !profileRes.UserExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found"),
+		}
+	}
+
+	var dataRes userapi.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{UserID: userID}, &dataRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	var devicesRes userapi.QueryDevicesResponse
+	if err := userAPI.QueryDevices(ctx, &userapi.QueryDevicesRequest{UserID: userID}, &devicesRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryDevices failed")
+		return jsonerror.InternalServerError()
+	}
+	events, err := db.EventsBySender(ctx, userID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.EventsBySender failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := exportUserResponse{
+		UserID: userID,
+		Profile: exportProfile{
+			DisplayName: profileRes.DisplayName,
+			AvatarURL:   profileRes.AvatarURL,
+		},
+		AccountData: exportAccountData{
+			Global: dataRes.GlobalAccountData,
+			Rooms:  dataRes.RoomAccountData,
+		},
+		Devices: []exportDevice{},
+		Events:  gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+	}
+	for _, dev := range devicesRes.Devices {
+		res.Devices = append(res.Devices, exportDevice{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+			LastSeenIP:  dev.LastSeenIP,
+			LastSeenTS:  dev.LastSeenTS,
+			UserAgent:   dev.UserAgent,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+		Headers: map[string]string{
+			"Content-Disposition": fmt.Sprintf("attachment; filename=%q", userID+".json"),
+		},
+	}
+}
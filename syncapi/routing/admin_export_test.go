@@ -0,0 +1,118 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type exportUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *exportUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
+	if req.UserID == "@alice:localhost" {
+		res.UserExists = true
+		res.DisplayName = "Alice"
+	}
+	return nil
+}
+
+func (u *exportUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.GlobalAccountData = map[string]json.RawMessage{
+		"m.direct": json.RawMessage(`{"@bob:localhost":["!dm:localhost"]}`),
+	}
+	res.RoomAccountData = map[string]map[string]json.RawMessage{
+		testRoomID: {"m.tag": json.RawMessage(`{"tags":{"u.work":{}}}`)},
+	}
+	return nil
+}
+
+func (u *exportUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	res.Devices = []userapi.Device{
+		{ID: "PHONE", UserID: req.UserID, AccessToken: "secret", DisplayName: "Phone", LastSeenIP: "10.0.0.1"},
+		{ID: "LAPTOP", UserID: req.UserID, AccessToken: "secret"},
+	}
+	return nil
+}
+
+func TestExportUser(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	mustCreateRoom(t, db, 3)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/exportUser/@alice:localhost", nil)
+	res := ExportUser(req, db, &exportUserAPI{}, "@alice:localhost")
+	if res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+	}
+	if res.Headers["Content-Disposition"] != `attachment; filename="@alice:localhost.json"` {
+		t.Errorf("got Content-Disposition %q", res.Headers["Content-Disposition"])
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal export: %s", err)
+	}
+	var export struct {
+		Profile struct {
+			DisplayName string `json:"displayname"`
+		} `json:"profile"`
+		AccountData struct {
+			Global map[string]json.RawMessage            `json:"global"`
+			Rooms  map[string]map[string]json.RawMessage `json:"rooms"`
+		} `json:"account_data"`
+		Devices []map[string]interface{} `json:"devices"`
+		Events  []struct {
+			Type   string `json:"type"`
+			Sender string `json:"sender"`
+		} `json:"events"`
+	}
+	if err = json.Unmarshal(body, &export); err != nil {
+		t.Fatalf("failed to unmarshal export: %s", err)
+	}
+
+	if export.Profile.DisplayName != "Alice" {
+		t.Errorf("got display name %q", export.Profile.DisplayName)
+	}
+	if _, ok := export.AccountData.Global["m.direct"]; !ok {
+		t.Errorf("got global account data %v, want m.direct", export.AccountData.Global)
+	}
+	if _, ok := export.AccountData.Rooms[testRoomID]["m.tag"]; !ok {
+		t.Errorf("got room account data %v, want m.tag in %s", export.AccountData.Rooms, testRoomID)
+	}
+	if len(export.Devices) != 2 || export.Devices[0]["device_id"] != "PHONE" || export.Devices[1]["device_id"] != "LAPTOP" {
+		t.Errorf("got devices %v", export.Devices)
+	}
+	for _, dev := range export.Devices {
+		if _, ok := dev["access_token"]; ok {
+			t.Errorf("device %v includes its access token", dev["device_id"])
+		}
+	}
+	// The create event, the join and the three messages.
+	if len(export.Events) != 5 || export.Events[0].Type != "m.room.create" || export.Events[4].Type != "m.room.message" {
+		t.Errorf("got events %+v", export.Events)
+	}
+
+	res = ExportUser(req, db, &exportUserAPI{}, "@nobody:localhost")
+	if res.Code != http.StatusNotFound {
+		t.Errorf("got HTTP %d for an unknown user, want %d", res.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type contextResp struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+const defaultContextLimit = 10
+
+// OnIncomingContextRequest implements the /context endpoint from the
+// client-server API.
+// See: https://matrix.org/docs/spec/client_server/latest#get-matrix-client-r0-rooms-roomid-context-eventid
+// nolint:gocyclo
+func OnIncomingContextRequest(
+	req *http.Request, db storage.Database, roomID, eventID string, device *userapi.Device,
+	rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+
+	// Maximum number of events to return around the event; defaults to 10.
+	limit := defaultContextLimit
+	if s := req.URL.Query().Get("limit"); len(s) > 0 {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+	}
+	// TODO: Implement filtering
+	applyEdits := req.URL.Query().Get(applyEditsParam) == "true"
+
+	isForgotten, err := checkIsRoomForgotten(ctx, roomID, device.UserID, rsAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("checkIsRoomForgotten failed")
+		return jsonerror.InternalServerError()
+	}
+	if isForgotten {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("user already forgot about this room"),
+		}
+	}
+
+	events, err := db.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+	visible, err := internal.ApplyHistoryVisibilityFilter(ctx, rsAPI, device.UserID, events)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("internal.ApplyHistoryVisibilityFilter failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(visible) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to see this event"),
+		}
+	}
+	event := visible[0]
+
+	windowBefore, windowAfter, err := getContextEvents(ctx, db, roomID, eventID, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("getContextEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsBefore, eventsAfter, err := filterContextEvents(ctx, rsAPI, device.UserID, event, windowBefore, windowAfter)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("filterContextEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The state is the state of the room after the last event returned.
+	lastEvent := event
+	if len(eventsAfter) > 0 {
+		lastEvent = eventsAfter[len(eventsAfter)-1]
+	}
+	stateRes := api.QueryStateAfterEventsResponse{}
+	if err = rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{lastEvent.EventID()},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The tokens cover the whole window, including any events that were
+	// trimmed, so that paginating from them doesn't fetch those again.
+	start, end := event, event
+	if len(windowBefore) > 0 {
+		start = windowBefore[len(windowBefore)-1]
+	}
+	if len(windowAfter) > 0 {
+		end = windowAfter[len(windowAfter)-1]
+	}
+	startToken, err := db.EventPositionInTopology(ctx, start.EventID())
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.EventPositionInTopology failed")
+		return jsonerror.InternalServerError()
+	}
+	// Paginating backwards from the start token must not return the earliest
+	// event again, see messagesReq.getStartEnd.
+	startToken.Decrement()
+	endToken, err := db.EventPositionInTopology(ctx, end.EventID())
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.EventPositionInTopology failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := contextResp{
+		Start:        startToken.String(),
+		End:          endToken.String(),
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(eventsBefore, gomatrixserverlib.FormatAll),
+		Event:        gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(eventsAfter, gomatrixserverlib.FormatAll),
+		State:        gomatrixserverlib.HeaderedToClientEvents(stateRes.StateEvents, gomatrixserverlib.FormatAll),
+	}
+	eventSlice := []gomatrixserverlib.ClientEvent{res.Event}
+	for _, clientEvents := range [][]gomatrixserverlib.ClientEvent{
+		res.EventsBefore, eventSlice, res.EventsAfter,
+	} {
+		if err = internal.BundleAggregations(ctx, db, clientEvents, applyEdits); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("internal.BundleAggregations failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	res.Event = eventSlice[0]
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// getContextEvents returns up to limit events around the given event, split
+// evenly between the events before and after it. The events before are in
+// reverse topological order, newest first, and the events after are in
+// topological order, oldest first.
+func getContextEvents(
+	ctx context.Context, db storage.Database, roomID, eventID string, limit int,
+) (before, after []*gomatrixserverlib.HeaderedEvent, err error) {
+	beforeLimit := limit / 2
+	afterLimit := limit - beforeLimit
+	pos, err := db.EventPositionInTopology(ctx, eventID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.EventPositionInTopology: %w", err)
+	}
+	maxPos, err := db.MaxTopologicalPosition(ctx, roomID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.MaxTopologicalPosition: %w", err)
+	}
+
+	// Going backwards includes the event itself, so ask for one more event
+	// than we need and then leave it out.
+	streamEvents, err := db.GetEventsInTopologicalRange(
+		ctx, &pos, &types.TopologyToken{}, roomID, beforeLimit+1, true,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.GetEventsInTopologicalRange: %w", err)
+	}
+	for _, ev := range db.StreamEventsToEvents(nil, streamEvents) {
+		if ev.EventID() != eventID && len(before) < beforeLimit {
+			before = append(before, ev)
+		}
+	}
+
+	// Going forwards excludes the upper bound, so go one past the most recent
+	// event in the room.
+	to := types.TopologyToken{Depth: maxPos.Depth + 1}
+	streamEvents, err = db.GetEventsInTopologicalRange(
+		ctx, &pos, &to, roomID, afterLimit, false,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.GetEventsInTopologicalRange: %w", err)
+	}
+	after = db.StreamEventsToEvents(nil, streamEvents)
+	return before, after, nil
+}
+
+// filterContextEvents removes the events around the given event that the user
+// isn't allowed to see according to the history visibility of the room. The
+// visibility changes as we walk through the window, e.g. when the user joins
+// or leaves the room, so the whole window is filtered in topological order
+// rather than each side on its own.
+func filterContextEvents(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, userID string,
+	event *gomatrixserverlib.HeaderedEvent, before, after []*gomatrixserverlib.HeaderedEvent,
+) (visibleBefore, visibleAfter []*gomatrixserverlib.HeaderedEvent, err error) {
+	window := make([]*gomatrixserverlib.HeaderedEvent, 0, len(before)+1+len(after))
+	for i := len(before) - 1; i >= 0; i-- {
+		window = append(window, before[i])
+	}
+	window = append(window, event)
+	window = append(window, after...)
+	visible, err := internal.ApplyHistoryVisibilityFilter(ctx, rsAPI, userID, window)
+	if err != nil {
+		return nil, nil, fmt.Errorf("internal.ApplyHistoryVisibilityFilter: %w", err)
+	}
+
+	// Split the visible events back up around the event, putting the events
+	// before it back into reverse topological order.
+	isBefore := make(map[string]bool, len(before))
+	for _, ev := range before {
+		isBefore[ev.EventID()] = true
+	}
+	visibleBefore = []*gomatrixserverlib.HeaderedEvent{}
+	visibleAfter = []*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range visible {
+		switch {
+		case ev.EventID() == event.EventID():
+		case isBefore[ev.EventID()]:
+			visibleBefore = append([]*gomatrixserverlib.HeaderedEvent{ev}, visibleBefore...)
+		default:
+			visibleAfter = append(visibleAfter, ev)
+		}
+	}
+	return visibleBefore, visibleAfter, nil
+}
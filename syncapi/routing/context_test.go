@@ -0,0 +1,167 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// contextRoomserverAPI works out the room state from a linear list of events.
+type contextRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	events []*gomatrixserverlib.HeaderedEvent
+}
+
+// stateAfter returns the state after the event with the given ID.
+func (r *contextRoomserverAPI) stateAfter(eventID string) map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent {
+	state := map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range r.events {
+		if ev.StateKey() != nil {
+			state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		}
+		if ev.EventID() == eventID {
+			break
+		}
+	}
+	return state
+}
+
+func (r *contextRoomserverAPI) QueryStateAfterEvents(ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse) error {
+	res.RoomExists = true
+	if len(req.PrevEventIDs) == 0 {
+		return nil
+	}
+	state := r.stateAfter(req.PrevEventIDs[0])
+	if len(req.StateToFetch) == 0 {
+		for _, ev := range state {
+			res.StateEvents = append(res.StateEvents, ev)
+		}
+		return nil
+	}
+	for _, tuple := range req.StateToFetch {
+		if ev, ok := state[tuple]; ok {
+			res.StateEvents = append(res.StateEvents, ev)
+		}
+	}
+	return nil
+}
+
+func (r *contextRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse) error {
+	state := r.stateAfter(r.events[len(r.events)-1].EventID())
+	if ev, ok := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: req.UserID}]; ok {
+		res.HasBeenInRoom = true
+		res.Membership, _ = ev.Membership()
+		res.IsInRoom = res.Membership == gomatrixserverlib.Join
+	}
+	return nil
+}
+
+// mustCreateContextRoom writes a room with "joined" history visibility, in
+// which bob joins, sees a message and then leaves again. It returns the
+// roomserver API and the events by name.
+func mustCreateContextRoom(t *testing.T, db storage.Database) (*contextRoomserverAPI, map[string]*gomatrixserverlib.HeaderedEvent) {
+	t.Helper()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	emptyStateKey, alice, bob := "", "@alice:localhost", "@bob:localhost"
+	builders := []struct {
+		name string
+		gomatrixserverlib.EventBuilder
+	}{
+		{"create", gomatrixserverlib.EventBuilder{Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Content: []byte(`{"creator":"@alice:localhost","room_version":"4"}`)}},
+		{"alice join", gomatrixserverlib.EventBuilder{Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: []byte(`{"membership":"join"}`)}},
+		{"history visibility", gomatrixserverlib.EventBuilder{Sender: alice, Type: gomatrixserverlib.MRoomHistoryVisibility, StateKey: &emptyStateKey, Content: []byte(`{"history_visibility":"joined"}`)}},
+		{"before bob", gomatrixserverlib.EventBuilder{Sender: alice, Type: "m.room.message", Content: []byte(`{"body":"Before bob"}`)}},
+		{"bob join", gomatrixserverlib.EventBuilder{Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: []byte(`{"membership":"join"}`)}},
+		{"target", gomatrixserverlib.EventBuilder{Sender: alice, Type: "m.room.message", Content: []byte(`{"body":"Target"}`)}},
+		{"bob leave", gomatrixserverlib.EventBuilder{Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: []byte(`{"membership":"leave"}`)}},
+		{"after bob", gomatrixserverlib.EventBuilder{Sender: alice, Type: "m.room.message", Content: []byte(`{"body":"After bob"}`)}},
+	}
+	rsAPI := &contextRoomserverAPI{}
+	named := map[string]*gomatrixserverlib.HeaderedEvent{}
+	var prevEvents []string
+	for i := range builders {
+		b := builders[i].EventBuilder
+		b.RoomID = testRoomID
+		b.Depth = int64(i + 1)
+		b.PrevEvents = prevEvents
+		ev, err := b.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		hev := ev.Headered(gomatrixserverlib.RoomVersionV4)
+		var addStateEvents []*gomatrixserverlib.HeaderedEvent
+		var addStateEventIDs []string
+		if hev.StateKey() != nil {
+			addStateEvents = append(addStateEvents, hev)
+			addStateEventIDs = append(addStateEventIDs, hev.EventID())
+		}
+		if _, err = db.WriteEvent(context.Background(), hev, addStateEvents, addStateEventIDs, nil, nil, false); err != nil {
+			t.Fatalf("failed to write event: %s", err)
+		}
+		prevEvents = []string{hev.EventID()}
+		rsAPI.events = append(rsAPI.events, hev)
+		named[builders[i].name] = hev
+	}
+	return rsAPI, named
+}
+
+func TestContextTrimsInvisibleEvents(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	rsAPI, events := mustCreateContextRoom(t, db)
+
+	assertEventIDs := func(msg string, got []gomatrixserverlib.ClientEvent, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d events, want %d", msg, len(got), len(want))
+		}
+		for i := range got {
+			if got[i].EventID != events[want[i]].EventID() {
+				t.Errorf("%s: got event %d %s, want %q (%s)", msg, i, got[i].EventID, want[i], events[want[i]].EventID())
+			}
+		}
+	}
+	request := func(userID, eventName string) contextResp {
+		t.Helper()
+		eventID := events[eventName].EventID()
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/context/"+eventID+"?limit=20", nil)
+		res := OnIncomingContextRequest(req, db, testRoomID, eventID, &userapi.Device{UserID: userID}, rsAPI)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+		}
+		return res.JSON.(contextResp)
+	}
+
+	// Bob can only see the events from when he was in the room, as well as
+	// his own join and leave.
+	res := request("@bob:localhost", "target")
+	assertEventIDs("bob events_before", res.EventsBefore, "bob join")
+	assertEventIDs("bob events_after", res.EventsAfter, "bob leave")
+
+	// Alice was there the whole time, so she sees everything.
+	res = request("@alice:localhost", "target")
+	assertEventIDs("alice events_before", res.EventsBefore, "bob join", "before bob", "history visibility", "alice join", "create")
+	assertEventIDs("alice events_after", res.EventsAfter, "bob leave", "after bob")
+}
@@ -0,0 +1,324 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const defaultInitialSyncLimit = 10
+
+type initialSyncMessages struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+type initialSyncRoom struct {
+	RoomID      string                          `json:"room_id"`
+	Membership  string                          `json:"membership"`
+	Messages    initialSyncMessages             `json:"messages"`
+	State       []gomatrixserverlib.ClientEvent `json:"state"`
+	Visibility  string                          `json:"visibility"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+type roomInitialSyncResponse struct {
+	initialSyncRoom
+	Presence []gomatrixserverlib.ClientEvent `json:"presence"`
+}
+
+type initialSyncResponse struct {
+	End         string                          `json:"end"`
+	Presence    []gomatrixserverlib.ClientEvent `json:"presence"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+	Rooms       []initialSyncRoom               `json:"rooms"`
+}
+
+// OnIncomingInitialSyncRequest implements the deprecated GET /initialSync
+// endpoint from the client-server API, which some older clients still use.
+// TODO: Include invited rooms, and left rooms if archived=true.
+// See: https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-initialsync
+func OnIncomingInitialSyncRequest(
+	req *http.Request, db storage.Database, device *userapi.Device,
+	rsAPI api.RoomserverInternalAPI, userAPI userapi.UserInternalAPI, cfg *config.SyncAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit, errRes := initialSyncLimit(req, cfg.MaxTimelineLimit)
+	if errRes != nil {
+		return *errRes
+	}
+
+	end, err := db.SyncPosition(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.SyncPosition failed")
+		return jsonerror.InternalServerError()
+	}
+	var roomsRes api.QueryRoomsForUserResponse
+	if err = rsAPI.QueryRoomsForUser(ctx, &api.QueryRoomsForUserRequest{
+		UserID:         device.UserID,
+		WantMembership: gomatrixserverlib.Join,
+	}, &roomsRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	var dataRes userapi.QueryAccountDataResponse
+	if err = userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID: device.UserID,
+	}, &dataRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := initialSyncResponse{
+		End:         end.String(),
+		Presence:    []gomatrixserverlib.ClientEvent{},
+		AccountData: accountDataEvents(dataRes.GlobalAccountData),
+		Rooms:       []initialSyncRoom{},
+	}
+	sort.Strings(roomsRes.RoomIDs)
+	var members []string
+	for _, roomID := range roomsRes.RoomIDs {
+		room, roomMembers, err := roomInitialSync(ctx, db, rsAPI, device, roomID, limit, end)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("roomInitialSync failed")
+			return jsonerror.InternalServerError()
+		}
+		room.AccountData = accountDataEvents(dataRes.RoomAccountData[roomID])
+		res.Rooms = append(res.Rooms, *room)
+		members = append(members, roomMembers...)
+	}
+	if res.Presence, err = presenceEvents(ctx, db, members); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("presenceEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// OnIncomingRoomInitialSyncRequest implements the deprecated
+// GET /rooms/{roomId}/initialSync endpoint from the client-server API.
+// See: https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-rooms-roomid-initialsync
+func OnIncomingRoomInitialSyncRequest(
+	req *http.Request, db storage.Database, roomID string, device *userapi.Device,
+	rsAPI api.RoomserverInternalAPI, userAPI userapi.UserInternalAPI, cfg *config.SyncAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit, errRes := initialSyncLimit(req, cfg.MaxMessagesLimit)
+	if errRes != nil {
+		return *errRes
+	}
+
+	// TODO: Allow people to peek into world-readable rooms.
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.IsInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+
+	end, err := db.SyncPosition(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.SyncPosition failed")
+		return jsonerror.InternalServerError()
+	}
+	room, members, err := roomInitialSync(ctx, db, rsAPI, device, roomID, limit, end)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("roomInitialSync failed")
+		return jsonerror.InternalServerError()
+	}
+	var dataRes userapi.QueryAccountDataResponse
+	if err = userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID: device.UserID,
+		RoomID: roomID,
+	}, &dataRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	room.AccountData = accountDataEvents(dataRes.RoomAccountData[roomID])
+
+	res := roomInitialSyncResponse{initialSyncRoom: *room}
+	if res.Presence, err = presenceEvents(ctx, db, members); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("presenceEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// initialSyncLimit returns the number of messages to return for each room,
+// capped at maxLimit if it is set.
+func initialSyncLimit(req *http.Request, maxLimit int) (int, *util.JSONResponse) {
+	s := req.URL.Query().Get("limit")
+	if s == "" {
+		return defaultInitialSyncLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 0 {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+		}
+	}
+	if maxLimit > 0 && limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, nil
+}
+
+// roomInitialSync returns the current state and most recent messages of a
+// room that the user is joined to, along with the IDs of the joined members.
+// The account data of the room is left for the caller to fill in.
+func roomInitialSync(
+	ctx context.Context, db storage.Database, rsAPI api.RoomserverInternalAPI,
+	device *userapi.Device, roomID string, limit int, end types.StreamingToken,
+) (*initialSyncRoom, []string, error) {
+	maxPos, err := db.MaxTopologicalPosition(ctx, roomID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.MaxTopologicalPosition: %w", err)
+	}
+	// Going backwards includes the most recent event itself.
+	streamEvents, err := db.GetEventsInTopologicalRange(
+		ctx, &maxPos, &types.TopologyToken{}, roomID, limit, true,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.GetEventsInTopologicalRange: %w", err)
+	}
+	events := db.StreamEventsToEvents(device, streamEvents)
+	// The events are newest first, but the chunk is oldest first.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	if events, err = internal.ApplyHistoryVisibilityFilter(ctx, rsAPI, device.UserID, events); err != nil {
+		return nil, nil, fmt.Errorf("internal.ApplyHistoryVisibilityFilter: %w", err)
+	}
+	start := maxPos
+	if len(events) > 0 {
+		if start, err = db.EventPositionInTopology(ctx, events[0].EventID()); err != nil {
+			return nil, nil, fmt.Errorf("db.EventPositionInTopology: %w", err)
+		}
+		// Paginating backwards from the start token must not return the
+		// earliest event again, see messagesReq.getStartEnd.
+		start.Decrement()
+	}
+
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	state, err := db.GetStateEventsForRoom(ctx, roomID, &stateFilter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.GetStateEventsForRoom: %w", err)
+	}
+	var members []string
+	for _, ev := range state {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		if membership, merr := ev.Membership(); merr == nil && membership == gomatrixserverlib.Join {
+			members = append(members, *ev.StateKey())
+		}
+	}
+
+	visibility := "private"
+	var publishedRes api.QueryPublishedRoomsResponse
+	if err = rsAPI.QueryPublishedRooms(ctx, &api.QueryPublishedRoomsRequest{
+		RoomID: roomID,
+	}, &publishedRes); err != nil {
+		return nil, nil, fmt.Errorf("rsAPI.QueryPublishedRooms: %w", err)
+	}
+	if len(publishedRes.RoomIDs) > 0 {
+		visibility = "public"
+	}
+
+	return &initialSyncRoom{
+		RoomID:     roomID,
+		Membership: gomatrixserverlib.Join,
+		Messages: initialSyncMessages{
+			Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+			Start: start.String(),
+			End:   end.String(),
+		},
+		State:       gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll),
+		Visibility:  visibility,
+		AccountData: []gomatrixserverlib.ClientEvent{},
+	}, members, nil
+}
+
+// accountDataEvents turns account data into events, sorted by type.
+func accountDataEvents(data map[string]json.RawMessage) []gomatrixserverlib.ClientEvent {
+	events := make([]gomatrixserverlib.ClientEvent, 0, len(data))
+	for dataType, content := range data {
+		events = append(events, gomatrixserverlib.ClientEvent{
+			Type:    dataType,
+			Content: gomatrixserverlib.RawJSON(content),
+		})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Type < events[j].Type
+	})
+	return events
+}
+
+// presenceEvents returns the presence of each of the given users that we
+// know the presence of.
+func presenceEvents(ctx context.Context, db storage.Database, userIDs []string) ([]gomatrixserverlib.ClientEvent, error) {
+	events := []gomatrixserverlib.ClientEvent{}
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		presence, err := db.GetPresence(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetPresence: %w", err)
+		}
+		if presence == nil {
+			continue
+		}
+		ev, err := types.NewPresenceClientEvent(presence, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("types.NewPresenceClientEvent: %w", err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
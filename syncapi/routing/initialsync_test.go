@@ -0,0 +1,192 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testRoomID = "!room:localhost"
+
+type initialSyncRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	members map[string]bool
+}
+
+func (r *initialSyncRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse) error {
+	res.IsInRoom = r.members[req.UserID]
+	res.HasBeenInRoom = res.IsInRoom
+	return nil
+}
+
+func (r *initialSyncRoomserverAPI) QueryStateAfterEvents(ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse) error {
+	res.RoomExists = true
+	return nil
+}
+
+func (r *initialSyncRoomserverAPI) QueryPublishedRooms(ctx context.Context, req *api.QueryPublishedRoomsRequest, res *api.QueryPublishedRoomsResponse) error {
+	return nil
+}
+
+type initialSyncUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *initialSyncUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.RoomAccountData = map[string]map[string]json.RawMessage{
+		testRoomID: {"m.tag": json.RawMessage(`{"tags":{"u.work":{}}}`)},
+	}
+	return nil
+}
+
+func mustCreateRoom(t *testing.T, db storage.Database, messages int) {
+	t.Helper()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	emptyStateKey, alice := "", "@alice:localhost"
+	builders := []gomatrixserverlib.EventBuilder{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Content: []byte(`{"creator":"@alice:localhost","room_version":"4"}`)},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: []byte(`{"membership":"join"}`)},
+	}
+	for i := 0; i < messages; i++ {
+		builders = append(builders, gomatrixserverlib.EventBuilder{
+			Type:    "m.room.message",
+			Content: []byte(fmt.Sprintf(`{"body":"Message %d"}`, i+1)),
+		})
+	}
+	var prevEvents []string
+	for i := range builders {
+		b := builders[i]
+		b.RoomID = testRoomID
+		b.Sender = alice
+		b.Depth = int64(i + 1)
+		b.PrevEvents = prevEvents
+		ev, err := b.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		hev := ev.Headered(gomatrixserverlib.RoomVersionV4)
+		var addStateEvents []*gomatrixserverlib.HeaderedEvent
+		var addStateEventIDs []string
+		if hev.StateKey() != nil {
+			addStateEvents = append(addStateEvents, hev)
+			addStateEventIDs = append(addStateEventIDs, hev.EventID())
+		}
+		if _, err = db.WriteEvent(context.Background(), hev, addStateEvents, addStateEventIDs, nil, nil, false); err != nil {
+			t.Fatalf("failed to write event: %s", err)
+		}
+		prevEvents = []string{hev.EventID()}
+	}
+}
+
+// mustCreateDatabase returns a sync database in a temporary file, which is
+// removed by calling the returned function.
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	t.Helper()
+	tmpfile, err := ioutil.TempFile("", "syncapi")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	db, err := sqlite3.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sync database: %s", err)
+	}
+	return db, func() {
+		_ = os.Remove(tmpfile.Name())
+	}
+}
+
+func TestRoomInitialSync(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	mustCreateRoom(t, db, 5)
+	rsAPI := &initialSyncRoomserverAPI{members: map[string]bool{"@alice:localhost": true}}
+
+	cfg := &config.SyncAPI{}
+	cfg.Defaults()
+	req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/initialSync?limit=3", nil)
+	res := OnIncomingRoomInitialSyncRequest(req, db, testRoomID, &userapi.Device{UserID: "@alice:localhost"}, rsAPI, &initialSyncUserAPI{}, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+	}
+	body, ok := res.JSON.(roomInitialSyncResponse)
+	if !ok {
+		t.Fatalf("got response of type %T", res.JSON)
+	}
+	if body.RoomID != testRoomID || body.Membership != gomatrixserverlib.Join || body.Visibility != "private" {
+		t.Errorf("got room %s with membership %q and visibility %q", body.RoomID, body.Membership, body.Visibility)
+	}
+
+	// The chunk has the most recent messages, oldest first.
+	var bodies []string
+	for _, ev := range body.Messages.Chunk {
+		var content struct {
+			Body string `json:"body"`
+		}
+		_ = json.Unmarshal(ev.Content, &content)
+		bodies = append(bodies, content.Body)
+	}
+	if fmt.Sprint(bodies) != "[Message 3 Message 4 Message 5]" {
+		t.Errorf("got message chunk %v", bodies)
+	}
+	if body.Messages.Start == "" || body.Messages.End == "" {
+		t.Errorf("got start %q and end %q, want tokens", body.Messages.Start, body.Messages.End)
+	}
+
+	// The state is the current state of the room.
+	state := map[string]bool{}
+	for _, ev := range body.State {
+		state[ev.Type] = true
+	}
+	if len(body.State) != 2 || !state[gomatrixserverlib.MRoomCreate] || !state[gomatrixserverlib.MRoomMember] {
+		t.Errorf("got state %+v", body.State)
+	}
+	if len(body.AccountData) != 1 || body.AccountData[0].Type != "m.tag" {
+		t.Errorf("got account data %+v", body.AccountData)
+	}
+
+	// Users who aren't in the room can't see it.
+	res = OnIncomingRoomInitialSyncRequest(req, db, testRoomID, &userapi.Device{UserID: "@bob:localhost"}, rsAPI, &initialSyncUserAPI{}, cfg)
+	if res.Code != http.StatusForbidden {
+		t.Errorf("got HTTP %d for a non-member, want %d", res.Code, http.StatusForbidden)
+	}
+
+	// The limit is capped by the configured maximum.
+	cfg.MaxMessagesLimit = 2
+	res = OnIncomingRoomInitialSyncRequest(req, db, testRoomID, &userapi.Device{UserID: "@alice:localhost"}, rsAPI, &initialSyncUserAPI{}, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+	}
+	if got := len(res.JSON.(roomInitialSyncResponse).Messages.Chunk); got != 2 {
+		t.Errorf("got %d messages with a maximum of 2", got)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestMessagesLimitIsClamped(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	mustCreateRoom(t, db, 10)
+	rsAPI := &initialSyncRoomserverAPI{members: map[string]bool{"@alice:localhost": true}}
+	device := &userapi.Device{UserID: "@alice:localhost"}
+
+	testCases := []struct {
+		maxLimit int
+		want     int
+	}{
+		{3, 3},
+		{0, 12}, // no maximum, so the whole room
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/messages?dir=b&limit=100&from=t100_100", nil)
+		cfg := &config.SyncAPI{MaxMessagesLimit: tc.maxLimit}
+		res := OnIncomingMessagesRequest(req, db, testRoomID, device, nil, rsAPI, cfg, nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("max %d: got HTTP %d: %+v", tc.maxLimit, res.Code, res.JSON)
+		}
+		if got := len(res.JSON.(messagesResp).Chunk); got != tc.want {
+			t.Errorf("max %d: got %d events, want %d", tc.maxLimit, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// GetPresence implements GET /_matrix/client/r0/presence/{userId}/status
+func GetPresence(
+	req *http.Request, device *userapi.Device, syncDB storage.Database, userID string,
+) util.JSONResponse {
+	shared, err := syncDB.SharesRoomWith(req.Context(), device.UserID, userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.SharesRoomWith failed")
+		return jsonerror.InternalServerError()
+	}
+	if !shared {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You do not share a room with this user"),
+		}
+	}
+
+	presence, err := syncDB.GetPresence(req.Context(), userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.GetPresence failed")
+		return jsonerror.InternalServerError()
+	}
+	if presence == nil {
+		// We don't know anything about this user, so as far as we're
+		// concerned they are offline.
+		presence = &eduAPI.OutputPresenceEvent{
+			UserID:   userID,
+			Presence: eduAPI.PresenceOffline,
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: types.NewPresenceContent(presence, time.Now()),
+	}
+}
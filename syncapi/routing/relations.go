@@ -0,0 +1,183 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type relationsResp struct {
+	Chunk          []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch      string                          `json:"next_batch,omitempty"`
+	RecursionDepth int                             `json:"recursion_depth,omitempty"`
+}
+
+const (
+	defaultRelationsLimit = 5
+	maxRelationsLimit     = 100
+	// How many levels of relations are returned when the client asks for
+	// the relations to be followed recursively (MSC3981).
+	maxRelationsRecursionDepth = 3
+)
+
+// OnIncomingRelationsRequest implements the /relations endpoint from the
+// client-server API, including following relations recursively when the
+// recurse parameter is set, as described in MSC3981.
+// See: https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+// nolint:gocyclo
+func OnIncomingRelationsRequest(
+	req *http.Request, db storage.Database, roomID, eventID, relType, eventType string,
+	device *userapi.Device, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	limit := defaultRelationsLimit
+	if s := query.Get("limit"); len(s) > 0 {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+		if limit > maxRelationsLimit {
+			limit = maxRelationsLimit
+		}
+	}
+	// The pagination tokens are offsets into the list of relations.
+	from := 0
+	if s := query.Get("from"); len(s) > 0 {
+		var err error
+		from, err = strconv.Atoi(s)
+		if err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("invalid from token"),
+			}
+		}
+	}
+	backwards := true
+	switch query.Get("dir") {
+	case "", "b":
+	case "f":
+		backwards = false
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("dir must be either 'f' or 'b'"),
+		}
+	}
+	recurse := false
+	for _, param := range []string{"recurse", "org.matrix.msc3981.recurse"} {
+		if s := query.Get(param); len(s) > 0 {
+			var err error
+			if recurse, err = strconv.ParseBool(s); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue(param + " must be a boolean"),
+				}
+			}
+		}
+	}
+
+	// The user must be able to see the event to see its relations.
+	events, err := db.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+	visible, err := internal.ApplyHistoryVisibilityFilter(ctx, rsAPI, device.UserID, events)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("internal.ApplyHistoryVisibilityFilter failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(visible) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to see this event"),
+		}
+	}
+
+	maxDepth := 1
+	if recurse {
+		maxDepth = maxRelationsRecursionDepth
+	}
+	// Ask for one more relation than we need, so that we know whether
+	// there is another page after this one.
+	relations, depth, err := db.RelationsForEvent(ctx, roomID, eventID, relType, eventType, maxDepth, backwards, from, limit+1)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.RelationsForEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	res := relationsResp{
+		Chunk: []gomatrixserverlib.ClientEvent{},
+	}
+	if recurse {
+		res.RecursionDepth = depth
+	}
+	if len(relations) > limit {
+		relations = relations[:limit]
+		res.NextBatch = strconv.Itoa(from + limit)
+	}
+	childEventIDs := make([]string, 0, len(relations))
+	for _, relation := range relations {
+		childEventIDs = append(childEventIDs, relation.ChildEventID)
+	}
+	childEvents, err := db.Events(ctx, childEventIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	// Put the events back into the order of the relations.
+	eventsByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(childEvents))
+	for _, ev := range childEvents {
+		eventsByID[ev.EventID()] = ev
+	}
+	children := make([]*gomatrixserverlib.HeaderedEvent, 0, len(childEvents))
+	for _, childEventID := range childEventIDs {
+		if ev, ok := eventsByID[childEventID]; ok {
+			children = append(children, ev)
+		}
+	}
+	// The relations aren't next to each other in the timeline, so the
+	// visibility of each of them has to be worked out separately.
+	children, err = internal.ApplyHistoryVisibilityFilterSeparately(ctx, rsAPI, device.UserID, children)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("internal.ApplyHistoryVisibilityFilterSeparately failed")
+		return jsonerror.InternalServerError()
+	}
+	res.Chunk = gomatrixserverlib.HeaderedToClientEvents(children, gomatrixserverlib.FormatAll)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
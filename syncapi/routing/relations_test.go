@@ -0,0 +1,205 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// relationsRoomEvent is an event to write into a relations test room. The
+// sender defaults to alice. Membership events are for their sender.
+type relationsRoomEvent struct {
+	name    string
+	sender  string
+	evType  string
+	content string
+}
+
+// mustCreateRelationsRoom writes a room with a thread, in which a reply to
+// the thread has a reaction. It returns the roomserver API and the events by
+// name.
+func mustCreateRelationsRoom(t *testing.T, db storage.Database) (*contextRoomserverAPI, map[string]*gomatrixserverlib.HeaderedEvent) {
+	t.Helper()
+	return mustWriteRelationsRoom(t, db, []relationsRoomEvent{
+		{"create", "", gomatrixserverlib.MRoomCreate, `{"creator":"@alice:localhost","room_version":"4"}`},
+		{"alice join", "", gomatrixserverlib.MRoomMember, `{"membership":"join"}`},
+		{"root", "", "m.room.message", `{"body":"Thread root"}`},
+		{"reply", "", "m.room.message", `{"body":"Reply","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}`},
+		{"reaction", "", "m.reaction", `{"m.relates_to":{"rel_type":"m.annotation","event_id":"$reply","key":"👍"}}`},
+		{"unrelated", "", "m.room.message", `{"body":"Unrelated"}`},
+	})
+}
+
+// mustWriteRelationsRoom writes the events into a room, one after the other,
+// a second apart. Relations to "$name" are pointed at the event with that
+// name. It returns the roomserver API and the events by name.
+func mustWriteRelationsRoom(t *testing.T, db storage.Database, builders []relationsRoomEvent) (*contextRoomserverAPI, map[string]*gomatrixserverlib.HeaderedEvent) {
+	t.Helper()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	emptyStateKey := ""
+	start := time.Now()
+	rsAPI := &contextRoomserverAPI{}
+	named := map[string]*gomatrixserverlib.HeaderedEvent{}
+	var prevEvents []string
+	for i, builder := range builders {
+		sender := builder.sender
+		if sender == "" {
+			sender = "@alice:localhost"
+		}
+		b := gomatrixserverlib.EventBuilder{
+			Sender:     sender,
+			RoomID:     testRoomID,
+			Type:       builder.evType,
+			Depth:      int64(i + 1),
+			PrevEvents: prevEvents,
+		}
+		switch builder.evType {
+		case gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomHistoryVisibility:
+			b.StateKey = &emptyStateKey
+		case gomatrixserverlib.MRoomMember:
+			b.StateKey = &sender
+		}
+		// Point the relations at the real event IDs.
+		content := builder.content
+		for name, ev := range named {
+			content = strings.ReplaceAll(content, `"$`+name+`"`, `"`+ev.EventID()+`"`)
+		}
+		b.Content = []byte(content)
+		ev, err := b.Build(start.Add(time.Duration(i)*time.Second), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		hev := ev.Headered(gomatrixserverlib.RoomVersionV4)
+		var addStateEvents []*gomatrixserverlib.HeaderedEvent
+		var addStateEventIDs []string
+		if hev.StateKey() != nil {
+			addStateEvents = append(addStateEvents, hev)
+			addStateEventIDs = append(addStateEventIDs, hev.EventID())
+		}
+		if _, err = db.WriteEvent(context.Background(), hev, addStateEvents, addStateEventIDs, nil, nil, false); err != nil {
+			t.Fatalf("failed to write event: %s", err)
+		}
+		prevEvents = []string{hev.EventID()}
+		rsAPI.events = append(rsAPI.events, hev)
+		named[builder.name] = hev
+	}
+	return rsAPI, named
+}
+
+func TestRelationsRecurse(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	rsAPI, events := mustCreateRelationsRoom(t, db)
+
+	request := func(path, relType string) relationsResp {
+		t.Helper()
+		eventID := events["root"].EventID()
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/relations/"+eventID+path, nil)
+		res := OnIncomingRelationsRequest(req, db, testRoomID, eventID, relType, "", &userapi.Device{UserID: "@alice:localhost"}, rsAPI)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+		}
+		return res.JSON.(relationsResp)
+	}
+	assertEventIDs := func(msg string, got []gomatrixserverlib.ClientEvent, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d events, want %d", msg, len(got), len(want))
+		}
+		for i := range got {
+			if got[i].EventID != events[want[i]].EventID() {
+				t.Errorf("%s: got event %d %s, want %q (%s)", msg, i, got[i].EventID, want[i], events[want[i]].EventID())
+			}
+		}
+	}
+
+	// Without recursion only the reply relates to the root.
+	res := request("", "")
+	assertEventIDs("without recurse", res.Chunk, "reply")
+	if res.RecursionDepth != 0 {
+		t.Errorf("got recursion_depth %d without recurse, want it to be left out", res.RecursionDepth)
+	}
+
+	// With recursion the reaction to the reply is included too, newest first.
+	res = request("?recurse=true", "")
+	assertEventIDs("with recurse", res.Chunk, "reaction", "reply")
+	if res.RecursionDepth != 2 {
+		t.Errorf("got recursion_depth %d, want 2", res.RecursionDepth)
+	}
+
+	// The relation type filter applies at every level, but relations of other
+	// types are still followed.
+	res = request("/m.annotation?recurse=true&dir=f", "m.annotation")
+	assertEventIDs("with recurse and rel_type", res.Chunk, "reaction")
+
+	// Paginating forwards returns one event from each page.
+	res = request("?recurse=true&dir=f&limit=1", "")
+	assertEventIDs("first page", res.Chunk, "reply")
+	if res.NextBatch == "" {
+		t.Fatalf("first page has no next_batch")
+	}
+	res = request("?recurse=true&dir=f&limit=1&from="+res.NextBatch, "")
+	assertEventIDs("second page", res.Chunk, "reaction")
+	if res.NextBatch != "" {
+		t.Errorf("got next_batch %q on the last page", res.NextBatch)
+	}
+}
+
+func TestRelationsHistoryVisibility(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	bob := "@bob:localhost"
+	rsAPI, events := mustWriteRelationsRoom(t, db, []relationsRoomEvent{
+		{"create", "", gomatrixserverlib.MRoomCreate, `{"creator":"@alice:localhost","room_version":"4"}`},
+		{"alice join", "", gomatrixserverlib.MRoomMember, `{"membership":"join"}`},
+		{"history visibility", "", gomatrixserverlib.MRoomHistoryVisibility, `{"history_visibility":"joined"}`},
+		{"bob join", bob, gomatrixserverlib.MRoomMember, `{"membership":"join"}`},
+		{"root", "", "m.room.message", `{"body":"Thread root"}`},
+		{"while joined", "", "m.room.message", `{"body":"Bob is here","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}`},
+		{"bob leave", bob, gomatrixserverlib.MRoomMember, `{"membership":"leave"}`},
+		{"while left", "", "m.room.message", `{"body":"Bob has gone","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}`},
+		{"bob rejoin", bob, gomatrixserverlib.MRoomMember, `{"membership":"join"}`},
+		{"after rejoin", "", "m.room.message", `{"body":"Bob is back","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}`},
+	})
+
+	// Bob can't see the reply which was sent while he wasn't in the room,
+	// even though he could see the replies either side of it.
+	eventID := events["root"].EventID()
+	req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/relations/"+eventID+"?dir=f", nil)
+	res := OnIncomingRelationsRequest(req, db, testRoomID, eventID, "", "", &userapi.Device{UserID: bob}, rsAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d: %+v", res.Code, res.JSON)
+	}
+	chunk := res.JSON.(relationsResp).Chunk
+	want := []string{"while joined", "after rejoin"}
+	if len(chunk) != len(want) {
+		t.Fatalf("got %d events, want %d", len(chunk), len(want))
+	}
+	for i := range chunk {
+		if chunk[i].EventID != events[want[i]].EventID() {
+			t.Errorf("got event %d %s, want %q (%s)", i, chunk[i].EventID, want[i], events[want[i]].EventID())
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -34,12 +35,13 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	csMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
+	csMux, dendriteMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
 	userAPI userapi.UserInternalAPI, federation *gomatrixserverlib.FederationClient,
-	rsAPI api.RoomserverInternalAPI,
-	cfg *config.SyncAPI,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI, keyRing gomatrixserverlib.JSONVerifier,
+	rsAPI api.RoomserverInternalAPI, cfg *config.SyncAPI,
 ) {
 	r0mux := csMux.PathPrefix("/r0").Subrouter()
+	unstableMux := csMux.PathPrefix("/unstable").Subrouter()
 
 	// TODO: Add AS support for all handlers below.
 	r0mux.Handle("/sync", httputil.MakeAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -54,6 +56,45 @@ func Setup(
 		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, federation, rsAPI, cfg, srp)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}", httputil.MakeAuthAPI("room_context", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingContextRequest(req, syncDB, vars["roomID"], vars["eventID"], device, rsAPI)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	relationsHandler := httputil.MakeAuthAPI("room_relations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingRelationsRequest(req, syncDB, vars["roomID"], vars["eventID"], vars["relType"], vars["eventType"], device, rsAPI)
+	})
+	r0mux.Handle("/rooms/{roomID}/relations/{eventID}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/relations/{eventID}/{relType}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/relations/{eventID}/{relType}/{eventType}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.msc3030/rooms/{roomID}/timestamp_to_event", httputil.MakeAuthAPI("room_timestamp_to_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingTimestampToEventRequest(req, syncDB, vars["roomID"], device, fsAPI, keyRing, rsAPI, cfg)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/initialSync", httputil.MakeAuthAPI("initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return OnIncomingInitialSyncRequest(req, syncDB, device, rsAPI, userAPI, cfg)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/initialSync", httputil.MakeAuthAPI("rooms_initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingRoomInitialSyncRequest(req, syncDB, vars["roomID"], device, rsAPI, userAPI, cfg)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/user/{userId}/filter",
 		httputil.MakeAuthAPI("put_filter", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -74,7 +115,27 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/presence/{userId}/status",
+		httputil.MakeAuthAPI("get_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPresence(req, device, syncDB, vars["userId"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/keys/changes", httputil.MakeAuthAPI("keys_changes", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingKeyChangeRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteMux.Handle("/admin/exportUser/{userId}",
+		httputil.MakeAdminAPI("admin_export_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ExportUser(req, syncDB, userAPI, vars["userId"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
 }
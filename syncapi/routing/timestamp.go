@@ -0,0 +1,220 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type timestampToEventResp struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// parseTimestampToEventQuery parses the ts and dir query parameters.
+func parseTimestampToEventQuery(req *http.Request) (ts gomatrixserverlib.Timestamp, backwards bool, errRes *util.JSONResponse) {
+	query := req.URL.Query()
+	t, err := strconv.ParseUint(query.Get("ts"), 10, 64)
+	if err != nil {
+		return 0, false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("ts must be a timestamp in milliseconds"),
+		}
+	}
+	switch query.Get("dir") {
+	case "b":
+		backwards = true
+	case "f":
+	default:
+		return 0, false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("dir must be either 'f' or 'b'"),
+		}
+	}
+	return gomatrixserverlib.Timestamp(t), backwards, nil
+}
+
+// OnIncomingTimestampToEventRequest implements the timestamp_to_event
+// endpoint from MSC3030, which returns the event closest to the given
+// timestamp in the given direction. If we don't have any events in that
+// direction then we ask the other servers in the room instead, checking the
+// signatures of the events they give us with the key ring.
+// See: https://github.com/matrix-org/matrix-doc/pull/3030
+func OnIncomingTimestampToEventRequest(
+	req *http.Request, db storage.Database, roomID string, device *userapi.Device,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI, keyRing gomatrixserverlib.JSONVerifier,
+	rsAPI api.RoomserverInternalAPI, cfg *config.SyncAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	ts, backwards, errRes := parseTimestampToEventQuery(req)
+	if errRes != nil {
+		return *errRes
+	}
+
+	eventID, originServerTS, err := db.EventNearestTimestamp(ctx, roomID, ts, backwards)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.EventNearestTimestamp failed")
+		return jsonerror.InternalServerError()
+	}
+	if eventID == "" {
+		return timestampToEventFromFederation(ctx, roomID, ts, backwards, device, fsAPI, keyRing, rsAPI, cfg)
+	}
+
+	// The user must be able to see the event that we found.
+	events, err := db.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	events, err = internal.ApplyHistoryVisibilityFilter(ctx, rsAPI, device.UserID, events)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("internal.ApplyHistoryVisibilityFilter failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to see this room"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: timestampToEventResp{
+			EventID:        eventID,
+			OriginServerTS: originServerTS,
+		},
+	}
+}
+
+// timestampToEventFederationTimeout is how long we spend asking the other
+// servers in the room for an event, in total.
+const timestampToEventFederationTimeout = time.Second * 30
+
+// timestampToEventFromFederation asks each of the other servers in the room
+// for the event closest to the timestamp, returning the first answer which
+// the user is allowed to see. The timestamp comes from the event itself, as
+// the event is signed but the rest of the answer isn't.
+func timestampToEventFromFederation(
+	ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, backwards bool,
+	device *userapi.Device, fsAPI federationSenderAPI.FederationSenderInternalAPI,
+	keyRing gomatrixserverlib.JSONVerifier, rsAPI api.RoomserverInternalAPI, cfg *config.SyncAPI,
+) util.JSONResponse {
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Unable to find an event in that direction"),
+	}
+	if fsAPI == nil {
+		return notFound
+	}
+	var joinedRes api.QueryServerJoinedToRoomResponse
+	if err := rsAPI.QueryServerJoinedToRoom(ctx, &api.QueryServerJoinedToRoomRequest{
+		ServerName: cfg.Matrix.ServerName,
+		RoomID:     roomID,
+	}, &joinedRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	var versionRes api.QueryRoomVersionForRoomResponse
+	if err := rsAPI.QueryRoomVersionForRoom(ctx, &api.QueryRoomVersionForRoomRequest{
+		RoomID: roomID,
+	}, &versionRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timestampToEventFederationTimeout)
+	defer cancel()
+	for _, serverName := range joinedRes.ServerNames {
+		if serverName == cfg.Matrix.ServerName {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		logger := util.GetLogger(ctx).WithField("server_name", serverName)
+		res, err := fsAPI.MSC3030TimestampToEvent(ctx, serverName, roomID, ts, backwards)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to look up event by timestamp")
+			continue
+		}
+		// We don't have the event, so fetch it to find out whether the user
+		// is allowed to see it. If we don't know the state before it either
+		// then we assume the default history visibility.
+		ev, err := fetchRemoteEvent(ctx, fsAPI, keyRing, serverName, roomID, res.EventID, versionRes.RoomVersion)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to fetch event found by timestamp")
+			continue
+		}
+		visible, err := internal.ApplyHistoryVisibilityFilter(ctx, rsAPI, device.UserID, []*gomatrixserverlib.HeaderedEvent{ev})
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("internal.ApplyHistoryVisibilityFilter failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(visible) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You are not allowed to see this room"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: timestampToEventResp{
+				EventID:        ev.EventID(),
+				OriginServerTS: ev.OriginServerTS(),
+			},
+		}
+	}
+	return notFound
+}
+
+// fetchRemoteEvent asks a remote server for an event in the room, and checks
+// that the event is correctly signed.
+func fetchRemoteEvent(
+	ctx context.Context, fsAPI federationSenderAPI.FederationSenderInternalAPI, keyRing gomatrixserverlib.JSONVerifier,
+	serverName gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	txn, err := fsAPI.GetEvent(ctx, serverName, eventID)
+	if err != nil {
+		return nil, err
+	}
+	for _, pdu := range txn.PDUs {
+		ev, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, roomVersion)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.NewEventFromUntrustedJSON: %w", err)
+		}
+		if ev.EventID() != eventID || ev.RoomID() != roomID {
+			continue
+		}
+		if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, []*gomatrixserverlib.Event{ev}, keyRing); err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.VerifyAllEventSignatures: %w", err)
+		}
+		return ev.Headered(roomVersion), nil
+	}
+	return nil, fmt.Errorf("server didn't return event %s", eventID)
+}
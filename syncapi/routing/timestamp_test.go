@@ -0,0 +1,244 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// mustWriteTimestampRoom writes a room whose events were sent a second
+// apart, returning a roomserver API which knows about them.
+func mustWriteTimestampRoom(t *testing.T, db storage.Database) *contextRoomserverAPI {
+	t.Helper()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	emptyStateKey, alice := "", "@alice:localhost"
+	builders := []gomatrixserverlib.EventBuilder{
+		{Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyStateKey, Content: []byte(`{"creator":"@alice:localhost","room_version":"4"}`)},
+		{Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: []byte(`{"membership":"join"}`)},
+		{Sender: alice, Type: "m.room.message", Content: []byte(`{"body":"First"}`)},
+		{Sender: alice, Type: "m.room.message", Content: []byte(`{"body":"Second"}`)},
+	}
+	rsAPI := &contextRoomserverAPI{}
+	var prevEvents []string
+	for i := range builders {
+		b := builders[i]
+		b.RoomID = testRoomID
+		b.Depth = int64(i + 1)
+		b.PrevEvents = prevEvents
+		ev, err := b.Build(time.Unix(int64(i+1), 0), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		hev := ev.Headered(gomatrixserverlib.RoomVersionV4)
+		var addStateEvents []*gomatrixserverlib.HeaderedEvent
+		var addStateEventIDs []string
+		if hev.StateKey() != nil {
+			addStateEvents = append(addStateEvents, hev)
+			addStateEventIDs = append(addStateEventIDs, hev.EventID())
+		}
+		if _, err = db.WriteEvent(context.Background(), hev, addStateEvents, addStateEventIDs, nil, nil, false); err != nil {
+			t.Fatalf("failed to write event: %s", err)
+		}
+		prevEvents = []string{hev.EventID()}
+		rsAPI.events = append(rsAPI.events, hev)
+	}
+	return rsAPI
+}
+
+func TestTimestampToEvent(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	rsAPI := mustWriteTimestampRoom(t, db)
+	alice := "@alice:localhost"
+
+	cfg := &config.SyncAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	device := &userapi.Device{UserID: alice}
+	for _, tc := range []struct {
+		query     string
+		wantCode  int
+		wantEvent int
+	}{
+		// Between the first and second messages.
+		{"ts=3500&dir=b", http.StatusOK, 2},
+		{"ts=3500&dir=f", http.StatusOK, 3},
+		// Exactly on an event, in either direction.
+		{"ts=3000&dir=b", http.StatusOK, 2},
+		{"ts=3000&dir=f", http.StatusOK, 2},
+		// Before the room was created and after the last event.
+		{"ts=500&dir=f", http.StatusOK, 0},
+		{"ts=500&dir=b", http.StatusNotFound, 0},
+		{"ts=9000&dir=b", http.StatusOK, 3},
+		{"ts=9000&dir=f", http.StatusNotFound, 0},
+		// Invalid parameters.
+		{"ts=3500", http.StatusBadRequest, 0},
+		{"ts=soon&dir=f", http.StatusBadRequest, 0},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/timestamp_to_event?"+tc.query, nil)
+		res := OnIncomingTimestampToEventRequest(req, db, testRoomID, device, nil, nil, rsAPI, cfg)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.query, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		want := rsAPI.events[tc.wantEvent]
+		got := res.JSON.(timestampToEventResp)
+		if got.EventID != want.EventID() || got.OriginServerTS != want.OriginServerTS() {
+			t.Errorf("%s: got event %s at %d, want %s at %d", tc.query, got.EventID, got.OriginServerTS, want.EventID(), want.OriginServerTS())
+		}
+	}
+}
+
+// timestampRoomserverAPI is a roomserver API for a room which two other
+// servers are also joined to.
+type timestampRoomserverAPI struct {
+	*contextRoomserverAPI
+}
+
+func (r *timestampRoomserverAPI) QueryServerJoinedToRoom(ctx context.Context, req *api.QueryServerJoinedToRoomRequest, res *api.QueryServerJoinedToRoomResponse) error {
+	res.RoomExists = true
+	res.IsInRoom = true
+	res.ServerNames = []gomatrixserverlib.ServerName{"localhost", "broken", "remote"}
+	return nil
+}
+
+func (r *timestampRoomserverAPI) QueryRoomVersionForRoom(ctx context.Context, req *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse) error {
+	res.RoomVersion = gomatrixserverlib.RoomVersionV4
+	return nil
+}
+
+// timestampFederationAPI answers timestamp_to_event requests with the given
+// event for one server, and fails for all of the others.
+type timestampFederationAPI struct {
+	federationSenderAPI.FederationSenderInternalAPI
+	serverName  gomatrixserverlib.ServerName
+	event       *gomatrixserverlib.HeaderedEvent
+	hadDeadline bool
+}
+
+func (f *timestampFederationAPI) MSC3030TimestampToEvent(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, backwards bool) (res federationSenderAPI.MSC3030TimestampToEventResponse, err error) {
+	_, f.hadDeadline = ctx.Deadline()
+	if s != f.serverName {
+		return res, fmt.Errorf("server %s is down", s)
+	}
+	// The timestamp isn't signed, so a server could say anything.
+	return federationSenderAPI.MSC3030TimestampToEventResponse{
+		EventID:        f.event.EventID(),
+		OriginServerTS: f.event.OriginServerTS() + 1000,
+	}, nil
+}
+
+func (f *timestampFederationAPI) GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error) {
+	if s != f.serverName || eventID != f.event.EventID() {
+		return res, fmt.Errorf("unknown event %s", eventID)
+	}
+	res.PDUs = []json.RawMessage{f.event.JSON()}
+	return res, nil
+}
+
+// timestampKeyRing checks signatures against the given public keys.
+type timestampKeyRing struct {
+	keys map[gomatrixserverlib.ServerName]ed25519.PublicKey
+}
+
+func (k *timestampKeyRing) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		publicKey, ok := k.keys[req.ServerName]
+		if !ok {
+			results[i].Error = fmt.Errorf("unknown server %s", req.ServerName)
+			continue
+		}
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(req.ServerName), "ed25519:test", publicKey, req.Message)
+	}
+	return results, nil
+}
+
+func TestTimestampToEventFromFederation(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	rsAPI := &timestampRoomserverAPI{mustWriteTimestampRoom(t, db)}
+
+	// An event sent after all of ours, which only the remote server has.
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	last := rsAPI.events[len(rsAPI.events)-1]
+	b := gomatrixserverlib.EventBuilder{
+		Sender: "@remote:remote", RoomID: testRoomID, Type: "m.room.message",
+		Content: []byte(`{"body":"Remote"}`), Depth: last.Depth() + 1, PrevEvents: []string{last.EventID()},
+	}
+	ev, err := b.Build(time.Unix(10, 0), "remote", "ed25519:test", key, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	fsAPI := &timestampFederationAPI{serverName: "remote", event: ev.Headered(gomatrixserverlib.RoomVersionV4)}
+	keyRing := &timestampKeyRing{keys: map[gomatrixserverlib.ServerName]ed25519.PublicKey{
+		"remote": key.Public().(ed25519.PublicKey),
+	}}
+
+	cfg := &config.SyncAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	for _, tc := range []struct {
+		userID   string
+		wantCode int
+	}{
+		{"@alice:localhost", http.StatusOK},
+		// Carol has never been in the room, so mustn't find out about the event.
+		{"@carol:localhost", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/timestamp_to_event?ts=9000&dir=f", nil)
+		res := OnIncomingTimestampToEventRequest(req, db, testRoomID, &userapi.Device{UserID: tc.userID}, fsAPI, keyRing, rsAPI, cfg)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d, want %d: %+v", tc.userID, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if !fsAPI.hadDeadline {
+			t.Errorf("%s: asked the remote server without a deadline", tc.userID)
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		got := res.JSON.(timestampToEventResp)
+		if got.EventID != ev.EventID() || got.OriginServerTS != ev.OriginServerTS() {
+			t.Errorf("%s: got event %s at %d, want %s at %d", tc.userID, got.EventID, got.OriginServerTS, ev.EventID(), ev.OriginServerTS())
+		}
+	}
+
+	// Events which aren't signed by the server they came from are ignored.
+	forgerKey := ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), 1))
+	forged, err := b.Build(time.Unix(10, 0), "remote", "ed25519:test", forgerKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	fsAPI.event = forged.Headered(gomatrixserverlib.RoomVersionV4)
+	req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/timestamp_to_event?ts=9000&dir=f", nil)
+	res := OnIncomingTimestampToEventRequest(req, db, testRoomID, &userapi.Device{UserID: "@alice:localhost"}, fsAPI, keyRing, rsAPI, cfg)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("got HTTP %d for a forged event, want %d: %+v", res.Code, http.StatusNotFound, res.JSON)
+	}
+}
@@ -40,6 +40,23 @@ type Database interface {
 	// Returns an error if there was a problem talking with the database.
 	// Does not include any transaction IDs in the returned events.
 	Events(ctx context.Context, eventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error)
+	// EventsBySender returns all of the events sent by the given user, oldest first.
+	// Does not include any transaction IDs in the returned events.
+	EventsBySender(ctx context.Context, userID string) ([]*gomatrixserverlib.HeaderedEvent, error)
+	// LatestRelation returns the most recent event sent by the given sender which relates to the
+	// given event with the given relation type, or nil if there is no such event.
+	LatestRelation(ctx context.Context, roomID, eventID, relType, sender string) (*gomatrixserverlib.HeaderedEvent, error)
+	// RelationChildren returns the IDs of all of the events which relate to the given event with
+	// the given relation type, oldest first.
+	RelationChildren(ctx context.Context, roomID, eventID, relType string) ([]string, error)
+	// RelationsForEvent returns up to limit of the relations of the given event, skipping the first from of them,
+	// oldest first or newest first if backwards is true, including the relations of those events and so on up to
+	// maxDepth levels. Only relations with the given relation type and event type are returned, unless they are
+	// empty. Also returns the depth that was actually reached.
+	RelationsForEvent(ctx context.Context, roomID, eventID, relType, eventType string, maxDepth int, backwards bool, from, limit int) ([]types.Relation, int, error)
+	// EventNearestTimestamp returns the ID and timestamp of the event in the room closest to the given timestamp, at or
+	// before it if backwards is true and at or after it otherwise. Returns an empty event ID if there is no such event.
+	EventNearestTimestamp(ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, backwards bool) (string, gomatrixserverlib.Timestamp, error)
 	// WriteEvent into the database. It is not safe to call this function from multiple goroutines, as it would create races
 	// when generating the sync stream position for this event. Returns the sync stream position for the inserted event.
 	// Returns an error if there was a problem inserting this event.
@@ -100,6 +117,10 @@ type Database interface {
 	// SetTypingTimeoutCallback sets a callback function that is called right after
 	// a user is removed from the typing user list due to timeout.
 	SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn)
+	// SetQueryChunkSize sets the most rows that will be fetched by a single query
+	// when reading the state or timeline of a room, so that syncing huge rooms
+	// doesn't require huge queries.
+	SetQueryChunkSize(size int)
 	// AddTypingUser adds a typing user to the typing cache.
 	// Returns the newly calculated sync position for typing notifications.
 	AddTypingUser(userID, roomID string, expireTime *time.Time) types.StreamPosition
@@ -152,8 +173,22 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
+	// StorePresence stores the presence of a user
+	StorePresence(ctx context.Context, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	// GetPresence returns the presence of a user, or nil if we don't know it
+	GetPresence(ctx context.Context, userID string) (*eduAPI.OutputPresenceEvent, error)
+	// SharesRoomWith returns true if the two users are joined to at least one common room.
+	SharesRoomWith(ctx context.Context, userID, otherUserID string) (bool, error)
+	// JoinedUsersInRoom returns the IDs of the users who are joined to the room.
+	JoinedUsersInRoom(ctx context.Context, roomID string) ([]string, error)
+	// AddNotifications counts a notification in the room for each of the users, which is also
+	// counted as a highlight for the users that map to true.
+	AddNotifications(ctx context.Context, roomID string, highlights map[string]bool) error
 	// StoreReceipt stores new receipt events
 	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	// GetRoomReceipts gets all receipts for a given roomID
 	GetRoomReceipts(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) ([]eduAPI.OutputReceiptEvent, error)
+	// PurgeEventsBefore deletes the non-state events in a room that were sent before the given time, e.g. because
+	// they have expired according to the room's retention policy. Returns the number of events that were deleted.
+	PurgeEventsBefore(ctx context.Context, roomID string, before gomatrixserverlib.Timestamp) (int, error)
 }
@@ -84,11 +84,28 @@ const selectCurrentStateSQL = "" +
 	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
 	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
 	" AND ( $6::bool IS NULL   OR     contains_url = $6  )" +
-	" LIMIT $7"
+	" AND event_id > $7" +
+	" ORDER BY event_id ASC LIMIT $8"
 
 const selectJoinedUsersSQL = "" +
 	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'"
 
+const selectJoinedUsersInRoomSQL = "" +
+	"SELECT state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND room_id = $1 AND membership = 'join'"
+
+const selectUsersSharingRoomsSQL = "" +
+	"SELECT DISTINCT state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'" +
+	" AND room_id IN (" +
+	"  SELECT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = 'join'" +
+	" )"
+
+const selectMembershipCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_current_room_state WHERE type = 'm.room.member' AND room_id = $1 AND membership = $2"
+
+const selectMembersWithMembershipSQL = "" +
+	"SELECT state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND room_id = $1 AND membership = $2" +
+	" AND state_key != $3 ORDER BY state_key ASC LIMIT $4"
+
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
@@ -107,8 +124,12 @@ type currentRoomStateStatements struct {
 	selectRoomIDsWithMembershipStmt *sql.Stmt
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
+	selectJoinedUsersInRoomStmt     *sql.Stmt
+	selectUsersSharingRoomsStmt     *sql.Stmt
 	selectEventsWithEventIDsStmt    *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	selectMembershipCountStmt       *sql.Stmt
+	selectMembersWithMembershipStmt *sql.Stmt
 }
 
 func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
@@ -135,12 +156,24 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	if s.selectJoinedUsersStmt, err = db.Prepare(selectJoinedUsersSQL); err != nil {
 		return nil, err
 	}
+	if s.selectUsersSharingRoomsStmt, err = db.Prepare(selectUsersSharingRoomsSQL); err != nil {
+		return nil, err
+	}
 	if s.selectEventsWithEventIDsStmt, err = db.Prepare(selectEventsWithEventIDsSQL); err != nil {
 		return nil, err
 	}
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMembershipCountStmt, err = db.Prepare(selectMembershipCountSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMembersWithMembershipStmt, err = db.Prepare(selectMembersWithMembershipSQL); err != nil {
+		return nil, err
+	}
+	if s.selectJoinedUsersInRoomStmt, err = db.Prepare(selectJoinedUsersInRoomSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -168,6 +201,28 @@ func (s *currentRoomStateStatements) SelectJoinedUsers(
 	return result, rows.Err()
 }
 
+// SelectUsersSharingRooms returns the IDs of all of the users who are joined
+// to a room that the given user is also joined to, including the user.
+func (s *currentRoomStateStatements) SelectUsersSharingRooms(
+	ctx context.Context, txn *sql.Tx, userID string,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectUsersSharingRoomsStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUsersSharingRooms: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var sharedUserID string
+		if err := rows.Scan(&sharedUserID); err != nil {
+			return nil, err
+		}
+		result = append(result, sharedUserID)
+	}
+	return result, rows.Err()
+}
+
 // SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	ctx context.Context,
@@ -193,10 +248,63 @@ func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	return result, rows.Err()
 }
 
+// SelectMembershipCount returns the number of users in the given room with the given membership.
+func (s *currentRoomStateStatements) SelectMembershipCount(
+	ctx context.Context, txn *sql.Tx, roomID, membership string,
+) (count int, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipCountStmt)
+	err = stmt.QueryRowContext(ctx, roomID, membership).Scan(&count)
+	return
+}
+
+// SelectJoinedUsersInRoom returns the IDs of the users who are joined to the given room.
+func (s *currentRoomStateStatements) SelectJoinedUsersInRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectJoinedUsersInRoomStmt).QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectJoinedUsersInRoom: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		result = append(result, userID)
+	}
+	return result, rows.Err()
+}
+
+// SelectMembersWithMembership returns up to limit user IDs in the given room with the given
+// membership, excluding the given user, sorted by user ID.
+func (s *currentRoomStateStatements) SelectMembersWithMembership(
+	ctx context.Context, txn *sql.Tx, roomID, membership, excludeUserID string, limit int,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembersWithMembershipStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, membership, excludeUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMembersWithMembership: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		result = append(result, userID)
+	}
+	return result, rows.Err()
+}
+
 // SelectCurrentState returns all the current state events for the given room.
 func (s *currentRoomStateStatements) SelectCurrentState(
 	ctx context.Context, txn *sql.Tx, roomID string,
-	stateFilter *gomatrixserverlib.StateFilter,
+	stateFilter *gomatrixserverlib.StateFilter, afterEventID string,
 ) ([]*gomatrixserverlib.HeaderedEvent, error) {
 	stmt := sqlutil.TxStmt(txn, s.selectCurrentStateStmt)
 	rows, err := stmt.QueryContext(ctx, roomID,
@@ -205,6 +313,7 @@ func (s *currentRoomStateStatements) SelectCurrentState(
 		pq.StringArray(filterConvertTypeWildcardToSQL(stateFilter.Types)),
 		pq.StringArray(filterConvertTypeWildcardToSQL(stateFilter.NotTypes)),
 		stateFilter.ContainsURL,
+		afterEventID,
 		stateFilter.Limit,
 	)
 	if err != nil {
@@ -0,0 +1,49 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadEventTimestamps(m *sqlutil.Migrations) {
+	m.AddMigration(UpEventTimestamps, DownEventTimestamps)
+}
+
+// UpEventTimestamps fills in syncapi_event_timestamps for the events which
+// were stored before the table existed.
+func UpEventTimestamps(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		INSERT INTO syncapi_event_timestamps (event_id, room_id, origin_server_ts)
+		SELECT event_id, room_id, (headered_event_json::jsonb->>'origin_server_ts')::BIGINT
+		FROM syncapi_output_room_events
+		ON CONFLICT (event_id) DO NOTHING;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownEventTimestamps(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM syncapi_event_timestamps;")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
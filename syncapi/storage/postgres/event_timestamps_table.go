@@ -0,0 +1,151 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const eventTimestampsSchema = `
+-- Stores the origin_server_ts of each event, so that we can find the event
+-- nearest to a given point in time.
+CREATE TABLE IF NOT EXISTS syncapi_event_timestamps (
+	event_id TEXT NOT NULL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	origin_server_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_event_timestamps_room_ts_idx ON syncapi_event_timestamps(room_id, origin_server_ts);
+`
+
+const insertEventTimestampSQL = "" +
+	"INSERT INTO syncapi_event_timestamps (event_id, room_id, origin_server_ts)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const deleteEventTimestampsSQL = "" +
+	"DELETE FROM syncapi_event_timestamps WHERE event_id = ANY($1)"
+
+const selectEventBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_event_timestamps" +
+	" WHERE room_id = $1 AND origin_server_ts <= $2" +
+	" ORDER BY origin_server_ts DESC, event_id DESC LIMIT 1"
+
+const selectEventAfterTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_event_timestamps" +
+	" WHERE room_id = $1 AND origin_server_ts >= $2" +
+	" ORDER BY origin_server_ts ASC, event_id ASC LIMIT 1"
+
+// Events are returned in the order that they were sent, starting after the
+// given timestamp and event ID, so that events which aren't deleted can be
+// paginated past.
+const selectEventsBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_event_timestamps" +
+	" WHERE room_id = $1 AND origin_server_ts < $2" +
+	" AND (origin_server_ts > $3 OR (origin_server_ts = $3 AND event_id > $4))" +
+	" ORDER BY origin_server_ts ASC, event_id ASC LIMIT $5"
+
+type eventTimestampsStatements struct {
+	insertEventTimestampStmt        *sql.Stmt
+	deleteEventTimestampsStmt       *sql.Stmt
+	selectEventBeforeTimestampStmt  *sql.Stmt
+	selectEventAfterTimestampStmt   *sql.Stmt
+	selectEventsBeforeTimestampStmt *sql.Stmt
+}
+
+func NewPostgresEventTimestampsTable(db *sql.DB) (tables.EventTimestamps, error) {
+	_, err := db.Exec(eventTimestampsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &eventTimestampsStatements{}
+	if s.insertEventTimestampStmt, err = db.Prepare(insertEventTimestampSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertEventTimestamp statement: %w", err)
+	}
+	if s.deleteEventTimestampsStmt, err = db.Prepare(deleteEventTimestampsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteEventTimestamps statement: %w", err)
+	}
+	if s.selectEventBeforeTimestampStmt, err = db.Prepare(selectEventBeforeTimestampSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectEventBeforeTimestamp statement: %w", err)
+	}
+	if s.selectEventAfterTimestampStmt, err = db.Prepare(selectEventAfterTimestampSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectEventAfterTimestamp statement: %w", err)
+	}
+	if s.selectEventsBeforeTimestampStmt, err = db.Prepare(selectEventsBeforeTimestampSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectEventsBeforeTimestamp statement: %w", err)
+	}
+	return s, nil
+}
+
+// InsertEventTimestamp records the origin_server_ts of the event.
+func (s *eventTimestampsStatements) InsertEventTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID, eventID string, originServerTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertEventTimestampStmt).ExecContext(ctx, eventID, roomID, originServerTS)
+	return err
+}
+
+// DeleteEventTimestamps removes the timestamps of the given events.
+func (s *eventTimestampsStatements) DeleteEventTimestamps(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEventTimestampsStmt).ExecContext(ctx, pq.StringArray(eventIDs))
+	return err
+}
+
+// SelectEventNearestTimestamp returns the event in the room which is closest
+// to the given timestamp, looking backwards in time (at or before it) or
+// forwards (at or after it). Returns sql.ErrNoRows if there is no such event.
+func (s *eventTimestampsStatements) SelectEventNearestTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp, backwards bool,
+) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error) {
+	stmt := s.selectEventAfterTimestampStmt
+	if backwards {
+		stmt = s.selectEventBeforeTimestampStmt
+	}
+	err = sqlutil.TxStmt(txn, stmt).QueryRowContext(ctx, roomID, ts).Scan(&eventID, &originServerTS)
+	return
+}
+
+// SelectEventsBeforeTimestamp returns up to limit events in the room which
+// were sent before the given time, oldest first, starting after the given
+// event.
+func (s *eventTimestampsStatements) SelectEventsBeforeTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, before gomatrixserverlib.Timestamp, after tables.EventTimestamp, limit int,
+) ([]tables.EventTimestamp, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventsBeforeTimestampStmt).QueryContext(
+		ctx, roomID, before, after.OriginServerTS, after.EventID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsBeforeTimestamp: rows.close() failed")
+	var results []tables.EventTimestamp
+	for rows.Next() {
+		var result tables.EventTimestamp
+		if err = rows.Scan(&result.EventID, &result.OriginServerTS); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+const notificationCountsSchema = `
+-- Stores the number of events in each room which the user's push rules have
+-- notified them about, and how many of those were highlighted.
+CREATE TABLE IF NOT EXISTS syncapi_notification_counts (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	notification_count BIGINT NOT NULL DEFAULT 0,
+	highlight_count BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (user_id, room_id)
+);
+`
+
+const incrementNotificationCountSQL = "" +
+	"INSERT INTO syncapi_notification_counts (user_id, room_id, notification_count, highlight_count)" +
+	" VALUES ($1, $2, 1, $3)" +
+	" ON CONFLICT (user_id, room_id) DO UPDATE SET" +
+	" notification_count = syncapi_notification_counts.notification_count + 1," +
+	" highlight_count = syncapi_notification_counts.highlight_count + $3"
+
+const selectNotificationCountSQL = "" +
+	"SELECT notification_count, highlight_count FROM syncapi_notification_counts" +
+	" WHERE user_id = $1 AND room_id = $2"
+
+const deleteNotificationCountSQL = "" +
+	"DELETE FROM syncapi_notification_counts WHERE user_id = $1 AND room_id = $2"
+
+type notificationCountsStatements struct {
+	incrementNotificationCountStmt *sql.Stmt
+	selectNotificationCountStmt    *sql.Stmt
+	deleteNotificationCountStmt    *sql.Stmt
+}
+
+func NewPostgresNotificationCountsTable(db *sql.DB) (tables.NotificationCounts, error) {
+	_, err := db.Exec(notificationCountsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &notificationCountsStatements{}
+	if s.incrementNotificationCountStmt, err = db.Prepare(incrementNotificationCountSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare incrementNotificationCount statement: %w", err)
+	}
+	if s.selectNotificationCountStmt, err = db.Prepare(selectNotificationCountSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectNotificationCount statement: %w", err)
+	}
+	if s.deleteNotificationCountStmt, err = db.Prepare(deleteNotificationCountSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteNotificationCount statement: %w", err)
+	}
+	return s, nil
+}
+
+// IncrementNotificationCount counts another notification for the user in
+// the room, which is also counted as a highlight if highlight is set.
+func (s *notificationCountsStatements) IncrementNotificationCount(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, highlight bool,
+) error {
+	highlights := 0
+	if highlight {
+		highlights = 1
+	}
+	_, err := sqlutil.TxStmt(txn, s.incrementNotificationCountStmt).ExecContext(ctx, userID, roomID, highlights)
+	return err
+}
+
+// SelectNotificationCount returns the number of notifications and highlights
+// for the user in the room, which are both zero if there are none.
+func (s *notificationCountsStatements) SelectNotificationCount(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) (notifications, highlights int, err error) {
+	err = sqlutil.TxStmt(txn, s.selectNotificationCountStmt).QueryRowContext(ctx, userID, roomID).Scan(&notifications, &highlights)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return
+}
+
+// DeleteNotificationCount resets the number of notifications and highlights
+// for the user in the room to zero.
+func (s *notificationCountsStatements) DeleteNotificationCount(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteNotificationCountStmt).ExecContext(ctx, userID, roomID)
+	return err
+}
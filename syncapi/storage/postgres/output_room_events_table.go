@@ -96,6 +96,11 @@ const selectEarlyEventsSQL = "" +
 	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
 	" ORDER BY id ASC LIMIT $4"
 
+const selectEventsBySenderSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
+	" WHERE sender = $1" +
+	" ORDER BY id ASC"
+
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
@@ -118,6 +123,9 @@ const selectStateInRangeSQL = "" +
 const deleteEventsForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = ANY($1)"
+
 type outputRoomEventsStatements struct {
 	insertEventStmt               *sql.Stmt
 	selectEventsStmt              *sql.Stmt
@@ -125,9 +133,11 @@ type outputRoomEventsStatements struct {
 	selectRecentEventsStmt        *sql.Stmt
 	selectRecentEventsForSyncStmt *sql.Stmt
 	selectEarlyEventsStmt         *sql.Stmt
+	selectEventsBySenderStmt      *sql.Stmt
 	selectStateInRangeStmt        *sql.Stmt
 	updateEventJSONStmt           *sql.Stmt
 	deleteEventsForRoomStmt       *sql.Stmt
+	deleteEventsStmt              *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -154,6 +164,9 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 	if s.selectEarlyEventsStmt, err = db.Prepare(selectEarlyEventsSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventsBySenderStmt, err = db.Prepare(selectEventsBySenderSQL); err != nil {
+		return nil, err
+	}
 	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
 		return nil, err
 	}
@@ -163,6 +176,9 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 	if s.deleteEventsForRoomStmt, err = db.Prepare(deleteEventsForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteEventsStmt, err = db.Prepare(deleteEventsSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -402,6 +418,20 @@ func (s *outputRoomEventsStatements) SelectEvents(
 	return rowsToStreamEvents(rows)
 }
 
+// SelectEventsBySender returns all of the events sent by the given user, in
+// the order that they were received.
+func (s *outputRoomEventsStatements) SelectEventsBySender(
+	ctx context.Context, txn *sql.Tx, sender string,
+) ([]types.StreamEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventsBySenderStmt)
+	rows, err := stmt.QueryContext(ctx, sender)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsBySender: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
 func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (err error) {
@@ -409,6 +439,13 @@ func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	return err
 }
 
+func (s *outputRoomEventsStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteEventsStmt).ExecContext(ctx, pq.StringArray(eventIDs))
+	return err
+}
+
 func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 	var result []types.StreamEvent
 	for rows.Next() {
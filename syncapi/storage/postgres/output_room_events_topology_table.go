@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
@@ -75,6 +76,9 @@ const selectMaxPositionInTopologySQL = "" +
 const deleteTopologyForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
+const deleteTopologyForEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE event_id = ANY($1)"
+
 type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt       *sql.Stmt
 	selectEventIDsInRangeASCStmt    *sql.Stmt
@@ -82,6 +86,7 @@ type outputRoomEventsTopologyStatements struct {
 	selectPositionInTopologyStmt    *sql.Stmt
 	selectMaxPositionInTopologyStmt *sql.Stmt
 	deleteTopologyForRoomStmt       *sql.Stmt
+	deleteTopologyForEventsStmt     *sql.Stmt
 }
 
 func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -108,6 +113,9 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.deleteTopologyForRoomStmt, err = db.Prepare(deleteTopologyForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteTopologyForEventsStmt, err = db.Prepare(deleteTopologyForEventsSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -182,3 +190,10 @@ func (s *outputRoomEventsTopologyStatements) DeleteTopologyForRoom(
 	_, err = sqlutil.TxStmt(txn, s.deleteTopologyForRoomStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) DeleteTopologyForEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteTopologyForEventsStmt).ExecContext(ctx, pq.StringArray(eventIDs))
+	return err
+}
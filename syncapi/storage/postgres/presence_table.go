@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const presenceSchema = `
+CREATE SEQUENCE IF NOT EXISTS syncapi_presence_id;
+
+-- Stores the latest presence of each user
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+	-- The stream position of the latest presence update for this user
+	id BIGINT NOT NULL DEFAULT nextval('syncapi_presence_id'),
+	user_id TEXT NOT NULL PRIMARY KEY,
+	presence TEXT NOT NULL,
+	status_msg TEXT,
+	last_active_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_presence_id_idx ON syncapi_presence(id);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence" +
+	" (user_id, presence, status_msg, last_active_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (user_id)" +
+	" DO UPDATE SET id = nextval('syncapi_presence_id'), presence = $2, status_msg = $3, last_active_ts = $4" +
+	" RETURNING id"
+
+const selectPresenceForUserSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts FROM syncapi_presence" +
+	" WHERE user_id = $1"
+
+const selectPresenceAfterSQL = "" +
+	"SELECT id, user_id, presence, status_msg, last_active_ts FROM syncapi_presence" +
+	" WHERE id > $1 AND id <= $2 ORDER BY id ASC"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_presence"
+
+type presenceStatements struct {
+	upsertPresenceStmt        *sql.Stmt
+	selectPresenceForUserStmt *sql.Stmt
+	selectPresenceAfterStmt   *sql.Stmt
+	selectMaxPresenceIDStmt   *sql.Stmt
+}
+
+func NewPostgresPresenceTable(db *sql.DB) (tables.Presence, error) {
+	_, err := db.Exec(presenceSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &presenceStatements{}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertPresence statement: %w", err)
+	}
+	if s.selectPresenceForUserStmt, err = db.Prepare(selectPresenceForUserSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPresenceForUser statement: %w", err)
+	}
+	if s.selectPresenceAfterStmt, err = db.Prepare(selectPresenceAfterSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPresenceAfter statement: %w", err)
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxPresenceID statement: %w", err)
+	}
+	return s, nil
+}
+
+// UpsertPresence updates the presence of a user and returns the new stream position.
+func (s *presenceStatements) UpsertPresence(
+	ctx context.Context, txn *sql.Tx, userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertPresenceStmt)
+	err = stmt.QueryRowContext(ctx, userID, presence, statusMsg, lastActiveTS).Scan(&pos)
+	return
+}
+
+// SelectPresenceForUser returns the presence of a user, or nil if there is none.
+func (s *presenceStatements) SelectPresenceForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (*api.OutputPresenceEvent, error) {
+	var presence api.OutputPresenceEvent
+	stmt := sqlutil.TxStmt(txn, s.selectPresenceForUserStmt)
+	err := stmt.QueryRowContext(ctx, userID).Scan(
+		&presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &presence, nil
+}
+
+// SelectPresenceAfter returns the presence of all users which has changed after the
+// given stream position and up to the given upper bound, along with the latest
+// stream position.
+func (s *presenceStatements) SelectPresenceAfter(
+	ctx context.Context, txn *sql.Tx, streamPos, to types.StreamPosition,
+) (types.StreamPosition, []api.OutputPresenceEvent, error) {
+	lastPos := streamPos
+	stmt := sqlutil.TxStmt(txn, s.selectPresenceAfterStmt)
+	rows, err := stmt.QueryContext(ctx, streamPos, to)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to query presence: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPresenceAfter: rows.close() failed")
+	var res []api.OutputPresenceEvent
+	for rows.Next() {
+		var presence api.OutputPresenceEvent
+		var id types.StreamPosition
+		if err = rows.Scan(&id, &presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS); err != nil {
+			return 0, res, fmt.Errorf("unable to scan row to api.OutputPresenceEvent: %w", err)
+		}
+		res = append(res, presence)
+		if id > lastPos {
+			lastPos = id
+		}
+	}
+	return lastPos, res, rows.Err()
+}
+
+func (s *presenceStatements) SelectMaxPresenceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxPresenceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -88,8 +88,25 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if err != nil {
 		return nil, err
 	}
+	presence, err := NewPostgresPresenceTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	relations, err := NewPostgresRelationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	eventTimestamps, err := NewPostgresEventTimestampsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	notificationCounts, err := NewPostgresNotificationCountsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
+	deltas.LoadEventTimestamps(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -106,6 +123,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
+		Presence:            presence,
+		Relations:           relations,
+		EventTimestamps:     eventTimestamps,
+		NotificationCounts:  notificationCounts,
 		EDUCache:            cache.New(),
 	}
 	return &d, nil
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
@@ -33,6 +34,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -50,7 +52,14 @@ type Database struct {
 	SendToDevice        tables.SendToDevice
 	Filter              tables.Filter
 	Receipts            tables.Receipts
+	Presence            tables.Presence
+	Relations           tables.Relations
+	EventTimestamps     tables.EventTimestamps
+	NotificationCounts  tables.NotificationCounts
 	EDUCache            *cache.EDUCache
+	// queryChunkSize is the most rows that we will fetch at once when
+	// reading the state or timeline of a room. 0 means no limit.
+	queryChunkSize int
 }
 
 // Events lookups a list of event by their event ID.
@@ -69,6 +78,85 @@ func (d *Database) Events(ctx context.Context, eventIDs []string) ([]*gomatrixse
 	return d.StreamEventsToEvents(nil, streamEvents), nil
 }
 
+// EventsBySender returns all of the events sent by the given user, oldest first.
+func (d *Database) EventsBySender(ctx context.Context, userID string) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	streamEvents, err := d.OutputEvents.SelectEventsBySender(ctx, nil, userID)
+	if err != nil {
+		return nil, err
+	}
+	return d.StreamEventsToEvents(nil, streamEvents), nil
+}
+
+// LatestRelation returns the most recent event sent by the given sender which
+// relates to the given event with the given relation type, or nil if there is
+// no such event.
+func (d *Database) LatestRelation(
+	ctx context.Context, roomID, eventID, relType, sender string,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	childEventID, err := d.Relations.SelectLatestRelation(ctx, nil, roomID, eventID, relType, sender)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	events, err := d.Events(ctx, []string{childEventID})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+// RelationChildren returns the IDs of all of the events which relate to the
+// given event with the given relation type, oldest first.
+func (d *Database) RelationChildren(
+	ctx context.Context, roomID, eventID, relType string,
+) ([]string, error) {
+	return d.Relations.SelectRelationChildren(ctx, nil, roomID, eventID, relType)
+}
+
+// RelationsForEvent returns up to limit of the relations of the given event,
+// skipping the first from of them, oldest first or newest first if backwards
+// is true. If maxDepth is more than 1 then the relations of those events are
+// included too, and so on up to maxDepth levels, e.g. the reactions to the
+// replies in a thread. Relations are followed whatever their type, but only
+// those with the given relation type and child event type are returned,
+// unless these are empty. The depth that was actually reached is also
+// returned, which is always at least 1.
+func (d *Database) RelationsForEvent(
+	ctx context.Context, roomID, eventID, relType, eventType string,
+	maxDepth int, backwards bool, from, limit int,
+) ([]types.Relation, int, error) {
+	relations, err := d.Relations.SelectRelations(ctx, nil, roomID, eventID, relType, eventType, maxDepth, backwards, from, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("d.Relations.SelectRelations: %w", err)
+	}
+	depth := 1
+	if maxDepth > 1 {
+		if depth, err = d.Relations.SelectRelationsDepth(ctx, nil, roomID, eventID, maxDepth); err != nil {
+			return nil, 0, fmt.Errorf("d.Relations.SelectRelationsDepth: %w", err)
+		}
+	}
+	return relations, depth, nil
+}
+
+// EventNearestTimestamp returns the ID and origin_server_ts of the event in
+// the room which is closest to the given timestamp, either at or before it
+// if backwards is true, or at or after it otherwise. Returns an empty event
+// ID if there is no such event.
+func (d *Database) EventNearestTimestamp(
+	ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, backwards bool,
+) (string, gomatrixserverlib.Timestamp, error) {
+	eventID, originServerTS, err := d.EventTimestamps.SelectEventNearestTimestamp(ctx, nil, roomID, ts, backwards)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("d.EventTimestamps.SelectEventNearestTimestamp: %w", err)
+	}
+	return eventID, originServerTS, nil
+}
+
 // GetEventsInStreamingRange retrieves all of the events on a given ordering using the
 // given extremities and limit.
 func (d *Database) GetEventsInStreamingRange(
@@ -128,6 +216,12 @@ func (d *Database) AllPeekingDevicesInRooms(ctx context.Context) (map[string][]t
 	return d.Peeks.SelectPeekingDevices(ctx)
 }
 
+// SetQueryChunkSize sets the most rows that will be fetched by a single query
+// when reading the state or timeline of a room.
+func (d *Database) SetQueryChunkSize(size int) {
+	d.queryChunkSize = size
+}
+
 func (d *Database) GetStateEvent(
 	ctx context.Context, roomID, evType, stateKey string,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
@@ -137,7 +231,7 @@ func (d *Database) GetStateEvent(
 func (d *Database) GetStateEventsForRoom(
 	ctx context.Context, roomID string, stateFilter *gomatrixserverlib.StateFilter,
 ) (stateEvents []*gomatrixserverlib.HeaderedEvent, err error) {
-	stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, nil, roomID, stateFilter)
+	stateEvents, err = d.selectCurrentState(ctx, nil, roomID, stateFilter)
 	return
 }
 
@@ -335,6 +429,14 @@ func (d *Database) WriteEvent(
 			return fmt.Errorf("d.handleBackwardExtremities: %w", err)
 		}
 
+		if err = d.insertRelation(ctx, txn, ev); err != nil {
+			return fmt.Errorf("d.insertRelation: %w", err)
+		}
+
+		if err = d.EventTimestamps.InsertEventTimestamp(ctx, txn, ev.RoomID(), ev.EventID(), ev.OriginServerTS()); err != nil {
+			return fmt.Errorf("d.EventTimestamps.InsertEventTimestamp: %w", err)
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -346,6 +448,20 @@ func (d *Database) WriteEvent(
 	return pduPosition, returnErr
 }
 
+// insertRelation records the relation described by the m.relates_to of the
+// event's content, if there is one.
+// This function should always be called within a sqlutil.Writer for safety in SQLite.
+func (d *Database) insertRelation(ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.HeaderedEvent) error {
+	relatesTo := gjson.GetBytes(ev.Content(), "m\\.relates_to")
+	relType, eventID := relatesTo.Get("rel_type").Str, relatesTo.Get("event_id").Str
+	if relType == "" || eventID == "" {
+		return nil
+	}
+	return d.Relations.InsertRelation(
+		ctx, txn, ev.RoomID(), eventID, ev.EventID(), ev.Type(), relType, ev.Sender(), ev.OriginServerTS(),
+	)
+}
+
 // This function should always be called within a sqlutil.Writer for safety in SQLite.
 func (d *Database) updateRoomState(
 	ctx context.Context, txn *sql.Tx,
@@ -466,9 +582,6 @@ func (d *Database) syncPositionTx(
 	if err != nil {
 		return sp, err
 	}
-	if maxAccountDataID > maxEventID {
-		maxEventID = maxAccountDataID
-	}
 	maxInviteID, err := d.Invites.SelectMaxInviteID(ctx, txn)
 	if err != nil {
 		return sp, err
@@ -487,12 +600,18 @@ func (d *Database) syncPositionTx(
 	if err != nil {
 		return sp, err
 	}
+	maxPresenceID, err := d.Presence.SelectMaxPresenceID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
 	// TODO: complete these positions
 	sp = types.StreamingToken{
-		PDUPosition:     types.StreamPosition(maxEventID),
-		TypingPosition:  types.StreamPosition(d.EDUCache.GetLatestSyncPosition()),
-		ReceiptPosition: types.StreamPosition(maxReceiptID),
-		InvitePosition:  types.StreamPosition(maxInviteID),
+		PDUPosition:         types.StreamPosition(maxEventID),
+		TypingPosition:      types.StreamPosition(d.EDUCache.GetLatestSyncPosition()),
+		ReceiptPosition:     types.StreamPosition(maxReceiptID),
+		InvitePosition:      types.StreamPosition(maxInviteID),
+		PresencePosition:    types.StreamPosition(maxPresenceID),
+		AccountDataPosition: types.StreamPosition(maxAccountDataID),
 	}
 	return
 }
@@ -584,9 +703,11 @@ func (d *Database) addTypingDeltaToResponse(
 }
 
 // addReceiptDeltaToResponse adds all receipt information to a sync response
-// since the specified position
+// since the specified position. Private read receipts are only included if
+// they were sent by the given user.
 func (d *Database) addReceiptDeltaToResponse(
 	since types.StreamingToken,
+	userID string,
 	joinedRoomIDs []string,
 	res *types.Response,
 ) error {
@@ -598,6 +719,9 @@ func (d *Database) addReceiptDeltaToResponse(
 	// Group receipts by room, so we can create one ClientEvent for every room
 	receiptsByRoom := make(map[string][]eduAPI.OutputReceiptEvent)
 	for _, receipt := range receipts {
+		if receipt.Type == eduAPI.ReceiptTypeReadPrivate && receipt.UserID != userID {
+			continue
+		}
 		receiptsByRoom[receipt.RoomID] = append(receiptsByRoom[receipt.RoomID], receipt)
 	}
 
@@ -615,22 +739,35 @@ func (d *Database) addReceiptDeltaToResponse(
 			Type:   gomatrixserverlib.MReceipt,
 			RoomID: roomID,
 		}
-		content := make(map[string]eduAPI.ReceiptMRead)
+		// event ID -> receipt type -> user ID -> timestamp
+		content := make(map[string]map[string]map[string]eduAPI.ReceiptTS)
+		sentReceipt := false
 		for _, receipt := range receipts {
-			var read eduAPI.ReceiptMRead
-			if read, ok = content[receipt.EventID]; !ok {
-				read = eduAPI.ReceiptMRead{
-					User: make(map[string]eduAPI.ReceiptTS),
-				}
+			if receipt.UserID == userID {
+				sentReceipt = true
+			}
+			if _, ok = content[receipt.EventID]; !ok {
+				content[receipt.EventID] = make(map[string]map[string]eduAPI.ReceiptTS)
+			}
+			if _, ok = content[receipt.EventID][receipt.Type]; !ok {
+				content[receipt.EventID][receipt.Type] = make(map[string]eduAPI.ReceiptTS)
 			}
-			read.User[receipt.UserID] = eduAPI.ReceiptTS{TS: receipt.Timestamp}
-			content[receipt.EventID] = read
+			content[receipt.EventID][receipt.Type][receipt.UserID] = eduAPI.ReceiptTS{TS: receipt.Timestamp}
 		}
 		ev.Content, err = json.Marshal(content)
 		if err != nil {
 			return err
 		}
 
+		// The user's own receipts change their notification counts, so
+		// include those even if nothing else has happened in the room.
+		if jr.UnreadNotifications == nil && sentReceipt {
+			jr.UnreadNotifications, err = d.getUnreadNotifications(context.TODO(), nil, roomID, userID)
+			if err != nil {
+				return err
+			}
+		}
+
 		jr.Ephemeral.Events = append(jr.Ephemeral.Events, ev)
 		res.Rooms.Join[roomID] = jr
 	}
@@ -639,10 +776,45 @@ func (d *Database) addReceiptDeltaToResponse(
 	return nil
 }
 
+// addPresenceDeltaToResponse adds the presence of the users whose presence
+// has changed between the specified positions to a sync response, as long
+// as they share a room with the syncing user or are the syncing user.
+func (d *Database) addPresenceDeltaToResponse(
+	since, to types.StreamingToken,
+	userID string,
+	res *types.Response,
+) error {
+	_, presences, err := d.Presence.SelectPresenceAfter(context.TODO(), nil, since.PresencePosition, to.PresencePosition)
+	if err != nil {
+		return fmt.Errorf("unable to select presence: %w", err)
+	}
+	sharedUserIDs, err := d.CurrentRoomState.SelectUsersSharingRooms(context.TODO(), nil, userID)
+	if err != nil {
+		return fmt.Errorf("unable to select users sharing rooms: %w", err)
+	}
+	shared := map[string]bool{userID: true}
+	for _, sharedUserID := range sharedUserIDs {
+		shared[sharedUserID] = true
+	}
+	for i := range presences {
+		if !shared[presences[i].UserID] {
+			continue
+		}
+		var ev gomatrixserverlib.ClientEvent
+		if ev, err = types.NewPresenceClientEvent(&presences[i], time.Now()); err != nil {
+			return err
+		}
+		res.Presence.Events = append(res.Presence.Events, ev)
+	}
+	res.NextBatch.PresencePosition = to.PresencePosition
+	return nil
+}
+
 // addEDUDeltaToResponse adds updates for EDUs of each type since fromPos if
 // the positions of that type are not equal in fromPos and toPos.
 func (d *Database) addEDUDeltaToResponse(
 	fromPos, toPos types.StreamingToken,
+	userID string,
 	joinedRoomIDs []string,
 	res *types.Response,
 ) error {
@@ -656,11 +828,17 @@ func (d *Database) addEDUDeltaToResponse(
 	// Check on initial sync and if EDUPositions differ
 	if (fromPos.ReceiptPosition == 0 && toPos.ReceiptPosition == 0) ||
 		fromPos.ReceiptPosition != toPos.ReceiptPosition {
-		if err := d.addReceiptDeltaToResponse(fromPos, joinedRoomIDs, res); err != nil {
+		if err := d.addReceiptDeltaToResponse(fromPos, userID, joinedRoomIDs, res); err != nil {
 			return fmt.Errorf("unable to apply receipts to response: %w", err)
 		}
 	}
 
+	if fromPos.PresencePosition != toPos.PresencePosition {
+		if err := d.addPresenceDeltaToResponse(fromPos, toPos, userID, res); err != nil {
+			return fmt.Errorf("unable to apply presence to response: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -716,7 +894,7 @@ func (d *Database) IncrementalSync(
 	// TODO: handle EDUs in peeked rooms
 
 	err = d.addEDUDeltaToResponse(
-		fromPos, toPos, joinedRoomIDs, res,
+		fromPos, toPos, device.UserID, joinedRoomIDs, res,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("d.addEDUDeltaToResponse: %w", err)
@@ -751,6 +929,11 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 
 	newEvent := ev.Headered(redactedBecause.RoomVersion)
 	err = d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		// A redacted event no longer relates to anything, since its
+		// m.relates_to has been stripped from the content.
+		if err = d.Relations.DeleteRelation(ctx, txn, redactedEventID); err != nil {
+			return fmt.Errorf("d.Relations.DeleteRelation: %w", err)
+		}
 		return d.OutputEvents.UpdateEventJSON(ctx, newEvent)
 	})
 	return err
@@ -849,7 +1032,7 @@ func (d *Database) getJoinResponseForCompleteSync(
 	numRecentEventsPerRoom int, device userapi.Device,
 ) (jr *types.JoinResponse, err error) {
 	var stateEvents []*gomatrixserverlib.HeaderedEvent
-	stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter)
+	stateEvents, err = d.selectCurrentState(ctx, txn, roomID, stateFilter)
 	if err != nil {
 		return
 	}
@@ -857,7 +1040,7 @@ func (d *Database) getJoinResponseForCompleteSync(
 	//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
 	var recentStreamEvents []types.StreamEvent
 	var limited bool
-	recentStreamEvents, limited, err = d.OutputEvents.SelectRecentEvents(
+	recentStreamEvents, limited, err = d.selectRecentEvents(
 		ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
 	)
 	if err != nil {
@@ -893,18 +1076,9 @@ func (d *Database) getJoinResponseForCompleteSync(
 
 	// Retrieve the backward topology position, i.e. the position of the
 	// oldest event in the room's topology.
-	var prevBatch *types.TopologyToken
-	if len(recentStreamEvents) > 0 {
-		var backwardTopologyPos, backwardStreamPos types.StreamPosition
-		backwardTopologyPos, backwardStreamPos, err = d.Topology.SelectPositionInTopology(ctx, txn, recentStreamEvents[0].EventID())
-		if err != nil {
-			return
-		}
-		prevBatch = &types.TopologyToken{
-			Depth:       backwardTopologyPos,
-			PDUPosition: backwardStreamPos,
-		}
-		prevBatch.Decrement()
+	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, roomID, recentStreamEvents)
+	if err != nil {
+		return
 	}
 
 	// We don't include a device here as we don't need to send down
@@ -913,10 +1087,20 @@ func (d *Database) getJoinResponseForCompleteSync(
 	recentEvents := d.StreamEventsToEvents(&device, recentStreamEvents)
 	stateEvents = removeDuplicates(stateEvents, recentEvents)
 	jr = types.NewJoinResponse()
-	jr.Timeline.PrevBatch = prevBatch
+	jr.Summary, err = d.getRoomSummary(ctx, txn, roomID, device.UserID)
+	if err != nil {
+		return
+	}
+	jr.UnreadNotifications, err = d.getUnreadNotifications(ctx, txn, roomID, device.UserID)
+	if err != nil {
+		return
+	}
+	jr.Timeline.PrevBatch = &prevBatch
 	jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+	jr.Timeline.PDUs = recentEvents
 	jr.Timeline.Limited = limited
 	jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
+	jr.State.PDUs = stateEvents
 	return jr, nil
 }
 
@@ -935,7 +1119,7 @@ func (d *Database) CompleteSync(
 
 	// Use a zero value SyncPosition for fromPos so all EDU states are added.
 	err = d.addEDUDeltaToResponse(
-		types.StreamingToken{}, toPos, joinedRoomIDs, res,
+		types.StreamingToken{}, toPos, device.UserID, joinedRoomIDs, res,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("d.addEDUDeltaToResponse: %w", err)
@@ -979,15 +1163,22 @@ func (d *Database) addInvitesToResponse(
 	return nil
 }
 
-// Retrieve the backward topology position, i.e. the position of the
-// oldest event in the room's topology.
+// Retrieve the backward topology position, i.e. the position just before
+// the oldest event in the timeline, so that clients can use it as a
+// prev_batch token to backfill any gap. If there are no events in the
+// timeline then the position of the latest event in the room is returned
+// instead, since everything up to and including it is before the timeline.
 func (d *Database) getBackwardTopologyPos(
 	ctx context.Context, txn *sql.Tx,
-	events []types.StreamEvent,
+	roomID string, events []types.StreamEvent,
 ) (types.TopologyToken, error) {
 	zeroToken := types.TopologyToken{}
 	if len(events) == 0 {
-		return zeroToken, nil
+		depth, spos, err := d.Topology.SelectMaxPositionInTopology(ctx, txn, roomID)
+		if err != nil {
+			return zeroToken, err
+		}
+		return types.TopologyToken{Depth: depth, PDUPosition: spos}, nil
 	}
 	pos, spos, err := d.Topology.SelectPositionInTopology(ctx, txn, events[0].EventID())
 	if err != nil {
@@ -1017,7 +1208,7 @@ func (d *Database) addRoomDeltaToResponse(
 		// This is all "okay" assuming history_visibility == "shared" which it is by default.
 		r.To = delta.membershipPos
 	}
-	recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
+	recentStreamEvents, limited, err := d.selectRecentEvents(
 		ctx, txn, delta.roomID, r,
 		numRecentEventsPerRoom, true, true,
 	)
@@ -1026,10 +1217,6 @@ func (d *Database) addRoomDeltaToResponse(
 	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
 	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
-	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
-	if err != nil {
-		return err
-	}
 
 	// XXX: should we ever get this far if we have no recent events or state in this room?
 	// in practice we do for peeks, but possibly not joins?
@@ -1037,22 +1224,40 @@ func (d *Database) addRoomDeltaToResponse(
 		return nil
 	}
 
+	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, delta.roomID, recentStreamEvents)
+	if err != nil {
+		return err
+	}
+
 	switch delta.membership {
 	case gomatrixserverlib.Join:
 		jr := types.NewJoinResponse()
+		if jr.Summary, err = d.getRoomSummary(ctx, txn, delta.roomID, device.UserID); err != nil {
+			return err
+		}
+		if jr.UnreadNotifications, err = d.getUnreadNotifications(ctx, txn, delta.roomID, device.UserID); err != nil {
+			return err
+		}
 
 		jr.Timeline.PrevBatch = &prevBatch
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+		jr.Timeline.PDUs = recentEvents
 		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
+		jr.State.PDUs = delta.stateEvents
 		res.Rooms.Join[delta.roomID] = *jr
 	case gomatrixserverlib.Peek:
 		jr := types.NewJoinResponse()
+		if jr.Summary, err = d.getRoomSummary(ctx, txn, delta.roomID, device.UserID); err != nil {
+			return err
+		}
 
 		jr.Timeline.PrevBatch = &prevBatch
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+		jr.Timeline.PDUs = recentEvents
 		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
+		jr.State.PDUs = delta.stateEvents
 		res.Rooms.Peek[delta.roomID] = *jr
 	case gomatrixserverlib.Leave:
 		fallthrough // transitions to leave are the same as ban
@@ -1062,14 +1267,58 @@ func (d *Database) addRoomDeltaToResponse(
 		lr := types.NewLeaveResponse()
 		lr.Timeline.PrevBatch = &prevBatch
 		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		lr.Timeline.PDUs = recentEvents
+		lr.Timeline.Limited = limited
 		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
+		lr.State.PDUs = delta.stateEvents
 		res.Rooms.Leave[delta.roomID] = *lr
 	}
 
 	return nil
 }
 
+// maxRoomSummaryHeroes is the maximum number of heroes to include in a room summary.
+const maxRoomSummaryHeroes = 5
+
+// getRoomSummary returns the room summary for the given room from the point of view of
+// the given user. Heroes are chosen from the joined and then the invited members of the
+// room, or from the members who have left if there are none, sorted by user ID so that
+// the same heroes are chosen each time.
+func (d *Database) getRoomSummary(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) (*types.Summary, error) {
+	joinedCount, err := d.CurrentRoomState.SelectMembershipCount(ctx, txn, roomID, gomatrixserverlib.Join)
+	if err != nil {
+		return nil, fmt.Errorf("d.CurrentRoomState.SelectMembershipCount: %w", err)
+	}
+	invitedCount, err := d.CurrentRoomState.SelectMembershipCount(ctx, txn, roomID, gomatrixserverlib.Invite)
+	if err != nil {
+		return nil, fmt.Errorf("d.CurrentRoomState.SelectMembershipCount: %w", err)
+	}
+	summary := &types.Summary{
+		Heroes:             []string{},
+		JoinedMemberCount:  &joinedCount,
+		InvitedMemberCount: &invitedCount,
+	}
+	for _, membership := range []string{gomatrixserverlib.Join, gomatrixserverlib.Invite, gomatrixserverlib.Leave} {
+		if membership == gomatrixserverlib.Leave && len(summary.Heroes) > 0 {
+			// only fall back to members who have left if there is nobody else
+			break
+		}
+		remaining := maxRoomSummaryHeroes - len(summary.Heroes)
+		if remaining <= 0 {
+			break
+		}
+		var heroes []string
+		heroes, err = d.CurrentRoomState.SelectMembersWithMembership(ctx, txn, roomID, membership, userID, remaining)
+		if err != nil {
+			return nil, fmt.Errorf("d.CurrentRoomState.SelectMembersWithMembership: %w", err)
+		}
+		summary.Heroes = append(summary.Heroes, heroes...)
+	}
+	return summary, nil
+}
+
 // fetchStateEvents converts the set of event IDs into a set of events. It will fetch any which are missing from the database.
 // Returns a map of room ID to list of events.
 func (d *Database) fetchStateEvents(
@@ -1239,6 +1488,14 @@ func (d *Database) getStateDeltas(
 					continue // we'll add this room in when we do joined rooms
 				}
 
+				if membership == gomatrixserverlib.Leave || membership == gomatrixserverlib.Ban {
+					stateStreamEvents, err = d.stateStreamEventsAtDeparture(
+						ctx, txn, roomID, r, ev.StreamPosition, stateStreamEvents, stateFilter,
+					)
+					if err != nil {
+						return nil, nil, err
+					}
+				}
 				deltas = append(deltas, stateDelta{
 					membership:    membership,
 					membershipPos: ev.StreamPosition,
@@ -1313,6 +1570,14 @@ func (d *Database) getStateDeltasForFullStateSync(
 		for _, ev := range stateStreamEvents {
 			if membership := getMembershipFromEvent(ev.Event, userID); membership != "" {
 				if membership != gomatrixserverlib.Join { // We've already added full state for all joined rooms above.
+					if membership == gomatrixserverlib.Leave || membership == gomatrixserverlib.Ban {
+						stateStreamEvents, err = d.stateStreamEventsAtDeparture(
+							ctx, txn, roomID, r, ev.StreamPosition, stateStreamEvents, stateFilter,
+						)
+						if err != nil {
+							return nil, nil, err
+						}
+					}
 					deltas[roomID] = stateDelta{
 						membership:    membership,
 						membershipPos: ev.StreamPosition,
@@ -1355,11 +1620,47 @@ func (d *Database) getStateDeltasForFullStateSync(
 	return result, joinedRoomIDs, nil
 }
 
+// stateStreamEventsAtDeparture returns the state changes in the room from the
+// start of the range up to the user's leave or ban event at departurePos, since
+// the leave section must not include any state changes made after the user
+// left the room. If none of the given state changes in the range happened after
+// the user left then they are returned as-is, otherwise the state changes are
+// worked out again for the range that ends at the departure.
+func (d *Database) stateStreamEventsAtDeparture(
+	ctx context.Context, txn *sql.Tx, roomID string,
+	r types.Range, departurePos types.StreamPosition,
+	stateStreamEvents []types.StreamEvent,
+	stateFilter *gomatrixserverlib.StateFilter,
+) ([]types.StreamEvent, error) {
+	changedSince := false
+	for _, ev := range stateStreamEvents {
+		if ev.StreamPosition > departurePos {
+			changedSince = true
+			break
+		}
+	}
+	if !changedSince {
+		return stateStreamEvents, nil
+	}
+	departureRange := types.Range{From: r.From, To: departurePos, Backwards: r.Backwards}
+	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, departureRange, stateFilter)
+	if err != nil {
+		return nil, err
+	}
+	state, err := d.fetchStateEvents(ctx, txn, map[string]map[string]bool{
+		roomID: stateNeeded[roomID],
+	}, eventMap)
+	if err != nil {
+		return nil, err
+	}
+	return state[roomID], nil
+}
+
 func (d *Database) currentStateStreamEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 	stateFilter *gomatrixserverlib.StateFilter,
 ) ([]types.StreamEvent, error) {
-	allState, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter)
+	allState, err := d.selectCurrentState(ctx, txn, roomID, stateFilter)
 	if err != nil {
 		return nil, err
 	}
@@ -1370,6 +1671,73 @@ func (d *Database) currentStateStreamEventsForRoom(
 	return s, nil
 }
 
+// selectCurrentState returns up to stateFilter.Limit of the current state
+// events for the room, fetching them in chunks of at most queryChunkSize.
+func (d *Database) selectCurrentState(
+	ctx context.Context, txn *sql.Tx, roomID string,
+	stateFilter *gomatrixserverlib.StateFilter,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	if d.queryChunkSize <= 0 || stateFilter.Limit <= d.queryChunkSize {
+		return d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter, "")
+	}
+	chunkFilter := *stateFilter
+	var stateEvents []*gomatrixserverlib.HeaderedEvent
+	afterEventID := ""
+	for len(stateEvents) < stateFilter.Limit {
+		chunkFilter.Limit = stateFilter.Limit - len(stateEvents)
+		if chunkFilter.Limit > d.queryChunkSize {
+			chunkFilter.Limit = d.queryChunkSize
+		}
+		chunk, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &chunkFilter, afterEventID)
+		if err != nil {
+			return nil, err
+		}
+		stateEvents = append(stateEvents, chunk...)
+		if len(chunk) < chunkFilter.Limit {
+			break
+		}
+		afterEventID = chunk[len(chunk)-1].EventID()
+	}
+	return stateEvents, nil
+}
+
+// selectRecentEvents returns up to limit of the most recent events in the
+// range, and whether there were more events that didn't fit. The events are
+// fetched newest first in chunks of at most queryChunkSize.
+func (d *Database) selectRecentEvents(
+	ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int,
+	chronologicalOrder bool, onlySyncEvents bool,
+) ([]types.StreamEvent, bool, error) {
+	if d.queryChunkSize <= 0 || limit <= d.queryChunkSize {
+		return d.OutputEvents.SelectRecentEvents(ctx, txn, roomID, r, limit, chronologicalOrder, onlySyncEvents)
+	}
+	var events []types.StreamEvent
+	chunkRange := types.Range{From: r.Low(), To: r.High()}
+	limited := true
+	for len(events) < limit {
+		chunkLimit := limit - len(events)
+		if chunkLimit > d.queryChunkSize {
+			chunkLimit = d.queryChunkSize
+		}
+		chunk, more, err := d.OutputEvents.SelectRecentEvents(ctx, txn, roomID, chunkRange, chunkLimit, false, onlySyncEvents)
+		if err != nil {
+			return nil, false, err
+		}
+		events = append(events, chunk...)
+		if !more {
+			limited = false
+			break
+		}
+		chunkRange.To = chunk[len(chunk)-1].StreamPosition - 1
+	}
+	if chronologicalOrder {
+		sort.SliceStable(events, func(i int, j int) bool {
+			return events[i].StreamPosition < events[j].StreamPosition
+		})
+	}
+	return events, limited, nil
+}
+
 func (d *Database) SendToDeviceUpdatesWaiting(
 	ctx context.Context, userID, deviceID string,
 ) (bool, error) {
@@ -1398,7 +1766,7 @@ func (d *Database) StoreNewSendForDeviceMessage(
 	if err != nil {
 		return 0, err
 	}
-	return 0, nil
+	return newPos, nil
 }
 
 func (d *Database) SendToDeviceUpdatesForSync(
@@ -1407,7 +1775,7 @@ func (d *Database) SendToDeviceUpdatesForSync(
 	token types.StreamingToken,
 ) (types.StreamPosition, []types.SendToDeviceEvent, []types.SendToDeviceNID, []types.SendToDeviceNID, error) {
 	// First of all, get our send-to-device updates for this user.
-	lastPos, events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, nil, userID, deviceID)
+	_, events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, nil, userID, deviceID)
 	if err != nil {
 		return 0, nil, nil, nil, fmt.Errorf("d.SendToDevice.SelectSendToDeviceMessages: %w", err)
 	}
@@ -1417,27 +1785,31 @@ func (d *Database) SendToDeviceUpdatesForSync(
 		return 0, nil, nil, nil, nil
 	}
 
-	// Work out whether we need to update any of the database entries.
+	// Work out whether we need to update any of the database entries. The
+	// send-to-device position of a sync token is the newest message that was
+	// included in the response it came from, so the client has only received
+	// a message once it syncs from a token at or after the message. If the
+	// response never reached the client then it will retry with its old token
+	// and we'll send the message again.
 	toReturn := []types.SendToDeviceEvent{}
 	toUpdate := []types.SendToDeviceNID{}
 	toDelete := []types.SendToDeviceNID{}
+	var lastPos types.StreamPosition
 	for _, event := range events {
+		if types.StreamPosition(event.ID) <= token.SendToDevicePosition {
+			// The client has seen this message, so we can remove it from the
+			// database.
+			toDelete = append(toDelete, event.ID)
+			continue
+		}
 		if event.SentByToken == nil {
 			// If the event has no sent-by token yet then we haven't attempted to send
 			// it. Record the current requested sync token in the database.
 			toUpdate = append(toUpdate, event.ID)
-			toReturn = append(toReturn, event)
-			event.SentByToken = &token
-		} else if token.IsAfter(*event.SentByToken) {
-			// The event had a sync token, therefore we've sent it before. The current
-			// sync token is now after the stored one so we can assume that the client
-			// successfully completed the previous sync (it would re-request it otherwise)
-			// so we can remove the entry from the database.
-			toDelete = append(toDelete, event.ID)
-		} else {
-			// It looks like the sync is being re-requested, maybe it timed out or
-			// failed. Re-send any that should have been acknowledged by now.
-			toReturn = append(toReturn, event)
+		}
+		toReturn = append(toReturn, event)
+		if types.StreamPosition(event.ID) > lastPos {
+			lastPos = types.StreamPosition(event.ID)
 		}
 	}
 
@@ -1463,7 +1835,7 @@ func (d *Database) CleanSendToDeviceUpdates(
 
 		// Now update any outstanding send-to-device messages with the new sync token.
 		if e := d.SendToDevice.UpdateSentSendToDeviceMessages(ctx, txn, token.String(), toUpdate); e != nil {
-			return fmt.Errorf("d.SendToDevice.UpdateSentSendToDeviceMessages: %w", err)
+			return fmt.Errorf("d.SendToDevice.UpdateSentSendToDeviceMessages: %w", e)
 		}
 
 		return nil
@@ -1518,11 +1890,83 @@ type stateDelta struct {
 	membershipPos types.StreamPosition
 }
 
-// StoreReceipt stores user receipts
+// StorePresence stores the presence of a user
+func (d *Database) StorePresence(ctx context.Context, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pos, err = d.Presence.UpsertPresence(ctx, txn, userID, presence, statusMsg, lastActiveTS)
+		return err
+	})
+	return
+}
+
+// GetPresence returns the presence of a user, or nil if we don't know it
+func (d *Database) GetPresence(ctx context.Context, userID string) (*eduAPI.OutputPresenceEvent, error) {
+	return d.Presence.SelectPresenceForUser(ctx, nil, userID)
+}
+
+// SharesRoomWith returns true if the two users are joined to at least one common room.
+func (d *Database) SharesRoomWith(ctx context.Context, userID, otherUserID string) (bool, error) {
+	if userID == otherUserID {
+		return true, nil
+	}
+	sharedUserIDs, err := d.CurrentRoomState.SelectUsersSharingRooms(ctx, nil, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, sharedUserID := range sharedUserIDs {
+		if sharedUserID == otherUserID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// JoinedUsersInRoom implements Database
+func (d *Database) JoinedUsersInRoom(ctx context.Context, roomID string) ([]string, error) {
+	return d.CurrentRoomState.SelectJoinedUsersInRoom(ctx, nil, roomID)
+}
+
+// AddNotifications implements Database
+func (d *Database) AddNotifications(ctx context.Context, roomID string, highlights map[string]bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for userID, highlight := range highlights {
+			if err := d.NotificationCounts.IncrementNotificationCount(ctx, txn, userID, roomID, highlight); err != nil {
+				return fmt.Errorf("d.NotificationCounts.IncrementNotificationCount: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// getUnreadNotifications returns the notification counts of the user in the room.
+func (d *Database) getUnreadNotifications(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) (*types.UnreadNotifications, error) {
+	notifications, highlights, err := d.NotificationCounts.SelectNotificationCount(ctx, txn, userID, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("d.NotificationCounts.SelectNotificationCount: %w", err)
+	}
+	return &types.UnreadNotifications{
+		NotificationCount: notifications,
+		HighlightCount:    highlights,
+	}, nil
+}
+
+// StoreReceipt stores user receipts. A read receipt, public or private, also
+// clears the notification counts of the user in the room, since they have
+// read up to the latest event.
 func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, timestamp)
-		return err
+		if err != nil {
+			return err
+		}
+		if receiptType == "m.read" || receiptType == eduAPI.ReceiptTypeReadPrivate {
+			if err = d.NotificationCounts.DeleteNotificationCount(ctx, txn, userId, roomId); err != nil {
+				return fmt.Errorf("d.NotificationCounts.DeleteNotificationCount: %w", err)
+			}
+		}
+		return nil
 	})
 	return
 }
@@ -1531,3 +1975,61 @@ func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, stream
 	_, receipts, err := d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 	return receipts, err
 }
+
+// purgeBatchSize is how many events PurgeEventsBefore looks at, and deletes, at once.
+const purgeBatchSize = 500
+
+// PurgeEventsBefore implements Database
+func (d *Database) PurgeEventsBefore(ctx context.Context, roomID string, before gomatrixserverlib.Timestamp) (int, error) {
+	// Work through the expired events from the oldest, stopping once we get
+	// to the first event which hasn't expired. State events are kept, and
+	// are skipped over on the next batch.
+	purged := 0
+	var after tables.EventTimestamp
+	for {
+		timestamps, err := d.EventTimestamps.SelectEventsBeforeTimestamp(ctx, nil, roomID, before, after, purgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("d.EventTimestamps.SelectEventsBeforeTimestamp: %w", err)
+		}
+		if len(timestamps) == 0 {
+			return purged, nil
+		}
+		after = timestamps[len(timestamps)-1]
+		eventIDs := make([]string, len(timestamps))
+		for i := range timestamps {
+			eventIDs[i] = timestamps[i].EventID
+		}
+		events, err := d.OutputEvents.SelectEvents(ctx, nil, eventIDs)
+		if err != nil {
+			return purged, fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+		}
+		var expired []string
+		for _, ev := range events {
+			if ev.StateKey() == nil {
+				expired = append(expired, ev.EventID())
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+			if err := d.OutputEvents.DeleteEvents(ctx, txn, expired); err != nil {
+				return fmt.Errorf("d.OutputEvents.DeleteEvents: %w", err)
+			}
+			if err := d.Topology.DeleteTopologyForEvents(ctx, txn, expired); err != nil {
+				return fmt.Errorf("d.Topology.DeleteTopologyForEvents: %w", err)
+			}
+			if err := d.EventTimestamps.DeleteEventTimestamps(ctx, txn, expired); err != nil {
+				return fmt.Errorf("d.EventTimestamps.DeleteEventTimestamps: %w", err)
+			}
+			if err := d.Relations.DeleteRelationsForEvents(ctx, txn, roomID, expired); err != nil {
+				return fmt.Errorf("d.Relations.DeleteRelationsForEvents: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged += len(expired)
+	}
+}
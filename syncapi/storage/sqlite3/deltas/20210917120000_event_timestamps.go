@@ -0,0 +1,72 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+func LoadEventTimestamps(m *sqlutil.Migrations) {
+	m.AddMigration(UpEventTimestamps, DownEventTimestamps)
+}
+
+// UpEventTimestamps fills in syncapi_event_timestamps for the events which
+// were stored before the table existed.
+func UpEventTimestamps(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT event_id, room_id, headered_event_json FROM syncapi_output_room_events")
+	if err != nil {
+		return fmt.Errorf("failed to query events: %w", err)
+	}
+	type eventTimestamp struct {
+		eventID, roomID string
+		ts              int64
+	}
+	var timestamps []eventTimestamp
+	for rows.Next() {
+		var ev eventTimestamp
+		var eventJSON []byte
+		if err = rows.Scan(&ev.eventID, &ev.roomID, &eventJSON); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan event: %w", err)
+		}
+		ev.ts = gjson.GetBytes(eventJSON, "origin_server_ts").Int()
+		timestamps = append(timestamps, ev)
+	}
+	if err = rows.Close(); err != nil {
+		return fmt.Errorf("failed to close rows: %w", err)
+	}
+	for _, ev := range timestamps {
+		_, err = tx.Exec(
+			"INSERT INTO syncapi_event_timestamps (event_id, room_id, origin_server_ts) VALUES ($1, $2, $3) ON CONFLICT (event_id) DO NOTHING",
+			ev.eventID, ev.roomID, ev.ts,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	return nil
+}
+
+func DownEventTimestamps(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM syncapi_event_timestamps")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
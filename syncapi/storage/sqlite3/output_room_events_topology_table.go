@@ -68,6 +68,9 @@ const selectMaxPositionInTopologySQL = "" +
 const deleteTopologyForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
+const deleteTopologyForEventSQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE event_id = $1"
+
 type outputRoomEventsTopologyStatements struct {
 	db                              *sql.DB
 	insertEventInTopologyStmt       *sql.Stmt
@@ -76,6 +79,7 @@ type outputRoomEventsTopologyStatements struct {
 	selectPositionInTopologyStmt    *sql.Stmt
 	selectMaxPositionInTopologyStmt *sql.Stmt
 	deleteTopologyForRoomStmt       *sql.Stmt
+	deleteTopologyForEventStmt      *sql.Stmt
 }
 
 func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -104,6 +108,9 @@ func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.deleteTopologyForRoomStmt, err = db.Prepare(deleteTopologyForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteTopologyForEventStmt, err = db.Prepare(deleteTopologyForEventSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -178,3 +185,15 @@ func (s *outputRoomEventsTopologyStatements) DeleteTopologyForRoom(
 	_, err = sqlutil.TxStmt(txn, s.deleteTopologyForRoomStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) DeleteTopologyForEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteTopologyForEventStmt)
+	for _, eventID := range eventIDs {
+		if _, err = stmt.ExecContext(ctx, eventID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
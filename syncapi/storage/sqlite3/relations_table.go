@@ -0,0 +1,249 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const relationsSchema = `
+-- Stores the relations between events, as described by m.relates_to
+CREATE TABLE IF NOT EXISTS syncapi_relations (
+	room_id TEXT NOT NULL,
+	-- The event which is being related to
+	event_id TEXT NOT NULL,
+	-- The event which relates to event_id
+	child_event_id TEXT NOT NULL UNIQUE,
+	child_event_type TEXT NOT NULL,
+	rel_type TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	origin_server_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_relations_event_idx ON syncapi_relations(room_id, event_id, rel_type);
+`
+
+const insertRelationSQL = "" +
+	"INSERT INTO syncapi_relations" +
+	" (room_id, event_id, child_event_id, child_event_type, rel_type, sender, origin_server_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	" ON CONFLICT (child_event_id) DO NOTHING"
+
+const deleteRelationSQL = "" +
+	"DELETE FROM syncapi_relations WHERE child_event_id = $1"
+
+const selectLatestRelationSQL = "" +
+	"SELECT child_event_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = $2 AND rel_type = $3 AND sender = $4" +
+	" ORDER BY origin_server_ts DESC, child_event_id DESC LIMIT 1"
+
+const selectRelationChildrenSQL = "" +
+	"SELECT child_event_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = $2 AND rel_type = $3" +
+	" ORDER BY origin_server_ts ASC, child_event_id ASC"
+
+// relatedEventsCTE follows the relations of the event $2 in the room $1,
+// and then the relations of those events and so on, up to $3 levels deep.
+// Each event only relates to one other, so an event can only be reached
+// once, unless it is the event we started from.
+const relatedEventsCTE = "" +
+	"WITH RECURSIVE related (event_id, child_event_id, child_event_type, rel_type, origin_server_ts, depth) AS (" +
+	"  SELECT event_id, child_event_id, child_event_type, rel_type, origin_server_ts, 1 FROM syncapi_relations" +
+	"  WHERE room_id = $1 AND event_id = $2" +
+	"  UNION ALL" +
+	"  SELECT r.event_id, r.child_event_id, r.child_event_type, r.rel_type, r.origin_server_ts, related.depth + 1" +
+	"  FROM syncapi_relations AS r INNER JOIN related ON r.event_id = related.child_event_id" +
+	"  WHERE r.room_id = $1 AND r.child_event_id != $2 AND related.depth < $3" +
+	")"
+
+const selectRelationsSQL = "" +
+	relatedEventsCTE +
+	" SELECT event_id, child_event_id, child_event_type, rel_type FROM related" +
+	" WHERE ($4 = '' OR rel_type = $4) AND ($5 = '' OR child_event_type = $5)" +
+	" ORDER BY origin_server_ts ASC, child_event_id ASC LIMIT $6 OFFSET $7"
+
+const selectRelationsBackwardsSQL = "" +
+	relatedEventsCTE +
+	" SELECT event_id, child_event_id, child_event_type, rel_type FROM related" +
+	" WHERE ($4 = '' OR rel_type = $4) AND ($5 = '' OR child_event_type = $5)" +
+	" ORDER BY origin_server_ts DESC, child_event_id DESC LIMIT $6 OFFSET $7"
+
+const selectRelationsDepthSQL = "" +
+	relatedEventsCTE +
+	" SELECT COALESCE(MAX(depth), 1) FROM related"
+
+const deleteRelationsForEventSQL = "" +
+	"DELETE FROM syncapi_relations" +
+	" WHERE room_id = $1 AND (event_id = $2 OR child_event_id = $2)"
+
+type relationsStatements struct {
+	insertRelationStmt           *sql.Stmt
+	deleteRelationStmt           *sql.Stmt
+	deleteRelationsForEventStmt  *sql.Stmt
+	selectLatestRelationStmt     *sql.Stmt
+	selectRelationChildrenStmt   *sql.Stmt
+	selectRelationsStmt          *sql.Stmt
+	selectRelationsBackwardsStmt *sql.Stmt
+	selectRelationsDepthStmt     *sql.Stmt
+}
+
+func NewSqliteRelationsTable(db *sql.DB) (tables.Relations, error) {
+	_, err := db.Exec(relationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &relationsStatements{}
+	if s.insertRelationStmt, err = db.Prepare(insertRelationSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertRelation statement: %w", err)
+	}
+	if s.deleteRelationStmt, err = db.Prepare(deleteRelationSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteRelation statement: %w", err)
+	}
+	if s.deleteRelationsForEventStmt, err = db.Prepare(deleteRelationsForEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteRelationsForEvent statement: %w", err)
+	}
+	if s.selectLatestRelationStmt, err = db.Prepare(selectLatestRelationSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectLatestRelation statement: %w", err)
+	}
+	if s.selectRelationChildrenStmt, err = db.Prepare(selectRelationChildrenSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelationChildren statement: %w", err)
+	}
+	if s.selectRelationsStmt, err = db.Prepare(selectRelationsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelations statement: %w", err)
+	}
+	if s.selectRelationsBackwardsStmt, err = db.Prepare(selectRelationsBackwardsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelationsBackwards statement: %w", err)
+	}
+	if s.selectRelationsDepthStmt, err = db.Prepare(selectRelationsDepthSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelationsDepth statement: %w", err)
+	}
+	return s, nil
+}
+
+// InsertRelation records that the child event relates to the given event.
+func (s *relationsStatements) InsertRelation(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, childEventID, childEventType, relType, sender string,
+	originServerTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertRelationStmt).ExecContext(
+		ctx, roomID, eventID, childEventID, childEventType, relType, sender, originServerTS,
+	)
+	return err
+}
+
+// DeleteRelation removes the relation of the given child event, if any.
+func (s *relationsStatements) DeleteRelation(
+	ctx context.Context, txn *sql.Tx, childEventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRelationStmt).ExecContext(ctx, childEventID)
+	return err
+}
+
+// DeleteRelationsForEvents removes the relations of the given events, as well
+// as the relations of other events to them.
+func (s *relationsStatements) DeleteRelationsForEvents(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRelationsForEventStmt)
+	for _, eventID := range eventIDs {
+		if _, err := stmt.ExecContext(ctx, roomID, eventID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectLatestRelation returns the ID of the most recent event sent by the
+// given sender which relates to the event with the given relation type.
+// Returns sql.ErrNoRows if there is no such event.
+func (s *relationsStatements) SelectLatestRelation(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, relType, sender string,
+) (childEventID string, err error) {
+	err = sqlutil.TxStmt(txn, s.selectLatestRelationStmt).QueryRowContext(
+		ctx, roomID, eventID, relType, sender,
+	).Scan(&childEventID)
+	return
+}
+
+// SelectRelationChildren returns the IDs of all of the events which relate to
+// the event with the given relation type, oldest first.
+func (s *relationsStatements) SelectRelationChildren(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, relType string,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRelationChildrenStmt).QueryContext(ctx, roomID, eventID, relType)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelationChildren: rows.close() failed")
+	var childEventIDs []string
+	for rows.Next() {
+		var childEventID string
+		if err = rows.Scan(&childEventID); err != nil {
+			return nil, err
+		}
+		childEventIDs = append(childEventIDs, childEventID)
+	}
+	return childEventIDs, rows.Err()
+}
+
+// SelectRelations returns up to limit of the events which relate to the
+// event, skipping the first from of them, oldest first or newest first if
+// backwards is true. If maxDepth is more than 1 then the events which relate
+// to those events are included too, and so on up to maxDepth levels.
+// Relations are followed whatever their type, but only those with the given
+// relation type and child event type are returned, unless these are empty.
+func (s *relationsStatements) SelectRelations(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, relType, eventType string,
+	maxDepth int, backwards bool, from, limit int,
+) ([]types.Relation, error) {
+	stmt := s.selectRelationsStmt
+	if backwards {
+		stmt = s.selectRelationsBackwardsStmt
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(
+		ctx, roomID, eventID, maxDepth, relType, eventType, limit, from,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelations: rows.close() failed")
+	var relations []types.Relation
+	for rows.Next() {
+		var relation types.Relation
+		if err = rows.Scan(&relation.EventID, &relation.ChildEventID, &relation.ChildEventType, &relation.RelType); err != nil {
+			return nil, err
+		}
+		relations = append(relations, relation)
+	}
+	return relations, rows.Err()
+}
+
+// SelectRelationsDepth returns how many levels of relations there are below
+// the event, up to maxDepth, whatever their type. Returns 1 if there are none.
+func (s *relationsStatements) SelectRelationsDepth(
+	ctx context.Context, txn *sql.Tx, roomID, eventID string, maxDepth int,
+) (depth int, err error) {
+	err = sqlutil.TxStmt(txn, s.selectRelationsDepthStmt).QueryRowContext(
+		ctx, roomID, eventID, maxDepth,
+	).Scan(&depth)
+	return
+}
@@ -46,7 +46,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if d.db, err = sqlutil.Open(dbProperties); err != nil {
 		return nil, err
 	}
-	d.writer = sqlutil.NewExclusiveWriter()
+	d.writer = sqlutil.ExclusiveWriterForDatabase(dbProperties)
 	if err = d.prepare(dbProperties); err != nil {
 		return nil, err
 	}
@@ -101,8 +101,25 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 	if err != nil {
 		return err
 	}
+	presence, err := NewSqlitePresenceTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	relations, err := NewSqliteRelationsTable(d.db)
+	if err != nil {
+		return err
+	}
+	eventTimestamps, err := NewSqliteEventTimestampsTable(d.db)
+	if err != nil {
+		return err
+	}
+	notificationCounts, err := NewSqliteNotificationCountsTable(d.db)
+	if err != nil {
+		return err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
+	deltas.LoadEventTimestamps(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
 		return err
 	}
@@ -119,6 +136,10 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
+		Presence:            presence,
+		Relations:           relations,
+		EventTimestamps:     eventTimestamps,
+		NotificationCounts:  notificationCounts,
 		EDUCache:            cache.New(),
 	}
 	return nil
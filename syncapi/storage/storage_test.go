@@ -6,15 +6,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"testing"
 	"time"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 var (
@@ -199,8 +203,8 @@ func TestSyncResponse(t *testing.T) {
 			},
 			// want the last 5 events
 			WantTimeline: events[len(events)-5:],
-			// want all state for the room
-			WantState: state,
+			// want all state for the room, which is returned in event ID order
+			WantState: sortedByEventID(state),
 		},
 		// The purpose of this test is to check that CompleteSync can return everything with a high enough
 		// `numRecentEventsPerRoom`.
@@ -237,6 +241,65 @@ func TestSyncResponse(t *testing.T) {
 			}
 			assertEventsEqual(st, "state for "+testRoomID, false, roomRes.State.Events, tc.WantState)
 			assertEventsEqual(st, "timeline for "+testRoomID, false, roomRes.Timeline.Events, tc.WantTimeline)
+			// The full events are kept for the federation event format.
+			assertEventsEqual(st, "state PDUs for "+testRoomID, false, gomatrixserverlib.HeaderedToClientEvents(roomRes.State.PDUs, gomatrixserverlib.FormatSync), tc.WantState)
+			assertEventsEqual(st, "timeline PDUs for "+testRoomID, false, gomatrixserverlib.HeaderedToClientEvents(roomRes.Timeline.PDUs, gomatrixserverlib.FormatSync), tc.WantTimeline)
+		})
+	}
+}
+
+// Rooms with more state or timeline than the query chunk size should be
+// returned in full, fetched across several chunks.
+func TestSyncResponseChunked(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	db.SetQueryChunkSize(2)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	gotState, err := db.GetStateEventsForRoom(ctx, testRoomID, &stateFilter)
+	if err != nil {
+		t.Fatalf("GetStateEventsForRoom failed: %s", err)
+	}
+	assertEventsEqual(t, "state for "+testRoomID, false, gomatrixserverlib.HeaderedToClientEvents(gotState, gomatrixserverlib.FormatAll), sortedByEventID(state))
+
+	testCases := []struct {
+		Name         string
+		Limit        int
+		WantTimeline []*gomatrixserverlib.HeaderedEvent
+		WantState    []*gomatrixserverlib.HeaderedEvent
+		WantLimited  bool
+	}{
+		{
+			Name:         "limited",
+			Limit:        5,
+			WantTimeline: events[len(events)-5:],
+			WantState:    sortedByEventID(state),
+			WantLimited:  true,
+		},
+		{
+			Name:         "whole room",
+			Limit:        len(events),
+			WantTimeline: events,
+			WantLimited:  false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(st *testing.T) {
+			res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, tc.Limit)
+			if err != nil {
+				st.Fatalf("failed to do sync: %s", err)
+			}
+			roomRes, ok := res.Rooms.Join[testRoomID]
+			if !ok {
+				st.Fatalf("CompleteSync response missing room %s - response: %+v", testRoomID, res)
+			}
+			assertEventsEqual(st, "state for "+testRoomID, false, roomRes.State.Events, tc.WantState)
+			assertEventsEqual(st, "timeline for "+testRoomID, false, roomRes.Timeline.Events, tc.WantTimeline)
+			if roomRes.Timeline.Limited != tc.WantLimited {
+				st.Errorf("got timeline limited %v, want %v", roomRes.Timeline.Limited, tc.WantLimited)
+			}
 		})
 	}
 }
@@ -285,6 +348,182 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	assertEventsEqual(t, "", true, gots, reversed(events[len(events)-6:len(events)-1]))
 }
 
+// The purpose of this test is to ensure that a burst of events larger than the timeline limit produces
+// a limited timeline, and that the prev_batch token can be used to backfill the gap.
+func TestIncrementalSyncLimitedWithPrevBatch(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	var burst []*gomatrixserverlib.HeaderedEvent
+	prev := events[len(events)-1]
+	for i := 0; i < 12; i++ {
+		prev = MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{prev}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Burst %d"}`, i+1)),
+			Type:    "m.room.message",
+			Sender:  testUserIDB,
+			Depth:   int64(len(events) + len(burst) + 1),
+		})
+		burst = append(burst, prev)
+	}
+	positions := MustWriteEvents(t, db, burst)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	res := types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+	if err != nil {
+		t.Fatalf("failed to IncrementalSync: %s", err)
+	}
+	roomRes, ok := res.Rooms.Join[testRoomID]
+	if !ok {
+		t.Fatalf("IncrementalSync response missing room %s - response: %+v", testRoomID, res)
+	}
+	if !roomRes.Timeline.Limited {
+		t.Errorf("IncrementalSync expected limited timeline for a burst of %d events with limit 5", len(burst))
+	}
+	assertEventsEqual(t, "IncrementalSync Timeline", false, roomRes.Timeline.Events, burst[len(burst)-5:])
+
+	// backpaginating from the prev_batch token should return the events in the gap
+	if roomRes.Timeline.PrevBatch == nil {
+		t.Fatalf("IncrementalSync expected prev_batch token")
+	}
+	to := types.TopologyToken{}
+	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, roomRes.Timeline.PrevBatch, &to, testRoomID, 7, true)
+	if err != nil {
+		t.Fatalf("GetEventsInRange returned an error: %s", err)
+	}
+	gots := gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)
+	assertEventsEqual(t, "", true, gots, reversed(burst[:len(burst)-5]))
+
+	// a further incremental sync which only covers the last event should not be limited
+	res = types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, types.StreamingToken{PDUPosition: positions[len(positions)-2]}, latest, 5, false)
+	if err != nil {
+		t.Fatalf("failed to IncrementalSync: %s", err)
+	}
+	roomRes, ok = res.Rooms.Join[testRoomID]
+	if !ok {
+		t.Fatalf("IncrementalSync response missing room %s - response: %+v", testRoomID, res)
+	}
+	if roomRes.Timeline.Limited {
+		t.Errorf("IncrementalSync expected timeline not to be limited")
+	}
+	assertEventsEqual(t, "IncrementalSync Timeline", false, roomRes.Timeline.Events, burst[len(burst)-1:])
+}
+
+// The purpose of this test is to ensure that the timeline for a room the user has left is marked as
+// limited if there were more events before the leave than the timeline limit.
+func TestIncrementalSyncLimitedLeave(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	var more []*gomatrixserverlib.HeaderedEvent
+	prev := events[len(events)-1]
+	for i := 0; i < 8; i++ {
+		prev = MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{prev}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Before leave %d"}`, i+1)),
+			Type:    "m.room.message",
+			Sender:  testUserIDB,
+			Depth:   int64(len(events) + len(more) + 1),
+		})
+		more = append(more, prev)
+	}
+	more = append(more, MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{prev}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"leave"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + len(more) + 1),
+	}))
+	MustWriteEvents(t, db, more)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	res := types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+	if err != nil {
+		t.Fatalf("failed to IncrementalSync: %s", err)
+	}
+	roomRes, ok := res.Rooms.Leave[testRoomID]
+	if !ok {
+		t.Fatalf("IncrementalSync response missing left room %s - response: %+v", testRoomID, res)
+	}
+	if !roomRes.Timeline.Limited {
+		t.Errorf("IncrementalSync expected limited timeline for left room")
+	}
+	assertEventsEqual(t, "IncrementalSync Timeline", false, roomRes.Timeline.Events, more[len(more)-5:])
+}
+
+// The purpose of this test is to ensure that the state in the leave section of a room is the state
+// as of the leave event, and that state changes made after the user left don't leak into it.
+func TestIncrementalSyncLeaveStateAtDeparture(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	topicBefore := MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"topic":"Before leave"}`),
+		Type:     "m.room.topic",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDB,
+		Depth:    int64(len(events) + 1),
+	})
+	leave := MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{topicBefore}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"leave"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 2),
+	})
+	name := MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{leave}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"name":"After leave"}`),
+		Type:     "m.room.name",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDB,
+		Depth:    int64(len(events) + 3),
+	})
+	MustWriteEvents(t, db, []*gomatrixserverlib.HeaderedEvent{topicBefore, leave, name})
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	for _, wantFullState := range []bool{false, true} {
+		res := types.NewResponse()
+		res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 1, wantFullState)
+		if err != nil {
+			t.Fatalf("failed to IncrementalSync: %s", err)
+		}
+		roomRes, ok := res.Rooms.Leave[testRoomID]
+		if !ok {
+			t.Fatalf("IncrementalSync response missing left room %s - response: %+v", testRoomID, res)
+		}
+		assertEventsEqual(t, "IncrementalSync Timeline", false, roomRes.Timeline.Events, []*gomatrixserverlib.HeaderedEvent{leave})
+		assertEventsEqual(t, "IncrementalSync State", false, roomRes.State.Events, []*gomatrixserverlib.HeaderedEvent{topicBefore})
+	}
+}
+
 // The purpose of this test is to ensure that backfill does indeed go backwards, using a stream token.
 func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 	t.Parallel()
@@ -561,58 +800,72 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// At this point we should get exactly one message. We're sending the sync position
-	// that we were given from the update and the send-to-device update will be updated
-	// in the database to reflect that this was the sync position we sent the message at.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos})
+	// At this point we should get exactly one message. The send-to-device update
+	// will be updated in the database to reflect the sync position we sent the
+	// message at, and we're told the position to put in the next batch token.
+	since := types.StreamingToken{}
+	lastPos, events, updates, deletions, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", since)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 1 || len(updates) != 1 || len(deletions) != 0 {
 		t.Fatal("second call should have one update")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos})
+	if lastPos != streamPos {
+		t.Fatalf("got last position %d, want the message's position %d", lastPos, streamPos)
+	}
+	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, since)
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
 
 	// At this point we should still have one message because we haven't progressed the
-	// sync position yet. This is equivalent to the client failing to /sync and retrying
-	// with the same position.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos})
+	// sync position yet. This is equivalent to the response never reaching the client,
+	// which retries the /sync with the same position, so the message is sent again.
+	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", since)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 1 || len(updates) != 0 || len(deletions) != 0 {
 		t.Fatal("third call should have one update still")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos})
+	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, since)
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
 
-	// At this point we should now have no updates, because we've progressed the sync
-	// position. Therefore the update from before will not be sent again.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos + 1})
+	// Other positions moving on doesn't mean that the client has the message.
+	_, events, _, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{PDUPosition: 10, TypingPosition: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || len(deletions) != 0 {
+		t.Fatal("fourth call should have one update still")
+	}
+
+	// At this point we should now have no updates, because the client has synced from
+	// a position which covers the message, so it must have received it.
+	since = types.StreamingToken{SendToDevicePosition: lastPos}
+	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", since)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 0 || len(updates) != 0 || len(deletions) != 1 {
-		t.Fatal("fourth call should have no updates")
+		t.Fatal("fifth call should have no updates")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos + 1})
+	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, since)
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
 
 	// At this point we should still have no updates, because no new updates have been
 	// sent.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos + 2})
+	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos + 1})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 0 || len(updates) != 0 || len(deletions) != 0 {
-		t.Fatal("fifth call should have no updates")
+		t.Fatal("sixth call should have no updates")
 	}
 }
 
@@ -677,6 +930,470 @@ func TestInviteBehaviour(t *testing.T) {
 	}
 }
 
+// Private read receipts should only be synced to the user who sent them.
+func TestPrivateReceipts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	private, public := events[len(events)-2].EventID(), events[len(events)-1].EventID()
+	if _, err := db.StoreReceipt(ctx, testRoomID, "m.read.private", testUserIDA, private, 1000); err != nil {
+		t.Fatalf("StoreReceipt failed: %s", err)
+	}
+	if _, err := db.StoreReceipt(ctx, testRoomID, "m.read", testUserIDB, public, 2000); err != nil {
+		t.Fatalf("StoreReceipt failed: %s", err)
+	}
+
+	receipts := func(device userapi.Device) map[string]map[string]map[string]interface{} {
+		t.Helper()
+		res, err := db.CompleteSync(ctx, types.NewResponse(), device, 5)
+		if err != nil {
+			t.Fatalf("CompleteSync failed: %s", err)
+		}
+		for _, ev := range res.Rooms.Join[testRoomID].Ephemeral.Events {
+			if ev.Type != gomatrixserverlib.MReceipt {
+				continue
+			}
+			var content map[string]map[string]map[string]interface{}
+			if err = json.Unmarshal(ev.Content, &content); err != nil {
+				t.Fatalf("failed to unmarshal receipt: %s", err)
+			}
+			return content
+		}
+		return nil
+	}
+
+	// The user who sent the private receipt sees it, as well as the public one.
+	content := receipts(testUserDeviceA)
+	if _, ok := content[private]["m.read.private"][testUserIDA]; !ok {
+		t.Errorf("sender didn't get their private receipt: %v", content)
+	}
+	if _, ok := content[public]["m.read"][testUserIDB]; !ok {
+		t.Errorf("sender didn't get the public receipt: %v", content)
+	}
+
+	// Everyone else only sees the public one.
+	content = receipts(userapi.Device{UserID: testUserIDB, ID: "device_id_B"})
+	if _, ok := content[private]; ok {
+		t.Errorf("other user got a private receipt: %v", content)
+	}
+	if _, ok := content[public]["m.read"][testUserIDB]; !ok {
+		t.Errorf("other user didn't get the public receipt: %v", content)
+	}
+}
+
+func TestPresenceBehaviour(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	before, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// a presence update for a user we share a room with should be stored
+	statusMsg := "performing"
+	lastActiveTS := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Minute))
+	if _, err = db.StorePresence(ctx, testUserIDB, eduAPI.PresenceOnline, &statusMsg, lastActiveTS); err != nil {
+		t.Fatalf("StorePresence failed: %s", err)
+	}
+	presence, err := db.GetPresence(ctx, testUserIDB)
+	if err != nil {
+		t.Fatalf("GetPresence failed: %s", err)
+	}
+	if presence == nil || presence.Presence != eduAPI.PresenceOnline || presence.StatusMsg == nil || *presence.StatusMsg != statusMsg || presence.LastActiveTS != lastActiveTS {
+		t.Fatalf("GetPresence returned unexpected presence %+v", presence)
+	}
+
+	// a presence update for a user we don't share a room with
+	stranger := fmt.Sprintf("@stranger:%s", testOrigin)
+	if _, err = db.StorePresence(ctx, stranger, eduAPI.PresenceOnline, nil, lastActiveTS); err != nil {
+		t.Fatalf("StorePresence failed: %s", err)
+	}
+
+	// only the user we share a room with should appear in the next incremental sync
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res := types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, before, latest, 0, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if len(res.Presence.Events) != 1 || res.Presence.Events[0].Sender != testUserIDB {
+		t.Fatalf("IncrementalSync: expected 1 presence event for %s, got %+v", testUserIDB, res.Presence.Events)
+	}
+	if res.NextBatch.PresencePosition != latest.PresencePosition {
+		t.Errorf("IncrementalSync: expected next batch presence position %d, got %d", latest.PresencePosition, res.NextBatch.PresencePosition)
+	}
+
+	// presence updates after the upper bound of the sync shouldn't be included
+	if _, err = db.StorePresence(ctx, testUserIDA, eduAPI.PresenceOnline, nil, lastActiveTS); err != nil {
+		t.Fatalf("StorePresence failed: %s", err)
+	}
+	res = types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, before, latest, 0, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if len(res.Presence.Events) != 1 || res.Presence.Events[0].Sender != testUserIDB {
+		t.Fatalf("IncrementalSync: expected only the presence event for %s, got %+v", testUserIDB, res.Presence.Events)
+	}
+
+	if shared, err := db.SharesRoomWith(ctx, testUserIDA, testUserIDB); err != nil || !shared {
+		t.Errorf("SharesRoomWith: expected %s to share a room with %s, got %v (err %v)", testUserIDA, testUserIDB, shared, err)
+	}
+	if shared, err := db.SharesRoomWith(ctx, testUserIDA, stranger); err != nil || shared {
+		t.Errorf("SharesRoomWith: expected %s not to share a room with %s, got %v (err %v)", testUserIDA, stranger, shared, err)
+	}
+}
+
+func TestPeekBehaviour(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	peekingDevice := userapi.Device{
+		UserID: fmt.Sprintf("@grub:%s", testOrigin),
+		ID:     "peeking_device",
+	}
+
+	if _, err := db.AddPeek(ctx, testRoomID, peekingDevice.UserID, peekingDevice.ID); err != nil {
+		t.Fatalf("Failed to AddPeek: %s", err)
+	}
+	beforeLive, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// a live event sent while peeking should be sent to the peeking device
+	liveEvent := MustCreateEvent(t, testRoomID, events[len(events)-1:], &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"body":"Live message"}`),
+		Type:    "m.room.message",
+		Sender:  testUserIDA,
+		Depth:   int64(len(events) + 1),
+	})
+	MustWriteEvents(t, db, []*gomatrixserverlib.HeaderedEvent{liveEvent})
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res := types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, peekingDevice, beforeLive, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	peekRes, ok := res.Rooms.Peek[testRoomID]
+	if !ok {
+		t.Fatalf("IncrementalSync response missing peeked room %s - response: %+v", testRoomID, res)
+	}
+	assertEventsEqual(t, "timeline for "+testRoomID, false, peekRes.Timeline.Events, []*gomatrixserverlib.HeaderedEvent{liveEvent})
+
+	// once the peek is retired, new events should no longer be sent to the peeking device
+	if _, err = db.DeletePeek(ctx, testRoomID, peekingDevice.UserID, peekingDevice.ID); err != nil {
+		t.Fatalf("Failed to DeletePeek: %s", err)
+	}
+	afterUnpeek, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	MustWriteEvents(t, db, []*gomatrixserverlib.HeaderedEvent{
+		MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{liveEvent}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(`{"body":"After unpeek"}`),
+			Type:    "m.room.message",
+			Sender:  testUserIDA,
+			Depth:   int64(len(events) + 2),
+		}),
+	})
+	latest, err = db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res = types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, peekingDevice, afterUnpeek, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if _, ok = res.Rooms.Peek[testRoomID]; ok {
+		t.Fatalf("IncrementalSync: expected not to see peeked room after unpeeking but did")
+	}
+}
+
+func TestRoomSummary(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	// add some more joined members, deliberately out of order, and an invited member
+	prev := events[len(events)-1]
+	for _, localpart := range []string{"zote", "quirrel", "cloth", "myla", "elderbug", "tiso"} {
+		userID := fmt.Sprintf("@%s:%s", localpart, testOrigin)
+		prev = MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{prev}, &gomatrixserverlib.EventBuilder{
+			Content:  []byte(`{"membership":"join"}`),
+			Type:     "m.room.member",
+			StateKey: &userID,
+			Sender:   userID,
+			Depth:    int64(len(events) + 1),
+		})
+		events = append(events, prev)
+	}
+	invitee := fmt.Sprintf("@bretta:%s", testOrigin)
+	events = append(events, MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{prev}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"invite"}`),
+		Type:     "m.room.member",
+		StateKey: &invitee,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	}))
+	MustWriteEvents(t, db, events)
+
+	// do the sync twice to make sure that the heroes are stable
+	for i := 0; i < 2; i++ {
+		res := types.NewResponse()
+		res, err := db.CompleteSync(ctx, res, testUserDeviceA, 5)
+		if err != nil {
+			t.Fatalf("CompleteSync failed: %s", err)
+		}
+		roomRes, ok := res.Rooms.Join[testRoomID]
+		if !ok {
+			t.Fatalf("CompleteSync response missing room %s - response: %+v", testRoomID, res)
+		}
+		summary := roomRes.Summary
+		if summary == nil {
+			t.Fatalf("CompleteSync response missing room summary")
+		}
+		if summary.JoinedMemberCount == nil || *summary.JoinedMemberCount != 8 {
+			t.Errorf("got joined member count %v, want 8", summary.JoinedMemberCount)
+		}
+		if summary.InvitedMemberCount == nil || *summary.InvitedMemberCount != 1 {
+			t.Errorf("got invited member count %v, want 1", summary.InvitedMemberCount)
+		}
+		wantHeroes := []string{
+			fmt.Sprintf("@cloth:%s", testOrigin),
+			fmt.Sprintf("@elderbug:%s", testOrigin),
+			fmt.Sprintf("@myla:%s", testOrigin),
+			testUserIDB,
+			fmt.Sprintf("@quirrel:%s", testOrigin),
+		}
+		if fmt.Sprintf("%v", summary.Heroes) != fmt.Sprintf("%v", wantHeroes) {
+			t.Errorf("got heroes %v, want %v", summary.Heroes, wantHeroes)
+		}
+	}
+}
+
+func TestNotificationCounts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	joined, err := db.JoinedUsersInRoom(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("JoinedUsersInRoom failed: %s", err)
+	}
+	if len(joined) != 2 {
+		t.Errorf("got joined users %v, want %s and %s", joined, testUserIDA, testUserIDB)
+	}
+
+	for _, highlight := range []bool{false, true, false} {
+		if err = db.AddNotifications(ctx, testRoomID, map[string]bool{testUserIDA: highlight}); err != nil {
+			t.Fatalf("AddNotifications failed: %s", err)
+		}
+	}
+	res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, 5)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	unread := res.Rooms.Join[testRoomID].UnreadNotifications
+	if unread == nil || unread.NotificationCount != 3 || unread.HighlightCount != 1 {
+		t.Errorf("got unread notifications %+v, want 3 notifications and 1 highlight", unread)
+	}
+
+	// Other users' counts are kept apart.
+	res, err = db.CompleteSync(ctx, types.NewResponse(), userapi.Device{UserID: testUserIDB}, 5)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	unread = res.Rooms.Join[testRoomID].UnreadNotifications
+	if unread == nil || unread.NotificationCount != 0 || unread.HighlightCount != 0 {
+		t.Errorf("got unread notifications %+v for %s, want none", unread, testUserIDB)
+	}
+}
+
+// A private read receipt clears the counts of the user who sent it, without
+// the receipt being visible to anyone else.
+func TestPrivateReceiptClearsNotificationCounts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	if err := db.AddNotifications(ctx, testRoomID, map[string]bool{testUserIDA: true, testUserIDB: true}); err != nil {
+		t.Fatalf("AddNotifications failed: %s", err)
+	}
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if _, err = db.StoreReceipt(ctx, testRoomID, "m.read.private", testUserIDA, events[len(events)-1].EventID(), 1000); err != nil {
+		t.Fatalf("StoreReceipt failed: %s", err)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// Nothing else has happened in the room, but the sender still learns
+	// that their counts have been cleared.
+	res, err := db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	unread := res.Rooms.Join[testRoomID].UnreadNotifications
+	if unread == nil || unread.NotificationCount != 0 || unread.HighlightCount != 0 {
+		t.Errorf("got unread notifications %+v after a private receipt, want none", unread)
+	}
+
+	// The other user keeps their counts and doesn't see the receipt.
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), userapi.Device{UserID: testUserIDB}, from, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if jr, ok := res.Rooms.Join[testRoomID]; ok && len(jr.Ephemeral.Events) > 0 {
+		t.Errorf("other user got receipts: %+v", jr.Ephemeral.Events)
+	}
+	res, err = db.CompleteSync(ctx, types.NewResponse(), userapi.Device{UserID: testUserIDB}, 5)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	unread = res.Rooms.Join[testRoomID].UnreadNotifications
+	if unread == nil || unread.NotificationCount != 1 || unread.HighlightCount != 1 {
+		t.Errorf("got unread notifications %+v for %s, want 1 notification and 1 highlight", unread, testUserIDB)
+	}
+}
+
+func TestEditAggregation(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	original := events[len(events)-1]
+	// Build the edits with increasing timestamps so that the latest is well defined.
+	mustCreateEdit := func(sender, body string, ts time.Time) *gomatrixserverlib.HeaderedEvent {
+		b := &gomatrixserverlib.EventBuilder{
+			RoomID: testRoomID,
+			Content: []byte(fmt.Sprintf(
+				`{"body":"* %s","m.new_content":{"body":%q},"m.relates_to":{"rel_type":"m.replace","event_id":%q}}`,
+				body, body, original.EventID(),
+			)),
+			Type:       "m.room.message",
+			Sender:     sender,
+			Depth:      int64(len(events) + 1),
+			PrevEvents: []string{events[len(events)-1].EventID()},
+		}
+		e, err := b.Build(ts, testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(testRoomVersion)
+		events = append(events, ev)
+		return ev
+	}
+	now := time.Now()
+	firstEdit := mustCreateEdit(testUserIDB, "first edit", now)
+	latestEdit := mustCreateEdit(testUserIDB, "latest edit", now.Add(time.Second))
+	// Only the original sender can edit an event.
+	mustCreateEdit(testUserIDA, "edit by someone else", now.Add(2*time.Second))
+	MustWriteEvents(t, db, events)
+
+	mustBundle := func(applyEdits bool) gomatrixserverlib.ClientEvent {
+		clientEvents := []gomatrixserverlib.ClientEvent{
+			gomatrixserverlib.HeaderedToClientEvent(original, gomatrixserverlib.FormatAll),
+		}
+		if err := internal.BundleAggregations(ctx, db, clientEvents, applyEdits); err != nil {
+			t.Fatalf("BundleAggregations failed: %s", err)
+		}
+		return clientEvents[0]
+	}
+	ev := mustBundle(false)
+	if editID := gjson.GetBytes(ev.Unsigned, `m\.relations.m\.replace.event_id`).Str; editID != latestEdit.EventID() {
+		t.Errorf("got bundled edit %q, want %q", editID, latestEdit.EventID())
+	}
+	if body := gjson.GetBytes(ev.Unsigned, `m\.relations.m\.replace.content.body`).Str; body != "* latest edit" {
+		t.Errorf("got bundled edit body %q, want %q", body, "* latest edit")
+	}
+	if body := gjson.GetBytes(ev.Content, "body").Str; body != "Message B 10" {
+		t.Errorf("got content body %q without applying edits, want the original", body)
+	}
+	if body := gjson.GetBytes(mustBundle(true).Content, "body").Str; body != "latest edit" {
+		t.Errorf("got content body %q when applying edits, want %q", body, "latest edit")
+	}
+
+	// Redacting the latest edit means the first edit is now the latest.
+	redaction := MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{}`),
+		Type:    gomatrixserverlib.MRoomRedaction,
+		Sender:  testUserIDB,
+		Redacts: latestEdit.EventID(),
+		Depth:   int64(len(events) + 1),
+	})
+	if err := db.RedactEvent(ctx, latestEdit.EventID(), redaction); err != nil {
+		t.Fatalf("RedactEvent failed: %s", err)
+	}
+	if editID := gjson.GetBytes(mustBundle(false).Unsigned, `m\.relations.m\.replace.event_id`).Str; editID != firstEdit.EventID() {
+		t.Errorf("got bundled edit %q after redaction, want %q", editID, firstEdit.EventID())
+	}
+}
+
+func TestReferenceAggregation(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	parent := events[len(events)-1]
+	mustCreateReference := func(sender, relType string, ts time.Time) *gomatrixserverlib.HeaderedEvent {
+		b := &gomatrixserverlib.EventBuilder{
+			RoomID: testRoomID,
+			Content: []byte(fmt.Sprintf(
+				`{"body":"see above","m.relates_to":{"rel_type":%q,"event_id":%q}}`, relType, parent.EventID(),
+			)),
+			Type:       "m.room.message",
+			Sender:     sender,
+			Depth:      int64(len(events) + 1),
+			PrevEvents: []string{events[len(events)-1].EventID()},
+		}
+		e, err := b.Build(ts, testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(testRoomVersion)
+		events = append(events, ev)
+		return ev
+	}
+	now := time.Now()
+	first := mustCreateReference(testUserIDA, internal.RelTypeReference, now)
+	second := mustCreateReference(testUserIDB, internal.RelTypeReference, now.Add(time.Second))
+	// Other relation types aren't references.
+	mustCreateReference(testUserIDA, "m.thread", now.Add(2*time.Second))
+	MustWriteEvents(t, db, events)
+
+	clientEvents := gomatrixserverlib.HeaderedToClientEvents(
+		[]*gomatrixserverlib.HeaderedEvent{parent, first}, gomatrixserverlib.FormatAll,
+	)
+	if err := internal.BundleAggregations(ctx, db, clientEvents, false); err != nil {
+		t.Fatalf("BundleAggregations failed: %s", err)
+	}
+	var got []string
+	for _, ref := range gjson.GetBytes(clientEvents[0].Unsigned, `m\.relations.m\.reference.chunk`).Array() {
+		got = append(got, ref.Get("event_id").Str)
+	}
+	want := []string{first.EventID(), second.EventID()}
+	if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", want) {
+		t.Errorf("got bundled references %v, want %v", got, want)
+	}
+	if refs := gjson.GetBytes(clientEvents[1].Unsigned, `m\.relations.m\.reference`); refs.Exists() {
+		t.Errorf("got bundled references %s on an event which isn't referenced", refs.Raw)
+	}
+}
+
 func assertInvitedToRooms(t *testing.T, res *types.Response, roomIDs []string) {
 	t.Helper()
 	if len(res.Rooms.Invite) != len(roomIDs) {
@@ -739,6 +1456,15 @@ func topologyTokenBefore(t *testing.T, db storage.Database, eventID string) *typ
 	return &tok
 }
 
+func sortedByEventID(in []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
+	out := make([]*gomatrixserverlib.HeaderedEvent, len(in))
+	copy(out, in)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].EventID() < out[j].EventID()
+	})
+	return out
+}
+
 func reversed(in []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
 	out := make([]*gomatrixserverlib.HeaderedEvent, len(in))
 	for i := 0; i < len(in); i++ {
@@ -746,3 +1472,90 @@ func reversed(in []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.Header
 	}
 	return out
 }
+
+func TestPurgeExpiredEvents(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	old := time.Now().Add(-48 * time.Hour)
+	var events []*gomatrixserverlib.HeaderedEvent
+	addEvent := func(ts time.Time, b gomatrixserverlib.EventBuilder) *gomatrixserverlib.HeaderedEvent {
+		t.Helper()
+		b.RoomID = testRoomID
+		b.Sender = testUserIDA
+		b.Depth = int64(len(events) + 1)
+		if len(events) > 0 {
+			b.PrevEvents = []string{events[len(events)-1].EventID()}
+		}
+		ev, err := b.Build(ts, testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		events = append(events, ev.Headered(testRoomVersion))
+		return events[len(events)-1]
+	}
+	addEvent(old, gomatrixserverlib.EventBuilder{
+		Type:     gomatrixserverlib.MRoomCreate,
+		StateKey: &emptyStateKey,
+		Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testUserIDA)),
+	})
+	addEvent(old, gomatrixserverlib.EventBuilder{
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &testUserIDA,
+		Content:  []byte(`{"membership":"join"}`),
+	})
+	addEvent(old, gomatrixserverlib.EventBuilder{
+		Type:     "m.room.retention",
+		StateKey: &emptyStateKey,
+		Content:  []byte(`{"max_lifetime":86400000}`),
+	})
+	expired := addEvent(old, gomatrixserverlib.EventBuilder{
+		Type:    "m.room.message",
+		Content: []byte(`{"body":"old message","msgtype":"m.text"}`),
+	})
+	addEvent(time.Now(), gomatrixserverlib.EventBuilder{
+		Type:    "m.room.message",
+		Content: []byte(`{"body":"new message","msgtype":"m.text"}`),
+	})
+	// A recent reaction to the old message is kept, but doesn't relate to
+	// anything once the old message has gone.
+	addEvent(time.Now(), gomatrixserverlib.EventBuilder{
+		Type:    "m.reaction",
+		Content: []byte(fmt.Sprintf(`{"m.relates_to":{"rel_type":"m.annotation","event_id":%q,"key":"👍"}}`, expired.EventID())),
+	})
+	MustWriteEvents(t, db, events)
+	if children, err := db.RelationChildren(ctx, testRoomID, expired.EventID(), "m.annotation"); err != nil || len(children) != 1 {
+		t.Fatalf("got relation children %v (err %v) before purging, want the reaction", children, err)
+	}
+
+	cfg := &config.RetentionOptions{Enabled: true}
+	if err := internal.PurgeExpiredEvents(ctx, cfg, db); err != nil {
+		t.Fatalf("PurgeExpiredEvents failed: %s", err)
+	}
+
+	// Only the old message should have been purged. State events are kept
+	// however old they are.
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	remaining, err := db.Events(ctx, eventIDs)
+	if err != nil {
+		t.Fatalf("Events failed: %s", err)
+	}
+	got := map[string]bool{}
+	for _, ev := range remaining {
+		got[ev.EventID()] = true
+	}
+	for _, ev := range events {
+		if want := ev != expired; got[ev.EventID()] != want {
+			t.Errorf("event %s of type %s: got present=%v, want %v", ev.EventID(), ev.Type(), got[ev.EventID()], want)
+		}
+	}
+	children, err := db.RelationChildren(ctx, testRoomID, expired.EventID(), "m.annotation")
+	if err != nil {
+		t.Fatalf("RelationChildren failed: %s", err)
+	}
+	if len(children) != 0 {
+		t.Errorf("got relation children %v for a purged event, want none", children)
+	}
+}
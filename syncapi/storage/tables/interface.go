@@ -60,9 +60,13 @@ type Events interface {
 	// SelectEarlyEvents returns the earliest events in the given room.
 	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
+	// SelectEventsBySender returns all of the events sent by the given user, oldest first.
+	SelectEventsBySender(ctx context.Context, txn *sql.Tx, sender string) ([]types.StreamEvent, error)
 	UpdateEventJSON(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
 	// DeleteEventsForRoom removes all event information for a room. This should only be done when removing the room entirely.
 	DeleteEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteEvents removes the given events, e.g. when they have expired.
+	DeleteEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) (err error)
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -82,6 +86,8 @@ type Topology interface {
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
 	// DeleteTopologyForRoom removes all topological information for a room. This should only be done when removing the room entirely.
 	DeleteTopologyForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteTopologyForEvents removes the topological information for the given events, e.g. when they have expired.
+	DeleteTopologyForEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) (err error)
 }
 
 type CurrentRoomState interface {
@@ -90,12 +96,22 @@ type CurrentRoomState interface {
 	UpsertRoomState(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, membership *string, addedAt types.StreamPosition) error
 	DeleteRoomStateByEventID(ctx context.Context, txn *sql.Tx, eventID string) error
 	DeleteRoomStateForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
-	// SelectCurrentState returns all the current state events for the given room.
-	SelectCurrentState(ctx context.Context, txn *sql.Tx, roomID string, stateFilter *gomatrixserverlib.StateFilter) ([]*gomatrixserverlib.HeaderedEvent, error)
+	// SelectCurrentState returns up to stateFilter.Limit of the current state events for the given room,
+	// ordered by event ID and starting after the given event ID, so that the state can be fetched in chunks.
+	SelectCurrentState(ctx context.Context, txn *sql.Tx, roomID string, stateFilter *gomatrixserverlib.StateFilter, afterEventID string) ([]*gomatrixserverlib.HeaderedEvent, error)
 	// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context) (map[string][]string, error)
+	// SelectUsersSharingRooms returns the IDs of the users who share a joined room with the given user, including the user.
+	SelectUsersSharingRooms(ctx context.Context, txn *sql.Tx, userID string) ([]string, error)
+	// SelectMembershipCount returns the number of users in the given room with the given membership.
+	SelectMembershipCount(ctx context.Context, txn *sql.Tx, roomID, membership string) (int, error)
+	// SelectMembersWithMembership returns up to limit user IDs in the given room with the given membership,
+	// excluding the given user, sorted by user ID.
+	SelectMembersWithMembership(ctx context.Context, txn *sql.Tx, roomID, membership, excludeUserID string, limit int) ([]string, error)
+	// SelectJoinedUsersInRoom returns the IDs of the users who are joined to the given room.
+	SelectJoinedUsersInRoom(ctx context.Context, txn *sql.Tx, roomID string) ([]string, error)
 }
 
 // BackwardsExtremities keeps track of backwards extremities for a room.
@@ -163,3 +179,43 @@ type Receipts interface {
 	SelectRoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error)
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
+
+type Presence interface {
+	UpsertPresence(ctx context.Context, txn *sql.Tx, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	SelectPresenceForUser(ctx context.Context, txn *sql.Tx, userID string) (*eduAPI.OutputPresenceEvent, error)
+	SelectPresenceAfter(ctx context.Context, txn *sql.Tx, streamPos, to types.StreamPosition) (types.StreamPosition, []eduAPI.OutputPresenceEvent, error)
+	SelectMaxPresenceID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+type Relations interface {
+	InsertRelation(ctx context.Context, txn *sql.Tx, roomID, eventID, childEventID, childEventType, relType, sender string, originServerTS gomatrixserverlib.Timestamp) error
+	DeleteRelation(ctx context.Context, txn *sql.Tx, childEventID string) error
+	SelectLatestRelation(ctx context.Context, txn *sql.Tx, roomID, eventID, relType, sender string) (childEventID string, err error)
+	SelectRelationChildren(ctx context.Context, txn *sql.Tx, roomID, eventID, relType string) ([]string, error)
+	SelectRelations(ctx context.Context, txn *sql.Tx, roomID, eventID, relType, eventType string, maxDepth int, backwards bool, from, limit int) ([]types.Relation, error)
+	SelectRelationsDepth(ctx context.Context, txn *sql.Tx, roomID, eventID string, maxDepth int) (int, error)
+	// DeleteRelationsForEvents removes the relations to and from the given events, e.g. when they have expired.
+	DeleteRelationsForEvents(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string) error
+}
+
+type EventTimestamps interface {
+	InsertEventTimestamp(ctx context.Context, txn *sql.Tx, roomID, eventID string, originServerTS gomatrixserverlib.Timestamp) error
+	DeleteEventTimestamps(ctx context.Context, txn *sql.Tx, eventIDs []string) error
+	// SelectEventNearestTimestamp returns sql.ErrNoRows if there is no event in that direction.
+	SelectEventNearestTimestamp(ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp, backwards bool) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error)
+	// SelectEventsBeforeTimestamp returns up to limit events in the room which were sent before the given time, oldest
+	// first, starting after the given event.
+	SelectEventsBeforeTimestamp(ctx context.Context, txn *sql.Tx, roomID string, before gomatrixserverlib.Timestamp, after EventTimestamp, limit int) ([]EventTimestamp, error)
+}
+
+// EventTimestamp is the origin_server_ts of an event.
+type EventTimestamp struct {
+	EventID        string
+	OriginServerTS gomatrixserverlib.Timestamp
+}
+
+type NotificationCounts interface {
+	IncrementNotificationCount(ctx context.Context, txn *sql.Tx, userID, roomID string, highlight bool) error
+	SelectNotificationCount(ctx context.Context, txn *sql.Tx, userID, roomID string) (notifications, highlights int, err error)
+	DeleteNotificationCount(ctx context.Context, txn *sql.Tx, userID, roomID string) error
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// eventFormatFederation is the filter event_format which asks for events in
+// the format that they are sent over federation, rather than the client one.
+const eventFormatFederation = "federation"
+
+// federationResponse is a sync response with the timeline and state events
+// of each room in the federation format. When marshalled, its rooms take the
+// place of the rooms in the embedded response.
+type federationResponse struct {
+	*types.Response
+	Rooms struct {
+		Join   map[string]federationJoinResponse  `json:"join"`
+		Peek   map[string]federationJoinResponse  `json:"peek"`
+		Invite map[string]types.InviteResponse    `json:"invite"`
+		Leave  map[string]federationLeaveResponse `json:"leave"`
+	} `json:"rooms"`
+}
+
+type federationJoinResponse struct {
+	types.JoinResponse
+	State    federationState    `json:"state"`
+	Timeline federationTimeline `json:"timeline"`
+}
+
+type federationLeaveResponse struct {
+	types.LeaveResponse
+	State    federationState    `json:"state"`
+	Timeline federationTimeline `json:"timeline"`
+}
+
+type federationState struct {
+	Events []json.RawMessage `json:"events"`
+}
+
+type federationTimeline struct {
+	Events    []json.RawMessage    `json:"events"`
+	Limited   bool                 `json:"limited"`
+	PrevBatch *types.TopologyToken `json:"prev_batch,omitempty"`
+}
+
+// federationFormatResponse returns the sync response with the timeline and
+// state events of each room replaced by the full events, including fields
+// like hashes, signatures and prev_events which the client format leaves out.
+// The events are the PDUs that the response was built from, so their
+// unsigned section is the one worked out for the syncing device.
+func federationFormatResponse(res *types.Response) *federationResponse {
+	fres := &federationResponse{Response: res}
+	fres.Rooms.Join = make(map[string]federationJoinResponse, len(res.Rooms.Join))
+	for roomID, room := range res.Rooms.Join {
+		fres.Rooms.Join[roomID] = toFederationJoinResponse(room)
+	}
+	fres.Rooms.Peek = make(map[string]federationJoinResponse, len(res.Rooms.Peek))
+	for roomID, room := range res.Rooms.Peek {
+		fres.Rooms.Peek[roomID] = toFederationJoinResponse(room)
+	}
+	fres.Rooms.Invite = res.Rooms.Invite
+	fres.Rooms.Leave = make(map[string]federationLeaveResponse, len(res.Rooms.Leave))
+	for roomID, room := range res.Rooms.Leave {
+		fr := federationLeaveResponse{LeaveResponse: room}
+		fr.State.Events = federationEvents(room.State.PDUs)
+		fr.Timeline.Events = federationEvents(room.Timeline.PDUs)
+		fr.Timeline.Limited = room.Timeline.Limited
+		fr.Timeline.PrevBatch = room.Timeline.PrevBatch
+		fres.Rooms.Leave[roomID] = fr
+	}
+	return fres
+}
+
+func toFederationJoinResponse(room types.JoinResponse) federationJoinResponse {
+	fr := federationJoinResponse{JoinResponse: room}
+	fr.State.Events = federationEvents(room.State.PDUs)
+	fr.Timeline.Events = federationEvents(room.Timeline.PDUs)
+	fr.Timeline.Limited = room.Timeline.Limited
+	fr.Timeline.PrevBatch = room.Timeline.PrevBatch
+	return fr
+}
+
+func federationEvents(pdus []*gomatrixserverlib.HeaderedEvent) []json.RawMessage {
+	events := make([]json.RawMessage, len(pdus))
+	for i, pdu := range pdus {
+		events[i] = pdu.JSON()
+	}
+	return events
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestFederationEventFormat(t *testing.T) {
+	roomID, alice := "!room:example.org", "@alice:example.org"
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	var prev []gomatrixserverlib.EventReference
+	build := func(eventType string, stateKey *string, content string) *gomatrixserverlib.HeaderedEvent {
+		t.Helper()
+		b := gomatrixserverlib.EventBuilder{
+			Sender:     alice,
+			RoomID:     roomID,
+			Type:       eventType,
+			StateKey:   stateKey,
+			Depth:      int64(len(prev) + 1),
+			PrevEvents: prev,
+			Content:    []byte(content),
+		}
+		ev, err := b.Build(time.Now(), "example.org", "ed25519:test", key, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		prev = []gomatrixserverlib.EventReference{ev.EventReference()}
+		return ev.Headered(gomatrixserverlib.RoomVersionV1)
+	}
+	emptyStateKey := ""
+	create := build(gomatrixserverlib.MRoomCreate, &emptyStateKey, `{"creator":"@alice:example.org"}`)
+	message := build("m.room.message", nil, `{"body":"hello","msgtype":"m.text"}`)
+
+	if err := message.SetUnsignedField("transaction_id", "txn1"); err != nil {
+		t.Fatalf("failed to set transaction ID: %s", err)
+	}
+
+	res := types.NewResponse()
+	jr := types.NewJoinResponse()
+	jr.State.PDUs = []*gomatrixserverlib.HeaderedEvent{create}
+	jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(jr.State.PDUs, gomatrixserverlib.FormatSync)
+	jr.Timeline.PDUs = []*gomatrixserverlib.HeaderedEvent{message}
+	jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(jr.Timeline.PDUs, gomatrixserverlib.FormatSync)
+	jr.Timeline.Limited = true
+	res.Rooms.Join[roomID] = *jr
+	res.Rooms.Invite[roomID] = *types.NewInviteResponse(create)
+
+	body, err := json.Marshal(federationFormatResponse(res))
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	var got struct {
+		NextBatch string `json:"next_batch"`
+		Rooms     struct {
+			Join map[string]struct {
+				State struct {
+					Events []map[string]json.RawMessage `json:"events"`
+				} `json:"state"`
+				Timeline struct {
+					Events  []map[string]json.RawMessage `json:"events"`
+					Limited bool                         `json:"limited"`
+				} `json:"timeline"`
+			} `json:"join"`
+			Invite map[string]json.RawMessage `json:"invite"`
+		} `json:"rooms"`
+	}
+	if err = json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if got.NextBatch == "" || got.Rooms.Invite[roomID] == nil {
+		t.Errorf("rest of the response is missing: %s", body)
+	}
+	room := got.Rooms.Join[roomID]
+	if !room.Timeline.Limited {
+		t.Errorf("timeline should be limited: %s", body)
+	}
+	if len(room.State.Events) != 1 || len(room.Timeline.Events) != 1 {
+		t.Fatalf("got %d state and %d timeline events, want 1 of each: %s", len(room.State.Events), len(room.Timeline.Events), body)
+	}
+	for name, ev := range map[string]map[string]json.RawMessage{
+		"state":    room.State.Events[0],
+		"timeline": room.Timeline.Events[0],
+	} {
+		for _, field := range []string{"event_id", "room_id", "hashes", "signatures", "prev_events", "auth_events", "depth", "origin"} {
+			if _, ok := ev[field]; !ok {
+				t.Errorf("%s event is missing %q", name, field)
+			}
+		}
+	}
+	var prevEvents [][]interface{}
+	if err = json.Unmarshal(room.Timeline.Events[0]["prev_events"], &prevEvents); err != nil || len(prevEvents) != 1 || prevEvents[0][0] != create.EventID() {
+		t.Errorf("got prev_events %s, want the create event", room.Timeline.Events[0]["prev_events"])
+	}
+	if unsigned := string(room.Timeline.Events[0]["unsigned"]); unsigned != `{"transaction_id":"txn1"}` {
+		t.Errorf("got unsigned %s, want the one for the syncing device", unsigned)
+	}
+}
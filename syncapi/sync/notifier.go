@@ -159,7 +159,8 @@ func (n *Notifier) OnNewSendToDevice(
 	n.wakeupUserDevice(userID, deviceIDs, n.currPos)
 }
 
-// OnNewReceipt updates the current position
+// OnNewTyping updates the current position and wakes up all users joined
+// to the room
 func (n *Notifier) OnNewTyping(
 	roomID string,
 	posUpdate types.StreamingToken,
@@ -171,7 +172,8 @@ func (n *Notifier) OnNewTyping(
 	n.wakeupUsers(n.joinedUsers(roomID), nil, n.currPos)
 }
 
-// OnNewReceipt updates the current position
+// OnNewReceipt updates the current position and wakes up all users joined
+// to the room
 func (n *Notifier) OnNewReceipt(
 	roomID string,
 	posUpdate types.StreamingToken,
@@ -183,6 +185,44 @@ func (n *Notifier) OnNewReceipt(
 	n.wakeupUsers(n.joinedUsers(roomID), nil, n.currPos)
 }
 
+// OnNewPrivateReceipt updates the current position and wakes up the user
+// who sent the receipt, since nobody else can see private receipts
+func (n *Notifier) OnNewPrivateReceipt(
+	userID string,
+	posUpdate types.StreamingToken,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n.wakeupUsers([]string{userID}, nil, n.currPos)
+}
+
+// OnNewAccountData updates the current position and wakes up the user whose
+// account data changed
+func (n *Notifier) OnNewAccountData(
+	userID string,
+	posUpdate types.StreamingToken,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n.wakeupUsers([]string{userID}, nil, n.currPos)
+}
+
+// OnNewPresence updates the current position and wakes up the user whose
+// presence changed, along with all users who share a room with them
+func (n *Notifier) OnNewPresence(
+	posUpdate types.StreamingToken, userID string,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n.wakeupUsers(n.sharedUsers(userID), nil, n.currPos)
+}
+
 func (n *Notifier) OnNewKeyChange(
 	posUpdate types.StreamingToken, wakeUserID, keyChangeUserID string,
 ) {
@@ -374,6 +414,21 @@ func (n *Notifier) joinedUsers(roomID string) (userIDs []string) {
 	return n.roomIDToJoinedUsers[roomID].values()
 }
 
+// sharedUsers returns the given user along with all users who share a room
+// with them. Not thread-safe: must be called on a locked Notifier.
+func (n *Notifier) sharedUsers(userID string) []string {
+	sharedUsers := userIDSet{userID: true}
+	for _, users := range n.roomIDToJoinedUsers {
+		if _, ok := users[userID]; !ok {
+			continue
+		}
+		for user := range users {
+			sharedUsers.add(user)
+		}
+	}
+	return sharedUsers.values()
+}
+
 // Not thread-safe: must be called on the OnNewEvent goroutine only
 func (n *Notifier) addPeekingDevice(roomID, userID, deviceID string) {
 	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
@@ -204,6 +204,80 @@ func TestNewInviteEventForUser(t *testing.T) {
 	wg.Wait()
 }
 
+// Test that an account data update wakes up the user's request
+func TestNewAccountDataForUser(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	syncPositionAccountData := syncPositionBefore
+	syncPositionAccountData.AccountDataPosition = 1
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(alice, aliceDev, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewAccountDataForUser error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAccountData)
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, alice, aliceDev)
+	waitForBlocking(stream, 1)
+
+	n.OnNewAccountData(alice, types.StreamingToken{AccountDataPosition: 1})
+
+	wg.Wait()
+}
+
+// Test that a private receipt only wakes up the user who sent it, and that
+// a public receipt wakes up everyone in the room
+func TestNewReceiptWakesUsers(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice, bob},
+	})
+	syncPositionPrivateReceipt := syncPositionBefore
+	syncPositionPrivateReceipt.ReceiptPosition = 1
+	syncPositionPublicReceipt := syncPositionBefore
+	syncPositionPublicReceipt.ReceiptPosition = 2
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(alice, aliceDev, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewReceiptWakesUsers error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionPrivateReceipt)
+		wg.Done()
+	}()
+
+	bobListener := n.GetListener(newTestSyncRequest(bob, bobDev, syncPositionBefore))
+	defer bobListener.Close()
+	aliceStream := lockedFetchUserStream(n, alice, aliceDev)
+	bobStream := lockedFetchUserStream(n, bob, bobDev)
+	waitForBlocking(aliceStream, 1)
+	waitForBlocking(bobStream, 1)
+
+	n.OnNewPrivateReceipt(alice, types.StreamingToken{ReceiptPosition: 1})
+	wg.Wait()
+
+	select {
+	case <-bobListener.GetNotifyChannel(syncPositionBefore):
+		t.Fatalf("expected bob not to be woken by alice's private receipt")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	n.OnNewReceipt(roomID, types.StreamingToken{ReceiptPosition: 2})
+
+	select {
+	case <-bobListener.GetNotifyChannel(syncPositionBefore):
+		mustEqualPositions(t, bobListener.GetSyncPosition(), syncPositionPublicReceipt)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected bob to be woken by a public receipt")
+	}
+}
+
 // Test an EDU-only update wakes up the request.
 // TODO: Fix this test, invites wake up with an incremented
 // PDU position, not EDU position
@@ -326,6 +400,65 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	time.Sleep(1 * time.Millisecond)
 }
 
+// Test that a peeking device is woken up by new events in the room, and stops
+// being woken up once the peek is retired.
+func TestNewEventAndPeekingRoom(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice},
+	})
+	n.OnNewPeek(roomID, bob, bobDev)
+
+	var peekWG sync.WaitGroup
+	peekWG.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewEventAndPeekingRoom error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter)
+		peekWG.Done()
+	}()
+	bobStream := lockedFetchUserStream(n, bob, bobDev)
+	waitForBlocking(bobStream, 1)
+	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter)
+	peekWG.Wait()
+
+	// Retire the peek and send another event. Alice should be woken up but
+	// not the device that was peeking.
+	n.OnRetirePeek(roomID, bob, bobDev)
+
+	var aliceWG sync.WaitGroup
+	aliceStream := lockedFetchUserStream(n, alice, aliceDev)
+	aliceWG.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(alice, aliceDev, syncPositionAfter))
+		if err != nil {
+			t.Errorf("TestNewEventAndPeekingRoom error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter2)
+		aliceWG.Done()
+	}()
+
+	go func() {
+		// this should timeout with an error (but the main goroutine won't wait for the timeout explicitly)
+		_, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionAfter))
+		if err == nil {
+			t.Errorf("TestNewEventAndPeekingRoom expect error but got nil")
+		}
+	}()
+
+	waitForBlocking(aliceStream, 1)
+	waitForBlocking(bobStream, 1)
+
+	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter2)
+	aliceWG.Wait()
+
+	// it's possible that at this point alice has been informed and the peeker is about to be informed,
+	// so wait for a fraction of a second to account for this race
+	time.Sleep(1 * time.Millisecond)
+}
+
 func waitForEvents(n *Notifier, req syncRequest) (types.StreamingToken, error) {
 	listener := n.GetListener(req)
 	defer listener.Close()
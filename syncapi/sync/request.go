@@ -21,6 +21,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -32,14 +33,6 @@ import (
 const defaultSyncTimeout = time.Duration(0)
 const DefaultTimelineLimit = 20
 
-type filter struct {
-	Room struct {
-		Timeline struct {
-			Limit *int `json:"limit"`
-		} `json:"timeline"`
-	} `json:"room"`
-}
-
 // syncRequest represents a /sync request, with sensible defaults/sanity checks applied.
 type syncRequest struct {
 	ctx           context.Context
@@ -48,10 +41,11 @@ type syncRequest struct {
 	timeout       time.Duration
 	since         types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
+	filter        gomatrixserverlib.Filter
 	log           *log.Entry
 }
 
-func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Database) (*syncRequest, error) {
+func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Database, cfg *config.SyncAPI) (*syncRequest, error) {
 	timeout := getTimeout(req.URL.Query().Get("timeout"))
 	fullState := req.URL.Query().Get("full_state")
 	wantFullState := fullState != "" && fullState != "false"
@@ -64,15 +58,16 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		}
 	}
 	timelineLimit := DefaultTimelineLimit
-	// TODO: read from stored filters too
+	f := gomatrixserverlib.DefaultFilter()
 	filterQuery := req.URL.Query().Get("filter")
 	if filterQuery != "" {
 		if filterQuery[0] == '{' {
-			// attempt to parse the timeline limit at least
-			var f filter
-			err := json.Unmarshal([]byte(filterQuery), &f)
-			if err == nil && f.Room.Timeline.Limit != nil {
-				timelineLimit = *f.Room.Timeline.Limit
+			// attempt to parse the filter, keeping the defaults for anything
+			// that isn't specified
+			inlineFilter := f
+			if err := json.Unmarshal([]byte(filterQuery), &inlineFilter); err == nil {
+				f = inlineFilter
+				timelineLimit = f.Room.Timeline.Limit
 			}
 		} else {
 			// attempt to load the filter ID
@@ -81,13 +76,16 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 				util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 				return nil, err
 			}
-			f, err := syncDB.GetFilter(req.Context(), localpart, filterQuery)
+			storedFilter, err := syncDB.GetFilter(req.Context(), localpart, filterQuery)
 			if err == nil {
+				f = *storedFilter
 				timelineLimit = f.Room.Timeline.Limit
 			}
 		}
 	}
-	// TODO: Additional query params: set_presence, filter
+	if cfg.MaxTimelineLimit > 0 && timelineLimit > cfg.MaxTimelineLimit {
+		timelineLimit = cfg.MaxTimelineLimit
+	}
 	return &syncRequest{
 		ctx:           req.Context(),
 		device:        device,
@@ -95,6 +93,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		since:         since,
 		wantFullState: wantFullState,
 		limit:         timelineLimit,
+		filter:        f,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
@@ -0,0 +1,98 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestNewSyncRequestInlineFilter(t *testing.T) {
+	device := userapi.Device{UserID: "@alice:localhost", ID: "ALICEDEVICE"}
+	newRequest := func(filter string) *syncRequest {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/_matrix/client/r0/sync?filter="+url.QueryEscape(filter), nil)
+		syncReq, err := newSyncRequest(req, device, nil, &config.SyncAPI{})
+		if err != nil {
+			t.Fatalf("failed to create sync request: %s", err)
+		}
+		return syncReq
+	}
+
+	syncReq := newRequest(`{"room":{"rooms":["!room:localhost"],"not_rooms":["!other:localhost"]}}`)
+	if !reflect.DeepEqual(syncReq.filter.Room.Rooms, []string{"!room:localhost"}) {
+		t.Errorf("got rooms %v from filter", syncReq.filter.Room.Rooms)
+	}
+	if !reflect.DeepEqual(syncReq.filter.Room.NotRooms, []string{"!other:localhost"}) {
+		t.Errorf("got not_rooms %v from filter", syncReq.filter.Room.NotRooms)
+	}
+	// the timeline limit isn't in the filter, so should be the default
+	if syncReq.limit != DefaultTimelineLimit {
+		t.Errorf("got timeline limit %d, want %d", syncReq.limit, DefaultTimelineLimit)
+	}
+
+	syncReq = newRequest(`{"room":{"timeline":{"limit":5}}}`)
+	if syncReq.limit != 5 {
+		t.Errorf("got timeline limit %d, want 5", syncReq.limit)
+	}
+	if syncReq.filter.Room.Rooms != nil {
+		t.Errorf("expected no room restriction, got %v", syncReq.filter.Room.Rooms)
+	}
+}
+
+func TestNewSyncRequestClampsTimelineLimit(t *testing.T) {
+	device := userapi.Device{UserID: "@alice:localhost", ID: "ALICEDEVICE"}
+	cfg := &config.SyncAPI{MaxTimelineLimit: 50}
+	testCases := []struct {
+		filter string
+		want   int
+	}{
+		{`{"room":{"timeline":{"limit":10000}}}`, 50},
+		{`{"room":{"timeline":{"limit":50}}}`, 50},
+		{`{"room":{"timeline":{"limit":5}}}`, 5},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/_matrix/client/r0/sync?filter="+url.QueryEscape(tc.filter), nil)
+		syncReq, err := newSyncRequest(req, device, nil, cfg)
+		if err != nil {
+			t.Fatalf("failed to create sync request: %s", err)
+		}
+		if syncReq.limit != tc.want {
+			t.Errorf("filter %s: got timeline limit %d, want %d", tc.filter, syncReq.limit, tc.want)
+		}
+	}
+}
+
+func TestSyncRequestWithMalformedSinceToken(t *testing.T) {
+	device := userapi.Device{UserID: "@alice:localhost", ID: "ALICEDEVICE"}
+	for _, since := range []string{"garbage", "s1_2_3", "s1_0_0_0_0_0.dl-x-1"} {
+		req := httptest.NewRequest("GET", "/_matrix/client/r0/sync?since="+url.QueryEscape(since), nil)
+		res := (&RequestPool{cfg: &config.SyncAPI{}}).OnIncomingSyncRequest(req, &device)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("since %q: got HTTP %d, want %d", since, res.Code, http.StatusBadRequest)
+			continue
+		}
+		if jsonErr, ok := res.JSON.(*jsonerror.MatrixError); !ok || jsonErr.ErrCode != "M_UNKNOWN_TOKEN" {
+			t.Errorf("since %q: got error %+v, want M_UNKNOWN_TOKEN", since, res.JSON)
+		}
+	}
+}
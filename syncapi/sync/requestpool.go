@@ -18,6 +18,7 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -47,6 +49,7 @@ type RequestPool struct {
 	Notifier *Notifier
 	keyAPI   keyapi.KeyInternalAPI
 	rsAPI    roomserverAPI.RoomserverInternalAPI
+	eduAPI   eduserverAPI.EDUServerInputAPI
 	lastseen sync.Map
 }
 
@@ -54,9 +57,9 @@ type RequestPool struct {
 func NewRequestPool(
 	db storage.Database, cfg *config.SyncAPI, n *Notifier,
 	userAPI userapi.UserInternalAPI, keyAPI keyapi.KeyInternalAPI,
-	rsAPI roomserverAPI.RoomserverInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, eduAPI eduserverAPI.EDUServerInputAPI,
 ) *RequestPool {
-	rp := &RequestPool{db, cfg, userAPI, n, keyAPI, rsAPI, sync.Map{}}
+	rp := &RequestPool{db, cfg, userAPI, n, keyAPI, rsAPI, eduAPI, sync.Map{}}
 	go rp.cleanLastSeen()
 	return rp
 }
@@ -100,6 +103,25 @@ func (rp *RequestPool) updateLastSeen(req *http.Request, device *userapi.Device)
 	rp.lastseen.Store(device.UserID+device.ID, time.Now())
 }
 
+// updatePresence marks the user as active with the presence given by the
+// set_presence parameter, which defaults to online. Syncing with a
+// set_presence of offline doesn't change the user's presence.
+func (rp *RequestPool) updatePresence(req *http.Request, device *userapi.Device) {
+	presence := req.URL.Query().Get("set_presence")
+	switch presence {
+	case "":
+		presence = eduserverAPI.PresenceOnline
+	case eduserverAPI.PresenceOnline, eduserverAPI.PresenceUnavailable:
+	default:
+		return
+	}
+	if err := eduserverAPI.SendPresenceActivity(
+		req.Context(), rp.eduAPI, device.UserID, presence, gomatrixserverlib.AsTimestamp(time.Now()),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Warn("eduserverAPI.SendPresenceActivity failed")
+	}
+}
+
 func init() {
 	prometheus.MustRegister(
 		activeSyncRequests, waitingSyncRequests,
@@ -131,7 +153,13 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	var syncData *types.Response
 
 	// Extract values from request
-	syncReq, err := newSyncRequest(req, *device, rp.db)
+	syncReq, err := newSyncRequest(req, *device, rp.db, rp.cfg)
+	if errors.Is(err, types.ErrMalformedToken) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnknownToken("Invalid since token: " + err.Error()),
+		}
+	}
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -151,6 +179,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	defer activeSyncRequests.Dec()
 
 	rp.updateLastSeen(req, device)
+	rp.updatePresence(req, device)
 
 	currPos := rp.Notifier.CurrentPosition()
 
@@ -161,10 +190,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			return jsonerror.InternalServerError()
 		}
 		logger.WithField("next", syncData.NextBatch).Info("Responding immediately")
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: syncData,
-		}
+		return rp.syncResponse(syncReq, syncData)
 	}
 
 	waitingSyncRequests.Inc()
@@ -216,12 +242,23 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 
 		if !syncData.IsEmpty() || hasTimedOut {
 			logger.WithField("next", syncData.NextBatch).WithField("timed_out", hasTimedOut).Info("Responding")
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: syncData,
-			}
+			return rp.syncResponse(syncReq, syncData)
+		}
+	}
+}
+
+// syncResponse returns the sync data in the event format from the filter.
+func (rp *RequestPool) syncResponse(req *syncRequest, syncData *types.Response) util.JSONResponse {
+	if req.filter.EventFormat != eventFormatFederation {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: syncData,
 		}
 	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationFormatResponse(syncData),
+	}
 }
 
 func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -297,7 +334,7 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 	}
 
 	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
-	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition, &accountDataFilter)
+	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.AccountDataPosition, &accountDataFilter)
 	if err != nil {
 		return res, fmt.Errorf("rp.appendAccountData: %w", err)
 	}
@@ -327,10 +364,46 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 		}
 	}
 
-	res.NextBatch.SendToDevicePosition = lastPos
+	rp.removeForgottenRooms(req.ctx, req.device.UserID, res)
+
+	// Only return the rooms that the filter asked for. This is done last so
+	// that nothing can add the excluded rooms back in.
+	res.ApplyRoomFilter(&req.filter.Room)
+
+	// The send-to-device position tells us which messages the client has
+	// received when it next syncs, so it must cover everything we've sent but
+	// never go backwards.
+	if lastPos > res.NextBatch.SendToDevicePosition {
+		res.NextBatch.SendToDevicePosition = lastPos
+	}
+	if req.since.SendToDevicePosition > res.NextBatch.SendToDevicePosition {
+		res.NextBatch.SendToDevicePosition = req.since.SendToDevicePosition
+	}
 	return res, err
 }
 
+// removeForgottenRooms removes the rooms that the user has forgotten from
+// the leave section of the response, so that they don't see them again.
+func (rp *RequestPool) removeForgottenRooms(
+	ctx context.Context, userID string, res *types.Response,
+) {
+	for roomID := range res.Rooms.Leave {
+		var membershipRes roomserverAPI.QueryMembershipForUserResponse
+		if err := rp.rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+			RoomID: roomID,
+			UserID: userID,
+		}, &membershipRes); err != nil {
+			// The roomserver may not know about rooms that we were only
+			// invited to over federation, which can't have been forgotten.
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Warn("rp.rsAPI.QueryMembershipForUser failed")
+			continue
+		}
+		if membershipRes.IsRoomForgotten {
+			delete(res.Rooms.Leave, roomID)
+		}
+	}
+}
+
 func (rp *RequestPool) appendDeviceLists(
 	data *types.Response, userID string, since, to types.StreamingToken,
 ) (*types.Response, error) {
@@ -347,11 +420,6 @@ func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
 	accountDataFilter *gomatrixserverlib.EventFilter,
 ) (*types.Response, error) {
-	// TODO: Account data doesn't have a sync position of its own, meaning that
-	// account data might be sent multiple time to the client if multiple account
-	// data keys were set between two message. This isn't a huge issue since the
-	// duplicate data doesn't represent a huge quantity of data, but an optimisation
-	// here would be making sure each data is sent only once to the client.
 	if req.since.IsEmpty() {
 		// If this is the initial sync, we don't need to check if a data has
 		// already been sent. Instead, we send the whole batch.
@@ -387,15 +455,9 @@ func (rp *RequestPool) appendAccountData(
 	}
 
 	r := types.Range{
-		From: req.since.PDUPosition,
+		From: req.since.AccountDataPosition,
 		To:   currentPos,
 	}
-	// If both positions are the same, it means that the data was saved after the
-	// latest room event. In that case, we need to decrement the old position as
-	// results are exclusive of Low.
-	if r.Low() == r.High() {
-		r.From--
-	}
 
 	// Sync is not initial, get all account data since the latest sync
 	dataTypes, err := rp.db.GetAccountDataInRange(
@@ -0,0 +1,58 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+type forgottenRoomsRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	forgotten map[string]bool
+}
+
+func (r *forgottenRoomsRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *roomserverAPI.QueryMembershipForUserRequest, res *roomserverAPI.QueryMembershipForUserResponse) error {
+	if req.RoomID == "!unknown:remote" {
+		return fmt.Errorf("unknown room %s", req.RoomID)
+	}
+	res.HasBeenInRoom = true
+	res.IsRoomForgotten = r.forgotten[req.RoomID]
+	return nil
+}
+
+func TestForgottenRoomsAreRemovedFromSync(t *testing.T) {
+	rp := &RequestPool{rsAPI: &forgottenRoomsRoomserverAPI{
+		forgotten: map[string]bool{"!forgotten:localhost": true},
+	}}
+	res := types.NewResponse()
+	res.Rooms.Leave["!forgotten:localhost"] = *types.NewLeaveResponse()
+	res.Rooms.Leave["!left:localhost"] = *types.NewLeaveResponse()
+	res.Rooms.Leave["!unknown:remote"] = *types.NewLeaveResponse()
+
+	rp.removeForgottenRooms(context.Background(), "@alice:localhost", res)
+	if _, ok := res.Rooms.Leave["!forgotten:localhost"]; ok {
+		t.Errorf("forgotten room is still in the leave section")
+	}
+	for _, roomID := range []string{"!left:localhost", "!unknown:remote"} {
+		if _, ok := res.Rooms.Leave[roomID]; !ok {
+			t.Errorf("room %s was removed from the leave section", roomID)
+		}
+	}
+}
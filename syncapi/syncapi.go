@@ -20,6 +20,8 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 
+	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -28,6 +30,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/syncapi/consumers"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/routing"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
@@ -37,10 +40,14 @@ import (
 // component.
 func AddPublicRoutes(
 	router *mux.Router,
+	dendriteRouter *mux.Router,
 	userAPI userapi.UserInternalAPI,
 	rsAPI api.RoomserverInternalAPI,
 	keyAPI keyapi.KeyInternalAPI,
+	eduAPI eduserverAPI.EDUServerInputAPI,
 	federation *gomatrixserverlib.FederationClient,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
+	keyRing gomatrixserverlib.JSONVerifier,
 	cfg *config.SyncAPI,
 ) {
 	consumer, _ := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
@@ -49,6 +56,7 @@ func AddPublicRoutes(
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to sync db")
 	}
+	syncDB.SetQueryChunkSize(cfg.QueryChunkSize)
 
 	pos, err := syncDB.SyncPosition(context.Background())
 	if err != nil {
@@ -61,18 +69,22 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start notifier")
 	}
 
-	requestPool := sync.NewRequestPool(syncDB, cfg, notifier, userAPI, keyAPI, rsAPI)
+	// Working out device list changes needs to know who shares rooms with
+	// whom, so remember that until the room memberships change.
+	sharedUsers := internal.NewSharedUsersCache(rsAPI, cfg.SharedUsersCacheLifetime)
+
+	requestPool := sync.NewRequestPool(syncDB, cfg, notifier, userAPI, keyAPI, sharedUsers, eduAPI)
 
 	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
 		cfg.Matrix.ServerName, string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputKeyChangeEvent)),
-		consumer, notifier, keyAPI, rsAPI, syncDB,
+		consumer, notifier, keyAPI, sharedUsers, syncDB,
 	)
 	if err = keyChangeConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start key change consumer")
 	}
 
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
-		cfg, consumer, notifier, syncDB, rsAPI,
+		cfg, consumer, notifier, syncDB, rsAPI, sharedUsers,
 	)
 	if err = roomConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start room server consumer")
@@ -106,5 +118,18 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start receipts consumer")
 	}
 
-	routing.Setup(router, requestPool, syncDB, userAPI, federation, rsAPI, cfg)
+	if cfg.Matrix.Presence.Enabled() {
+		presenceConsumer := consumers.NewOutputPresenceEventConsumer(
+			cfg, consumer, notifier, syncDB,
+		)
+		if err = presenceConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start presence consumer")
+		}
+	}
+
+	if cfg.Matrix.Retention.Enabled {
+		go internal.PurgeExpiredEventsPeriodically(&cfg.Matrix.Retention, syncDB)
+	}
+
+	routing.Setup(router, dendriteRouter, requestPool, syncDB, userAPI, federation, fsAPI, keyRing, rsAPI, cfg)
 }
@@ -19,7 +19,9 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
@@ -33,6 +35,9 @@ var (
 	// ErrInvalidSyncTokenLen is returned when the pagination token is an
 	// invalid length
 	ErrInvalidSyncTokenLen = fmt.Errorf("Sync token has an invalid length")
+	// ErrMalformedToken is wrapped by the errors returned when a stream or
+	// topology token can't be parsed, e.g. because it has been truncated.
+	ErrMalformedToken = fmt.Errorf("malformed token")
 )
 
 // StreamPosition represents the offset in the sync stream a client is at.
@@ -67,6 +72,15 @@ type StreamEvent struct {
 	ExcludeFromSync bool
 }
 
+// Relation is an event which relates to another event, as described by the
+// m.relates_to of its content.
+type Relation struct {
+	EventID        string // the event which is being related to
+	ChildEventID   string // the event which relates to EventID
+	ChildEventType string
+	RelType        string
+}
+
 // Range represents a range between two stream positions.
 type Range struct {
 	// From is the position the client has already received.
@@ -108,15 +122,37 @@ const (
 	SyncTokenTypeTopology SyncTokenType = "t"
 )
 
+// StreamingToken is a position in each of the streams that make up a sync.
+// It is sent to clients as next_batch, see String for the wire format.
 type StreamingToken struct {
 	PDUPosition          StreamPosition
 	TypingPosition       StreamPosition
 	ReceiptPosition      StreamPosition
 	SendToDevicePosition StreamPosition
 	InvitePosition       StreamPosition
+	PresencePosition     StreamPosition
+	AccountDataPosition  StreamPosition
 	DeviceListPosition   LogPosition
 }
 
+// streamTokenPositions are the stream positions of a StreamingToken in the
+// order that they appear in the wire format. New streams must only ever be
+// appended to the end, so that tokens from before a stream was added can
+// still be parsed: the positions that they don't have are left as zero.
+var streamTokenPositions = []func(t *StreamingToken) *StreamPosition{
+	func(t *StreamingToken) *StreamPosition { return &t.PDUPosition },
+	func(t *StreamingToken) *StreamPosition { return &t.TypingPosition },
+	func(t *StreamingToken) *StreamPosition { return &t.ReceiptPosition },
+	func(t *StreamingToken) *StreamPosition { return &t.SendToDevicePosition },
+	func(t *StreamingToken) *StreamPosition { return &t.InvitePosition },
+	func(t *StreamingToken) *StreamPosition { return &t.PresencePosition },
+	func(t *StreamingToken) *StreamPosition { return &t.AccountDataPosition },
+}
+
+// Tokens from before account data had its own position have six or fewer
+// positions. Account data used the PDU position until then.
+const accountDataTokenPosition = 6
+
 // This will be used as a fallback by json.Marshal.
 func (s StreamingToken) MarshalText() ([]byte, error) {
 	return []byte(s.String()), nil
@@ -128,17 +164,22 @@ func (s *StreamingToken) UnmarshalText(text []byte) (err error) {
 	return err
 }
 
+// String returns the wire format of the token, which is an "s" followed by
+// the stream positions separated by underscores, then any log positions,
+// e.g. "s1_2_3_4_5_6_7.dl-0-8".
 func (t StreamingToken) String() string {
-	posStr := fmt.Sprintf(
-		"s%d_%d_%d_%d_%d",
-		t.PDUPosition, t.TypingPosition,
-		t.ReceiptPosition, t.SendToDevicePosition,
-		t.InvitePosition,
-	)
+	var sb strings.Builder
+	sb.WriteString(string(SyncTokenTypeStream))
+	for i, pos := range streamTokenPositions {
+		if i > 0 {
+			sb.WriteByte('_')
+		}
+		sb.WriteString(strconv.FormatInt(int64(*pos(&t)), 10))
+	}
 	if dl := t.DeviceListPosition; !dl.IsEmpty() {
-		posStr += fmt.Sprintf(".dl-%d-%d", dl.Partition, dl.Offset)
+		fmt.Fprintf(&sb, ".dl-%d-%d", dl.Partition, dl.Offset)
 	}
-	return posStr
+	return sb.String()
 }
 
 // IsAfter returns true if ANY position in this token is greater than `other`.
@@ -154,6 +195,10 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 		return true
 	case t.InvitePosition > other.InvitePosition:
 		return true
+	case t.PresencePosition > other.PresencePosition:
+		return true
+	case t.AccountDataPosition > other.AccountDataPosition:
+		return true
 	case t.DeviceListPosition.IsAfter(&other.DeviceListPosition):
 		return true
 	}
@@ -161,7 +206,7 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 }
 
 func (t *StreamingToken) IsEmpty() bool {
-	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition == 0 && t.DeviceListPosition.IsEmpty()
+	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.PresencePosition+t.AccountDataPosition == 0 && t.DeviceListPosition.IsEmpty()
 }
 
 // WithUpdates returns a copy of the StreamingToken with updates applied from another StreamingToken.
@@ -193,6 +238,12 @@ func (t *StreamingToken) ApplyUpdates(other StreamingToken) {
 	if other.InvitePosition > 0 {
 		t.InvitePosition = other.InvitePosition
 	}
+	if other.PresencePosition > 0 {
+		t.PresencePosition = other.PresencePosition
+	}
+	if other.AccountDataPosition > 0 {
+		t.AccountDataPosition = other.AccountDataPosition
+	}
 	if other.DeviceListPosition.Offset > 0 {
 		t.DeviceListPosition = other.DeviceListPosition
 	}
@@ -248,25 +299,23 @@ func (t *TopologyToken) Decrement() {
 
 func NewTopologyTokenFromString(tok string) (token TopologyToken, err error) {
 	if len(tok) < 1 {
-		err = fmt.Errorf("empty topology token")
+		err = fmt.Errorf("%w: empty topology token", ErrMalformedToken)
 		return
 	}
 	if tok[0] != SyncTokenTypeTopology[0] {
-		err = fmt.Errorf("topology token must start with 't'")
+		err = fmt.Errorf("%w: topology token must start with 't'", ErrMalformedToken)
 		return
 	}
 	parts := strings.Split(tok[1:], "_")
+	if len(parts) != 2 {
+		err = fmt.Errorf("%w: topology token must have 2 positions, got %d", ErrMalformedToken, len(parts))
+		return
+	}
 	var positions [2]StreamPosition
 	for i, p := range parts {
-		if i > len(positions) {
-			break
-		}
-		var pos int
-		pos, err = strconv.Atoi(p)
-		if err != nil {
+		if positions[i], err = parseStreamPosition(p); err != nil {
 			return
 		}
-		positions[i] = StreamPosition(pos)
 	}
 	token = TopologyToken{
 		Depth:       positions[0],
@@ -275,64 +324,85 @@ func NewTopologyTokenFromString(tok string) (token TopologyToken, err error) {
 	return
 }
 
+// The number of stream positions in a token is the version of the format.
+// The oldest tokens that we accept, from before the presence position was
+// added, have five. Extra positions and unknown logs, which may be in tokens
+// from a newer version, are ignored so that clients can keep syncing after
+// a downgrade.
+const minStreamTokenPositions = 5
+
 func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	if len(tok) < 1 {
-		err = fmt.Errorf("empty stream token")
+		err = fmt.Errorf("%w: empty stream token", ErrMalformedToken)
 		return
 	}
 	if tok[0] != SyncTokenTypeStream[0] {
-		err = fmt.Errorf("stream token must start with 's'")
+		err = fmt.Errorf("%w: stream token must start with 's'", ErrMalformedToken)
 		return
 	}
 	categories := strings.Split(tok[1:], ".")
 	parts := strings.Split(categories[0], "_")
-	var positions [5]StreamPosition
+	if len(parts) < minStreamTokenPositions {
+		err = fmt.Errorf("%w: stream token must have at least %d positions, got %d", ErrMalformedToken, minStreamTokenPositions, len(parts))
+		return
+	}
 	for i, p := range parts {
-		if i > len(positions) {
-			break
-		}
-		var pos int
-		pos, err = strconv.Atoi(p)
-		if err != nil {
+		// Check all of the positions, even the ones we don't know about,
+		// so that a corrupted token isn't mistaken for a newer one.
+		var pos StreamPosition
+		if pos, err = parseStreamPosition(p); err != nil {
 			return
 		}
-		positions[i] = StreamPosition(pos)
+		if i < len(streamTokenPositions) {
+			*streamTokenPositions[i](&token) = pos
+		}
 	}
-	token = StreamingToken{
-		PDUPosition:          positions[0],
-		TypingPosition:       positions[1],
-		ReceiptPosition:      positions[2],
-		SendToDevicePosition: positions[3],
-		InvitePosition:       positions[4],
+	if len(parts) <= accountDataTokenPosition {
+		token.AccountDataPosition = token.PDUPosition
 	}
 	// dl-0-1234
 	// $log_name-$partition-$offset
+	seen := make(map[string]bool, len(categories)-1)
 	for _, logStr := range categories[1:] {
 		segments := strings.Split(logStr, "-")
-		if len(segments) != 3 {
-			err = fmt.Errorf("invalid log position %q", logStr)
+		if len(segments) != 3 || segments[0] == "" {
+			err = fmt.Errorf("%w: invalid log position %q", ErrMalformedToken, logStr)
+			return
+		}
+		if seen[segments[0]] {
+			err = fmt.Errorf("%w: duplicate log position %q", ErrMalformedToken, segments[0])
+			return
+		}
+		seen[segments[0]] = true
+		var partition int64
+		var offset StreamPosition
+		if partition, err = strconv.ParseInt(segments[1], 10, 32); err != nil || partition < 0 {
+			err = fmt.Errorf("%w: invalid partition in log position %q", ErrMalformedToken, logStr)
+			return
+		}
+		if offset, err = parseStreamPosition(segments[2]); err != nil {
 			return
 		}
 		switch segments[0] {
 		case "dl":
 			// Device list syncing
-			var partition, offset int
-			if partition, err = strconv.Atoi(segments[1]); err != nil {
-				return
-			}
-			if offset, err = strconv.Atoi(segments[2]); err != nil {
-				return
-			}
 			token.DeviceListPosition.Partition = int32(partition)
 			token.DeviceListPosition.Offset = int64(offset)
-		default:
-			err = fmt.Errorf("unrecognised token type %q", segments[0])
-			return
 		}
 	}
 	return token, nil
 }
 
+// parseStreamPosition parses a single position from a token, which must be
+// a non-negative integer.
+func parseStreamPosition(p string) (StreamPosition, error) {
+	pos, err := strconv.ParseInt(p, 10, 64)
+	if err != nil || pos < 0 {
+		return 0, fmt.Errorf("%w: invalid position %q", ErrMalformedToken, p)
+	}
+	return StreamPosition(pos), nil
+}
+
 // PrevEventRef represents a reference to a previous event in a state event upgrade
 type PrevEventRef struct {
 	PrevContent   json.RawMessage `json:"prev_content"`
@@ -387,6 +457,50 @@ func NewResponse() *Response {
 	return &res
 }
 
+// ApplyRoomFilter removes any rooms from the response that the room filter
+// excludes with its rooms or not_rooms lists.
+func (r *Response) ApplyRoomFilter(filter *gomatrixserverlib.RoomFilter) {
+	for roomID := range r.Rooms.Join {
+		if !RoomFilterAllows(filter, roomID) {
+			delete(r.Rooms.Join, roomID)
+		}
+	}
+	for roomID := range r.Rooms.Peek {
+		if !RoomFilterAllows(filter, roomID) {
+			delete(r.Rooms.Peek, roomID)
+		}
+	}
+	for roomID := range r.Rooms.Invite {
+		if !RoomFilterAllows(filter, roomID) {
+			delete(r.Rooms.Invite, roomID)
+		}
+	}
+	for roomID := range r.Rooms.Leave {
+		if !RoomFilterAllows(filter, roomID) {
+			delete(r.Rooms.Leave, roomID)
+		}
+	}
+}
+
+// RoomFilterAllows returns true if the room filter allows the given room. A
+// room is allowed if it isn't in not_rooms and, if rooms is given, is in rooms.
+func RoomFilterAllows(filter *gomatrixserverlib.RoomFilter, roomID string) bool {
+	for _, notRoomID := range filter.NotRooms {
+		if notRoomID == roomID {
+			return false
+		}
+	}
+	if filter.Rooms == nil {
+		return true
+	}
+	for _, allowedRoomID := range filter.Rooms {
+		if allowedRoomID == roomID {
+			return true
+		}
+	}
+	return false
+}
+
 // IsEmpty returns true if the response is empty, i.e. used to decided whether
 // to return the response immediately to the client or to wait for more data.
 func (r *Response) IsEmpty() bool {
@@ -398,15 +512,71 @@ func (r *Response) IsEmpty() bool {
 		len(r.ToDevice.Events) == 0
 }
 
+// PresenceContent is the content of an m.presence event, as well as the
+// response to GET /presence/{userID}/status.
+type PresenceContent struct {
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool    `json:"currently_active"`
+}
+
+// NewPresenceContent creates the presence content for the given presence,
+// working out how long ago the user was last active relative to now.
+func NewPresenceContent(presence *eduAPI.OutputPresenceEvent, now time.Time) PresenceContent {
+	content := PresenceContent{
+		Presence:        presence.Presence,
+		StatusMsg:       presence.StatusMsg,
+		CurrentlyActive: presence.Presence == eduAPI.PresenceOnline,
+	}
+	if presence.LastActiveTS > 0 {
+		content.LastActiveAgo = now.Sub(presence.LastActiveTS.Time()).Milliseconds()
+	}
+	return content
+}
+
+// NewPresenceClientEvent creates an m.presence event for a /sync response.
+func NewPresenceClientEvent(presence *eduAPI.OutputPresenceEvent, now time.Time) (gomatrixserverlib.ClientEvent, error) {
+	ev := gomatrixserverlib.ClientEvent{
+		Type:   "m.presence",
+		Sender: presence.UserID,
+	}
+	var err error
+	ev.Content, err = json.Marshal(NewPresenceContent(presence, now))
+	return ev, err
+}
+
+// Summary represents the room summary in a /sync response, which clients use
+// to calculate the room name if one isn't set.
+type Summary struct {
+	Heroes             []string `json:"m.heroes,omitempty"`
+	JoinedMemberCount  *int     `json:"m.joined_member_count,omitempty"`
+	InvitedMemberCount *int     `json:"m.invited_member_count,omitempty"`
+}
+
+// UnreadNotifications represents the notification counts of a room in a /sync response.
+type UnreadNotifications struct {
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+}
+
 // JoinResponse represents a /sync response for a room which is under the 'join' or 'peek' key.
 type JoinResponse struct {
-	State struct {
+	Summary             *Summary             `json:"summary,omitempty"`
+	UnreadNotifications *UnreadNotifications `json:"unread_notifications,omitempty"`
+	State               struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
+		// PDUs are the full events behind Events, for the federation event
+		// format.
+		PDUs []*gomatrixserverlib.HeaderedEvent `json:"-"`
 	} `json:"state"`
 	Timeline struct {
 		Events    []gomatrixserverlib.ClientEvent `json:"events"`
 		Limited   bool                            `json:"limited"`
 		PrevBatch *TopologyToken                  `json:"prev_batch,omitempty"`
+		// PDUs are the full events behind Events, for the federation event
+		// format.
+		PDUs []*gomatrixserverlib.HeaderedEvent `json:"-"`
 	} `json:"timeline"`
 	Ephemeral struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
@@ -460,11 +630,17 @@ func NewInviteResponse(event *gomatrixserverlib.HeaderedEvent) *InviteResponse {
 type LeaveResponse struct {
 	State struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
+		// PDUs are the full events behind Events, for the federation event
+		// format.
+		PDUs []*gomatrixserverlib.HeaderedEvent `json:"-"`
 	} `json:"state"`
 	Timeline struct {
 		Events    []gomatrixserverlib.ClientEvent `json:"events"`
 		Limited   bool                            `json:"limited"`
 		PrevBatch *TopologyToken                  `json:"prev_batch,omitempty"`
+		// PDUs are the full events behind Events, for the federation event
+		// format.
+		PDUs []*gomatrixserverlib.HeaderedEvent `json:"-"`
 	} `json:"timeline"`
 }
 
@@ -2,7 +2,9 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -10,10 +12,10 @@ import (
 
 func TestNewSyncTokenWithLogs(t *testing.T) {
 	tests := map[string]*StreamingToken{
-		"s4_0_0_0_0": {
+		"s4_0_0_0_0_0_0": {
 			PDUPosition: 4,
 		},
-		"s4_0_0_0_0.dl-0-123": {
+		"s4_0_0_0_0_0_0.dl-0-123": {
 			PDUPosition: 4,
 			DeviceListPosition: LogPosition{
 				Partition: 0,
@@ -40,12 +42,39 @@ func TestNewSyncTokenWithLogs(t *testing.T) {
 	}
 }
 
+func TestSyncTokenWithoutPresencePosition(t *testing.T) {
+	got, err := NewStreamTokenFromString("s3_1_2_3_5")
+	if err != nil {
+		t.Fatalf("NewStreamTokenFromString failed: %s", err)
+	}
+	want := StreamingToken{3, 1, 2, 3, 5, 0, 3, LogPosition{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatch: got %v want %v", got, want)
+	}
+}
+
+func TestSyncTokenWithoutAccountDataPosition(t *testing.T) {
+	// Account data used the PDU position before it had its own.
+	got, err := NewStreamTokenFromString("s3_1_2_3_5_8.dl-0-4")
+	if err != nil {
+		t.Fatalf("NewStreamTokenFromString failed: %s", err)
+	}
+	want := StreamingToken{3, 1, 2, 3, 5, 8, 3, LogPosition{0, 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatch: got %v want %v", got, want)
+	}
+	if got.String() != "s3_1_2_3_5_8_3.dl-0-4" {
+		t.Errorf("reserialisation mismatch: got %s", got.String())
+	}
+}
+
 func TestSyncTokens(t *testing.T) {
 	shouldPass := map[string]string{
-		"s4_0_0_0_0":        StreamingToken{4, 0, 0, 0, 0, LogPosition{}}.String(),
-		"s3_1_0_0_0.dl-1-2": StreamingToken{3, 1, 0, 0, 0, LogPosition{1, 2}}.String(),
-		"s3_1_2_3_5":        StreamingToken{3, 1, 2, 3, 5, LogPosition{}}.String(),
-		"t3_1":              TopologyToken{3, 1}.String(),
+		"s4_0_0_0_0_0_0":        StreamingToken{4, 0, 0, 0, 0, 0, 0, LogPosition{}}.String(),
+		"s3_1_0_0_0_0_2.dl-1-2": StreamingToken{3, 1, 0, 0, 0, 0, 2, LogPosition{1, 2}}.String(),
+		"s3_1_2_3_5_0_0":        StreamingToken{3, 1, 2, 3, 5, 0, 0, LogPosition{}}.String(),
+		"s3_1_2_3_5_8_9":        StreamingToken{3, 1, 2, 3, 5, 8, 9, LogPosition{}}.String(),
+		"t3_1":                  TopologyToken{3, 1}.String(),
 	}
 
 	for a, b := range shouldPass {
@@ -77,6 +106,79 @@ func TestSyncTokens(t *testing.T) {
 	}
 }
 
+func TestMalformedSyncTokens(t *testing.T) {
+	for _, tok := range []string{
+		"s1_2_3_4",
+		"s1_2_3_4_5_",
+		"s1_2_3_4_5_x",
+		"s-1_0_0_0_0_0",
+		"s1_0_0_0_0_0_-7",
+		"s99999999999999999999_0_0_0_0_0",
+		"s1_0_0_0_0_0.dl-1",
+		"s1_0_0_0_0_0.dl-a-1",
+		"s1_0_0_0_0_0.dl--1-1",
+		"s1_0_0_0_0_0.dl-0-1.dl-0-2",
+		"s1_0_0_0_0_0.",
+		"s1_0_0_0_0_0.-0-1",
+		"s\x00garbage",
+	} {
+		if _, err := NewStreamTokenFromString(tok); !errors.Is(err, ErrMalformedToken) {
+			t.Errorf("NewStreamTokenFromString %q: got error %v, want ErrMalformedToken", tok, err)
+		}
+	}
+	for _, tok := range []string{"t1", "t1_2_3", "t-1_2", "t1_x"} {
+		if _, err := NewTopologyTokenFromString(tok); !errors.Is(err, ErrMalformedToken) {
+			t.Errorf("NewTopologyTokenFromString %q: got error %v, want ErrMalformedToken", tok, err)
+		}
+	}
+}
+
+func TestSyncTokenFromNewerVersion(t *testing.T) {
+	// Positions and logs that we don't know about yet are ignored.
+	got, err := NewStreamTokenFromString("s1_2_3_4_5_6_7_8.xx-3-9.dl-1-10")
+	if err != nil {
+		t.Fatalf("NewStreamTokenFromString failed: %s", err)
+	}
+	want := StreamingToken{1, 2, 3, 4, 5, 6, 7, LogPosition{1, 10}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatch: got %v want %v", got, want)
+	}
+}
+
+func TestMultiStreamSyncTokenRoundTrip(t *testing.T) {
+	want := StreamingToken{
+		PDUPosition:          12,
+		TypingPosition:       3,
+		ReceiptPosition:      45,
+		SendToDevicePosition: 6,
+		InvitePosition:       7,
+		PresencePosition:     89,
+		AccountDataPosition:  13,
+		DeviceListPosition:   LogPosition{Partition: 2, Offset: 1011},
+	}
+	got, err := NewStreamTokenFromString(want.String())
+	if err != nil {
+		t.Fatalf("NewStreamTokenFromString %q failed: %s", want.String(), err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip mismatch: got %v want %v", got, want)
+	}
+
+	// The same must be true when the token goes through JSON, as it does
+	// for next_batch.
+	j, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	got = StreamingToken{}
+	if err = json.Unmarshal(j, &got); err != nil {
+		t.Fatalf("json.Unmarshal %s failed: %s", string(j), err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON round trip mismatch: got %v want %v", got, want)
+	}
+}
+
 func TestNewInviteResponse(t *testing.T) {
 	event := `{"auth_events":["$SbSsh09j26UAXnjd3RZqf2lyA3Kw2sY_VZJVZQAV9yA","$EwL53onrLwQ5gL8Dv3VrOOCvHiueXu2ovLdzqkNi3lo","$l2wGmz9iAwevBDGpHT_xXLUA5O8BhORxWIGU1cGi1ZM","$GsWFJLXgdlF5HpZeyWkP72tzXYWW3uQ9X28HBuTztHE"],"content":{"avatar_url":"","displayname":"neilalexander","membership":"invite"},"depth":9,"hashes":{"sha256":"8p+Ur4f8vLFX6mkIXhxI0kegPG7X3tWy56QmvBkExAg"},"origin":"matrix.org","origin_server_ts":1602087113066,"prev_events":["$1v-O6tNwhOZcA8bvCYY-Dnj1V2ZDE58lLPxtlV97S28"],"prev_state":[],"room_id":"!XbeXirGWSPXbEaGokF:matrix.org","sender":"@neilalexander:matrix.org","signatures":{"dendrite.neilalexander.dev":{"ed25519:BMJi":"05KQ5lPw0cSFsE4A0x1z7vi/3cc8bG4WHUsFWYkhxvk/XkXMGIYAYkpNThIvSeLfdcHlbm/k10AsBSKH8Uq4DA"},"matrix.org":{"ed25519:a_RXGa":"jeovuHr9E/x0sHbFkdfxDDYV/EyoeLi98douZYqZ02iYddtKhfB7R3WLay/a+D3V3V7IW0FUmPh/A404x5sYCw"}},"state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member","unsigned":{"age":2512,"invite_room_state":[{"content":{"join_rule":"invite"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"avatar_url":"mxc://matrix.org/BpDaozLwgLnlNStxDxvLzhPr","displayname":"neilalexander","membership":"join"},"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:matrix.org","type":"m.room.member"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"}]},"_room_version":"5"}`
 	expected := `{"invite_state":{"events":[{"content":{"join_rule":"invite"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"avatar_url":"mxc://matrix.org/BpDaozLwgLnlNStxDxvLzhPr","displayname":"neilalexander","membership":"join"},"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:matrix.org","type":"m.room.member"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"},{"content":{"avatar_url":"","displayname":"neilalexander","membership":"invite"},"event_id":"$GQmw8e8-26CQv1QuFoHBHpKF1hQj61Flg3kvv_v_XWs","origin_server_ts":1602087113066,"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member"}]}}`
@@ -96,3 +198,70 @@ func TestNewInviteResponse(t *testing.T) {
 		t.Fatalf("Invite response didn't contain correct info")
 	}
 }
+
+func TestApplyRoomFilter(t *testing.T) {
+	newResponse := func() *Response {
+		res := NewResponse()
+		res.Rooms.Join["!joined:localhost"] = *NewJoinResponse()
+		res.Rooms.Join["!other_joined:localhost"] = *NewJoinResponse()
+		res.Rooms.Peek["!peeked:localhost"] = *NewJoinResponse()
+		res.Rooms.Invite["!invited:localhost"] = InviteResponse{}
+		res.Rooms.Leave["!left:localhost"] = *NewLeaveResponse()
+		return res
+	}
+	roomIDs := func(res *Response) []string {
+		var ids []string
+		for _, rooms := range []interface{}{res.Rooms.Join, res.Rooms.Peek, res.Rooms.Invite, res.Rooms.Leave} {
+			for _, roomID := range reflect.ValueOf(rooms).MapKeys() {
+				ids = append(ids, roomID.String())
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	testCases := []struct {
+		name   string
+		filter gomatrixserverlib.RoomFilter
+		want   []string
+	}{
+		{
+			name: "no filter",
+			want: []string{"!invited:localhost", "!joined:localhost", "!left:localhost", "!other_joined:localhost", "!peeked:localhost"},
+		},
+		{
+			name:   "one room",
+			filter: gomatrixserverlib.RoomFilter{Rooms: []string{"!joined:localhost"}},
+			want:   []string{"!joined:localhost"},
+		},
+		{
+			name:   "rooms in each section",
+			filter: gomatrixserverlib.RoomFilter{Rooms: []string{"!invited:localhost", "!left:localhost", "!peeked:localhost"}},
+			want:   []string{"!invited:localhost", "!left:localhost", "!peeked:localhost"},
+		},
+		{
+			name:   "not rooms",
+			filter: gomatrixserverlib.RoomFilter{NotRooms: []string{"!joined:localhost", "!invited:localhost"}},
+			want:   []string{"!left:localhost", "!other_joined:localhost", "!peeked:localhost"},
+		},
+		{
+			name: "not rooms wins",
+			filter: gomatrixserverlib.RoomFilter{
+				Rooms:    []string{"!joined:localhost", "!other_joined:localhost"},
+				NotRooms: []string{"!joined:localhost"},
+			},
+			want: []string{"!other_joined:localhost"},
+		},
+		{
+			name:   "empty rooms",
+			filter: gomatrixserverlib.RoomFilter{Rooms: []string{}},
+		},
+	}
+	for _, tc := range testCases {
+		res := newResponse()
+		res.ApplyRoomFilter(&tc.filter)
+		if got := roomIDs(res); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got rooms %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
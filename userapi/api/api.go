@@ -32,12 +32,107 @@ type UserInternalAPI interface {
 	PerformLastSeenUpdate(ctx context.Context, req *PerformLastSeenUpdateRequest, res *PerformLastSeenUpdateResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
+	PerformOpenIDTokenCreation(ctx context.Context, req *PerformOpenIDTokenCreationRequest, res *PerformOpenIDTokenCreationResponse) error
+	PerformKeyBackup(ctx context.Context, req *PerformKeyBackupRequest, res *PerformKeyBackupResponse) error
+	PerformLoginTokenCreation(ctx context.Context, req *PerformLoginTokenCreationRequest, res *PerformLoginTokenCreationResponse) error
+	PerformLoginTokenConsumption(ctx context.Context, req *PerformLoginTokenConsumptionRequest, res *PerformLoginTokenConsumptionResponse) error
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
 	QuerySearchProfiles(ctx context.Context, req *QuerySearchProfilesRequest, res *QuerySearchProfilesResponse) error
+	QueryOpenIDToken(ctx context.Context, req *QueryOpenIDTokenRequest, res *QueryOpenIDTokenResponse) error
+	QueryKeyBackup(ctx context.Context, req *QueryKeyBackupRequest, res *QueryKeyBackupResponse) error
+}
+
+// PerformKeyBackupRequest is the request for PerformKeyBackup. If Version is
+// empty then a new backup version is created, otherwise the given version is
+// updated with the new auth data, deleted, or has keys uploaded to it.
+type PerformKeyBackupRequest struct {
+	UserID       string
+	Version      string // optional: the version to modify, or empty to create a new version
+	AuthData     json.RawMessage
+	Algorithm    string
+	DeleteBackup bool // if true will delete the backup based on 'Version'.
+
+	// The keys to upload, if any. A backup version must be specified.
+	Keys []InternalKeyBackupSession
+}
+
+// PerformKeyBackupResponse is the response for PerformKeyBackup
+type PerformKeyBackupResponse struct {
+	Error    string // set if there was a problem performing the request
+	BadInput bool   // if set, the Error was due to bad input (HTTP 400)
+
+	Exists  bool   // set to true if the Version exists
+	Version string // the newly created version if Version was empty, else the version that was modified
+
+	// If keys were uploaded, the new key count and etag for the version.
+	// WrongVersion is set if the keys were uploaded to a version which
+	// isn't the latest, in which case Version holds the latest version.
+	KeyCount     int64
+	KeyETag      string
+	WrongVersion bool
+}
+
+// QueryKeyBackupRequest is the request for QueryKeyBackup
+type QueryKeyBackupRequest struct {
+	UserID  string
+	Version string // the version to query, or the latest version if this is empty
+
+	// If set, the backed up keys are returned too, optionally filtered
+	// down to a room or a session within a room.
+	ReturnKeys       bool
+	KeysForRoomID    string
+	KeysForSessionID string
+}
+
+// QueryKeyBackupResponse is the response for QueryKeyBackup
+type QueryKeyBackupResponse struct {
+	Error  string
+	Exists bool
+
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Count     int64           `json:"count"`
+	ETag      string          `json:"etag"`
+	Version   string          `json:"version"`
+
+	Keys map[string]map[string]KeyBackupSession // the keys if ReturnKeys=true: room ID -> session ID -> key
+}
+
+// KeyBackupSession is the encrypted data for a single megolm session in a
+// key backup.
+type KeyBackupSession struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// ShouldReplaceRoomKey returns true if the uploaded session should replace the
+// existing one, according to the rules in
+// https://matrix.org/docs/spec/client_server/r0.6.1#backup-algorithm-m-megolm-backup-v1-curve25519-aes-sha2
+func (a *KeyBackupSession) ShouldReplaceRoomKey(newKey *KeyBackupSession) bool {
+	// "if the keys have different values for is_verified, then it will keep the key that has is_verified set to true"
+	if newKey.IsVerified != a.IsVerified {
+		return newKey.IsVerified
+	}
+	// "if they have the same values for is_verified, then it will keep the key with a lower first_message_index"
+	if newKey.FirstMessageIndex != a.FirstMessageIndex {
+		return newKey.FirstMessageIndex < a.FirstMessageIndex
+	}
+	// "and finally, if is_verified and first_message_index are equal, then it will keep the key with a lower forwarded_count"
+	return newKey.ForwardedCount < a.ForwardedCount
+}
+
+// InternalKeyBackupSession is a KeyBackupSession along with the room and
+// session it belongs to.
+type InternalKeyBackupSession struct {
+	KeyBackupSession
+	RoomID    string
+	SessionID string
 }
 
 // InputAccountDataRequest is the request for InputAccountData
@@ -94,6 +189,9 @@ type QueryAccessTokenRequest struct {
 	// optional user ID, valid only if the token is an appservice.
 	// https://matrix.org/docs/spec/application_service/r0.1.2#using-sync-and-events
 	AppServiceUserID string
+	// optional device ID, valid only if the token is an appservice, for
+	// appservices that manage encryption on behalf of their users (MSC3202).
+	AppServiceDeviceID string
 }
 
 // QueryAccessTokenResponse is the response for QueryAccessToken
@@ -115,6 +213,18 @@ type QueryAccountDataResponse struct {
 	RoomAccountData   map[string]map[string]json.RawMessage // room -> type -> data
 }
 
+// AutoAcceptInvitesAccountDataType is the type of the global account data in
+// which users store whether invites they receive should be accepted for them.
+const AutoAcceptInvitesAccountDataType = "org.matrix.dendrite.auto_accept_invites"
+
+// AutoAcceptInvites is the content of the auto-accept invites account data.
+type AutoAcceptInvites struct {
+	// Whether invites should be joined automatically.
+	Enabled bool `json:"enabled"`
+	// Whether only invites to direct messages should be joined automatically.
+	OnlyDirect bool `json:"only_direct"`
+}
+
 // QueryDevicesRequest is the request for QueryDevices
 type QueryDevicesRequest struct {
 	UserID string
@@ -214,6 +324,7 @@ type PerformDeviceCreationRequest struct {
 type PerformDeviceCreationResponse struct {
 	DeviceCreated bool
 	Device        *Device
+	Err           *ErrorForbidden // set if the user can't have any more devices
 }
 
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
@@ -226,6 +337,64 @@ type PerformAccountDeactivationResponse struct {
 	AccountDeactivated bool
 }
 
+// PerformOpenIDTokenCreationRequest is the request for PerformOpenIDTokenCreation
+type PerformOpenIDTokenCreationRequest struct {
+	UserID string
+}
+
+// PerformOpenIDTokenCreationResponse is the response for PerformOpenIDTokenCreation
+type PerformOpenIDTokenCreationResponse struct {
+	Token OpenIDToken
+}
+
+// QueryOpenIDTokenRequest is the request for QueryOpenIDToken
+type QueryOpenIDTokenRequest struct {
+	Token string
+}
+
+// QueryOpenIDTokenResponse is the response for QueryOpenIDToken. Sub is empty
+// if the token doesn't exist or has expired.
+type QueryOpenIDTokenResponse struct {
+	Sub         string // The Matrix User ID that generated the token
+	ExpiresAtMS int64
+}
+
+// PerformLoginTokenCreationRequest is the request for PerformLoginTokenCreation
+type PerformLoginTokenCreationRequest struct {
+	UserID string
+}
+
+// PerformLoginTokenCreationResponse is the response for PerformLoginTokenCreation
+type PerformLoginTokenCreationResponse struct {
+	Token       string
+	ExpiresAtMS int64
+}
+
+// PerformLoginTokenConsumptionRequest is the request for PerformLoginTokenConsumption
+type PerformLoginTokenConsumptionRequest struct {
+	Token string
+}
+
+// PerformLoginTokenConsumptionResponse is the response for PerformLoginTokenConsumption.
+// UserID is empty if the token doesn't exist, has expired or has already been used.
+type PerformLoginTokenConsumptionResponse struct {
+	UserID string
+}
+
+// OpenIDToken represents an OpenID token which a user can hand to a third
+// party so that it can verify the user's identity
+type OpenIDToken struct {
+	Token       string
+	UserID      string
+	ExpiresAtMS int64
+}
+
+// OpenIDTokenAttributes represents the attributes associated with an OpenID token
+type OpenIDTokenAttributes struct {
+	UserID      string
+	ExpiresAtMS int64
+}
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -241,6 +410,9 @@ type Device struct {
 	LastSeenTS  int64
 	LastSeenIP  string
 	UserAgent   string
+	// The type of account this device belongs to, e.g. a guest account.
+	// This is only populated for devices returned by QueryAccessToken.
+	AccountType AccountType
 }
 
 // Account represents a Matrix account on this home server.
@@ -249,7 +421,7 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	AccountType  AccountType
 	// TODO: Associations (e.g. with application services)
 }
 
@@ -287,4 +459,7 @@ const (
 	AccountTypeUser AccountType = 1
 	// AccountTypeGuest indicates this is a guest account
 	AccountTypeGuest AccountType = 2
+	// AccountTypeAdmin indicates this is a user account which can use the
+	// server admin APIs
+	AccountTypeAdmin AccountType = 3
 )
@@ -0,0 +1,146 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputRoomEventConsumer consumes events that originated in the room server,
+// so that invites can be accepted for users who have asked for that.
+type OutputRoomEventConsumer struct {
+	cfg        *config.UserAPI
+	rsAPI      rsapi.RoomserverInternalAPI
+	rsConsumer *internal.ContinualConsumer
+	accountDB  accounts.Database
+}
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	cfg *config.UserAPI,
+	kafkaConsumer sarama.Consumer,
+	accountDB accounts.Database,
+	rsAPI rsapi.RoomserverInternalAPI,
+) *OutputRoomEventConsumer {
+	consumer := internal.ContinualConsumer{
+		ComponentName:  "userapi/roomserver",
+		Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
+		Consumer:       kafkaConsumer,
+		PartitionStore: accountDB,
+	}
+	s := &OutputRoomEventConsumer{
+		cfg:        cfg,
+		rsConsumer: &consumer,
+		accountDB:  accountDB,
+		rsAPI:      rsAPI,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() error {
+	return s.rsConsumer.Start()
+}
+
+func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output rsapi.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+	if output.Type != rsapi.OutputTypeNewInviteEvent {
+		return nil
+	}
+	s.onNewInviteEvent(context.TODO(), output.NewInviteEvent.Event)
+	return nil
+}
+
+// onNewInviteEvent joins the invited user to the room if they are a local
+// user who wants their invites to be accepted automatically. Failing to do so
+// isn't fatal, since the invite is still there for the user to accept.
+func (s *OutputRoomEventConsumer) onNewInviteEvent(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) {
+	if ev.StateKey() == nil {
+		return
+	}
+	userID := *ev.StateKey()
+	logger := log.WithFields(log.Fields{
+		"user_id": userID,
+		"room_id": ev.RoomID(),
+	})
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != s.cfg.Matrix.ServerName {
+		return
+	}
+
+	data, err := s.accountDB.GetAccountDataByType(ctx, localpart, "", api.AutoAcceptInvitesAccountDataType)
+	if err != nil || data == nil {
+		return
+	}
+	var autoAccept api.AutoAcceptInvites
+	if err = json.Unmarshal(data, &autoAccept); err != nil || !autoAccept.Enabled {
+		return
+	}
+	if autoAccept.OnlyDirect {
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(ev.Content(), &content); err != nil || !content.IsDirect {
+			return
+		}
+	}
+
+	// Only join if the user is still invited, in case the invite has been
+	// retired since, or this is an old invite that we're seeing again.
+	var membershipRes rsapi.QueryMembershipForUserResponse
+	if err = s.rsAPI.QueryMembershipForUser(ctx, &rsapi.QueryMembershipForUserRequest{
+		RoomID: ev.RoomID(),
+		UserID: userID,
+	}, &membershipRes); err != nil {
+		logger.WithError(err).Error("Failed to check membership before accepting invite")
+		return
+	}
+	if membershipRes.Membership != gomatrixserverlib.Invite {
+		return
+	}
+
+	// The inviting server is in the room, so it can help us to join it.
+	var serverNames []gomatrixserverlib.ServerName
+	if _, senderDomain, senderErr := gomatrixserverlib.SplitID('@', ev.Sender()); senderErr == nil {
+		serverNames = append(serverNames, senderDomain)
+	}
+	var joinRes rsapi.PerformJoinResponse
+	s.rsAPI.PerformJoin(ctx, &rsapi.PerformJoinRequest{
+		RoomIDOrAlias: ev.RoomID(),
+		UserID:        userID,
+		Content:       map[string]interface{}{},
+		ServerNames:   serverNames,
+	}, &joinRes)
+	if joinRes.Error != nil {
+		logger.WithError(joinRes.Error).Error("Failed to automatically accept invite")
+		return
+	}
+	logger.Info("Automatically accepted invite")
+}
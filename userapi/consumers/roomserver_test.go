@@ -0,0 +1,142 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type joinRecordingRoomserverAPI struct {
+	rsapi.RoomserverInternalAPI
+	joins []string // room IDs
+}
+
+func (r *joinRecordingRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *rsapi.QueryMembershipForUserRequest, res *rsapi.QueryMembershipForUserResponse) error {
+	res.Membership = gomatrixserverlib.Invite
+	return nil
+}
+
+func (r *joinRecordingRoomserverAPI) PerformJoin(ctx context.Context, req *rsapi.PerformJoinRequest, res *rsapi.PerformJoinResponse) {
+	r.joins = append(r.joins, req.RoomIDOrAlias)
+	res.RoomID = req.RoomIDOrAlias
+}
+
+func mustInviteMessage(t *testing.T, roomID, userID string, isDirect bool) *sarama.ConsumerMessage {
+	t.Helper()
+	content, err := json.Marshal(gomatrixserverlib.MemberContent{
+		Membership: gomatrixserverlib.Invite,
+		IsDirect:   isDirect,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal invite content: %s", err)
+	}
+	b := gomatrixserverlib.EventBuilder{
+		RoomID:   roomID,
+		Sender:   "@bob:remote",
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &userID,
+		Content:  content,
+		Depth:    1,
+	}
+	ev, err := b.Build(
+		time.Now(), "remote", "ed25519:test",
+		ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), gomatrixserverlib.RoomVersionV4,
+	)
+	if err != nil {
+		t.Fatalf("failed to build invite event: %s", err)
+	}
+	value, err := json.Marshal(rsapi.OutputEvent{
+		Type: rsapi.OutputTypeNewInviteEvent,
+		NewInviteEvent: &rsapi.OutputNewInviteEvent{
+			RoomVersion: gomatrixserverlib.RoomVersionV4,
+			Event:       ev.Headered(gomatrixserverlib.RoomVersionV4),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal output event: %s", err)
+	}
+	return &sarama.ConsumerMessage{Value: value}
+}
+
+func TestAutoAcceptInvites(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	cfg := &config.UserAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		accountData string // empty for no account data
+		isDirect    bool
+		wantJoin    bool
+	}{
+		{"no preference", "", false, false},
+		{"disabled", `{"enabled":false}`, false, false},
+		{"enabled", `{"enabled":true}`, false, true},
+		{"only direct with direct invite", `{"enabled":true,"only_direct":true}`, true, true},
+		{"only direct with other invite", `{"enabled":true,"only_direct":true}`, false, false},
+	}
+	for i, tc := range testCases {
+		localpart := fmt.Sprintf("user%d", i)
+		if _, err = accountDB.CreateAccount(ctx, localpart, "", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		if tc.accountData != "" {
+			if err = accountDB.SaveAccountData(ctx, localpart, "", api.AutoAcceptInvitesAccountDataType, json.RawMessage(tc.accountData)); err != nil {
+				t.Fatalf("failed to save account data: %s", err)
+			}
+		}
+
+		rsAPI := &joinRecordingRoomserverAPI{}
+		s := NewOutputRoomEventConsumer(cfg, nil, accountDB, rsAPI)
+		msg := mustInviteMessage(t, "!room:remote", fmt.Sprintf("@%s:localhost", localpart), tc.isDirect)
+		if err = s.onMessage(msg); err != nil {
+			t.Fatalf("%s: onMessage failed: %s", tc.name, err)
+		}
+		if joined := len(rsAPI.joins) > 0; joined != tc.wantJoin {
+			t.Errorf("%s: got joined %v, want %v", tc.name, joined, tc.wantJoin)
+		}
+	}
+
+	// Invites for remote users are never accepted by us.
+	rsAPI := &joinRecordingRoomserverAPI{}
+	s := NewOutputRoomEventConsumer(cfg, nil, accountDB, rsAPI)
+	if err = s.onMessage(mustInviteMessage(t, "!room:remote", "@user2:remote", false)); err != nil {
+		t.Fatalf("onMessage failed: %s", err)
+	}
+	if len(rsAPI.joins) > 0 {
+		t.Errorf("joined a remote user to %v", rsAPI.joins)
+	}
+}
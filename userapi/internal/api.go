@@ -20,11 +20,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -34,6 +40,10 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// deviceCreationMutexCount is the number of mutexes that device creation is
+// spread over. Users that hash to the same mutex create devices one at a time.
+const deviceCreationMutexCount = 64
+
 type UserInternalAPI struct {
 	AccountDB  accounts.Database
 	DeviceDB   devices.Database
@@ -41,6 +51,26 @@ type UserInternalAPI struct {
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
 	KeyAPI      keyapi.KeyInternalAPI
+	RSAPI       rsapi.RoomserverInternalAPI
+	// OpenIDTokenLifetimeMS is how long issued OpenID tokens are valid for
+	OpenIDTokenLifetimeMS int64
+	// LoginTokenLifetimeMS is how long issued login tokens are valid for
+	LoginTokenLifetimeMS int64
+	// AutoJoinRooms are the room IDs or aliases that new users are joined to
+	AutoJoinRooms []string
+	// MaxDevicesPerUser is the maximum number of devices a user may have, or
+	// 0 for no limit
+	MaxDevicesPerUser int
+	// DeviceLimitStrategy is what to do when a user has too many devices
+	DeviceLimitStrategy string
+	// deviceCreationMutexes makes checking the device limit and creating a
+	// device atomic, so that concurrent logins can't exceed the limit. Users
+	// are hashed onto a fixed number of mutexes so that this doesn't grow
+	// with the number of users.
+	deviceCreationMutexes [deviceCreationMutexCount]sync.Mutex
+	// AccountTypes caches the account type of each local user, so that
+	// looking up an access token doesn't need to hit the account database
+	AccountTypes caching.AccountTypeCache
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -67,7 +97,7 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		res.Account = acc
 		return nil
 	}
-	acc, err := a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID)
+	acc, err := a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID, req.AccountType)
 	if err != nil {
 		if errors.Is(err, sqlutil.ErrUserExists) { // This account already exists
 			switch req.OnConflict {
@@ -94,11 +124,37 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		return err
 	}
 
+	// Users registered by application services are managed by the
+	// application service, so don't join them to anything.
+	if req.AppServiceID == "" {
+		a.joinAutoJoinRooms(ctx, acc.UserID)
+	}
+
 	res.AccountCreated = true
 	res.Account = acc
 	return nil
 }
 
+// joinAutoJoinRooms joins a newly registered user to each of the configured
+// auto-join rooms. Failing to join a room is logged but otherwise ignored, so
+// that a broken room can't prevent users from registering.
+func (a *UserInternalAPI) joinAutoJoinRooms(ctx context.Context, userID string) {
+	for _, room := range a.AutoJoinRooms {
+		var joinRes rsapi.PerformJoinResponse
+		a.RSAPI.PerformJoin(ctx, &rsapi.PerformJoinRequest{
+			RoomIDOrAlias: room,
+			UserID:        userID,
+			Content:       map[string]interface{}{},
+		}, &joinRes)
+		if joinRes.Error != nil {
+			util.GetLogger(ctx).WithError(joinRes.Error).WithFields(logrus.Fields{
+				"user_id": userID,
+				"room":    room,
+			}).Error("Failed to auto-join user to room")
+		}
+	}
+}
+
 func (a *UserInternalAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
 	if err := a.AccountDB.SetPassword(ctx, req.Localpart, req.Password); err != nil {
 		return err
@@ -113,6 +169,20 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 		"device_id":    req.DeviceID,
 		"display_name": req.DeviceDisplayName,
 	}).Info("PerformDeviceCreation")
+	if a.MaxDevicesPerUser > 0 {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(req.Localpart))
+		mutex := &a.deviceCreationMutexes[hash.Sum32()%deviceCreationMutexCount]
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+	if err := a.enforceDeviceLimit(ctx, req.Localpart, req.DeviceID); err != nil {
+		if forbidden, ok := err.(*api.ErrorForbidden); ok {
+			res.Err = forbidden
+			return nil
+		}
+		return err
+	}
 	dev, err := a.DeviceDB.CreateDevice(ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
 	if err != nil {
 		return err
@@ -123,6 +193,52 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID})
 }
 
+// enforceDeviceLimit makes sure that the user has room for another device,
+// either by returning api.ErrorForbidden or by removing the devices that were
+// used least recently, depending on the DeviceLimitStrategy. Replacing one of
+// the user's existing devices doesn't count as another device.
+func (a *UserInternalAPI) enforceDeviceLimit(ctx context.Context, localpart string, deviceID *string) error {
+	if a.MaxDevicesPerUser == 0 {
+		return nil
+	}
+	devices, err := a.DeviceDB.GetDevicesByLocalpart(ctx, localpart)
+	if err != nil {
+		return fmt.Errorf("a.DeviceDB.GetDevicesByLocalpart: %w", err)
+	}
+	if deviceID != nil {
+		for _, dev := range devices {
+			if dev.ID == *deviceID {
+				return nil
+			}
+		}
+	}
+	excess := len(devices) - a.MaxDevicesPerUser + 1
+	if excess <= 0 {
+		return nil
+	}
+	if a.DeviceLimitStrategy != config.DeviceLimitPruneOldest {
+		return &api.ErrorForbidden{
+			Message: fmt.Sprintf("Users may not have more than %d devices", a.MaxDevicesPerUser),
+		}
+	}
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].LastSeenTS < devices[j].LastSeenTS
+	})
+	pruned := make([]string, 0, excess)
+	for _, dev := range devices[:excess] {
+		pruned = append(pruned, dev.ID)
+	}
+	util.GetLogger(ctx).WithFields(logrus.Fields{
+		"localpart": localpart,
+		"devices":   pruned,
+	}).Info("Removing least recently used devices to stay within the device limit")
+	if err = a.DeviceDB.RemoveDevices(ctx, localpart, pruned); err != nil {
+		return fmt.Errorf("a.DeviceDB.RemoveDevices: %w", err)
+	}
+	return a.deviceListUpdate(userutil.MakeUserID(localpart, a.ServerName), pruned)
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -342,11 +458,20 @@ func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAc
 }
 
 func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAccessTokenRequest, res *api.QueryAccessTokenResponse) error {
-	if req.AppServiceUserID != "" {
-		appServiceDevice, err := a.queryAppServiceToken(ctx, req.AccessToken, req.AppServiceUserID)
-		res.Device = appServiceDevice
-		res.Err = err
-		return nil
+	if req.AppServiceUserID != "" || req.AppServiceDeviceID != "" {
+		appServiceDevice, err := a.queryAppServiceToken(ctx, req.AccessToken, req.AppServiceUserID, req.AppServiceDeviceID)
+		if forbidden, ok := err.(*api.ErrorForbidden); ok {
+			res.Err = forbidden
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if appServiceDevice != nil {
+			res.Device = appServiceDevice
+			return nil
+		}
+		// The token doesn't belong to an appservice, so the user ID and
+		// device ID are ignored.
 	}
 	device, err := a.DeviceDB.GetDeviceByAccessToken(ctx, req.AccessToken)
 	if err != nil {
@@ -355,18 +480,33 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return err
+	}
+	if accountType, ok := a.AccountTypes.GetAccountType(localpart); ok {
+		device.AccountType = accountType
+	} else {
+		acc, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
+		if err != nil {
+			return err
+		}
+		a.AccountTypes.StoreAccountType(localpart, acc.AccountType)
+		device.AccountType = acc.AccountType
+	}
 	res.Device = device
 	return nil
 }
 
-// Return the appservice 'device' or nil if the token is not an appservice. Returns an error if there was a problem
-// creating a 'device'.
-func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appServiceUserID string) (*api.Device, error) {
+// Return the appservice 'device' or nil if the token is not an appservice. Returns an
+// api.ErrorForbidden if the appservice isn't allowed to act as the given user or device.
+// https://matrix.org/docs/spec/application_service/r0.1.2#identity-assertion
+func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appServiceUserID, appServiceDeviceID string) (*api.Device, error) {
 	// Search for app service with given access_token
 	var appService *config.ApplicationService
-	for _, as := range a.AppServices {
-		if as.ASToken == token {
-			appService = &as
+	for i := range a.AppServices {
+		if a.AppServices[i].ASToken == token {
+			appService = &a.AppServices[i]
 			break
 		}
 	}
@@ -380,27 +520,45 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 		ID: types.AppServiceDeviceID,
 		// AS dummy device has AS's token.
 		AccessToken: token,
+		AccountType: api.AccountTypeUser,
 	}
 
 	localpart, err := userutil.ParseUsernameParam(appServiceUserID, &a.ServerName)
 	if err != nil {
-		return nil, err
+		return nil, &api.ErrorForbidden{Message: err.Error()}
 	}
 
-	if localpart != "" { // AS is masquerading as another user
+	if localpart != "" && localpart != appService.SenderLocalpart { // AS is masquerading as another user
+		userID := userutil.MakeUserID(localpart, a.ServerName)
+		// Verify that the user is in the AS's namespace
+		if !appService.IsInterestedInUserID(userID) {
+			return nil, &api.ErrorForbidden{Message: "appservice cannot masquerade as this user"}
+		}
 		// Verify that the user is registered
-		account, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
-		// Verify that account exists & appServiceID matches
-		if err == nil && account.AppServiceID == appService.ID {
-			// Set the userID of dummy device
-			dev.UserID = appServiceUserID
-			return &dev, nil
+		if _, err = a.AccountDB.GetAccountByLocalpart(ctx, localpart); err == sql.ErrNoRows {
+			return nil, &api.ErrorForbidden{Message: "appservice has not registered this user"}
+		} else if err != nil {
+			return nil, err
+		}
+		// Set the userID of dummy device
+		dev.UserID = userID
+	} else {
+		// AS is not masquerading as any user, so use AS's sender_localpart
+		localpart = appService.SenderLocalpart
+		dev.UserID = userutil.MakeUserID(localpart, a.ServerName)
+	}
+
+	if appServiceDeviceID != "" { // AS is acting as one of the user's devices
+		device, devErr := a.DeviceDB.GetDeviceByID(ctx, localpart, appServiceDeviceID)
+		if devErr == sql.ErrNoRows {
+			return nil, &api.ErrorForbidden{Message: "appservice has not registered this device"}
+		} else if devErr != nil {
+			return nil, devErr
 		}
-		return nil, &api.ErrorForbidden{Message: "appservice has not registered this user"}
+		dev.ID = device.ID
+		dev.DisplayName = device.DisplayName
 	}
 
-	// AS is not masquerading as any user, so use AS's sender_localpart
-	dev.UserID = appService.SenderLocalpart
 	return &dev, nil
 }
 
@@ -410,3 +568,183 @@ func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *a
 	res.AccountDeactivated = err == nil
 	return err
 }
+
+// PerformOpenIDTokenCreation creates a new token that a relying party uses to authenticate a user
+func (a *UserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, req *api.PerformOpenIDTokenCreationRequest, res *api.PerformOpenIDTokenCreationResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot create OpenID tokens for remote users: got %s want %s", domain, a.ServerName)
+	}
+
+	token := util.RandomString(24)
+	expiresAtMS := time.Now().UnixNano()/int64(time.Millisecond) + a.OpenIDTokenLifetimeMS
+	if err = a.AccountDB.CreateOpenIDToken(ctx, token, local, expiresAtMS); err != nil {
+		return err
+	}
+
+	res.Token = api.OpenIDToken{
+		Token:       token,
+		UserID:      req.UserID,
+		ExpiresAtMS: expiresAtMS,
+	}
+	return nil
+}
+
+// QueryOpenIDToken validates that the OpenID token was issued for the user, the relying party uses this for validation
+func (a *UserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOpenIDTokenRequest, res *api.QueryOpenIDTokenResponse) error {
+	openIDTokenAttrs, err := a.AccountDB.GetOpenIDTokenAttributes(ctx, req.Token)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	res.ExpiresAtMS = openIDTokenAttrs.ExpiresAtMS
+	if openIDTokenAttrs.ExpiresAtMS > time.Now().UnixNano()/int64(time.Millisecond) {
+		res.Sub = openIDTokenAttrs.UserID
+	}
+	return nil
+}
+
+// PerformLoginTokenCreation creates a new single-use token which can be exchanged for an access token
+func (a *UserInternalAPI) PerformLoginTokenCreation(ctx context.Context, req *api.PerformLoginTokenCreationRequest, res *api.PerformLoginTokenCreationResponse) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot create login tokens for remote users: got %s want %s", domain, a.ServerName)
+	}
+
+	token := util.RandomString(32)
+	expiresAtMS := time.Now().UnixNano()/int64(time.Millisecond) + a.LoginTokenLifetimeMS
+	if err = a.AccountDB.CreateLoginToken(ctx, token, req.UserID, expiresAtMS); err != nil {
+		return err
+	}
+
+	res.Token = token
+	res.ExpiresAtMS = expiresAtMS
+	return nil
+}
+
+// PerformLoginTokenConsumption uses up a login token, returning the user it was issued to if it was still valid
+func (a *UserInternalAPI) PerformLoginTokenConsumption(ctx context.Context, req *api.PerformLoginTokenConsumptionRequest, res *api.PerformLoginTokenConsumptionResponse) error {
+	userID, err := a.AccountDB.ConsumeLoginToken(ctx, req.Token)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.UserID = userID
+	return nil
+}
+
+func (a *UserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) error {
+	// Delete metadata
+	if req.DeleteBackup {
+		if req.Version == "" {
+			res.BadInput = true
+			res.Error = "must specify a version to delete"
+			return nil
+		}
+		exists, err := a.AccountDB.DeleteKeyBackup(ctx, req.UserID, req.Version)
+		if err != nil {
+			res.Error = fmt.Sprintf("failed to delete backup: %s", err)
+		}
+		res.Exists = exists
+		res.Version = req.Version
+		return nil
+	}
+	// Create metadata
+	if req.Version == "" {
+		version, err := a.AccountDB.CreateKeyBackup(ctx, req.UserID, req.Algorithm, req.AuthData)
+		if err != nil {
+			res.Error = fmt.Sprintf("failed to create backup: %s", err)
+		}
+		res.Exists = err == nil
+		res.Version = version
+		return nil
+	}
+	// Upload keys
+	if req.Keys != nil {
+		a.uploadBackupKeys(ctx, req, res)
+		return nil
+	}
+	// Update metadata
+	_, algorithm, _, _, deleted, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err == sql.ErrNoRows || (err == nil && deleted) {
+		res.Exists = false
+		return nil
+	} else if err != nil {
+		res.Error = fmt.Sprintf("failed to query backup: %s", err)
+		return nil
+	}
+	res.Exists = true
+	res.Version = req.Version
+	if algorithm != req.Algorithm {
+		res.BadInput = true
+		res.Error = "algorithm does not match the existing backup"
+		return nil
+	}
+	if err = a.AccountDB.UpdateKeyBackupAuthData(ctx, req.UserID, req.Version, req.AuthData); err != nil {
+		res.Error = fmt.Sprintf("failed to update backup: %s", err)
+	}
+	return nil
+}
+
+// uploadBackupKeys stores keys in a key backup version. Keys can only be
+// uploaded to the latest version of the backup.
+func (a *UserInternalAPI) uploadBackupKeys(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) {
+	latest, _, _, _, deleted, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, "")
+	if err == sql.ErrNoRows || (err == nil && deleted) {
+		res.Exists = false
+		return
+	} else if err != nil {
+		res.Error = fmt.Sprintf("failed to query backup: %s", err)
+		return
+	}
+	res.Exists = true
+	res.Version = latest
+	if latest != req.Version {
+		res.WrongVersion = true
+		return
+	}
+	count, etag, err := a.AccountDB.UpsertBackupKeys(ctx, req.Version, req.UserID, req.Keys)
+	if err != nil {
+		res.Error = fmt.Sprintf("failed to upsert keys: %s", err)
+		return
+	}
+	res.KeyCount = count
+	res.KeyETag = etag
+}
+
+func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyBackupRequest, res *api.QueryKeyBackupResponse) error {
+	version, algorithm, authData, etag, deleted, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err == sql.ErrNoRows || (err == nil && deleted) {
+		res.Exists = false
+		return nil
+	} else if err != nil {
+		res.Error = fmt.Sprintf("failed to query backup: %s", err)
+		return nil
+	}
+	res.Exists = true
+	res.Version = version
+	res.Algorithm = algorithm
+	res.AuthData = authData
+	res.ETag = etag
+	res.Count, err = a.AccountDB.CountBackupKeys(ctx, version, req.UserID)
+	if err != nil {
+		res.Error = fmt.Sprintf("failed to count keys: %s", err)
+		return nil
+	}
+	if req.ReturnKeys {
+		res.Keys, err = a.AccountDB.GetBackupKeys(ctx, version, req.UserID, req.KeysForRoomID, req.KeysForSessionID)
+		if err != nil {
+			res.Error = fmt.Sprintf("failed to query keys: %s", err)
+		}
+	}
+	return nil
+}
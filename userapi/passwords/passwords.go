@@ -0,0 +1,135 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package passwords hashes the passwords of local users and verifies them
+// against stored hashes.
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrMismatchedPassword is returned by Verify when the password doesn't
+// match the hash.
+var ErrMismatchedPassword = errors.New("password does not match hash")
+
+const (
+	argon2idPrefix  = "$argon2id$"
+	argon2idSaltLen = 16
+	argon2idKeyLen  = 32
+)
+
+// Hasher hashes new passwords with the configured scheme.
+type Hasher struct {
+	cfg config.PasswordHashing
+}
+
+// NewHasher returns a hasher for the given config. A nil config hashes with
+// the default scheme.
+func NewHasher(cfg *config.PasswordHashing) *Hasher {
+	h := &Hasher{}
+	if cfg != nil {
+		h.cfg = *cfg
+	} else {
+		h.cfg.Defaults()
+	}
+	return h
+}
+
+// Hash returns a hash of the password, in a format that records the scheme
+// and its parameters.
+func (h *Hasher) Hash(plaintext string) (string, error) {
+	switch h.cfg.Algorithm {
+	case config.PasswordHashingBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), h.cfg.BcryptCost)
+		return string(hash), err
+	case config.PasswordHashingArgon2id:
+		return hashArgon2id(plaintext, h.cfg.Argon2id)
+	default:
+		return "", fmt.Errorf("unknown password hashing algorithm %q", h.cfg.Algorithm)
+	}
+}
+
+// Verify checks the password against a hash made by any of the supported
+// schemes, whatever the configured one is. It returns ErrMismatchedPassword
+// if the password is wrong.
+func Verify(hash, plaintext string) error {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		return verifyArgon2id(hash, plaintext)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintext))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrMismatchedPassword
+	}
+	return err
+}
+
+// hashArgon2id hashes the password in the PHC string format, e.g.
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func hashArgon2id(plaintext string, opts config.Argon2idOptions) (string, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	key := argon2.IDKey(
+		[]byte(plaintext), salt, uint32(opts.Iterations), uint32(opts.MemoryKiB), uint8(opts.Parallelism), argon2idKeyLen,
+	)
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		opts.MemoryKiB, opts.Iterations, opts.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func verifyArgon2id(hash, plaintext string) error {
+	// The fields are "", "argon2id", version, parameters, salt and key.
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if iterations < 1 || parallelism < 1 {
+		return fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("malformed argon2id key: %w", err)
+	}
+	got := argon2.IDKey([]byte(plaintext), salt, iterations, memory, parallelism, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return ErrMismatchedPassword
+	}
+	return nil
+}
@@ -31,10 +31,10 @@ type Database interface {
 	SetPassword(ctx context.Context, localpart string, plaintextPassword string) error
 	SetAvatarURL(ctx context.Context, localpart string, avatarURL string) error
 	SetDisplayName(ctx context.Context, localpart string, displayName string) error
-	// CreateAccount makes a new account with the given login name and password, and creates an empty profile
-	// for this account. If no password is supplied, the account will be a passwordless account. If the
-	// account already exists, it will return nil, ErrUserExists.
-	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string) (*api.Account, error)
+	// CreateAccount makes a new account of the given type with the given login name and password, and creates
+	// an empty profile for this account. If no password is supplied, the account will be a passwordless account.
+	// If the account already exists, it will return nil, ErrUserExists.
+	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string, accountType api.AccountType) (*api.Account, error)
 	CreateGuestAccount(ctx context.Context) (*api.Account, error)
 	SaveAccountData(ctx context.Context, localpart, roomID, dataType string, content json.RawMessage) error
 	GetAccountData(ctx context.Context, localpart string) (global map[string]json.RawMessage, rooms map[string]map[string]json.RawMessage, err error)
@@ -44,7 +44,7 @@ type Database interface {
 	// Returns an error if there was an issue with the retrieval
 	GetAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (data json.RawMessage, err error)
 	GetNewNumericLocalpart(ctx context.Context) (int64, error)
-	SaveThreePIDAssociation(ctx context.Context, threepid, localpart, medium string) (err error)
+	SaveThreePIDAssociation(ctx context.Context, threepid, localpart, medium, idServer string) (err error)
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
 	GetLocalpartForThreePID(ctx context.Context, threepid string, medium string) (localpart string, err error)
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
@@ -52,6 +52,23 @@ type Database interface {
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
 	SearchProfiles(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
 	DeactivateAccount(ctx context.Context, localpart string) (err error)
+	CreateOpenIDToken(ctx context.Context, token, localpart string, expiresAtMS int64) error
+	// GetOpenIDTokenAttributes returns the attributes of the given OpenID token.
+	// Returns sql.ErrNoRows if the token doesn't exist.
+	GetOpenIDTokenAttributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
+	CreateLoginToken(ctx context.Context, token, userID string, expiresAtMS int64) error
+	// ConsumeLoginToken deletes the given login token, returning the user ID it was issued to.
+	// Returns sql.ErrNoRows if the token doesn't exist or has expired.
+	ConsumeLoginToken(ctx context.Context, token string) (userID string, err error)
+	CreateKeyBackup(ctx context.Context, userID, algorithm string, authData json.RawMessage) (version string, err error)
+	UpdateKeyBackupAuthData(ctx context.Context, userID, version string, authData json.RawMessage) (err error)
+	DeleteKeyBackup(ctx context.Context, userID, version string) (exists bool, err error)
+	// GetKeyBackup returns the given key backup version, or the latest version if version is empty.
+	// Returns sql.ErrNoRows if there is no such version.
+	GetKeyBackup(ctx context.Context, userID, version string) (versionResult, algorithm string, authData json.RawMessage, etag string, deleted bool, err error)
+	UpsertBackupKeys(ctx context.Context, version, userID string, uploads []api.InternalKeyBackupSession) (count int64, etag string, err error)
+	GetBackupKeys(ctx context.Context, version, userID, filterRoomID, filterSessionID string) (result map[string]map[string]api.KeyBackupSession, err error)
+	CountBackupKeys(ctx context.Context, version, userID string) (count int64, err error)
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
@@ -0,0 +1,28 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadThreePIDIDServer(m *sqlutil.Migrations) {
+	m.AddMigration(UpThreePIDIDServer, DownThreePIDIDServer)
+}
+
+func UpThreePIDIDServer(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE account_threepid ADD COLUMN IF NOT EXISTS id_server TEXT NOT NULL DEFAULT '';")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownThreePIDIDServer(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE account_threepid DROP COLUMN id_server;")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -17,7 +17,7 @@ package postgres
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal"
@@ -49,7 +49,9 @@ const setDisplayNameSQL = "" +
 	"UPDATE account_profiles SET display_name = $1 WHERE localpart = $2"
 
 const selectProfilesBySearchSQL = "" +
-	"SELECT localpart, display_name, avatar_url FROM account_profiles WHERE localpart LIKE $1 OR display_name LIKE $1 LIMIT $2"
+	"SELECT localpart, display_name, avatar_url FROM account_profiles" +
+	" WHERE LOWER(localpart) LIKE $1 ESCAPE '\\' OR LOWER(display_name) LIKE $1 ESCAPE '\\' OR LOWER(display_name) LIKE $2 ESCAPE '\\'" +
+	" ORDER BY localpart LIMIT $3"
 
 type profilesStatements struct {
 	insertProfileStmt            *sql.Stmt
@@ -120,10 +122,9 @@ func (s *profilesStatements) selectProfilesBySearch(
 	ctx context.Context, searchString string, limit int,
 ) ([]authtypes.Profile, error) {
 	var profiles []authtypes.Profile
-	// The fmt.Sprintf directive below is building a parameter for the
-	// "LIKE" condition in the SQL query. %% escapes the % char, so the
-	// statement in the end will look like "LIKE %searchString%".
-	rows, err := s.selectProfilesBySearchStmt.QueryContext(ctx, fmt.Sprintf("%%%s%%", searchString), limit)
+	// Match on a prefix of the localpart or of any word in the display name.
+	search := sqlutil.EscapeLike(strings.ToLower(searchString))
+	rows, err := s.selectProfilesBySearchStmt.QueryContext(ctx, search+"%", "% "+search+"%", limit)
 	if err != nil {
 		return nil, err
 	}
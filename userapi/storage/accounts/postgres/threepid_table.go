@@ -32,6 +32,8 @@ CREATE TABLE IF NOT EXISTS account_threepid (
 	medium TEXT NOT NULL DEFAULT 'email',
 	-- The localpart of the Matrix user ID associated to this 3PID
 	localpart TEXT NOT NULL,
+	-- The identity server that the 3PID was bound to, if it was bound to one
+	id_server TEXT NOT NULL DEFAULT '',
 
 	PRIMARY KEY(threepid, medium)
 );
@@ -43,10 +45,10 @@ const selectLocalpartForThreePIDSQL = "" +
 	"SELECT localpart FROM account_threepid WHERE threepid = $1 AND medium = $2"
 
 const selectThreePIDsForLocalpartSQL = "" +
-	"SELECT threepid, medium FROM account_threepid WHERE localpart = $1"
+	"SELECT threepid, medium, id_server FROM account_threepid WHERE localpart = $1"
 
 const insertThreePIDSQL = "" +
-	"INSERT INTO account_threepid (threepid, medium, localpart) VALUES ($1, $2, $3)"
+	"INSERT INTO account_threepid (threepid, medium, localpart, id_server) VALUES ($1, $2, $3, $4)"
 
 const deleteThreePIDSQL = "" +
 	"DELETE FROM account_threepid WHERE threepid = $1 AND medium = $2"
@@ -58,11 +60,12 @@ type threepidStatements struct {
 	deleteThreePIDStmt              *sql.Stmt
 }
 
+func (s *threepidStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(threepidSchema)
+	return err
+}
+
 func (s *threepidStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(threepidSchema)
-	if err != nil {
-		return
-	}
 	if s.selectLocalpartForThreePIDStmt, err = db.Prepare(selectLocalpartForThreePIDSQL); err != nil {
 		return
 	}
@@ -102,12 +105,14 @@ func (s *threepidStatements) selectThreePIDsForLocalpart(
 	for rows.Next() {
 		var threepid string
 		var medium string
-		if err = rows.Scan(&threepid, &medium); err != nil {
+		var idServer string
+		if err = rows.Scan(&threepid, &medium, &idServer); err != nil {
 			return
 		}
 		threepids = append(threepids, authtypes.ThreePID{
-			Address: threepid,
-			Medium:  medium,
+			Address:  threepid,
+			Medium:   medium,
+			IDServer: idServer,
 		})
 	}
 
@@ -115,10 +120,10 @@ func (s *threepidStatements) selectThreePIDsForLocalpart(
 }
 
 func (s *threepidStatements) insertThreePID(
-	ctx context.Context, txn *sql.Tx, threepid, medium, localpart string,
+	ctx context.Context, txn *sql.Tx, threepid, medium, localpart, idServer string,
 ) (err error) {
 	stmt := sqlutil.TxStmt(txn, s.insertThreePIDStmt)
-	_, err = stmt.ExecContext(ctx, threepid, medium, localpart)
+	_, err = stmt.ExecContext(ctx, threepid, medium, localpart, idServer)
 	return
 }
 
@@ -0,0 +1,61 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadThreePIDIDServer(m *sqlutil.Migrations) {
+	m.AddMigration(UpThreePIDIDServer, DownThreePIDIDServer)
+}
+
+func UpThreePIDIDServer(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE account_threepid RENAME TO account_threepid_tmp;
+CREATE TABLE account_threepid (
+    threepid TEXT NOT NULL,
+    medium TEXT NOT NULL DEFAULT 'email',
+    localpart TEXT NOT NULL,
+    id_server TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY(threepid, medium)
+);
+INSERT
+    INTO account_threepid (
+      threepid, medium, localpart
+    ) SELECT
+        threepid, medium, localpart
+    FROM account_threepid_tmp
+;
+DROP TABLE account_threepid_tmp;
+CREATE INDEX IF NOT EXISTS account_threepid_localpart ON account_threepid(localpart);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownThreePIDIDServer(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE account_threepid RENAME TO account_threepid_tmp;
+CREATE TABLE account_threepid (
+    threepid TEXT NOT NULL,
+    medium TEXT NOT NULL DEFAULT 'email',
+    localpart TEXT NOT NULL,
+    PRIMARY KEY(threepid, medium)
+);
+INSERT
+    INTO account_threepid (
+      threepid, medium, localpart
+    ) SELECT
+        threepid, medium, localpart
+    FROM account_threepid_tmp
+;
+DROP TABLE account_threepid_tmp;
+CREATE INDEX IF NOT EXISTS account_threepid_localpart ON account_threepid(localpart);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const loginTokenSchema = `
+-- Stores single-use login tokens, which can be exchanged for an access token
+CREATE TABLE IF NOT EXISTS account_login_tokens (
+	-- The value of the token issued to a user
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The Matrix user ID the token was issued to
+	user_id TEXT NOT NULL,
+	-- When the token expires, as a unix timestamp (ms resolution).
+	token_expires_at_ms BIGINT NOT NULL
+);
+`
+
+const insertLoginTokenSQL = "" +
+	"INSERT INTO account_login_tokens(token, user_id, token_expires_at_ms) VALUES ($1, $2, $3)"
+
+const selectLoginTokenSQL = "" +
+	"SELECT user_id, token_expires_at_ms FROM account_login_tokens WHERE token = $1"
+
+const deleteLoginTokenSQL = "" +
+	"DELETE FROM account_login_tokens WHERE token = $1"
+
+const deleteExpiredLoginTokensSQL = "" +
+	"DELETE FROM account_login_tokens WHERE token_expires_at_ms <= $1"
+
+type loginTokenStatements struct {
+	insertLoginTokenStmt         *sql.Stmt
+	selectLoginTokenStmt         *sql.Stmt
+	deleteLoginTokenStmt         *sql.Stmt
+	deleteExpiredLoginTokensStmt *sql.Stmt
+}
+
+func (s *loginTokenStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(loginTokenSchema)
+	if err != nil {
+		return
+	}
+	if s.insertLoginTokenStmt, err = db.Prepare(insertLoginTokenSQL); err != nil {
+		return
+	}
+	if s.selectLoginTokenStmt, err = db.Prepare(selectLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteLoginTokenStmt, err = db.Prepare(deleteLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredLoginTokensStmt, err = db.Prepare(deleteExpiredLoginTokensSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertLoginToken inserts a new login token into the DB. Returns an error if
+// the token already exists.
+func (s *loginTokenStatements) insertLoginToken(
+	ctx context.Context, txn *sql.Tx, token, userID string, expiresAtMS int64,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.insertLoginTokenStmt).ExecContext(ctx, token, userID, expiresAtMS)
+	return
+}
+
+// selectLoginToken returns the user ID and expiry of a login token. Returns
+// sql.ErrNoRows if no token is found.
+func (s *loginTokenStatements) selectLoginToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (userID string, expiresAtMS int64, err error) {
+	err = sqlutil.TxStmt(txn, s.selectLoginTokenStmt).QueryRowContext(ctx, token).Scan(&userID, &expiresAtMS)
+	return
+}
+
+// deleteLoginToken removes a login token from the DB. Returns false if the
+// token didn't exist, e.g. because it was already deleted by someone else.
+func (s *loginTokenStatements) deleteLoginToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteLoginTokenStmt).ExecContext(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// deleteExpiredLoginTokens removes all login tokens which expired at or
+// before the given time.
+func (s *loginTokenStatements) deleteExpiredLoginTokens(
+	ctx context.Context, txn *sql.Tx, nowMS int64,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteExpiredLoginTokensStmt).ExecContext(ctx, nowMS)
+	return
+}
@@ -19,16 +19,18 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/passwords"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts/sqlite3/deltas"
 	"github.com/matrix-org/gomatrixserverlib"
-	"golang.org/x/crypto/bcrypt"
 	// Import the sqlite3 database driver.
 )
 
@@ -38,11 +40,16 @@ type Database struct {
 	writer sqlutil.Writer
 
 	sqlutil.PartitionOffsetStatements
-	accounts     accountsStatements
-	profiles     profilesStatements
-	accountDatas accountDataStatements
-	threepids    threepidStatements
-	serverName   gomatrixserverlib.ServerName
+	accounts          accountsStatements
+	profiles          profilesStatements
+	accountDatas      accountDataStatements
+	threepids         threepidStatements
+	openIDTokens      tokenStatements
+	keyBackupVersions keyBackupVersionStatements
+	keyBackups        keyBackupStatements
+	loginTokens       loginTokenStatements
+	serverName        gomatrixserverlib.ServerName
+	passwordHasher    *passwords.Hasher
 
 	accountsMu     sync.Mutex
 	profilesMu     sync.Mutex
@@ -51,15 +58,19 @@ type Database struct {
 }
 
 // NewDatabase creates a new accounts and profiles database
-func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName) (*Database, error) {
+func NewDatabase(
+	dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName,
+	passwordHashing *config.PasswordHashing,
+) (*Database, error) {
 	db, err := sqlutil.Open(dbProperties)
 	if err != nil {
 		return nil, err
 	}
 	d := &Database{
-		serverName: serverName,
-		db:         db,
-		writer:     sqlutil.NewExclusiveWriter(),
+		serverName:     serverName,
+		db:             db,
+		writer:         sqlutil.ExclusiveWriterForDatabase(dbProperties),
+		passwordHasher: passwords.NewHasher(passwordHashing),
 	}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
@@ -67,8 +78,13 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.accounts.execSchema(db); err != nil {
 		return nil, err
 	}
+	if err = d.threepids.execSchema(db); err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadIsActive(m)
+	deltas.LoadAccountType(m)
+	deltas.LoadThreePIDIDServer(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -89,6 +105,18 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.threepids.prepare(db); err != nil {
 		return nil, err
 	}
+	if err = d.openIDTokens.prepare(db, serverName); err != nil {
+		return nil, err
+	}
+	if err = d.keyBackupVersions.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.keyBackups.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.loginTokens.prepare(db); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -102,7 +130,7 @@ func (d *Database) GetAccountByPassword(
 	if err != nil {
 		return nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintextPassword)); err != nil {
+	if err := passwords.Verify(hash, plaintextPassword); err != nil {
 		return nil, err
 	}
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
@@ -144,12 +172,13 @@ func (d *Database) SetDisplayName(
 func (d *Database) SetPassword(
 	ctx context.Context, localpart, plaintextPassword string,
 ) error {
-	hash, err := hashPassword(plaintextPassword)
+	hash, err := d.passwordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
-	err = d.accounts.updatePassword(ctx, localpart, hash)
-	return err
+	return d.writer.Do(nil, nil, func(txn *sql.Tx) error {
+		return d.accounts.updatePassword(ctx, txn, localpart, hash)
+	})
 }
 
 // CreateGuestAccount makes a new guest account and creates an empty profile
@@ -173,17 +202,17 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", api.AccountTypeGuest)
 		return err
 	})
 	return acc, err
 }
 
-// CreateAccount makes a new account with the given login name and password, and creates an empty profile
-// for this account. If no password is supplied, the account will be a passwordless account. If the
+// CreateAccount makes a new account of the given type with the given login name and password, and creates
+// an empty profile for this account. If no password is supplied, the account will be a passwordless account. If the
 // account already exists, it will return nil, ErrUserExists.
 func (d *Database) CreateAccount(
-	ctx context.Context, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (acc *api.Account, err error) {
 	// Create one account at a time else we can get 'database is locked'.
 	d.profilesMu.Lock()
@@ -193,7 +222,7 @@ func (d *Database) CreateAccount(
 	defer d.accountDatasMu.Unlock()
 	defer d.accountsMu.Unlock()
 	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, accountType)
 		return err
 	})
 	return
@@ -202,13 +231,13 @@ func (d *Database) CreateAccount(
 // WARNING! This function assumes that the relevant mutexes have already
 // been taken out by the caller (e.g. CreateAccount or CreateGuestAccount).
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (*api.Account, error) {
 	var err error
 	// Generate a password hash if this is not a password-less user
 	hash := ""
 	if plaintextPassword != "" {
-		hash, err = hashPassword(plaintextPassword)
+		hash, err = d.passwordHasher.Hash(plaintextPassword)
 		if err != nil {
 			return nil, err
 		}
@@ -231,7 +260,7 @@ func (d *Database) createAccount(
 	}`)); err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, accountType)
 }
 
 // SaveAccountData saves new account data for a given user and a given room.
@@ -279,21 +308,17 @@ func (d *Database) GetNewNumericLocalpart(
 	return d.accounts.selectNewNumericLocalpart(ctx, nil)
 }
 
-func hashPassword(plaintext string) (hash string, err error) {
-	hashBytes, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
-	return string(hashBytes), err
-}
-
 // Err3PIDInUse is the error returned when trying to save an association involving
 // a third-party identifier which is already associated to a local user.
 var Err3PIDInUse = errors.New("This third-party identifier is already in use")
 
 // SaveThreePIDAssociation saves the association between a third party identifier
-// and a local Matrix user (identified by the user's ID's local part).
+// and a local Matrix user (identified by the user's ID's local part), along with
+// the identity server that it was bound to, if any.
 // If the third-party identifier is already part of an association, returns Err3PIDInUse.
 // Returns an error if there was a problem talking to the database.
 func (d *Database) SaveThreePIDAssociation(
-	ctx context.Context, threepid, localpart, medium string,
+	ctx context.Context, threepid, localpart, medium, idServer string,
 ) (err error) {
 	d.threepidsMu.Lock()
 	defer d.threepidsMu.Unlock()
@@ -309,7 +334,7 @@ func (d *Database) SaveThreePIDAssociation(
 			return Err3PIDInUse
 		}
 
-		return d.threepids.insertThreePID(ctx, txn, threepid, medium, localpart)
+		return d.threepids.insertThreePID(ctx, txn, threepid, medium, localpart, idServer)
 	})
 }
 
@@ -376,5 +401,193 @@ func (d *Database) SearchProfiles(ctx context.Context, searchString string, limi
 
 // DeactivateAccount deactivates the user's account, removing all ability for the user to login again.
 func (d *Database) DeactivateAccount(ctx context.Context, localpart string) (err error) {
-	return d.accounts.deactivateAccount(ctx, localpart)
+	return d.writer.Do(nil, nil, func(txn *sql.Tx) error {
+		return d.accounts.deactivateAccount(ctx, txn, localpart)
+	})
+}
+
+// CreateOpenIDToken persists a new OpenID token
+func (d *Database) CreateOpenIDToken(
+	ctx context.Context,
+	token, localpart string,
+	expiresAtMS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.openIDTokens.insertToken(ctx, txn, token, localpart, expiresAtMS)
+	})
+}
+
+// GetOpenIDTokenAttributes gets the attributes of an issued OpenID token.
+// Returns sql.ErrNoRows if the token doesn't exist.
+func (d *Database) GetOpenIDTokenAttributes(
+	ctx context.Context,
+	token string,
+) (*api.OpenIDTokenAttributes, error) {
+	return d.openIDTokens.selectOpenIDTokenAttributes(ctx, token)
+}
+
+// CreateLoginToken persists a new single-use login token, pruning any
+// login tokens which have already expired.
+func (d *Database) CreateLoginToken(
+	ctx context.Context, token, userID string, expiresAtMS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err := d.loginTokens.deleteExpiredLoginTokens(ctx, txn, time.Now().UnixNano()/int64(time.Millisecond)); err != nil {
+			return fmt.Errorf("d.loginTokens.deleteExpiredLoginTokens: %w", err)
+		}
+		return d.loginTokens.insertLoginToken(ctx, txn, token, userID, expiresAtMS)
+	})
+}
+
+// ConsumeLoginToken deletes a login token, returning the user ID it was
+// issued to. Returns sql.ErrNoRows if the token doesn't exist or has expired,
+// so that each token can only be used once.
+func (d *Database) ConsumeLoginToken(
+	ctx context.Context, token string,
+) (userID string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		var expiresAtMS int64
+		userID, expiresAtMS, err = d.loginTokens.selectLoginToken(ctx, txn, token)
+		if err != nil {
+			return err
+		}
+		var deleted bool
+		if deleted, err = d.loginTokens.deleteLoginToken(ctx, txn, token); err != nil {
+			return fmt.Errorf("d.loginTokens.deleteLoginToken: %w", err)
+		}
+		// if someone else deleted the token first then they've used it
+		if !deleted || expiresAtMS <= time.Now().UnixNano()/int64(time.Millisecond) {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// CreateKeyBackup creates a new key backup version for the user, returning
+// the new version.
+func (d *Database) CreateKeyBackup(
+	ctx context.Context, userID, algorithm string, authData json.RawMessage,
+) (version string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		version, err = d.keyBackupVersions.insertKeyBackup(ctx, txn, userID, algorithm, authData, "")
+		return err
+	})
+	return
+}
+
+// UpdateKeyBackupAuthData replaces the auth_data of an existing key backup version.
+func (d *Database) UpdateKeyBackupAuthData(
+	ctx context.Context, userID, version string, authData json.RawMessage,
+) (err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.keyBackupVersions.updateKeyBackupAuthData(ctx, txn, userID, version, authData)
+	})
+	return
+}
+
+// DeleteKeyBackup marks a key backup version as deleted. Returns false if
+// there was no such version.
+func (d *Database) DeleteKeyBackup(
+	ctx context.Context, userID, version string,
+) (exists bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		exists, err = d.keyBackupVersions.deleteKeyBackup(ctx, txn, userID, version)
+		return err
+	})
+	return
+}
+
+// GetKeyBackup returns the given key backup version, or the latest version
+// if version is empty. Returns sql.ErrNoRows if there is no such version.
+func (d *Database) GetKeyBackup(
+	ctx context.Context, userID, version string,
+) (versionResult, algorithm string, authData json.RawMessage, etag string, deleted bool, err error) {
+	versionResult, algorithm, authData, etag, deleted, err = d.keyBackupVersions.selectKeyBackup(ctx, nil, userID, version)
+	return
+}
+
+// GetBackupKeys returns the keys stored in a key backup version, optionally
+// filtered by room ID and session ID, as a map of room ID -> session ID -> session.
+func (d *Database) GetBackupKeys(
+	ctx context.Context, version, userID, filterRoomID, filterSessionID string,
+) (result map[string]map[string]api.KeyBackupSession, err error) {
+	switch {
+	case filterSessionID != "":
+		return d.keyBackups.selectKeysByRoomIDAndSessionID(ctx, nil, userID, version, filterRoomID, filterSessionID)
+	case filterRoomID != "":
+		return d.keyBackups.selectKeysByRoomID(ctx, nil, userID, version, filterRoomID)
+	default:
+		return d.keyBackups.selectKeys(ctx, nil, userID, version)
+	}
+}
+
+// CountBackupKeys returns the number of keys stored in a key backup version.
+func (d *Database) CountBackupKeys(
+	ctx context.Context, version, userID string,
+) (count int64, err error) {
+	return d.keyBackups.countKeys(ctx, nil, userID, version)
+}
+
+// UpsertBackupKeys stores the uploaded keys in a key backup version,
+// replacing existing keys only where the spec says the new key is better.
+// The etag of the version is bumped if any keys changed. Returns the new
+// key count and etag.
+func (d *Database) UpsertBackupKeys(
+	ctx context.Context, version, userID string, uploads []api.InternalKeyBackupSession,
+) (count int64, etag string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		var oldETag string
+		_, _, _, oldETag, _, err = d.keyBackupVersions.selectKeyBackup(ctx, txn, userID, version)
+		if err != nil {
+			return err
+		}
+		etag = oldETag
+		changed := false
+		for _, newKey := range uploads {
+			var existingKeys map[string]map[string]api.KeyBackupSession
+			existingKeys, err = d.keyBackups.selectKeysByRoomIDAndSessionID(ctx, txn, userID, version, newKey.RoomID, newKey.SessionID)
+			if err != nil {
+				return err
+			}
+			if existingRoom := existingKeys[newKey.RoomID]; existingRoom != nil {
+				if existingKey, ok := existingRoom[newKey.SessionID]; ok {
+					if existingKey.ShouldReplaceRoomKey(&newKey.KeyBackupSession) {
+						if err = d.keyBackups.updateBackupKey(ctx, txn, userID, version, newKey); err != nil {
+							return fmt.Errorf("d.keyBackups.updateBackupKey: %w", err)
+						}
+						changed = true
+					}
+					continue
+				}
+			}
+			if err = d.keyBackups.insertBackupKey(ctx, txn, userID, version, newKey); err != nil {
+				return fmt.Errorf("d.keyBackups.insertBackupKey: %w", err)
+			}
+			changed = true
+		}
+		count, err = d.keyBackups.countKeys(ctx, txn, userID, version)
+		if err != nil {
+			return err
+		}
+		if changed {
+			// update the etag
+			var newETag int
+			if oldETag != "" {
+				newETag, err = strconv.Atoi(oldETag)
+				if err != nil {
+					return fmt.Errorf("failed to parse old etag: %s", err)
+				}
+			}
+			etag = strconv.Itoa(newETag + 1)
+			if err = d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version, etag); err != nil {
+				return fmt.Errorf("updateKeyBackupETag: %w", err)
+			}
+		}
+		return nil
+	})
+	return
 }
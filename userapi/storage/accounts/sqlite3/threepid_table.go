@@ -33,6 +33,8 @@ CREATE TABLE IF NOT EXISTS account_threepid (
 	medium TEXT NOT NULL DEFAULT 'email',
 	-- The localpart of the Matrix user ID associated to this 3PID
 	localpart TEXT NOT NULL,
+	-- The identity server that the 3PID was bound to, if it was bound to one
+	id_server TEXT NOT NULL DEFAULT '',
 
 	PRIMARY KEY(threepid, medium)
 );
@@ -44,10 +46,10 @@ const selectLocalpartForThreePIDSQL = "" +
 	"SELECT localpart FROM account_threepid WHERE threepid = $1 AND medium = $2"
 
 const selectThreePIDsForLocalpartSQL = "" +
-	"SELECT threepid, medium FROM account_threepid WHERE localpart = $1"
+	"SELECT threepid, medium, id_server FROM account_threepid WHERE localpart = $1"
 
 const insertThreePIDSQL = "" +
-	"INSERT INTO account_threepid (threepid, medium, localpart) VALUES ($1, $2, $3)"
+	"INSERT INTO account_threepid (threepid, medium, localpart, id_server) VALUES ($1, $2, $3, $4)"
 
 const deleteThreePIDSQL = "" +
 	"DELETE FROM account_threepid WHERE threepid = $1 AND medium = $2"
@@ -60,12 +62,13 @@ type threepidStatements struct {
 	deleteThreePIDStmt              *sql.Stmt
 }
 
+func (s *threepidStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(threepidSchema)
+	return err
+}
+
 func (s *threepidStatements) prepare(db *sql.DB) (err error) {
 	s.db = db
-	_, err = db.Exec(threepidSchema)
-	if err != nil {
-		return
-	}
 	if s.selectLocalpartForThreePIDStmt, err = db.Prepare(selectLocalpartForThreePIDSQL); err != nil {
 		return
 	}
@@ -106,22 +109,24 @@ func (s *threepidStatements) selectThreePIDsForLocalpart(
 	for rows.Next() {
 		var threepid string
 		var medium string
-		if err = rows.Scan(&threepid, &medium); err != nil {
+		var idServer string
+		if err = rows.Scan(&threepid, &medium, &idServer); err != nil {
 			return
 		}
 		threepids = append(threepids, authtypes.ThreePID{
-			Address: threepid,
-			Medium:  medium,
+			Address:  threepid,
+			Medium:   medium,
+			IDServer: idServer,
 		})
 	}
 	return threepids, rows.Err()
 }
 
 func (s *threepidStatements) insertThreePID(
-	ctx context.Context, txn *sql.Tx, threepid, medium, localpart string,
+	ctx context.Context, txn *sql.Tx, threepid, medium, localpart, idServer string,
 ) (err error) {
 	stmt := sqlutil.TxStmt(txn, s.insertThreePIDStmt)
-	_, err = stmt.ExecContext(ctx, threepid, medium, localpart)
+	_, err = stmt.ExecContext(ctx, threepid, medium, localpart, idServer)
 	return err
 }
 
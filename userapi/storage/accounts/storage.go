@@ -26,13 +26,17 @@ import (
 )
 
 // NewDatabase opens a new Postgres or Sqlite database (based on dataSourceName scheme)
-// and sets postgres connection parameters
-func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName) (Database, error) {
+// and sets postgres connection parameters. New password hashes are made as set by
+// passwordHashing, or with the default scheme if it is nil.
+func NewDatabase(
+	dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName,
+	passwordHashing *config.PasswordHashing,
+) (Database, error) {
 	switch {
 	case dbProperties.ConnectionString.IsSQLite():
-		return sqlite3.NewDatabase(dbProperties, serverName)
+		return sqlite3.NewDatabase(dbProperties, serverName, passwordHashing)
 	case dbProperties.ConnectionString.IsPostgres():
-		return postgres.NewDatabase(dbProperties, serverName)
+		return postgres.NewDatabase(dbProperties, serverName, passwordHashing)
 	default:
 		return nil, fmt.Errorf("unexpected database type")
 	}
@@ -45,7 +45,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err != nil {
 		return nil, err
 	}
-	writer := sqlutil.NewExclusiveWriter()
+	writer := sqlutil.ExclusiveWriterForDatabase(dbProperties)
 	d := devicesStatements{}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
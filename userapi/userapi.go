@@ -16,9 +16,13 @@ package userapi
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/caching"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/kafka"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/consumers"
 	"github.com/matrix-org/dendrite/userapi/internal"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -36,6 +40,7 @@ func AddInternalRoutes(router *mux.Router, intAPI api.UserInternalAPI) {
 // can call functions directly on the returned API or via an HTTP interface using AddInternalRoutes.
 func NewInternalAPI(
 	accountDB accounts.Database, cfg *config.UserAPI, appServices []config.ApplicationService, keyAPI keyapi.KeyInternalAPI,
+	rsAPI rsapi.RoomserverInternalAPI, caches caching.AccountTypeCache,
 ) api.UserInternalAPI {
 
 	deviceDB, err := devices.NewDatabase(&cfg.DeviceDatabase, cfg.Matrix.ServerName)
@@ -49,5 +54,26 @@ func NewInternalAPI(
 		ServerName:  cfg.Matrix.ServerName,
 		AppServices: appServices,
 		KeyAPI:      keyAPI,
+		RSAPI:       rsAPI,
+
+		OpenIDTokenLifetimeMS: cfg.OpenIDTokenLifetimeMS,
+		LoginTokenLifetimeMS:  cfg.LoginTokenLifetimeMS,
+		AutoJoinRooms:         cfg.AutoJoinRooms,
+		MaxDevicesPerUser:     cfg.MaxDevicesPerUser,
+		DeviceLimitStrategy:   cfg.DeviceLimitStrategy,
+		AccountTypes:          caches,
+	}
+}
+
+// StartConsumers starts consuming from the roomserver, so that invites can be
+// accepted automatically for users who have asked for that.
+func StartConsumers(
+	accountDB accounts.Database, cfg *config.UserAPI, rsAPI rsapi.RoomserverInternalAPI,
+) {
+	consumer, _ := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
+
+	rsConsumer := consumers.NewOutputRoomEventConsumer(cfg, consumer, accountDB, rsAPI)
+	if err := rsConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start roomserver consumer")
 	}
 }
@@ -2,19 +2,30 @@ package userapi_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/test"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/internal"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -25,7 +36,7 @@ const (
 func MustMakeInternalAPI(t *testing.T) (api.UserInternalAPI, accounts.Database) {
 	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: "file::memory:",
-	}, serverName)
+	}, serverName, nil)
 	if err != nil {
 		t.Fatalf("failed to create account DB: %s", err)
 	}
@@ -38,16 +49,28 @@ func MustMakeInternalAPI(t *testing.T) (api.UserInternalAPI, accounts.Database)
 		Matrix: &config.Global{
 			ServerName: serverName,
 		},
+		OpenIDTokenLifetimeMS: config.DefaultOpenIDTokenLifetimeMS,
+		LoginTokenLifetimeMS:  config.DefaultLoginTokenLifetimeMS,
 	}
 
-	return userapi.NewInternalAPI(accountDB, cfg, nil, nil), accountDB
+	return userapi.NewInternalAPI(accountDB, cfg, nil, nil, nil, mustCreateCache(t)), accountDB
+}
+
+// mustCreateCache returns an in-memory cache with the default sizes.
+func mustCreateCache(t *testing.T) *caching.Caches {
+	t.Helper()
+	cache, err := caching.NewInMemoryLRUCache(nil, false)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	return cache
 }
 
 func TestQueryProfile(t *testing.T) {
 	aliceAvatarURL := "mxc://example.com/alice"
 	aliceDisplayName := "Alice"
 	userAPI, accountDB := MustMakeInternalAPI(t)
-	_, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "")
+	_, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "", api.AccountTypeUser)
 	if err != nil {
 		t.Fatalf("failed to make account: %s", err)
 	}
@@ -118,3 +141,684 @@ func TestQueryProfile(t *testing.T) {
 		runCases(userAPI)
 	})
 }
+
+func TestOpenIDToken(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	_, err := accountDB.CreateAccount(context.TODO(), "alice", "foobar", "", api.AccountTypeUser)
+	if err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	aliceUserID := fmt.Sprintf("@alice:%s", serverName)
+
+	// an expired token should never resolve back to the user
+	expiredToken := "expired_token"
+	expiredAtMS := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	if err = accountDB.CreateOpenIDToken(context.TODO(), expiredToken, "alice", expiredAtMS); err != nil {
+		t.Fatalf("failed to create expired token: %s", err)
+	}
+
+	runCases := func(testAPI api.UserInternalAPI) {
+		var createRes api.PerformOpenIDTokenCreationResponse
+		err := testAPI.PerformOpenIDTokenCreation(context.TODO(), &api.PerformOpenIDTokenCreationRequest{
+			UserID: aliceUserID,
+		}, &createRes)
+		if err != nil {
+			t.Fatalf("PerformOpenIDTokenCreation failed: %s", err)
+		}
+		if createRes.Token.Token == "" || createRes.Token.UserID != aliceUserID {
+			t.Fatalf("PerformOpenIDTokenCreation returned unexpected token %+v", createRes.Token)
+		}
+		lifetime := time.Duration(createRes.Token.ExpiresAtMS)*time.Millisecond - time.Duration(time.Now().UnixNano())
+		if lifetime <= 0 || lifetime > config.DefaultOpenIDTokenLifetimeMS*time.Millisecond {
+			t.Errorf("PerformOpenIDTokenCreation returned token with unexpected lifetime %s", lifetime)
+		}
+
+		testCases := []struct {
+			token   string
+			wantSub string
+		}{
+			{createRes.Token.Token, aliceUserID},
+			{expiredToken, ""},
+			{"unknown_token", ""},
+		}
+		for _, tc := range testCases {
+			var queryRes api.QueryOpenIDTokenResponse
+			if err := testAPI.QueryOpenIDToken(context.TODO(), &api.QueryOpenIDTokenRequest{
+				Token: tc.token,
+			}, &queryRes); err != nil {
+				t.Errorf("QueryOpenIDToken(%s) failed: %s", tc.token, err)
+				continue
+			}
+			if queryRes.Sub != tc.wantSub {
+				t.Errorf("QueryOpenIDToken(%s) got sub %q want %q", tc.token, queryRes.Sub, tc.wantSub)
+			}
+		}
+
+		// tokens can't be created for remote users
+		err = testAPI.PerformOpenIDTokenCreation(context.TODO(), &api.PerformOpenIDTokenCreationRequest{
+			UserID: "@alice:wrongdomain.com",
+		}, &createRes)
+		if err == nil {
+			t.Errorf("PerformOpenIDTokenCreation succeeded for a remote user")
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runCases(userAPI)
+	})
+}
+
+func TestKeyBackup(t *testing.T) {
+	userAPI, _ := MustMakeInternalAPI(t)
+	aliceUserID := fmt.Sprintf("@alice:%s", serverName)
+	authData := json.RawMessage(`{"public_key":"abcdefg"}`)
+
+	runCases := func(testAPI api.UserInternalAPI) {
+		var createRes api.PerformKeyBackupResponse
+		if err := testAPI.PerformKeyBackup(context.TODO(), &api.PerformKeyBackupRequest{
+			UserID:    aliceUserID,
+			Algorithm: "m.megolm_backup.v1.curve25519-aes-sha2",
+			AuthData:  authData,
+		}, &createRes); err != nil || createRes.Error != "" {
+			t.Fatalf("PerformKeyBackup create failed: %v %s", err, createRes.Error)
+		}
+		version := createRes.Version
+		if !createRes.Exists || version == "" {
+			t.Fatalf("PerformKeyBackup didn't create a version: %+v", createRes)
+		}
+
+		query := func() api.QueryKeyBackupResponse {
+			var queryRes api.QueryKeyBackupResponse
+			if err := testAPI.QueryKeyBackup(context.TODO(), &api.QueryKeyBackupRequest{
+				UserID:     aliceUserID,
+				ReturnKeys: true,
+			}, &queryRes); err != nil || queryRes.Error != "" {
+				t.Fatalf("QueryKeyBackup failed: %v %s", err, queryRes.Error)
+			}
+			return queryRes
+		}
+		latest := query()
+		if !latest.Exists || latest.Version != version || latest.Count != 0 || string(latest.AuthData) != string(authData) {
+			t.Fatalf("QueryKeyBackup returned unexpected latest version: %+v", latest)
+		}
+
+		upload := func(uploadVersion string, keys ...api.InternalKeyBackupSession) api.PerformKeyBackupResponse {
+			var uploadRes api.PerformKeyBackupResponse
+			if err := testAPI.PerformKeyBackup(context.TODO(), &api.PerformKeyBackupRequest{
+				UserID:  aliceUserID,
+				Version: uploadVersion,
+				Keys:    keys,
+			}, &uploadRes); err != nil || uploadRes.Error != "" {
+				t.Fatalf("PerformKeyBackup upload failed: %v %s", err, uploadRes.Error)
+			}
+			return uploadRes
+		}
+		key := api.InternalKeyBackupSession{
+			RoomID:    "!room:" + string(serverName),
+			SessionID: "session",
+			KeyBackupSession: api.KeyBackupSession{
+				FirstMessageIndex: 10,
+				ForwardedCount:    1,
+				SessionData:       json.RawMessage(`{"ciphertext":"first"}`),
+			},
+		}
+		first := upload(version, key)
+		if first.KeyCount != 1 || first.KeyETag == "" {
+			t.Fatalf("uploading a key returned count %d etag %q", first.KeyCount, first.KeyETag)
+		}
+
+		// a worse key shouldn't replace the existing one or change the etag
+		worse := key
+		worse.FirstMessageIndex = 20
+		worse.SessionData = json.RawMessage(`{"ciphertext":"worse"}`)
+		if res := upload(version, worse); res.KeyCount != 1 || res.KeyETag != first.KeyETag {
+			t.Errorf("uploading a worse key returned count %d etag %q, want 1 %q", res.KeyCount, res.KeyETag, first.KeyETag)
+		}
+
+		// a better key should replace it and change the etag
+		better := key
+		better.IsVerified = true
+		better.SessionData = json.RawMessage(`{"ciphertext":"better"}`)
+		second := upload(version, better)
+		if second.KeyCount != 1 || second.KeyETag == first.KeyETag {
+			t.Errorf("uploading a better key returned count %d etag %q, want 1 and not %q", second.KeyCount, second.KeyETag, first.KeyETag)
+		}
+		// as should a new session
+		another := key
+		another.SessionID = "another_session"
+		third := upload(version, another)
+		if third.KeyCount != 2 || third.KeyETag == second.KeyETag {
+			t.Errorf("uploading a new session returned count %d etag %q, want 2 and not %q", third.KeyCount, third.KeyETag, second.KeyETag)
+		}
+
+		latest = query()
+		if latest.Count != 2 || latest.ETag != third.KeyETag {
+			t.Errorf("QueryKeyBackup returned count %d etag %q, want 2 %q", latest.Count, latest.ETag, third.KeyETag)
+		}
+		if got := latest.Keys[key.RoomID][key.SessionID]; string(got.SessionData) != string(better.SessionData) {
+			t.Errorf("QueryKeyBackup returned session data %s, want %s", got.SessionData, better.SessionData)
+		}
+
+		// once there is a newer version, uploads to the old one are rejected
+		var newRes api.PerformKeyBackupResponse
+		if err := testAPI.PerformKeyBackup(context.TODO(), &api.PerformKeyBackupRequest{
+			UserID:    aliceUserID,
+			Algorithm: "m.megolm_backup.v1.curve25519-aes-sha2",
+			AuthData:  authData,
+		}, &newRes); err != nil || newRes.Error != "" {
+			t.Fatalf("PerformKeyBackup create failed: %v %s", err, newRes.Error)
+		}
+		if res := upload(version, key); !res.WrongVersion || res.Version != newRes.Version {
+			t.Errorf("uploading to an old version returned %+v, want wrong version %s", res, newRes.Version)
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runCases(userAPI)
+	})
+}
+
+func TestKeyBackupReplacementRules(t *testing.T) {
+	_, accountDB := MustMakeInternalAPI(t)
+	aliceUserID := fmt.Sprintf("@alice:%s", serverName)
+	roomID := "!room:" + string(serverName)
+
+	existing := api.KeyBackupSession{
+		FirstMessageIndex: 10,
+		ForwardedCount:    5,
+		IsVerified:        false,
+		SessionData:       json.RawMessage(`"existing"`),
+	}
+	testCases := []struct {
+		name        string
+		existing    api.KeyBackupSession
+		upload      api.KeyBackupSession
+		wantReplace bool
+	}{
+		{"verified replaces unverified", existing, api.KeyBackupSession{FirstMessageIndex: 100, ForwardedCount: 100, IsVerified: true}, true},
+		{"unverified doesn't replace verified", api.KeyBackupSession{FirstMessageIndex: 10, ForwardedCount: 5, IsVerified: true}, api.KeyBackupSession{FirstMessageIndex: 0, ForwardedCount: 0}, false},
+		{"lower first_message_index replaces", existing, api.KeyBackupSession{FirstMessageIndex: 9, ForwardedCount: 100}, true},
+		{"higher first_message_index doesn't replace", existing, api.KeyBackupSession{FirstMessageIndex: 11, ForwardedCount: 0}, false},
+		{"lower forwarded_count replaces", existing, api.KeyBackupSession{FirstMessageIndex: 10, ForwardedCount: 4}, true},
+		{"higher forwarded_count doesn't replace", existing, api.KeyBackupSession{FirstMessageIndex: 10, ForwardedCount: 6}, false},
+		{"identical key doesn't replace", existing, api.KeyBackupSession{FirstMessageIndex: 10, ForwardedCount: 5}, false},
+	}
+	for i, tc := range testCases {
+		version, err := accountDB.CreateKeyBackup(context.TODO(), aliceUserID, "m.megolm_backup.v1.curve25519-aes-sha2", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatalf("CreateKeyBackup failed: %s", err)
+		}
+		sessionID := fmt.Sprintf("session%d", i)
+		tc.existing.SessionData = json.RawMessage(`"existing"`)
+		tc.upload.SessionData = json.RawMessage(`"upload"`)
+		_, oldETag, err := accountDB.UpsertBackupKeys(context.TODO(), version, aliceUserID, []api.InternalKeyBackupSession{
+			{RoomID: roomID, SessionID: sessionID, KeyBackupSession: tc.existing},
+		})
+		if err != nil {
+			t.Fatalf("%s: UpsertBackupKeys failed: %s", tc.name, err)
+		}
+		count, newETag, err := accountDB.UpsertBackupKeys(context.TODO(), version, aliceUserID, []api.InternalKeyBackupSession{
+			{RoomID: roomID, SessionID: sessionID, KeyBackupSession: tc.upload},
+		})
+		if err != nil {
+			t.Fatalf("%s: UpsertBackupKeys failed: %s", tc.name, err)
+		}
+		if count != 1 {
+			t.Errorf("%s: got key count %d, want 1", tc.name, count)
+		}
+		if changed := newETag != oldETag; changed != tc.wantReplace {
+			t.Errorf("%s: etag changed %v, want %v", tc.name, changed, tc.wantReplace)
+		}
+		keys, err := accountDB.GetBackupKeys(context.TODO(), version, aliceUserID, roomID, sessionID)
+		if err != nil {
+			t.Fatalf("%s: GetBackupKeys failed: %s", tc.name, err)
+		}
+		want := tc.existing
+		if tc.wantReplace {
+			want = tc.upload
+		}
+		if got := keys[roomID][sessionID]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got stored key %+v, want %+v", tc.name, got, want)
+		}
+	}
+}
+
+func TestLoginToken(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	aliceUserID := fmt.Sprintf("@alice:%s", serverName)
+
+	// an expired token should never resolve back to the user
+	expiredToken := "expired_login_token"
+	expiredAtMS := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	if err := accountDB.CreateLoginToken(context.TODO(), expiredToken, aliceUserID, expiredAtMS); err != nil {
+		t.Fatalf("failed to create expired token: %s", err)
+	}
+
+	runCases := func(testAPI api.UserInternalAPI) {
+		var createRes api.PerformLoginTokenCreationResponse
+		if err := testAPI.PerformLoginTokenCreation(context.TODO(), &api.PerformLoginTokenCreationRequest{
+			UserID: aliceUserID,
+		}, &createRes); err != nil {
+			t.Fatalf("PerformLoginTokenCreation failed: %s", err)
+		}
+		lifetime := time.Duration(createRes.ExpiresAtMS)*time.Millisecond - time.Duration(time.Now().UnixNano())
+		if createRes.Token == "" || lifetime <= 0 || lifetime > config.DefaultLoginTokenLifetimeMS*time.Millisecond {
+			t.Fatalf("PerformLoginTokenCreation returned unexpected token %+v", createRes)
+		}
+
+		consume := func(token string) string {
+			var res api.PerformLoginTokenConsumptionResponse
+			if err := testAPI.PerformLoginTokenConsumption(context.TODO(), &api.PerformLoginTokenConsumptionRequest{
+				Token: token,
+			}, &res); err != nil {
+				t.Fatalf("PerformLoginTokenConsumption(%s) failed: %s", token, err)
+			}
+			return res.UserID
+		}
+		if got := consume(createRes.Token); got != aliceUserID {
+			t.Errorf("consuming a valid token returned user %q want %q", got, aliceUserID)
+		}
+		if got := consume(createRes.Token); got != "" {
+			t.Errorf("consuming a token twice returned user %q", got)
+		}
+		if got := consume(expiredToken); got != "" {
+			t.Errorf("consuming an expired token returned user %q", got)
+		}
+		if got := consume("unknown_token"); got != "" {
+			t.Errorf("consuming an unknown token returned user %q", got)
+		}
+
+		// tokens can't be created for remote users
+		if err := testAPI.PerformLoginTokenCreation(context.TODO(), &api.PerformLoginTokenCreationRequest{
+			UserID: "@alice:wrongdomain.com",
+		}, &createRes); err == nil {
+			t.Errorf("PerformLoginTokenCreation succeeded for a remote user")
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runCases(userAPI)
+	})
+}
+
+type joinRecordingRoomserverAPI struct {
+	rsapi.RoomserverInternalAPI
+	joins map[string][]string // user ID -> rooms
+}
+
+func (r *joinRecordingRoomserverAPI) PerformJoin(ctx context.Context, req *rsapi.PerformJoinRequest, res *rsapi.PerformJoinResponse) {
+	if req.RoomIDOrAlias == "#broken:example.com" {
+		res.Error = &rsapi.PerformError{
+			Code: rsapi.PerformErrorNoRoom,
+			Msg:  "room does not exist",
+		}
+		return
+	}
+	r.joins[req.UserID] = append(r.joins[req.UserID], req.RoomIDOrAlias)
+	res.RoomID = req.RoomIDOrAlias
+}
+
+func TestQueryAccessTokenCachesAccountType(t *testing.T) {
+	ctx := context.TODO()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "alice", "alicepassword", "", api.AccountTypeGuest); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	cache := mustCreateCache(t)
+	userAPI := userapi.NewInternalAPI(accountDB, &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: serverName,
+		},
+	}, nil, &nopKeyAPI{}, nil, cache)
+	var devRes api.PerformDeviceCreationResponse
+	if err = userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   "alice",
+		AccessToken: "alice_token",
+	}, &devRes); err != nil {
+		t.Fatalf("failed to create device: %s", err)
+	}
+
+	queryAccountType := func() api.AccountType {
+		t.Helper()
+		var res api.QueryAccessTokenResponse
+		if err = userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "alice_token"}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		if res.Device == nil {
+			t.Fatalf("QueryAccessToken didn't find the device")
+		}
+		return res.Device.AccountType
+	}
+	if got := queryAccountType(); got != api.AccountTypeGuest {
+		t.Fatalf("got account type %d, want %d", got, api.AccountTypeGuest)
+	}
+	if got, ok := cache.GetAccountType("alice"); !ok || got != api.AccountTypeGuest {
+		t.Fatalf("expected the account type to be cached, got %d (ok %v)", got, ok)
+	}
+
+	// A second lookup is answered from the cache and should agree.
+	if got := queryAccountType(); got != api.AccountTypeGuest {
+		t.Fatalf("got account type %d from the cache, want %d", got, api.AccountTypeGuest)
+	}
+}
+
+func TestAutoJoinRooms(t *testing.T) {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, nil)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	rsAPI := &joinRecordingRoomserverAPI{joins: map[string][]string{}}
+	userAPI := userapi.NewInternalAPI(accountDB, &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: serverName,
+		},
+		AutoJoinRooms: []string{"!welcome:example.com", "#broken:example.com", "#general:example.com"},
+	}, nil, nil, rsAPI, mustCreateCache(t))
+
+	create := func(req *api.PerformAccountCreationRequest) *api.Account {
+		var res api.PerformAccountCreationResponse
+		if err := userAPI.PerformAccountCreation(context.TODO(), req, &res); err != nil {
+			t.Fatalf("PerformAccountCreation failed: %s", err)
+		}
+		if !res.AccountCreated {
+			t.Fatalf("PerformAccountCreation didn't create an account")
+		}
+		return res.Account
+	}
+
+	// failing to join the broken room shouldn't stop the other joins
+	alice := create(&api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeUser,
+		Localpart:   "alice",
+		Password:    "foobar",
+	})
+	want := []string{"!welcome:example.com", "#general:example.com"}
+	if got := rsAPI.joins[alice.UserID]; !reflect.DeepEqual(got, want) {
+		t.Errorf("new user was joined to %v, want %v", got, want)
+	}
+
+	// application service users are left alone
+	bot := create(&api.PerformAccountCreationRequest{
+		AccountType:  api.AccountTypeUser,
+		Localpart:    "bot",
+		AppServiceID: "some_appservice",
+	})
+	if got := rsAPI.joins[bot.UserID]; len(got) != 0 {
+		t.Errorf("application service user was joined to %v", got)
+	}
+}
+
+func TestPasswordHashingSchemeChange(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "userapi_accounts")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(tmpfile.Name()) // nolint: errcheck
+	dbOpts := &config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	}
+	bcryptHashing := &config.PasswordHashing{Algorithm: config.PasswordHashingBcrypt, BcryptCost: 4}
+	argon2idHashing := &config.PasswordHashing{
+		Algorithm: config.PasswordHashingArgon2id,
+		Argon2id:  config.Argon2idOptions{MemoryKiB: 1024, Iterations: 1, Parallelism: 1},
+	}
+	ctx := context.TODO()
+	open := func(passwordHashing *config.PasswordHashing) accounts.Database {
+		accountDB, openErr := accounts.NewDatabase(dbOpts, serverName, passwordHashing)
+		if openErr != nil {
+			t.Fatalf("failed to open account DB: %s", openErr)
+		}
+		return accountDB
+	}
+	assertPassword := func(accountDB accounts.Database, localpart, password string) {
+		t.Helper()
+		if _, err = accountDB.GetAccountByPassword(ctx, localpart, password); err != nil {
+			t.Errorf("%s: correct password was refused: %s", localpart, err)
+		}
+		if _, err = accountDB.GetAccountByPassword(ctx, localpart, password+"wrong"); err == nil {
+			t.Errorf("%s: wrong password was accepted", localpart)
+		}
+	}
+
+	accountDB := open(bcryptHashing)
+	if _, err = accountDB.CreateAccount(ctx, "alice", "alicepassword", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+
+	// Accounts made with bcrypt still work after switching to argon2id, and
+	// new passwords are hashed with argon2id.
+	accountDB = open(argon2idHashing)
+	assertPassword(accountDB, "alice", "alicepassword")
+	if _, err = accountDB.CreateAccount(ctx, "bob", "bobpassword", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	if err = accountDB.SetPassword(ctx, "alice", "newalicepassword"); err != nil {
+		t.Fatalf("failed to set password: %s", err)
+	}
+	assertPassword(accountDB, "bob", "bobpassword")
+
+	// And the other way around.
+	accountDB = open(bcryptHashing)
+	assertPassword(accountDB, "alice", "newalicepassword")
+	assertPassword(accountDB, "bob", "bobpassword")
+}
+
+type nopKeyAPI struct {
+	keyapi.KeyInternalAPI
+}
+
+func (k *nopKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+}
+
+// slowDeviceDB takes a while to list devices, to widen the window in which
+// another device could be created.
+type slowDeviceDB struct {
+	devices.Database
+}
+
+func (d *slowDeviceDB) GetDevicesByLocalpart(ctx context.Context, localpart string) ([]api.Device, error) {
+	devs, err := d.Database.GetDevicesByLocalpart(ctx, localpart)
+	time.Sleep(10 * time.Millisecond)
+	return devs, err
+}
+
+func TestDeviceLimit(t *testing.T) {
+	ctx := context.TODO()
+	var tmpfiles []string
+	defer func() {
+		for _, name := range tmpfiles {
+			os.Remove(name) // nolint: errcheck
+		}
+	}()
+	makeAPI := func(strategy string) api.UserInternalAPI {
+		accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+			ConnectionString: "file::memory:",
+		}, serverName, nil)
+		if err != nil {
+			t.Fatalf("failed to create account DB: %s", err)
+		}
+		if _, err = accountDB.CreateAccount(ctx, "alice", "alicepassword", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		// Removing devices prepares statements outside of the transaction, so
+		// this needs a database file rather than an in-memory database.
+		tmpfile, err := ioutil.TempFile("", "userapi_devices")
+		if err != nil {
+			t.Fatalf("failed to create temp file: %s", err)
+		}
+		tmpfiles = append(tmpfiles, tmpfile.Name())
+		return userapi.NewInternalAPI(accountDB, &config.UserAPI{
+			DeviceDatabase: config.DatabaseOptions{
+				ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+			},
+			Matrix: &config.Global{
+				ServerName: serverName,
+			},
+			MaxDevicesPerUser:   2,
+			DeviceLimitStrategy: strategy,
+		}, nil, &nopKeyAPI{}, nil, mustCreateCache(t))
+	}
+	createDevice := func(userAPI api.UserInternalAPI, deviceID string) error {
+		var res api.PerformDeviceCreationResponse
+		if err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   "alice",
+			AccessToken: "token_" + deviceID,
+			DeviceID:    &deviceID,
+		}, &res); err != nil {
+			return err
+		}
+		if res.Err != nil {
+			return res.Err
+		}
+		return nil
+	}
+	assertDevices := func(userAPI api.UserInternalAPI, want []string) {
+		t.Helper()
+		var res api.QueryDevicesResponse
+		if err := userAPI.QueryDevices(ctx, &api.QueryDevicesRequest{
+			UserID: fmt.Sprintf("@alice:%s", serverName),
+		}, &res); err != nil {
+			t.Fatalf("failed to query devices: %s", err)
+		}
+		var got []string
+		for _, dev := range res.Devices {
+			got = append(got, dev.ID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got devices %v, want %v", got, want)
+		}
+	}
+
+	// Rejecting new devices beyond the limit, but still allowing existing
+	// devices to log in again.
+	runRejectCases := func(userAPI api.UserInternalAPI) {
+		t.Helper()
+		for _, deviceID := range []string{"one", "two"} {
+			if err := createDevice(userAPI, deviceID); err != nil {
+				t.Fatalf("failed to create device %s: %s", deviceID, err)
+			}
+		}
+		err := createDevice(userAPI, "three")
+		if forbidden, ok := err.(*api.ErrorForbidden); !ok || forbidden.Message == "" {
+			t.Errorf("expected ErrorForbidden creating a third device, got %v", err)
+		}
+		if err = createDevice(userAPI, "two"); err != nil {
+			t.Errorf("failed to replace an existing device: %s", err)
+		}
+		assertDevices(userAPI, []string{"one", "two"})
+	}
+	t.Run("HTTP API", func(t *testing.T) {
+		userAPI := makeAPI(config.DeviceLimitReject)
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runRejectCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runRejectCases(makeAPI(config.DeviceLimitReject))
+	})
+
+	// Concurrent logins can't take the user over the limit between checking
+	// it and creating their devices.
+	userAPI := makeAPI(config.DeviceLimitReject)
+	internalAPI := userAPI.(*internal.UserInternalAPI)
+	internalAPI.DeviceDB = &slowDeviceDB{internalAPI.DeviceDB}
+	var wg sync.WaitGroup
+	for _, deviceID := range []string{"one", "two", "three", "four", "five"} {
+		wg.Add(1)
+		go func(deviceID string) {
+			defer wg.Done()
+			if err := createDevice(userAPI, deviceID); err != nil {
+				if _, ok := err.(*api.ErrorForbidden); !ok {
+					t.Errorf("failed to create device %s: %s", deviceID, err)
+				}
+			}
+		}(deviceID)
+	}
+	wg.Wait()
+	var devRes api.QueryDevicesResponse
+	if err := userAPI.QueryDevices(ctx, &api.QueryDevicesRequest{
+		UserID: fmt.Sprintf("@alice:%s", serverName),
+	}, &devRes); err != nil {
+		t.Fatalf("failed to query devices: %s", err)
+	}
+	if len(devRes.Devices) != 2 {
+		t.Errorf("got %d devices after concurrent logins, want 2", len(devRes.Devices))
+	}
+
+	// Removing the least recently used device to make room for new ones.
+	userAPI = makeAPI(config.DeviceLimitPruneOldest)
+	var err error
+	for _, deviceID := range []string{"one", "two"} {
+		if err = createDevice(userAPI, deviceID); err != nil {
+			t.Fatalf("failed to create device %s: %s", deviceID, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err = userAPI.PerformLastSeenUpdate(ctx, &api.PerformLastSeenUpdateRequest{
+		UserID:   fmt.Sprintf("@alice:%s", serverName),
+		DeviceID: "one",
+	}, &api.PerformLastSeenUpdateResponse{}); err != nil {
+		t.Fatalf("failed to update last seen: %s", err)
+	}
+	if err = createDevice(userAPI, "three"); err != nil {
+		t.Fatalf("failed to create a third device: %s", err)
+	}
+	assertDevices(userAPI, []string{"one", "three"})
+}